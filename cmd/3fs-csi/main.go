@@ -0,0 +1,63 @@
+// Command 3fs-csi is the Container Storage Interface driver, provisioning
+// Kubernetes volumes as directories of a block namespace and mounting them
+// into pods through FUSE. Run it as the controller with no -node-id, and
+// on every node with the node's name as -node-id.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/3fs-storage/internal/csi"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+func main() {
+	endpoint := flag.String("endpoint", "unix:///csi/csi.sock", "Endpoint serving the CSI services, as unix:///path or tcp://host:port")
+	name := flag.String("name", csi.DefaultName, "Driver name, which storage classes give as their provisioner")
+	nodeID := flag.String("node-id", "", "ID of the node, which runs the node service; empty runs only the controller")
+	address := flag.String("addr", "127.0.0.1:7000", "Data address of the storage node holding the volumes")
+	token := flag.String("token", "", "Bearer token, or a secret reference such as env://TOKEN; a token secret of the storage class replaces it")
+	timeout := flag.Duration("timeout", client.DefaultTimeout, "Timeout of the connection and each request")
+	caFile := flag.String("tls-ca", "", "CA certificate verifying the node; enables TLS")
+	certFile := flag.String("tls-cert", "", "Client certificate presented to the node")
+	keyFile := flag.String("tls-key", "", "Private key of the client certificate")
+	stagingDir := flag.String("staging-dir", "", "Directory staging files being written; defaults to the system temporary directory")
+	logLevel := flag.String("log-level", "info", "Log level: debug, info, warn or error")
+	flag.Parse()
+
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		log.Fatalf("Failed to configure logging: %v", err)
+	}
+	opts := client.Options{Timeout: *timeout}
+	if opts.Token, err = config.ResolveSecret(*token); err != nil {
+		log.Fatalf("Failed to read token: %v", err)
+	}
+	if opts.TLS, err = client.LoadTLS(*caFile, *certFile, *keyFile); err != nil {
+		log.Fatal(err)
+	}
+
+	driver, err := csi.New(csi.Options{
+		Name:       *name,
+		NodeID:     *nodeID,
+		Address:    *address,
+		Client:     opts,
+		StagingDir: *stagingDir,
+	}, logger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	if err := driver.Serve(ctx, *endpoint); err != nil {
+		log.Fatal(err)
+	}
+}
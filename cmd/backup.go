@@ -0,0 +1,441 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/3fs-storage/internal/backup"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/s3client"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// s3Flags are the flags reaching the S3 service of s3:// locations
+type s3Flags struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// addS3Flags adds the flags reaching an S3 service to a command's flag set
+func addS3Flags(flags *flag.FlagSet) *s3Flags {
+	f := &s3Flags{}
+	flags.StringVar(&f.endpoint, "s3-endpoint", "", "URL of the S3 service of s3://bucket/key locations")
+	flags.StringVar(&f.region, "s3-region", "us-east-1", "Region of the S3 service")
+	flags.StringVar(&f.accessKey, "s3-access-key", "env://AWS_ACCESS_KEY_ID", "S3 access key, or a secret reference")
+	flags.StringVar(&f.secretKey, "s3-secret-key", "env://AWS_SECRET_ACCESS_KEY", "S3 secret key, or a secret reference")
+	return f
+}
+
+// config returns the S3 configuration the flags describe. The keys are
+// only resolved for s3:// locations, so that files need none.
+func (f *s3Flags) config(locations ...string) (s3client.Config, error) {
+	cfg := s3client.Config{Endpoint: f.endpoint, Region: f.region}
+	for _, location := range locations {
+		if !strings.HasPrefix(location, "s3://") {
+			continue
+		}
+		var err error
+		if cfg.AccessKey, err = config.ResolveSecret(f.accessKey); err != nil {
+			return cfg, fmt.Errorf("failed to read S3 access key: %w", err)
+		}
+		if cfg.SecretKey, err = config.ResolveSecret(f.secretKey); err != nil {
+			return cfg, fmt.Errorf("failed to read S3 secret key: %w", err)
+		}
+		break
+	}
+	return cfg, nil
+}
+
+// backupNode writes the blocks of a node, or of a namespace, to an
+// archive, copying only what changed since -base if it is given, or to a
+// repository, uploading only what changed since its last backup
+func backupNode(_ *options, args []string) error {
+	flags := newFlagSet("backup")
+	node := addClientFlags(flags)
+	s3 := addS3Flags(flags)
+	prefix := flags.String("prefix", "", "Back up only the blocks with IDs starting with this prefix")
+	namespace := flags.String("namespace", "", "Back up only the blocks of a namespace")
+	baseLocation := flags.String("base", "", "Archive of an earlier backup to take an incremental backup against")
+	repository := flags.String("repository", "", "s3://bucket/prefix or directory of a backup repository to back up to instead of an archive")
+	full := flags.Bool("full", false, "With -repository, upload every block rather than those changed since the last backup")
+	freeze := flags.String("freeze", "", "Admin address of the node, put in read-only mode during the backup for a point-in-time snapshot")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	location := *repository
+	switch {
+	case *repository != "":
+		if flags.NArg() != 0 || *baseLocation != "" {
+			flags.Usage()
+			return errors.New("-repository takes no archive or -base")
+		}
+	case flags.NArg() != 1:
+		flags.Usage()
+		return errors.New("backup takes an archive")
+	case *full:
+		return errors.New("-full needs -repository")
+	default:
+		location = flags.Arg(0)
+	}
+	if location == "-" && output.json() {
+		return errors.New("-output json cannot be used when the archive is written to stdout")
+	}
+	if *namespace != "" {
+		if *prefix != "" {
+			return errors.New("-prefix and -namespace cannot both be set")
+		}
+		*prefix = *namespace + api.NamespaceSeparator
+	}
+
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	s3cfg, err := s3.config(location, *baseLocation)
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+
+	var base *backup.Manifest
+	if *baseLocation != "" {
+		r, err := backup.Open(ctx, *baseLocation, s3cfg)
+		if err != nil {
+			return err
+		}
+		base, err = backup.ReadManifest(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read base backup: %w", err)
+		}
+	}
+
+	if *freeze != "" {
+		admin := &adminFlags{address: *freeze, timeout: node.timeout}
+		if err := setReadOnly(admin, true, "backup"); err != nil {
+			return err
+		}
+		defer func() {
+			if err := setReadOnly(admin, false, ""); err != nil {
+				logger.Error("failed to leave read-only mode; disable it through the admin API", "error", err)
+			}
+		}()
+	}
+
+	opts, err := node.options()
+	if err != nil {
+		return err
+	}
+	c, err := client.DialWithOptions(node.address, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if *repository != "" {
+		return backupToRepository(ctx, c, location, s3cfg, backup.RepositoryOptions{Source: node.address, Prefix: *prefix, Full: *full}, output, logger)
+	}
+
+	w, err := backup.Create(ctx, location, s3cfg)
+	if err != nil {
+		return err
+	}
+	manifest, err := backup.Write(ctx, c, w, backup.Options{Source: node.address, Prefix: *prefix, Base: base}, logger)
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	logger.Info("backup complete", "archive", location, "blocks", len(manifest.Blocks),
+		"copied", manifest.Copied, "bytes", manifest.Bytes, "deleted", len(manifest.Deleted), "incremental", manifest.Incremental())
+	if output.json() {
+		return writeJSON(archiveSummary{
+			Archive:     location,
+			Blocks:      len(manifest.Blocks),
+			Copied:      manifest.Copied,
+			Bytes:       manifest.Bytes,
+			Deleted:     len(manifest.Deleted),
+			Incremental: manifest.Incremental(),
+		})
+	}
+	return nil
+}
+
+// backupToRepository backs up a node's blocks to a repository
+func backupToRepository(ctx context.Context, c *client.Client, location string, s3cfg s3client.Config, opts backup.RepositoryOptions, output *outputFormat, logger *slog.Logger) error {
+	repo, err := backup.OpenRepository(location, s3cfg)
+	if err != nil {
+		return err
+	}
+	catalog, err := repo.Backup(ctx, c, opts, logger)
+	if err != nil {
+		return fmt.Errorf("backup failed: %w", err)
+	}
+	if output.json() {
+		return writeJSON(archiveSummary{
+			Archive:     location,
+			Catalog:     catalog.CreatedAt,
+			Blocks:      len(catalog.Blocks),
+			Copied:      catalog.Uploaded,
+			Bytes:       catalog.Bytes,
+			Deleted:     len(catalog.Deleted),
+			Incremental: catalog.Incremental(),
+		})
+	}
+	return nil
+}
+
+// archiveSummary is an archive written or restored, as backup and restore
+// print it with -output json
+type archiveSummary struct {
+	Archive     string `json:"archive"`
+	Catalog     int64  `json:"catalog,omitempty"`
+	Blocks      int    `json:"blocks"`
+	Copied      int    `json:"copied"`
+	Bytes       int64  `json:"bytes"`
+	Deleted     int    `json:"deleted"`
+	Incremental bool   `json:"incremental"`
+	Restored    int    `json:"restored,omitempty"`
+	Verified    bool   `json:"verified,omitempty"`
+}
+
+// setReadOnly enables or disables a node's read-only mode
+func setReadOnly(admin *adminFlags, enabled bool, reason string) error {
+	body := map[string]any{"enabled": enabled, "reason": reason}
+	if _, err := admin.send(http.MethodPut, "/v1/readonly", body); err != nil {
+		return fmt.Errorf("failed to set read-only mode: %w", err)
+	}
+	return nil
+}
+
+// restoreNode writes the blocks of archives to a node: a full backup
+// followed by the incremental backups taken after it, in order. With
+// -repository it restores a backup of a repository instead.
+func restoreNode(_ *options, args []string) error {
+	flags := newFlagSet("restore")
+	node := addClientFlags(flags)
+	s3 := addS3Flags(flags)
+	verifyOnly := flags.Bool("verify-only", false, "Verify the archives without writing to the node")
+	repo := &repositoryRestoreFlags{}
+	flags.StringVar(&repo.location, "repository", "", "s3://bucket/prefix or directory of a backup repository to restore from instead of archives")
+	flags.Int64Var(&repo.catalog, "catalog", 0, "With -repository, the backup to restore; the newest of -prefix by default")
+	flags.StringVar(&repo.prefix, "prefix", "", "With -repository, restore the newest backup of this prefix")
+	flags.StringVar(&repo.namespace, "namespace", "", "With -repository, restore the newest backup of a namespace")
+	flags.StringVar(&repo.cluster, "cluster", "", "Admin addresses of the coordinator replicas of a cluster to restore to along its routing table, comma-separated")
+	flags.StringVar(&repo.progress, "progress", "", "File recording the blocks restored, to resume an interrupted restore")
+	flags.IntVar(&repo.workers, "workers", backup.DefaultRestoreWorkers, "Number of blocks restored at the same time")
+	flags.BoolVar(&repo.dryRun, "dry-run", false, "With -repository, check the backup's catalog and objects without writing")
+	flags.BoolVar(&repo.list, "list", false, "With -repository, list the repository's backups")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if repo.location != "" {
+		if flags.NArg() != 0 || *verifyOnly {
+			flags.Usage()
+			return errors.New("-repository takes no archives or -verify-only")
+		}
+	} else if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("restore takes one or more archives")
+	}
+
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	s3cfg, err := s3.config(append(flags.Args(), repo.location)...)
+	if err != nil {
+		return err
+	}
+	if repo.location != "" {
+		return restoreFromRepository(node, s3cfg, repo, output, logger)
+	}
+	ctx := context.Background()
+
+	var c *client.Client
+	if !*verifyOnly {
+		opts, err := node.options()
+		if err != nil {
+			return err
+		}
+		c, err = client.DialWithOptions(node.address, opts)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+	}
+
+	var previous *backup.Manifest
+	summaries := []archiveSummary{}
+	for i, location := range flags.Args() {
+		r, err := backup.Open(ctx, location, s3cfg)
+		if err != nil {
+			return err
+		}
+		result, err := backup.Restore(ctx, c, r, backup.RestoreOptions{VerifyOnly: *verifyOnly, Base: previous}, logger)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", location, err)
+		}
+		if i == 0 && result.Manifest.Incremental() {
+			logger.Warn("the first archive is incremental; restore its full backup first", "archive", location)
+		}
+		previous = result.Manifest
+		logger.Info("archive processed", "archive", location, "verified", *verifyOnly,
+			"blocks", result.Manifest.Copied, "restored", result.Restored, "deleted", result.Deleted)
+		summaries = append(summaries, archiveSummary{
+			Archive:     location,
+			Blocks:      len(result.Manifest.Blocks),
+			Copied:      result.Manifest.Copied,
+			Bytes:       result.Bytes,
+			Deleted:     result.Deleted,
+			Incremental: result.Manifest.Incremental(),
+			Restored:    result.Restored,
+			Verified:    *verifyOnly,
+		})
+	}
+	if output.json() {
+		return writeJSON(summaries)
+	}
+	return nil
+}
+
+// repositoryRestoreFlags are the flags of a restore from a repository
+type repositoryRestoreFlags struct {
+	location  string
+	catalog   int64
+	prefix    string
+	namespace string
+	cluster   string
+	progress  string
+	workers   int
+	dryRun    bool
+	list      bool
+}
+
+// restoreFromRepository restores a backup of a repository to a node, or
+// to a cluster along its routing table, or lists the repository's backups
+func restoreFromRepository(node *clientFlags, s3cfg s3client.Config, flags *repositoryRestoreFlags, output *outputFormat, logger *slog.Logger) error {
+	if flags.namespace != "" {
+		if flags.prefix != "" {
+			return errors.New("-prefix and -namespace cannot both be set")
+		}
+		flags.prefix = flags.namespace + api.NamespaceSeparator
+	}
+	repo, err := backup.OpenRepository(flags.location, s3cfg)
+	if err != nil {
+		return err
+	}
+	// Stopping finishes the blocks being restored, which the progress file
+	// then records
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if flags.list {
+		return listCatalogs(ctx, repo, output)
+	}
+	var catalog *backup.Catalog
+	if flags.catalog != 0 {
+		catalog, err = repo.ReadCatalog(ctx, flags.catalog)
+	} else if catalog, err = repo.Latest(ctx, flags.prefix); err == nil && catalog == nil {
+		err = fmt.Errorf("the repository holds no backup of prefix %q; list its backups with -list", flags.prefix)
+	}
+	if err != nil {
+		return err
+	}
+
+	opts := backup.RepositoryRestoreOptions{DryRun: flags.dryRun, Workers: flags.workers}
+	var dst backup.Destination
+	clientOpts, err := node.options()
+	if err != nil {
+		return err
+	}
+	if flags.cluster != "" {
+		if opts.Table, err = fetchRouting(ctx, flags.cluster); err != nil {
+			return err
+		}
+		cluster := client.NewCluster(opts.Table, clientOpts, client.ReadTail)
+		defer cluster.Close()
+		dst = cluster
+	} else if !flags.dryRun {
+		c, err := client.DialWithOptions(node.address, clientOpts)
+		if err != nil {
+			return err
+		}
+		defer c.Close()
+		dst = c
+	}
+	if flags.progress != "" && !flags.dryRun {
+		checkpoint, err := backup.OpenCheckpoint(flags.progress)
+		if err != nil {
+			return err
+		}
+		defer checkpoint.Close()
+		opts.Checkpoint = checkpoint
+	}
+
+	result, err := repo.Restore(ctx, dst, catalog, opts, logger)
+	if result != nil && output.json() {
+		if writeErr := writeJSON(result); writeErr != nil {
+			return writeErr
+		}
+	}
+	return err
+}
+
+// catalogSummary is a backup of a repository, as restore -list prints it
+type catalogSummary struct {
+	Catalog     int64  `json:"catalog"`
+	CreatedAt   string `json:"created_at"`
+	Prefix      string `json:"prefix,omitempty"`
+	Blocks      int    `json:"blocks"`
+	Incremental bool   `json:"incremental"`
+}
+
+// listCatalogs prints the backups of a repository, oldest first
+func listCatalogs(ctx context.Context, repo *backup.Repository, output *outputFormat) error {
+	ids, err := repo.Catalogs(ctx)
+	if err != nil {
+		return err
+	}
+	summaries := []catalogSummary{}
+	for _, id := range ids {
+		catalog, err := repo.ReadCatalog(ctx, id)
+		if err != nil {
+			return err
+		}
+		summaries = append(summaries, catalogSummary{
+			Catalog:     id,
+			CreatedAt:   time.Unix(0, catalog.CreatedAt).UTC().Format(time.RFC3339),
+			Prefix:      catalog.Prefix,
+			Blocks:      len(catalog.Blocks),
+			Incremental: catalog.Incremental(),
+		})
+	}
+	if output.json() {
+		return writeJSON(summaries)
+	}
+	for _, s := range summaries {
+		fmt.Printf("%d  %s  %-20q %d blocks\n", s.Catalog, s.CreatedAt, s.Prefix, s.Blocks)
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/3fs-storage/internal/loadgen"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// benchNode generates load from a workload profile against a node and
+// reports the throughput and latencies measured, compared with an earlier
+// run's report if given
+func benchNode(_ *options, args []string) error {
+	flags := newFlagSet("bench")
+	node := addClientFlags(flags)
+	profileName := flags.String("profile", "mixed-small-kv", "Workload profile to run")
+	listProfiles := flags.Bool("list-profiles", false, "List the workload profiles and exit")
+	distribution := flags.String("distribution", "", "Override the profile's key distribution: uniform, zipfian or sequential")
+	keys := flags.Int("keys", 0, "Override the profile's number of keys")
+	size := flags.String("size", "", "Override the profile's block size, such as 4MiB")
+	minSize := flags.String("min-size", "", "Override the profile's smallest block size")
+	maxSize := flags.String("max-size", "", "Override the profile's largest block size")
+	readPercent := flags.Int("read-percent", -1, "Override the profile's share of reads, in percent")
+	workers := flags.Int("workers", loadgen.DefaultWorkers, "Number of concurrent workers, each over its own connection")
+	warmUp := flags.Duration("warmup", 5*time.Second, "Time the workload runs unmeasured first")
+	duration := flags.Duration("duration", 30*time.Second, "Time the workload is measured for")
+	ops := flags.Int64("ops", 0, "End the measured phase after this many operations instead")
+	seed := flags.Int64("seed", 1, "Seed of the random choices, to repeat a run")
+	prefix := flags.String("prefix", loadgen.DefaultPrefix, "Prefix of the block IDs the run uses")
+	cleanup := flags.Bool("cleanup", false, "Delete the run's blocks at the end")
+	reportPath := flags.String("report", "", "File to save the report to as JSON, to compare later runs with")
+	comparePath := flags.String("compare", "", "Report of an earlier run to compare with")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 0 {
+		flags.Usage()
+		return errors.New("bench takes no arguments")
+	}
+	if *listProfiles {
+		return printProfiles(output)
+	}
+
+	profile, err := loadgen.LookupProfile(*profileName)
+	if err != nil {
+		return err
+	}
+	if *distribution != "" {
+		profile.Distribution = *distribution
+	}
+	if *keys > 0 {
+		profile.Keys = *keys
+	}
+	if *readPercent >= 0 {
+		profile.ReadPercent = *readPercent
+	}
+	if *size != "" {
+		*minSize, *maxSize = *size, *size
+	}
+	for _, override := range []struct {
+		value string
+		size  *int
+	}{{*minSize, &profile.MinSize}, {*maxSize, &profile.MaxSize}} {
+		if override.value == "" {
+			continue
+		}
+		n, err := config.ParseSize(override.value)
+		if err != nil {
+			return err
+		}
+		*override.size = int(n)
+	}
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+
+	var base *loadgen.Report
+	if *comparePath != "" {
+		if base, err = loadgen.ReadReport(*comparePath); err != nil {
+			return err
+		}
+	}
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	clientOpts, err := node.options()
+	if err != nil {
+		return err
+	}
+
+	// Stopping ends the run early, and reports what it measured so far
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	dial := func() (*client.Client, error) {
+		return client.DialWithOptions(node.address, clientOpts)
+	}
+	report, err := loadgen.Run(ctx, dial, loadgen.Options{
+		Profile:  profile,
+		Workers:  *workers,
+		Prefix:   *prefix,
+		WarmUp:   *warmUp,
+		Duration: *duration,
+		Ops:      *ops,
+		Seed:     *seed,
+		Cleanup:  *cleanup,
+	}, logger)
+	if err != nil {
+		return err
+	}
+
+	if *reportPath != "" {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return fmt.Errorf("failed to encode report: %w", err)
+		}
+		if err := os.WriteFile(*reportPath, append(data, '\n'), 0o644); err != nil {
+			return fmt.Errorf("failed to save report: %w", err)
+		}
+	}
+	if output.json() {
+		return writeJSON(report)
+	}
+	return loadgen.WriteText(os.Stdout, report, base)
+}
+
+// printProfiles lists the built-in workload profiles
+func printProfiles(output *outputFormat) error {
+	profiles := loadgen.Profiles()
+	if output.json() {
+		return writeJSON(profiles)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tREADS\tDELETES\tSIZE\tKEYS\tDISTRIBUTION\tDESCRIPTION")
+	for _, p := range profiles {
+		sizes := config.Size(p.MinSize).String()
+		if p.MaxSize != p.MinSize {
+			sizes += "-" + config.Size(p.MaxSize).String()
+		}
+		fmt.Fprintf(w, "%s\t%d%%\t%d%%\t%s\t%d\t%s\t%s\n", p.Name, p.ReadPercent, p.DeletePercent,
+			sizes, p.Keys, p.Distribution, p.Description)
+	}
+	return w.Flush()
+}
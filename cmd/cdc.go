@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// cdcFollowWait is how long each read of the change log waits for records
+// with -follow
+const cdcFollowWait = 30 * time.Second
+
+// tailChanges prints the records of a node's change log following a
+// resume token, and with -follow the records appended after them until
+// interrupted. The token to resume from is printed to stderr at the end.
+func tailChanges(_ *options, args []string) error {
+	cmd, _ := lookupCommand("cdc")
+	flags := commandFlagSet("cdc", cmd)
+	admin := addAdminFlags(flags, defaultAdminAddress)
+	after := flags.String("after", "", "Resume token to print the records following; empty starts at the oldest record, end at the next one appended")
+	prefix := flags.String("prefix", "", "Print only the records of blocks whose ID starts with this")
+	limit := flags.Int("limit", 1000, "Records fetched per request")
+	follow := flags.Bool("follow", false, "Keep printing records as they are appended")
+	output := addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("cdc takes no arguments; use -after and -prefix")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	token := *after
+	defer func() {
+		if token != "" {
+			fmt.Fprintf(os.Stderr, "resume with -after %s\n", token)
+		}
+	}()
+	for {
+		var wait time.Duration
+		if *follow {
+			wait = cdcFollowWait
+		}
+		batch, err := fetchChanges(ctx, admin, token, *prefix, *limit, wait)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		for _, rec := range batch.Records {
+			if err := printChange(output, rec); err != nil {
+				return err
+			}
+		}
+		caughtUp := batch.Next == token
+		token = batch.Next
+		if caughtUp && !*follow {
+			return nil
+		}
+	}
+}
+
+// fetchChanges reads a page of a node's change log, waiting up to wait for
+// records when there are none yet
+func fetchChanges(ctx context.Context, admin *adminFlags, after, prefix string, limit int, wait time.Duration) (*api.ChangeBatch, error) {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if after != "" {
+		query.Set("after", after)
+	}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if wait > 0 {
+		query.Set("wait", wait.String())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, admin.url(api.CDCPath+"?"+query.Encode()), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := (&http.Client{Timeout: admin.timeout + wait}).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusGone {
+		return nil, fmt.Errorf("the records following %s are gone: %s; start over without -after", after, strings.TrimSpace(string(body)))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("node returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var batch api.ChangeBatch
+	if err := json.Unmarshal(body, &batch); err != nil {
+		return nil, fmt.Errorf("failed to decode change records: %w", err)
+	}
+	return &batch, nil
+}
+
+// printChange prints a change record as a line of text, or as a line of
+// JSON with -output json
+func printChange(output *outputFormat, rec api.ChangeRecord) error {
+	if output.json() {
+		data, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", data)
+		return err
+	}
+
+	at := time.Unix(0, rec.Time).Format(time.RFC3339Nano)
+	if rec.Op == api.ChangeDelete {
+		_, err := fmt.Printf("%d %s %-6s %s target=%s\n", rec.Offset, at, rec.Op, rec.BlockID, rec.Target)
+		return err
+	}
+	_, err := fmt.Printf("%d %s %-6s %s target=%s size=%d version=%d checksum=%s\n",
+		rec.Offset, at, rec.Op, rec.BlockID, rec.Target, rec.Size, rec.Version, rec.Checksum)
+	return err
+}
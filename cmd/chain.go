@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// rebalancePollInterval is how often a rebalance waited for is checked
+const rebalancePollInterval = time.Second
+
+// chainCommands lists the subcommands of chain. It is set in init, as the
+// subcommands look up their own usage in it.
+var chainCommands []command
+
+func init() {
+	chainCommands = []command{
+		{"list", "", "List the chains and their members", listChains},
+		{"show", "<chain>", "Show a chain's members and their nodes", showChain},
+		{"add-node", "<chain> <node>", "Add a node to a chain, before its tail", addChainNode},
+		{"remove-node", "<chain> <node>", "Remove a node from a chain", removeChainNode},
+		{"set-head", "<chain> <node>", "Move a member to the head of a chain", setChainHead},
+		{"rebalance", "", "Start a rebalance pass", rebalanceChains},
+		{"explain", "[chain]", "Dry-run chain assignment under the placement rules, and explain a chain's candidates", explainPlacement},
+	}
+}
+
+// chainAdmin runs a subcommand of chain, which drive the coordinator API
+func chainAdmin(opts *options, args []string) error {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "--help" {
+		chainUsage()
+		if len(args) == 0 {
+			return errors.New("chain takes a subcommand")
+		}
+		return flag.ErrHelp
+	}
+	for _, cmd := range chainCommands {
+		if cmd.name == args[0] {
+			return cmd.run(opts, args[1:])
+		}
+	}
+	chainUsage()
+	return fmt.Errorf("unknown chain subcommand %q", args[0])
+}
+
+// chainUsage prints the subcommands of chain
+func chainUsage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s chain <subcommand> [flags] [args]\n\nSubcommands:\n", filepath.Base(os.Args[0]))
+	printCommands(out, chainCommands)
+	fmt.Fprintf(out, "\nRun a subcommand with -h for its flags.\n")
+}
+
+// chainFlags are the flags of a chain subcommand
+type chainFlags struct {
+	*flag.FlagSet
+	addresses string
+	output    *outputFormat
+}
+
+// newChainFlags returns the flag set of a chain subcommand, with the flag
+// naming the coordinator
+func newChainFlags(name string) *chainFlags {
+	var cmd command
+	for _, c := range chainCommands {
+		if c.name == name {
+			cmd = c
+		}
+	}
+	f := &chainFlags{FlagSet: commandFlagSet("chain "+name, cmd)}
+	f.StringVar(&f.addresses, "coordinator", defaultAdminAddress, "Admin addresses of the coordinator replicas, comma-separated")
+	f.output = addOutputFlag(f.FlagSet)
+	return f
+}
+
+// parse parses the arguments of the subcommand, which takes nargs
+// positional arguments, and returns a client of the coordinator
+func (f *chainFlags) parse(args []string, nargs int) (*coordinator.Client, error) {
+	if err := f.Parse(args); err != nil {
+		return nil, err
+	}
+	if f.NArg() != nargs {
+		f.Usage()
+		return nil, fmt.Errorf("%s takes %d arguments", f.Name(), nargs)
+	}
+	return coordinator.NewClient(strings.Split(f.addresses, ","))
+}
+
+// chainArg parses the chain ID given as the first argument
+func (f *chainFlags) chainArg() (uint32, error) {
+	id, err := strconv.ParseUint(f.Arg(0), 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid chain ID %q", f.Arg(0))
+	}
+	return uint32(id), nil
+}
+
+// listChains prints a line per chain with its members from head to tail
+func listChains(_ *options, args []string) error {
+	flags := newChainFlags("list")
+	coord, err := flags.parse(args, 0)
+	if err != nil {
+		return err
+	}
+	table, err := coord.FetchRouting(context.Background(), 0)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the chain table: %w", err)
+	}
+	if flags.output.json() {
+		list := chainList{Version: table.Version, Chains: make([]chainOutput, 0, len(table.Chains))}
+		for _, chain := range table.Chains {
+			list.Chains = append(list.Chains, newChainOutput(table, chain))
+		}
+		return writeJSON(list)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "CHAIN\tNAMESPACE\tVERSION\tMEMBERS (HEAD TO TAIL)")
+	for _, chain := range table.Chains {
+		members := make([]string, 0, len(chain.Members))
+		for _, member := range chain.Members {
+			members = append(members, member+memberState(table, member))
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%s\n", chain.ID, orDash(chain.Namespace), chain.Version, strings.Join(members, " "))
+	}
+	return w.Flush()
+}
+
+// showChain prints a chain's members and the nodes serving them
+func showChain(_ *options, args []string) error {
+	flags := newChainFlags("show")
+	coord, err := flags.parse(args, 1)
+	if err != nil {
+		return err
+	}
+	chainID, err := flags.chainArg()
+	if err != nil {
+		return err
+	}
+	table, err := coord.FetchRouting(context.Background(), 0)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the chain table: %w", err)
+	}
+	if int(chainID) >= len(table.Chains) {
+		return fmt.Errorf("chain %d not found", chainID)
+	}
+	return printChain(flags, table, table.Chains[chainID])
+}
+
+// chainList is the chain table as printed with -output json
+type chainList struct {
+	Version uint64        `json:"version"`
+	Chains  []chainOutput `json:"chains"`
+}
+
+// chainOutput is a chain as printed with -output json, its members from
+// head to tail
+type chainOutput struct {
+	ID        uint32         `json:"id"`
+	Namespace string         `json:"namespace"`
+	Version   uint64         `json:"version"`
+	Members   []memberOutput `json:"members"`
+}
+
+// memberOutput is a chain member and the node serving it. State is
+// "unknown" for a member missing from the node table.
+type memberOutput struct {
+	Node    string `json:"node"`
+	Role    string `json:"role"`
+	Address string `json:"address"`
+	State   string `json:"state"`
+	Suspect bool   `json:"suspect"`
+	Host    string `json:"host"`
+	Zone    string `json:"zone"`
+	Rack    string `json:"rack"`
+}
+
+// newChainOutput describes a chain and its members for -output json
+func newChainOutput(table *api.RoutingTable, chain *api.ChainRecord) chainOutput {
+	out := chainOutput{ID: chain.ID, Namespace: chain.Namespace, Version: chain.Version, Members: []memberOutput{}}
+	for i, member := range chain.Members {
+		m := memberOutput{Node: member, Role: memberRole(chain, i), State: "unknown"}
+		if node, ok := table.Nodes[member]; ok {
+			m.Address, m.State, m.Suspect = node.Address, string(node.State), node.Suspect
+			m.Host, m.Zone, m.Rack = node.Host(), node.Zone, node.Rack
+		}
+		out.Members = append(out.Members, m)
+	}
+	return out
+}
+
+// memberRole returns the role of the member at a position in a chain:
+// head, middle, tail, or head+tail for the only member
+func memberRole(chain *api.ChainRecord, i int) string {
+	var roles []string
+	if i == 0 {
+		roles = append(roles, "head")
+	}
+	if i == len(chain.Members)-1 {
+		roles = append(roles, "tail")
+	}
+	if len(roles) == 0 {
+		roles = append(roles, "middle")
+	}
+	return strings.Join(roles, "+")
+}
+
+// printChain prints a chain with a line per member
+func printChain(flags *chainFlags, table *api.RoutingTable, chain *api.ChainRecord) error {
+	if flags.output.json() {
+		return writeJSON(newChainOutput(table, chain))
+	}
+	fmt.Printf("chain %d, version %d, namespace %s\n\n", chain.ID, chain.Version, orDash(chain.Namespace))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "ROLE\tNODE\tADDRESS\tSTATE\tHOST\tZONE\tRACK")
+	for i, member := range chain.Members {
+		state, address, host, zone, rack := "unknown", "-", "-", "-", "-"
+		if node, ok := table.Nodes[member]; ok {
+			state = string(node.State)
+			if node.Suspect {
+				state += ", suspect"
+			}
+			address, host, zone, rack = node.Address, node.Host(), orDash(node.Zone), orDash(node.Rack)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", memberRole(chain, i), member, address, state, host, zone, rack)
+	}
+	return w.Flush()
+}
+
+// memberState returns the state of a chain member to show after its ID,
+// or nothing if it is up
+func memberState(table *api.RoutingTable, member string) string {
+	node, ok := table.Nodes[member]
+	switch {
+	case !ok:
+		return "(unknown)"
+	case node.State != api.NodeStateUp:
+		return "(" + string(node.State) + ")"
+	case node.Suspect:
+		return "(suspect)"
+	}
+	return ""
+}
+
+// orDash returns s, or a dash if it is empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// changeChain applies a change to a chain and prints the chain it results
+// in
+func changeChain(flags *chainFlags, coord *coordinator.Client, change func(ctx context.Context, chainID uint32, nodeID string) (*api.ChainRecord, error)) error {
+	chainID, err := flags.chainArg()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	if _, err := change(ctx, chainID, flags.Arg(1)); err != nil {
+		return err
+	}
+	table, err := coord.FetchRouting(ctx, 0)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the chain table: %w", err)
+	}
+	return printChain(flags, table, table.Chains[chainID])
+}
+
+// addChainNode adds a node to a chain
+func addChainNode(_ *options, args []string) error {
+	flags := newChainFlags("add-node")
+	coord, err := flags.parse(args, 2)
+	if err != nil {
+		return err
+	}
+	return changeChain(flags, coord, coord.AddChainMember)
+}
+
+// removeChainNode removes a node from a chain
+func removeChainNode(_ *options, args []string) error {
+	flags := newChainFlags("remove-node")
+	force := flags.Bool("force", false, "Remove the node even if the chain is left short of members")
+	coord, err := flags.parse(args, 2)
+	if err != nil {
+		return err
+	}
+	return changeChain(flags, coord, func(ctx context.Context, chainID uint32, nodeID string) (*api.ChainRecord, error) {
+		return coord.RemoveChainMember(ctx, chainID, nodeID, *force)
+	})
+}
+
+// setChainHead moves a member to the head of a chain
+func setChainHead(_ *options, args []string) error {
+	flags := newChainFlags("set-head")
+	coord, err := flags.parse(args, 2)
+	if err != nil {
+		return err
+	}
+	return changeChain(flags, coord, coord.SetChainHead)
+}
+
+// rebalanceChains starts a rebalance pass, and with -wait prints its moves
+// once it is done
+func rebalanceChains(_ *options, args []string) error {
+	flags := newChainFlags("rebalance")
+	wait := flags.Bool("wait", false, "Wait for the pass to finish and print its moves")
+	coord, err := flags.parse(args, 0)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	before, err := coord.RebalanceStatus(ctx)
+	if err != nil {
+		return err
+	}
+	if err := coord.Rebalance(ctx); err != nil {
+		return err
+	}
+	if !*wait {
+		if flags.output.json() {
+			return writeJSON(map[string]bool{"started": true})
+		}
+		fmt.Println("rebalance started")
+		return nil
+	}
+
+	for {
+		time.Sleep(rebalancePollInterval)
+		status, err := coord.RebalanceStatus(ctx)
+		if err != nil {
+			return err
+		}
+		if status.Running || status.StartedAt == before.StartedAt {
+			continue
+		}
+		return printRebalance(flags, status)
+	}
+}
+
+// printRebalance prints the outcome of a rebalance pass
+func printRebalance(flags *chainFlags, status *coordinator.RebalanceStatus) error {
+	if flags.output.json() {
+		if err := writeJSON(status); err != nil {
+			return err
+		}
+	} else {
+		printRebalanceText(status)
+	}
+	if status.Error != "" {
+		return fmt.Errorf("rebalance failed: %s", status.Error)
+	}
+	return nil
+}
+
+// printRebalanceText prints the moves of a rebalance pass as a table
+func printRebalanceText(status *coordinator.RebalanceStatus) {
+	fmt.Printf("bytes skew %.2f, blocks skew %.2f, %d moves completed, %d failed, %d bytes copied\n",
+		status.BytesSkew, status.BlocksSkew, status.Completed, status.Failed, status.BytesCopied)
+	if len(status.Moves) > 0 {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CHAIN\tFROM\tTO\tBLOCKS\tSTATE\tERROR")
+		for _, move := range status.Moves {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%s\t%s\n", move.ChainID, move.From, move.To, move.Blocks, move.State, move.Error)
+		}
+		w.Flush()
+	}
+}
+
+// explainPlacement prints the chains a new assignment would change, and
+// with a chain ID, how each node fares as a new member of the chain
+func explainPlacement(_ *options, args []string) error {
+	flags := newChainFlags("explain")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 1 {
+		flags.Usage()
+		return errors.New("explain takes at most one chain ID")
+	}
+	coord, err := coordinator.NewClient(strings.Split(flags.addresses, ","))
+	if err != nil {
+		return err
+	}
+	var chain *uint32
+	if flags.NArg() == 1 {
+		chainID, err := flags.chainArg()
+		if err != nil {
+			return err
+		}
+		chain = &chainID
+	}
+	explanation, err := coord.ExplainPlacement(context.Background(), chain)
+	if err != nil {
+		return fmt.Errorf("failed to explain placement: %w", err)
+	}
+	if flags.output.json() {
+		return writeJSON(explanation)
+	}
+
+	fmt.Printf("%d placement rules\n", len(explanation.Rules))
+	for _, rule := range explanation.Rules {
+		kind := "hard"
+		if rule.Soft {
+			kind = "soft"
+		}
+		fmt.Printf("  %s: %s, %s, namespaces %s\n", rule.Name, rule.Type, kind, orDash(strings.Join(rule.Namespaces, ",")))
+	}
+	if len(explanation.Changes) == 0 {
+		fmt.Println("\nassignment would change no chain")
+	} else {
+		fmt.Println()
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "CHAIN\tNAMESPACE\tMEMBERS NOW\tMEMBERS AFTER")
+		for _, change := range explanation.Changes {
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\n", change.Chain, orDash(change.Namespace),
+				orDash(strings.Join(change.Before, " ")), orDash(strings.Join(change.After, " ")))
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if explanation.Chain == nil {
+		return nil
+	}
+
+	fmt.Printf("\ncandidates for chain %d (members %s)\n\n", explanation.Chain.Chain, orDash(strings.Join(explanation.Chain.Members, " ")))
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tVERDICT\tFAILED CHECKS")
+	for _, candidate := range explanation.Chain.Candidates {
+		verdict := "refused"
+		switch {
+		case candidate.Preferred:
+			verdict = "preferred"
+		case candidate.Eligible:
+			verdict = "eligible"
+		}
+		var failed []string
+		for _, check := range candidate.Checks {
+			if !check.Passed {
+				failed = append(failed, check.Rule+": "+check.Reason)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", candidate.Node, verdict, orDash(strings.Join(failed, "; ")))
+	}
+	return w.Flush()
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// Default addresses of the node the client commands talk to
+const (
+	defaultNodeAddress  = "127.0.0.1:7000"
+	defaultAdminAddress = "127.0.0.1:7100"
+)
+
+// clientFlags are the flags of the commands that talk to a node's block
+// API
+type clientFlags struct {
+	address  string
+	token    string
+	timeout  time.Duration
+	caFile   string
+	certFile string
+	keyFile  string
+	retries  int
+}
+
+// addClientFlags adds the flags to reach a node to a command's flag set
+func addClientFlags(flags *flag.FlagSet) *clientFlags {
+	f := &clientFlags{}
+	flags.StringVar(&f.address, "addr", defaultNodeAddress, "Data address of the node, as host:port")
+	flags.StringVar(&f.token, "token", "", "Bearer token, or a secret reference such as env://TOKEN")
+	flags.DurationVar(&f.timeout, "timeout", client.DefaultTimeout, "Timeout of the connection and each request")
+	flags.StringVar(&f.caFile, "tls-ca", "", "CA certificate verifying the node; enables TLS")
+	flags.StringVar(&f.certFile, "tls-cert", "", "Client certificate presented to the node")
+	flags.StringVar(&f.keyFile, "tls-key", "", "Private key of the client certificate")
+	flags.IntVar(&f.retries, "retries", client.DefaultRetryPolicy.MaxAttempts-1, "Times a request failing transiently is retried")
+	return f
+}
+
+// options returns the client options the flags describe
+func (f *clientFlags) options() (client.Options, error) {
+	opts := client.Options{Timeout: f.timeout}
+	if f.retries > 0 {
+		opts.Retry = client.DefaultRetryPolicy
+		opts.Retry.MaxAttempts = f.retries + 1
+	}
+	token, err := config.ResolveSecret(f.token)
+	if err != nil {
+		return opts, fmt.Errorf("failed to read token: %w", err)
+	}
+	opts.Token = token
+
+	opts.TLS, err = client.LoadTLS(f.caFile, f.certFile, f.keyFile)
+	return opts, err
+}
+
+// call connects to the node and runs fn. A node that is draining or
+// shutting down redirects the request, which is then retried once on the
+// node it suggests.
+func (f *clientFlags) call(fn func(ctx context.Context, c *client.Client) error) error {
+	opts, err := f.options()
+	if err != nil {
+		return err
+	}
+	c, err := client.DialWithOptions(f.address, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	err = fn(ctx, c)
+	var redirect *api.RedirectError
+	if !errors.As(err, &redirect) {
+		return err
+	}
+	next, dialErr := client.DialRedirect(err, opts)
+	if dialErr != nil {
+		return dialErr
+	}
+	defer next.Close()
+	return fn(ctx, next)
+}
+
+// putBlock writes a block from a file, or stdin
+func putBlock(_ *options, args []string) error {
+	flags := newFlagSet("put")
+	node := addClientFlags(flags)
+	stream := flags.Bool("stream", false, "Store the file as a stream of chunks, for files larger than a block")
+	chunkSize := flags.String("chunk-size", config.Size(client.DefaultChunkSize).String(), "Size of a stream's chunks")
+	resume := flags.String("resume", "", "Resume the stream upload with this ID")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("put takes a block ID and a file")
+	}
+	blockID, path := flags.Arg(0), flags.Arg(1)
+	if *stream || *resume != "" {
+		size, err := config.ParseSize(*chunkSize)
+		if err != nil {
+			return fmt.Errorf("invalid chunk size: %w", err)
+		}
+		return putStream(node, blockID, path, int(size), *resume)
+	}
+
+	var data []byte
+	var err error
+	if path == "-" {
+		data, err = io.ReadAll(os.Stdin)
+	} else {
+		data, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read block data: %w", err)
+	}
+	return node.call(func(ctx context.Context, c *client.Client) error {
+		if err := c.Write(ctx, blockID, data); err != nil {
+			return fmt.Errorf("failed to write %s: %w", blockID, err)
+		}
+		return nil
+	})
+}
+
+// getBlock reads a block to a file, or stdout
+func getBlock(_ *options, args []string) error {
+	flags := newFlagSet("get")
+	node := addClientFlags(flags)
+	stream := flags.Bool("stream", false, "Read a stream stored with put -stream")
+	offset := flags.Int64("offset", 0, "Offset to read a stream from, writing the file from there on")
+	replicas := flags.String("replicas", "", "Data addresses of other nodes holding the block, comma-separated, to read from any of them")
+	hedgeAfter := flags.Duration("hedge-after", 0, "With -replicas, how long to wait for a node before reading from another as well")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		flags.Usage()
+		return errors.New("get takes a block ID and optionally a file")
+	}
+	blockID := flags.Arg(0)
+	if *stream || *offset != 0 {
+		return getStream(node, blockID, flags.Arg(1), *offset)
+	}
+
+	var data []byte
+	var err error
+	if *replicas != "" {
+		data, err = readReplicas(node, strings.Split(*replicas, ","), *hedgeAfter, blockID)
+	} else {
+		err = node.call(func(ctx context.Context, c *client.Client) error {
+			var err error
+			if data, err = c.Read(ctx, blockID); err != nil {
+				return fmt.Errorf("failed to read %s: %w", blockID, err)
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if path := flags.Arg(1); path != "" && path != "-" {
+		return os.WriteFile(path, data, 0o644)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// readReplicas reads a block from the node and the other replicas of its
+// chain, hedging the read to another replica when one is slow
+func readReplicas(node *clientFlags, replicas []string, hedgeAfter time.Duration, blockID string) ([]byte, error) {
+	opts, err := node.options()
+	if err != nil {
+		return nil, err
+	}
+	r, err := client.NewReplicas(append([]string{node.address}, replicas...), opts, client.HedgePolicy{After: hedgeAfter})
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := r.Read(context.Background(), blockID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", blockID, err)
+	}
+	return data, nil
+}
+
+// putStream uploads a file as a stream. A failed upload can be resumed
+// with the ID it reports, skipping the part of the file already stored.
+func putStream(node *clientFlags, name, path string, chunkSize int, uploadID string) error {
+	in := os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", path, err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	return node.call(func(ctx context.Context, c *client.Client) error {
+		var w *client.StreamWriter
+		var err error
+		if uploadID == "" {
+			w, err = c.PutStream(ctx, name, chunkSize)
+		} else {
+			w, err = c.ResumeStream(ctx, name, uploadID)
+		}
+		if err != nil {
+			return err
+		}
+		if w.Offset() > 0 {
+			if in == os.Stdin {
+				return errors.New("a stream read from stdin cannot be resumed")
+			}
+			if _, err := in.Seek(w.Offset(), io.SeekStart); err != nil {
+				return fmt.Errorf("failed to skip the stored part of %s: %w", path, err)
+			}
+		}
+
+		_, err = w.ReadFrom(in)
+		if err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "stored %d bytes; resume with -resume %s\n", w.Offset(), w.UploadID())
+			return fmt.Errorf("failed to write %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// getStream reads a stream to a file, or stdout, from an offset. With a
+// file, the data is written at the same offset of it, so that a download
+// cut short is resumed with the size of the partial file as the offset.
+func getStream(node *clientFlags, name, path string, offset int64) error {
+	out := os.Stdout
+	if path != "" && path != "-" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", path, err)
+		}
+		defer f.Close()
+		if err := f.Truncate(offset); err != nil {
+			return fmt.Errorf("failed to truncate %s: %w", path, err)
+		}
+		if _, err := f.Seek(offset, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to seek %s: %w", path, err)
+		}
+		out = f
+	}
+
+	return node.call(func(ctx context.Context, c *client.Client) error {
+		r, err := c.GetStream(ctx, name, offset)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		defer r.Close()
+		if _, err := io.Copy(out, r); err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// deleteBlocks deletes blocks, going on past failures to report them all
+func deleteBlocks(_ *options, args []string) error {
+	flags := newFlagSet("del")
+	node := addClientFlags(flags)
+	stream := flags.Bool("stream", false, "Delete streams, with their chunks")
+	output := addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("del takes at least one block ID")
+	}
+
+	return node.call(func(ctx context.Context, c *client.Client) error {
+		result := deleteResult{Deleted: []string{}, Failed: []deleteFailure{}}
+		del := c.Delete
+		if *stream {
+			del = c.DeleteStream
+		}
+		for _, blockID := range flags.Args() {
+			if err := del(ctx, blockID); err != nil {
+				var redirect *api.RedirectError
+				if errors.As(err, &redirect) {
+					return err
+				}
+				if !output.json() {
+					fmt.Fprintf(os.Stderr, "failed to delete %s: %v\n", blockID, err)
+				}
+				result.Failed = append(result.Failed, deleteFailure{ID: blockID, Error: err.Error()})
+				continue
+			}
+			result.Deleted = append(result.Deleted, blockID)
+		}
+		if output.json() {
+			if err := writeJSON(result); err != nil {
+				return err
+			}
+		}
+		if len(result.Failed) > 0 {
+			return fmt.Errorf("failed to delete %d of %d blocks", len(result.Failed), flags.NArg())
+		}
+		return nil
+	})
+}
+
+// deleteResult is the outcome of del as printed with -output json
+type deleteResult struct {
+	Deleted []string        `json:"deleted"`
+	Failed  []deleteFailure `json:"failed"`
+}
+
+// deleteFailure is a block del failed to delete
+type deleteFailure struct {
+	ID    string `json:"id"`
+	Error string `json:"error"`
+}
+
+// listBlocks prints the IDs of the blocks with a prefix, one per line
+func listBlocks(_ *options, args []string) error {
+	flags := newFlagSet("ls")
+	node := addClientFlags(flags)
+	prefix := flags.String("prefix", "", "List only the blocks whose ID starts with this")
+	output := addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("ls takes no arguments; use -prefix")
+	}
+
+	return node.call(func(ctx context.Context, c *client.Client) error {
+		ids, err := c.List(ctx, *prefix)
+		if err != nil {
+			return fmt.Errorf("failed to list blocks: %w", err)
+		}
+		if output.json() {
+			if ids == nil {
+				ids = []string{}
+			}
+			return writeJSON(blockList{Prefix: *prefix, Blocks: ids})
+		}
+		for _, id := range ids {
+			fmt.Println(id)
+		}
+		return nil
+	})
+}
+
+// blockList is the outcome of ls as printed with -output json
+type blockList struct {
+	Prefix string   `json:"prefix"`
+	Blocks []string `json:"blocks"`
+}
+
+// adminFlags are the flags of the commands that talk to a node's admin
+// API
+type adminFlags struct {
+	address string
+	timeout time.Duration
+}
+
+// addAdminFlags adds the flags to reach a node's admin API to a command's
+// flag set
+func addAdminFlags(flags *flag.FlagSet, address string) *adminFlags {
+	f := &adminFlags{}
+	flags.StringVar(&f.address, "admin", address, "Admin address of the node, as host:port or a URL")
+	flags.DurationVar(&f.timeout, "timeout", client.DefaultTimeout, "Timeout of each request")
+	return f
+}
+
+// url returns the URL of a path of the admin API
+func (f *adminFlags) url(path string) string {
+	url := f.address
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		url = "http://" + url
+	}
+	return strings.TrimSuffix(url, "/") + path
+}
+
+// do sends a request to the admin API, returning the body of a successful
+// response
+func (f *adminFlags) do(method, path string) ([]byte, error) {
+	return f.send(method, path, nil)
+}
+
+// send sends a request with a JSON body to the admin API, returning the
+// body of a successful response
+func (f *adminFlags) send(method, path string, body any) ([]byte, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, f.url(path), reqBody)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	httpClient := &http.Client{Timeout: f.timeout}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("node returned %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// printJSON pretty-prints a JSON document to stdout
+func printJSON(data []byte) error {
+	var out bytes.Buffer
+	if err := json.Indent(&out, data, "", "  "); err != nil {
+		return err
+	}
+	out.WriteByte('\n')
+	_, err := out.WriteTo(os.Stdout)
+	return err
+}
+
+// printStats prints a node's stats from its admin API, which are JSON
+// whatever the output format
+func printStats(_ *options, args []string) error {
+	flags := newFlagSet("stats")
+	admin := addAdminFlags(flags, defaultAdminAddress)
+	addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	body, err := admin.do(http.MethodGet, "/v1/stats")
+	if err != nil {
+		return fmt.Errorf("failed to fetch stats: %w", err)
+	}
+	if err := printJSON(body); err != nil {
+		return fmt.Errorf("failed to decode stats: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/3fs-storage/internal/clone"
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// cloneCluster copies the blocks of namespaces or prefixes from one
+// cluster to another, each reached through its coordinator's routing
+// table
+func cloneCluster(_ *options, args []string) error {
+	flags := newFlagSet("clone")
+	node := addClientFlags(flags)
+	srcCluster := flags.String("src-cluster", "", "Admin addresses of the source cluster's coordinator replicas, comma-separated")
+	dstCluster := flags.String("dst-cluster", "", "Admin addresses of the destination cluster's coordinator replicas, comma-separated")
+	srcToken := flags.String("src-token", "", "Bearer token of the source cluster, if not -token")
+	dstToken := flags.String("dst-token", "", "Bearer token of the destination cluster, if not -token")
+	namespaces := flags.String("namespace", "", "Namespaces to copy the blocks of, comma-separated")
+	prefixes := flags.String("prefix", "", "Copy the blocks with IDs starting with these prefixes, comma-separated")
+	readPolicy := flags.String("read-policy", client.ReadTail.String(), "Source replicas to read from: tail, round-robin or least-latency")
+	var cloneOpts clone.Options
+	flags.IntVar(&cloneOpts.Workers, "workers", clone.DefaultWorkers, "Number of blocks copied at the same time")
+	flags.BoolVar(&cloneOpts.Delta, "delta", false, "Copy only blocks whose version or checksum differ in the destination")
+	flags.BoolVar(&cloneOpts.DryRun, "dry-run", false, "Log the blocks that would be copied without copying them")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("clone takes no arguments")
+	}
+	if *srcCluster == "" || *dstCluster == "" {
+		return errors.New("clone needs -src-cluster and -dst-cluster")
+	}
+	if *namespaces != "" {
+		for _, namespace := range strings.Split(*namespaces, ",") {
+			if namespace == "" || strings.Contains(namespace, api.NamespaceSeparator) {
+				return fmt.Errorf("invalid namespace %q", namespace)
+			}
+			cloneOpts.Prefixes = append(cloneOpts.Prefixes, namespace+api.NamespaceSeparator)
+		}
+	}
+	if *prefixes != "" {
+		cloneOpts.Prefixes = append(cloneOpts.Prefixes, strings.Split(*prefixes, ",")...)
+	}
+	policy, err := client.ParseReadPolicy(*readPolicy)
+	if err != nil {
+		return err
+	}
+
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	srcOpts, err := clusterOptions(node, *srcToken)
+	if err != nil {
+		return err
+	}
+	dstOpts, err := clusterOptions(node, *dstToken)
+	if err != nil {
+		return err
+	}
+
+	// Stopping finishes the blocks being copied
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	srcTable, err := fetchRouting(ctx, *srcCluster)
+	if err != nil {
+		return fmt.Errorf("source cluster: %w", err)
+	}
+	dstTable, err := fetchRouting(ctx, *dstCluster)
+	if err != nil {
+		return fmt.Errorf("destination cluster: %w", err)
+	}
+	src := func() *client.Cluster { return client.NewCluster(srcTable, srcOpts, policy) }
+	dst := func() *client.Cluster { return client.NewCluster(dstTable, dstOpts, client.ReadTail) }
+
+	result, err := clone.Run(ctx, src, dst, cloneOpts, logger)
+	if result != nil {
+		logger.Info("clone finished", "listed", result.Listed, "copied", result.Copied, "skipped", result.Skipped,
+			"failed", result.Failed, "bytes", result.Bytes)
+		if output.json() {
+			if writeErr := writeJSON(result); writeErr != nil {
+				return writeErr
+			}
+		}
+	}
+	return err
+}
+
+// clusterOptions returns the client options of one of the clusters, with
+// its own token if one is given
+func clusterOptions(node *clientFlags, token string) (client.Options, error) {
+	opts, err := node.options()
+	if err != nil || token == "" {
+		return opts, err
+	}
+	if opts.Token, err = config.ResolveSecret(token); err != nil {
+		return opts, fmt.Errorf("failed to read token: %w", err)
+	}
+	return opts, nil
+}
+
+// fetchRouting fetches the routing table from a cluster's coordinator
+func fetchRouting(ctx context.Context, coordinators string) (*api.RoutingTable, error) {
+	coord, err := coordinator.NewClient(strings.Split(coordinators, ","))
+	if err != nil {
+		return nil, err
+	}
+	table, err := coord.FetchRouting(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the routing table: %w", err)
+	}
+	return table, nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/3fs-storage/internal/version"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// command is a subcommand of the binary
+type command struct {
+	name string
+	// args describes the command's arguments, and summary what it does
+	args, summary string
+	run           func(opts *options, args []string) error
+}
+
+// commands lists the subcommands, in the order the help shows them. It is
+// set in init, as the commands look up their own usage in it.
+var commands []command
+
+func init() {
+	commands = []command{
+		{"serve", "", "Run the storage node (the default)", serve},
+		{"put", "<id> <file>", "Write a block from a file, or stdin if the file is -", putBlock},
+		{"get", "<id> [file]", "Read a block to a file, or stdout", getBlock},
+		{"put-dir", "<dir> <manifest-id>", "Upload a directory tree, writing a manifest of its files", putDir},
+		{"get-dir", "<manifest-id> <dir>", "Rebuild a directory tree uploaded with put-dir", getDir},
+		{"del", "<id>...", "Delete blocks", deleteBlocks},
+		{"ls", "", "List block IDs", listBlocks},
+		{"shell", "", "Run commands interactively against a node", runShell},
+		{"mount", "<mountpoint>", "Mount a block namespace as a filesystem through FUSE", mountFS},
+		{"stats", "", "Print a node's stats", printStats},
+		{"top", "", "Show the activity of a cluster's nodes, refreshed live", topNodes},
+		{"bench", "", "Generate load from a workload profile and report its performance", benchNode},
+		{"watch", "", "Print a node's block events as they happen", watchEvents},
+		{"cdc", "", "Print the block mutations a node committed, from a resume token", tailChanges},
+		{"fsck", "", "Check a node's storage, offline or through its admin API", fsck},
+		{"verify", "", "Check that every block of a cluster has consistent replicas on its chain", verifyCluster},
+		{"gc", "", "Reclaim the data blocks no object of a namespace references", collectGarbage},
+		{"backup", "[archive]", "Back up a node's blocks to a file or s3:// archive, or to a repository", backupNode},
+		{"restore", "[archive...]", "Restore blocks from backup archives, full then incremental, or from a repository", restoreNode},
+		{"import", "<source>", "Import the files of a directory, S3 bucket or HDFS", importData},
+		{"clone", "", "Copy namespaces or prefixes from one cluster to another", cloneCluster},
+		{"presign", "<url>", "Print a time-limited URL to read or write an object on the S3 gateway", presignURL},
+		{"chain", "<subcommand>", "Inspect and change the chain table", chainAdmin},
+		{"usage", "", "Print the bytes each namespace stores and transfers and the requests it makes", printUsage},
+		{"version", "", "Print the build's version and enabled features", printVersion},
+		{"config", "", "Print the effective configuration", printConfig},
+		{"sample-config", "", "Print a commented sample configuration", printSample},
+		{"generate-config-key", "", "Create a key for encrypting secrets", generateConfigKey},
+		{"encrypt-secret", "", "Encrypt a secret read from stdin", encryptSecret},
+	}
+}
+
+// lookupCommand returns the command with a name
+func lookupCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// usage prints the flags and the commands
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command] [command flags] [args]\n\nFlags:\n", filepath.Base(os.Args[0]))
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\nCommands:\n")
+	printCommands(out, commands)
+	fmt.Fprintf(out, "\nRun a command with -h for its flags.\n")
+}
+
+// printCommands prints a line for each command with its arguments and
+// summary
+func printCommands(out io.Writer, cmds []command) {
+	for _, cmd := range cmds {
+		fmt.Fprintf(out, "  %-22s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+}
+
+// newFlagSet returns the flag set of a command. Parse returns
+// flag.ErrHelp for -h, which main treats as success.
+func newFlagSet(name string) *flag.FlagSet {
+	cmd, _ := lookupCommand(name)
+	return commandFlagSet(name, cmd)
+}
+
+// commandFlagSet returns the flag set of a command, whose usage names it
+// as name
+func commandFlagSet(name string, cmd command) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.Usage = func() {
+		line := strings.TrimSpace(fmt.Sprintf("%s %s [flags] %s", filepath.Base(os.Args[0]), name, cmd.args))
+		fmt.Fprintf(flags.Output(), "Usage: %s\n\n%s.\n", line, cmd.summary)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// printConfig prints the effective configuration, with the secrets
+// redacted, and the changes made to upgrade it on stderr
+func printConfig(opts *options, args []string) error {
+	flags := newFlagSet("config")
+	format := flags.String("format", string(config.FormatYAML), "Output format: yaml, json or toml")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	_, cfg, err := opts.load()
+	if err != nil {
+		return err
+	}
+
+	data, err := cfg.Dump(config.Format(*format))
+	if err != nil {
+		return fmt.Errorf("failed to print configuration: %w", err)
+	}
+	for _, warning := range cfg.Warnings() {
+		fmt.Fprintf(os.Stderr, "warning: %s\n", warning)
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+// printVersion prints the build and the features the configuration
+// enables, or those of a running node with -admin
+func printVersion(opts *options, args []string) error {
+	flags := newFlagSet("version")
+	admin := addAdminFlags(flags, "")
+	output := addOutputFlag(flags)
+	asJSON := flags.Bool("json", false, "Print the information as JSON, as -output json does")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var info version.Info
+	if admin.address != "" {
+		body, err := admin.do(http.MethodGet, "/v1/version")
+		if err != nil {
+			return fmt.Errorf("failed to fetch version: %w", err)
+		}
+		if err := json.Unmarshal(body, &info); err != nil {
+			return fmt.Errorf("failed to decode version: %w", err)
+		}
+	} else {
+		// The build is printed without a configuration to take the
+		// features from, as on a client machine
+		var features []string
+		if _, cfg, err := opts.load(); err == nil {
+			features = cfg.Storage.FeatureFlags.List()
+		}
+		info = version.Get(features)
+	}
+
+	if *asJSON || output.json() {
+		return writeJSON(info)
+	}
+	_, err := fmt.Print(info)
+	return err
+}
+
+// printSample prints a sample configuration with every field documented
+// and at its default
+func printSample(_ *options, args []string) error {
+	flags := newFlagSet("sample-config")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	return config.WriteSample(os.Stdout)
+}
+
+// generateConfigKey writes a new key for encrypting configuration secrets.
+// An existing key is never overwritten, as the secrets encrypted with it
+// could no longer be read.
+func generateConfigKey(_ *options, args []string) error {
+	flags := newFlagSet("generate-config-key")
+	out := flags.String("out", config.KeyFile(), "Path of the key file to create")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := config.GenerateKey()
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to create config key: %w", err)
+	}
+	if _, err := fmt.Fprintln(f, key); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write config key: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write config key: %w", err)
+	}
+	fmt.Fprintf(os.Stderr, "wrote config key to %s\n", *out)
+	return nil
+}
+
+// encryptSecret encrypts a secret read from stdin with the config key and
+// prints the value to put in the configuration. The secret is not taken
+// as an argument, so that it stays out of the shell history.
+func encryptSecret(_ *options, args []string) error {
+	flags := newFlagSet("encrypt-secret")
+	keyFile := flags.String("key", config.KeyFile(), "Path of the config key file")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	key, err := config.ReadKey(*keyFile)
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return fmt.Errorf("failed to read secret: %w", err)
+	}
+	secret := strings.TrimRight(string(data), "\r\n")
+	if secret == "" {
+		return errors.New("no secret given on stdin")
+	}
+	value, err := config.EncryptSecret(key, secret)
+	if err != nil {
+		return err
+	}
+	fmt.Println(value)
+	return nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/3fs-storage/internal/dirtree"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// treeSummary is what put-dir and get-dir print with -output json
+type treeSummary struct {
+	Manifest string `json:"manifest"`
+	Files    int    `json:"files"`
+	Dirs     int    `json:"dirs"`
+	Size     int64  `json:"size"`
+	dirtree.Result
+}
+
+// putDir uploads a directory tree in parallel and writes a manifest
+// mapping its paths to the streams or objects holding them
+func putDir(_ *options, args []string) error {
+	flags := newFlagSet("put-dir")
+	node := addClientFlags(flags)
+	var putOpts dirtree.PutOptions
+	flags.IntVar(&putOpts.Workers, "workers", dirtree.DefaultWorkers, "Number of files uploaded at the same time")
+	flags.StringVar(&putOpts.Namespace, "namespace", "", "Store the files as objects of this namespace, named by their paths, instead of as streams")
+	chunkSize := flags.String("chunk-size", config.Size(client.DefaultChunkSize).String(), "Size of the chunks of the files' streams")
+	flags.StringVar(&putOpts.Progress, "progress", "", "File recording the files uploaded, to resume an interrupted upload")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("put-dir takes a directory and a manifest ID")
+	}
+	root, manifestID := flags.Arg(0), flags.Arg(1)
+	size, err := config.ParseSize(*chunkSize)
+	if err != nil {
+		return fmt.Errorf("invalid chunk size: %w", err)
+	}
+	putOpts.ChunkSize = int(size)
+
+	logger, dial, err := treeClient(node, *logLevel)
+	if err != nil {
+		return err
+	}
+	// Stopping finishes the files being uploaded, which the progress file
+	// then records
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	manifest, result, err := dirtree.Put(ctx, root, manifestID, dial, putOpts, logger)
+	if result != nil {
+		logger.Info("upload finished", "uploaded", result.Transferred, "skipped", result.Skipped,
+			"failed", result.Failed, "bytes", result.Bytes)
+	}
+	if err != nil {
+		if putOpts.Progress == "" && result != nil && result.Transferred > 0 {
+			logger.Info("upload again with -progress to skip the files already uploaded next time")
+		}
+		return err
+	}
+	return printTree(output, manifestID, manifest, result)
+}
+
+// getDir rebuilds a directory tree from the manifest put-dir wrote
+func getDir(_ *options, args []string) error {
+	flags := newFlagSet("get-dir")
+	node := addClientFlags(flags)
+	var getOpts dirtree.GetOptions
+	flags.IntVar(&getOpts.Workers, "workers", dirtree.DefaultWorkers, "Number of files downloaded at the same time")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return errors.New("get-dir takes a manifest ID and a directory")
+	}
+	manifestID, dest := flags.Arg(0), flags.Arg(1)
+
+	logger, dial, err := treeClient(node, *logLevel)
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	manifest, result, err := dirtree.Get(ctx, manifestID, dest, dial, getOpts, logger)
+	if result != nil {
+		logger.Info("download finished", "downloaded", result.Transferred, "skipped", result.Skipped,
+			"failed", result.Failed, "bytes", result.Bytes)
+	}
+	if err != nil {
+		return err
+	}
+	return printTree(output, manifestID, manifest, result)
+}
+
+// treeClient sets up the logger and the connections of put-dir and
+// get-dir
+func treeClient(node *clientFlags, level string) (*slog.Logger, dirtree.Dial, error) {
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: level})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to configure logging: %w", err)
+	}
+	clientOpts, err := node.options()
+	if err != nil {
+		return nil, nil, err
+	}
+	dial := func() (*client.Client, error) {
+		return client.DialWithOptions(node.address, clientOpts)
+	}
+	return logger, dial, nil
+}
+
+// printTree prints what a transfer of a tree did
+func printTree(output *outputFormat, manifestID string, manifest *dirtree.Manifest, result *dirtree.Result) error {
+	summary := treeSummary{
+		Manifest: manifestID,
+		Files:    len(manifest.Files),
+		Dirs:     len(manifest.Dirs),
+		Size:     manifest.Size,
+		Result:   *result,
+	}
+	if output.json() {
+		return writeJSON(summary)
+	}
+	fmt.Printf("%s: %d files in %d directories, %s; %d transferred, %d skipped\n", manifestID,
+		summary.Files, summary.Dirs, config.Size(summary.Size), result.Transferred, result.Skipped)
+	return nil
+}
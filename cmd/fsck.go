@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/3fs-storage/internal/node"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// fsckPollInterval is how often the progress of an fsck on a running node
+// is checked
+const fsckPollInterval = time.Second
+
+// runningProbeTimeout bounds the check that a node is not running before
+// its storage is checked offline
+const runningProbeTimeout = time.Second
+
+// fsck checks a node's storage, offline from its configuration or through
+// the admin API of the running node, and prints the report as JSON. It
+// fails if problems were left unresolved.
+func fsck(opts *options, args []string) error {
+	flags := newFlagSet("fsck")
+	admin := addAdminFlags(flags, "")
+	var fsckOpts node.FsckOptions
+	flags.StringVar(&fsckOpts.Target, "target", "", "Check only this storage target")
+	flags.BoolVar(&fsckOpts.Repair, "repair", false, "Fix misplaced blocks, orphaned metadata and, online, damaged or stale blocks from replicas")
+	flags.BoolVar(&fsckOpts.Quarantine, "quarantine", false, "Move damaged blocks to the quarantine directory")
+	flags.BoolVar(&fsckOpts.Replicas, "replicas", true, "Compare blocks with their replicas on the other chain members (online only)")
+	force := flags.Bool("force", false, "Check offline even if the node seems to be running")
+	// The report is JSON whatever the output format
+	addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var report *node.FsckReport
+	var err error
+	if admin.address != "" {
+		report, err = fsckOnline(admin, fsckOpts)
+	} else {
+		report, err = fsckOffline(opts, fsckOpts, *force)
+	}
+	if report != nil {
+		if writeErr := writeJSON(report); writeErr != nil {
+			return writeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if report.Unresolved > 0 {
+		return fmt.Errorf("fsck left %d problems unresolved", report.Unresolved)
+	}
+	return nil
+}
+
+// fsckOffline checks the storage targets in the node's configuration. The
+// node must be stopped, as its writes would race with the check.
+func fsckOffline(opts *options, fsckOpts node.FsckOptions, force bool) (*node.FsckReport, error) {
+	_, cfg, err := opts.load()
+	if err != nil {
+		return nil, err
+	}
+	if !force {
+		if address, running := nodeRunning(cfg); running {
+			return nil, fmt.Errorf("the node seems to be running at %s; stop it, or check it online with -admin", address)
+		}
+	}
+	return node.FsckOffline(context.Background(), cfg, fsckOpts)
+}
+
+// nodeRunning reports whether a node answers at the addresses in its
+// configuration
+func nodeRunning(cfg *config.Config) (string, bool) {
+	for _, address := range []string{cfg.Storage.Node.ListenAddress, cfg.Storage.Admin.ListenAddress} {
+		if address == "" {
+			continue
+		}
+		conn, err := net.DialTimeout("tcp", address, runningProbeTimeout)
+		if err == nil {
+			conn.Close()
+			return address, true
+		}
+	}
+	return "", false
+}
+
+// fsckJob is the part of the fsck job's status the client follows
+type fsckJob struct {
+	Running    bool            `json:"running"`
+	Runs       int             `json:"runs"`
+	LastError  string          `json:"last_error"`
+	LastResult json.RawMessage `json:"last_result"`
+}
+
+// fsckOnline starts an fsck on a running node and waits for its report
+func fsckOnline(admin *adminFlags, fsckOpts node.FsckOptions) (*node.FsckReport, error) {
+	before, err := fsckStatus(admin)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{}
+	query.Set("repair", strconv.FormatBool(fsckOpts.Repair))
+	query.Set("quarantine", strconv.FormatBool(fsckOpts.Quarantine))
+	query.Set("replicas", strconv.FormatBool(fsckOpts.Replicas))
+	if fsckOpts.Target != "" {
+		query.Set("target", fsckOpts.Target)
+	}
+	if _, err := admin.do(http.MethodPost, "/v1/fsck?"+query.Encode()); err != nil {
+		return nil, fmt.Errorf("failed to start fsck: %w", err)
+	}
+
+	for {
+		time.Sleep(fsckPollInterval)
+		status, err := fsckStatus(admin)
+		if err != nil {
+			return nil, err
+		}
+		if status.Running || status.Runs <= before.Runs {
+			continue
+		}
+
+		var report *node.FsckReport
+		if len(status.LastResult) > 0 && string(status.LastResult) != "null" {
+			report = &node.FsckReport{}
+			if err := json.Unmarshal(status.LastResult, report); err != nil {
+				return nil, fmt.Errorf("failed to decode fsck report: %w", err)
+			}
+		}
+		if status.LastError != "" {
+			return report, fmt.Errorf("fsck failed: %s", status.LastError)
+		}
+		if report == nil {
+			return nil, errors.New("fsck returned no report")
+		}
+		return report, nil
+	}
+}
+
+// fsckStatus fetches the status of a node's fsck job
+func fsckStatus(admin *adminFlags) (*fsckJob, error) {
+	body, err := admin.do(http.MethodGet, "/v1/jobs/fsck")
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch fsck status: %w", err)
+	}
+	var status fsckJob
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, fmt.Errorf("failed to decode fsck status: %w", err)
+	}
+	return &status, nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// collectGarbage runs a garbage collection of a namespace's object store
+// across a cluster, reached through its coordinator's routing table
+func collectGarbage(_ *options, args []string) error {
+	flags := newFlagSet("gc")
+	node := addClientFlags(flags)
+	coordinators := flags.String("coordinator", "", "Admin addresses of the coordinator replicas, comma-separated")
+	namespace := flags.String("namespace", "", "Block namespace of the object store, such as an S3 gateway bucket")
+	metadata := addMetadataFlags(flags)
+	var gcOpts block.GCOptions
+	flags.DurationVar(&gcOpts.Grace, "grace", block.DefaultGCGrace, "Least time between two runs; blocks stay unreferenced this long before they are reclaimed")
+	flags.BoolVar(&gcOpts.DryRun, "dry-run", false, "Report the blocks that would be reclaimed without deleting them")
+	flags.BoolVar(&gcOpts.AllowEmpty, "allow-empty", false, "Reclaim blocks even if the namespace has no objects")
+	output := addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("gc takes no arguments")
+	}
+	if *coordinators == "" {
+		return errors.New("gc needs -coordinator")
+	}
+	if *namespace == "" || strings.Contains(*namespace, api.NamespaceSeparator) {
+		return errors.New("gc needs a -namespace without a separator")
+	}
+
+	opts, err := node.options()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	table, err := fetchRouting(ctx, *coordinators)
+	if err != nil {
+		return err
+	}
+	// A chain with no member to list would hide the manifests it holds,
+	// leaving the blocks they reference unreferenced
+	for _, chain := range table.Chains {
+		listed := false
+		for _, member := range chain.Members {
+			if record, ok := table.Nodes[member]; ok && record.Healthy() {
+				listed = true
+			}
+		}
+		if !listed {
+			return fmt.Errorf("chain %d has no healthy member; gc needs every chain listed", chain.ID)
+		}
+	}
+
+	cluster := client.NewCluster(table, opts, client.ReadTail)
+	defer cluster.Close()
+	blocks := block.NewClusterBlocks(cluster)
+	store, err := block.NewNamespacedObjectStore(blocks, 0, *namespace)
+	if err != nil {
+		return err
+	}
+	if err := metadata.open(store, blocks, *namespace); err != nil {
+		return err
+	}
+
+	report, err := store.CollectGarbage(ctx, gcOpts)
+	if err != nil {
+		return err
+	}
+	if output.json() {
+		return writeJSON(report)
+	}
+	verb := "reclaimed"
+	if report.DryRun {
+		verb = "would reclaim"
+	}
+	fmt.Printf("epoch %d: %d objects, %d uploads, %d data blocks\n", report.Epoch, report.Objects, report.Uploads, report.Listed)
+	fmt.Printf("referenced %d blocks, %d shared, %d dangling\n", report.Referenced, report.Shared, report.Dangling)
+	fmt.Printf("%s %d blocks, %d failed; %d candidates for the next run\n", verb, len(report.Reclaimed), report.Failed, report.Candidates)
+	fmt.Printf("took %s\n", time.Duration(report.FinishedAt-report.StartedAt).Round(time.Millisecond))
+	if report.Failed > 0 {
+		return fmt.Errorf("failed to reclaim %d blocks", report.Failed)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/migrate"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// importData imports the files of an existing store into a namespace, or
+// as blocks
+func importData(_ *options, args []string) error {
+	flags := newFlagSet("import")
+	node := addClientFlags(flags)
+	s3 := addS3Flags(flags)
+	from := flags.String("from", migrate.FromDir, "Kind of source: dir, s3 or hdfs")
+	namespace := flags.String("namespace", "", "Namespace to import the files into as objects")
+	asBlocks := flags.Bool("blocks", false, "Import each file as a block named by its mapped key instead")
+	var mapper migrate.Mapper
+	flags.Var(&mapper, "map", "Rename source keys matching a regexp, as pattern=replacement; an empty replacement skips them (repeatable)")
+	workers := flags.Int("workers", migrate.DefaultWorkers, "Number of files imported at the same time")
+	progressPath := flags.String("progress", "", "File recording the files imported, to resume an interrupted import")
+	hdfsUser := flags.String("hdfs-user", os.Getenv("USER"), "User WebHDFS requests are made as")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("import takes a source")
+	}
+	location := flags.Arg(0)
+	if *asBlocks == (*namespace != "") {
+		return errors.New("import needs either -namespace or -blocks")
+	}
+	if *namespace != "" {
+		if strings.Contains(*namespace, api.NamespaceSeparator) {
+			return errors.New("the namespace cannot hold a separator")
+		}
+		if err := api.ValidateBlockID(*namespace + api.NamespaceSeparator); err != nil {
+			return fmt.Errorf("invalid namespace: %w", err)
+		}
+	}
+
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	s3cfg, err := s3.config(location)
+	if err != nil {
+		return err
+	}
+	src, err := migrate.OpenSource(*from, location, migrate.SourceConfig{S3: s3cfg, HDFSUser: *hdfsUser})
+	if err != nil {
+		return err
+	}
+	clientOpts, err := node.options()
+	if err != nil {
+		return err
+	}
+
+	importOpts := migrate.Options{
+		Workers:   *workers,
+		Namespace: *namespace,
+		Blocks:    *asBlocks,
+		Mapper:    mapper,
+	}
+	if *progressPath != "" {
+		progress, err := migrate.OpenProgress(*progressPath)
+		if err != nil {
+			return err
+		}
+		defer progress.Close()
+		importOpts.Progress = progress
+	}
+
+	// Stopping finishes the files being imported, which the progress file
+	// then records
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	dial := func() (*client.Client, error) {
+		return client.DialWithOptions(node.address, clientOpts)
+	}
+	result, err := migrate.Run(ctx, src, dial, importOpts, logger)
+	if result != nil {
+		logger.Info("import finished", "imported", result.Imported, "skipped", result.Skipped,
+			"failed", result.Failed, "bytes", result.Bytes)
+		if output.json() {
+			if writeErr := writeJSON(result); writeErr != nil {
+				return writeErr
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if result.Failed > 0 {
+		return fmt.Errorf("%d files failed to import; run the import again to retry them", result.Failed)
+	}
+	return nil
+}
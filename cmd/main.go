@@ -1,50 +1,66 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
-	"github.com/3fs-storage/internal/node"
 	"github.com/3fs-storage/pkg/config"
 )
 
-func main() {
-	// Parse command line flags
-	configPath := flag.String("config", "config/config.yaml", "Path to configuration file")
-	flag.Parse()
+// options are the flags given before the command
+type options struct {
+	configPath    string
+	overrides     config.Overrides
+	watchInterval time.Duration
+}
 
-	// Load configuration
-	cfg, err := config.LoadConfig(*configPath)
+// load loads the node's configuration as the node would, with the
+// overrides set in main
+func (o *options) load() (config.Source, *config.Config, error) {
+	source, err := config.OpenSource(o.configPath)
 	if err != nil {
-		log.Fatalf("Failed to load configuration: %v", err)
+		return nil, nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
-
-	// Initialize the storage node
-	storageNode, err := node.NewStorageNode(cfg)
+	cfg, err := config.Load(context.Background(), source)
 	if err != nil {
-		log.Fatalf("Failed to initialize storage node: %v", err)
+		return nil, nil, fmt.Errorf("failed to load configuration: %w", err)
 	}
+	return source, cfg, nil
+}
 
-	// Start the storage node
-	if err := storageNode.Start(); err != nil {
-		log.Fatalf("Failed to start storage node: %v", err)
+func main() {
+	// Parse command line flags
+	var opts options
+	flag.StringVar(&opts.configPath, "config", "config/config.yaml", "Path to configuration file, or an etcd:// or consul:// key")
+	flag.Var(&opts.overrides, "set", "Override a configuration field, as path=value (repeatable)")
+	flag.DurationVar(&opts.watchInterval, "watch-config", config.DefaultWatchInterval, "How often to check the configuration file for changes; 0 disables watching")
+	flag.Usage = usage
+	flag.Parse()
+	if err := config.SetOverrides(opts.overrides); err != nil {
+		log.Fatalf("Failed to load configuration: %v", err)
 	}
-	
-	fmt.Println("3FS Storage Service started successfully")
-	fmt.Printf("Node ID: %s, Listening on: %s\n", cfg.Storage.Node.ID, cfg.Storage.Node.ListenAddress)
 
-	// Wait for shutdown signal
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
-
-	fmt.Println("Shutting down 3FS Storage Service...")
-	if err := storageNode.Stop(); err != nil {
-		log.Fatalf("Error during shutdown: %v", err)
+	// Without a command, the node is started, as before there were
+	// commands
+	name, args := "serve", []string(nil)
+	if flag.NArg() > 0 {
+		name, args = flag.Arg(0), flag.Args()[1:]
+	}
+	cmd, ok := lookupCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+	if err := cmd.run(&opts, args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		log.Fatal(err)
 	}
-	fmt.Println("Shutdown complete")
-} 
\ No newline at end of file
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/fusefs"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/meta"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// mountFS mounts a block namespace as a filesystem and serves it until it
+// is unmounted or the command is signalled to stop
+func mountFS(_ *options, args []string) error {
+	flags := newFlagSet("mount")
+	node := addClientFlags(flags)
+	namespace := flags.String("namespace", "", "Block namespace holding the files, such as an S3 gateway bucket")
+	subdir := flags.String("subdir", "", "Directory of the namespace to mount instead of all of it")
+	readOnly := flags.Bool("read-only", false, "Mount the filesystem read-only")
+	allowOther := flags.Bool("allow-other", false, "Let other users access the filesystem")
+	stagingDir := flags.String("staging-dir", "", "Directory staging files being written; defaults to the system temporary directory")
+	cacheSize := flags.String("cache-size", "0", "Memory caching blocks read, such as 512MiB; 0 disables the cache")
+	cacheTTL := flags.Duration("cache-ttl", time.Minute, "How long a cached block is read without checking it is unchanged")
+	metadata := addMetadataFlags(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("mount takes a mount point")
+	}
+	mountpoint := flags.Arg(0)
+	if *namespace == "" || strings.Contains(*namespace, api.NamespaceSeparator) {
+		return errors.New("mount needs a -namespace without a separator")
+	}
+	if err := api.ValidateBlockID(*namespace + api.NamespaceSeparator); err != nil {
+		return fmt.Errorf("invalid namespace: %w", err)
+	}
+
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	opts, err := node.options()
+	if err != nil {
+		return err
+	}
+	size, err := config.ParseSize(*cacheSize)
+	if err != nil {
+		return fmt.Errorf("invalid -cache-size: %w", err)
+	}
+	if size > 0 {
+		opts.Cache = client.NewCache(client.CacheOptions{MaxBytes: int64(size), TTL: *cacheTTL})
+	}
+	c, err := client.DialWithOptions(node.address, opts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	blocks := block.NewClientBlocks(c)
+	store, err := block.NewNamespacedObjectStore(blocks, 0, *namespace)
+	if err != nil {
+		return err
+	}
+	if err := metadata.open(store, blocks, *namespace); err != nil {
+		return err
+	}
+	filesystem := fusefs.New(store, fusefs.Options{
+		ReadOnly:   *readOnly,
+		AllowOther: *allowOther,
+		TempDir:    *stagingDir,
+		Subdir:     *subdir,
+	}, logger)
+	source := node.address + "/" + *namespace
+	if *subdir != "" {
+		source += "/" + strings.Trim(*subdir, "/")
+	}
+	m, err := filesystem.Mount(mountpoint, source)
+	if err != nil {
+		return err
+	}
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(signalChan)
+	go func() {
+		for sig := range signalChan {
+			logger.Info("unmounting", "mountpoint", mountpoint, "signal", sig.String())
+			if err := m.Unmount(); err != nil {
+				logger.Error("failed to unmount; close the files open on it and retry", "mountpoint", mountpoint, "error", err)
+			}
+		}
+	}()
+	return m.Wait()
+}
+
+// metadataFlags name the metadata service keeping a namespace's manifests
+type metadataFlags struct {
+	backend, endpoints, prefix string
+}
+
+// addMetadataFlags adds the flags naming a metadata service
+func addMetadataFlags(flags *flag.FlagSet) *metadataFlags {
+	f := &metadataFlags{}
+	flags.StringVar(&f.backend, "metadata", "", "Metadata service keeping the namespace's manifests, embedded or etcd, as the gateway serving it uses")
+	flags.StringVar(&f.endpoints, "metadata-endpoints", "", "Comma-separated etcd endpoints of the etcd metadata service")
+	flags.StringVar(&f.prefix, "metadata-prefix", "", "Key prefix of the etcd metadata service")
+	return f
+}
+
+// open indexes a namespace's store in the metadata service, if one is
+// named
+func (f *metadataFlags) open(store *block.ObjectStore, blocks block.Blocks, namespace string) error {
+	if f.backend == "" {
+		return nil
+	}
+	cfg := config.MetadataConfig{Backend: f.backend, Prefix: f.prefix}
+	if f.endpoints != "" {
+		cfg.Endpoints = strings.Split(f.endpoints, ",")
+	}
+	index, err := meta.Open(cfg, blocks, namespace)
+	if err != nil {
+		return err
+	}
+	store.SetIndex(index)
+	return nil
+}
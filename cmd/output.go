@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// Formats of the -output flag
+const (
+	outputText = "text"
+	outputJSON = "json"
+)
+
+// outputFormat is the value of a command's -output flag, saying whether it
+// prints its results for people or as JSON for scripts
+type outputFormat string
+
+// addOutputFlag adds the -output flag to a command's flag set
+func addOutputFlag(flags *flag.FlagSet) *outputFormat {
+	f := outputFormat(outputText)
+	flags.Var(&f, "output", "Output format: text or json")
+	return &f
+}
+
+// String returns the format
+func (f *outputFormat) String() string {
+	return string(*f)
+}
+
+// Set parses the flag, refusing unknown formats
+func (f *outputFormat) Set(value string) error {
+	switch value {
+	case outputText, outputJSON:
+		*f = outputFormat(value)
+		return nil
+	}
+	return fmt.Errorf("unknown output format %q; expected text or json", value)
+}
+
+// json reports whether results are printed as JSON
+func (f *outputFormat) json() bool {
+	return *f == outputJSON
+}
+
+// writeJSON prints a value as indented JSON on stdout
+func writeJSON(v any) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode output: %w", err)
+	}
+	data = append(data, '\n')
+	_, err = os.Stdout.Write(data)
+	return err
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/gateway"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// presignURL prints a pre-signed URL of an object on the gateway, through
+// which a client without credentials can read or write it until it expires
+func presignURL(_ *options, args []string) error {
+	flags := newFlagSet("presign")
+	method := flags.String("method", http.MethodGet, "Method the URL allows: GET, PUT, HEAD or DELETE")
+	expires := flags.Duration("expires", time.Hour, "How long the URL stays valid, up to 7 days")
+	region := flags.String("region", "us-east-1", "Region of the gateway")
+	accessKey := flags.String("access-key", "env://AWS_ACCESS_KEY_ID", "Access key of a gateway credential, or a secret reference")
+	secretKey := flags.String("secret-key", "env://AWS_SECRET_ACCESS_KEY", "Secret key of the credential, or a secret reference")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return errors.New("presign takes the URL of an object on the gateway")
+	}
+	u, err := url.Parse(flags.Arg(0))
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return fmt.Errorf("invalid object URL %q", flags.Arg(0))
+	}
+	switch m := strings.ToUpper(*method); m {
+	case http.MethodGet, http.MethodPut, http.MethodHead, http.MethodDelete:
+		*method = m
+	default:
+		return fmt.Errorf("invalid method %q", *method)
+	}
+
+	access, err := config.ResolveSecret(*accessKey)
+	if err != nil {
+		return fmt.Errorf("failed to read access key: %w", err)
+	}
+	secret, err := config.ResolveSecret(*secretKey)
+	if err != nil {
+		return fmt.Errorf("failed to read secret key: %w", err)
+	}
+	signed, err := gateway.PresignURL(*method, u, access, secret, *region, *expires)
+	if err != nil {
+		return err
+	}
+	fmt.Println(signed)
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/node"
+	"github.com/3fs-storage/internal/systemd"
+	"github.com/3fs-storage/internal/tracing"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// serve runs the storage node until it is signalled to stop
+func serve(opts *options, args []string) error {
+	flags := newFlagSet("serve")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	// Load configuration
+	source, cfg, err := opts.load()
+	if err != nil {
+		return err
+	}
+
+	// Set up structured logging
+	logOutput, err := logging.Output(cfg.Storage.Logging)
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	defer logOutput.Close()
+	logger, err := logging.New(logOutput, cfg.Storage.Logging)
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	slog.SetDefault(logger)
+	for _, warning := range cfg.Warnings() {
+		logger.Warn("configuration upgraded", "change", warning)
+	}
+
+	// Set up tracing
+	shutdownTracing, err := tracing.Setup(cfg.Storage.Tracing, cfg.Storage.Node.ID)
+	if err != nil {
+		logger.Error("failed to configure tracing", "error", err)
+		os.Exit(1)
+	}
+	defer shutdownTracing(context.Background())
+
+	// Initialize the storage node
+	storageNode, err := node.NewStorageNode(cfg, logger)
+	if err != nil {
+		logger.Error("failed to initialize storage node", "error", err)
+		os.Exit(1)
+	}
+
+	// Start the storage node
+	if err := storageNode.Start(); err != nil {
+		logger.Error("failed to start storage node", "error", err)
+		os.Exit(1)
+	}
+
+	logger.Info("3FS Storage Service started",
+		"node", cfg.Storage.Node.ID,
+		"listen_address", cfg.Storage.Node.ListenAddress)
+
+	// Start returns once the targets are open, the node has caught up with
+	// its chains and its listeners accept, so systemd is told only now
+	if err := systemd.Notify(systemd.Ready, "STATUS=serving"); err != nil {
+		logger.Warn("failed to notify systemd", "error", err)
+	}
+
+	// Apply configuration changes without a restart, when the file changes
+	// or on SIGHUP
+	watcher := config.NewWatcher(source, cfg, opts.watchInterval, logger)
+	watcher.OnChange("logging", func(_, next *config.Config, _ []config.Change) error {
+		return logging.SetLevels(next.Storage.Logging)
+	}, "storage.logging.level", "storage.logging.components")
+	storageNode.RegisterReloadHooks(watcher)
+
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	defer stopWatching()
+	if opts.watchInterval > 0 {
+		go watcher.Run(watchCtx)
+	}
+	go systemd.RunWatchdog(watchCtx, func() error {
+		return storageNode.CheckAlive(5 * time.Second)
+	}, logger)
+
+	// Wait for shutdown signal
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-signalChan
+	for sig == syscall.SIGHUP {
+		systemd.Notify(systemd.Reloading)
+		if _, err := watcher.Reload(watchCtx); err != nil {
+			logger.Error("config reload failed", "source", source.String(), "error", err)
+		}
+		systemd.Notify(systemd.Ready)
+		sig = <-signalChan
+	}
+	stopWatching()
+	systemd.Notify(systemd.Stopping)
+
+	logger.Info("shutting down 3FS Storage Service", "signal", sig.String())
+	if err := storageNode.Stop(); err != nil {
+		logger.Error("error during shutdown", "error", err)
+		os.Exit(1)
+	}
+	logger.Info("shutdown complete")
+	return nil
+}
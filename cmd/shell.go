@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// shellPrompt is the prompt of the interactive shell
+const shellPrompt = "3fs> "
+
+// maxCompletions bounds the block IDs listed to complete an argument
+const maxCompletions = 1000
+
+// shellCommand is a command of the shell. complete, if set, completes its
+// arguments.
+type shellCommand struct {
+	name, args, summary string
+	run                 func(s *shell, args []string) error
+	complete            func(s *shell, args []string, word string) []string
+}
+
+// shellCommands lists the shell's commands, in the order help shows them.
+// It is set in init, as help refers to it.
+var shellCommands []shellCommand
+
+func init() {
+	shellCommands = []shellCommand{
+		{"ls", "[prefix]", "List block IDs", (*shell).list, nil},
+		{"stat", "<id>", "Show a block's metadata", (*shell).stat, completeBlocks},
+		{"cat", "<id>", "Print a block", (*shell).cat, completeBlocks},
+		{"get", "<id> <file>", "Read a block to a file", (*shell).get, completeBlocks},
+		{"put", "<id> <file>", "Write a block from a file", (*shell).put, nil},
+		{"del", "<id>...", "Delete blocks", (*shell).del, completeBlocks},
+		{"use", "<namespace>", "Select the namespace of the object commands", (*shell).use, nil},
+		{"objects", "[prefix]", "List the objects of the namespace", (*shell).objects, nil},
+		{"object", "<stat|get|put|rm> <key> [file]", "Inspect, read, write or delete an object", (*shell).object, completeObject},
+		{"stats", "", "Print the node's stats", (*shell).stats, nil},
+		{"chain", "<list|show> [chain]", "Inspect the chain table", (*shell).chain, completeChain},
+		{"connect", "<addr>", "Connect to another node", (*shell).connect, nil},
+		{"help", "", "List the commands", (*shell).help, nil},
+		{"exit", "", "Leave the shell", nil, nil},
+	}
+}
+
+// shell is an interactive session against a node, keeping its connection
+// between commands
+type shell struct {
+	opts      *options
+	node      *clientFlags
+	admin     string
+	client    *client.Client
+	namespace string
+	store     *block.ObjectStore
+	out       io.Writer
+	ctx       context.Context
+}
+
+// runShell reads commands from the terminal, with line editing, history
+// and completion, or from stdin when it is not a terminal
+func runShell(opts *options, args []string) error {
+	flags := newFlagSet("shell")
+	node := addClientFlags(flags)
+	admin := flags.String("admin", defaultAdminAddress, "Admin address of the node, as host:port or a URL")
+	namespace := flags.String("namespace", "", "Namespace of the object commands")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("shell takes no arguments")
+	}
+
+	s := &shell{opts: opts, node: node, admin: *admin, out: os.Stdout, ctx: context.Background()}
+	defer s.close()
+	if *namespace != "" {
+		if err := s.use([]string{*namespace}); err != nil {
+			return err
+		}
+	}
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if done := s.exec(scanner.Text()); done {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, shellPrompt)
+	t.AutoCompleteCallback = s.autoComplete
+	fmt.Fprintf(s.out, "Connected to %s. Type help for the commands, exit or Ctrl-D to leave.\n", node.address)
+	for {
+		// The terminal is raw only while a line is edited, so that the
+		// commands print as usual
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to set up the terminal: %w", err)
+		}
+		line, err := t.ReadLine()
+		term.Restore(fd, state)
+		if err == io.EOF {
+			fmt.Fprintln(s.out)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if done := s.exec(line); done {
+			return nil
+		}
+	}
+}
+
+// exec runs a command line, printing its error, and reports whether the
+// shell should end
+func (s *shell) exec(line string) bool {
+	words, err := splitWords(line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return false
+	}
+	if len(words) == 0 {
+		return false
+	}
+	name, args := words[0], words[1:]
+	if name == "exit" || name == "quit" {
+		return true
+	}
+	cmd, ok := lookupShellCommand(name)
+	if !ok {
+		fmt.Fprintf(os.Stderr, "error: unknown command %q; type help for the commands\n", name)
+		return false
+	}
+	if err := cmd.run(s, args); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	}
+	return false
+}
+
+// lookupShellCommand returns the shell command with a name
+func lookupShellCommand(name string) (shellCommand, bool) {
+	for _, cmd := range shellCommands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return shellCommand{}, false
+}
+
+// splitWords splits a command line into words at spaces, keeping quoted
+// strings together
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	for _, c := range line {
+		switch {
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			word.WriteRune(c)
+		case c == '"' || c == '\'':
+			quote, inWord = c, true
+		case c == ' ' || c == '\t':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// conn returns the connection to the node, connecting again if a previous
+// command lost it
+func (s *shell) conn() (*client.Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+	opts, err := s.node.options()
+	if err != nil {
+		return nil, err
+	}
+	c, err := client.DialWithOptions(s.node.address, opts)
+	if err != nil {
+		return nil, err
+	}
+	s.client = c
+	if s.namespace != "" {
+		if s.store, err = block.NewNamespacedObjectStore(block.NewClientBlocks(c), 0, s.namespace); err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// call runs fn on the connection, dropping the connection if fn fails on
+// the transport, so that the next command reconnects
+func (s *shell) call(fn func(c *client.Client) error) error {
+	c, err := s.conn()
+	if err != nil {
+		return err
+	}
+	err = fn(c)
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		s.close()
+	}
+	return err
+}
+
+// close closes the connection
+func (s *shell) close() {
+	if s.client != nil {
+		s.client.Close()
+		s.client, s.store = nil, nil
+	}
+}
+
+// autoComplete completes the word before the cursor on tab: command names
+// first, then the arguments the command completes. With several
+// candidates the word is extended to their common prefix.
+func (s *shell) autoComplete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	before := line[:pos]
+	words, err := splitWords(before)
+	if err != nil {
+		return "", 0, false
+	}
+	word := ""
+	if len(words) > 0 && !strings.HasSuffix(before, " ") {
+		word, words = words[len(words)-1], words[:len(words)-1]
+	}
+
+	var candidates []string
+	if len(words) == 0 {
+		for _, cmd := range shellCommands {
+			candidates = append(candidates, cmd.name)
+		}
+	} else if cmd, ok := lookupShellCommand(words[0]); ok && cmd.complete != nil {
+		candidates = cmd.complete(s, words[1:], word)
+	}
+
+	completion := commonPrefix(word, candidates)
+	if completion == word {
+		return "", 0, false
+	}
+	if len(candidates) == 1 {
+		completion += " "
+	}
+	newBefore := before[:len(before)-len(word)] + completion
+	return newBefore + line[pos:], len(newBefore), true
+}
+
+// commonPrefix returns the longest prefix of the candidates starting with
+// word
+func commonPrefix(word string, candidates []string) string {
+	prefix, found := "", false
+	for _, c := range candidates {
+		if !strings.HasPrefix(c, word) {
+			continue
+		}
+		if !found {
+			prefix, found = c, true
+			continue
+		}
+		for !strings.HasPrefix(c, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if !found {
+		return word
+	}
+	return prefix
+}
+
+// completeBlocks completes block IDs from the node's listing
+func completeBlocks(s *shell, _ []string, word string) []string {
+	var ids []string
+	s.call(func(c *client.Client) error {
+		var err error
+		ids, err = c.List(s.ctx, word)
+		return err
+	})
+	if len(ids) > maxCompletions {
+		ids = ids[:maxCompletions]
+	}
+	return ids
+}
+
+// completeObject completes the subcommands of object, then object keys
+func completeObject(s *shell, args []string, word string) []string {
+	if len(args) == 0 {
+		return []string{"stat", "get", "put", "rm"}
+	}
+	if len(args) > 1 {
+		return nil
+	}
+	keys, _ := s.listObjects(word)
+	return keys
+}
+
+// completeChain completes the subcommands of chain
+func completeChain(_ *shell, args []string, _ string) []string {
+	if len(args) == 0 {
+		return []string{"list", "show"}
+	}
+	return nil
+}
+
+// help lists the commands
+func (s *shell) help([]string) error {
+	for _, cmd := range shellCommands {
+		fmt.Fprintf(s.out, "  %-40s %s\n", strings.TrimSpace(cmd.name+" "+cmd.args), cmd.summary)
+	}
+	return nil
+}
+
+// connect switches to another node
+func (s *shell) connect(args []string) error {
+	if len(args) != 1 {
+		return errors.New("connect takes an address")
+	}
+	s.close()
+	s.node.address = args[0]
+	_, err := s.conn()
+	return err
+}
+
+// list prints the block IDs with a prefix
+func (s *shell) list(args []string) error {
+	if len(args) > 1 {
+		return errors.New("ls takes at most a prefix")
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	return s.call(func(c *client.Client) error {
+		ids, err := c.List(s.ctx, prefix)
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			fmt.Fprintln(s.out, id)
+		}
+		return nil
+	})
+}
+
+// stat prints a block's metadata
+func (s *shell) stat(args []string) error {
+	if len(args) != 1 {
+		return errors.New("stat takes a block ID")
+	}
+	return s.call(func(c *client.Client) error {
+		stat, err := c.Stat(s.ctx, args[0])
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(s.out, "size:          %d\nversion:       %d\nchecksum:      %s\ncreated:       %d\nlast modified: %d\n",
+			stat.Size, stat.Version, stat.Checksum, stat.CreatedAt, stat.LastModified)
+		return nil
+	})
+}
+
+// cat prints a block
+func (s *shell) cat(args []string) error {
+	if len(args) != 1 {
+		return errors.New("cat takes a block ID")
+	}
+	return s.call(func(c *client.Client) error {
+		data, err := c.Read(s.ctx, args[0])
+		if err != nil {
+			return err
+		}
+		s.out.Write(data)
+		if len(data) > 0 && data[len(data)-1] != '\n' {
+			fmt.Fprintln(s.out)
+		}
+		return nil
+	})
+}
+
+// get reads a block to a file
+func (s *shell) get(args []string) error {
+	if len(args) != 2 {
+		return errors.New("get takes a block ID and a file")
+	}
+	return s.call(func(c *client.Client) error {
+		data, err := c.Read(s.ctx, args[0])
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(args[1], data, 0o644)
+	})
+}
+
+// put writes a block from a file
+func (s *shell) put(args []string) error {
+	if len(args) != 2 {
+		return errors.New("put takes a block ID and a file")
+	}
+	data, err := os.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	return s.call(func(c *client.Client) error {
+		return c.Write(s.ctx, args[0], data)
+	})
+}
+
+// del deletes blocks
+func (s *shell) del(args []string) error {
+	if len(args) == 0 {
+		return errors.New("del takes at least one block ID")
+	}
+	return s.call(func(c *client.Client) error {
+		for _, id := range args {
+			if err := c.Delete(s.ctx, id); err != nil {
+				return fmt.Errorf("failed to delete %s: %w", id, err)
+			}
+		}
+		return nil
+	})
+}
+
+// use selects the namespace of the object commands
+func (s *shell) use(args []string) error {
+	if len(args) != 1 {
+		return errors.New("use takes a namespace")
+	}
+	namespace := args[0]
+	if strings.Contains(namespace, api.NamespaceSeparator) {
+		return errors.New("the namespace cannot hold a separator")
+	}
+	if err := api.ValidateBlockID(namespace + api.NamespaceSeparator); err != nil {
+		return fmt.Errorf("invalid namespace: %w", err)
+	}
+	s.namespace, s.store = namespace, nil
+	if s.client != nil {
+		var err error
+		s.store, err = block.NewNamespacedObjectStore(block.NewClientBlocks(s.client), 0, namespace)
+		return err
+	}
+	return nil
+}
+
+// listObjects returns the keys of the namespace's objects with a prefix,
+// unescaped as the gateway shows them
+func (s *shell) listObjects(prefix string) ([]string, error) {
+	if s.namespace == "" {
+		return nil, errors.New("no namespace selected; run use <namespace>")
+	}
+	var keys []string
+	err := s.call(func(*client.Client) error {
+		names, err := s.store.ListObjects(s.ctx, block.EscapeName(prefix))
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if key, err := block.UnescapeName(name); err == nil {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	sort.Strings(keys)
+	return keys, err
+}
+
+// objects lists the namespace's objects
+func (s *shell) objects(args []string) error {
+	if len(args) > 1 {
+		return errors.New("objects takes at most a prefix")
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+	keys, err := s.listObjects(prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		fmt.Fprintln(s.out, key)
+	}
+	return nil
+}
+
+// object inspects, reads, writes or deletes an object of the namespace
+func (s *shell) object(args []string) error {
+	if len(args) < 2 {
+		return errors.New("object takes a subcommand and a key")
+	}
+	if s.namespace == "" {
+		return errors.New("no namespace selected; run use <namespace>")
+	}
+	sub, name := args[0], block.EscapeName(args[1])
+	return s.call(func(*client.Client) error {
+		switch sub {
+		case "stat":
+			manifest, err := s.store.HeadObject(s.ctx, name)
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(s.out, "size:     %d\nblocks:   %d\nchecksum: %s\ncreated:  %d\n",
+				manifest.Size, len(manifest.Blocks), manifest.Checksum, manifest.CreatedAt)
+			return nil
+		case "get":
+			w := s.out
+			if len(args) == 3 {
+				f, err := os.Create(args[2])
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				w = f
+			}
+			_, err := s.store.GetObject(s.ctx, name, w)
+			return err
+		case "put":
+			if len(args) != 3 {
+				return errors.New("object put takes a key and a file")
+			}
+			f, err := os.Open(args[2])
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			_, err = s.store.PutObject(s.ctx, name, f, block.ObjectAttributes{})
+			return err
+		case "rm":
+			return s.store.DeleteObject(s.ctx, name)
+		}
+		return fmt.Errorf("unknown object subcommand %q", sub)
+	})
+}
+
+// stats prints the node's stats from its admin API
+func (s *shell) stats([]string) error {
+	admin := &adminFlags{address: s.admin, timeout: s.node.timeout}
+	body, err := admin.do(http.MethodGet, "/v1/stats")
+	if err != nil {
+		return err
+	}
+	return printJSON(body)
+}
+
+// chain runs the chain list and show commands against the node's
+// coordinator
+func (s *shell) chain(args []string) error {
+	if len(args) == 0 || (args[0] != "list" && args[0] != "show") {
+		return errors.New("chain takes list or show")
+	}
+	chainArgs := append([]string{args[0], "-coordinator", s.admin}, args[1:]...)
+	return chainAdmin(s.opts, chainArgs)
+}
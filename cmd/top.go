@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/node"
+)
+
+// topSample is the stats of a node at one refresh, or the error fetching
+// them
+type topSample struct {
+	stats *node.NodeStats
+	err   error
+}
+
+// topRow is a node's activity between two refreshes, as top shows it and
+// prints it with -output json. Rates are per second, latencies in
+// milliseconds over every operation, and HitRate the fraction of block
+// cache lookups that hit, or -1 without lookups.
+type topRow struct {
+	Node           string  `json:"node"`
+	Address        string  `json:"address"`
+	Error          string  `json:"error,omitempty"`
+	ReadsPerSec    float64 `json:"reads_per_sec"`
+	WritesPerSec   float64 `json:"writes_per_sec"`
+	OtherPerSec    float64 `json:"other_per_sec"`
+	FailedPerSec   float64 `json:"failed_per_sec"`
+	InBytesPerSec  float64 `json:"in_bytes_per_sec"`
+	OutBytesPerSec float64 `json:"out_bytes_per_sec"`
+	P50Ms          float64 `json:"p50_ms"`
+	P99Ms          float64 `json:"p99_ms"`
+	P999Ms         float64 `json:"p999_ms"`
+	HitRate        float64 `json:"cache_hit_rate"`
+	DirtyVersions  int     `json:"dirty_versions"`
+	CommitLagMs    float64 `json:"commit_lag_ms"`
+	Queued         int     `json:"queued"`
+	Inflight       int     `json:"inflight"`
+	Connections    int64   `json:"connections"`
+	latency        node.LatencyStats
+}
+
+// topNodes shows the activity of a cluster's nodes, refreshed on an
+// interval from their stats, until interrupted
+func topNodes(_ *options, args []string) error {
+	flags := newFlagSet("top")
+	admin := addAdminFlags(flags, defaultAdminAddress)
+	coordinators := flags.String("coordinator", "", "Admin addresses of the coordinator replicas, comma-separated, to show every node in the routing table instead of -admin")
+	interval := flags.Duration("interval", time.Second, "How often to refresh")
+	iterations := flags.Int("n", 0, "Number of refreshes before exiting; 0 runs until interrupted")
+	output := addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("top takes no arguments")
+	}
+	if *interval <= 0 {
+		return errors.New("-interval must be positive")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	addresses := strings.Split(admin.address, ",")
+	if *coordinators != "" {
+		var err error
+		if addresses, err = clusterAdminAddresses(ctx, *coordinators); err != nil {
+			return err
+		}
+	}
+
+	clear := !output.json() && term.IsTerminal(int(os.Stdout.Fd()))
+	previous := sampleNodes(admin, addresses)
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for i := 0; *iterations == 0 || i < *iterations; i++ {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+		current := sampleNodes(admin, addresses)
+		rows := make([]topRow, len(addresses))
+		for j, address := range addresses {
+			rows[j] = newTopRow(address, previous[j], current[j])
+		}
+		previous = current
+
+		var err error
+		if output.json() {
+			err = writeTopJSON(rows)
+		} else {
+			err = printTop(rows, *interval, clear)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterAdminAddresses returns the admin addresses of the nodes in the
+// routing table
+func clusterAdminAddresses(ctx context.Context, coordinators string) ([]string, error) {
+	coord, err := coordinator.NewClient(strings.Split(coordinators, ","))
+	if err != nil {
+		return nil, err
+	}
+	table, err := coord.FetchRouting(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch the routing table: %w", err)
+	}
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, record := range table.Nodes {
+		if record.AdminAddress != "" && !seen[record.AdminAddress] {
+			seen[record.AdminAddress] = true
+			addresses = append(addresses, record.AdminAddress)
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, errors.New("the routing table names no node admin addresses")
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// sampleNodes fetches the stats of the nodes at the admin addresses at
+// the same time
+func sampleNodes(admin *adminFlags, addresses []string) []topSample {
+	samples := make([]topSample, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			f := &adminFlags{address: address, timeout: admin.timeout}
+			body, err := f.do(http.MethodGet, "/v1/stats")
+			if err != nil {
+				samples[i].err = err
+				return
+			}
+			var stats node.NodeStats
+			if err := json.Unmarshal(body, &stats); err != nil {
+				samples[i].err = fmt.Errorf("failed to decode stats: %w", err)
+				return
+			}
+			samples[i].stats = &stats
+		}(i, address)
+	}
+	wg.Wait()
+	return samples
+}
+
+// newTopRow computes a node's activity between two samples. Rates need
+// both samples; the gauges only the current one.
+func newTopRow(address string, prev, cur topSample) topRow {
+	row := topRow{Address: address, HitRate: -1}
+	if cur.err != nil {
+		row.Error = cur.err.Error()
+		return row
+	}
+	s := cur.stats
+	row.Node = s.NodeID
+	row.Queued = s.Scheduler.Queued
+	row.Inflight = s.Transport.Inflight
+	row.Connections = s.Transport.Connections
+	if s.Chain != nil {
+		row.DirtyVersions = s.Chain.DirtyVersions
+		row.CommitLagMs = float64(s.Chain.OldestDirtyNanos) / float64(time.Millisecond)
+	}
+	// A node that restarted has counters lower than before, which would
+	// make the rates meaningless until the next refresh
+	if prev.stats == nil || prev.stats.Transport.RequestsServed > s.Transport.RequestsServed {
+		return row
+	}
+	p := prev.stats
+	seconds := float64(s.Timestamp-p.Timestamp) / float64(time.Second)
+	if seconds <= 0 {
+		return row
+	}
+
+	for name, op := range s.Transport.Ops {
+		before, ok := p.Transport.Ops[name]
+		if !ok {
+			before = &node.OpStats{}
+		}
+		requests := float64(op.Requests-before.Requests) / seconds
+		switch name {
+		case "read", "fetch":
+			row.ReadsPerSec += requests
+		case "write", "delete":
+			row.WritesPerSec += requests
+		default:
+			row.OtherPerSec += requests
+		}
+		row.FailedPerSec += float64(op.Failed-before.Failed) / seconds
+		row.InBytesPerSec += float64(op.BytesIn-before.BytesIn) / seconds
+		row.OutBytesPerSec += float64(op.BytesOut-before.BytesOut) / seconds
+		row.latency.Add(op.Latency.Sub(before.Latency))
+	}
+	row.P50Ms = durationMs(row.latency.Percentile(0.5))
+	row.P99Ms = durationMs(row.latency.Percentile(0.99))
+	row.P999Ms = durationMs(row.latency.Percentile(0.999))
+
+	hits := s.Storage.CacheHits - p.Storage.CacheHits
+	misses := s.Storage.CacheMisses - p.Storage.CacheMisses
+	if hits+misses > 0 && s.Storage.CacheHits >= p.Storage.CacheHits {
+		row.HitRate = float64(hits) / float64(hits+misses)
+	}
+	return row
+}
+
+// durationMs returns a duration in milliseconds
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// writeTopJSON prints a refresh as a line of JSON
+func writeTopJSON(rows []topRow) error {
+	data, err := json.Marshal(map[string]any{"time": time.Now().UTC().Format(time.RFC3339), "nodes": rows})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Printf("%s\n", data)
+	return err
+}
+
+// printTop prints a refresh as a table with a line per node and the
+// cluster's totals, over the previous one on a terminal
+func printTop(rows []topRow, interval time.Duration, clear bool) error {
+	if clear {
+		fmt.Print("\033[H\033[2J")
+	}
+	fmt.Printf("%s  %d nodes, refreshed every %s\n\n", time.Now().Format("15:04:05"), len(rows), interval)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "NODE\tREAD/S\tWRITE/S\tIN MB/S\tOUT MB/S\tP50\tP99\tP99.9\tHIT%\tDIRTY\tLAG\tQUEUED\tINFLIGHT\tCONNS\t")
+	total := topRow{Node: "TOTAL", HitRate: -1}
+	for _, row := range rows {
+		name := row.Node
+		if name == "" {
+			name = row.Address
+		}
+		if row.Error != "" {
+			fmt.Fprintf(w, "%s\t%s\t\t\t\t\t\t\t\t\t\t\t\t\t\n", name, "unreachable")
+			continue
+		}
+		printTopRow(w, name, row)
+		total.ReadsPerSec += row.ReadsPerSec
+		total.WritesPerSec += row.WritesPerSec
+		total.InBytesPerSec += row.InBytesPerSec
+		total.OutBytesPerSec += row.OutBytesPerSec
+		total.latency.Add(row.latency)
+		total.DirtyVersions += row.DirtyVersions
+		total.CommitLagMs = max(total.CommitLagMs, row.CommitLagMs)
+		total.Queued += row.Queued
+		total.Inflight += row.Inflight
+		total.Connections += row.Connections
+	}
+	if len(rows) > 1 {
+		total.P50Ms = durationMs(total.latency.Percentile(0.5))
+		total.P99Ms = durationMs(total.latency.Percentile(0.99))
+		total.P999Ms = durationMs(total.latency.Percentile(0.999))
+		printTopRow(w, total.Node, total)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if row.Error != "" {
+			fmt.Printf("\n%s: %s", row.Address, row.Error)
+		}
+	}
+	fmt.Println()
+	return nil
+}
+
+// printTopRow prints the columns of a node's line
+func printTopRow(w *tabwriter.Writer, name string, row topRow) {
+	hitRate := "-"
+	if row.HitRate >= 0 {
+		hitRate = fmt.Sprintf("%.1f", row.HitRate*100)
+	}
+	fmt.Fprintf(w, "%s\t%.0f\t%.0f\t%.1f\t%.1f\t%s\t%s\t%s\t%s\t%d\t%s\t%d\t%d\t%d\t\n",
+		name, row.ReadsPerSec, row.WritesPerSec, row.InBytesPerSec/1e6, row.OutBytesPerSec/1e6,
+		formatMs(row.P50Ms), formatMs(row.P99Ms), formatMs(row.P999Ms), hitRate,
+		row.DirtyVersions, formatMs(row.CommitLagMs), row.Queued, row.Inflight, row.Connections)
+}
+
+// formatMs formats a latency in milliseconds, or a dash for none
+func formatMs(ms float64) string {
+	switch {
+	case ms == 0:
+		return "-"
+	case ms < 1:
+		return fmt.Sprintf("%.0fµs", ms*1000)
+	case ms < 1000:
+		return fmt.Sprintf("%.1fms", ms)
+	}
+	return fmt.Sprintf("%.1fs", ms/1000)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+)
+
+// printUsage prints the use each namespace made of the cluster, as the
+// coordinator added it up
+func printUsage(_ *options, args []string) error {
+	cmd, _ := lookupCommand("usage")
+	flags := commandFlagSet("usage", cmd)
+	addresses := flags.String("coordinator", defaultAdminAddress, "Admin addresses of the coordinator replicas, comma-separated")
+	namespace := flags.String("namespace", "", "Only report this namespace")
+	since := flags.Duration("since", 24*time.Hour, "Report the windows of this last span of time, or every window kept if zero")
+	output := addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	coord, err := coordinator.NewClient(strings.Split(*addresses, ","))
+	if err != nil {
+		return err
+	}
+	summary, err := coord.Usage(context.Background(), *namespace, *since)
+	if err != nil {
+		return fmt.Errorf("failed to fetch usage: %w", err)
+	}
+	if output.json() {
+		return writeJSON(summary)
+	}
+
+	namespaces := make([]string, 0, len(summary.Namespaces))
+	for ns := range summary.Namespaces {
+		namespaces = append(namespaces, ns)
+	}
+	slices.Sort(namespaces)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tSTORED\tBLOCKS\tREQUESTS\tREADS\tWRITES\tDELETES\tIN\tOUT")
+	for _, ns := range namespaces {
+		u := summary.Namespaces[ns]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%d\t%d\t%d\n", orDash(ns), u.StoredBytes, u.Blocks,
+			u.Requests, u.Reads, u.Writes, u.Deletes, u.BytesIn, u.BytesOut)
+	}
+	return w.Flush()
+}
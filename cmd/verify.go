@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/verify"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// verifyCluster checks that every block of a cluster has its replicas,
+// that they agree, and that the nodes serve the chains the coordinator
+// gives them. It fails if anything was found wrong.
+func verifyCluster(_ *options, args []string) error {
+	flags := newFlagSet("verify")
+	node := addClientFlags(flags)
+	coordinators := flags.String("coordinator", "", "Admin addresses of the coordinator replicas, comma-separated")
+	var verifyOpts verify.Options
+	flags.StringVar(&verifyOpts.Prefix, "prefix", "", "Verify only blocks with IDs starting with this prefix")
+	flags.BoolVar(&verifyOpts.Deep, "deep", false, "Read every replica and check its data against its checksum")
+	flags.IntVar(&verifyOpts.Workers, "workers", verify.DefaultWorkers, "Number of blocks checked at the same time")
+	flags.IntVar(&verifyOpts.Factor, "factor", 0, "Replication factor of the cluster; 0 asks a node")
+	output := addOutputFlag(flags)
+	logLevel := flags.String("log-level", "info", "Log level: debug, info, warn or error")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("verify takes no arguments")
+	}
+	if *coordinators == "" {
+		return errors.New("verify needs -coordinator")
+	}
+
+	logger, err := logging.New(os.Stderr, config.LoggingConfig{Level: *logLevel})
+	if err != nil {
+		return fmt.Errorf("failed to configure logging: %w", err)
+	}
+	clientOpts, err := node.options()
+	if err != nil {
+		return err
+	}
+
+	// Stopping ends the verification, reporting what was checked so far
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	table, err := fetchRouting(ctx, *coordinators)
+	if err != nil {
+		return err
+	}
+	dial := func(address string) (*client.Client, error) {
+		return client.DialWithOptions(address, clientOpts)
+	}
+	admin := func(_ context.Context, address, path string) ([]byte, error) {
+		f := &adminFlags{address: address, timeout: node.timeout}
+		return f.do(http.MethodGet, path)
+	}
+
+	report, err := verify.Run(ctx, table, dial, admin, verifyOpts, logger)
+	if report != nil {
+		var writeErr error
+		if output.json() {
+			writeErr = writeJSON(report)
+		} else {
+			writeErr = printVerify(report)
+		}
+		if writeErr != nil {
+			return writeErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if !report.Intact() {
+		return fmt.Errorf("verification found %d problems", len(report.Problems))
+	}
+	return nil
+}
+
+// printVerify prints a verification's summary and the problems it found
+func printVerify(report *verify.Report) error {
+	elapsed := time.Duration(report.FinishedAt - report.StartedAt).Round(time.Millisecond)
+	mode := "metadata"
+	if report.Options.Deep {
+		mode = "data"
+	}
+	fmt.Printf("routing table version %d: %d nodes, %d targets\n", report.TableVersion, report.Nodes, report.Targets)
+	fmt.Printf("%d blocks, %d replicas checked (%s) in %s\n", report.Blocks, report.Replicas, mode, elapsed)
+	if report.Unverified > 0 {
+		fmt.Printf("%d blocks have replicas that could not be verified\n", report.Unverified)
+	}
+	if report.Intact() {
+		fmt.Println("no problems found")
+		return nil
+	}
+
+	counts := report.Counts()
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	summary := make([]string, len(kinds))
+	for i, kind := range kinds {
+		summary[i] = fmt.Sprintf("%d %s", counts[kind], kind)
+	}
+	fmt.Printf("%d problems: %s\n\n", len(report.Problems), strings.Join(summary, ", "))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "KIND\tTARGET\tBLOCK\tDETAIL")
+	for _, p := range report.Problems {
+		block := p.BlockID
+		if block == "" {
+			block = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.Kind, p.Target, block, p.Detail)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// watchRetryInterval is how long watch waits before subscribing again
+// after the node's event stream ends
+const watchRetryInterval = 2 * time.Second
+
+// watchEvents prints the block events of a node as they happen, until
+// interrupted. A stream the node ends, such as on a restart, is
+// subscribed to again.
+func watchEvents(_ *options, args []string) error {
+	flags := newFlagSet("watch")
+	admin := addAdminFlags(flags, defaultAdminAddress)
+	prefix := flags.String("prefix", "", "Watch only the blocks whose ID starts with this")
+	output := addOutputFlag(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return errors.New("watch takes no arguments; use -prefix")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	path := api.EventsPath
+	if *prefix != "" {
+		path += "?" + url.Values{"prefix": {*prefix}}.Encode()
+	}
+	var lastSeq uint64
+	for {
+		err := streamEvents(ctx, admin, path, func(e api.BlockEvent) error {
+			if lastSeq != 0 && e.Seq < lastSeq {
+				fmt.Fprintln(os.Stderr, "node restarted; event sequence numbers start over")
+			}
+			lastSeq = e.Seq
+			return printEvent(output, e)
+		})
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err == nil {
+			err = errors.New("stream ended")
+		}
+		fmt.Fprintf(os.Stderr, "event stream of %s interrupted: %v; subscribing again\n", admin.address, err)
+		select {
+		case <-time.After(watchRetryInterval):
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// streamEvents subscribes to a node's event stream and calls fn with each
+// event until the stream or the context ends
+func streamEvents(ctx context.Context, admin *adminFlags, path string, fn func(api.BlockEvent) error) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, admin.url(path), nil)
+	if err != nil {
+		return err
+	}
+	// The stream has no end, so only the connection is bounded by the
+	// timeout
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = admin.timeout
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return fmt.Errorf("node returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		var e api.BlockEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return fmt.Errorf("failed to decode event: %w", err)
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// printEvent prints an event as a line of text, or as a line of JSON with
+// -output json
+func printEvent(output *outputFormat, e api.BlockEvent) error {
+	if output.json() {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Printf("%s\n", data)
+		return err
+	}
+
+	at := time.Unix(0, e.Time).Format(time.RFC3339Nano)
+	switch e.Type {
+	case api.EventDropped:
+		_, err := fmt.Printf("%s %d events dropped: reading too slowly\n", at, e.Count)
+		return err
+	case api.EventDeleted:
+		_, err := fmt.Printf("%s %-7s %s target=%s\n", at, e.Type, e.BlockID, e.Target)
+		return err
+	}
+	_, err := fmt.Printf("%s %-7s %s target=%s size=%d version=%d checksum=%s\n",
+		at, e.Type, e.BlockID, e.Target, e.Size, e.Version, e.Checksum)
+	return err
+}
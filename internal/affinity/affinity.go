@@ -0,0 +1,246 @@
+// Package affinity runs work on OS threads pinned to chosen CPUs. On a
+// server with several sockets, a request served by a CPU of the socket its
+// network card or disk hangs off avoids crossing the interconnect for every
+// byte it copies or checksums.
+//
+// Goroutines are not tied to a thread, so work is handed to a Pool: workers
+// that each lock themselves to an OS thread and pin that thread to the
+// pool's CPUs. The CPUs of a device's NUMA node are found in sysfs, on
+// Linux only.
+package affinity
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnsupported is returned where threads cannot be pinned or the NUMA
+// topology cannot be read
+var ErrUnsupported = errors.New("CPU affinity is not supported on this platform")
+
+// maxCPUs is the highest CPU number a set can hold, plus one
+const maxCPUs = 1024
+
+// CPUSet is a sorted set of CPU numbers
+type CPUSet []int
+
+// ParseCPUList parses a CPU list as the kernel writes them, such as
+// "0-7,16-23"
+func ParseCPUList(list string) (CPUSet, error) {
+	seen := make(map[int]bool)
+	set := make(CPUSet, 0)
+	for _, part := range strings.Split(strings.TrimSpace(list), ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last := part, part
+		if i := strings.IndexByte(part, '-'); i >= 0 {
+			first, last = part[:i], part[i+1:]
+		}
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU list %q: %w", list, err)
+		}
+		hi, err := strconv.Atoi(last)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CPU list %q: %w", list, err)
+		}
+		if lo < 0 || hi < lo || hi >= maxCPUs {
+			return nil, fmt.Errorf("invalid CPU range %q in %q", part, list)
+		}
+		for cpu := lo; cpu <= hi; cpu++ {
+			if !seen[cpu] {
+				seen[cpu] = true
+				set = append(set, cpu)
+			}
+		}
+	}
+	if len(set) == 0 {
+		return nil, fmt.Errorf("CPU list %q is empty", list)
+	}
+	sort.Ints(set)
+	return set, nil
+}
+
+// String formats the set as a CPU list, with runs as ranges
+func (s CPUSet) String() string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		j := i
+		for j+1 < len(s) && s[j+1] == s[j]+1 {
+			j++
+		}
+		if b.Len() > 0 {
+			b.WriteByte(',')
+		}
+		if j == i {
+			fmt.Fprintf(&b, "%d", s[i])
+		} else {
+			fmt.Fprintf(&b, "%d-%d", s[i], s[j])
+		}
+		i = j + 1
+	}
+	return b.String()
+}
+
+// mask returns the set as the bit mask sched_setaffinity takes
+func (s CPUSet) mask() [maxCPUs / 64]uint64 {
+	var mask [maxCPUs / 64]uint64
+	for _, cpu := range s {
+		mask[cpu/64] |= 1 << (uint(cpu) % 64)
+	}
+	return mask
+}
+
+// NUMANode is a NUMA node and its CPUs
+type NUMANode struct {
+	ID   int    `json:"id"`
+	CPUs CPUSet `json:"cpus"`
+}
+
+// NodeCPUs returns the CPUs of the NUMA node with the given ID
+func NodeCPUs(nodes []NUMANode, id int) (CPUSet, bool) {
+	for _, node := range nodes {
+		if node.ID == id {
+			return node.CPUs, true
+		}
+	}
+	return nil, false
+}
+
+// Pool runs work on a fixed number of workers, each locked to an OS thread
+// pinned to the pool's CPUs. A nil pool runs work on the caller's
+// goroutine, unpinned.
+type Pool struct {
+	name    string
+	cpus    CPUSet
+	work    chan func()
+	stop    chan struct{}
+	once    sync.Once
+	wg      sync.WaitGroup
+	busy    atomic.Int64
+	ran     atomic.Uint64
+	pinned  atomic.Int64
+	pinErr  atomic.Value
+	workers int
+}
+
+// NewPool starts a pool of workers pinned to cpus
+func NewPool(name string, workers int, cpus CPUSet) (*Pool, error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("pool %s needs at least one worker", name)
+	}
+	if len(cpus) == 0 {
+		return nil, fmt.Errorf("pool %s has no CPUs", name)
+	}
+	p := &Pool{
+		name:    name,
+		cpus:    cpus,
+		work:    make(chan func()),
+		stop:    make(chan struct{}),
+		workers: workers,
+	}
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.worker()
+	}
+	return p, nil
+}
+
+// worker pins its thread and runs work until the pool is closed. The
+// thread stays locked when the worker exits, so that the runtime discards
+// it rather than reuse a pinned thread for other goroutines.
+func (p *Pool) worker() {
+	defer p.wg.Done()
+	runtime.LockOSThread()
+	if err := setAffinity(p.cpus); err != nil {
+		p.pinErr.Store(err)
+	} else {
+		p.pinned.Add(1)
+	}
+
+	for {
+		select {
+		case fn := <-p.work:
+			fn()
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Run runs fn on one of the pool's workers and waits for it to return. It
+// gives up if ctx is done before a worker is free; once the pool is
+// closed, fn runs on the caller's goroutine.
+func (p *Pool) Run(ctx context.Context, fn func()) error {
+	if p == nil {
+		fn()
+		return nil
+	}
+	done := make(chan struct{})
+	task := func() {
+		defer close(done)
+		p.busy.Add(1)
+		defer p.busy.Add(-1)
+		fn()
+		p.ran.Add(1)
+	}
+	select {
+	case p.work <- task:
+		<-done
+		return nil
+	case <-p.stop:
+		fn()
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to run on %s workers: %w", p.name, ctx.Err())
+	}
+}
+
+// Close stops the pool's workers once they finish what they run
+func (p *Pool) Close() {
+	if p == nil {
+		return
+	}
+	p.once.Do(func() { close(p.stop) })
+	p.wg.Wait()
+}
+
+// PoolStats reports a pool's placement and load. Pinned counts the workers
+// whose thread was pinned, and Error why the others were not.
+type PoolStats struct {
+	Name    string `json:"name"`
+	CPUs    string `json:"cpus"`
+	Workers int    `json:"workers"`
+	Pinned  int    `json:"pinned"`
+	Busy    int    `json:"busy"`
+	Ran     uint64 `json:"ran"`
+	Error   string `json:"error,omitempty"`
+}
+
+// Stats returns the pool's placement and load
+func (p *Pool) Stats() *PoolStats {
+	if p == nil {
+		return nil
+	}
+	stats := &PoolStats{
+		Name:    p.name,
+		CPUs:    p.cpus.String(),
+		Workers: p.workers,
+		Pinned:  int(p.pinned.Load()),
+		Busy:    int(p.busy.Load()),
+		Ran:     p.ran.Load(),
+	}
+	if err, ok := p.pinErr.Load().(error); ok {
+		stats.Error = err.Error()
+	}
+	return stats
+}
@@ -0,0 +1,175 @@
+//go:build linux
+
+package affinity
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// nodeDir lists the NUMA nodes and their CPUs
+const nodeDir = "/sys/devices/system/node"
+
+// Nodes returns the machine's NUMA nodes. A machine whose kernel does not
+// list them is a single node holding every CPU.
+func Nodes() ([]NUMANode, error) {
+	dirs, err := filepath.Glob(filepath.Join(nodeDir, "node[0-9]*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(dirs) == 0 {
+		cpus := make(CPUSet, runtime.NumCPU())
+		for i := range cpus {
+			cpus[i] = i
+		}
+		return []NUMANode{{ID: 0, CPUs: cpus}}, nil
+	}
+
+	nodes := make([]NUMANode, 0, len(dirs))
+	for _, dir := range dirs {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(dir), "node"))
+		if err != nil {
+			continue
+		}
+		list, err := ioutil.ReadFile(filepath.Join(dir, "cpulist"))
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(list)) == "" {
+			// A node with memory but no CPUs
+			continue
+		}
+		cpus, err := ParseCPUList(string(list))
+		if err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, NUMANode{ID: id, CPUs: cpus})
+	}
+	return nodes, nil
+}
+
+// PathNode returns the NUMA node of the disk holding path, or -1 if it is
+// not known, as for a virtual disk. Device-mapper and md devices take the
+// node of the first of their disks that has one.
+func PathNode(path string) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1, err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return -1, ErrUnsupported
+	}
+	dev := uint64(st.Dev)
+	major := (dev>>8)&0xfff | (dev>>32)&^0xfff
+	minor := dev&0xff | (dev>>12)&^0xff
+	dir, err := filepath.EvalSymlinks("/sys/dev/block/" + strconv.FormatUint(major, 10) + ":" + strconv.FormatUint(minor, 10))
+	if err != nil {
+		return -1, nil
+	}
+	return blockNode(dir, 0), nil
+}
+
+// blockNode finds the NUMA node of a block device's sysfs directory in the
+// nearest of its parents that records one, or in its underlying disks
+func blockNode(dir string, depth int) int {
+	for d := dir; d != "/sys" && d != "/" && d != "."; d = filepath.Dir(d) {
+		if node := readNode(filepath.Join(d, "numa_node")); node >= 0 {
+			return node
+		}
+	}
+	if depth > 4 {
+		return -1
+	}
+	slaves, _ := filepath.Glob(filepath.Join(dir, "slaves", "*"))
+	for _, slave := range slaves {
+		target, err := filepath.EvalSymlinks(slave)
+		if err != nil {
+			continue
+		}
+		if node := blockNode(target, depth+1); node >= 0 {
+			return node
+		}
+	}
+	return -1
+}
+
+// AddressNode returns the NUMA node of the network interface with the IP
+// of addr, a host:port, or -1 if it is not known, as for a wildcard
+// address or a virtual interface. Bonds take the node of the first of
+// their links that has one.
+func AddressNode(addr string) (int, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return -1, nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return -1, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return interfaceNode(iface.Name, 0), nil
+			}
+		}
+	}
+	return -1, nil
+}
+
+// interfaceNode reads the NUMA node of a network interface's device, or
+// of the links under it
+func interfaceNode(name string, depth int) int {
+	dir := filepath.Join("/sys/class/net", name)
+	if node := readNode(filepath.Join(dir, "device", "numa_node")); node >= 0 {
+		return node
+	}
+	if depth > 4 {
+		return -1
+	}
+	lowers, _ := filepath.Glob(filepath.Join(dir, "lower_*"))
+	for _, lower := range lowers {
+		if node := interfaceNode(strings.TrimPrefix(filepath.Base(lower), "lower_"), depth+1); node >= 0 {
+			return node
+		}
+	}
+	return -1
+}
+
+// readNode reads a numa_node file, -1 meaning none
+func readNode(path string) int {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return -1
+	}
+	node, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return -1
+	}
+	return node
+}
+
+// setAffinity pins the calling thread to cpus
+func setAffinity(cpus CPUSet) error {
+	mask := cpus.mask()
+	_, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, uintptr(len(mask)*8), uintptr(unsafe.Pointer(&mask[0])))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+//go:build !linux
+
+package affinity
+
+// Nodes reports that the NUMA topology cannot be read
+func Nodes() ([]NUMANode, error) {
+	return nil, ErrUnsupported
+}
+
+// PathNode reports that the NUMA node of a disk cannot be found
+func PathNode(path string) (int, error) {
+	return -1, ErrUnsupported
+}
+
+// AddressNode reports that the NUMA node of a network interface cannot be
+// found
+func AddressNode(addr string) (int, error) {
+	return -1, ErrUnsupported
+}
+
+// setAffinity reports that threads cannot be pinned
+func setAffinity(cpus CPUSet) error {
+	return ErrUnsupported
+}
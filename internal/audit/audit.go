@@ -0,0 +1,295 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxSize is the size at which the log is rotated by default
+const DefaultMaxSize = 100 << 20
+
+// rotatedTimeFormat names rotated files so that they sort by age
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// Event is one audited operation
+type Event struct {
+	Time time.Time `json:"time"`
+	// Node is the node the operation was made on
+	Node string `json:"node"`
+	// Actor is the identity that made the operation, and Method how it
+	// was authenticated
+	Actor  string `json:"actor"`
+	Method string `json:"method,omitempty"`
+	// Remote is the address the operation came from
+	Remote string `json:"remote,omitempty"`
+	// Action names the operation, such as "delete" or "PUT /v1/maintenance"
+	Action string `json:"action"`
+	// Resource is what the operation applied to, such as a block ID
+	Resource string `json:"resource,omitempty"`
+	// Details holds the operation's parameters, such as a request body
+	Details json.RawMessage `json:"details,omitempty"`
+	Success bool            `json:"success"`
+	Error   string          `json:"error,omitempty"`
+}
+
+// Filter selects the events to export. Zero fields match every event.
+type Filter struct {
+	Since  time.Time
+	Until  time.Time
+	Actor  string
+	Action string
+}
+
+// match reports whether an event passes the filter. Actions match by
+// prefix, so "PUT" selects every PUT request.
+func (f Filter) match(e *Event) bool {
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && !e.Time.Before(f.Until) {
+		return false
+	}
+	if f.Actor != "" && e.Actor != f.Actor {
+		return false
+	}
+	return f.Action == "" || strings.HasPrefix(e.Action, f.Action)
+}
+
+// Log is an append-only log of audited operations, one JSON event per
+// line. Once the file grows past its maximum size it is renamed with a
+// timestamp and a new file is started; rotated files are never written
+// again. Every event is synced to disk before Record returns.
+type Log struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+// Open opens the log at path, creating it and its directory if needed.
+// maxSize is the size in bytes at which the log is rotated, zero meaning
+// DefaultMaxSize. maxFiles is the number of rotated files kept, zero
+// keeping them all.
+func Open(path string, maxSize int64, maxFiles int) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create audit log directory: %w", err)
+	}
+
+	l := &Log{path: path, maxSize: maxSize, maxFiles: maxFiles}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file for appending
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat audit log: %w", err)
+	}
+
+	l.file = file
+	l.size = info.Size()
+	return nil
+}
+
+// Path returns the path of the current file
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Record appends an event to the log, rotating it first if the event would
+// take it past its maximum size. A nil log records nothing.
+func (l *Log) Record(e Event) error {
+	if l == nil {
+		return nil
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	e.Time = e.Time.UTC()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("failed to encode audit event: %w", err)
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit event: %w", err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync audit log: %w", err)
+	}
+	return nil
+}
+
+// Rotate closes the current file under a timestamped name and starts a new
+// one. An empty file is not rotated.
+func (l *Log) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return fmt.Errorf("audit log %s is closed", l.path)
+	}
+	if l.size == 0 {
+		return nil
+	}
+	return l.rotate()
+}
+
+// rotate renames the current file and opens a new one. Must be called
+// with the lock held.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+	l.file = nil
+
+	ext := filepath.Ext(l.path)
+	rotated := strings.TrimSuffix(l.path, ext) + "-" + time.Now().UTC().Format(rotatedTimeFormat) + ext
+	if err := os.Rename(l.path, rotated); err != nil {
+		// Keep appending to the current file rather than lose events
+		if openErr := l.open(); openErr != nil {
+			return openErr
+		}
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	return l.prune()
+}
+
+// rotatedFiles returns the rotated files of the log, oldest first
+func (l *Log) rotatedFiles() ([]string, error) {
+	ext := filepath.Ext(l.path)
+	matches, err := filepath.Glob(strings.TrimSuffix(l.path, ext) + "-*" + ext)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// prune removes the oldest rotated files beyond the number kept. Must be
+// called with the lock held.
+func (l *Log) prune() error {
+	if l.maxFiles <= 0 {
+		return nil
+	}
+	files, err := l.rotatedFiles()
+	if err != nil {
+		return fmt.Errorf("failed to list rotated audit logs: %w", err)
+	}
+	for len(files) > l.maxFiles {
+		if err := os.Remove(files[0]); err != nil {
+			return fmt.Errorf("failed to remove old audit log: %w", err)
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// Export writes the events that pass the filter to w, oldest first, as
+// JSON lines. It covers the rotated files still kept as well as the
+// current one, and does not block recording while it runs.
+func (l *Log) Export(w io.Writer, filter Filter) error {
+	// Open every file up front, so that a rotation during the export
+	// neither hides nor repeats events
+	l.mu.Lock()
+	paths, err := l.rotatedFiles()
+	if err != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("failed to list rotated audit logs: %w", err)
+	}
+	readers := make([]io.Reader, 0, len(paths)+1)
+	for _, path := range paths {
+		file, err := os.Open(path)
+		if err != nil {
+			l.mu.Unlock()
+			return fmt.Errorf("failed to open audit log: %w", err)
+		}
+		defer file.Close()
+		readers = append(readers, file)
+	}
+
+	current, err := os.Open(l.path)
+	if err != nil {
+		l.mu.Unlock()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	defer current.Close()
+	// Leave out events recorded after the export started
+	readers = append(readers, io.LimitReader(current, l.size))
+	l.mu.Unlock()
+
+	for _, r := range readers {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 64*1024), 16<<20)
+		for scanner.Scan() {
+			var e Event
+			if err := json.Unmarshal(scanner.Bytes(), &e); err != nil || !filter.match(&e) {
+				continue
+			}
+			if _, err := w.Write(append(scanner.Bytes(), '\n')); err != nil {
+				return err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("failed to read audit log: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close closes the log. Events recorded after Close fail.
+func (l *Log) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
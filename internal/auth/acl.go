@@ -0,0 +1,133 @@
+package auth
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// Permission is an operation class granted by an ACL rule
+type Permission string
+
+const (
+	// PermRead allows reading, stating and listing blocks
+	PermRead Permission = "read"
+	// PermWrite allows writing blocks
+	PermWrite Permission = "write"
+	// PermDelete allows deleting blocks
+	PermDelete Permission = "delete"
+	// PermAdmin allows every operation
+	PermAdmin Permission = "admin"
+)
+
+// Wildcard matches any identity or namespace in an ACL rule
+const Wildcard = "*"
+
+// DefaultNamespace is the namespace of block IDs without a namespace prefix
+const DefaultNamespace = api.DefaultNamespace
+
+// Namespace returns the namespace a block ID belongs to: the part before
+// the first separator, or the default namespace
+func Namespace(blockID string) string {
+	return api.Namespace(blockID)
+}
+
+// aclRule grants permissions to an identity within a namespace
+type aclRule struct {
+	identity    string
+	namespace   string
+	permissions map[Permission]bool
+}
+
+// ACL maps identities to the operations they may perform per namespace.
+// When enabled it denies everything that no rule allows.
+type ACL struct {
+	enabled bool
+	rules   []aclRule
+	mu      sync.RWMutex
+}
+
+// NewACL creates an ACL from the configuration
+func NewACL(cfg config.ACLConfig) (*ACL, error) {
+	acl := &ACL{enabled: cfg.Enabled}
+	for i, rule := range cfg.Rules {
+		if rule.Identity == "" || rule.Namespace == "" {
+			return nil, fmt.Errorf("ACL rule %d needs an identity and a namespace", i)
+		}
+
+		r := aclRule{
+			identity:    rule.Identity,
+			namespace:   rule.Namespace,
+			permissions: make(map[Permission]bool),
+		}
+		for _, op := range rule.Operations {
+			perm := Permission(op)
+			switch perm {
+			case PermRead, PermWrite, PermDelete, PermAdmin:
+				r.permissions[perm] = true
+			default:
+				return nil, fmt.Errorf("ACL rule %d has unknown operation %q", i, op)
+			}
+		}
+		acl.rules = append(acl.rules, r)
+	}
+	return acl, nil
+}
+
+// Update replaces the rules with those of the configuration. The ACL is
+// left as it was if the configuration is invalid.
+func (a *ACL) Update(cfg config.ACLConfig) error {
+	next, err := NewACL(cfg)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.enabled = next.enabled
+	a.rules = next.rules
+	return nil
+}
+
+// Enabled reports whether the ACL is enforced
+func (a *ACL) Enabled() bool {
+	if a == nil {
+		return false
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	return a.enabled
+}
+
+// Allowed reports whether identity may perform perm within namespace
+func (a *ACL) Allowed(identity *Identity, namespace string, perm Permission) bool {
+	if !a.Enabled() {
+		return true
+	}
+
+	name := AnonymousName
+	if identity != nil {
+		name = identity.Name
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	for _, rule := range a.rules {
+		if rule.identity != Wildcard && rule.identity != name {
+			continue
+		}
+		if rule.namespace != Wildcard && rule.namespace != namespace {
+			continue
+		}
+		if rule.permissions[perm] || rule.permissions[PermAdmin] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,308 @@
+package auth
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// Authentication modes
+const (
+	// ModeOff accepts every client as anonymous unless it presents
+	// credentials
+	ModeOff = "off"
+	// ModeSecure requires credentials unless anonymous access is allowed
+	ModeSecure = "secure"
+)
+
+// Authentication methods recorded on an identity
+const (
+	MethodAnonymous = "anonymous"
+	MethodToken     = "token"
+	MethodTLS       = "tls"
+	MethodSigV4     = "sigv4"
+)
+
+// AnonymousName is the identity name of unauthenticated clients
+const AnonymousName = "anonymous"
+
+// Identity is an authenticated client
+type Identity struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+}
+
+// identityKey is the context key of the request identity
+type identityKey struct{}
+
+// WithIdentity returns a context carrying the request's identity
+func WithIdentity(ctx context.Context, identity *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, identity)
+}
+
+// FromContext returns the request identity carried by ctx, or the
+// anonymous identity
+func FromContext(ctx context.Context) *Identity {
+	if identity, ok := ctx.Value(identityKey{}).(*Identity); ok {
+		return identity
+	}
+	return Anonymous()
+}
+
+// Anonymous returns the identity of a client without credentials
+func Anonymous() *Identity {
+	return &Identity{Name: AnonymousName, Method: MethodAnonymous}
+}
+
+// IsAnonymous reports whether the identity carries no credentials
+func (i *Identity) IsAnonymous() bool {
+	return i == nil || i.Method == MethodAnonymous
+}
+
+// TokenProvider validates bearer tokens. Implementations may consult any
+// external system; StaticTokens validates against the configuration.
+type TokenProvider interface {
+	Authenticate(ctx context.Context, token string) (*Identity, error)
+}
+
+// StaticTokens validates tokens against a fixed set. Tokens are kept as
+// SHA-256 digests and compared in constant time.
+type StaticTokens struct {
+	digests map[[sha256.Size]byte]string
+	mu      sync.RWMutex
+}
+
+// NewStaticTokens creates a provider from the configured tokens
+func NewStaticTokens(tokens []config.TokenConfig) (*StaticTokens, error) {
+	p := &StaticTokens{digests: make(map[[sha256.Size]byte]string, len(tokens))}
+	for _, t := range tokens {
+		if t.Identity == "" || t.Token == "" {
+			return nil, errors.New("auth tokens need both an identity and a token")
+		}
+		p.digests[sha256.Sum256([]byte(t.Token))] = t.Identity
+	}
+	return p, nil
+}
+
+// Update replaces the accepted tokens, so that they can be rotated without
+// a restart. The tokens are left as they were if any is invalid.
+func (p *StaticTokens) Update(tokens []config.TokenConfig) error {
+	next, err := NewStaticTokens(tokens)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.digests = next.digests
+	return nil
+}
+
+// Authenticate returns the identity the token belongs to
+func (p *StaticTokens) Authenticate(ctx context.Context, token string) (*Identity, error) {
+	digest := sha256.Sum256([]byte(token))
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	// Walk every entry so the comparison time does not depend on which
+	// token matched
+	name := ""
+	for d, identity := range p.digests {
+		if subtle.ConstantTimeCompare(d[:], digest[:]) == 1 {
+			name = identity
+		}
+	}
+	if name == "" {
+		return nil, api.ErrUnauthenticated
+	}
+	return &Identity{Name: name, Method: MethodToken}, nil
+}
+
+// Authenticator resolves the identity of client connections and requests
+type Authenticator struct {
+	mode           string
+	allowAnonymous bool
+	tokens         TokenProvider
+	tlsConfig      *tls.Config
+}
+
+// New creates an authenticator from the configuration. tokens overrides the
+// configured static tokens when set, so that other providers can be
+// plugged in.
+func New(cfg config.AuthConfig, tokens TokenProvider) (*Authenticator, error) {
+	mode := cfg.Mode
+	if mode == "" {
+		mode = ModeOff
+	}
+	if mode != ModeOff && mode != ModeSecure {
+		return nil, fmt.Errorf("unknown auth mode %q", cfg.Mode)
+	}
+
+	if tokens == nil {
+		static, err := NewStaticTokens(cfg.Tokens)
+		if err != nil {
+			return nil, err
+		}
+		tokens = static
+	}
+
+	a := &Authenticator{
+		mode:           mode,
+		allowAnonymous: mode == ModeOff || cfg.AllowAnonymous,
+		tokens:         tokens,
+	}
+
+	if cfg.TLS.CertFile != "" {
+		tlsConfig, err := ServerTLSConfig(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+		a.tlsConfig = tlsConfig
+	}
+
+	return a, nil
+}
+
+// UpdateTokens replaces the configured static tokens. It fails if the
+// tokens come from another provider.
+func (a *Authenticator) UpdateTokens(tokens []config.TokenConfig) error {
+	static, ok := a.tokens.(*StaticTokens)
+	if !ok {
+		return errors.New("tokens are not configured statically")
+	}
+	return static.Update(tokens)
+}
+
+// TLSConfig returns the server TLS configuration, or nil if TLS is disabled
+func (a *Authenticator) TLSConfig() *tls.Config {
+	return a.tlsConfig
+}
+
+// ConnIdentity returns the identity proven by a connection's verified
+// client certificate, or the anonymous identity
+func (a *Authenticator) ConnIdentity(state *tls.ConnectionState) *Identity {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return Anonymous()
+	}
+	return &Identity{Name: state.VerifiedChains[0][0].Subject.CommonName, Method: MethodTLS}
+}
+
+// Authenticate resolves the identity of a request. A bearer token in the
+// request headers takes precedence over the connection's identity.
+// Anonymous requests fail unless anonymous access is allowed.
+func (a *Authenticator) Authenticate(ctx context.Context, conn *Identity, headers map[string]string) (*Identity, error) {
+	if token := headers[api.AuthorizationHeader]; token != "" {
+		return a.tokens.Authenticate(ctx, strings.TrimPrefix(token, "Bearer "))
+	}
+	if !conn.IsAnonymous() {
+		return conn, nil
+	}
+	if !a.allowAnonymous {
+		return nil, api.ErrUnauthenticated
+	}
+	return Anonymous(), nil
+}
+
+// ServerTLSConfig builds the TLS configuration of a node's client-facing
+// listener. With a client CA, client certificates are verified, and with
+// RequireClientCert they are mandatory.
+func ServerTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	cert, err := loadKeyPair(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		if cfg.RequireClientCert {
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// ClientTLSConfig builds the TLS configuration a node uses to reach its
+// peers, presenting its own certificate and trusting the client CA
+func ClientTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	if cfg.CertFile == "" {
+		return nil, nil
+	}
+
+	cert, err := loadKeyPair(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if cfg.ClientCAFile != "" {
+		pool, err := loadCertPool(cfg.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return tlsConfig, nil
+}
+
+// loadKeyPair loads the node's certificate and private key. The key is
+// either a file or, when it came from a secret reference, the PEM itself.
+func loadKeyPair(cfg config.TLSConfig) (tls.Certificate, error) {
+	if !strings.HasPrefix(strings.TrimSpace(cfg.KeyFile), "-----BEGIN") {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return cert, fmt.Errorf("failed to load TLS certificate: %w", err)
+		}
+		return cert, nil
+	}
+
+	certPEM, err := ioutil.ReadFile(cfg.CertFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, []byte(cfg.KeyFile))
+	if err != nil {
+		return cert, fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// loadCertPool reads a PEM bundle of CA certificates
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
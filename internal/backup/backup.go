@@ -0,0 +1,256 @@
+// Package backup copies a node's blocks, or those under a prefix such as a
+// namespace, to an archive, and restores them from one. An archive is a
+// tar stream holding each block copied as an entry under blocks/, with the
+// block's version and checksum in the entry's PAX records, followed by a
+// manifest listing every block the node held and its version.
+//
+// A backup taken against the manifest of an earlier one is incremental: it
+// copies only the blocks that are new or at a newer version since, and
+// records the blocks deleted since, so that restoring a full backup and
+// then its incremental backups in order rebuilds the latest state.
+//
+// Backups can instead be kept in a repository, where blocks are stored
+// content-addressed and each backup is described by a catalog; see
+// Repository.
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/3fs-storage/pkg/client"
+)
+
+// FormatVersion is the version of the archive format
+const FormatVersion = 1
+
+// Names within an archive
+const (
+	blocksDir    = "blocks/"
+	manifestName = "MANIFEST.json"
+	paxVersion   = "3FS.version"
+	paxChecksum  = "3FS.checksum"
+)
+
+// Entry describes a block as it was when backed up
+type Entry struct {
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+	Size     int    `json:"size"`
+}
+
+// Manifest describes a backup. It ends the archive, so that it can list
+// what was copied.
+type Manifest struct {
+	Format int `json:"format"`
+	// Source is the node the blocks were copied from, and Prefix the prefix
+	// of the blocks copied; empty copies every block
+	Source string `json:"source"`
+	Prefix string `json:"prefix,omitempty"`
+	// CreatedAt is when the backup started, in Unix nanoseconds. Base is
+	// the CreatedAt of the backup an incremental backup builds on, and zero
+	// for a full backup.
+	CreatedAt int64 `json:"created_at"`
+	Base      int64 `json:"base,omitempty"`
+	// Blocks are all the blocks the node held, whether copied into this
+	// archive or left unchanged since the base
+	Blocks map[string]Entry `json:"blocks"`
+	// Copied is the number of blocks in this archive, and Bytes their size
+	Copied int   `json:"copied"`
+	Bytes  int64 `json:"bytes"`
+	// Deleted are the blocks of the base the node no longer held
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// Incremental reports whether the backup builds on an earlier one
+func (m *Manifest) Incremental() bool {
+	return m.Base != 0
+}
+
+// Options configures a backup
+type Options struct {
+	// Source names the node in the manifest
+	Source string
+	// Prefix limits the backup to the blocks whose IDs start with it
+	Prefix string
+	// Base is the manifest of the backup to build on; nil takes a full
+	// backup
+	Base *Manifest
+	// Progress, if set, is called after each block is examined
+	Progress func(done, total int)
+}
+
+// Write backs up the blocks of the node a client is connected to as an
+// archive. Each block is copied at a single version, verified against its
+// checksum; a block written while the backup runs is copied at either its
+// old or its new version, and a block deleted meanwhile is left out.
+func Write(ctx context.Context, c *client.Client, w io.Writer, opts Options, logger *slog.Logger) (*Manifest, error) {
+	if opts.Base != nil && opts.Base.Prefix != opts.Prefix {
+		return nil, fmt.Errorf("the base backup is of prefix %q, not %q", opts.Base.Prefix, opts.Prefix)
+	}
+	manifest := &Manifest{
+		Format:    FormatVersion,
+		Source:    opts.Source,
+		Prefix:    opts.Prefix,
+		CreatedAt: time.Now().UnixNano(),
+		Blocks:    make(map[string]Entry),
+	}
+	if opts.Base != nil {
+		manifest.Base = opts.Base.CreatedAt
+	}
+
+	ids, err := c.List(ctx, opts.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %w", err)
+	}
+	slices.Sort(ids)
+
+	tw := tar.NewWriter(w)
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		copied, err := backupBlock(ctx, c, tw, id, opts.Base, manifest)
+		if err != nil {
+			return nil, err
+		}
+		if copied {
+			logger.Debug("block backed up", "block", id, "version", manifest.Blocks[id].Version)
+		}
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(ids))
+		}
+	}
+
+	if opts.Base != nil {
+		for id := range opts.Base.Blocks {
+			if _, ok := manifest.Blocks[id]; !ok {
+				manifest.Deleted = append(manifest.Deleted, id)
+			}
+		}
+		slices.Sort(manifest.Deleted)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := writeEntry(tw, &tar.Header{Name: manifestName}, data); err != nil {
+		return nil, err
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write archive: %w", err)
+	}
+	return manifest, nil
+}
+
+// backupBlock copies a block to the archive unless the base holds it at
+// the same version, and records it in the manifest. It reports whether the
+// block was copied.
+func backupBlock(ctx context.Context, c *client.Client, tw *tar.Writer, id string, base *Manifest, manifest *Manifest) (bool, error) {
+	if base != nil {
+		if previous, ok := base.Blocks[id]; ok {
+			stat, err := c.Stat(ctx, id)
+			if err != nil {
+				if deleted(ctx, c, id) {
+					return false, nil
+				}
+				return false, fmt.Errorf("failed to stat block %s: %w", id, err)
+			}
+			if stat.Version == previous.Version && stat.Checksum == previous.Checksum {
+				manifest.Blocks[id] = previous
+				return false, nil
+			}
+		}
+	}
+
+	data, stat, err := c.Fetch(ctx, id, 0)
+	if err != nil {
+		if deleted(ctx, c, id) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read block %s: %w", id, err)
+	}
+	header := &tar.Header{
+		Name:    blocksDir + id,
+		ModTime: time.Unix(0, stat.LastModified),
+		PAXRecords: map[string]string{
+			paxVersion:  strconv.Itoa(stat.Version),
+			paxChecksum: stat.Checksum,
+		},
+	}
+	if err := writeEntry(tw, header, data); err != nil {
+		return false, err
+	}
+	manifest.Blocks[id] = Entry{Version: stat.Version, Checksum: stat.Checksum, Size: len(data)}
+	manifest.Copied++
+	manifest.Bytes += int64(len(data))
+	return true, nil
+}
+
+// deleted reports whether a block is known to have been deleted, as it is
+// absent from the listing of its own ID
+func deleted(ctx context.Context, c *client.Client, id string) bool {
+	ids, err := c.List(ctx, id)
+	return err == nil && !slices.Contains(ids, id)
+}
+
+// writeEntry adds a file to the archive
+func writeEntry(tw *tar.Writer, header *tar.Header, data []byte) error {
+	header.Typeflag = tar.TypeReg
+	header.Mode = 0o644
+	header.Size = int64(len(data))
+	if header.ModTime.IsZero() {
+		header.ModTime = time.Now()
+	}
+	header.Format = tar.FormatPAX
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest at the end of an archive, skipping the
+// blocks before it
+func ReadManifest(r io.Reader) (*Manifest, error) {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("the archive has no manifest; it may be truncated")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Name == manifestName {
+			return decodeManifest(tr)
+		}
+	}
+}
+
+// decodeManifest decodes a manifest, refusing formats this build does not
+// know
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Format < 1 || manifest.Format > FormatVersion {
+		return nil, fmt.Errorf("unsupported archive format %d", manifest.Format)
+	}
+	if manifest.Blocks == nil {
+		manifest.Blocks = make(map[string]Entry)
+	}
+	return &manifest, nil
+}
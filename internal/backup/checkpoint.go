@@ -0,0 +1,80 @@
+package backup
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// checkpointRecord is a line of a checkpoint file: a block restored, with
+// the checksum of the content it was restored with
+type checkpointRecord struct {
+	Block    string `json:"block"`
+	Checksum string `json:"checksum"`
+}
+
+// Checkpoint records the blocks a restore from a repository wrote in a
+// file, one JSON line each, so that an interrupted restore resumes with
+// the blocks it had not written. A block recorded with other content, as
+// when restoring another backup, is restored again.
+type Checkpoint struct {
+	file *os.File
+	mu   sync.Mutex
+	done map[string]string
+}
+
+// OpenCheckpoint opens a checkpoint file, creating it if it does not exist
+func OpenCheckpoint(path string) (*Checkpoint, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint file: %w", err)
+	}
+
+	c := &Checkpoint{file: f, done: make(map[string]string)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var record checkpointRecord
+		// A line torn by a crash is ignored, and its block restored again
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		c.done[record.Block] = record.Checksum
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read checkpoint file: %w", err)
+	}
+	return c, nil
+}
+
+// Done reports whether a block was restored with the content of a
+// checksum
+func (c *Checkpoint) Done(blockID, checksum string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.done[blockID] == checksum
+}
+
+// Record records a block restored with the content of a checksum
+func (c *Checkpoint) Record(blockID, checksum string) error {
+	line, err := json.Marshal(checkpointRecord{Block: blockID, Checksum: checksum})
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to record checkpoint: %w", err)
+	}
+	c.done[blockID] = checksum
+	return nil
+}
+
+// Close closes the checkpoint file
+func (c *Checkpoint) Close() error {
+	return c.file.Close()
+}
@@ -0,0 +1,155 @@
+package backup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/3fs-storage/internal/s3client"
+)
+
+// ArchiveWriter writes an archive to its location. Close completes the
+// archive; Abort discards it.
+type ArchiveWriter interface {
+	io.WriteCloser
+	Abort()
+}
+
+// Create opens a location to write an archive to: "-" for stdout,
+// s3://bucket/key for an object on the S3 service s3 describes, or a file
+// path. The archive appears at the location only once Close succeeds, so
+// that a failed backup never leaves a partial archive in place of a good
+// one.
+func Create(ctx context.Context, location string, s3 s3client.Config) (ArchiveWriter, error) {
+	if location == "-" {
+		return nopCloser{os.Stdout}, nil
+	}
+	if bucket, key, ok := s3client.ParseLocation(location); ok {
+		c, err := s3client.New(s3)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.CreateTemp("", "3fs-backup-*")
+		if err != nil {
+			return nil, fmt.Errorf("failed to stage archive: %w", err)
+		}
+		return &s3Writer{ctx: ctx, client: c, bucket: bucket, key: key, file: f}, nil
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(location), filepath.Base(location)+".tmp*")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create archive: %w", err)
+	}
+	return &fileWriter{file: f, path: location}, nil
+}
+
+// Open opens an archive at a location Create accepts
+func Open(ctx context.Context, location string, s3 s3client.Config) (io.ReadCloser, error) {
+	if location == "-" {
+		return io.NopCloser(os.Stdin), nil
+	}
+	if bucket, key, ok := s3client.ParseLocation(location); ok {
+		c, err := s3client.New(s3)
+		if err != nil {
+			return nil, err
+		}
+		r, err := c.Get(ctx, bucket, key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch archive: %w", err)
+		}
+		return r, nil
+	}
+	f, err := os.Open(location)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	return f, nil
+}
+
+// fileWriter writes an archive to a temporary file renamed into place on
+// Close
+type fileWriter struct {
+	file *os.File
+	path string
+}
+
+// Write writes to the temporary file
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// Close syncs the archive and renames it into place
+func (w *fileWriter) Close() error {
+	err := w.file.Sync()
+	if closeErr := w.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(w.file.Name(), w.path)
+	}
+	if err != nil {
+		os.Remove(w.file.Name())
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	return nil
+}
+
+// Abort removes the temporary file
+func (w *fileWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// s3Writer stages an archive in a temporary file and uploads it on Close,
+// as an upload must declare its size and checksum up front
+type s3Writer struct {
+	ctx    context.Context
+	client *s3client.Client
+	bucket string
+	key    string
+	file   *os.File
+}
+
+// Write writes to the staging file
+func (w *s3Writer) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// Close uploads the staged archive
+func (w *s3Writer) Close() error {
+	defer os.Remove(w.file.Name())
+	defer w.file.Close()
+
+	size, err := w.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("failed to read staged archive: %w", err)
+	}
+	if _, err := w.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to read staged archive: %w", err)
+	}
+	if err := w.client.Put(w.ctx, w.bucket, w.key, w.file, size, "application/x-tar"); err != nil {
+		return fmt.Errorf("failed to upload archive: %w", err)
+	}
+	return nil
+}
+
+// Abort removes the staging file without uploading it
+func (w *s3Writer) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+// nopCloser leaves stdout open
+type nopCloser struct {
+	io.Writer
+}
+
+// Close does nothing
+func (nopCloser) Close() error {
+	return nil
+}
+
+// Abort does nothing, as what was written to stdout cannot be taken back
+func (nopCloser) Abort() {}
@@ -0,0 +1,255 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+const (
+	// DefaultRestoreWorkers is the number of blocks restored from a
+	// repository at the same time
+	DefaultRestoreWorkers = 8
+	// progressInterval is how often a restore from a repository logs its
+	// progress
+	progressInterval = 10 * time.Second
+	// maxProblems is the most problems of a catalog an error lists
+	maxProblems = 5
+)
+
+// Destination is where blocks are restored to: a node's *client.Client, or
+// a *client.Cluster, which writes each block to the chain the cluster's
+// routing table assigns it now, whatever chain held it when it was backed
+// up
+type Destination interface {
+	Write(ctx context.Context, blockID string, data []byte) error
+}
+
+// RepositoryRestoreOptions configures a restore from a repository
+type RepositoryRestoreOptions struct {
+	// DryRun checks the catalog and the objects it names without reading
+	// them or writing to the destination
+	DryRun bool
+	// Workers is the number of blocks restored at the same time
+	Workers int
+	// Table, if set, is the routing table of the cluster restored to, to
+	// report the chain each block is assigned
+	Table *api.RoutingTable
+	// Checkpoint, if set, records the blocks restored, and skips those it
+	// recorded before
+	Checkpoint *Checkpoint
+	// Progress, if set, is called after each block is restored or skipped
+	Progress func(done, total int, bytes int64)
+}
+
+// RepositoryRestoreResult describes a restore from a repository
+type RepositoryRestoreResult struct {
+	Catalog int64 `json:"catalog"`
+	Blocks  int   `json:"blocks"`
+	// Restored counts the blocks written, Skipped those the checkpoint
+	// recorded as restored before, and Failed those that could not be
+	// restored
+	Restored int64 `json:"restored"`
+	Skipped  int64 `json:"skipped"`
+	Failed   int64 `json:"failed"`
+	Bytes    int64 `json:"bytes"`
+	// Chains counts the blocks assigned to each chain of the routing table
+	// restored along
+	Chains map[uint32]int `json:"chains,omitempty"`
+	DryRun bool           `json:"dry_run,omitempty"`
+}
+
+// Check checks that a catalog is consistent and that the repository holds
+// the object of every block it lists at the size it records, without
+// reading the objects
+func (r *Repository) Check(ctx context.Context, catalog *Catalog) error {
+	objects, err := r.store.list(ctx, objectsDir)
+	if err != nil {
+		return fmt.Errorf("failed to list objects: %w", err)
+	}
+	sizes := make(map[string]int64, len(objects))
+	for _, object := range objects {
+		sizes[object.key] = object.size
+	}
+
+	var problems []string
+	for _, id := range catalogBlocks(catalog) {
+		entry := catalog.Blocks[id]
+		if err := checkEntry(catalog, id, entry); err != nil {
+			problems = append(problems, fmt.Sprintf("block %s: %v", id, err))
+			continue
+		}
+		size, ok := sizes[objectKey(entry.Checksum)]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("block %s: object %s is missing", id, entry.Checksum))
+		case size != int64(entry.Size):
+			problems = append(problems, fmt.Sprintf("block %s: object %s holds %d bytes, not %d", id, entry.Checksum, size, entry.Size))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	listed := problems[:min(len(problems), maxProblems)]
+	return fmt.Errorf("catalog %d has %d problems: %s", catalog.CreatedAt, len(problems), strings.Join(listed, "; "))
+}
+
+// checkEntry checks a block of a catalog
+func checkEntry(catalog *Catalog, id string, entry Entry) error {
+	if err := api.ValidateBlockID(id); err != nil {
+		return err
+	}
+	if !strings.HasPrefix(id, catalog.Prefix) {
+		return fmt.Errorf("outside the backup's prefix %q", catalog.Prefix)
+	}
+	if _, err := hex.DecodeString(entry.Checksum); err != nil || len(entry.Checksum) != 2*sha256.Size {
+		return fmt.Errorf("invalid checksum %q", entry.Checksum)
+	}
+	if entry.Size < 0 || entry.Size > api.MaxDataSize {
+		return fmt.Errorf("invalid size %d", entry.Size)
+	}
+	return nil
+}
+
+// Restore writes the blocks a catalog lists to a destination. The catalog
+// is checked first, and nothing is written if it fails the check. Each
+// block is then downloaded and verified against its checksum before it is
+// written; a block that fails is logged and counted, and the others are
+// still restored. With a checkpoint, a restore run again after an
+// interruption or failures restores only the blocks not yet restored.
+// Blocks the destination holds that the catalog does not list are left in
+// place, and restored blocks get new versions.
+func (r *Repository) Restore(ctx context.Context, dst Destination, catalog *Catalog, opts RepositoryRestoreOptions, logger *slog.Logger) (*RepositoryRestoreResult, error) {
+	if dst == nil && !opts.DryRun {
+		return nil, errors.New("restoring needs a destination")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultRestoreWorkers
+	}
+	result := &RepositoryRestoreResult{Catalog: catalog.CreatedAt, Blocks: len(catalog.Blocks), DryRun: opts.DryRun}
+	if err := r.Check(ctx, catalog); err != nil {
+		return result, err
+	}
+
+	ids := catalogBlocks(catalog)
+	if opts.Table != nil {
+		result.Chains = make(map[uint32]int)
+		for _, id := range ids {
+			chain := opts.Table.ChainForBlock(id)
+			if chain == nil {
+				return result, fmt.Errorf("block %s: the routing table has no chain for it", id)
+			}
+			result.Chains[chain.ID]++
+		}
+	}
+	if opts.DryRun {
+		logger.Info("catalog checked", "catalog", catalog.CreatedAt, "blocks", len(ids), "chains", len(result.Chains))
+		return result, nil
+	}
+	logger.Info("restoring blocks", "catalog", catalog.CreatedAt, "blocks", len(ids), "workers", opts.Workers)
+
+	var done atomic.Int64
+	var mu sync.Mutex
+	lastLogged := time.Now()
+	report := func() {
+		n, bytes := int(done.Add(1)), atomic.LoadInt64(&result.Bytes)
+		if opts.Progress != nil {
+			opts.Progress(n, len(ids), bytes)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if time.Since(lastLogged) >= progressInterval {
+			lastLogged = time.Now()
+			logger.Info("restore progress", "done", n, "blocks", len(ids), "bytes", bytes)
+		}
+	}
+
+	// Blocks being restored finish when ctx ends, so that the checkpoint
+	// records them
+	restoreCtx := context.WithoutCancel(ctx)
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range work {
+				entry := catalog.Blocks[id]
+				if opts.Checkpoint != nil && opts.Checkpoint.Done(id, entry.Checksum) {
+					atomic.AddInt64(&result.Skipped, 1)
+					report()
+					continue
+				}
+				if err := r.restoreBlock(restoreCtx, dst, id, entry, opts.Checkpoint); err != nil {
+					atomic.AddInt64(&result.Failed, 1)
+					logger.Error("failed to restore block", "block", id, "error", err)
+					continue
+				}
+				atomic.AddInt64(&result.Restored, 1)
+				atomic.AddInt64(&result.Bytes, int64(entry.Size))
+				logger.Debug("block restored", "block", id, "bytes", entry.Size)
+				report()
+			}
+		}()
+	}
+
+feed:
+	for _, id := range ids {
+		select {
+		case work <- id:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return result, err
+	}
+	if result.Failed > 0 {
+		return result, fmt.Errorf("%d blocks failed to restore; run the restore again with the same checkpoint to retry them", result.Failed)
+	}
+	logger.Info("backup restored", "catalog", catalog.CreatedAt, "restored", result.Restored, "skipped", result.Skipped, "bytes", result.Bytes)
+	return result, nil
+}
+
+// restoreBlock downloads a block's object, verifies it and writes it to
+// the destination
+func (r *Repository) restoreBlock(ctx context.Context, dst Destination, id string, entry Entry, checkpoint *Checkpoint) error {
+	data, err := r.store.get(ctx, objectKey(entry.Checksum))
+	if err != nil {
+		return fmt.Errorf("failed to download object %s: %w", entry.Checksum, err)
+	}
+	sum := sha256.Sum256(data)
+	if len(data) != entry.Size || hex.EncodeToString(sum[:]) != entry.Checksum {
+		return fmt.Errorf("object %s failed checksum verification", entry.Checksum)
+	}
+	if err := dst.Write(ctx, id, data); err != nil {
+		return err
+	}
+	if checkpoint != nil {
+		return checkpoint.Record(id, entry.Checksum)
+	}
+	return nil
+}
+
+// catalogBlocks returns the IDs of the blocks of a catalog, in order
+func catalogBlocks(catalog *Catalog) []string {
+	ids := make([]string, 0, len(catalog.Blocks))
+	for id := range catalog.Blocks {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	return ids
+}
@@ -0,0 +1,410 @@
+package backup
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/s3client"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// Names within a repository
+const (
+	objectsDir  = "objects/"
+	catalogsDir = "catalogs/"
+	catalogExt  = ".json"
+)
+
+// Repository keeps backups as objects on an S3 service, or in a directory.
+// Blocks are stored content-addressed, as an object named by their
+// checksum, so that a block is uploaded once however many backups and
+// block IDs share it. Each backup writes a catalog listing every block it
+// covers with its version and checksum, which is all a restore of that
+// backup needs. A backup uploads only the blocks at another version than
+// in the catalog of the backup before it: the versions a catalog records
+// are the watermarks the next backup compares against.
+type Repository struct {
+	location string
+	store    store
+}
+
+// store holds the objects of a repository under slash-separated keys
+type store interface {
+	put(ctx context.Context, key string, data []byte) error
+	get(ctx context.Context, key string) ([]byte, error)
+	// list returns the objects whose keys start with prefix, in key order
+	list(ctx context.Context, prefix string) ([]storedObject, error)
+}
+
+// storedObject is an object of a store's listing
+type storedObject struct {
+	key  string
+	size int64
+}
+
+// Catalog describes a backup in a repository. It is written once every
+// block it lists was uploaded, so that a catalog only ever names objects
+// the repository holds.
+type Catalog struct {
+	Format int `json:"format"`
+	// Source is the node the blocks were read from, and Prefix the prefix
+	// of the blocks backed up; empty backs up every block
+	Source string `json:"source"`
+	Prefix string `json:"prefix,omitempty"`
+	// CreatedAt is when the backup started, in Unix nanoseconds, and
+	// identifies it in the repository. Parent is the CreatedAt of the
+	// backup whose versions it was compared against, and zero for a full
+	// backup.
+	CreatedAt int64 `json:"created_at"`
+	Parent    int64 `json:"parent,omitempty"`
+	// Blocks are all the blocks the node held
+	Blocks map[string]Entry `json:"blocks"`
+	// Changed counts the blocks new or at another version since the
+	// parent; Uploaded counts the objects uploaded for them, fewer when
+	// their content was already stored, and Bytes their size
+	Changed  int   `json:"changed"`
+	Uploaded int   `json:"uploaded"`
+	Bytes    int64 `json:"bytes"`
+	// Deleted are the blocks of the parent the node no longer held
+	Deleted []string `json:"deleted,omitempty"`
+}
+
+// Incremental reports whether the backup was compared against an earlier
+// one
+func (c *Catalog) Incremental() bool {
+	return c.Parent != 0
+}
+
+// RepositoryOptions configures a backup to a repository
+type RepositoryOptions struct {
+	// Source names the node in the catalog
+	Source string
+	// Prefix limits the backup to the blocks whose IDs start with it
+	Prefix string
+	// Full compares against no earlier backup, reading and uploading every
+	// block
+	Full bool
+	// Progress, if set, is called after each block is examined
+	Progress func(done, total int)
+}
+
+// OpenRepository opens the repository at a location: s3://bucket/prefix
+// on the S3 service s3 describes, or a directory, created if needed
+func OpenRepository(location string, s3 s3client.Config) (*Repository, error) {
+	if bucket, prefix, ok := s3client.ParseLocation(location); ok {
+		c, err := s3client.New(s3)
+		if err != nil {
+			return nil, err
+		}
+		if prefix != "" && !strings.HasSuffix(prefix, "/") {
+			prefix += "/"
+		}
+		return &Repository{location: location, store: &s3Store{client: c, bucket: bucket, prefix: prefix}}, nil
+	}
+	if location == "" || location == "-" {
+		return nil, fmt.Errorf("invalid repository location %q", location)
+	}
+	if err := os.MkdirAll(location, 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create repository: %w", err)
+	}
+	return &Repository{location: location, store: dirStore(location)}, nil
+}
+
+// Location returns where the repository is
+func (r *Repository) Location() string {
+	return r.location
+}
+
+// Catalogs returns the CreatedAt of the backups in the repository, oldest
+// first
+func (r *Repository) Catalogs(ctx context.Context) ([]int64, error) {
+	objects, err := r.store.list(ctx, catalogsDir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list catalogs: %w", err)
+	}
+	ids := make([]int64, 0, len(objects))
+	for _, object := range objects {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(object.key, catalogsDir), catalogExt)
+		if !ok {
+			continue
+		}
+		if id, err := strconv.ParseInt(name, 10, 64); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	slices.Sort(ids)
+	return ids, nil
+}
+
+// ReadCatalog reads the catalog of a backup
+func (r *Repository) ReadCatalog(ctx context.Context, id int64) (*Catalog, error) {
+	data, err := r.store.get(ctx, catalogKey(id))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read catalog %d: %w", id, err)
+	}
+	var catalog Catalog
+	if err := json.Unmarshal(data, &catalog); err != nil {
+		return nil, fmt.Errorf("invalid catalog %d: %w", id, err)
+	}
+	if catalog.Format < 1 || catalog.Format > FormatVersion {
+		return nil, fmt.Errorf("catalog %d has unsupported format %d", id, catalog.Format)
+	}
+	if catalog.Blocks == nil {
+		catalog.Blocks = make(map[string]Entry)
+	}
+	return &catalog, nil
+}
+
+// Latest returns the catalog of the newest backup of a prefix, or nil if
+// the repository holds none
+func (r *Repository) Latest(ctx context.Context, prefix string) (*Catalog, error) {
+	ids, err := r.Catalogs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		catalog, err := r.ReadCatalog(ctx, ids[i])
+		if err != nil {
+			return nil, err
+		}
+		if catalog.Prefix == prefix {
+			return catalog, nil
+		}
+	}
+	return nil, nil
+}
+
+// Backup backs up the blocks of the node a client is connected to. Each
+// block at the version it had in the newest backup of the same prefix is
+// recorded without being read; any other is read, verified against its
+// checksum and uploaded unless the repository holds its content already.
+// The catalog is written last, so that a backup that fails leaves the
+// repository's earlier backups as they were.
+func (r *Repository) Backup(ctx context.Context, c *client.Client, opts RepositoryOptions, logger *slog.Logger) (*Catalog, error) {
+	catalog := &Catalog{
+		Format:    FormatVersion,
+		Source:    opts.Source,
+		Prefix:    opts.Prefix,
+		CreatedAt: time.Now().UnixNano(),
+		Blocks:    make(map[string]Entry),
+	}
+	var parent *Catalog
+	if !opts.Full {
+		var err error
+		if parent, err = r.Latest(ctx, opts.Prefix); err != nil {
+			return nil, err
+		}
+	}
+	// The objects the parent lists are known to be stored
+	stored := make(map[string]bool)
+	if parent != nil {
+		catalog.Parent = parent.CreatedAt
+		for _, entry := range parent.Blocks {
+			stored[entry.Checksum] = true
+		}
+	}
+
+	ids, err := c.List(ctx, opts.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %w", err)
+	}
+	slices.Sort(ids)
+	for i, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if err := r.backupBlock(ctx, c, id, parent, stored, catalog); err != nil {
+			return nil, err
+		}
+		if opts.Progress != nil {
+			opts.Progress(i+1, len(ids))
+		}
+	}
+
+	if parent != nil {
+		for id := range parent.Blocks {
+			if _, ok := catalog.Blocks[id]; !ok {
+				catalog.Deleted = append(catalog.Deleted, id)
+			}
+		}
+		slices.Sort(catalog.Deleted)
+	}
+
+	data, err := json.MarshalIndent(catalog, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := r.store.put(ctx, catalogKey(catalog.CreatedAt), data); err != nil {
+		return nil, fmt.Errorf("failed to write catalog: %w", err)
+	}
+	logger.Info("backup written to repository", "repository", r.location, "catalog", catalog.CreatedAt,
+		"blocks", len(catalog.Blocks), "changed", catalog.Changed, "uploaded", catalog.Uploaded)
+	return catalog, nil
+}
+
+// backupBlock records a block in the catalog, uploading its content if it
+// changed since the parent and is not stored yet
+func (r *Repository) backupBlock(ctx context.Context, c *client.Client, id string, parent *Catalog, stored map[string]bool, catalog *Catalog) error {
+	if parent != nil {
+		if previous, ok := parent.Blocks[id]; ok {
+			stat, err := c.Stat(ctx, id)
+			if err != nil {
+				if deleted(ctx, c, id) {
+					return nil
+				}
+				return fmt.Errorf("failed to stat block %s: %w", id, err)
+			}
+			if stat.Version == previous.Version && stat.Checksum == previous.Checksum {
+				catalog.Blocks[id] = previous
+				return nil
+			}
+		}
+	}
+
+	data, stat, err := c.Fetch(ctx, id, 0)
+	if err != nil {
+		if deleted(ctx, c, id) {
+			return nil
+		}
+		return fmt.Errorf("failed to read block %s: %w", id, err)
+	}
+	catalog.Blocks[id] = Entry{Version: stat.Version, Checksum: stat.Checksum, Size: len(data)}
+	catalog.Changed++
+	if stored[stat.Checksum] {
+		return nil
+	}
+	if err := r.store.put(ctx, objectKey(stat.Checksum), data); err != nil {
+		return fmt.Errorf("failed to upload block %s: %w", id, err)
+	}
+	stored[stat.Checksum] = true
+	catalog.Uploaded++
+	catalog.Bytes += int64(len(data))
+	return nil
+}
+
+// catalogKey is the key of a backup's catalog. The zero-padded timestamp
+// keeps listings in the order the backups were taken.
+func catalogKey(id int64) string {
+	return fmt.Sprintf("%s%019d%s", catalogsDir, id, catalogExt)
+}
+
+// objectKey is the key of the content of a checksum, spread over
+// directories by its first byte
+func objectKey(checksum string) string {
+	if len(checksum) < 2 {
+		return objectsDir + checksum
+	}
+	return objectsDir + checksum[:2] + "/" + checksum
+}
+
+// s3Store keeps a repository under a prefix of a bucket
+type s3Store struct {
+	client *s3client.Client
+	bucket string
+	prefix string
+}
+
+// put uploads an object
+func (s *s3Store) put(ctx context.Context, key string, data []byte) error {
+	return s.client.Put(ctx, s.bucket, s.prefix+key, bytes.NewReader(data), int64(len(data)), "application/octet-stream")
+}
+
+// get downloads an object
+func (s *s3Store) get(ctx context.Context, key string) ([]byte, error) {
+	r, err := s.client.Get(ctx, s.bucket, s.prefix+key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
+
+// list lists the objects under a prefix of the repository
+func (s *s3Store) list(ctx context.Context, prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	err := s.client.List(ctx, s.bucket, s.prefix+prefix, func(object s3client.Object) error {
+		objects = append(objects, storedObject{key: strings.TrimPrefix(object.Key, s.prefix), size: object.Size})
+		return nil
+	})
+	return objects, err
+}
+
+// dirStore keeps a repository in a directory, each key a file under it
+type dirStore string
+
+// put writes a file, renaming it into place once it is synced
+func (d dirStore) put(_ context.Context, key string, data []byte) error {
+	p := filepath.Join(string(d), filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".tmp*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// get reads a file
+func (d dirStore) get(_ context.Context, key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(string(d), filepath.FromSlash(key)))
+}
+
+// list walks the directory a prefix names
+func (d dirStore) list(_ context.Context, prefix string) ([]storedObject, error) {
+	root := filepath.Join(string(d), filepath.FromSlash(path.Dir(prefix+"x")))
+	var objects []storedObject
+	err := filepath.WalkDir(root, func(p string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if entry.IsDir() || strings.Contains(entry.Name(), ".tmp") {
+			return nil
+		}
+		rel, err := filepath.Rel(string(d), p)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		objects = append(objects, storedObject{key: key, size: info.Size()})
+		return nil
+	})
+	slices.SortFunc(objects, func(a, b storedObject) int { return strings.Compare(a.key, b.key) })
+	return objects, err
+}
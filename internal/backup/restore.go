@@ -0,0 +1,152 @@
+package backup
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/3fs-storage/pkg/client"
+)
+
+// RestoreOptions configures a restore
+type RestoreOptions struct {
+	// VerifyOnly checks the archive without writing to the node
+	VerifyOnly bool
+	// Base is the manifest of the backup restored before an incremental
+	// one, which must be the one it builds on; nil skips the check
+	Base *Manifest
+	// Progress, if set, is called after each block is restored
+	Progress func(blocks int, bytes int64)
+}
+
+// RestoreResult describes a restore
+type RestoreResult struct {
+	Manifest *Manifest `json:"manifest"`
+	// Restored and Bytes count the blocks written, and Deleted the blocks
+	// deleted as the backup recorded
+	Restored int   `json:"restored"`
+	Bytes    int64 `json:"bytes"`
+	Deleted  int   `json:"deleted"`
+}
+
+// Restore writes the blocks of an archive to the node a client is
+// connected to, verifying each against its checksum before it is written,
+// then deletes the blocks an incremental backup recorded as deleted. The
+// blocks get new versions on the node. An archive that fails verification
+// stops the restore, with the blocks before the failure already written;
+// verify an archive first with VerifyOnly, which needs no client.
+func Restore(ctx context.Context, c *client.Client, r io.Reader, opts RestoreOptions, logger *slog.Logger) (*RestoreResult, error) {
+	if c == nil && !opts.VerifyOnly {
+		return nil, errors.New("restoring needs a client")
+	}
+
+	result := &RestoreResult{}
+	archived := make(map[string]Entry)
+	tr := tar.NewReader(r)
+	for {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		header, err := tr.Next()
+		if err == io.EOF {
+			return result, errors.New("the archive has no manifest; it may be truncated")
+		}
+		if err != nil {
+			return result, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		if header.Name == manifestName {
+			manifest, err := decodeManifest(tr)
+			if err != nil {
+				return result, err
+			}
+			result.Manifest = manifest
+			break
+		}
+		id, ok := strings.CutPrefix(header.Name, blocksDir)
+		if !ok || id == "" {
+			return result, fmt.Errorf("unexpected archive entry %q", header.Name)
+		}
+
+		entry, data, err := readBlock(tr, header)
+		if err != nil {
+			return result, fmt.Errorf("block %s: %w", id, err)
+		}
+		archived[id] = entry
+		if opts.VerifyOnly {
+			continue
+		}
+		if err := c.Write(ctx, id, data); err != nil {
+			return result, fmt.Errorf("failed to restore block %s: %w", id, err)
+		}
+		result.Restored++
+		result.Bytes += int64(len(data))
+		if opts.Progress != nil {
+			opts.Progress(result.Restored, result.Bytes)
+		}
+	}
+
+	manifest := result.Manifest
+	if err := checkArchived(manifest, archived); err != nil {
+		return result, err
+	}
+	if opts.Base != nil && manifest.Base != opts.Base.CreatedAt {
+		return result, errors.New("the backup does not build on the one restored before it")
+	}
+	if opts.VerifyOnly {
+		return result, nil
+	}
+
+	for _, id := range manifest.Deleted {
+		if err := c.Delete(ctx, id); err != nil && !deleted(ctx, c, id) {
+			return result, fmt.Errorf("failed to delete block %s: %w", id, err)
+		}
+		result.Deleted++
+	}
+	logger.Info("backup restored", "created_at", manifest.CreatedAt, "blocks", result.Restored, "deleted", result.Deleted)
+	return result, nil
+}
+
+// readBlock reads a block's entry, checking the data against the size and
+// checksum recorded with it
+func readBlock(tr *tar.Reader, header *tar.Header) (Entry, []byte, error) {
+	version, err := strconv.Atoi(header.PAXRecords[paxVersion])
+	if err != nil {
+		return Entry{}, nil, errors.New("the archive records no version")
+	}
+	entry := Entry{Version: version, Checksum: header.PAXRecords[paxChecksum], Size: int(header.Size)}
+
+	data, err := io.ReadAll(tr)
+	if err != nil {
+		return entry, nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+	if int64(len(data)) != header.Size {
+		return entry, nil, errors.New("the archive is truncated")
+	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != entry.Checksum {
+		return entry, nil, errors.New("failed checksum verification")
+	}
+	return entry, data, nil
+}
+
+// checkArchived checks that an archive holds exactly the blocks its
+// manifest says were copied
+func checkArchived(manifest *Manifest, archived map[string]Entry) error {
+	if len(archived) != manifest.Copied {
+		return fmt.Errorf("the archive holds %d blocks, but its manifest lists %d copied", len(archived), manifest.Copied)
+	}
+	for id, entry := range archived {
+		if manifest.Blocks[id] != entry {
+			return fmt.Errorf("block %s does not match the manifest", id)
+		}
+	}
+	return nil
+}
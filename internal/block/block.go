@@ -1,14 +1,25 @@
 package block
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/3fs-storage/internal/affinity"
 	"github.com/3fs-storage/internal/craq"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/ratelimit"
 	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/internal/tracing"
+	"github.com/3fs-storage/pkg/api"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // BlockID is a unique identifier for a block
@@ -26,25 +37,127 @@ type Block struct {
 type Service struct {
 	localStorage *storage.LocalStorage
 	craqChain    *craq.Chain
-	mu           sync.RWMutex
+	scheduler    *Scheduler
+	workers      atomic.Pointer[affinity.Pool]
+	logger       *slog.Logger
+	// blockLocks order the writes, deletes and reads of each block, hashed
+	// by ID, so that no IO waits behind that of an unrelated block
+	blockLocks [blockLockStripes]sync.RWMutex
+	// mu guards the scheduler
+	mu sync.RWMutex
+}
+
+// blockLockStripes is the number of locks the blocks are hashed across
+const blockLockStripes = 256
+
+// blockLock returns the lock ordering the operations on a block
+func (s *Service) blockLock(blockID string) *sync.RWMutex {
+	h := fnv.New32a()
+	h.Write([]byte(blockID))
+	return &s.blockLocks[h.Sum32()%blockLockStripes]
 }
 
 // NewService creates a new block service
-func NewService(localStorage *storage.LocalStorage, craqChain *craq.Chain) (*Service, error) {
+func NewService(localStorage *storage.LocalStorage, craqChain *craq.Chain, logger *slog.Logger) (*Service, error) {
 	if localStorage == nil {
 		return nil, errors.New("localStorage cannot be nil")
 	}
 
+	scheduler, err := NewScheduler(DefaultMaxInflight, DefaultClassLimits())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request scheduler: %w", err)
+	}
+
 	return &Service{
 		localStorage: localStorage,
 		craqChain:    craqChain,
+		scheduler:    scheduler,
+		logger:       logging.Component(logger, "block"),
 	}, nil
 }
 
-// WriteBlock writes a block to the storage system
-func (s *Service) WriteBlock(blockID string, data []byte) error {
+// SetScheduler replaces the request scheduler used by the service
+func (s *Service) SetScheduler(scheduler *Scheduler) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.scheduler = scheduler
+}
+
+// Scheduler returns the request scheduler used by the service
+func (s *Service) Scheduler() *Scheduler {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.scheduler
+}
+
+// SetWorkers runs the service's local reads and writes on a pool of
+// pinned workers; nil runs them on the requests' goroutines
+func (s *Service) SetWorkers(pool *affinity.Pool) {
+	s.workers.Store(pool)
+}
+
+// Workers returns the pool running the service's local reads and writes
+func (s *Service) Workers() *affinity.Pool {
+	return s.workers.Load()
+}
+
+// admit waits for the scheduler to let a request of the given class run
+func (s *Service) admit(ctx context.Context, class IOClass) (func(), error) {
+	s.mu.RLock()
+	scheduler := s.scheduler
+	s.mu.RUnlock()
+
+	release, err := scheduler.Acquire(ctx, class)
+	if err != nil {
+		// A request whose deadline passed while it was queued found the
+		// node too busy
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("failed to schedule %s request: %w: %w", class, api.ErrBackpressure, err)
+		}
+		return nil, fmt.Errorf("failed to schedule %s request: %w", class, err)
+	}
+	return release, nil
+}
+
+// acquireDisk waits for the storage's disk scheduler to let a local read or
+// write run. Background requests take the background share of the disk;
+// the others are foreground operations of the given kind.
+func (s *Service) acquireDisk(ctx context.Context, class IOClass, op storage.DiskClass) (func(), error) {
+	if class == IOClassBackground {
+		op = storage.DiskBackground
+	}
+	release, err := s.localStorage.DiskScheduler().Acquire(ctx, op)
+	if err != nil {
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil, fmt.Errorf("failed to schedule %s disk operation: %w: %w", op, api.ErrBackpressure, err)
+		}
+		return nil, fmt.Errorf("failed to schedule %s disk operation: %w", op, err)
+	}
+	return release, nil
+}
+
+// WriteBlock writes a block to the storage system
+func (s *Service) WriteBlock(ctx context.Context, blockID string, data []byte) error {
+	return s.WriteBlockWithClass(ctx, IOClassBulk, blockID, data)
+}
+
+// WriteBlockWithClass writes a block, scheduled under the given IO class
+func (s *Service) WriteBlockWithClass(ctx context.Context, class IOClass, blockID string, data []byte) (err error) {
+	ctx, span := tracing.Start(ctx, "block.write",
+		attribute.String("block.id", blockID),
+		attribute.Int("block.size", len(data)),
+		attribute.String("io.class", class.String()))
+	defer func() { tracing.End(span, err) }()
+
+	release, err := s.admit(ctx, class)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	lock := s.blockLock(blockID)
+	lock.Lock()
+	defer lock.Unlock()
 
 	// Create block metadata
 	metadata := storage.NewBlockMetadata(data, 1, time.Now().UnixNano())
@@ -55,35 +168,75 @@ func (s *Service) WriteBlock(blockID string, data []byte) error {
 
 	// If CRAQ chain is available, replicate the block
 	if s.craqChain != nil {
-		if err := s.craqChain.Write(blockID, data, metadataBytes); err != nil {
+		if err := s.craqChain.Write(ctx, blockID, data, metadataBytes); err != nil {
 			return fmt.Errorf("failed to replicate block: %w", err)
 		}
 	}
 
 	// Always write to local storage as well
-	if err := s.localStorage.WriteBlock(blockID, data, metadataBytes); err != nil {
+	diskCtx, diskSpan := tracing.Start(ctx, "storage.write_block", attribute.String("block.id", blockID))
+	err = s.writeLocal(diskCtx, class, blockID, data, metadataBytes)
+	tracing.End(diskSpan, err)
+	if err != nil {
 		return fmt.Errorf("failed to write block to local storage: %w", err)
 	}
 
 	return nil
 }
 
+// writeLocal writes a block to local storage once the disk scheduler lets
+// it, on the service's workers
+func (s *Service) writeLocal(ctx context.Context, class IOClass, blockID string, data, metadata []byte) error {
+	release, err := s.acquireDisk(ctx, class, storage.DiskWrite)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if runErr := s.Workers().Run(ctx, func() {
+		err = s.localStorage.WriteBlock(blockID, data, metadata)
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
 // ReadBlock reads a block from the storage system
-func (s *Service) ReadBlock(blockID string) ([]byte, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Service) ReadBlock(ctx context.Context, blockID string) ([]byte, error) {
+	return s.ReadBlockWithClass(ctx, IOClassInteractive, blockID)
+}
+
+// ReadBlockWithClass reads a block, scheduled under the given IO class
+func (s *Service) ReadBlockWithClass(ctx context.Context, class IOClass, blockID string) (_ []byte, err error) {
+	ctx, span := tracing.Start(ctx, "block.read",
+		attribute.String("block.id", blockID),
+		attribute.String("io.class", class.String()))
+	defer func() { tracing.End(span, err) }()
+
+	release, err := s.admit(ctx, class)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	lock := s.blockLock(blockID)
+	lock.RLock()
+	defer lock.RUnlock()
 
 	// Try to read from CRAQ chain first if available
 	if s.craqChain != nil {
-		data, _, err := s.craqChain.Read(blockID)
+		data, _, err := s.craqChain.Read(ctx, blockID)
 		if err == nil && data != nil {
 			return data, nil
 		}
 		// Fall back to local storage if CRAQ read fails
+		s.logger.Debug("chain read failed, falling back to local storage", "block", blockID, "error", err)
 	}
 
 	// Read from local storage
-	data, _, err := s.localStorage.ReadBlock(blockID)
+	diskCtx, diskSpan := tracing.Start(ctx, "storage.read_block", attribute.String("block.id", blockID))
+	data, _, err := s.readLocal(diskCtx, class, blockID)
+	tracing.End(diskSpan, err)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read block: %w", err)
 	}
@@ -91,14 +244,36 @@ func (s *Service) ReadBlock(blockID string) ([]byte, error) {
 	return data, nil
 }
 
+// readLocal reads a block and its metadata from local storage once the
+// disk scheduler lets it, on the service's workers
+func (s *Service) readLocal(ctx context.Context, class IOClass, blockID string) ([]byte, []byte, error) {
+	release, err := s.acquireDisk(ctx, class, storage.DiskRead)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	var data, metadata []byte
+	if runErr := s.Workers().Run(ctx, func() {
+		data, metadata, err = s.localStorage.ReadBlock(blockID)
+	}); runErr != nil {
+		return nil, nil, runErr
+	}
+	return data, metadata, err
+}
+
 // ReadBlockMetadata reads metadata for a block
-func (s *Service) ReadBlockMetadata(blockID string) (*storage.BlockMetadata, error) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func (s *Service) ReadBlockMetadata(ctx context.Context, blockID string) (_ *storage.BlockMetadata, err error) {
+	ctx, span := tracing.Start(ctx, "block.stat", attribute.String("block.id", blockID))
+	defer func() { tracing.End(span, err) }()
+
+	lock := s.blockLock(blockID)
+	lock.RLock()
+	defer lock.RUnlock()
 
 	// Try CRAQ chain first if available
 	if s.craqChain != nil {
-		_, metadataBytes, err := s.craqChain.Read(blockID)
+		_, metadataBytes, err := s.craqChain.Read(ctx, blockID)
 		if err == nil && metadataBytes != nil {
 			var metadata storage.BlockMetadata
 			if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
@@ -115,7 +290,7 @@ func (s *Service) ReadBlockMetadata(blockID string) (*storage.BlockMetadata, err
 	}
 
 	if !exists || metadataBytes == nil {
-		return nil, fmt.Errorf("block %s not found", blockID)
+		return nil, fmt.Errorf("block %s: %w", blockID, api.ErrNotFound)
 	}
 
 	var metadata storage.BlockMetadata
@@ -126,31 +301,109 @@ func (s *Service) ReadBlockMetadata(blockID string) (*storage.BlockMetadata, err
 	return &metadata, nil
 }
 
+// FetchBlock reads a block and its metadata from local storage for a peer
+// copying it, scheduled as background traffic. It refuses to hand out a
+// copy older than minVersion, or one that fails its checksum, so that a
+// stale or corrupt replica is never propagated.
+func (s *Service) FetchBlock(ctx context.Context, blockID string, minVersion int) (_ []byte, _ *storage.BlockMetadata, err error) {
+	ctx, span := tracing.Start(ctx, "block.fetch", attribute.String("block.id", blockID))
+	defer func() { tracing.End(span, err) }()
+
+	release, err := s.admit(ctx, IOClassBackground)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer release()
+
+	lock := s.blockLock(blockID)
+	lock.RLock()
+	defer lock.RUnlock()
+
+	diskCtx, diskSpan := tracing.Start(ctx, "storage.read_block", attribute.String("block.id", blockID))
+	data, metadataBytes, err := s.readLocal(diskCtx, IOClassBackground, blockID)
+	tracing.End(diskSpan, err)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read block: %w", err)
+	}
+	if metadataBytes == nil {
+		return nil, nil, fmt.Errorf("block %s has no metadata", blockID)
+	}
+
+	var metadata storage.BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, nil, fmt.Errorf("failed to unmarshal block metadata: %w", err)
+	}
+	if metadata.Version < minVersion {
+		return nil, nil, fmt.Errorf("block %s is at version %d, older than %d: %w", blockID, metadata.Version, minVersion, api.ErrVersionConflict)
+	}
+	if hex.EncodeToString(storage.CalculateChecksum(data)) != metadata.Checksum {
+		return nil, nil, fmt.Errorf("block %s: %w", blockID, api.ErrCorrupted)
+	}
+
+	return data, &metadata, nil
+}
+
 // DeleteBlock deletes a block from the storage system
-func (s *Service) DeleteBlock(blockID string) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func (s *Service) DeleteBlock(ctx context.Context, blockID string) (err error) {
+	ctx, span := tracing.Start(ctx, "block.delete", attribute.String("block.id", blockID))
+	defer func() { tracing.End(span, err) }()
+
+	release, err := s.admit(ctx, IOClassBulk)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	lock := s.blockLock(blockID)
+	lock.Lock()
+	defer lock.Unlock()
 
 	// Delete from CRAQ chain if available
 	if s.craqChain != nil {
-		if err := s.craqChain.Delete(blockID); err != nil {
+		if err := s.craqChain.Delete(ctx, blockID); err != nil {
 			return fmt.Errorf("failed to delete block from replication chain: %w", err)
 		}
 	}
 
 	// Delete from local storage
-	if err := s.localStorage.DeleteBlock(blockID); err != nil {
+	diskCtx, diskSpan := tracing.Start(ctx, "storage.delete_block", attribute.String("block.id", blockID))
+	err = s.deleteLocal(diskCtx, blockID)
+	tracing.End(diskSpan, err)
+	if err != nil {
 		return fmt.Errorf("failed to delete block from local storage: %w", err)
 	}
 
 	return nil
 }
 
-// ListBlocks lists all blocks in the storage system (not implemented yet)
-func (s *Service) ListBlocks() ([]string, error) {
-	// This would typically scan local storage and/or query the metadata service
-	// For now, return a not implemented error
-	return nil, errors.New("list blocks operation not implemented")
+// deleteLocal deletes a block from local storage once the disk scheduler
+// lets it, on the service's workers
+func (s *Service) deleteLocal(ctx context.Context, blockID string) error {
+	release, err := s.acquireDisk(ctx, IOClassBulk, storage.DiskWrite)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if runErr := s.Workers().Run(ctx, func() {
+		err = s.localStorage.DeleteBlock(blockID)
+	}); runErr != nil {
+		return runErr
+	}
+	return err
+}
+
+// ListBlocks lists the blocks held by this node whose IDs start with prefix
+func (s *Service) ListBlocks(ctx context.Context, prefix string) (_ []string, err error) {
+	_, span := tracing.Start(ctx, "block.list", attribute.String("prefix", prefix))
+	defer func() { tracing.End(span, err) }()
+
+	blockIDs, err := s.localStorage.ListBlocks(prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %w", err)
+	}
+
+	return blockIDs, nil
 }
 
 // Initialize initializes the block service
@@ -170,42 +423,109 @@ func (s *Service) Initialize() error {
 	return nil
 }
 
-// GetStats returns statistics for the block service
-func (s *Service) GetStats() (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+// ServiceStats reports the state of a block service's storage, cache,
+// chain and request scheduler
+type ServiceStats struct {
+	Storage   *storage.Stats      `json:"storage"`
+	Chain     *craq.ChainStats    `json:"chain,omitempty"`
+	Scheduler *SchedulerStats     `json:"scheduler"`
+	Disk      *storage.DiskStats  `json:"disk,omitempty"`
+	Workers   *affinity.PoolStats `json:"workers,omitempty"`
+}
 
-	// Get local storage stats
-	usedSpace, err := s.localStorage.GetUsedSpace()
+// GetStats returns statistics for the block service
+func (s *Service) GetStats() (*ServiceStats, error) {
+	storageStats, err := s.localStorage.GetStats()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get storage stats: %w", err)
 	}
 
-	stats["used_space_bytes"] = usedSpace
-
-	// Add CRAQ chain stats if available
+	stats := &ServiceStats{Storage: storageStats}
 	if s.craqChain != nil {
-		craqStats, err := s.craqChain.GetStats()
-		if err == nil {
-			for k, v := range craqStats {
-				stats["craq_"+k] = v
-			}
-		}
+		stats.Chain = s.craqChain.GetStats()
 	}
 
+	s.mu.RLock()
+	scheduler := s.scheduler
+	s.mu.RUnlock()
+	stats.Scheduler = scheduler.GetStats()
+	stats.Disk = s.localStorage.DiskScheduler().Stats()
+	stats.Workers = s.Workers().Stats()
+
 	return stats, nil
 }
 
+// SchedulerLoad returns the running and queued requests of the scheduler
+// and its capacity
+func (s *Service) SchedulerLoad() (inflight, queued, maxInflight int) {
+	s.mu.RLock()
+	scheduler := s.scheduler
+	s.mu.RUnlock()
+	return scheduler.Load()
+}
+
+// Scrub verifies every locally stored block against its checksum, reading
+// no faster than budget allows
+func (s *Service) Scrub(ctx context.Context, budget *ratelimit.Limiter) (*storage.ScrubReport, error) {
+	release, err := s.admit(ctx, IOClassBackground)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	report, err := s.localStorage.Scrub(ctx, budget)
+	if err != nil {
+		return report, fmt.Errorf("failed to scrub local storage: %w", err)
+	}
+
+	return report, nil
+}
+
+// Fsck checks every file of local storage for damage and misplacement,
+// reading no faster than budget allows, and repairs or quarantines what it
+// finds as opts ask
+func (s *Service) Fsck(ctx context.Context, budget *ratelimit.Limiter, opts storage.FsckOptions) (*storage.FsckReport, error) {
+	release, err := s.admit(ctx, IOClassBackground)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	report, err := s.localStorage.Fsck(ctx, budget, opts)
+	if err != nil {
+		return report, fmt.Errorf("failed to check local storage: %w", err)
+	}
+
+	return report, nil
+}
+
+// CollectGarbage reclaims files left behind by interrupted operations
+func (s *Service) CollectGarbage(ctx context.Context, grace time.Duration) (*storage.GCReport, error) {
+	release, err := s.admit(ctx, IOClassBackground)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	report, err := s.localStorage.CollectGarbage(grace)
+	if err != nil {
+		return nil, fmt.Errorf("failed to collect garbage: %w", err)
+	}
+
+	return report, nil
+}
+
 // calculateChecksum calculates a checksum for the given data
 // In a real implementation, this would use a secure hash function
 func calculateChecksum(data []byte) []byte {
 	// This is a placeholder. In a real implementation, use a cryptographic hash.
 	// For example: sha256.Sum256(data)
 	checksum := make([]byte, 4)
-	
+
 	// Simple XOR-based checksum for demonstration
 	for i, b := range data {
 		checksum[i%4] ^= b
 	}
-	
+
 	return checksum
-} 
\ No newline at end of file
+}
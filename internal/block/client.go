@@ -0,0 +1,58 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// clientBlocks implements the block API over a client connection
+type clientBlocks struct {
+	client *client.Client
+}
+
+// NewClientBlocks returns the block API of the node a client is connected
+// to, so that an object store can be kept on a remote node
+func NewClientBlocks(c *client.Client) Blocks {
+	return clientBlocks{client: c}
+}
+
+// ReadBlock reads a block, telling a block that does not exist from one
+// that cannot be read
+func (b clientBlocks) ReadBlock(ctx context.Context, blockID string) ([]byte, error) {
+	data, err := b.client.Read(ctx, blockID)
+	if err != nil {
+		// Nodes that predate error codes only tell by listing
+		if errors.Is(err, api.ErrNotFound) || b.missing(ctx, blockID) {
+			return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, blockID)
+		}
+		return nil, err
+	}
+	return data, nil
+}
+
+// missing reports whether a block is known not to exist, as it is absent
+// from the listing of its own ID
+func (b clientBlocks) missing(ctx context.Context, blockID string) bool {
+	ids, err := b.client.List(ctx, blockID)
+	return err == nil && !slices.Contains(ids, blockID)
+}
+
+// WriteBlock writes a block
+func (b clientBlocks) WriteBlock(ctx context.Context, blockID string, data []byte) error {
+	return b.client.Write(ctx, blockID, data)
+}
+
+// DeleteBlock deletes a block
+func (b clientBlocks) DeleteBlock(ctx context.Context, blockID string) error {
+	return b.client.Delete(ctx, blockID)
+}
+
+// ListBlocks lists the blocks with IDs starting with prefix
+func (b clientBlocks) ListBlocks(ctx context.Context, prefix string) ([]string, error) {
+	return b.client.List(ctx, prefix)
+}
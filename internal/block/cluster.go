@@ -0,0 +1,82 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// clusterBlocks implements the block API over a whole cluster, sending
+// each block to its own chain
+type clusterBlocks struct {
+	cluster *client.Cluster
+}
+
+// NewClusterBlocks returns the block API of a cluster, so that an object
+// store can stripe its objects across the cluster's chains
+func NewClusterBlocks(c *client.Cluster) Blocks {
+	return clusterBlocks{cluster: c}
+}
+
+// ReadBlock reads a block from a member of its chain
+func (b clusterBlocks) ReadBlock(ctx context.Context, blockID string) ([]byte, error) {
+	data, err := b.cluster.Read(ctx, blockID)
+	if errors.Is(err, api.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrBlockNotFound, blockID)
+	}
+	return data, err
+}
+
+// WriteBlock writes a block to its chain
+func (b clusterBlocks) WriteBlock(ctx context.Context, blockID string, data []byte) error {
+	return b.cluster.Write(ctx, blockID, data)
+}
+
+// DeleteBlock deletes a block from its chain
+func (b clusterBlocks) DeleteBlock(ctx context.Context, blockID string) error {
+	return b.cluster.Delete(ctx, blockID)
+}
+
+// ListBlocks lists the blocks with IDs starting with prefix across the
+// cluster
+func (b clusterBlocks) ListBlocks(ctx context.Context, prefix string) ([]string, error) {
+	return b.cluster.List(ctx, prefix)
+}
+
+// Chains returns the IDs of the chains a block may map to, less those with
+// a nearly full member unless every chain has one
+func (b clusterBlocks) Chains(blockID string) []uint32 {
+	table := b.cluster.Table()
+	if table == nil {
+		return nil
+	}
+	chains := table.ChainsFor(blockID)
+	ids := make([]uint32, 0, len(chains))
+	for _, chain := range chains {
+		if !table.NearlyFull(chain) {
+			ids = append(ids, chain.ID)
+		}
+	}
+	if len(ids) == 0 {
+		for _, chain := range chains {
+			ids = append(ids, chain.ID)
+		}
+	}
+	return ids
+}
+
+// ChainOf returns the ID of the chain a block maps to
+func (b clusterBlocks) ChainOf(blockID string) (uint32, bool) {
+	table := b.cluster.Table()
+	if table == nil {
+		return 0, false
+	}
+	chain := table.ChainForBlock(blockID)
+	if chain == nil {
+		return 0, false
+	}
+	return chain.ID, true
+}
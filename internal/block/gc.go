@@ -0,0 +1,455 @@
+package block
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// Garbage collection reclaims the data blocks of a store that no object or
+// upload references, such as the blocks of writers that failed before
+// storing their manifest, or of deletes that failed part way. A run marks
+// the blocks referenced by every upload and object, counting references,
+// and sweeps the data blocks that it and the run before it both found
+// unreferenced, so a block is only deleted once it stayed unreferenced
+// for the grace period runs are spaced by.
+//
+// Writers are protected by epochs. A run lists the store's blocks, then
+// advances the store's epoch, then marks. A writer reads the epoch before
+// writing blocks and again once the manifest or upload referencing them is
+// stored. Its blocks can only have been listed by one run and found
+// unreferenced by the next if the epoch advanced by two meanwhile, in which
+// case the write is undone and fails with ErrEpochExpired.
+
+const (
+	// DefaultGCGrace is the least time between two garbage collection runs
+	DefaultGCGrace = time.Hour
+	// MaxGCCandidates bounds the unreferenced blocks a run keeps for the
+	// next one to reclaim; the rest are found again by later runs
+	MaxGCCandidates = 500000
+	// markPasses bounds how many times a run lists the store's objects
+	// looking for objects renamed while it marks
+	markPasses = 3
+)
+
+// ErrEpochExpired is returned by a write that outlived two garbage
+// collection epochs, whose blocks may have been reclaimed before it stored
+// the manifest or upload referencing them. The write was undone and can
+// be retried.
+var ErrEpochExpired = errors.New("write outlived the garbage collection epoch it started in")
+
+// ErrGCTooSoon is returned by a garbage collection run started within the
+// grace period of the previous one
+var ErrGCTooSoon = errors.New("garbage collection ran too recently")
+
+// ErrNoReferences is returned by a garbage collection run that found data
+// blocks but no objects, as when a store keeping its manifests in an index
+// is opened without it
+var ErrNoReferences = errors.New("no objects reference the store's blocks")
+
+// GCOptions tune a garbage collection run
+type GCOptions struct {
+	// Grace is the least time since the previous run's mark; zero means
+	// DefaultGCGrace
+	Grace time.Duration
+	// DryRun reports the blocks that would be reclaimed without deleting
+	// them or changing the store's garbage collection state
+	DryRun bool
+	// AllowEmpty lets a run that finds no objects reclaim blocks
+	AllowEmpty bool
+}
+
+// GCReport summarises a garbage collection run. Referenced counts the
+// distinct blocks referenced, Shared those referenced more than once, and
+// Dangling those referenced but not found by the listing. Candidates are
+// the blocks found unreferenced and kept for the next run.
+type GCReport struct {
+	Epoch      uint64   `json:"epoch"`
+	DryRun     bool     `json:"dry_run,omitempty"`
+	StartedAt  int64    `json:"started_at"`
+	FinishedAt int64    `json:"finished_at"`
+	Objects    int      `json:"objects"`
+	Uploads    int      `json:"uploads"`
+	Listed     int      `json:"listed"`
+	Referenced int      `json:"referenced"`
+	Shared     int      `json:"shared"`
+	Dangling   int      `json:"dangling"`
+	Candidates int      `json:"candidates"`
+	Reclaimed  []string `json:"reclaimed"`
+	Failed     int      `json:"failed"`
+}
+
+// gcEpochState is a store's garbage collection epoch, which writers read,
+// and when the run that advanced it started marking
+type gcEpochState struct {
+	Epoch    uint64 `json:"epoch"`
+	MarkedAt int64  `json:"marked_at"`
+}
+
+// gcCandidates are the blocks a garbage collection run found unreferenced
+type gcCandidates struct {
+	Epoch  uint64   `json:"epoch"`
+	Blocks []string `json:"blocks"`
+}
+
+// isNotFound reports whether a block API error is for a missing block
+func isNotFound(err error) bool {
+	return errors.Is(err, ErrBlockNotFound) || errors.Is(err, api.ErrNotFound)
+}
+
+// gcEpochBlockID returns the ID of the block holding the store's garbage
+// collection epoch
+func (o *ObjectStore) gcEpochBlockID() string {
+	return o.internalBlockID("gc.epoch")
+}
+
+// gcCandidatesBlockID returns the ID of the block holding the candidates
+// of the store's last garbage collection run
+func (o *ObjectStore) gcCandidatesBlockID() string {
+	return o.internalBlockID("gc.candidates")
+}
+
+// loadGCState reads a block of the store's garbage collection state into
+// v, leaving v as it is before the first run
+func (o *ObjectStore) loadGCState(ctx context.Context, blockID string, v any) error {
+	data, err := o.blocks.ReadBlock(ctx, blockID)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read garbage collection state: %w", err)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to unmarshal garbage collection state: %w", err)
+	}
+	return nil
+}
+
+// saveGCState writes a block of the store's garbage collection state
+func (o *ObjectStore) saveGCState(ctx context.Context, blockID string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to marshal garbage collection state: %w", err)
+	}
+	if err := o.blocks.WriteBlock(ctx, blockID, data); err != nil {
+		return fmt.Errorf("failed to write garbage collection state: %w", err)
+	}
+	return nil
+}
+
+// gcEpoch returns the store's garbage collection epoch. Stores outside a
+// namespace are not collected and stay at epoch zero.
+func (o *ObjectStore) gcEpoch(ctx context.Context) (uint64, error) {
+	if o.namespace == "" {
+		return 0, nil
+	}
+	var state gcEpochState
+	if err := o.loadGCState(ctx, o.gcEpochBlockID(), &state); err != nil {
+		return 0, err
+	}
+	return state.Epoch, nil
+}
+
+// checkEpoch fails with ErrEpochExpired if the store's epoch advanced by
+// two since a write read it as start
+func (o *ObjectStore) checkEpoch(ctx context.Context, start uint64) error {
+	epoch, err := o.gcEpoch(ctx)
+	if err != nil {
+		return err
+	}
+	if epoch >= start+2 {
+		return fmt.Errorf("%w: started in epoch %d, now %d", ErrEpochExpired, start, epoch)
+	}
+	return nil
+}
+
+// discard undoes the write of an object that outlived its epoch, unless
+// the object was replaced since. Its blocks may have been reclaimed, so
+// it could not be read back.
+func (o *ObjectStore) discard(ctx context.Context, manifest *ObjectManifest) {
+	current, err := o.HeadObject(ctx, manifest.Name)
+	if err == nil && current.CreatedAt == manifest.CreatedAt && current.Checksum == manifest.Checksum {
+		o.DeleteObject(ctx, manifest.Name)
+	}
+}
+
+// discardPart undoes the upload of a part that outlived its epoch, unless
+// the part was uploaded again since. It is called with the store locked.
+func (o *ObjectStore) discardPart(ctx context.Context, uploadID string, part PartInfo) {
+	upload, err := o.GetUpload(ctx, uploadID)
+	if err != nil {
+		return
+	}
+	current, ok := upload.Parts[part.Number]
+	if !ok || current.UploadedAt != part.UploadedAt || current.Checksum != part.Checksum {
+		return
+	}
+	delete(upload.Parts, part.Number)
+	if o.saveUpload(ctx, upload) == nil {
+		o.deleteBlocks(ctx, part.Blocks)
+	}
+}
+
+// collectable reports whether a block of the store may be a data block:
+// its internal blocks named by a hash. The store's manifests, upload
+// states, garbage collection state and the key-value stores kept in its
+// namespace are named otherwise, except for the states of uploads started
+// before they could be listed, which mark finds among the blocks it lists.
+func (o *ObjectStore) collectable(blockID string) bool {
+	id, ok := strings.CutPrefix(blockID, o.internalBlockID(""))
+	if !ok || len(id) != 2*sha256.Size {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// CollectGarbage runs a garbage collection of the store, which must be
+// kept in a namespace. Runs must be spaced by the grace period and must
+// not overlap; a single process should collect each store.
+func (o *ObjectStore) CollectGarbage(ctx context.Context, opts GCOptions) (*GCReport, error) {
+	if o.namespace == "" {
+		return nil, errors.New("garbage collection needs a store kept in a namespace")
+	}
+	grace := opts.Grace
+	if grace <= 0 {
+		grace = DefaultGCGrace
+	}
+
+	report := &GCReport{StartedAt: time.Now().UnixNano(), DryRun: opts.DryRun, Reclaimed: make([]string, 0)}
+	var state gcEpochState
+	if err := o.loadGCState(ctx, o.gcEpochBlockID(), &state); err != nil {
+		return nil, err
+	}
+	var previous gcCandidates
+	if err := o.loadGCState(ctx, o.gcCandidatesBlockID(), &previous); err != nil {
+		return nil, err
+	}
+	if state.MarkedAt != 0 {
+		if since := time.Since(time.Unix(0, state.MarkedAt)); since < grace {
+			return nil, fmt.Errorf("%w: the last run marked %s ago, within the grace period of %s", ErrGCTooSoon, since.Round(time.Second), grace)
+		}
+	}
+
+	// List before advancing the epoch, so that the blocks of writes that
+	// start in the new epoch are not candidates of this run
+	blockIDs, err := o.blocks.ListBlocks(ctx, o.internalBlockID(""))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %w", err)
+	}
+	listed := make(map[string]bool, len(blockIDs))
+	for _, id := range blockIDs {
+		if o.collectable(id) {
+			listed[id] = true
+		}
+	}
+	report.Listed = len(listed)
+
+	state.Epoch++
+	state.MarkedAt = time.Now().UnixNano()
+	report.Epoch = state.Epoch
+	if !opts.DryRun {
+		if err := o.saveGCState(ctx, o.gcEpochBlockID(), &state); err != nil {
+			return nil, err
+		}
+	}
+
+	refs := make(map[string]int)
+	if err := o.mark(ctx, refs, report); err != nil {
+		return nil, err
+	}
+	legacy, err := o.markLegacyUploads(ctx, listed, refs, report, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+	for id := range legacy {
+		delete(listed, id)
+	}
+	report.Listed = len(listed)
+	for id, count := range refs {
+		if count > 1 {
+			report.Shared++
+		}
+		if o.collectable(id) && !listed[id] {
+			report.Dangling++
+		}
+	}
+	report.Referenced = len(refs)
+	if report.Objects == 0 && report.Listed > 0 && !opts.AllowEmpty {
+		return nil, fmt.Errorf("%w: %d data blocks listed", ErrNoReferences, report.Listed)
+	}
+
+	// Sweep the previous run's candidates that are still unreferenced
+	confirmed := make(map[string]bool, len(previous.Blocks))
+	for _, id := range previous.Blocks {
+		confirmed[id] = true
+	}
+	candidates := make([]string, 0)
+	for _, id := range blockIDs {
+		if !listed[id] || refs[id] > 0 {
+			continue
+		}
+		if confirmed[id] {
+			if opts.DryRun {
+				report.Reclaimed = append(report.Reclaimed, id)
+				continue
+			}
+			if err := o.blocks.DeleteBlock(ctx, id); err == nil || isNotFound(err) {
+				report.Reclaimed = append(report.Reclaimed, id)
+				continue
+			}
+			report.Failed++
+		}
+		if len(candidates) < MaxGCCandidates {
+			candidates = append(candidates, id)
+		}
+	}
+	report.Candidates = len(candidates)
+
+	if !opts.DryRun {
+		next := gcCandidates{Epoch: state.Epoch, Blocks: candidates}
+		if err := o.saveGCState(ctx, o.gcCandidatesBlockID(), &next); err != nil {
+			return nil, err
+		}
+	}
+	report.FinishedAt = time.Now().UnixNano()
+	return report, nil
+}
+
+// mark counts the references to blocks of the store's uploads and
+// objects. Uploads are marked first: a completed upload's manifest is
+// stored before its state is removed, so its blocks are found either way.
+// Objects are listed again until no new names turn up, so that an object
+// renamed while marking is found under its new name.
+func (o *ObjectStore) mark(ctx context.Context, refs map[string]int, report *GCReport) error {
+	prefix := o.internalBlockID(uploadPrefix)
+	uploadIDs, err := o.blocks.ListBlocks(ctx, prefix)
+	if err != nil {
+		return fmt.Errorf("failed to list uploads: %w", err)
+	}
+	for _, id := range uploadIDs {
+		upload, err := o.GetUpload(ctx, strings.TrimPrefix(id, prefix))
+		if isNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		report.Uploads++
+		for _, part := range upload.Parts {
+			for _, b := range part.Blocks {
+				refs[b.ID]++
+			}
+		}
+	}
+
+	seen := make(map[string]bool)
+	for pass := 0; pass < markPasses; pass++ {
+		names, err := o.ListObjects(ctx, "")
+		if err != nil {
+			return err
+		}
+		missing := 0
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+
+			manifest, err := o.HeadObject(ctx, name)
+			if isNotFound(err) {
+				missing++
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			report.Objects++
+			for _, b := range manifest.Blocks {
+				refs[b.ID]++
+			}
+		}
+		if missing == 0 {
+			// Nothing disappeared while marking, so nothing was renamed
+			break
+		}
+	}
+	return nil
+}
+
+// markLegacyUploads finds the states of uploads started before upload
+// states could be listed, which are named by a hash like data blocks,
+// among the listed blocks that nothing references. It marks their parts,
+// moves the states to listable blocks unless dryRun is set, and returns
+// the IDs of the blocks the states were found in, which are not data.
+func (o *ObjectStore) markLegacyUploads(ctx context.Context, listed map[string]bool, refs map[string]int, report *GCReport, dryRun bool) (map[string]bool, error) {
+	legacy := make(map[string]bool)
+	for id := range listed {
+		if refs[id] > 0 {
+			continue
+		}
+		upload, ok := o.readLegacyUpload(ctx, id)
+		if !ok {
+			continue
+		}
+		legacy[id] = true
+		report.Uploads++
+		for _, part := range upload.Parts {
+			for _, b := range part.Blocks {
+				refs[b.ID]++
+			}
+		}
+		if !dryRun {
+			if err := o.migrateUpload(ctx, upload.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return legacy, nil
+}
+
+// readLegacyUpload reads a block as the state of an upload kept under its
+// legacy ID, reporting false if the block is anything else
+func (o *ObjectStore) readLegacyUpload(ctx context.Context, blockID string) (*Upload, bool) {
+	data, err := o.blocks.ReadBlock(ctx, blockID)
+	if err != nil || len(data) == 0 || data[0] != '{' {
+		return nil, false
+	}
+	var upload Upload
+	if err := json.Unmarshal(data, &upload); err != nil || upload.ID == "" {
+		return nil, false
+	}
+	if o.legacyUploadBlockID(upload.ID) != blockID {
+		return nil, false
+	}
+	return &upload, true
+}
+
+// migrateUpload moves the state of an upload kept under its legacy ID to
+// its listable block, so that later runs mark it like any other upload
+func (o *ObjectStore) migrateUpload(ctx context.Context, uploadID string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	upload, err := o.GetUpload(ctx, uploadID)
+	if isNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !upload.legacy {
+		return nil
+	}
+	return o.saveUpload(ctx, upload)
+}
@@ -0,0 +1,91 @@
+package block
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrNotIndexed is returned when renaming objects of a store without an
+// index, whose manifests are named after their objects
+var ErrNotIndexed = errors.New("objects can only be renamed in an indexed store")
+
+// Index keeps the manifests of a store's objects by name, in place of the
+// manifest blocks, so that objects can be renamed atomically without
+// copying their data. Get returns an error wrapping ErrBlockNotFound for a
+// name it does not hold.
+type Index interface {
+	// Get returns the manifest of an object
+	Get(ctx context.Context, name string) (*ObjectManifest, error)
+	// Put stores the manifest of an object, returning the manifest it
+	// replaces, if any
+	Put(ctx context.Context, manifest *ObjectManifest) (*ObjectManifest, error)
+	// Delete removes the manifest of an object, returning it
+	Delete(ctx context.Context, name string) (*ObjectManifest, error)
+	// Rename moves an object to a new name at once, returning the manifest
+	// of the object it replaces, if any
+	Rename(ctx context.Context, from, to string) (*ObjectManifest, error)
+	// RenamePrefix moves every object whose name starts with from to the
+	// same name starting with to at once, returning the manifests of the
+	// objects they replace
+	RenamePrefix(ctx context.Context, from, to string) ([]*ObjectManifest, error)
+	// List returns the names of the objects starting with prefix, sorted
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// SetIndex keeps the store's manifests in an index rather than in manifest
+// blocks. Every client of a store must use the same index, as the objects
+// of an indexed store have no manifest blocks.
+func (o *ObjectStore) SetIndex(index Index) {
+	o.index = index
+}
+
+// Indexed reports whether the store's manifests are kept in an index, so
+// that its objects can be renamed
+func (o *ObjectStore) Indexed() bool {
+	return o.index != nil
+}
+
+// RenameObject moves an object to a new name, replacing any object there.
+// Only the manifest moves, so the rename is atomic and copies no data.
+func (o *ObjectStore) RenameObject(ctx context.Context, from, to string) error {
+	if o.index == nil {
+		return ErrNotIndexed
+	}
+	if err := o.checkName(to); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	replaced, err := o.index.Rename(ctx, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to rename object %s: %w", from, err)
+	}
+	if replaced != nil {
+		o.deleteBlocks(ctx, replaced.Blocks)
+	}
+	return nil
+}
+
+// RenamePrefix moves every object whose name starts with from to the same
+// name starting with to, as renaming a directory does, all at once
+func (o *ObjectStore) RenamePrefix(ctx context.Context, from, to string) error {
+	if o.index == nil {
+		return ErrNotIndexed
+	}
+	if err := o.checkName(to); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	replaced, err := o.index.RenamePrefix(ctx, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to rename objects under %s: %w", from, err)
+	}
+	for _, manifest := range replaced {
+		o.deleteBlocks(ctx, manifest.Blocks)
+	}
+	return nil
+}
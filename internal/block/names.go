@@ -0,0 +1,47 @@
+package block
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// EscapeName turns an S3 key or file path into an object name valid in
+// block IDs. Letters, digits, '-' and '.' are kept and every other byte
+// becomes '_' followed by its two hex digits, so that escaping is
+// reversible and the escaped form of a prefix is a prefix of the escaped
+// key. The gateway and mounts escape alike, so that they share objects.
+func EscapeName(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '.':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "_%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// UnescapeName reverses EscapeName
+func UnescapeName(name string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '_' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", fmt.Errorf("truncated escape in %q", name)
+		}
+		c, err := strconv.ParseUint(name[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", fmt.Errorf("invalid escape in %q", name)
+		}
+		b.WriteByte(byte(c))
+		i += 2
+	}
+	return b.String(), nil
+}
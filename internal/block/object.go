@@ -0,0 +1,813 @@
+package block
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultObjectBlockSize is the size of the data blocks an object is split into
+const DefaultObjectBlockSize = 4 << 20
+
+// ManifestBlock describes one data block of an object
+type ManifestBlock struct {
+	ID       string `json:"id"`
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// ObjectAttributes are set by the writer of an object and returned with it
+type ObjectAttributes struct {
+	ContentType string            `json:"content_type,omitempty"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+}
+
+// ObjectManifest describes how an object is laid out across blocks. MD5
+// is the hex MD5 of the object's data, which S3 clients know as its ETag.
+type ObjectManifest struct {
+	Name      string          `json:"name"`
+	Size      int64           `json:"size"`
+	BlockSize int             `json:"block_size"`
+	Blocks    []ManifestBlock `json:"blocks"`
+	Checksum  string          `json:"checksum"`
+	MD5       string          `json:"md5,omitempty"`
+	CreatedAt int64           `json:"created_at"`
+	// StripeWidth is the number of blocks the object was written in
+	// parallel, which readers read it by too
+	StripeWidth int `json:"stripe_width,omitempty"`
+	ObjectAttributes
+}
+
+// PartInfo describes a completed part of a multipart upload. MD5 is the
+// hex MD5 of the part's data, which S3 clients know as its ETag.
+type PartInfo struct {
+	Number     int             `json:"number"`
+	Size       int64           `json:"size"`
+	Checksum   string          `json:"checksum"`
+	MD5        string          `json:"md5,omitempty"`
+	Blocks     []ManifestBlock `json:"blocks"`
+	UploadedAt int64           `json:"uploaded_at,omitempty"`
+}
+
+// Upload is the persisted state of a multipart upload. Attributes are
+// given when the upload starts, and passed on to the object.
+type Upload struct {
+	ID         string           `json:"id"`
+	Name       string           `json:"name"`
+	Parts      map[int]PartInfo `json:"parts"`
+	Attributes ObjectAttributes `json:"attributes"`
+	CreatedAt  int64            `json:"created_at"`
+	// legacy is set for an upload loaded from a block named by hash, as
+	// uploads were before they could be listed
+	legacy bool
+}
+
+// ErrInvalidPart is returned when completing an upload with a part that
+// was not uploaded
+var ErrInvalidPart = errors.New("part was not uploaded")
+
+// ErrBlockNotFound is returned by Blocks for a block that does not exist
+var ErrBlockNotFound = errors.New("block not found")
+
+// Blocks is the block API an object store keeps its blocks in. Service
+// implements it for a single target.
+type Blocks interface {
+	ReadBlock(ctx context.Context, blockID string) ([]byte, error)
+	WriteBlock(ctx context.Context, blockID string, data []byte) error
+	DeleteBlock(ctx context.Context, blockID string) error
+	ListBlocks(ctx context.Context, prefix string) ([]string, error)
+}
+
+// ObjectStore layers large objects on top of fixed-size blocks. Each object
+// is described by a manifest block; multipart upload state is persisted in
+// its own block so an interrupted upload can be resumed by uploading only
+// the parts that are missing.
+//
+// A store kept in a namespace names each manifest block after its object,
+// so that objects can be listed by name, and its other blocks after the
+// namespace followed by a second separator, which no object name can
+// start with. Object names must then be valid in block IDs. A store with
+// an index keeps its manifests there instead.
+type ObjectStore struct {
+	blocks      Blocks
+	blockSize   int
+	namespace   string
+	stripeWidth int
+	index       Index
+	mu          sync.Mutex
+}
+
+// NewObjectStore creates an object store on top of a block API
+func NewObjectStore(blocks Blocks, blockSize int) (*ObjectStore, error) {
+	return NewNamespacedObjectStore(blocks, blockSize, "")
+}
+
+// NewNamespacedObjectStore creates an object store keeping its blocks in a
+// namespace, where its objects can be listed
+func NewNamespacedObjectStore(blocks Blocks, blockSize int, namespace string) (*ObjectStore, error) {
+	if blocks == nil {
+		return nil, errors.New("block service cannot be nil")
+	}
+
+	if blockSize <= 0 {
+		blockSize = DefaultObjectBlockSize
+	}
+
+	return &ObjectStore{
+		blocks:      blocks,
+		blockSize:   blockSize,
+		namespace:   namespace,
+		stripeWidth: 1,
+	}, nil
+}
+
+// manifestBlockID returns the ID of the block holding an object's manifest
+func (o *ObjectStore) manifestBlockID(name string) string {
+	if o.namespace == "" {
+		return hashID("manifest", name)
+	}
+	return o.namespace + api.NamespaceSeparator + name
+}
+
+// uploadPrefix starts the names of the blocks holding upload states, so
+// that garbage collection can list them
+const uploadPrefix = "upload."
+
+// uploadBlockID returns the ID of the block holding an upload's state
+func (o *ObjectStore) uploadBlockID(uploadID string) string {
+	return o.internalBlockID(uploadPrefix + uploadID)
+}
+
+// legacyUploadBlockID returns the ID of the block an upload's state was
+// kept in before uploads could be listed
+func (o *ObjectStore) legacyUploadBlockID(uploadID string) string {
+	return o.internalBlockID(hashID("upload", uploadID))
+}
+
+// internalBlockID places the ID of a block other than a manifest in the
+// store's namespace
+func (o *ObjectStore) internalBlockID(id string) string {
+	if o.namespace == "" {
+		return id
+	}
+	return o.namespace + api.NamespaceSeparator + api.NamespaceSeparator + id
+}
+
+// checkName checks that an object can be stored under a name
+func (o *ObjectStore) checkName(name string) error {
+	if name == "" {
+		return errors.New("object name cannot be empty")
+	}
+	if o.namespace == "" {
+		return nil
+	}
+	if strings.HasPrefix(name, api.NamespaceSeparator) {
+		return fmt.Errorf("object name cannot start with %q", api.NamespaceSeparator)
+	}
+	if err := api.ValidateBlockID(o.manifestBlockID(name)); err != nil {
+		return fmt.Errorf("invalid object name: %w", err)
+	}
+	return nil
+}
+
+// hashID derives a hex block ID from the given parts so that generated IDs
+// always land in one of the storage shard directories
+func hashID(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newNonce returns a random hex string
+func newNonce() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// writtenBlocks are the blocks a stream was written to, with its size and
+// digests
+type writtenBlocks struct {
+	blocks   []ManifestBlock
+	size     int64
+	checksum string
+	md5      string
+}
+
+// writeBlocks splits the stream into blocks and writes them, a stripe at a
+// time, returning the written blocks, the total size and the SHA-256 and
+// MD5 of the stream
+func (o *ObjectStore) writeBlocks(ctx context.Context, prefix string, r io.Reader) (*writtenBlocks, error) {
+	var blocks []ManifestBlock
+	var size int64
+	digest := sha256.New()
+	md5Digest := md5.New()
+	placer := o.newPlacer(prefix)
+	width := max(o.stripeWidth, 1)
+
+	for done := false; !done; {
+		stripe, eof, err := readStripe(r, width, o.blockSize)
+		if err != nil {
+			o.deleteBlocks(ctx, blocks)
+			return nil, fmt.Errorf("failed to read object data: %w", err)
+		}
+		done = eof
+		if len(stripe) == 0 {
+			break
+		}
+
+		ids := make([]string, len(stripe))
+		for i := range stripe {
+			ids[i] = placer.blockID(len(blocks) + i)
+		}
+		if err := o.writeStripe(ctx, ids, stripe); err != nil {
+			o.deleteBlocks(ctx, blocks)
+			o.deleteBlocks(ctx, stripeBlocks(ids))
+			return nil, fmt.Errorf("failed to write object block %d: %w", len(blocks), err)
+		}
+
+		for i, data := range stripe {
+			sum := sha256.Sum256(data)
+			blocks = append(blocks, ManifestBlock{ID: ids[i], Size: len(data), Checksum: hex.EncodeToString(sum[:])})
+			digest.Write(data)
+			md5Digest.Write(data)
+			size += int64(len(data))
+		}
+	}
+
+	return &writtenBlocks{
+		blocks:   blocks,
+		size:     size,
+		checksum: hex.EncodeToString(digest.Sum(nil)),
+		md5:      hex.EncodeToString(md5Digest.Sum(nil)),
+	}, nil
+}
+
+// stripeBlocks describes the blocks of a stripe by ID alone, to delete
+// them
+func stripeBlocks(ids []string) []ManifestBlock {
+	blocks := make([]ManifestBlock, len(ids))
+	for i, id := range ids {
+		blocks[i] = ManifestBlock{ID: id}
+	}
+	return blocks
+}
+
+// unreferenced returns the blocks of a replaced manifest its replacement
+// does not reuse
+func unreferenced(previous, current []ManifestBlock) []ManifestBlock {
+	kept := make(map[string]bool, len(current))
+	for _, b := range current {
+		kept[b.ID] = true
+	}
+	blocks := make([]ManifestBlock, 0, len(previous))
+	for _, b := range previous {
+		if !kept[b.ID] {
+			blocks = append(blocks, b)
+		}
+	}
+	return blocks
+}
+
+// deleteBlocks removes data blocks, ignoring errors for blocks already gone
+func (o *ObjectStore) deleteBlocks(ctx context.Context, blocks []ManifestBlock) {
+	for _, b := range blocks {
+		o.blocks.DeleteBlock(ctx, b.ID)
+	}
+}
+
+// writeManifest stores an object's manifest
+func (o *ObjectStore) writeManifest(ctx context.Context, manifest *ObjectManifest) error {
+	manifestBytes, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to marshal object manifest: %w", err)
+	}
+
+	if err := o.blocks.WriteBlock(ctx, o.manifestBlockID(manifest.Name), manifestBytes); err != nil {
+		return fmt.Errorf("failed to write object manifest: %w", err)
+	}
+
+	return nil
+}
+
+// PutObject streams data into a new object, replacing any existing object
+// with the same name once the new manifest has been written
+func (o *ObjectStore) PutObject(ctx context.Context, name string, r io.Reader, attrs ObjectAttributes) (*ObjectManifest, error) {
+	if err := o.checkName(name); err != nil {
+		return nil, err
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := o.gcEpoch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := o.writeBlocks(ctx, hashID("object", name, nonce), r)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &ObjectManifest{
+		Name:             name,
+		Size:             written.size,
+		BlockSize:        o.blockSize,
+		Blocks:           written.blocks,
+		Checksum:         written.checksum,
+		MD5:              written.md5,
+		CreatedAt:        time.Now().UnixNano(),
+		StripeWidth:      o.stripeWidth,
+		ObjectAttributes: attrs,
+	}
+
+	if err := o.commitManifest(ctx, manifest); err != nil {
+		o.deleteBlocks(ctx, written.blocks)
+		return nil, err
+	}
+	if err := o.checkEpoch(ctx, epoch); err != nil {
+		o.discard(ctx, manifest)
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// commitManifest writes a manifest and reclaims the blocks of the object it
+// replaces that the new manifest does not reuse
+func (o *ObjectStore) commitManifest(ctx context.Context, manifest *ObjectManifest) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.commitManifestLocked(ctx, manifest)
+}
+
+// commitManifestLocked is commitManifest with o.mu held
+func (o *ObjectStore) commitManifestLocked(ctx context.Context, manifest *ObjectManifest) error {
+	if o.index != nil {
+		previous, err := o.index.Put(ctx, manifest)
+		if err != nil {
+			return fmt.Errorf("failed to index object manifest: %w", err)
+		}
+		if previous != nil {
+			o.deleteBlocks(ctx, unreferenced(previous.Blocks, manifest.Blocks))
+		}
+		return nil
+	}
+
+	previous, _ := o.HeadObject(ctx, manifest.Name)
+
+	if err := o.writeManifest(ctx, manifest); err != nil {
+		return err
+	}
+
+	if previous != nil {
+		o.deleteBlocks(ctx, unreferenced(previous.Blocks, manifest.Blocks))
+	}
+
+	return nil
+}
+
+// HeadObject returns the manifest of an object without reading its data
+func (o *ObjectStore) HeadObject(ctx context.Context, name string) (*ObjectManifest, error) {
+	if o.index != nil {
+		manifest, err := o.index.Get(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("object %s not found: %w", name, err)
+		}
+		return manifest, nil
+	}
+
+	manifestBytes, err := o.blocks.ReadBlock(ctx, o.manifestBlockID(name))
+	if err != nil {
+		return nil, fmt.Errorf("object %s not found: %w", name, err)
+	}
+
+	var manifest ObjectManifest
+	if err := json.Unmarshal(manifestBytes, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal object manifest: %w", err)
+	}
+
+	return &manifest, nil
+}
+
+// GetObject reassembles an object into w, verifying each block's checksum
+func (o *ObjectStore) GetObject(ctx context.Context, name string, w io.Writer) (*ObjectManifest, error) {
+	manifest, err := o.HeadObject(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = o.readBlocks(ctx, manifest, 0, len(manifest.Blocks)-1, func(_ int, data []byte) error {
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write object data: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// GetObjectRange writes length bytes of an object from offset into w,
+// reading and verifying only the blocks they lie in. The range must lie
+// within the object.
+func (o *ObjectStore) GetObjectRange(ctx context.Context, manifest *ObjectManifest, offset, length int64, w io.Writer) error {
+	if offset < 0 || length < 0 || offset+length > manifest.Size {
+		return fmt.Errorf("range %d-%d outside object %s of %d bytes", offset, offset+length, manifest.Name, manifest.Size)
+	}
+	if length == 0 {
+		return nil
+	}
+	first, start := manifest.BlockAt(offset)
+	last, _ := manifest.BlockAt(offset + length - 1)
+	return o.readBlocks(ctx, manifest, first, last, func(index int, data []byte) error {
+		data = data[offset-start:]
+		if int64(len(data)) > length {
+			data = data[:length]
+		}
+		if _, err := w.Write(data); err != nil {
+			return fmt.Errorf("failed to write object data: %w", err)
+		}
+		offset += int64(len(data))
+		length -= int64(len(data))
+		start += int64(manifest.Blocks[index].Size)
+		return nil
+	})
+}
+
+// ReadObjectBlock reads one data block of an object, verifying its
+// checksum, so that parts of an object can be read without the rest
+func (o *ObjectStore) ReadObjectBlock(ctx context.Context, manifest *ObjectManifest, index int) ([]byte, error) {
+	b := manifest.Blocks[index]
+	data, err := o.blocks.ReadBlock(ctx, b.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object block %d: %w", index, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if len(data) != b.Size || hex.EncodeToString(sum[:]) != b.Checksum {
+		return nil, fmt.Errorf("object block %d of %s: %w", index, manifest.Name, api.ErrCorrupted)
+	}
+
+	return data, nil
+}
+
+// BlockAt returns the index of the data block holding the byte of an
+// object at offset, and the offset the block starts at. Blocks of objects
+// uploaded in parts vary in size, so the offset is found by walking them.
+// It returns -1 for an offset past the end of the object.
+func (m *ObjectManifest) BlockAt(offset int64) (int, int64) {
+	var start int64
+	for i, b := range m.Blocks {
+		if offset < start+int64(b.Size) {
+			return i, start
+		}
+		start += int64(b.Size)
+	}
+	return -1, start
+}
+
+// DeleteObject deletes an object's manifest and all of its blocks
+func (o *ObjectStore) DeleteObject(ctx context.Context, name string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.index != nil {
+		manifest, err := o.index.Delete(ctx, name)
+		if err != nil {
+			return fmt.Errorf("failed to delete object %s: %w", name, err)
+		}
+		o.deleteBlocks(ctx, manifest.Blocks)
+		return nil
+	}
+
+	manifest, err := o.HeadObject(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := o.blocks.DeleteBlock(ctx, o.manifestBlockID(name)); err != nil {
+		return fmt.Errorf("failed to delete object manifest: %w", err)
+	}
+
+	o.deleteBlocks(ctx, manifest.Blocks)
+
+	return nil
+}
+
+// CreateUpload starts a multipart upload for the named object, which will
+// carry attrs
+func (o *ObjectStore) CreateUpload(ctx context.Context, name string, attrs ObjectAttributes) (*Upload, error) {
+	if err := o.checkName(name); err != nil {
+		return nil, err
+	}
+
+	uploadID, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	upload := &Upload{
+		ID:         uploadID,
+		Name:       name,
+		Parts:      make(map[int]PartInfo),
+		Attributes: attrs,
+		CreatedAt:  time.Now().UnixNano(),
+	}
+
+	if err := o.saveUpload(ctx, upload); err != nil {
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// GetUpload loads the persisted state of a multipart upload
+func (o *ObjectStore) GetUpload(ctx context.Context, uploadID string) (*Upload, error) {
+	legacy := false
+	uploadBytes, err := o.blocks.ReadBlock(ctx, o.uploadBlockID(uploadID))
+	if isNotFound(err) {
+		legacy = true
+		uploadBytes, err = o.blocks.ReadBlock(ctx, o.legacyUploadBlockID(uploadID))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("upload %s not found: %w", uploadID, err)
+	}
+
+	var upload Upload
+	if err := json.Unmarshal(uploadBytes, &upload); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal upload state: %w", err)
+	}
+	if upload.Parts == nil {
+		upload.Parts = make(map[int]PartInfo)
+	}
+	upload.legacy = legacy
+
+	return &upload, nil
+}
+
+// saveUpload persists the state of a multipart upload, moving the state of
+// a legacy upload to its listable block
+func (o *ObjectStore) saveUpload(ctx context.Context, upload *Upload) error {
+	uploadBytes, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal upload state: %w", err)
+	}
+
+	if err := o.blocks.WriteBlock(ctx, o.uploadBlockID(upload.ID), uploadBytes); err != nil {
+		return fmt.Errorf("failed to write upload state: %w", err)
+	}
+	if upload.legacy {
+		o.blocks.DeleteBlock(ctx, o.legacyUploadBlockID(upload.ID))
+		upload.legacy = false
+	}
+
+	return nil
+}
+
+// removeUpload removes the persisted state of a multipart upload
+func (o *ObjectStore) removeUpload(ctx context.Context, upload *Upload) error {
+	id := o.uploadBlockID(upload.ID)
+	if upload.legacy {
+		id = o.legacyUploadBlockID(upload.ID)
+	}
+	if err := o.blocks.DeleteBlock(ctx, id); err != nil {
+		return fmt.Errorf("failed to remove upload state: %w", err)
+	}
+	return nil
+}
+
+// UploadPart writes one part of a multipart upload. Re-uploading a part
+// number replaces the previous attempt, which is how interrupted parts are
+// retried.
+func (o *ObjectStore) UploadPart(ctx context.Context, uploadID string, partNumber int, r io.Reader) (*PartInfo, error) {
+	if partNumber <= 0 {
+		return nil, errors.New("part number must be greater than zero")
+	}
+
+	if _, err := o.GetUpload(ctx, uploadID); err != nil {
+		return nil, err
+	}
+
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := o.gcEpoch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	written, err := o.writeBlocks(ctx, hashID("part", uploadID, fmt.Sprintf("%d", partNumber), nonce), r)
+	if err != nil {
+		return nil, err
+	}
+	blocks := written.blocks
+
+	part := PartInfo{
+		Number:     partNumber,
+		Size:       written.size,
+		Checksum:   written.checksum,
+		MD5:        written.md5,
+		Blocks:     blocks,
+		UploadedAt: time.Now().UnixNano(),
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// Reload under the lock so concurrent parts don't overwrite each other
+	upload, err := o.GetUpload(ctx, uploadID)
+	if err != nil {
+		o.deleteBlocks(ctx, blocks)
+		return nil, err
+	}
+
+	previous, replaced := upload.Parts[partNumber]
+	upload.Parts[partNumber] = part
+
+	if err := o.saveUpload(ctx, upload); err != nil {
+		o.deleteBlocks(ctx, blocks)
+		return nil, err
+	}
+
+	if replaced {
+		o.deleteBlocks(ctx, previous.Blocks)
+	}
+	if err := o.checkEpoch(ctx, epoch); err != nil {
+		o.discardPart(ctx, uploadID, part)
+		return nil, err
+	}
+
+	return &part, nil
+}
+
+// ListParts returns the completed parts of an upload ordered by part number
+func (o *ObjectStore) ListParts(ctx context.Context, uploadID string) ([]PartInfo, error) {
+	upload, err := o.GetUpload(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return upload.sortedParts(), nil
+}
+
+// sortedParts returns the parts of an upload ordered by part number
+func (upload *Upload) sortedParts() []PartInfo {
+	parts := make([]PartInfo, 0, len(upload.Parts))
+	for _, part := range upload.Parts {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return parts[i].Number < parts[j].Number
+	})
+	return parts
+}
+
+// CompleteUpload stitches the uploaded parts into the object's manifest
+// and removes the upload state. partNumbers selects the parts, in the
+// order they make up the object; nil takes every part in part number
+// order. Parts uploaded but not selected are deleted.
+func (o *ObjectStore) CompleteUpload(ctx context.Context, uploadID string, partNumbers []int) (*ObjectManifest, error) {
+	// Hold the lock from loading the parts to removing the upload, so that
+	// a part uploaded meanwhile is neither lost nor left behind
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	upload, err := o.GetUpload(ctx, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := upload.sortedParts()
+	if partNumbers != nil {
+		selected := make([]PartInfo, 0, len(partNumbers))
+		for _, number := range partNumbers {
+			part, ok := upload.Parts[number]
+			if !ok {
+				return nil, fmt.Errorf("%w: part %d of upload %s", ErrInvalidPart, number, uploadID)
+			}
+			selected = append(selected, part)
+		}
+		parts = selected
+	}
+	if len(parts) == 0 {
+		return nil, fmt.Errorf("upload %s has no parts", uploadID)
+	}
+
+	manifest := &ObjectManifest{
+		Name:             upload.Name,
+		BlockSize:        o.blockSize,
+		CreatedAt:        time.Now().UnixNano(),
+		StripeWidth:      o.stripeWidth,
+		ObjectAttributes: upload.Attributes,
+	}
+
+	// The object checksum is computed over the part checksums, since the
+	// parts may have been uploaded independently. Its MD5 is S3's ETag of
+	// a multipart object: the MD5 of the parts' MD5s and their count.
+	digest := sha256.New()
+	md5Digest := md5.New()
+	used := make(map[int]bool, len(parts))
+	for _, part := range parts {
+		manifest.Blocks = append(manifest.Blocks, part.Blocks...)
+		manifest.Size += part.Size
+		digest.Write([]byte(part.Checksum))
+		sum, err := hex.DecodeString(part.MD5)
+		if err != nil || part.MD5 == "" {
+			md5Digest = nil
+		} else if md5Digest != nil {
+			md5Digest.Write(sum)
+		}
+		used[part.Number] = true
+	}
+	manifest.Checksum = fmt.Sprintf("%s-%d", hex.EncodeToString(digest.Sum(nil)), len(parts))
+	if md5Digest != nil {
+		manifest.MD5 = fmt.Sprintf("%s-%d", hex.EncodeToString(md5Digest.Sum(nil)), len(parts))
+	}
+
+	if err := o.commitManifestLocked(ctx, manifest); err != nil {
+		return nil, err
+	}
+
+	for number, part := range upload.Parts {
+		if !used[number] {
+			o.deleteBlocks(ctx, part.Blocks)
+		}
+	}
+	if err := o.removeUpload(ctx, upload); err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// AbortUpload discards a multipart upload and all parts written so far
+func (o *ObjectStore) AbortUpload(ctx context.Context, uploadID string) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	upload, err := o.GetUpload(ctx, uploadID)
+	if err != nil {
+		return err
+	}
+
+	for _, part := range upload.Parts {
+		o.deleteBlocks(ctx, part.Blocks)
+	}
+
+	return o.removeUpload(ctx, upload)
+}
+
+// ListObjects returns the names of the objects whose names start with
+// prefix, sorted. Only a store kept in a namespace or an index can list
+// its objects.
+func (o *ObjectStore) ListObjects(ctx context.Context, prefix string) ([]string, error) {
+	if o.index != nil {
+		names, err := o.index.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list objects: %w", err)
+		}
+		return names, nil
+	}
+	if o.namespace == "" {
+		return nil, errors.New("objects can only be listed in a namespace")
+	}
+
+	blockPrefix := o.manifestBlockID(prefix)
+	internal := o.internalBlockID("")
+	blockIDs, err := o.blocks.ListBlocks(ctx, blockPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+
+	names := make([]string, 0, len(blockIDs))
+	for _, id := range blockIDs {
+		if !strings.HasPrefix(id, blockPrefix) || strings.HasPrefix(id, internal) {
+			continue
+		}
+		names = append(names, strings.TrimPrefix(id, o.manifestBlockID("")))
+	}
+	sort.Strings(names)
+	return names, nil
+}
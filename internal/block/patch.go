@@ -0,0 +1,131 @@
+package block
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// BlockSize returns the size of the data blocks the store splits objects
+// into
+func (o *ObjectStore) BlockSize() int {
+	return o.blockSize
+}
+
+// PatchObject stores a new version of an object of size bytes made of the
+// changed blocks, by index in blocks of the store's block size, and the
+// previous version's data elsewhere, so that a change to part of a large
+// object writes only the blocks it touches. Blocks of previous lying
+// wholly within its size, where the new version has a block of the same
+// size, are reused as they are; the rest of the previous data is read and
+// written again. Changed blocks are cut or zero-padded to their place in
+// the object, and data past the previous version's size reads as zeros.
+// previous may be nil for a new object.
+//
+// The new version's checksum is derived from its blocks' checksums, as for
+// a multipart upload, and it has no MD5.
+func (o *ObjectStore) PatchObject(ctx context.Context, previous *ObjectManifest, name string, size int64, changed map[int][]byte, attrs ObjectAttributes) (*ObjectManifest, error) {
+	if err := o.checkName(name); err != nil {
+		return nil, err
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("invalid object size %d", size)
+	}
+	nonce, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+	epoch, err := o.gcEpoch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	bs := int64(o.blockSize)
+	count := int((size + bs - 1) / bs)
+	regular := previous != nil && previous.regular(o.blockSize)
+	placer := o.newPlacer(hashID("object", name, nonce))
+	blocks := make([]ManifestBlock, count)
+	var written []ManifestBlock
+	digest := sha256.New()
+
+	for i := 0; i < count; i++ {
+		start := int64(i) * bs
+		want := min(bs, size-start)
+		data, ok := changed[i]
+		if !ok && regular && i < len(previous.Blocks) && int64(previous.Blocks[i].Size) == want && start+want <= previous.Size {
+			blocks[i] = previous.Blocks[i]
+			digest.Write([]byte(blocks[i].Checksum))
+			continue
+		}
+		if !ok {
+			if data, err = o.readPrevious(ctx, previous, start, want); err != nil {
+				o.deleteBlocks(ctx, written)
+				return nil, err
+			}
+		}
+		if int64(len(data)) > want {
+			data = data[:want]
+		} else if int64(len(data)) < want {
+			data = append(data[:len(data):len(data)], make([]byte, want-int64(len(data)))...)
+		}
+
+		id := placer.blockID(i)
+		if err := o.blocks.WriteBlock(ctx, id, data); err != nil {
+			o.deleteBlocks(ctx, written)
+			return nil, fmt.Errorf("failed to write object block %d: %w", i, err)
+		}
+		sum := sha256.Sum256(data)
+		blocks[i] = ManifestBlock{ID: id, Size: len(data), Checksum: hex.EncodeToString(sum[:])}
+		written = append(written, blocks[i])
+		digest.Write([]byte(blocks[i].Checksum))
+	}
+
+	manifest := &ObjectManifest{
+		Name:             name,
+		Size:             size,
+		BlockSize:        o.blockSize,
+		Blocks:           blocks,
+		Checksum:         hex.EncodeToString(digest.Sum(nil)) + "-" + strconv.Itoa(count),
+		CreatedAt:        time.Now().UnixNano(),
+		StripeWidth:      o.stripeWidth,
+		ObjectAttributes: attrs,
+	}
+	if err := o.commitManifest(ctx, manifest); err != nil {
+		o.deleteBlocks(ctx, written)
+		return nil, err
+	}
+	if err := o.checkEpoch(ctx, epoch); err != nil {
+		o.discard(ctx, manifest)
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// readPrevious reads length bytes of a previous version of an object from
+// offset, zero-padded past its end
+func (o *ObjectStore) readPrevious(ctx context.Context, previous *ObjectManifest, offset, length int64) ([]byte, error) {
+	data := make([]byte, length)
+	if previous == nil || offset >= previous.Size {
+		return data, nil
+	}
+	buf := bytes.NewBuffer(data[:0])
+	if err := o.GetObjectRange(ctx, previous, offset, min(length, previous.Size-offset), buf); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// regular reports whether every block of an object but the last has the
+// given size, so that block i starts at i times it
+func (m *ObjectManifest) regular(blockSize int) bool {
+	for i, b := range m.Blocks {
+		if i < len(m.Blocks)-1 && b.Size != blockSize {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,326 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// IOClass classifies a request for scheduling purposes
+type IOClass int
+
+const (
+	// IOClassInteractive is latency-sensitive foreground reads
+	IOClassInteractive IOClass = iota
+	// IOClassBulk is foreground writes and deletes
+	IOClassBulk
+	// IOClassBackground is repair, scrub and other maintenance traffic
+	IOClassBackground
+
+	numIOClasses
+)
+
+// String returns the name of the IO class
+func (c IOClass) String() string {
+	switch c {
+	case IOClassInteractive:
+		return "interactive"
+	case IOClassBulk:
+		return "bulk"
+	case IOClassBackground:
+		return "background"
+	default:
+		return "unknown"
+	}
+}
+
+// ClassLimits holds the share and concurrency limit of an IO class
+type ClassLimits struct {
+	// Weight is the relative share of dispatch slots the class receives
+	// while other classes are also waiting
+	Weight int
+	// MaxConcurrent caps the number of in-flight requests of the class
+	MaxConcurrent int
+}
+
+// DefaultMaxInflight is the default number of requests the scheduler lets
+// run at the same time across all classes
+const DefaultMaxInflight = 64
+
+// DefaultClassLimits returns the default limits for each IO class
+func DefaultClassLimits() map[IOClass]ClassLimits {
+	return ClassLimitsFor(DefaultMaxInflight)
+}
+
+// ClassLimitsFor returns the default limits for each IO class, scaled to a
+// scheduler that runs maxInflight requests at the same time
+func ClassLimitsFor(maxInflight int) map[IOClass]ClassLimits {
+	bulk, background := maxInflight/2, maxInflight/8
+	if bulk < 1 {
+		bulk = 1
+	}
+	if background < 1 {
+		background = 1
+	}
+	return map[IOClass]ClassLimits{
+		IOClassInteractive: {Weight: 8, MaxConcurrent: maxInflight},
+		IOClassBulk:        {Weight: 4, MaxConcurrent: bulk},
+		IOClassBackground:  {Weight: 1, MaxConcurrent: background},
+	}
+}
+
+// classState tracks the queue and accounting of one IO class
+type classState struct {
+	limits   ClassLimits
+	inflight int
+	waiters  []chan struct{}
+	pass     float64
+	granted  uint64
+}
+
+// Scheduler admits block requests according to weighted shares and
+// per-class concurrency limits. When several classes are waiting, slots are
+// handed out by stride scheduling so that each class receives a share
+// proportional to its weight, and background traffic can never occupy more
+// than its own concurrency limit.
+type Scheduler struct {
+	maxInflight int
+	inflight    int
+	vtime       float64
+	classes     [numIOClasses]*classState
+	mu          sync.Mutex
+}
+
+// NewScheduler creates a new request scheduler
+func NewScheduler(maxInflight int, limits map[IOClass]ClassLimits) (*Scheduler, error) {
+	if maxInflight <= 0 {
+		return nil, fmt.Errorf("max inflight must be greater than zero")
+	}
+
+	s := &Scheduler{maxInflight: maxInflight}
+	defaults := DefaultClassLimits()
+	for class := IOClass(0); class < numIOClasses; class++ {
+		l, ok := limits[class]
+		if !ok {
+			l = defaults[class]
+		}
+		if l.Weight <= 0 {
+			return nil, fmt.Errorf("weight for class %s must be greater than zero", class)
+		}
+		if l.MaxConcurrent <= 0 {
+			return nil, fmt.Errorf("max concurrent for class %s must be greater than zero", class)
+		}
+		s.classes[class] = &classState{limits: l}
+	}
+
+	return s, nil
+}
+
+// SetMaxConcurrent changes the concurrency limit of an IO class. A higher
+// limit admits waiting requests right away; with a lower one, requests
+// already running finish and no more start until the class is under it.
+func (s *Scheduler) SetMaxConcurrent(class IOClass, n int) error {
+	if class < 0 || class >= numIOClasses {
+		return fmt.Errorf("unknown IO class %d", class)
+	}
+	if n <= 0 {
+		return fmt.Errorf("max concurrent for class %s must be greater than zero", class)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.classes[class].limits.MaxConcurrent = n
+	s.dispatch()
+	return nil
+}
+
+// MaxConcurrent returns the concurrency limit of an IO class
+func (s *Scheduler) MaxConcurrent(class IOClass) int {
+	if class < 0 || class >= numIOClasses {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.classes[class].limits.MaxConcurrent
+}
+
+// MaxInflight returns the number of requests the scheduler lets run at the
+// same time across all classes
+func (s *Scheduler) MaxInflight() int {
+	return s.maxInflight
+}
+
+// Acquire blocks until a request of the given class may run. The returned
+// function must be called once the request has finished.
+func (s *Scheduler) Acquire(ctx context.Context, class IOClass) (func(), error) {
+	if class < 0 || class >= numIOClasses {
+		return nil, fmt.Errorf("unknown IO class %d", class)
+	}
+
+	s.mu.Lock()
+	cs := s.classes[class]
+
+	// Fast path: nothing queued ahead of us and there is capacity
+	if len(cs.waiters) == 0 && s.canRun(cs) {
+		s.grant(cs)
+		s.mu.Unlock()
+		return s.releaseFunc(cs), nil
+	}
+
+	// A class returning from idle must not bank credit from the time it
+	// was not competing
+	if len(cs.waiters) == 0 && cs.pass < s.vtime {
+		cs.pass = s.vtime
+	}
+
+	ch := make(chan struct{})
+	cs.waiters = append(cs.waiters, ch)
+	s.mu.Unlock()
+
+	select {
+	case <-ch:
+		return s.releaseFunc(cs), nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		for i, w := range cs.waiters {
+			if w == ch {
+				cs.waiters = append(cs.waiters[:i], cs.waiters[i+1:]...)
+				return nil, ctx.Err()
+			}
+		}
+
+		// We were granted a slot concurrently with the cancellation, so
+		// give it back
+		cs.inflight--
+		s.inflight--
+		s.dispatch()
+		return nil, ctx.Err()
+	}
+}
+
+// releaseFunc returns a function that releases a slot of the class exactly once
+func (s *Scheduler) releaseFunc(cs *classState) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			cs.inflight--
+			s.inflight--
+			s.dispatch()
+		})
+	}
+}
+
+// canRun reports whether a request of the class fits within the limits
+func (s *Scheduler) canRun(cs *classState) bool {
+	return s.inflight < s.maxInflight && cs.inflight < cs.limits.MaxConcurrent
+}
+
+// grant accounts a dispatched request against its class
+func (s *Scheduler) grant(cs *classState) {
+	cs.inflight++
+	s.inflight++
+	cs.granted++
+	cs.pass += 1 / float64(cs.limits.Weight)
+	if cs.pass > s.vtime {
+		s.vtime = cs.pass
+	}
+}
+
+// dispatch hands free slots to waiting classes in stride order
+func (s *Scheduler) dispatch() {
+	for s.inflight < s.maxInflight {
+		var next *classState
+		for _, cs := range s.classes {
+			if len(cs.waiters) == 0 || cs.inflight >= cs.limits.MaxConcurrent {
+				continue
+			}
+			if next == nil || cs.pass < next.pass {
+				next = cs
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		ch := next.waiters[0]
+		next.waiters = next.waiters[1:]
+		s.grant(next)
+		close(ch)
+	}
+}
+
+// Load returns the number of running and queued requests and the
+// scheduler's capacity
+func (s *Scheduler) Load() (inflight, queued, maxInflight int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, cs := range s.classes {
+		queued += len(cs.waiters)
+	}
+	return s.inflight, queued, s.maxInflight
+}
+
+// SchedulerStats reports the scheduler's load, overall and per IO class
+type SchedulerStats struct {
+	Inflight    int                    `json:"inflight"`
+	MaxInflight int                    `json:"max_inflight"`
+	Queued      int                    `json:"queued"`
+	Classes     map[string]*ClassStats `json:"classes"`
+}
+
+// ClassStats reports the queue and dispatch counts of one IO class
+type ClassStats struct {
+	Inflight int    `json:"inflight"`
+	Queued   int    `json:"queued"`
+	Granted  uint64 `json:"granted"`
+}
+
+// Add accumulates the counts of other into s
+func (s *SchedulerStats) Add(other *SchedulerStats) {
+	s.Inflight += other.Inflight
+	s.MaxInflight += other.MaxInflight
+	s.Queued += other.Queued
+	if s.Classes == nil {
+		s.Classes = make(map[string]*ClassStats, len(other.Classes))
+	}
+	for name, cs := range other.Classes {
+		total, ok := s.Classes[name]
+		if !ok {
+			total = &ClassStats{}
+			s.Classes[name] = total
+		}
+		total.Inflight += cs.Inflight
+		total.Queued += cs.Queued
+		total.Granted += cs.Granted
+	}
+}
+
+// GetStats returns queue and dispatch statistics per IO class
+func (s *Scheduler) GetStats() *SchedulerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats := &SchedulerStats{
+		Inflight:    s.inflight,
+		MaxInflight: s.maxInflight,
+		Classes:     make(map[string]*ClassStats, len(s.classes)),
+	}
+	for class, cs := range s.classes {
+		stats.Queued += len(cs.waiters)
+		stats.Classes[IOClass(class).String()] = &ClassStats{
+			Inflight: cs.inflight,
+			Queued:   len(cs.waiters),
+			Granted:  cs.granted,
+		}
+	}
+
+	return stats
+}
@@ -0,0 +1,195 @@
+package block
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+)
+
+// MaxStripeWidth is the most blocks of an object written or read at once
+const MaxStripeWidth = 64
+
+// placementAttempts bounds the block IDs tried per chain for a block to
+// land on the chain its stripe assigns it
+const placementAttempts = 16
+
+// ChainLocator is implemented by block APIs that know which chain each
+// block maps to, so that an object store can stripe an object's blocks
+// across chains
+type ChainLocator interface {
+	// Chains returns the IDs of the chains new blocks may be placed on
+	// among those a block may map to
+	Chains(blockID string) []uint32
+	// ChainOf returns the ID of the chain a block maps to
+	ChainOf(blockID string) (uint32, bool)
+}
+
+// SetStripeWidth sets how many consecutive blocks of an object make up a
+// stripe, written and read in parallel. When the store's block API is a
+// ChainLocator, the blocks of an object are also assigned to the chains
+// round-robin, so that a stripe spans width chains. A width of zero or
+// one, the default, writes and reads blocks one at a time.
+func (o *ObjectStore) SetStripeWidth(width int) error {
+	if width < 0 || width > MaxStripeWidth {
+		return fmt.Errorf("stripe width must be between 0 and %d, got %d", MaxStripeWidth, width)
+	}
+	o.stripeWidth = max(width, 1)
+	return nil
+}
+
+// readWidth returns the number of blocks of an object read at once: the
+// store's stripe width, or the one the object was written with
+func (o *ObjectStore) readWidth(manifest *ObjectManifest) int {
+	return max(o.stripeWidth, manifest.StripeWidth, 1)
+}
+
+// placer picks the IDs of the blocks of one stream, assigning them to the
+// chains round-robin from the chain the stream's first block maps to when
+// striping, and otherwise to any of the chains new blocks may be placed on
+type placer struct {
+	o       *ObjectStore
+	prefix  string
+	chains  []uint32
+	first   int
+	striped bool
+}
+
+// newPlacer returns the placer of a stream. Without a chain locator, block
+// IDs follow from the prefix alone.
+func (o *ObjectStore) newPlacer(prefix string) *placer {
+	p := &placer{o: o, prefix: prefix, striped: o.stripeWidth > 1}
+	locator, ok := o.blocks.(ChainLocator)
+	if !ok {
+		return p
+	}
+	p.chains = locator.Chains(p.candidate(0, 0))
+	if chain, ok := locator.ChainOf(p.candidate(0, 0)); ok && p.striped {
+		for i, id := range p.chains {
+			if id == chain {
+				p.first = i
+				break
+			}
+		}
+	}
+	return p
+}
+
+// candidate returns the ID of a stream's block under one attempt at
+// placing it
+func (p *placer) candidate(index, attempt int) string {
+	if attempt == 0 {
+		return p.o.internalBlockID(hashID(p.prefix, fmt.Sprintf("%d", index)))
+	}
+	return p.o.internalBlockID(hashID(p.prefix, fmt.Sprintf("%d", index), fmt.Sprintf("%d", attempt)))
+}
+
+// blockID returns the ID of block index of the stream. Block IDs map to
+// chains by hash, so IDs are tried until one maps to the block's chain, or
+// without striping to any chain new blocks may be placed on; in the
+// unlikely case that none does, the block goes wherever its first ID maps.
+// Placement holds for the routing table the stream is written under:
+// blocks move with their IDs when the chains change.
+func (p *placer) blockID(index int) string {
+	if len(p.chains) == 0 {
+		return p.candidate(index, 0)
+	}
+	locator := p.o.blocks.(ChainLocator)
+	if !p.striped {
+		for attempt := 0; attempt < placementAttempts; attempt++ {
+			id := p.candidate(index, attempt)
+			if chain, ok := locator.ChainOf(id); !ok || slices.Contains(p.chains, chain) {
+				return id
+			}
+		}
+		return p.candidate(index, 0)
+	}
+	want := p.chains[(p.first+index)%len(p.chains)]
+	for attempt := 0; attempt < placementAttempts*len(p.chains); attempt++ {
+		id := p.candidate(index, attempt)
+		if chain, ok := locator.ChainOf(id); !ok || chain == want {
+			return id
+		}
+	}
+	return p.candidate(index, 0)
+}
+
+// writeStripe writes the blocks of a stripe in parallel, returning the
+// first error
+func (o *ObjectStore) writeStripe(ctx context.Context, ids []string, data [][]byte) error {
+	if len(ids) == 1 {
+		return o.blocks.WriteBlock(ctx, ids[0], data[0])
+	}
+	errs := make([]error, len(ids))
+	var wg sync.WaitGroup
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = o.blocks.WriteBlock(ctx, ids[i], data[i])
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("block %s: %w", ids[i], err)
+		}
+	}
+	return nil
+}
+
+// readBlocks reads blocks first to last of an object, a stripe at a time
+// with the blocks of each stripe read in parallel, and hands them to fn in
+// order
+func (o *ObjectStore) readBlocks(ctx context.Context, manifest *ObjectManifest, first, last int, fn func(index int, data []byte) error) error {
+	width := o.readWidth(manifest)
+	for start := first; start <= last; start += width {
+		end := min(start+width-1, last)
+		stripe := make([][]byte, end-start+1)
+		errs := make([]error, len(stripe))
+		if len(stripe) == 1 {
+			stripe[0], errs[0] = o.ReadObjectBlock(ctx, manifest, start)
+		} else {
+			var wg sync.WaitGroup
+			for i := range stripe {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					stripe[i], errs[i] = o.ReadObjectBlock(ctx, manifest, start+i)
+				}(i)
+			}
+			wg.Wait()
+		}
+
+		for i, data := range stripe {
+			if errs[i] != nil {
+				return errs[i]
+			}
+			if err := fn(start+i, data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// readStripe reads the blocks of the next stripe of a stream, at most
+// width of them, reporting whether the stream is exhausted
+func readStripe(r io.Reader, width, blockSize int) ([][]byte, bool, error) {
+	stripe := make([][]byte, 0, width)
+	for len(stripe) < width {
+		buf := make([]byte, blockSize)
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			stripe = append(stripe, buf[:n])
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return stripe, true, nil
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return stripe, false, nil
+}
@@ -0,0 +1,503 @@
+// Package cdc keeps a durable, ordered log of the block mutations a node
+// committed, for external consumers to tail. Records are numbered by
+// offsets that only grow; a consumer resumes after the last record it
+// processed with a token naming the log and the offset, so that a log
+// that was wiped and started over is told apart from the one it read.
+package cdc
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+const (
+	// metaFile holds the log's ID, in the log's directory
+	metaFile = "log.json"
+	// segmentSuffix ends the names of segment files, which start with the
+	// offset of their first record
+	segmentSuffix = ".log"
+	// maxSegmentSize is the size a segment is closed at and a new one
+	// started, unless the log's maximum size calls for smaller ones
+	maxSegmentSize = 64 << 20
+	// minSegmentSize is the smallest size segments are closed at
+	minSegmentSize = 1 << 20
+	// indexInterval is how many records apart the in-memory index of a
+	// segment points into it
+	indexInterval = 256
+)
+
+var (
+	// ErrTruncated reports a read of records pruned from the log
+	ErrTruncated = errors.New("change records were pruned from the log")
+	// ErrUnknownLog reports a resume token of another log, such as the log
+	// of the node before its data was wiped
+	ErrUnknownLog = errors.New("resume token is of another change log")
+	// ErrClosed reports the use of a closed log
+	ErrClosed = errors.New("change log is closed")
+)
+
+// Options bound how much of the log is kept. Whole segments are pruned,
+// oldest first, once the log outgrows MaxSize or their newest record is
+// older than Retention; zero leaves either unbounded. The segment being
+// written to is never pruned.
+type Options struct {
+	Retention time.Duration
+	MaxSize   int64
+}
+
+// meta is the content of the meta file
+type meta struct {
+	ID string `json:"id"`
+}
+
+// indexEntry points at the record with an offset in a segment file
+type indexEntry struct {
+	offset uint64
+	pos    int64
+}
+
+// segment is a file of consecutive records
+type segment struct {
+	path string
+	// first is the offset of the segment's first record and last that of
+	// its last, or first-1 when it holds none
+	first uint64
+	last  uint64
+	size  int64
+	// newest is the time of the last record
+	newest int64
+	index  []indexEntry
+}
+
+// Log is a change log made of segment files. Each record is synced before
+// Append returns, so that a change acknowledged to a client is never lost
+// to consumers.
+type Log struct {
+	dir         string
+	id          string
+	opts        Options
+	segmentSize int64
+
+	mu       sync.Mutex
+	segments []*segment
+	// file is the last segment, which records are appended to
+	file *os.File
+	next uint64
+	// changed is closed when records are appended, for Wait
+	changed chan struct{}
+	closed  bool
+}
+
+// Open opens the log in dir, creating it if needed. A record torn by a
+// crash at the end of the last segment is dropped: the change it recorded
+// was never acknowledged.
+func Open(dir string, opts Options) (*Log, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create change log directory: %w", err)
+	}
+	l := &Log{dir: dir, opts: opts, segmentSize: maxSegmentSize, next: 1, changed: make(chan struct{})}
+	if opts.MaxSize > 0 && opts.MaxSize/4 < l.segmentSize {
+		l.segmentSize = max(opts.MaxSize/4, minSegmentSize)
+	}
+	id, err := loadID(dir)
+	if err != nil {
+		return nil, err
+	}
+	l.id = id
+
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segmentSuffix))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list change log segments: %w", err)
+	}
+	// Names are zero-padded, so that they sort by offset
+	slices.Sort(names)
+	for _, name := range names {
+		first, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seg, err := scanSegment(name, first)
+		if err != nil {
+			return nil, err
+		}
+		l.segments = append(l.segments, seg)
+	}
+
+	if len(l.segments) == 0 {
+		if err := l.startSegment(); err != nil {
+			return nil, err
+		}
+	} else {
+		seg := l.segments[len(l.segments)-1]
+		file, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open change log segment: %w", err)
+		}
+		if err := file.Truncate(seg.size); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to truncate change log segment: %w", err)
+		}
+		if _, err := file.Seek(seg.size, io.SeekStart); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to open change log segment: %w", err)
+		}
+		l.file = file
+		l.next = seg.last + 1
+	}
+	l.prune(time.Now())
+	return l, nil
+}
+
+// loadID reads the log's ID, giving the log a new random one if it has
+// none yet
+func loadID(dir string) (string, error) {
+	path := filepath.Join(dir, metaFile)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		var m meta
+		if err := json.Unmarshal(data, &m); err != nil || m.ID == "" {
+			return "", fmt.Errorf("failed to parse change log metadata %s", path)
+		}
+		return m.ID, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read change log metadata: %w", err)
+	}
+
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate change log ID: %w", err)
+	}
+	m := meta{ID: hex.EncodeToString(b[:])}
+	data, err = json.Marshal(m)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal change log metadata: %w", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write change log metadata: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write change log metadata: %w", err)
+	}
+	return m.ID, nil
+}
+
+// scanSegment reads a segment file on opening, indexing its records. Its
+// size is set to the end of the last whole record.
+func scanSegment(path string, first uint64) (*segment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open change log segment: %w", err)
+	}
+	defer file.Close()
+
+	seg := &segment{path: path, first: first, last: first - 1}
+	r := bufio.NewReader(file)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read change log segment: %w", err)
+		}
+		var rec api.ChangeRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			break
+		}
+		seg.add(rec, int64(len(line)))
+	}
+	return seg, nil
+}
+
+// add accounts for a record of length n appended to the segment
+func (s *segment) add(rec api.ChangeRecord, n int64) {
+	if (rec.Offset-s.first)%indexInterval == 0 {
+		s.index = append(s.index, indexEntry{offset: rec.Offset, pos: s.size})
+	}
+	s.last = rec.Offset
+	s.newest = rec.Time
+	s.size += n
+}
+
+// seek returns where to start reading the segment for the record at
+// offset, or those following it
+func (s *segment) seek(offset uint64) int64 {
+	i := sort.Search(len(s.index), func(i int) bool { return s.index[i].offset > offset })
+	if i == 0 {
+		return 0
+	}
+	return s.index[i-1].pos
+}
+
+// startSegment closes the segment being written to and starts a new one at
+// the next offset. Must be called with the lock held, or while opening.
+func (l *Log) startSegment() error {
+	path := filepath.Join(l.dir, fmt.Sprintf("%020d%s", l.next, segmentSuffix))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create change log segment: %w", err)
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+	l.segments = append(l.segments, &segment{path: path, first: l.next, last: l.next - 1})
+	return nil
+}
+
+// Append records a change at the next offset, which it returns. The record
+// is synced before Append returns.
+func (l *Log) Append(rec api.ChangeRecord) (uint64, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return 0, ErrClosed
+	}
+
+	seg := l.segments[len(l.segments)-1]
+	if seg.size >= l.segmentSize {
+		if err := l.startSegment(); err != nil {
+			return 0, err
+		}
+		seg = l.segments[len(l.segments)-1]
+		l.prune(time.Now())
+	}
+
+	rec.Offset = l.next
+	if rec.Time == 0 {
+		rec.Time = time.Now().UnixNano()
+	}
+	line, err := json.Marshal(&rec)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal change record: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err = l.file.Write(line); err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// Drop what was written of the record, so that it neither tears
+		// the segment nor reaches consumers
+		l.file.Truncate(seg.size)
+		l.file.Seek(seg.size, io.SeekStart)
+		return 0, fmt.Errorf("failed to append to change log: %w", err)
+	}
+	seg.add(rec, int64(len(line)))
+	l.next++
+
+	close(l.changed)
+	l.changed = make(chan struct{})
+	return rec.Offset, nil
+}
+
+// prune removes the segments the options no longer keep. Must be called
+// with the lock held, or while opening.
+func (l *Log) prune(now time.Time) {
+	var total int64
+	for _, seg := range l.segments {
+		total += seg.size
+	}
+	for len(l.segments) > 1 {
+		seg := l.segments[0]
+		tooBig := l.opts.MaxSize > 0 && total > l.opts.MaxSize
+		tooOld := l.opts.Retention > 0 && seg.newest < now.Add(-l.opts.Retention).UnixNano()
+		if !tooBig && !tooOld {
+			return
+		}
+		if err := os.Remove(seg.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		total -= seg.size
+		l.segments = l.segments[1:]
+	}
+}
+
+// Read returns up to limit records following offset after, of the blocks
+// whose ID starts with prefix, and the offset of the last record it went
+// through, to read on after. An offset of zero reads from the oldest
+// record the log holds; a later one fails with ErrTruncated once the
+// records following it were pruned.
+func (l *Log) Read(after uint64, limit int, prefix string) ([]api.ChangeRecord, uint64, error) {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil, after, ErrClosed
+	}
+	if after != 0 && after+1 < l.segments[0].first {
+		l.mu.Unlock()
+		return nil, after, ErrTruncated
+	}
+	// The segments are copied, so that records appended while reading are
+	// left to the next read
+	var segments []segment
+	for _, seg := range l.segments {
+		if seg.last > after {
+			segments = append(segments, *seg)
+		}
+	}
+	l.mu.Unlock()
+
+	records := []api.ChangeRecord{}
+	last := after
+	for _, seg := range segments {
+		done, err := readSegment(&seg, after, func(rec api.ChangeRecord) bool {
+			last = rec.Offset
+			if strings.HasPrefix(rec.BlockID, prefix) {
+				records = append(records, rec)
+			}
+			return limit > 0 && len(records) >= limit
+		})
+		if err != nil {
+			return nil, after, err
+		}
+		if done {
+			break
+		}
+	}
+	return records, last, nil
+}
+
+// readSegment calls fn with the records of a segment following offset
+// after, until fn returns true, which readSegment then returns
+func readSegment(seg *segment, after uint64, fn func(api.ChangeRecord) bool) (bool, error) {
+	file, err := os.Open(seg.path)
+	if errors.Is(err, os.ErrNotExist) {
+		// Pruned since the segments were copied
+		return false, ErrTruncated
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to open change log segment: %w", err)
+	}
+	defer file.Close()
+
+	pos := seg.seek(after + 1)
+	r := bufio.NewReader(io.NewSectionReader(file, pos, seg.size-pos))
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to read change log segment: %w", err)
+		}
+		var rec api.ChangeRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return false, fmt.Errorf("failed to parse change record: %w", err)
+		}
+		if rec.Offset <= after {
+			continue
+		}
+		if fn(rec) {
+			return true, nil
+		}
+	}
+}
+
+// Wait blocks until the log holds records following offset after, or the
+// context ends
+func (l *Log) Wait(ctx context.Context, after uint64) error {
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return ErrClosed
+		}
+		if l.next-1 > after {
+			l.mu.Unlock()
+			return nil
+		}
+		changed := l.changed
+		l.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Oldest returns the offset of the oldest record the log holds, or of the
+// next one when it holds none
+func (l *Log) Oldest() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, seg := range l.segments {
+		if seg.last >= seg.first {
+			return seg.first
+		}
+	}
+	return l.next
+}
+
+// Last returns the offset of the last record appended, or zero if there
+// is none yet
+func (l *Log) Last() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.next - 1
+}
+
+// Token returns the resume token to read the records following offset
+// after with
+func (l *Log) Token(after uint64) string {
+	return fmt.Sprintf("%s-%d", l.id, after)
+}
+
+// ParseToken returns the offset a resume token reads on after. An empty
+// token reads from the oldest record.
+func (l *Log) ParseToken(token string) (uint64, error) {
+	if token == "" {
+		return 0, nil
+	}
+	id, offset, ok := strings.Cut(token, "-")
+	if !ok {
+		return 0, fmt.Errorf("invalid resume token %q", token)
+	}
+	after, err := strconv.ParseUint(offset, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid resume token %q", token)
+	}
+	if id != l.id {
+		return 0, ErrUnknownLog
+	}
+	return after, nil
+}
+
+// Close syncs and closes the log, waking the readers waiting for records
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.changed)
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close change log: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+// Package clone copies blocks from one cluster to another, such as to seed
+// a disaster recovery site or refresh a staging environment from
+// production. Blocks are read from the tails of their chains in the
+// source and written to the heads in the destination, by workers in
+// parallel; each copy is verified against the source's checksum once
+// written. In delta mode, blocks the destination already holds with the
+// same version and checksum are skipped, so that a clone run again copies
+// only what changed.
+package clone
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// DefaultWorkers is the number of blocks copied at the same time
+const DefaultWorkers = 16
+
+// Options configures a clone
+type Options struct {
+	// Prefixes selects the blocks with IDs starting with any of them; a
+	// namespace is selected as "namespace:". Empty selects every block.
+	Prefixes []string
+	// Workers is the number of blocks copied at the same time, each worker
+	// with connections of its own
+	Workers int
+	// Delta skips blocks the destination holds with the same version and
+	// checksum as the source
+	Delta bool
+	// DryRun lists what would be copied without writing
+	DryRun bool
+}
+
+// Result counts the blocks of a clone
+type Result struct {
+	Listed  int64 `json:"listed"`
+	Copied  int64 `json:"copied"`
+	Skipped int64 `json:"skipped"`
+	Failed  int64 `json:"failed"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Cluster opens a client of a cluster for a worker
+type Cluster func() *client.Cluster
+
+// Run copies the selected blocks of src to dst. A block that fails to
+// copy is logged and counted, and the others are still copied; run the
+// clone again in delta mode to retry only the failures. Ending ctx stops
+// the clone once the blocks being copied are.
+func Run(ctx context.Context, src, dst Cluster, opts Options, logger *slog.Logger) (*Result, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	prefixes := opts.Prefixes
+	if len(prefixes) == 0 {
+		prefixes = []string{""}
+	}
+
+	lister := src()
+	defer lister.Close()
+	var result Result
+	var blockIDs []string
+	seen := make(map[string]bool)
+	for _, prefix := range prefixes {
+		ids, err := lister.List(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list the source: %w", err)
+		}
+		for _, id := range ids {
+			// Prefixes may overlap
+			if !seen[id] {
+				seen[id] = true
+				blockIDs = append(blockIDs, id)
+			}
+		}
+	}
+	result.Listed = int64(len(blockIDs))
+	logger.Info("copying blocks", "blocks", len(blockIDs), "delta", opts.Delta, "dry_run", opts.DryRun)
+
+	copyCtx := context.WithoutCancel(ctx)
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			from, to := src(), dst()
+			defer from.Close()
+			defer to.Close()
+			for blockID := range work {
+				copied, n, err := copyBlock(copyCtx, from, to, blockID, opts)
+				switch {
+				case err != nil:
+					atomic.AddInt64(&result.Failed, 1)
+					logger.Error("failed to copy block", "block", blockID, "error", err)
+				case copied && opts.DryRun:
+					atomic.AddInt64(&result.Copied, 1)
+					logger.Info("block would be copied", "block", blockID)
+				case copied:
+					atomic.AddInt64(&result.Copied, 1)
+					atomic.AddInt64(&result.Bytes, n)
+					logger.Debug("block copied", "block", blockID, "bytes", n)
+				default:
+					atomic.AddInt64(&result.Skipped, 1)
+				}
+			}
+		}()
+	}
+
+feed:
+	for _, blockID := range blockIDs {
+		select {
+		case work <- blockID:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return &result, err
+	}
+	if result.Failed > 0 {
+		return &result, fmt.Errorf("%d blocks failed to copy; run the clone again with delta mode to retry them", result.Failed)
+	}
+	return &result, nil
+}
+
+// copyBlock copies a block unless delta mode finds the destination's copy
+// current, returning whether it was copied and its size. The copy is
+// verified by reading back the destination's checksum.
+func copyBlock(ctx context.Context, src, dst *client.Cluster, blockID string, opts Options) (bool, int64, error) {
+	if opts.Delta {
+		srcStat, err := src.Stat(ctx, blockID)
+		if err != nil {
+			return false, 0, fmt.Errorf("source: %w", err)
+		}
+		if dstStat, err := dst.Stat(ctx, blockID); err == nil && current(srcStat, dstStat) {
+			return false, 0, nil
+		}
+	}
+	if opts.DryRun {
+		return true, 0, nil
+	}
+
+	// Fetch verifies the data against the source's checksum
+	data, stat, err := src.Fetch(ctx, blockID, 0)
+	if err != nil {
+		return false, 0, fmt.Errorf("source: %w", err)
+	}
+	if err := dst.Write(ctx, blockID, data); err != nil {
+		return false, 0, fmt.Errorf("destination: %w", err)
+	}
+	written, err := dst.Stat(ctx, blockID)
+	if err != nil {
+		return false, 0, fmt.Errorf("destination: %w", err)
+	}
+	if written.Checksum != stat.Checksum {
+		return false, 0, errors.New("the destination's checksum differs from the source's")
+	}
+	return true, int64(len(data)), nil
+}
+
+// current reports whether the destination's copy of a block is that of
+// the source
+func current(src, dst *api.BlockStat) bool {
+	return src.Version == dst.Version && src.Checksum == dst.Checksum
+}
@@ -0,0 +1,134 @@
+package coordinator
+
+import (
+	"fmt"
+	"time"
+)
+
+// fullnessHysteresis is how far below the balance policy's maximum a nearly
+// full node's fullness has to drop before it takes new data again, so that
+// a node hovering at the limit does not flip with every heartbeat
+const fullnessHysteresis = 0.02
+
+// BalancePolicy skews new chain members and object blocks towards emptier,
+// less busy nodes, from the free space and write rate they report in their
+// heartbeats. The cost of placing a member on a node is its number of
+// memberships plus one, scaled by one plus FullnessWeight times the
+// fraction of its capacity in use plus WriteWeight times its write rate
+// relative to the busiest node's; the cheapest node wins.
+type BalancePolicy struct {
+	// FullnessWeight is how much a full node costs over an empty one
+	FullnessWeight float64
+	// WriteWeight is how much the busiest node costs over an idle one
+	WriteWeight float64
+	// MaxFullness is the fraction of its capacity above which a node is
+	// nearly full: it only gets new members when no other node fits, and
+	// clients stop placing new object blocks on its chains
+	MaxFullness float64
+}
+
+// Defaults of the balance policy
+const (
+	DefaultFullnessWeight = 1.0
+	DefaultWriteWeight    = 0.5
+	DefaultMaxFullness    = 0.9
+)
+
+// DefaultBalancePolicy returns the balance policy used when none is set
+func DefaultBalancePolicy() BalancePolicy {
+	return BalancePolicy{
+		FullnessWeight: DefaultFullnessWeight,
+		WriteWeight:    DefaultWriteWeight,
+		MaxFullness:    DefaultMaxFullness,
+	}
+}
+
+// validate checks the weights and the maximum fullness of a policy
+func (p BalancePolicy) validate() error {
+	if p.FullnessWeight < 0 || p.WriteWeight < 0 {
+		return fmt.Errorf("balance weights must not be negative, got %g and %g", p.FullnessWeight, p.WriteWeight)
+	}
+	if p.MaxFullness <= 0 || p.MaxFullness > 1 {
+		return fmt.Errorf("max fullness must be above 0 and at most 1, got %g", p.MaxFullness)
+	}
+	return nil
+}
+
+// SetBalance sets the balance policy used for chain assignments from now
+// on. Existing members are not moved, and nodes are marked nearly full or
+// not as they next report.
+func (c *Coordinator) SetBalance(policy BalancePolicy) error {
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.balance = policy
+	return nil
+}
+
+// Balance returns the balance policy
+func (c *Coordinator) Balance() BalancePolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.balance
+}
+
+// markFullness sets or clears a node's nearly full flag from its latest
+// heartbeat, reporting whether the flag changed. Must be called with the
+// lock held.
+func (c *Coordinator) markFullness(nodeID string) bool {
+	node, ok := c.table.Nodes[nodeID]
+	if !ok {
+		return false
+	}
+	fullness, ok := c.fullness(nodeID)
+	if !ok {
+		return false
+	}
+
+	switch {
+	case !node.NearlyFull && fullness >= c.balance.MaxFullness:
+		node.NearlyFull = true
+		c.logger.Warn("node is nearly full; new data goes to other nodes",
+			"node", nodeID, "fullness", fullness, "max_fullness", c.balance.MaxFullness)
+	case node.NearlyFull && fullness < c.balance.MaxFullness-fullnessHysteresis:
+		node.NearlyFull = false
+		c.logger.Info("node has room for new data again", "node", nodeID, "fullness", fullness)
+	default:
+		return false
+	}
+	node.UpdatedAt = time.Now().UnixNano()
+	return true
+}
+
+// maxWriteRate returns the highest write rate the nodes last reported.
+// Must be called with the lock held.
+func (c *Coordinator) maxWriteRate() float64 {
+	var highest float64
+	for _, load := range c.loads {
+		highest = max(highest, load.WriteRate)
+	}
+	return highest
+}
+
+// allocationCost returns the cost of adding a chain member on a node under
+// the balance policy. Nodes that have not reported cost as much as empty,
+// idle ones. Must be called with the lock held.
+func (c *Coordinator) allocationCost(nodeID string, load map[string]int, maxWrite float64) float64 {
+	scale := 1.0
+	if fullness, ok := c.fullness(nodeID); ok {
+		scale += c.balance.FullnessWeight * min(fullness, 1)
+	}
+	if l, ok := c.loads[nodeID]; ok && maxWrite > 0 {
+		scale += c.balance.WriteWeight * l.WriteRate / maxWrite
+	}
+	return float64(load[nodeID]+1) * scale
+}
+
+// nearlyFull reports whether a node is marked nearly full. Must be called
+// with the lock held.
+func (c *Coordinator) nearlyFull(nodeID string) bool {
+	node, ok := c.table.Nodes[nodeID]
+	return ok && node.NearlyFull
+}
@@ -0,0 +1,130 @@
+package coordinator
+
+import (
+	"fmt"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// AddChainMember adds an up node to a chain, just before its tail. The
+// tail serves committed reads and is the reference for repair, so it stays
+// the member that holds the chain's data while the new one is filled by
+// repair. The chain may grow past its length this way; a member can then
+// be removed once the new one has caught up.
+func (c *Coordinator) AddChainMember(chainID uint32, nodeID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chain, err := c.chainLocked(chainID)
+	if err != nil {
+		return err
+	}
+	if node, ok := c.table.Nodes[nodeID]; !ok || !node.Healthy() {
+		return fmt.Errorf("node %s is not up", nodeID)
+	} else if node.IsCache() {
+		return fmt.Errorf("node %s is a cache node, which holds no replicas", nodeID)
+	}
+	if contains(chain.Members, nodeID) {
+		return fmt.Errorf("node %s is already a member of chain %d", nodeID, chainID)
+	}
+	if sharesHost(c.table, chain.Members, "", nodeID) {
+		return fmt.Errorf("node %s shares a host with a member of chain %d", nodeID, chainID)
+	}
+	if !c.placementOf(chain).placeable(c.table, chain.Members, "", nodeID) {
+		return fmt.Errorf("node %s shares a failure domain with a member of chain %d", nodeID, chainID)
+	}
+	if err := c.breaksRules(chain, "", nodeID); err != nil {
+		return err
+	}
+
+	members := make([]string, 0, len(chain.Members)+1)
+	if n := len(chain.Members); n > 0 {
+		members = append(members, chain.Members[:n-1]...)
+		members = append(members, nodeID, chain.Members[n-1])
+	} else {
+		members = append(members, nodeID)
+	}
+	chain.Members = members
+	chain.Version++
+	c.logger.Info("added chain member", "chain", chainID, "node", nodeID)
+	return c.commit()
+}
+
+// RemoveChainMember removes a node from a chain. A chain is not left with
+// fewer up members than its length unless force is set, so that a member
+// is replaced by adding the new one first; a chain left short is refilled
+// at the next change of the chain table. The last member is never removed.
+func (c *Coordinator) RemoveChainMember(chainID uint32, nodeID string, force bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chain, err := c.chainLocked(chainID)
+	if err != nil {
+		return err
+	}
+	if !contains(chain.Members, nodeID) {
+		return fmt.Errorf("node %s is not a member of chain %d", nodeID, chainID)
+	}
+	if len(chain.Members) == 1 {
+		return fmt.Errorf("node %s is the last member of chain %d", nodeID, chainID)
+	}
+
+	members := make([]string, 0, len(chain.Members)-1)
+	up := 0
+	for _, member := range chain.Members {
+		if member == nodeID {
+			continue
+		}
+		members = append(members, member)
+		if node, ok := c.table.Nodes[member]; ok && node.State == api.NodeStateUp {
+			up++
+		}
+	}
+	if length := c.chainLengthOf(chain); up < length && !force {
+		return fmt.Errorf("chain %d would be left with %d of %d up members; add a replacement first", chainID, up, length)
+	}
+
+	chain.Members = members
+	chain.Version++
+	c.logger.Info("removed chain member", "chain", chainID, "node", nodeID)
+	return c.commit()
+}
+
+// SetChainHead moves a member of a chain to its head, keeping the order of
+// the others
+func (c *Coordinator) SetChainHead(chainID uint32, nodeID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	chain, err := c.chainLocked(chainID)
+	if err != nil {
+		return err
+	}
+	if !contains(chain.Members, nodeID) {
+		return fmt.Errorf("node %s is not a member of chain %d", nodeID, chainID)
+	}
+	if chain.Head() == nodeID {
+		return nil
+	}
+
+	members := make([]string, 0, len(chain.Members))
+	members = append(members, nodeID)
+	for _, member := range chain.Members {
+		if member != nodeID {
+			members = append(members, member)
+		}
+	}
+	chain.Members = members
+	chain.Version++
+	c.logger.Info("changed chain head", "chain", chainID, "node", nodeID)
+	return c.commit()
+}
+
+// chainLocked returns a chain of the table. Must be called with the lock
+// held.
+func (c *Coordinator) chainLocked(chainID uint32) (*api.ChainRecord, error) {
+	if int(chainID) >= len(c.table.Chains) {
+		return nil, fmt.Errorf("chain %d not found", chainID)
+	}
+	return c.table.Chains[chainID], nil
+}
@@ -0,0 +1,347 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/usage"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// PathPrefix is where storage nodes mount the coordinator API on their
+// admin server
+const PathPrefix = "/v1/coordinator"
+
+// Client talks to the coordinator API, failing over between the
+// configured coordinator addresses. Replicas that are not the elected
+// leader redirect requests to it.
+type Client struct {
+	addresses []string
+	http      *http.Client
+}
+
+// NewClient creates a coordinator client. Addresses are the admin
+// host:port of nodes running the coordinator.
+func NewClient(addresses []string) (*Client, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("at least one coordinator address is required")
+	}
+
+	normalized := make([]string, 0, len(addresses))
+	for _, addr := range addresses {
+		normalized = append(normalized, hostPort(addr))
+	}
+
+	return &Client{
+		addresses: normalized,
+		http:      &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// do sends a request to the first reachable coordinator. It returns false
+// if the coordinator replied 304 Not Modified.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) (bool, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return false, fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	var lastErr error
+	for _, addr := range c.addresses {
+		req, err := http.NewRequestWithContext(ctx, method, "http://"+addr+PathPrefix+path, bytes.NewReader(body))
+		if err != nil {
+			return false, fmt.Errorf("failed to build request: %w", err)
+		}
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode == http.StatusNotModified {
+			return false, nil
+		}
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			// A replica without a leader; another may know one
+			lastErr = fmt.Errorf("coordinator %s returned %s", addr, resp.Status)
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			var apiErr struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(respBody, &apiErr) == nil && apiErr.Error != "" {
+				return false, fmt.Errorf("coordinator %s: %s", addr, apiErr.Error)
+			}
+			return false, fmt.Errorf("coordinator %s returned %s", addr, resp.Status)
+		}
+
+		if out != nil {
+			if err := json.Unmarshal(respBody, out); err != nil {
+				return false, fmt.Errorf("failed to unmarshal response: %w", err)
+			}
+		}
+		return true, nil
+	}
+
+	return false, fmt.Errorf("no coordinator reachable: %w", lastErr)
+}
+
+// FetchRouting returns the routing table, or nil if it is still at
+// knownVersion
+func (c *Client) FetchRouting(ctx context.Context, knownVersion uint64) (*api.RoutingTable, error) {
+	path := "/routing"
+	if knownVersion > 0 {
+		path += fmt.Sprintf("?version=%d", knownVersion)
+	}
+
+	var table api.RoutingTable
+	changed, err := c.do(ctx, http.MethodGet, path, nil, &table)
+	if err != nil || !changed {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// AddNode adds or updates a node record
+func (c *Client) AddNode(ctx context.Context, node *api.NodeRecord) (*api.RoutingTable, error) {
+	var table api.RoutingTable
+	if _, err := c.do(ctx, http.MethodPost, "/nodes", node, &table); err != nil {
+		return nil, err
+	}
+	return &table, nil
+}
+
+// RemoveNode removes a node
+func (c *Client) RemoveNode(ctx context.Context, nodeID string) error {
+	_, err := c.do(ctx, http.MethodDelete, "/nodes/"+url.PathEscape(nodeID), nil, nil)
+	return err
+}
+
+// SetNodeState changes a node's state
+func (c *Client) SetNodeState(ctx context.Context, nodeID string, state api.NodeState) error {
+	body := map[string]api.NodeState{"state": state}
+	_, err := c.do(ctx, http.MethodPut, "/nodes/"+url.PathEscape(nodeID)+"/state", body, nil)
+	return err
+}
+
+// Heartbeat reports a node's capacity and load
+func (c *Client) Heartbeat(ctx context.Context, hb *api.Heartbeat) error {
+	_, err := c.do(ctx, http.MethodPost, "/nodes/"+url.PathEscape(hb.NodeID)+"/heartbeat", hb, nil)
+	return err
+}
+
+// ReportUsage reports a node's usage of the namespaces
+func (c *Client) ReportUsage(ctx context.Context, report *api.UsageReport) error {
+	_, err := c.do(ctx, http.MethodPost, "/usage", report, nil)
+	return err
+}
+
+// Usage returns the use of a namespace, or of every namespace if it is
+// empty, over the windows ending in the last since, or every window kept
+// if since is zero
+func (c *Client) Usage(ctx context.Context, namespace string, since time.Duration) (*usage.Summary, error) {
+	query := url.Values{}
+	if namespace != "" {
+		query.Set("namespace", namespace)
+	}
+	if since > 0 {
+		query.Set("since", since.String())
+	}
+	path := "/usage"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	var summary usage.Summary
+	if _, err := c.do(ctx, http.MethodGet, path, nil, &summary); err != nil {
+		return nil, err
+	}
+	return &summary, nil
+}
+
+// Nodes returns the node records
+func (c *Client) Nodes(ctx context.Context) ([]*api.NodeRecord, error) {
+	var nodes []*api.NodeRecord
+	if _, err := c.do(ctx, http.MethodGet, "/nodes", nil, &nodes); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// Chain returns a single chain
+func (c *Client) Chain(ctx context.Context, chainID uint32) (*api.ChainRecord, error) {
+	var chain api.ChainRecord
+	if _, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/chains/%d", chainID), nil, &chain); err != nil {
+		return nil, err
+	}
+	return &chain, nil
+}
+
+// AddChainMember adds a node to a chain, returning the changed chain
+func (c *Client) AddChainMember(ctx context.Context, chainID uint32, nodeID string) (*api.ChainRecord, error) {
+	var chain api.ChainRecord
+	body := map[string]string{"node": nodeID}
+	if _, err := c.do(ctx, http.MethodPost, fmt.Sprintf("/chains/%d/members", chainID), body, &chain); err != nil {
+		return nil, err
+	}
+	return &chain, nil
+}
+
+// RemoveChainMember removes a node from a chain, returning the changed
+// chain. Without force, a chain is not left short of members.
+func (c *Client) RemoveChainMember(ctx context.Context, chainID uint32, nodeID string, force bool) (*api.ChainRecord, error) {
+	var chain api.ChainRecord
+	path := fmt.Sprintf("/chains/%d/members/%s", chainID, url.PathEscape(nodeID))
+	if force {
+		path += "?force=true"
+	}
+	if _, err := c.do(ctx, http.MethodDelete, path, nil, &chain); err != nil {
+		return nil, err
+	}
+	return &chain, nil
+}
+
+// SetChainHead moves a member to the head of a chain, returning the
+// changed chain
+func (c *Client) SetChainHead(ctx context.Context, chainID uint32, nodeID string) (*api.ChainRecord, error) {
+	var chain api.ChainRecord
+	body := map[string]string{"node": nodeID}
+	if _, err := c.do(ctx, http.MethodPut, fmt.Sprintf("/chains/%d/head", chainID), body, &chain); err != nil {
+		return nil, err
+	}
+	return &chain, nil
+}
+
+// Rebalance starts a rebalance pass
+func (c *Client) Rebalance(ctx context.Context) error {
+	_, err := c.do(ctx, http.MethodPost, "/rebalance", nil, nil)
+	return err
+}
+
+// RebalanceStatus returns the status of the current or last rebalance
+func (c *Client) RebalanceStatus(ctx context.Context) (*RebalanceStatus, error) {
+	var status RebalanceStatus
+	if _, err := c.do(ctx, http.MethodGet, "/rebalance", nil, &status); err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+// ExplainPlacement returns a dry run of chain assignment, with the
+// candidates of a chain if it is not nil
+func (c *Client) ExplainPlacement(ctx context.Context, chain *uint32) (*PlacementExplanation, error) {
+	path := "/placement/explain"
+	if chain != nil {
+		path += "?chain=" + strconv.FormatUint(uint64(*chain), 10)
+	}
+	var explanation PlacementExplanation
+	if _, err := c.do(ctx, http.MethodGet, path, nil, &explanation); err != nil {
+		return nil, err
+	}
+	return &explanation, nil
+}
+
+// Watcher keeps a local copy of the routing table up to date by polling
+// the coordinator
+type Watcher struct {
+	client   *Client
+	interval time.Duration
+	table    *api.RoutingTable
+	onUpdate func(*api.RoutingTable)
+	logger   *slog.Logger
+	mu       sync.RWMutex
+}
+
+// NewWatcher creates a routing table watcher. onUpdate, if set, is called
+// with every new table version.
+func NewWatcher(client *Client, interval time.Duration, onUpdate func(*api.RoutingTable), logger *slog.Logger) *Watcher {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	return &Watcher{
+		client:   client,
+		interval: interval,
+		onUpdate: onUpdate,
+		logger:   logging.Component(logger, "routing"),
+	}
+}
+
+// Run polls the coordinator until ctx is cancelled
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.Refresh(ctx); err != nil && ctx.Err() == nil {
+			w.logger.Warn("failed to refresh routing table", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Refresh fetches the routing table once
+func (w *Watcher) Refresh(ctx context.Context) error {
+	var known uint64
+	if current := w.Table(); current != nil {
+		known = current.Version
+	}
+
+	table, err := w.client.FetchRouting(ctx, known)
+	if err != nil || table == nil {
+		return err
+	}
+
+	w.mu.Lock()
+	w.table = table
+	w.mu.Unlock()
+
+	w.logger.Info("routing table updated", "version", table.Version, "nodes", len(table.Nodes), "chains", len(table.Chains))
+	if w.onUpdate != nil {
+		w.onUpdate(table)
+	}
+	return nil
+}
+
+// Table returns the most recently fetched routing table, or nil
+func (w *Watcher) Table() *api.RoutingTable {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.table
+}
+
+// hostPort strips any scheme from a coordinator address
+func hostPort(addr string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(addr, "http://"), "https://")
+}
@@ -0,0 +1,530 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"maps"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/ring"
+	"github.com/3fs-storage/internal/usage"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultNumChains is the number of chains created when none is configured
+const DefaultNumChains = 64
+
+// Coordinator owns the cluster's chain table. It tracks storage nodes,
+// assigns them to chains, and persists the resulting routing table so it
+// survives restarts. Storage nodes and clients fetch the table over HTTP.
+type Coordinator struct {
+	statePath    string
+	numChains    int
+	chainLength  int
+	hashing      string
+	placement    PlacementPolicy
+	balance      BalancePolicy
+	rules        []PlacementRule
+	namespaces   map[string]NamespacePolicy
+	table        *api.RoutingTable
+	loads        map[string]*NodeLoad
+	rebalancer   *Rebalancer
+	election     *Election
+	detector     *FailureDetector
+	usage        *usage.Ledger
+	usageMetrics bool
+	notify       func(api.ClusterEvent)
+	// observedNodes and observedChains are the node states and chain
+	// versions last reported on
+	observedNodes  map[string]api.NodeState
+	observedChains map[uint32]uint64
+	// committed is a copy of the table as last persisted, which a failed
+	// commit puts back
+	committed *api.RoutingTable
+	logger    *slog.Logger
+	mu        sync.RWMutex
+}
+
+// New creates a coordinator, loading its state from statePath if present
+func New(statePath string, numChains, chainLength int, logger *slog.Logger) (*Coordinator, error) {
+	if statePath == "" {
+		return nil, errors.New("state path cannot be empty")
+	}
+	if numChains <= 0 {
+		numChains = DefaultNumChains
+	}
+	if chainLength <= 0 {
+		return nil, errors.New("chain length must be greater than zero")
+	}
+
+	c := &Coordinator{
+		statePath:   statePath,
+		numChains:   numChains,
+		chainLength: chainLength,
+		table: &api.RoutingTable{
+			Nodes:  make(map[string]*api.NodeRecord),
+			Chains: make([]*api.ChainRecord, 0),
+		},
+		hashing:   api.HashingRing,
+		placement: PlacementPolicy{Domain: DomainHost},
+		balance:   DefaultBalancePolicy(),
+		loads:     make(map[string]*NodeLoad),
+		logger:    logging.Component(logger, "coordinator"),
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	c.committed = copyTable(c.table)
+
+	return c, nil
+}
+
+// load reads the persisted routing table, if any
+func (c *Coordinator) load() error {
+	data, err := ioutil.ReadFile(c.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read coordinator state: %w", err)
+	}
+
+	var table api.RoutingTable
+	if err := json.Unmarshal(data, &table); err != nil {
+		return fmt.Errorf("failed to unmarshal coordinator state: %w", err)
+	}
+	if table.Nodes == nil {
+		table.Nodes = make(map[string]*api.NodeRecord)
+	}
+
+	c.table = &table
+	c.logger.Info("loaded coordinator state", "version", table.Version, "nodes", len(table.Nodes), "chains", len(table.Chains))
+	return nil
+}
+
+// persist durably writes the routing table
+func (c *Coordinator) persist() error {
+	data, err := json.MarshalIndent(c.table, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal coordinator state: %w", err)
+	}
+	return writeFileAtomic(c.statePath, data)
+}
+
+// writeFileAtomic durably replaces a state file: the data is written to a
+// temporary file, synced, and renamed over the previous file
+func writeFileAtomic(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %w", err)
+	}
+
+	tmp, err := ioutil.TempFile(dir, ".coordinator-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary state file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write coordinator state: %w", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to sync coordinator state: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close coordinator state: %w", err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace coordinator state: %w", err)
+	}
+
+	// Sync the directory so the rename itself is durable
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+
+	return nil
+}
+
+// commit bumps the table version, persists it and reports the nodes that
+// went down and the chains that changed. The first version of a table
+// takes the configured hashing. If the table cannot be persisted, it is
+// restored as last committed. Must be called with the lock held.
+func (c *Coordinator) commit() error {
+	if c.table.Version == 0 {
+		c.table.Hashing = c.hashing
+	}
+	c.table.Version++
+	if err := c.persist(); err != nil {
+		// Undo every change made since the last commit, not just the
+		// version, so the table in memory matches the one on disk
+		c.table = copyTable(c.committed)
+		return err
+	}
+	c.committed = copyTable(c.table)
+	c.observe(true)
+	return nil
+}
+
+// Bootstrap seeds an empty coordinator with an initial set of nodes. It
+// does nothing if the coordinator already has state.
+func (c *Coordinator) Bootstrap(nodes []*api.NodeRecord) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.table.Version > 0 {
+		return nil
+	}
+
+	now := time.Now().UnixNano()
+	for _, node := range nodes {
+		record := *node
+		record.State = api.NodeStateUp
+		record.UpdatedAt = now
+		c.issueEpoch(&record)
+		c.table.Nodes[record.ID] = &record
+	}
+
+	c.assignChains()
+	c.logger.Info("bootstrapped chain table", "nodes", len(nodes), "chains", len(c.table.Chains))
+	return c.commit()
+}
+
+// AddNode adds a node, or updates an existing node's record, and places it
+// into chains that are short of members
+func (c *Coordinator) AddNode(node *api.NodeRecord) error {
+	if node.ID == "" || node.Address == "" {
+		return errors.New("node ID and address are required")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// A node that joins again is a new process, so it gets a new epoch
+	// and anything left of the old one is fenced off
+	record := *node
+	record.State = api.NodeStateUp
+	record.UpdatedAt = time.Now().UnixNano()
+	c.issueEpoch(&record)
+	c.table.Nodes[record.ID] = &record
+
+	c.assignChains()
+	c.logger.Info("added node", "node", record.ID, "address", record.Address)
+	return c.commit()
+}
+
+// RemoveNode removes a node and reassigns its chain memberships
+func (c *Coordinator) RemoveNode(nodeID string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.table.Nodes[nodeID]; !ok {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+	delete(c.table.Nodes, nodeID)
+	delete(c.loads, nodeID)
+	if c.detector != nil {
+		c.detector.forget(nodeID)
+	}
+
+	c.assignChains()
+	c.logger.Info("removed node", "node", nodeID)
+	return c.commit()
+}
+
+// SetNodeState changes a node's state. Nodes that are down are removed
+// from their chains, which are then refilled from the remaining nodes.
+// Draining nodes stay in their chains alongside their replacements. An
+// explicit state overrides the failure detector's suspicion.
+func (c *Coordinator) SetNodeState(nodeID string, state api.NodeState) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, ok := c.table.Nodes[nodeID]
+	if !ok {
+		return fmt.Errorf("node %s not found", nodeID)
+	}
+	if node.State == state && !node.Suspect {
+		return nil
+	}
+
+	from := node.State
+	node.State = state
+	node.Suspect = false
+	node.UpdatedAt = time.Now().UnixNano()
+	c.fenceTransition(node, from)
+
+	c.assignChains()
+	c.logger.Info("changed node state", "node", nodeID, "state", state)
+	return c.commit()
+}
+
+// ReplaceChainMember swaps a member of a chain for another up node, keeping
+// its position in the chain. It is used to move a chain's replica once the
+// new member has a copy of the chain's data.
+func (c *Coordinator) ReplaceChainMember(chainID uint32, from, to string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if int(chainID) >= len(c.table.Chains) {
+		return fmt.Errorf("chain %d not found", chainID)
+	}
+	if node, ok := c.table.Nodes[to]; !ok || !node.Healthy() {
+		return fmt.Errorf("node %s is not up", to)
+	} else if node.IsCache() {
+		return fmt.Errorf("node %s is a cache node, which holds no replicas", to)
+	}
+
+	chain := c.table.Chains[chainID]
+	if contains(chain.Members, to) {
+		return fmt.Errorf("node %s is already a member of chain %d", to, chainID)
+	}
+	if !c.placementOf(chain).placeable(c.table, chain.Members, from, to) {
+		return fmt.Errorf("node %s shares a failure domain with a member of chain %d", to, chainID)
+	}
+	if err := c.breaksRules(chain, from, to); err != nil {
+		return err
+	}
+	for i, member := range chain.Members {
+		if member == from {
+			chain.Members[i] = to
+			chain.Version++
+			c.logger.Info("moved chain member", "chain", chainID, "from", from, "to", to)
+			return c.commit()
+		}
+	}
+
+	return fmt.Errorf("node %s is not a member of chain %d", from, chainID)
+}
+
+// assignChains makes sure the configured number of chains exists, shared
+// and for each namespace with a policy of its own, drops
+// members that are neither up nor draining, and fills chains that are short
+// of up members with the up nodes holding the fewest memberships, breaking
+// ties by reported free space and skipping suspected nodes, nodes that
+// reported being full and the other targets of a member's node. Nodes in a
+// failure domain the chain does not cover yet come first; under a strict
+// placement policy they are the only candidates. Nodes breaking a hard
+// placement rule are never picked, and nodes breaking a soft one only when
+// no other node fits. Each chain follows the length and placement of its
+// namespace. Draining members do not count
+// towards the chain length, so their chains gain a replacement while they
+// still hold the data. Existing members are never
+// moved, so a change only affects the chains that actually lost a member.
+// Must be called with the lock held.
+func (c *Coordinator) assignChains() {
+	c.ensureChains("", c.numChains, c.chainLength)
+	for _, name := range c.namespaceNames() {
+		ns := c.namespaces[name]
+		c.ensureChains(name, ns.NumChains, ns.Replication.ChainLength)
+	}
+
+	// Count memberships of the nodes that stay. Cache nodes hold no
+	// replicas, so they are never members.
+	load := make(map[string]int)
+	for id, node := range c.table.Nodes {
+		if node.State == api.NodeStateUp && !node.IsCache() {
+			load[id] = 0
+		}
+	}
+
+	changed := make(map[uint32]bool)
+	upMembers := make(map[uint32]int)
+	for _, chain := range c.table.Chains {
+		members := make([]string, 0, len(chain.Members))
+		for _, id := range chain.Members {
+			if _, ok := load[id]; ok {
+				members = append(members, id)
+				load[id]++
+				upMembers[chain.ID]++
+			} else if node, ok := c.table.Nodes[id]; ok && node.State == api.NodeStateDraining {
+				members = append(members, id)
+			}
+		}
+		if len(members) != len(chain.Members) {
+			changed[chain.ID] = true
+		}
+		chain.Members = members
+	}
+
+	// Fill short chains, least loaded node first
+	nodes := c.nodeRing(load)
+	for _, chain := range c.table.Chains {
+		length, placement := c.chainLengthOf(chain), c.placementOf(chain)
+		for upMembers[chain.ID] < length {
+			candidate := c.pickCandidate(chain, nodes, load, true, false)
+			if candidate == "" {
+				candidate = c.pickCandidate(chain, nodes, load, true, true)
+				if candidate != "" {
+					c.logger.Warn("placing a replica of a chain against a soft placement rule",
+						"chain", chain.ID, "node", candidate)
+				}
+			}
+			if candidate == "" && !placement.Strict {
+				candidate = c.pickCandidate(chain, nodes, load, false, true)
+				if candidate != "" {
+					c.logger.Warn("placing replicas of a chain in one failure domain",
+						"chain", chain.ID, "node", candidate, "domain", placement.Domain)
+				}
+			}
+			if candidate == "" {
+				break
+			}
+			chain.Members = append(chain.Members, candidate)
+			load[candidate]++
+			upMembers[chain.ID]++
+			changed[chain.ID] = true
+		}
+		if changed[chain.ID] {
+			chain.Version++
+		}
+	}
+}
+
+// pickCandidate returns the best up node to add to a chain, or "" if there
+// is none. Nodes outside the zones the chain's placement allows or breaking
+// a hard placement rule are never picked; with spread, nodes in a failure
+// domain of the chain's members are passed over too, and unless relaxed,
+// nodes breaking a soft placement rule or nearly full. Equally good nodes are told apart
+// by their order on the node ring from the chain. Must be called with the
+// lock held.
+func (c *Coordinator) pickCandidate(chain *api.ChainRecord, nodes *ring.Ring, load map[string]int, spread, relaxed bool) string {
+	placement := c.placementOf(chain)
+	rank := ringOrder(nodes, chain.ID)
+	maxWrite := c.maxWriteRate()
+	candidate := ""
+	for id := range load {
+		// Keep the replicas of a chain on different nodes, even when a
+		// node has several storage targets
+		if sharesHost(c.table, chain.Members, "", id) {
+			continue
+		}
+		if !placement.allows(c.table, id) {
+			continue
+		}
+		if spread && placement.sharesDomain(c.table, chain.Members, "", id) {
+			continue
+		}
+		if !c.rulesPass(c.table, chain, "", id, relaxed) {
+			continue
+		}
+		// Never place new data on a node suspected of failing or that
+		// reported being full, and only relaxed on a nearly full one
+		if c.table.Nodes[id].Suspect {
+			continue
+		}
+		if free, ok := c.freeBytes(id); ok && free <= 0 {
+			continue
+		}
+		if !relaxed && c.nearlyFull(id) {
+			continue
+		}
+		if candidate == "" || c.preferCandidate(id, candidate, load, rank, maxWrite) {
+			candidate = id
+		}
+	}
+	return candidate
+}
+
+// sharesHost reports whether id is, or is served by the same node as, one
+// of members other than except
+func sharesHost(table *api.RoutingTable, members []string, except, id string) bool {
+	host := id
+	if record, ok := table.Nodes[id]; ok {
+		host = record.Host()
+	}
+	for _, member := range members {
+		if member == except {
+			continue
+		}
+		if member == id {
+			return true
+		}
+		if record, ok := table.Nodes[member]; ok && record.Host() == host {
+			return true
+		}
+	}
+	return false
+}
+
+// contains reports whether ids contains id
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Routing returns a copy of the current routing table
+func (c *Coordinator) Routing() *api.RoutingTable {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return copyTable(c.table)
+}
+
+// copyTable deep-copies a routing table
+func copyTable(t *api.RoutingTable) *api.RoutingTable {
+	cp := &api.RoutingTable{
+		Version: t.Version,
+		Epoch:   t.Epoch,
+		Nodes:   make(map[string]*api.NodeRecord, len(t.Nodes)),
+		Chains:  make([]*api.ChainRecord, 0, len(t.Chains)),
+		Hashing: t.Hashing,
+	}
+	if len(t.Policies) > 0 {
+		cp.Policies = make(map[string]*api.ReplicationPolicy, len(t.Policies))
+		for name, policy := range t.Policies {
+			p := *policy
+			cp.Policies[name] = &p
+		}
+	}
+	for id, node := range t.Nodes {
+		n := *node
+		n.Labels = maps.Clone(node.Labels)
+		cp.Nodes[id] = &n
+	}
+	for _, chain := range t.Chains {
+		ch := *chain
+		ch.Members = append([]string(nil), chain.Members...)
+		cp.Chains = append(cp.Chains, &ch)
+	}
+	return cp
+}
+
+// Nodes returns the node records sorted by ID
+func (c *Coordinator) Nodes() []*api.NodeRecord {
+	table := c.Routing()
+
+	nodes := make([]*api.NodeRecord, 0, len(table.Nodes))
+	for _, node := range table.Nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
+
+// Chain returns a copy of a single chain
+func (c *Coordinator) Chain(chainID uint32) (*api.ChainRecord, error) {
+	table := c.Routing()
+	if int(chainID) >= len(table.Chains) {
+		return nil, fmt.Errorf("chain %d not found", chainID)
+	}
+	return table.Chains[chainID], nil
+}
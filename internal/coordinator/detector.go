@@ -0,0 +1,278 @@
+package coordinator
+
+import (
+	"context"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/api"
+)
+
+const (
+	// DefaultSuspectPhi is the suspicion level above which a node is
+	// marked suspect
+	DefaultSuspectPhi = 3.0
+	// DefaultDownPhi is the suspicion level above which a node is marked
+	// down
+	DefaultDownPhi = 8.0
+	// DefaultDetectorWindow is the number of heartbeat intervals the
+	// detector keeps per node
+	DefaultDetectorWindow = 100
+	// DefaultMinStdDev keeps a node with very regular heartbeats from
+	// being suspected on the first slightly late one
+	DefaultMinStdDev = 500 * time.Millisecond
+	// DefaultCheckInterval is how often suspicion levels are evaluated
+	DefaultCheckInterval = time.Second
+
+	// minSamples is the number of heartbeat intervals needed before a
+	// node's suspicion level is computed
+	minSamples = 3
+)
+
+// DetectorOptions configures the failure detector
+type DetectorOptions struct {
+	// SuspectPhi is the suspicion level at which a node is marked suspect
+	SuspectPhi float64
+	// DownPhi is the suspicion level at which a node is marked down; a
+	// negative level never marks nodes down
+	DownPhi float64
+	// Window is the number of recent heartbeat intervals kept per node
+	Window int
+	// MinStdDev is the least deviation assumed of heartbeat intervals
+	MinStdDev time.Duration
+	// AcceptablePause is added to the expected interval, to tolerate
+	// pauses such as garbage collection without raising suspicion
+	AcceptablePause time.Duration
+	// CheckInterval is how often suspicion levels are evaluated
+	CheckInterval time.Duration
+}
+
+// arrivals is a sliding window of the intervals between a node's
+// heartbeats, in milliseconds
+type arrivals struct {
+	intervals []float64
+	sum       float64
+	squares   float64
+	last      time.Time
+}
+
+// add records a heartbeat arriving at t
+func (a *arrivals) add(t time.Time, window int) {
+	if !a.last.IsZero() {
+		interval := float64(t.Sub(a.last)) / float64(time.Millisecond)
+		a.intervals = append(a.intervals, interval)
+		a.sum += interval
+		a.squares += interval * interval
+		if len(a.intervals) > window {
+			dropped := a.intervals[0]
+			a.intervals = a.intervals[1:]
+			a.sum -= dropped
+			a.squares -= dropped * dropped
+		}
+	}
+	a.last = t
+}
+
+// phi returns the suspicion level of the node at time t: the negative
+// base-10 logarithm of the probability that a heartbeat still arrives
+// after this long, assuming normally distributed intervals
+func (a *arrivals) phi(t time.Time, minStdDev, pause time.Duration) float64 {
+	n := float64(len(a.intervals))
+	mean := a.sum / n
+	variance := a.squares/n - mean*mean
+	stdDev := math.Sqrt(math.Max(variance, 0))
+	if min := float64(minStdDev) / float64(time.Millisecond); stdDev < min {
+		stdDev = min
+	}
+	mean += float64(pause) / float64(time.Millisecond)
+
+	elapsed := float64(t.Sub(a.last)) / float64(time.Millisecond)
+	y := (elapsed - mean) / stdDev
+	// Logistic approximation of the normal distribution's tail
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if elapsed > mean {
+		return -math.Log10(e / (1 + e))
+	}
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// FailureDetector is a phi-accrual failure detector fed by the arrival
+// times of node heartbeats. Rather than declaring a node dead after a
+// fixed timeout, it learns the distribution of each node's heartbeat
+// intervals and turns the time since the last heartbeat into a suspicion
+// level, phi, that grows the more unlikely the silence is. Jittery nodes
+// therefore get more slack while a node with steady heartbeats is
+// detected soon after it stops.
+//
+// On the coordinator leader, nodes whose phi reaches the suspect level are
+// flagged as suspect in the routing table, so that chain placement,
+// rebalancing and repair avoid them; at the down level they are marked
+// down and dropped from their chains. A node marked down by the detector
+// is brought back up once its heartbeats are steady again.
+type FailureDetector struct {
+	coord  *Coordinator
+	opts   DetectorOptions
+	nodes  map[string]*arrivals
+	logger *slog.Logger
+	mu     sync.Mutex
+}
+
+// NewFailureDetector creates a failure detector for the coordinator's
+// nodes and feeds it the heartbeats the coordinator receives
+func NewFailureDetector(coord *Coordinator, opts DetectorOptions, logger *slog.Logger) *FailureDetector {
+	if opts.SuspectPhi <= 0 {
+		opts.SuspectPhi = DefaultSuspectPhi
+	}
+	if opts.DownPhi == 0 {
+		opts.DownPhi = DefaultDownPhi
+	}
+	if opts.Window <= 0 {
+		opts.Window = DefaultDetectorWindow
+	}
+	if opts.MinStdDev <= 0 {
+		opts.MinStdDev = DefaultMinStdDev
+	}
+	if opts.CheckInterval <= 0 {
+		opts.CheckInterval = DefaultCheckInterval
+	}
+
+	d := &FailureDetector{
+		coord:  coord,
+		opts:   opts,
+		nodes:  make(map[string]*arrivals),
+		logger: logging.Component(logger, "detector"),
+	}
+
+	coord.mu.Lock()
+	coord.detector = d
+	coord.mu.Unlock()
+
+	return d
+}
+
+// heartbeat records the arrival of a node's heartbeat
+func (d *FailureDetector) heartbeat(nodeID string, t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, ok := d.nodes[nodeID]
+	if !ok {
+		a = &arrivals{}
+		d.nodes[nodeID] = a
+	}
+	a.add(t, d.opts.Window)
+}
+
+// forget drops a node's heartbeat history
+func (d *FailureDetector) forget(nodeID string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.nodes, nodeID)
+}
+
+// Phi returns the current suspicion level of a node, and false if too few
+// of its heartbeats have arrived to tell
+func (d *FailureDetector) Phi(nodeID string) (float64, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	a, ok := d.nodes[nodeID]
+	if !ok || len(a.intervals) < minSamples {
+		return 0, false
+	}
+	return a.phi(time.Now(), d.opts.MinStdDev, d.opts.AcceptablePause), true
+}
+
+// Run evaluates suspicion levels until ctx is done
+func (d *FailureDetector) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.opts.CheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		d.check()
+	}
+}
+
+// check updates the routing table with the nodes' suspicion levels. Only
+// the leader acts, since only it receives heartbeats.
+func (d *FailureDetector) check() {
+	if !d.coord.IsLeader() {
+		return
+	}
+
+	for _, node := range d.coord.Nodes() {
+		phi, ok := d.Phi(node.ID)
+		if !ok {
+			continue
+		}
+
+		var err error
+		switch {
+		case node.State == api.NodeStateDown:
+			if node.Suspect && phi < d.opts.SuspectPhi {
+				d.logger.Info("suspected node is alive again", "node", node.ID, "phi", phi)
+				err = d.coord.setSuspect(node.ID, api.NodeStateUp, false)
+			}
+		case node.State == api.NodeStateUp && d.opts.DownPhi > 0 && phi >= d.opts.DownPhi:
+			d.logger.Warn("node failed", "node", node.ID, "phi", phi)
+			err = d.coord.setSuspect(node.ID, api.NodeStateDown, true)
+			// Start afresh, so that the gap does not skew the intervals
+			// once the node is back
+			d.forget(node.ID)
+		case phi >= d.opts.SuspectPhi:
+			if !node.Suspect {
+				d.logger.Warn("node suspected of failing", "node", node.ID, "phi", phi)
+				err = d.coord.setSuspect(node.ID, node.State, true)
+			}
+		case node.Suspect:
+			d.logger.Info("node no longer suspected", "node", node.ID, "phi", phi)
+			err = d.coord.setSuspect(node.ID, node.State, false)
+		}
+		if err != nil {
+			d.logger.Error("failed to update suspected node", "node", node.ID, "error", err)
+		}
+	}
+}
+
+// setSuspect sets a node's state and whether it is suspected of failing,
+// refilling chains if its state changed
+func (c *Coordinator) setSuspect(nodeID string, state api.NodeState, suspect bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	node, ok := c.table.Nodes[nodeID]
+	if !ok {
+		return nil
+	}
+	if node.State == state && node.Suspect == suspect {
+		return nil
+	}
+
+	from := node.State
+	node.State = state
+	node.Suspect = suspect
+	node.UpdatedAt = time.Now().UnixNano()
+	if from != state {
+		c.fenceTransition(node, from)
+		c.assignChains()
+	}
+	return c.commit()
+}
+
+// phi returns a node's suspicion level, or 0 without a failure detector or
+// enough heartbeats. Must be called with the lock held.
+func (c *Coordinator) phi(nodeID string) float64 {
+	if c.detector == nil {
+		return 0
+	}
+	phi, _ := c.detector.Phi(nodeID)
+	return phi
+}
@@ -0,0 +1,600 @@
+package coordinator
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultLeaseDuration is how long a coordinator leader's lease lasts
+// without renewal. The leader renews it three times per lease.
+const DefaultLeaseDuration = 3 * time.Second
+
+// electionFile holds a replica's current term and vote, next to the
+// coordinator state
+const electionFile = "election.json"
+
+// Roles of a coordinator replica
+const (
+	RoleFollower  = "follower"
+	RoleCandidate = "candidate"
+	RoleLeader    = "leader"
+)
+
+// ElectionOptions configures a coordinator replica's election
+type ElectionOptions struct {
+	// ID identifies this replica, usually the ID of its node
+	ID string
+	// Address is this replica's admin address
+	Address string
+	// Peers are the admin addresses of the other replicas; Address is
+	// ignored if listed
+	Peers []string
+	// LeaseDuration is how long a leader leads without renewing its
+	// lease with a majority; defaults to DefaultLeaseDuration
+	LeaseDuration time.Duration
+	// OnLeader, when set, is called each time this replica is elected
+	OnLeader func()
+}
+
+// ElectionStatus reports a replica's view of the election
+type ElectionStatus struct {
+	ID             string   `json:"id"`
+	Role           string   `json:"role"`
+	Term           uint64   `json:"term"`
+	Leader         string   `json:"leader,omitempty"`
+	LeaderAddress  string   `json:"leader_address,omitempty"`
+	LeaseExpiresAt int64    `json:"lease_expires_at,omitempty"`
+	TableVersion   uint64   `json:"table_version"`
+	Peers          []string `json:"peers"`
+}
+
+// electionState is the part of the election that survives restarts, so
+// that a replica never votes twice in a term
+type electionState struct {
+	Term     uint64 `json:"term"`
+	VotedFor string `json:"voted_for,omitempty"`
+}
+
+// voteRequest asks a replica to vote for a candidate
+type voteRequest struct {
+	Term      uint64 `json:"term"`
+	Candidate string `json:"candidate"`
+	Version   uint64 `json:"version"`
+}
+
+// voteResponse answers a vote request
+type voteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+// leaseRequest renews the leader's lease with a replica
+type leaseRequest struct {
+	Term    uint64 `json:"term"`
+	Leader  string `json:"leader"`
+	Address string `json:"address"`
+	Version uint64 `json:"version"`
+}
+
+// leaseResponse answers a lease renewal
+type leaseResponse struct {
+	Term     uint64 `json:"term"`
+	Accepted bool   `json:"accepted"`
+}
+
+// Election elects one leader among the replicas of an embedded
+// coordinator, so that exactly one of them changes the chain table and
+// runs the rebalancer. A candidate needs the votes of a majority of
+// replicas, and a replica only votes for candidates whose routing table is
+// at least as recent as its own. The leader holds a lease that it renews
+// with a majority; replicas refuse to vote while a lease they granted is
+// running, and a leader that cannot renew steps down when its lease ends.
+// Followers copy the routing table from the leader as it changes.
+type Election struct {
+	coord     *Coordinator
+	opts      ElectionOptions
+	statePath string
+	state     electionState
+	role      string
+	leader    string
+	address   string
+	// granted is the candidate last voted for, whose lease is promised
+	// until leaseExpiry even before it has claimed leadership
+	granted string
+	// leaseExpiry is when the current leader's lease ends: for the leader
+	// its own lease, for followers the lease they last granted
+	leaseExpiry time.Time
+	syncing     atomic.Bool
+	http        *http.Client
+	logger      *slog.Logger
+	mu          sync.Mutex
+}
+
+// NewElection creates the election of a coordinator replica, restoring its
+// term and vote from the coordinator's state directory, and exposes it
+// through the coordinator's HTTP API. Run takes part in the election.
+func NewElection(coord *Coordinator, opts ElectionOptions, logger *slog.Logger) (*Election, error) {
+	if opts.ID == "" || opts.Address == "" {
+		return nil, errors.New("election requires a replica ID and address")
+	}
+	if opts.LeaseDuration <= 0 {
+		opts.LeaseDuration = DefaultLeaseDuration
+	}
+
+	self := hostPort(opts.Address)
+	peers := make([]string, 0, len(opts.Peers))
+	for _, peer := range opts.Peers {
+		if peer = hostPort(peer); peer != self && !contains(peers, peer) {
+			peers = append(peers, peer)
+		}
+	}
+	opts.Address = self
+	opts.Peers = peers
+
+	e := &Election{
+		coord:     coord,
+		opts:      opts,
+		statePath: filepath.Join(filepath.Dir(coord.statePath), electionFile),
+		role:      RoleFollower,
+		http:      &http.Client{Timeout: opts.LeaseDuration / 2},
+		logger:    logging.Component(logger, "election"),
+	}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+
+	// Honour any lease granted before a restart, and wait it out before
+	// campaigning
+	e.granted = e.state.VotedFor
+	e.leaseExpiry = time.Now().Add(opts.LeaseDuration)
+
+	coord.mu.Lock()
+	coord.election = e
+	coord.mu.Unlock()
+
+	return e, nil
+}
+
+// load reads the persisted term and vote, if any
+func (e *Election) load() error {
+	data, err := ioutil.ReadFile(e.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read election state: %w", err)
+	}
+	if err := json.Unmarshal(data, &e.state); err != nil {
+		return fmt.Errorf("failed to unmarshal election state: %w", err)
+	}
+	return nil
+}
+
+// persist durably writes the term and vote. Must be called with the lock
+// held.
+func (e *Election) persist() error {
+	data, err := json.Marshal(&e.state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal election state: %w", err)
+	}
+	return writeFileAtomic(e.statePath, data)
+}
+
+// IsLeader reports whether this replica currently holds the leader lease
+func (e *Election) IsLeader() bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.role == RoleLeader && time.Now().Before(e.leaseExpiry)
+}
+
+// Leader returns the ID and admin address of the current leader, if known
+func (e *Election) Leader() (string, string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.leader == "" || !time.Now().Before(e.leaseExpiry) {
+		return "", ""
+	}
+	return e.leader, e.address
+}
+
+// Status returns this replica's view of the election
+func (e *Election) Status() ElectionStatus {
+	version := e.coord.version()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	status := ElectionStatus{
+		ID:           e.opts.ID,
+		Role:         e.role,
+		Term:         e.state.Term,
+		TableVersion: version,
+		Peers:        append([]string(nil), e.opts.Peers...),
+	}
+	if e.leader != "" && time.Now().Before(e.leaseExpiry) {
+		status.Leader = e.leader
+		status.LeaderAddress = e.address
+		status.LeaseExpiresAt = e.leaseExpiry.UnixNano()
+	}
+	return status
+}
+
+// quorum returns the number of replicas that form a majority
+func (e *Election) quorum() int {
+	return (len(e.opts.Peers)+1)/2 + 1
+}
+
+// Run takes part in the election until ctx is done: as a follower it
+// waits for the leader's lease to lapse and then campaigns, and as the
+// leader it renews its lease
+func (e *Election) Run(ctx context.Context) {
+	renewEvery := e.opts.LeaseDuration / 3
+
+	for {
+		e.mu.Lock()
+		role := e.role
+		lapsesAt := e.leaseExpiry
+		e.mu.Unlock()
+
+		var wait time.Duration
+		switch role {
+		case RoleLeader:
+			e.renew(ctx)
+			wait = renewEvery
+		default:
+			// Randomise when followers campaign so that one of them
+			// usually wins the first round
+			jitter := time.Duration(rand.Int63n(int64(e.opts.LeaseDuration)))
+			if now := time.Now(); now.After(lapsesAt) {
+				e.campaign(ctx)
+				wait = jitter / 2
+			} else {
+				wait = lapsesAt.Sub(now) + jitter/4
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// campaign starts a new term and asks the other replicas for their votes
+func (e *Election) campaign(ctx context.Context) {
+	started := time.Now()
+
+	e.mu.Lock()
+	e.state.Term++
+	e.state.VotedFor = e.opts.ID
+	if err := e.persist(); err != nil {
+		e.state.Term--
+		e.state.VotedFor = ""
+		e.mu.Unlock()
+		e.logger.Warn("failed to start election", "error", err)
+		return
+	}
+	e.role = RoleCandidate
+	e.leader = ""
+	term := e.state.Term
+	e.mu.Unlock()
+
+	req := &voteRequest{Term: term, Candidate: e.opts.ID, Version: e.coord.version()}
+	votes := 1
+	for _, resp := range e.broadcast(ctx, "/election/vote", req, func() interface{} { return &voteResponse{} }) {
+		vote := resp.(*voteResponse)
+		if vote.Term > term {
+			e.observeTerm(vote.Term)
+			return
+		}
+		if vote.Granted {
+			votes++
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state.Term != term || e.role != RoleCandidate {
+		return
+	}
+	if votes < e.quorum() {
+		e.role = RoleFollower
+		return
+	}
+
+	// Voters granted their leases after the campaign started, so the
+	// leader's lease is safe to count from then
+	e.role = RoleLeader
+	e.leader = e.opts.ID
+	e.address = e.opts.Address
+	e.leaseExpiry = started.Add(e.opts.LeaseDuration)
+	e.logger.Info("elected coordinator leader", "term", term, "votes", votes)
+	if e.opts.OnLeader != nil {
+		go e.opts.OnLeader()
+	}
+}
+
+// renew extends the leader's lease with a majority of replicas, stepping
+// down if a newer term exists or the lease ran out
+func (e *Election) renew(ctx context.Context) {
+	started := time.Now()
+
+	e.mu.Lock()
+	term := e.state.Term
+	e.mu.Unlock()
+
+	req := &leaseRequest{Term: term, Leader: e.opts.ID, Address: e.opts.Address, Version: e.coord.version()}
+	acks := 1
+	for _, resp := range e.broadcast(ctx, "/election/lease", req, func() interface{} { return &leaseResponse{} }) {
+		lease := resp.(*leaseResponse)
+		if lease.Term > term {
+			e.observeTerm(lease.Term)
+			return
+		}
+		if lease.Accepted {
+			acks++
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.state.Term != term || e.role != RoleLeader {
+		return
+	}
+	if acks >= e.quorum() {
+		e.leaseExpiry = started.Add(e.opts.LeaseDuration)
+		return
+	}
+	if !time.Now().Before(e.leaseExpiry) {
+		e.role = RoleFollower
+		e.leader = ""
+		e.logger.Warn("stepped down as coordinator leader, lease could not be renewed", "term", term, "acks", acks)
+	}
+}
+
+// observeTerm moves to a newer term seen in a reply, as a follower
+func (e *Election) observeTerm(term uint64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.adoptTerm(term)
+}
+
+// adoptTerm moves to a newer term as a follower. Must be called with the
+// lock held.
+func (e *Election) adoptTerm(term uint64) {
+	if term <= e.state.Term {
+		return
+	}
+	if e.role == RoleLeader {
+		e.logger.Info("stepped down as coordinator leader", "term", e.state.Term, "new_term", term)
+	}
+	e.state.Term = term
+	e.state.VotedFor = ""
+	e.role = RoleFollower
+	e.leader = ""
+	if err := e.persist(); err != nil {
+		e.logger.Warn("failed to persist election state", "error", err)
+	}
+}
+
+// broadcast posts a request to every peer in parallel and returns the
+// replies that arrived within the timeout
+func (e *Election) broadcast(ctx context.Context, path string, req interface{}, newResp func() interface{}) []interface{} {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.opts.LeaseDuration/2)
+	defer cancel()
+
+	replies := make(chan interface{}, len(e.opts.Peers))
+	var wg sync.WaitGroup
+	for _, peer := range e.opts.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			resp := newResp()
+			if err := e.post(ctx, peer, path, body, resp); err == nil {
+				replies <- resp
+			}
+		}(peer)
+	}
+	wg.Wait()
+	close(replies)
+
+	results := make([]interface{}, 0, len(e.opts.Peers))
+	for resp := range replies {
+		results = append(results, resp)
+	}
+	return results
+}
+
+// post sends an election request to a peer
+func (e *Election) post(ctx context.Context, peer, path string, body []byte, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+PathPrefix+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := e.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("peer %s returned %s", peer, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// vote answers a candidate's vote request
+func (e *Election) vote(req *voteRequest) *voteResponse {
+	version := e.coord.version()
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	if req.Term < e.state.Term {
+		return &voteResponse{Term: e.state.Term}
+	}
+	// A live leader keeps its lease; the request does not even advance
+	// the term, so that a replica that was cut off cannot depose it
+	holder := e.leader
+	if holder == "" {
+		holder = e.granted
+	}
+	if holder != "" && holder != req.Candidate && now.Before(e.leaseExpiry) {
+		return &voteResponse{Term: e.state.Term}
+	}
+	e.adoptTerm(req.Term)
+
+	if e.state.VotedFor != "" && e.state.VotedFor != req.Candidate {
+		return &voteResponse{Term: e.state.Term}
+	}
+	if req.Version < version {
+		return &voteResponse{Term: e.state.Term}
+	}
+
+	e.state.VotedFor = req.Candidate
+	if err := e.persist(); err != nil {
+		e.state.VotedFor = ""
+		e.logger.Warn("failed to persist election state", "error", err)
+		return &voteResponse{Term: e.state.Term}
+	}
+	e.granted = req.Candidate
+	e.leaseExpiry = now.Add(e.opts.LeaseDuration)
+	return &voteResponse{Term: e.state.Term, Granted: true}
+}
+
+// lease answers the leader's lease renewal, and fetches the leader's
+// routing table when it is newer than this replica's
+func (e *Election) lease(req *leaseRequest) *leaseResponse {
+	version := e.coord.version()
+
+	e.mu.Lock()
+	if req.Term < e.state.Term {
+		defer e.mu.Unlock()
+		return &leaseResponse{Term: e.state.Term}
+	}
+	e.adoptTerm(req.Term)
+	e.role = RoleFollower
+	e.leader = req.Leader
+	e.granted = ""
+	e.address = hostPort(req.Address)
+	e.leaseExpiry = time.Now().Add(e.opts.LeaseDuration)
+	resp := &leaseResponse{Term: e.state.Term, Accepted: true}
+	address := e.address
+	e.mu.Unlock()
+
+	if req.Version > version && e.syncing.CompareAndSwap(false, true) {
+		go e.sync(address)
+	}
+	return resp
+}
+
+// sync copies the routing table from the leader
+func (e *Election) sync(address string) {
+	defer e.syncing.Store(false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.opts.LeaseDuration)
+	defer cancel()
+
+	client, err := NewClient([]string{address})
+	if err != nil {
+		return
+	}
+	table, err := client.FetchRouting(ctx, 0)
+	if err != nil {
+		e.logger.Warn("failed to copy routing table from leader", "leader", address, "error", err)
+		return
+	}
+	if err := e.coord.adopt(table); err != nil {
+		e.logger.Warn("failed to store routing table from leader", "error", err)
+	}
+}
+
+// version returns the version of the routing table
+func (c *Coordinator) version() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.table.Version
+}
+
+// adopt replaces the routing table with a newer one copied from the
+// leader, keeping the version
+func (c *Coordinator) adopt(table *api.RoutingTable) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if table.Version <= c.table.Version {
+		return nil
+	}
+	if table.Nodes == nil {
+		table.Nodes = make(map[string]*api.NodeRecord)
+	}
+
+	previous := c.table
+	c.table = table
+	if err := c.persist(); err != nil {
+		c.table = previous
+		return err
+	}
+	c.committed = copyTable(table)
+	// The leader reported the changes; should this replica lead next, it
+	// reports from here on
+	c.observe(false)
+	return nil
+}
+
+// IsLeader reports whether this coordinator may change the chain table:
+// always, unless it is one of several replicas and not the elected leader
+func (c *Coordinator) IsLeader() bool {
+	c.mu.RLock()
+	election := c.election
+	c.mu.RUnlock()
+	return election == nil || election.IsLeader()
+}
+
+// redirectToLeader sends a request that only the leader may serve to the
+// leader, reporting whether it did. Without a leader the request fails
+// with 503, so that clients try the next coordinator address.
+func (c *Coordinator) redirectToLeader(w http.ResponseWriter, r *http.Request) bool {
+	c.mu.RLock()
+	election := c.election
+	c.mu.RUnlock()
+	if election == nil || election.IsLeader() {
+		return false
+	}
+
+	leader, address := election.Leader()
+	if leader == "" || leader == election.opts.ID {
+		writeError(w, http.StatusServiceUnavailable, errors.New("no coordinator leader elected"))
+		return true
+	}
+
+	target := "http://" + address + PathPrefix + r.URL.Path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusTemporaryRedirect)
+	return true
+}
@@ -0,0 +1,27 @@
+package coordinator
+
+import (
+	"github.com/3fs-storage/pkg/api"
+)
+
+// issueEpoch gives a record a new fencing epoch, higher than any issued
+// before. Writes other nodes receive with the record's previous epoch are
+// refused from then on. Must be called with the lock held.
+func (c *Coordinator) issueEpoch(node *api.NodeRecord) {
+	c.table.Epoch++
+	node.Epoch = c.table.Epoch
+}
+
+// fenceTransition issues a record a new fencing epoch if its state changed
+// to or from down: a node declared down must be fenced off in case it is
+// still running, and one that comes back must not be mistaken for the
+// process that was fenced. Must be called with the lock held.
+func (c *Coordinator) fenceTransition(node *api.NodeRecord, from api.NodeState) {
+	if from == node.State {
+		return
+	}
+	if from == api.NodeStateDown || node.State == api.NodeStateDown {
+		c.issueEpoch(node)
+		c.logger.Info("issued fencing epoch", "node", node.ID, "epoch", node.Epoch, "state", node.State)
+	}
+}
@@ -0,0 +1,62 @@
+package coordinator
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/3fs-storage/internal/ring"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// SetHashing sets how a new routing table maps blocks to chains: ring or
+// modulo. A table keeps the hashing it was created with, since changing it
+// would move nearly every block to another chain without its data.
+func (c *Coordinator) SetHashing(hashing string) error {
+	switch hashing {
+	case "":
+		hashing = api.HashingRing
+	case api.HashingRing, api.HashingModulo:
+	default:
+		return fmt.Errorf("unknown hashing %q", hashing)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hashing = hashing
+	current := c.table.Hashing
+	if current == "" {
+		current = api.HashingModulo
+	}
+	if c.table.Version > 0 && current != hashing {
+		c.logger.Warn("routing table keeps the hashing it was created with",
+			"hashing", current, "configured", hashing)
+	}
+	return nil
+}
+
+// nodeRing returns a consistent-hash ring of the nodes in load, weighted by
+// their capacity. Must be called with the lock held.
+func (c *Coordinator) nodeRing(load map[string]int) *ring.Ring {
+	members := make([]ring.Member, 0, len(load))
+	for id := range load {
+		var weight float64
+		if node, ok := c.table.Nodes[id]; ok {
+			weight = float64(node.CapacityBytes)
+		}
+		members = append(members, ring.Member{ID: id, Weight: weight})
+	}
+	return ring.New(ring.DefaultVirtualNodes, members)
+}
+
+// ringOrder ranks the nodes of a ring for a chain, in the order met walking
+// the ring from the chain's ID. Ties between equally good candidates are
+// broken by rank, so that chains spread over the nodes in proportion to
+// their capacity, and the same nodes are picked for a chain every time.
+func ringOrder(nodes *ring.Ring, chainID uint32) map[string]int {
+	rank := make(map[string]int, nodes.Len())
+	nodes.Walk("chain/"+strconv.FormatUint(uint64(chainID), 10), func(id string) bool {
+		rank[id] = len(rank)
+		return true
+	})
+	return rank
+}
@@ -0,0 +1,161 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// NodeLoad is the latest heartbeat of a node, when it arrived, and the
+// failure detector's current suspicion of the node
+type NodeLoad struct {
+	api.Heartbeat
+	ReceivedAt int64   `json:"received_at"`
+	Phi        float64 `json:"phi"`
+}
+
+// Heartbeat records a node's capacity and load report. Heartbeats are kept
+// in memory only; nodes report again shortly after a coordinator restart.
+// A node crossing the balance policy's maximum fullness is marked nearly
+// full in the routing table, or no longer once it drops below it.
+// Nodes speaking a protocol version the coordinator no longer supports are
+// refused, so that they stop being counted as alive.
+func (c *Coordinator) Heartbeat(hb *api.Heartbeat) error {
+	if hb.NodeID == "" {
+		return errors.New("node ID is required")
+	}
+	if hb.ProtocolVersion == 0 {
+		hb.ProtocolVersion = 1
+	}
+	if err := api.CheckProtocol(hb.ProtocolVersion); err != nil {
+		return fmt.Errorf("node %s: %w", hb.NodeID, err)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.table.Nodes[hb.NodeID]; !ok {
+		return fmt.Errorf("node %s not found", hb.NodeID)
+	}
+
+	now := time.Now()
+	c.loads[hb.NodeID] = &NodeLoad{Heartbeat: *hb, ReceivedAt: now.UnixNano()}
+	if c.detector != nil {
+		c.detector.heartbeat(hb.NodeID, now)
+	}
+	if c.markFullness(hb.NodeID) {
+		return c.commit()
+	}
+	return nil
+}
+
+// Loads returns the latest heartbeat of every node that has reported,
+// sorted by node ID
+func (c *Coordinator) Loads() []*NodeLoad {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	loads := make([]*NodeLoad, 0, len(c.loads))
+	for _, load := range c.loads {
+		l := *load
+		l.Phi = c.phi(load.NodeID)
+		loads = append(loads, &l)
+	}
+	sort.Slice(loads, func(i, j int) bool {
+		return loads[i].NodeID < loads[j].NodeID
+	})
+	return loads
+}
+
+// ClusterVersions summarises the builds the nodes reported in their latest
+// heartbeats, to follow a rolling upgrade
+type ClusterVersions struct {
+	// MinProtocol and MaxProtocol span the protocol versions of the nodes
+	MinProtocol int `json:"min_protocol"`
+	MaxProtocol int `json:"max_protocol"`
+	// Mixed is set while nodes run different software versions or builds
+	Mixed bool `json:"mixed"`
+	// Software maps each software version to the nodes running it; nodes
+	// that predate version reporting are listed under "unknown"
+	Software map[string][]string `json:"software"`
+	// Commits maps each source revision to the nodes built from it, for
+	// the nodes that report one
+	Commits map[string][]string `json:"commits"`
+	// Features maps each feature flag to the nodes enabling it, and
+	// MixedFeatures is set while a feature is enabled on only some nodes
+	Features      map[string][]string `json:"features"`
+	MixedFeatures bool                `json:"mixed_features"`
+}
+
+// Versions returns the builds reported by the nodes
+func (c *Coordinator) Versions() *ClusterVersions {
+	loads := c.Loads()
+
+	versions := &ClusterVersions{
+		Software: make(map[string][]string),
+		Commits:  make(map[string][]string),
+		Features: make(map[string][]string),
+	}
+	for _, load := range loads {
+		if versions.MinProtocol == 0 || load.ProtocolVersion < versions.MinProtocol {
+			versions.MinProtocol = load.ProtocolVersion
+		}
+		if load.ProtocolVersion > versions.MaxProtocol {
+			versions.MaxProtocol = load.ProtocolVersion
+		}
+		software := load.SoftwareVersion
+		if software == "" {
+			software = "unknown"
+		}
+		versions.Software[software] = append(versions.Software[software], load.NodeID)
+		if load.Commit != "" {
+			versions.Commits[load.Commit] = append(versions.Commits[load.Commit], load.NodeID)
+		}
+		for _, feature := range load.Features {
+			versions.Features[feature] = append(versions.Features[feature], load.NodeID)
+		}
+	}
+	versions.Mixed = len(versions.Software) > 1 || len(versions.Commits) > 1
+	for _, nodes := range versions.Features {
+		if len(nodes) < len(loads) {
+			versions.MixedFeatures = true
+		}
+	}
+	return versions
+}
+
+// freeBytes returns the free space a node last reported. Must be called
+// with the lock held.
+func (c *Coordinator) freeBytes(nodeID string) (int64, bool) {
+	load, ok := c.loads[nodeID]
+	if !ok {
+		return 0, false
+	}
+	return load.FreeBytes, true
+}
+
+// preferCandidate reports whether node a is a better choice than node b for
+// a new chain membership. The node with the lower allocation cost under the
+// balance policy wins, so that new members skew towards emptier, less busy
+// nodes; among equals, the node with more reported free space, and then
+// the node ranked first on the node ring. Must be called with the lock
+// held.
+func (c *Coordinator) preferCandidate(a, b string, load, rank map[string]int, maxWrite float64) bool {
+	costA, costB := c.allocationCost(a, load, maxWrite), c.allocationCost(b, load, maxWrite)
+	if costA != costB {
+		return costA < costB
+	}
+
+	freeA, okA := c.freeBytes(a)
+	freeB, okB := c.freeBytes(b)
+	if okA && okB && freeA != freeB {
+		return freeA > freeB
+	}
+	if rank[a] != rank[b] {
+		return rank[a] < rank[b]
+	}
+	return a < b
+}
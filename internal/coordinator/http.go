@@ -0,0 +1,338 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// Handler returns the coordinator's HTTP API. Paths are relative to the
+// prefix the handler is mounted under:
+//
+//	GET    /routing[?version=N]  routing table (304 if still at version N)
+//	GET    /nodes                node records
+//	POST   /nodes                add or update a node
+//	DELETE /nodes/{id}           remove a node
+//	PUT    /nodes/{id}/state     set a node's state
+//	POST   /nodes/{id}/heartbeat report a node's capacity and load
+//	GET    /loads                latest heartbeat of every node
+//	GET    /versions             protocol and software versions of the nodes
+//	GET    /usage[?namespace=&since=]
+//	                             use of the namespaces, by window of time
+//	POST   /usage                report a node's usage of the namespaces
+//	GET    /usage/metrics        use of the namespaces as Prometheus metrics
+//	GET    /chains               chain table
+//	GET    /chains/{id}          a single chain
+//	POST   /chains/{id}/members  add a node to a chain, before its tail
+//	DELETE /chains/{id}/members/{node}[?force=true]
+//	                             remove a node from a chain
+//	PUT    /chains/{id}/head     move a member to the head of a chain
+//	GET    /placement/explain[?chain=N]
+//	                             dry run of chain assignment under the
+//	                             placement rules, with the candidates of a
+//	                             chain
+//	GET    /rebalance            status of the current or last rebalance
+//	POST   /rebalance            start a rebalance pass
+//	GET    /election             this replica's view of the leader election
+//	POST   /election/vote        ask for this replica's vote
+//	POST   /election/lease       renew the leader's lease
+//
+// When replicas elect a leader, followers redirect requests that change
+// the chain table, heartbeats, loads, usage and rebalancing to the leader.
+func (c *Coordinator) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/routing", c.handleRouting)
+	mux.HandleFunc("/nodes", c.handleNodes)
+	mux.HandleFunc("/nodes/", c.handleNode)
+	mux.HandleFunc("/chains", c.handleChains)
+	mux.HandleFunc("/chains/", c.handleChain)
+	mux.HandleFunc("/placement/explain", c.handlePlacementExplain)
+	mux.HandleFunc("/rebalance", c.handleRebalance)
+	mux.HandleFunc("/loads", c.handleLoads)
+	mux.HandleFunc("/versions", c.handleVersions)
+	mux.HandleFunc("/usage", c.handleUsage)
+	mux.HandleFunc("/usage/metrics", c.handleUsageMetrics)
+	mux.HandleFunc("/election", c.handleElection)
+	mux.HandleFunc("/election/", c.handleElection)
+	return mux
+}
+
+// writeJSON writes v as a JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error as a JSON response body
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// methodNotAllowed rejects a request with an unsupported method
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+}
+
+// handleRouting serves the routing table
+func (c *Coordinator) handleRouting(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+
+	table := c.Routing()
+	if v := r.URL.Query().Get("version"); v != "" {
+		if known, err := strconv.ParseUint(v, 10, 64); err == nil && known == table.Version {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, table)
+}
+
+// handleNodes lists or adds nodes
+func (c *Coordinator) handleNodes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, c.Nodes())
+	case http.MethodPost:
+		if c.redirectToLeader(w, r) {
+			return
+		}
+		var node api.NodeRecord
+		if err := json.NewDecoder(r.Body).Decode(&node); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid node record: %w", err))
+			return
+		}
+		if err := c.AddNode(&node); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Routing())
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleNode removes a node or changes its state
+func (c *Coordinator) handleNode(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/nodes/")
+	nodeID, action := path, ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		nodeID, action = path[:i], path[i+1:]
+	}
+	if nodeID == "" {
+		writeError(w, http.StatusBadRequest, errors.New("node ID is required"))
+		return
+	}
+	if c.redirectToLeader(w, r) {
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodDelete:
+		if err := c.RemoveNode(nodeID); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Routing())
+	case action == "state" && r.Method == http.MethodPut:
+		var body struct {
+			State api.NodeState `json:"state"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.State == "" {
+			writeError(w, http.StatusBadRequest, errors.New(`request body must be {"state": "..."}`))
+			return
+		}
+		if err := c.SetNodeState(nodeID, body.State); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, c.Routing())
+	case action == "heartbeat" && r.Method == http.MethodPost:
+		var hb api.Heartbeat
+		if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid heartbeat: %w", err))
+			return
+		}
+		hb.NodeID = nodeID
+		if err := c.Heartbeat(&hb); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleLoads lists the latest heartbeat of every node
+func (c *Coordinator) handleLoads(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	if c.redirectToLeader(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Loads())
+}
+
+// handleVersions reports the builds running in the cluster
+func (c *Coordinator) handleVersions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	if c.redirectToLeader(w, r) {
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Versions())
+}
+
+// handleChains lists the chain table
+func (c *Coordinator) handleChains(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.Routing().Chains)
+}
+
+// handleChain shows a single chain or changes its members
+func (c *Coordinator) handleChain(w http.ResponseWriter, r *http.Request) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/chains/"), "/", 3)
+	chainID, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errors.New("invalid chain ID"))
+		return
+	}
+	action := strings.Join(parts[1:], "/")
+
+	if action == "" {
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, r)
+			return
+		}
+		chain, err := c.Chain(uint32(chainID))
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, chain)
+		return
+	}
+	if c.redirectToLeader(w, r) {
+		return
+	}
+
+	switch {
+	case action == "members" && r.Method == http.MethodPost:
+		nodeID, ok := decodeChainNode(w, r)
+		if !ok {
+			return
+		}
+		err = c.AddChainMember(uint32(chainID), nodeID)
+	case strings.HasPrefix(action, "members/") && r.Method == http.MethodDelete:
+		force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+		err = c.RemoveChainMember(uint32(chainID), strings.TrimPrefix(action, "members/"), force)
+	case action == "head" && r.Method == http.MethodPut:
+		nodeID, ok := decodeChainNode(w, r)
+		if !ok {
+			return
+		}
+		err = c.SetChainHead(uint32(chainID), nodeID)
+	default:
+		methodNotAllowed(w, r)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	chain, err := c.Chain(uint32(chainID))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, chain)
+}
+
+// decodeChainNode reads the node a chain change names from a request body
+// of the form {"node": "..."}
+func decodeChainNode(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body struct {
+		Node string `json:"node"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Node == "" {
+		writeError(w, http.StatusBadRequest, errors.New(`request body must be {"node": "..."}`))
+		return "", false
+	}
+	return body.Node, true
+}
+
+// handleRebalance reports on (GET) or starts (POST) a rebalance pass
+func (c *Coordinator) handleRebalance(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	rebalancer := c.rebalancer
+	c.mu.RUnlock()
+
+	if rebalancer == nil {
+		writeError(w, http.StatusNotFound, errors.New("rebalancer is not enabled"))
+		return
+	}
+	if c.redirectToLeader(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, rebalancer.Status())
+	case http.MethodPost:
+		rebalancer.Trigger()
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"triggered": true})
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleElection reports this replica's view of the election (GET) and
+// answers the vote and lease requests of other replicas (POST)
+func (c *Coordinator) handleElection(w http.ResponseWriter, r *http.Request) {
+	c.mu.RLock()
+	election := c.election
+	c.mu.RUnlock()
+
+	if election == nil {
+		writeError(w, http.StatusNotFound, errors.New("leader election is not enabled"))
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/election" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, election.Status())
+	case r.URL.Path == "/election/vote" && r.Method == http.MethodPost:
+		var req voteRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid vote request: %w", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, election.vote(&req))
+	case r.URL.Path == "/election/lease" && r.Method == http.MethodPost:
+		var req leaseRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid lease request: %w", err))
+			return
+		}
+		writeJSON(w, http.StatusOK, election.lease(&req))
+	default:
+		methodNotAllowed(w, r)
+	}
+}
@@ -0,0 +1,104 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// NamespacePolicy is the replication policy of a namespace whose blocks
+// are kept on chains of their own rather than on the shared chains
+type NamespacePolicy struct {
+	// Replication is published in the routing table, so that every node
+	// applies the namespace's factor and consistency, or erasure coding
+	Replication api.ReplicationPolicy
+	// NumChains is the number of chains of the namespace
+	NumChains int
+	// Placement spreads the replicas of the namespace's chains
+	Placement PlacementPolicy
+}
+
+// SetNamespaces sets the namespaces with a replication policy of their
+// own. A coordinator with state creates the chains of new namespaces
+// right away; a fresh one creates them when it is bootstrapped. The chains
+// of a namespace that is no longer listed are kept, but no block maps to
+// them any more.
+func (c *Coordinator) SetNamespaces(namespaces map[string]NamespacePolicy) error {
+	policies := make(map[string]*api.ReplicationPolicy, len(namespaces))
+	for name, ns := range namespaces {
+		if name == "" {
+			return errors.New("namespace name cannot be empty")
+		}
+		if ns.Replication.ChainLength <= 0 || ns.NumChains <= 0 {
+			return fmt.Errorf("namespace %s needs a chain length and a number of chains", name)
+		}
+		if e := ns.Replication.Erasure; e != nil && e.Data+e.Parity > ns.Replication.ChainLength {
+			return fmt.Errorf("namespace %s has %d erasure shards, more than its chain length of %d", name, e.Data+e.Parity, ns.Replication.ChainLength)
+		}
+		replication := ns.Replication
+		policies[name] = &replication
+	}
+	if len(policies) == 0 {
+		policies = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.namespaces = namespaces
+	changed := !reflect.DeepEqual(c.table.Policies, policies)
+	c.table.Policies = policies
+	if c.table.Version == 0 {
+		return nil
+	}
+
+	chains := len(c.table.Chains)
+	c.assignChains()
+	if !changed && len(c.table.Chains) == chains {
+		return nil
+	}
+	c.logger.Info("updated namespace replication policies", "namespaces", len(namespaces), "chains", len(c.table.Chains))
+	return c.commit()
+}
+
+// namespaceNames returns the names of the namespaces with a policy of
+// their own, sorted so that their chains are created in a stable order.
+// Must be called with the lock held.
+func (c *Coordinator) namespaceNames() []string {
+	names := make([]string, 0, len(c.namespaces))
+	for name := range c.namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ensureChains appends chains to a namespace, "" for the shared chains,
+// until it has count of them. Must be called with the lock held.
+func (c *Coordinator) ensureChains(namespace string, count, length int) {
+	existing := 0
+	for _, chain := range c.table.Chains {
+		if chain.Namespace == namespace {
+			existing++
+		}
+	}
+	for ; existing < count; existing++ {
+		c.table.Chains = append(c.table.Chains, &api.ChainRecord{
+			ID:        uint32(len(c.table.Chains)),
+			Members:   make([]string, 0, length),
+			Namespace: namespace,
+		})
+	}
+}
+
+// chainLengthOf returns the number of members a chain should have. Must be
+// called with the lock held.
+func (c *Coordinator) chainLengthOf(chain *api.ChainRecord) int {
+	if ns, ok := c.namespaces[chain.Namespace]; ok && chain.Namespace != "" {
+		return ns.Replication.ChainLength
+	}
+	return c.chainLength
+}
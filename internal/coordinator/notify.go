@@ -0,0 +1,69 @@
+package coordinator
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// SetNotifier makes the coordinator report the nodes it marks down and the
+// chains whose members change. Only changes the coordinator commits are
+// reported, so a replica reports nothing until it leads.
+func (c *Coordinator) SetNotifier(notify func(api.ClusterEvent)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.notify = notify
+	c.observe(false)
+}
+
+// observe records the state of each node and the version of each chain,
+// and if report is set first reports the nodes that went down and the
+// chains that changed since they were last recorded. Must be called with
+// the lock held.
+func (c *Coordinator) observe(report bool) {
+	if c.notify == nil {
+		return
+	}
+
+	nodes := make(map[string]api.NodeState, len(c.table.Nodes))
+	for id, node := range c.table.Nodes {
+		nodes[id] = node.State
+		if from, ok := c.observedNodes[id]; report && ok && from != api.NodeStateDown && node.State == api.NodeStateDown {
+			c.notify(api.ClusterEvent{
+				Type:    api.ClusterEventNodeFailed,
+				Message: fmt.Sprintf("node %s is down", id),
+				Details: map[string]string{
+					"node":    id,
+					"address": node.Address,
+					"host":    node.Host(),
+					"zone":    node.Zone,
+					"from":    string(from),
+					"suspect": strconv.FormatBool(node.Suspect),
+				},
+			})
+		}
+	}
+
+	chains := make(map[uint32]uint64, len(c.table.Chains))
+	for _, chain := range c.table.Chains {
+		chains[chain.ID] = chain.Version
+		if version, ok := c.observedChains[chain.ID]; report && ok && version != chain.Version {
+			c.notify(api.ClusterEvent{
+				Type:    api.ClusterEventChainReconfigured,
+				Message: fmt.Sprintf("chain %d has members %s", chain.ID, strings.Join(chain.Members, ", ")),
+				Details: map[string]string{
+					"chain":     strconv.FormatUint(uint64(chain.ID), 10),
+					"namespace": chain.Namespace,
+					"version":   strconv.FormatUint(chain.Version, 10),
+					"members":   strings.Join(chain.Members, ","),
+					"head":      chain.Head(),
+				},
+			})
+		}
+	}
+
+	c.observedNodes = nodes
+	c.observedChains = chains
+}
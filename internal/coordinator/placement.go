@@ -0,0 +1,140 @@
+package coordinator
+
+import (
+	"fmt"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// Failure domains, from the narrowest to the widest
+const (
+	DomainHost = "host"
+	DomainRack = "rack"
+	DomainZone = "zone"
+)
+
+// PlacementPolicy controls how the replicas of a chain are spread over
+// failure domains. The replicas of a chain are always on different hosts;
+// the policy may spread them over racks or zones as well.
+type PlacementPolicy struct {
+	// Domain is the failure domain replicas are spread over: host, rack
+	// or zone
+	Domain string
+	// Strict leaves a chain short of members rather than place two of its
+	// replicas in one domain. Otherwise replicas share a domain when there
+	// are not enough domains, but never a host.
+	Strict bool
+	// Zones restricts members to nodes in these zones; empty allows any
+	Zones []string
+}
+
+// ParsePlacementPolicy validates a failure domain name and builds a
+// policy. An empty domain spreads replicas over hosts.
+func ParsePlacementPolicy(domain string, strict bool) (PlacementPolicy, error) {
+	switch domain {
+	case "":
+		domain = DomainHost
+	case DomainHost, DomainRack, DomainZone:
+	default:
+		return PlacementPolicy{}, fmt.Errorf("unknown failure domain %q", domain)
+	}
+	return PlacementPolicy{Domain: domain, Strict: strict}, nil
+}
+
+// SetPlacement sets the policy used for chain assignments from now on.
+// Existing members are not moved.
+func (c *Coordinator) SetPlacement(policy PlacementPolicy) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.placement = policy
+}
+
+// failureDomain returns the domain of a node at the given level. A node
+// without a rack or zone label is a domain of its own at that level, so
+// that unlabelled clusters are spread over hosts as before.
+func failureDomain(table *api.RoutingTable, id, level string) string {
+	record, ok := table.Nodes[id]
+	if !ok {
+		return "host:" + id
+	}
+	host := "host:" + record.Host()
+
+	switch level {
+	case DomainZone:
+		if record.Zone != "" {
+			return "zone:" + record.Zone
+		}
+		fallthrough
+	case DomainRack:
+		if record.Rack != "" {
+			// Rack names need only be unique within a zone
+			return "rack:" + record.Zone + "/" + record.Rack
+		}
+	}
+	return host
+}
+
+// domains counts the distinct failure domains of members at the given
+// level, leaving out except
+func domains(table *api.RoutingTable, members []string, except, level string) map[string]int {
+	counts := make(map[string]int)
+	for _, member := range members {
+		if member != except {
+			counts[failureDomain(table, member, level)]++
+		}
+	}
+	return counts
+}
+
+// Placement returns the placement policy of a chain: its namespace's, or
+// the coordinator's for shared chains
+func (c *Coordinator) Placement(chain *api.ChainRecord) PlacementPolicy {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.placementOf(chain)
+}
+
+// placementOf returns the placement policy of a chain. Must be called with
+// the lock held.
+func (c *Coordinator) placementOf(chain *api.ChainRecord) PlacementPolicy {
+	if ns, ok := c.namespaces[chain.Namespace]; ok && chain.Namespace != "" {
+		return ns.Placement
+	}
+	return c.placement
+}
+
+// allows reports whether id is in one of the zones the policy allows
+func (p PlacementPolicy) allows(table *api.RoutingTable, id string) bool {
+	if len(p.Zones) == 0 {
+		return true
+	}
+	record, ok := table.Nodes[id]
+	return ok && contains(p.Zones, record.Zone)
+}
+
+// sharesDomain reports whether id is in the same failure domain as one of
+// members other than except
+func (p PlacementPolicy) sharesDomain(table *api.RoutingTable, members []string, except, id string) bool {
+	return domains(table, members, except, p.Domain)[failureDomain(table, id, p.Domain)] > 0
+}
+
+// placeable reports whether id may replace except among a chain's members
+// under the placement policy: never on a member's host or outside the
+// allowed zones, never in a member's domain when strict, and otherwise
+// without narrowing the chain's spread over domains
+func (p PlacementPolicy) placeable(table *api.RoutingTable, members []string, except, id string) bool {
+	if sharesHost(table, members, except, id) || !p.allows(table, id) {
+		return false
+	}
+	if !p.sharesDomain(table, members, except, id) {
+		return true
+	}
+	if p.Strict {
+		return false
+	}
+
+	before := len(domains(table, members, "", p.Domain))
+	after := domains(table, members, except, p.Domain)
+	after[failureDomain(table, id, p.Domain)]++
+	return len(after) >= before
+}
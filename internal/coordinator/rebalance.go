@@ -0,0 +1,516 @@
+package coordinator
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// UsagePath is the node admin endpoint reporting the data a node holds
+const UsagePath = "/v1/usage"
+
+// Move states
+const (
+	MovePending = "pending"
+	MoveCopying = "copying"
+	MoveDone    = "done"
+	MoveFailed  = "failed"
+)
+
+// RebalanceOptions configures the rebalancer
+type RebalanceOptions struct {
+	// Interval is how often skew is checked; zero only rebalances on demand
+	Interval time.Duration
+	// Threshold is how far, as a fraction of the average, the fullest node
+	// may be above the average before chains are moved
+	Threshold float64
+	// MaxMoves caps the number of chain moves planned per pass
+	MaxMoves int
+	// Concurrency is the number of chain moves executed in parallel
+	Concurrency int
+	// BandwidthBytes caps the copy traffic of all moves, in bytes per
+	// second; zero means unlimited
+	BandwidthBytes int64
+	// Limiter, when set, caps the copy traffic in place of BandwidthBytes,
+	// so that it can share a budget with other work
+	Limiter *ratelimit.Limiter
+	// Schedule, when set, is called by Trigger in place of waking Run, for
+	// rebalancers whose passes are run by an external scheduler
+	Schedule func()
+	// Dial connects to a node's data port; defaults to client.Dial
+	Dial func(address string) (*client.Client, error)
+}
+
+// Move relocates one chain membership from a node to another
+type Move struct {
+	ChainID uint32 `json:"chain_id"`
+	From    string `json:"from"`
+	To      string `json:"to"`
+	Bytes   int64  `json:"bytes"`
+	Blocks  int    `json:"blocks"`
+	State   string `json:"state"`
+	Copied  int64  `json:"copied_bytes"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RebalanceStatus reports the current or last rebalance pass
+type RebalanceStatus struct {
+	Running     bool    `json:"running"`
+	StartedAt   int64   `json:"started_at,omitempty"`
+	FinishedAt  int64   `json:"finished_at,omitempty"`
+	BytesSkew   float64 `json:"bytes_skew"`
+	BlocksSkew  float64 `json:"blocks_skew"`
+	Moves       []*Move `json:"moves"`
+	Completed   int     `json:"completed"`
+	Failed      int     `json:"failed"`
+	BytesCopied int64   `json:"bytes_copied"`
+	Error       string  `json:"error,omitempty"`
+}
+
+// Rebalancer moves chain memberships from the fullest nodes to the emptiest
+// ones. A move copies the chain's blocks to the new node, swaps it into the
+// chain, copies anything written in the meantime, and finally deletes the
+// blocks from the old node.
+type Rebalancer struct {
+	coord   *Coordinator
+	opts    RebalanceOptions
+	http    *http.Client
+	limiter *ratelimit.Limiter
+	trigger chan struct{}
+	status  RebalanceStatus
+	logger  *slog.Logger
+	mu      sync.Mutex
+}
+
+// NewRebalancer creates a rebalancer for the coordinator's chain table and
+// exposes it through the coordinator's HTTP API
+func NewRebalancer(coord *Coordinator, opts RebalanceOptions, logger *slog.Logger) *Rebalancer {
+	if opts.Threshold <= 0 {
+		opts.Threshold = 0.1
+	}
+	if opts.MaxMoves <= 0 {
+		opts.MaxMoves = 8
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 2
+	}
+	if opts.Dial == nil {
+		opts.Dial = func(address string) (*client.Client, error) {
+			return client.Dial(address, 0)
+		}
+	}
+
+	limiter := opts.Limiter
+	if limiter == nil {
+		rate := float64(opts.BandwidthBytes)
+		limiter = ratelimit.New(rate, int(rate))
+	}
+	r := &Rebalancer{
+		coord:   coord,
+		opts:    opts,
+		http:    &http.Client{Timeout: 30 * time.Second},
+		limiter: limiter,
+		trigger: make(chan struct{}, 1),
+		logger:  logging.Component(logger, "rebalancer"),
+	}
+
+	coord.mu.Lock()
+	coord.rebalancer = r
+	coord.mu.Unlock()
+
+	return r
+}
+
+// Trigger asks for a rebalance pass as soon as possible
+func (r *Rebalancer) Trigger() {
+	if r.opts.Schedule != nil {
+		r.opts.Schedule()
+		return
+	}
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Status returns a copy of the current or last pass's status
+func (r *Rebalancer) Status() RebalanceStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	status.Moves = make([]*Move, 0, len(r.status.Moves))
+	for _, move := range r.status.Moves {
+		m := *move
+		status.Moves = append(status.Moves, &m)
+	}
+	return status
+}
+
+// Run performs rebalance passes on demand and periodically until ctx is done
+func (r *Rebalancer) Run(ctx context.Context) {
+	var tick <-chan time.Time
+	if r.opts.Interval > 0 {
+		ticker := time.NewTicker(r.opts.Interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.trigger:
+		case <-tick:
+		}
+
+		if err := r.pass(ctx); err != nil && ctx.Err() == nil {
+			r.logger.Warn("rebalance pass failed", "error", err)
+		}
+	}
+}
+
+// RunPass performs a single rebalance pass, for callers that schedule
+// passes themselves instead of calling Run
+func (r *Rebalancer) RunPass(ctx context.Context) error {
+	return r.pass(ctx)
+}
+
+// pass gathers usage, plans moves, and executes them
+func (r *Rebalancer) pass(ctx context.Context) (err error) {
+	r.mu.Lock()
+	r.status = RebalanceStatus{Running: true, StartedAt: time.Now().UnixNano(), Moves: make([]*Move, 0)}
+	r.mu.Unlock()
+
+	defer func() {
+		r.mu.Lock()
+		r.status.Running = false
+		r.status.FinishedAt = time.Now().UnixNano()
+		if err != nil {
+			r.status.Error = err.Error()
+		}
+		r.mu.Unlock()
+	}()
+
+	table := r.coord.Routing()
+	usage := r.gatherUsage(ctx, table)
+	if len(usage) < 2 {
+		return nil
+	}
+
+	bytesSkew, blocksSkew := skew(usage)
+	moves := r.plan(table, usage)
+
+	r.mu.Lock()
+	r.status.BytesSkew = bytesSkew
+	r.status.BlocksSkew = blocksSkew
+	r.status.Moves = moves
+	r.mu.Unlock()
+
+	if len(moves) == 0 {
+		return nil
+	}
+	r.logger.Info("rebalancing", "bytes_skew", bytesSkew, "blocks_skew", blocksSkew, "moves", len(moves))
+
+	sem := make(chan struct{}, r.opts.Concurrency)
+	var wg sync.WaitGroup
+	for _, move := range moves {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			wg.Wait()
+			return ctx.Err()
+		}
+
+		wg.Add(1)
+		go func(move *Move) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r.execute(ctx, move)
+		}(move)
+	}
+	wg.Wait()
+
+	return nil
+}
+
+// gatherUsage asks every up node with an admin address for its usage.
+// Nodes that are suspected of failing or cannot be reached are left out
+// of the pass.
+func (r *Rebalancer) gatherUsage(ctx context.Context, table *api.RoutingTable) map[string]*api.NodeUsage {
+	usage := make(map[string]*api.NodeUsage)
+	for id, node := range table.Nodes {
+		if !node.Healthy() || node.AdminAddress == "" || node.IsCache() {
+			continue
+		}
+
+		u, err := r.fetchUsage(ctx, id, node.AdminAddress)
+		if err != nil {
+			r.logger.Warn("failed to fetch node usage", "node", id, "error", err)
+			continue
+		}
+		usage[id] = u
+	}
+	return usage
+}
+
+// fetchUsage reads the usage of a node, or of one of a node's storage
+// targets, from its admin API
+func (r *Rebalancer) fetchUsage(ctx context.Context, id, adminAddress string) (*api.NodeUsage, error) {
+	u := "http://" + hostPort(adminAddress) + UsagePath + "?target=" + url.QueryEscape(id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("node returned %s", resp.Status)
+	}
+
+	var usage api.NodeUsage
+	if err := json.NewDecoder(resp.Body).Decode(&usage); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal usage: %w", err)
+	}
+	return &usage, nil
+}
+
+// skew returns how far apart the fullest and emptiest nodes are, as a
+// fraction of the average, by bytes and by block count
+func skew(usage map[string]*api.NodeUsage) (float64, float64) {
+	spread := func(value func(*api.NodeUsage) float64) float64 {
+		var min, max, total float64
+		first := true
+		for _, u := range usage {
+			v := value(u)
+			total += v
+			if first || v < min {
+				min = v
+			}
+			if first || v > max {
+				max = v
+			}
+			first = false
+		}
+		avg := total / float64(len(usage))
+		if avg == 0 {
+			return 0
+		}
+		return (max - min) / avg
+	}
+
+	return spread(func(u *api.NodeUsage) float64 { return float64(u.Bytes) }),
+		spread(func(u *api.NodeUsage) float64 { return float64(u.Blocks) })
+}
+
+// plan greedily moves chains from the fullest to the emptiest node while
+// the fullest node is above the threshold. Each chain moves at most once
+// per pass, and only moves that bring the two nodes closer are planned.
+func (r *Rebalancer) plan(table *api.RoutingTable, usage map[string]*api.NodeUsage) []*Move {
+	load := make(map[string]int64, len(usage))
+	var total int64
+	for id, u := range usage {
+		load[id] = u.Bytes
+		total += u.Bytes
+	}
+	avg := float64(total) / float64(len(load))
+	if avg == 0 {
+		return nil
+	}
+
+	ids := make([]string, 0, len(load))
+	for id := range load {
+		ids = append(ids, id)
+	}
+
+	moved := make(map[uint32]bool)
+	moves := make([]*Move, 0)
+	for len(moves) < r.opts.MaxMoves {
+		// Order nodes by load, breaking ties by ID so plans are stable
+		sort.Slice(ids, func(i, j int) bool {
+			if load[ids[i]] != load[ids[j]] {
+				return load[ids[i]] > load[ids[j]]
+			}
+			return ids[i] < ids[j]
+		})
+		src, dst := ids[0], ids[len(ids)-1]
+		if float64(load[src]) <= avg*(1+r.opts.Threshold) {
+			break
+		}
+
+		// Pick the chain whose move best evens out src and dst
+		gap := load[src] - load[dst]
+		var best *Move
+		var bestDiff int64
+		for chainID, cu := range usage[src].Chains {
+			if moved[chainID] || cu.Bytes <= 0 || cu.Bytes >= gap || int(chainID) >= len(table.Chains) {
+				continue
+			}
+			chain := table.Chains[chainID]
+			if !contains(chain.Members, src) || !r.coord.Placement(chain).placeable(table, chain.Members, src, dst) ||
+				!r.coord.allowedByRules(table, chain, src, dst) {
+				continue
+			}
+
+			diff := gap - 2*cu.Bytes
+			if diff < 0 {
+				diff = -diff
+			}
+			if best == nil || diff < bestDiff || (diff == bestDiff && chainID < best.ChainID) {
+				best = &Move{ChainID: chainID, From: src, To: dst, Bytes: cu.Bytes, Blocks: cu.Blocks, State: MovePending}
+				bestDiff = diff
+			}
+		}
+		if best == nil {
+			break
+		}
+
+		moves = append(moves, best)
+		moved[best.ChainID] = true
+		load[src] -= best.Bytes
+		load[dst] += best.Bytes
+	}
+
+	return moves
+}
+
+// setMove updates a move's state under the status lock
+func (r *Rebalancer) setMove(move *Move, fn func(*Move)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(move)
+}
+
+// execute carries out a single move
+func (r *Rebalancer) execute(ctx context.Context, move *Move) {
+	err := r.moveChain(ctx, move)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		move.State = MoveFailed
+		move.Error = err.Error()
+		r.status.Failed++
+		r.logger.Warn("chain move failed", "chain", move.ChainID, "from", move.From, "to", move.To, "error", err)
+		return
+	}
+	move.State = MoveDone
+	r.status.Completed++
+}
+
+// moveChain copies a chain's blocks to the new member, swaps the member in,
+// catches up on writes that raced with the copy, and deletes the blocks
+// from the old member
+func (r *Rebalancer) moveChain(ctx context.Context, move *Move) error {
+	table := r.coord.Routing()
+	fromAddr, toAddr := table.NodeAddress(move.From), table.NodeAddress(move.To)
+	if fromAddr == "" || toAddr == "" {
+		return errors.New("node address unknown")
+	}
+
+	from, err := r.opts.Dial(fromAddr)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := r.opts.Dial(toAddr)
+	if err != nil {
+		return err
+	}
+	defer to.Close()
+
+	r.setMove(move, func(m *Move) { m.State = MoveCopying })
+	if _, err := r.copyChain(ctx, table, move, from, to); err != nil {
+		return err
+	}
+
+	if err := r.coord.ReplaceChainMember(move.ChainID, move.From, move.To); err != nil {
+		return err
+	}
+
+	// Writes that reached the old member before it saw the new table
+	blockIDs, err := r.copyChain(ctx, table, move, from, to)
+	if err != nil {
+		return fmt.Errorf("failed to catch up after swapping members: %w", err)
+	}
+
+	fromCtx := client.WithTarget(ctx, move.From)
+	for _, blockID := range blockIDs {
+		if err := from.Delete(fromCtx, blockID); err != nil {
+			r.logger.Warn("failed to delete moved block", "block", blockID, "node", move.From, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// copyChain copies every block of the move's chain that the new member
+// lacks, returning the IDs of the chain's blocks on the old member. Requests
+// name each side's storage target, since the new member is not in the chain
+// yet.
+func (r *Rebalancer) copyChain(ctx context.Context, table *api.RoutingTable, move *Move, from, to *client.Client) ([]string, error) {
+	fromCtx, toCtx := client.WithTarget(ctx, move.From), client.WithTarget(ctx, move.To)
+	// Copies are written on behalf of the old member, so they are refused
+	// if it has been fenced off since the move was planned
+	if node, ok := table.Nodes[move.From]; ok {
+		toCtx = client.WithFence(toCtx, api.FencingToken{NodeID: move.From, Epoch: node.Epoch})
+	}
+
+	all, err := from.List(fromCtx, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list blocks: %w", err)
+	}
+
+	blockIDs := make([]string, 0)
+	for _, blockID := range all {
+		if chain := table.ChainForBlock(blockID); chain == nil || chain.ID != move.ChainID {
+			continue
+		}
+		blockIDs = append(blockIDs, blockID)
+
+		src, err := from.Stat(fromCtx, blockID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat block %s: %w", blockID, err)
+		}
+		if dst, err := to.Stat(toCtx, blockID); err == nil && dst.Checksum == src.Checksum {
+			continue
+		}
+
+		if err := r.limiter.WaitN(ctx, src.Size); err != nil {
+			return nil, err
+		}
+		data, _, err := from.Fetch(fromCtx, blockID, src.Version)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch block %s: %w", blockID, err)
+		}
+		if err := to.Write(toCtx, blockID, data); err != nil {
+			return nil, fmt.Errorf("failed to write block %s: %w", blockID, err)
+		}
+
+		copied := int64(len(data))
+		r.mu.Lock()
+		move.Copied += copied
+		r.status.BytesCopied += copied
+		r.mu.Unlock()
+	}
+
+	return blockIDs, nil
+}
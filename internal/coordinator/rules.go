@@ -0,0 +1,390 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// Types of placement rules
+const (
+	// RuleSpread keeps the members of a chain in different failure domains
+	// of a level
+	RuleSpread = "spread"
+	// RuleFullness passes over nodes that reported being fuller than a
+	// fraction of their capacity
+	RuleFullness = "fullness"
+	// RuleLabels only places members on nodes carrying labels
+	RuleLabels = "labels"
+	// RuleAvoidLabels never places members on nodes carrying labels
+	RuleAvoidLabels = "avoid_labels"
+)
+
+// PlacementRule is a declarative constraint on the nodes chain members are
+// placed on, evaluated on top of the chains' placement policies whenever a
+// member is chosen: when chains are filled, when a member is added or
+// moved, and when rebalancing. A hard rule is never broken; a soft rule is
+// broken only when no node satisfies it.
+type PlacementRule struct {
+	// Name identifies the rule in explanations and logs
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Namespaces are the namespaces whose chains the rule applies to;
+	// empty applies it to every chain, shared ones included
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Domain is the failure domain level of a spread rule
+	Domain string `json:"domain,omitempty"`
+	// MaxFullness is the fraction of its capacity a node may have used
+	// under a fullness rule
+	MaxFullness float64 `json:"max_fullness,omitempty"`
+	// Labels are the labels a labels rule requires all of, and an
+	// avoid_labels rule refuses any of
+	Labels map[string]string `json:"labels,omitempty"`
+	Soft   bool              `json:"soft,omitempty"`
+}
+
+// builtinChecks name the checks every candidate goes through before the
+// placement rules, which rules may not be named after
+var builtinChecks = []string{"member", "role", "state", "suspect", "space", "nearly_full", "host", "zones", "spread"}
+
+// validate checks that the rule is complete
+func (r PlacementRule) validate() error {
+	if r.Name == "" {
+		return errors.New("placement rule needs a name")
+	}
+	if contains(builtinChecks, r.Name) {
+		return fmt.Errorf("placement rule %s is named after a built-in check", r.Name)
+	}
+	switch r.Type {
+	case RuleSpread:
+		if r.Domain != DomainHost && r.Domain != DomainRack && r.Domain != DomainZone {
+			return fmt.Errorf("placement rule %s: unknown failure domain %q", r.Name, r.Domain)
+		}
+	case RuleFullness:
+		if r.MaxFullness <= 0 || r.MaxFullness > 1 {
+			return fmt.Errorf("placement rule %s: max fullness must be above 0 and at most 1", r.Name)
+		}
+	case RuleLabels, RuleAvoidLabels:
+		if len(r.Labels) == 0 {
+			return fmt.Errorf("placement rule %s: no labels", r.Name)
+		}
+	default:
+		return fmt.Errorf("placement rule %s: unknown type %q", r.Name, r.Type)
+	}
+	return nil
+}
+
+// appliesTo reports whether the rule applies to a chain
+func (r PlacementRule) appliesTo(chain *api.ChainRecord) bool {
+	return len(r.Namespaces) == 0 || contains(r.Namespaces, chain.Namespace)
+}
+
+// check evaluates the rule on id replacing except among members, returning
+// why it fails. Must be called with the lock held.
+func (r PlacementRule) check(c *Coordinator, table *api.RoutingTable, members []string, except, id string) (bool, string) {
+	record, ok := table.Nodes[id]
+	if !ok {
+		return false, "unknown node"
+	}
+	switch r.Type {
+	case RuleSpread:
+		domain := failureDomain(table, id, r.Domain)
+		if domains(table, members, except, r.Domain)[domain] > 0 {
+			return false, "shares " + domain + " with a member"
+		}
+	case RuleFullness:
+		fullness, ok := c.fullness(id)
+		if ok && fullness > r.MaxFullness {
+			return false, fmt.Sprintf("%.0f%% full, above %.0f%%", fullness*100, r.MaxFullness*100)
+		}
+	case RuleLabels:
+		for _, key := range sortedKeys(r.Labels) {
+			if record.Labels[key] != r.Labels[key] {
+				return false, "lacks label " + key + "=" + r.Labels[key]
+			}
+		}
+	case RuleAvoidLabels:
+		for _, key := range sortedKeys(r.Labels) {
+			if value, ok := record.Labels[key]; ok && value == r.Labels[key] {
+				return false, "has label " + key + "=" + value
+			}
+		}
+	}
+	return true, ""
+}
+
+// sortedKeys returns the keys of labels in order, so that explanations are
+// stable
+func sortedKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for key := range labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// fullness returns the fraction of its capacity a node last reported
+// using. Must be called with the lock held.
+func (c *Coordinator) fullness(nodeID string) (float64, bool) {
+	load, ok := c.loads[nodeID]
+	if !ok || load.CapacityBytes <= 0 {
+		return 0, false
+	}
+	return float64(load.UsedBytes) / float64(load.CapacityBytes), true
+}
+
+// SetPlacementRules sets the placement rules used for chain assignments
+// from now on. Existing members are not moved.
+func (c *Coordinator) SetPlacementRules(rules []PlacementRule) error {
+	names := make(map[string]bool, len(rules))
+	for _, rule := range rules {
+		if err := rule.validate(); err != nil {
+			return err
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("placement rule %s is defined twice", rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rules = rules
+	return nil
+}
+
+// PlacementRules returns the placement rules
+func (c *Coordinator) PlacementRules() []PlacementRule {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return slices.Clone(c.rules)
+}
+
+// RuleCheck is the verdict of a placement check on a candidate node
+type RuleCheck struct {
+	Rule   string `json:"rule"`
+	Passed bool   `json:"passed"`
+	Soft   bool   `json:"soft,omitempty"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// checkRules evaluates the rules applying to a chain on id replacing
+// except among its members. Must be called with the lock held.
+func (c *Coordinator) checkRules(table *api.RoutingTable, chain *api.ChainRecord, except, id string) []RuleCheck {
+	var checks []RuleCheck
+	for _, rule := range c.rules {
+		if !rule.appliesTo(chain) {
+			continue
+		}
+		passed, reason := rule.check(c, table, chain.Members, except, id)
+		checks = append(checks, RuleCheck{Rule: rule.Name, Passed: passed, Soft: rule.Soft, Reason: reason})
+	}
+	return checks
+}
+
+// rulesPass reports whether id passes the hard rules of a chain, and its
+// soft rules as well unless relaxed. Must be called with the lock held.
+func (c *Coordinator) rulesPass(table *api.RoutingTable, chain *api.ChainRecord, except, id string, relaxed bool) bool {
+	return failedRule(c.checkRules(table, chain, except, id), relaxed) == nil
+}
+
+// failedRule returns the first check that failed, passing over soft rules
+// when relaxed
+func failedRule(checks []RuleCheck, relaxed bool) *RuleCheck {
+	for i, check := range checks {
+		if !check.Passed && !(relaxed && check.Soft) {
+			return &checks[i]
+		}
+	}
+	return nil
+}
+
+// breaksRules returns an error naming the hard rule id breaks by replacing
+// except among a chain's members, if any. Must be called with the lock
+// held.
+func (c *Coordinator) breaksRules(chain *api.ChainRecord, except, id string) error {
+	if check := failedRule(c.checkRules(c.table, chain, except, id), true); check != nil {
+		return fmt.Errorf("node %s breaks placement rule %s of chain %d: %s", id, check.Rule, chain.ID, check.Reason)
+	}
+	return nil
+}
+
+// allowedByRules reports whether the hard rules of a chain allow id to
+// replace except among its members in a table
+func (c *Coordinator) allowedByRules(table *api.RoutingTable, chain *api.ChainRecord, except, id string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.rulesPass(table, chain, except, id, true)
+}
+
+// PlacementExplanation is a dry run of chain assignment: the chains a new
+// assignment would change, and optionally how each node fares as a new
+// member of one chain
+type PlacementExplanation struct {
+	Rules   []PlacementRule  `json:"rules"`
+	Changes []ChainChange    `json:"changes"`
+	Chain   *ChainCandidates `json:"chain,omitempty"`
+}
+
+// ChainChange is the change to a chain's members a new assignment makes
+type ChainChange struct {
+	Chain     uint32   `json:"chain"`
+	Namespace string   `json:"namespace,omitempty"`
+	Before    []string `json:"before"`
+	After     []string `json:"after"`
+}
+
+// ChainCandidates explains which nodes may join a chain and why the others
+// may not
+type ChainCandidates struct {
+	Chain      uint32      `json:"chain"`
+	Namespace  string      `json:"namespace,omitempty"`
+	Members    []string    `json:"members"`
+	Candidates []Candidate `json:"candidates"`
+}
+
+// Candidate is a node's verdicts as a new member of a chain. A node is
+// eligible when it passes every check but soft rules; preferred when it
+// passes those too.
+type Candidate struct {
+	Node      string      `json:"node"`
+	Eligible  bool        `json:"eligible"`
+	Preferred bool        `json:"preferred"`
+	Checks    []RuleCheck `json:"checks"`
+}
+
+// ExplainPlacement runs chain assignment without committing it, to report
+// the chains it would change, and explains the candidates of chain if it
+// is not nil
+func (c *Coordinator) ExplainPlacement(chain *uint32) (*PlacementExplanation, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	explanation := &PlacementExplanation{Rules: slices.Clone(c.rules), Changes: []ChainChange{}}
+	if explanation.Rules == nil {
+		explanation.Rules = []PlacementRule{}
+	}
+	if chain != nil {
+		record, err := c.chainLocked(*chain)
+		if err != nil {
+			return nil, err
+		}
+		explanation.Chain = c.candidates(record)
+	}
+
+	// Assign chains on a copy of the table, quietly, and put the table
+	// back
+	table, logger := c.table, c.logger
+	c.table = copyTable(table)
+	c.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	c.assignChains()
+	planned := c.table
+	c.table, c.logger = table, logger
+
+	for i, after := range planned.Chains {
+		var before []string
+		if i < len(table.Chains) {
+			before = table.Chains[i].Members
+		}
+		if !slices.Equal(before, after.Members) {
+			explanation.Changes = append(explanation.Changes, ChainChange{
+				Chain:     after.ID,
+				Namespace: after.Namespace,
+				Before:    append([]string{}, before...),
+				After:     after.Members,
+			})
+		}
+	}
+	return explanation, nil
+}
+
+// candidates evaluates every node as a new member of a chain. Must be
+// called with the lock held.
+func (c *Coordinator) candidates(chain *api.ChainRecord) *ChainCandidates {
+	ids := make([]string, 0, len(c.table.Nodes))
+	for id := range c.table.Nodes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	placement := c.placementOf(chain)
+	explained := &ChainCandidates{
+		Chain:      chain.ID,
+		Namespace:  chain.Namespace,
+		Members:    append([]string{}, chain.Members...),
+		Candidates: make([]Candidate, 0, len(ids)),
+	}
+	for _, id := range ids {
+		node := c.table.Nodes[id]
+		check := func(name string, passed bool, reason string) RuleCheck {
+			if passed {
+				reason = ""
+			}
+			return RuleCheck{Rule: name, Passed: passed, Reason: reason}
+		}
+		free, reported := c.freeBytes(id)
+		checks := []RuleCheck{
+			check("member", !contains(chain.Members, id), "already a member"),
+			check("role", !node.IsCache(), "cache node"),
+			check("state", node.State == api.NodeStateUp, "node is "+string(node.State)),
+			check("suspect", !node.Suspect, "suspected of failing"),
+			check("space", !reported || free > 0, "reported being full"),
+			check("host", contains(chain.Members, id) || !sharesHost(c.table, chain.Members, "", id), "shares a host with a member"),
+			check("zones", placement.allows(c.table, id), "outside zones "+strings.Join(placement.Zones, ",")),
+		}
+		nearlyFull := check("nearly_full", !node.NearlyFull, "nearly full")
+		nearlyFull.Soft = true
+		checks = append(checks, nearlyFull)
+		// The policy's spread is soft unless it is strict, as when chains
+		// are filled
+		spread := check("spread", !placement.sharesDomain(c.table, chain.Members, "", id), "shares a "+placement.Domain+" with a member")
+		spread.Soft = !placement.Strict
+		checks = append(checks, spread)
+		checks = append(checks, c.checkRules(c.table, chain, "", id)...)
+		explained.Candidates = append(explained.Candidates, Candidate{
+			Node:      id,
+			Eligible:  failedRule(checks, true) == nil,
+			Preferred: failedRule(checks, false) == nil,
+			Checks:    checks,
+		})
+	}
+	return explained
+}
+
+// handlePlacementExplain serves a dry run of chain assignment, with the
+// candidates of the chain query parameter if it is set
+func (c *Coordinator) handlePlacementExplain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	if c.redirectToLeader(w, r) {
+		return
+	}
+
+	var chain *uint32
+	if value := r.URL.Query().Get("chain"); value != "" {
+		id, err := strconv.ParseUint(value, 10, 32)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid chain ID %q", value))
+			return
+		}
+		chainID := uint32(id)
+		chain = &chainID
+	}
+	explanation, err := c.ExplainPlacement(chain)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, explanation)
+}
@@ -0,0 +1,141 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/3fs-storage/internal/usage"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// errUsageDisabled is returned while the coordinator keeps no usage ledger
+var errUsageDisabled = errors.New("usage accounting is not enabled")
+
+// SetUsage makes the coordinator add up the usage reports of the nodes in
+// a ledger
+func (c *Coordinator) SetUsage(ledger *usage.Ledger) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usage = ledger
+}
+
+// SetUsageMetrics sets whether the coordinator serves the totals of its
+// usage ledger as Prometheus metrics
+func (c *Coordinator) SetUsageMetrics(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.usageMetrics = enabled
+}
+
+// RecordUsage counts a node's usage report. Reports are only taken from
+// the storage nodes of the routing table.
+func (c *Coordinator) RecordUsage(report *api.UsageReport) error {
+	c.mu.RLock()
+	ledger := c.usage
+	known := false
+	for _, node := range c.table.Nodes {
+		if node.ID == report.Node || node.Node == report.Node {
+			known = true
+			break
+		}
+	}
+	c.mu.RUnlock()
+
+	if ledger == nil {
+		return errUsageDisabled
+	}
+	if !known {
+		return fmt.Errorf("node %s not found", report.Node)
+	}
+	return ledger.Record(report)
+}
+
+// Usage returns the use of a namespace, or of every namespace if it is
+// empty, over the windows ending after since
+func (c *Coordinator) Usage(namespace string, since time.Time) (*usage.Summary, error) {
+	c.mu.RLock()
+	ledger := c.usage
+	c.mu.RUnlock()
+	if ledger == nil {
+		return nil, errUsageDisabled
+	}
+	return ledger.Summary(namespace, since), nil
+}
+
+// FlushUsage persists the usage ledger, if there is one
+func (c *Coordinator) FlushUsage() error {
+	c.mu.RLock()
+	ledger := c.usage
+	c.mu.RUnlock()
+	if ledger == nil {
+		return nil
+	}
+	return ledger.Flush()
+}
+
+// handleUsage reports the use of the namespaces, optionally of one
+// namespace and since a duration ago, or records a node's usage report
+func (c *Coordinator) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if c.redirectToLeader(w, r) {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		since := time.Unix(0, 0)
+		if s := r.URL.Query().Get("since"); s != "" {
+			d, err := time.ParseDuration(s)
+			if err != nil || d <= 0 {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid since %q", s))
+				return
+			}
+			since = time.Now().Add(-d)
+		}
+		summary, err := c.Usage(r.URL.Query().Get("namespace"), since)
+		if err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, summary)
+	case http.MethodPost:
+		var report api.UsageReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid usage report: %w", err))
+			return
+		}
+		if err := c.RecordUsage(&report); err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		methodNotAllowed(w, r)
+	}
+}
+
+// handleUsageMetrics serves the totals of the usage ledger as Prometheus
+// metrics
+func (c *Coordinator) handleUsageMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, r)
+		return
+	}
+	if c.redirectToLeader(w, r) {
+		return
+	}
+
+	c.mu.RLock()
+	ledger, enabled := c.usage, c.usageMetrics
+	c.mu.RUnlock()
+	if ledger == nil || !enabled {
+		writeError(w, http.StatusNotFound, errors.New("usage metrics are not enabled"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := ledger.WritePrometheus(w); err != nil {
+		c.logger.Warn("failed to write usage metrics", "error", err)
+	}
+}
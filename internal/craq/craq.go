@@ -1,10 +1,16 @@
 package craq
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
 	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // NodeState represents the state of a node in the CRAQ chain
@@ -35,6 +41,27 @@ const (
 	NodeRoleMiddle
 )
 
+// String returns the name of the role
+func (r NodeRole) String() string {
+	switch r {
+	case NodeRoleHead:
+		return "head"
+	case NodeRoleTail:
+		return "tail"
+	case NodeRoleMiddle:
+		return "middle"
+	default:
+		return "unknown"
+	}
+}
+
+// NodeInfo is a snapshot of a chain member, safe to hand out to callers
+type NodeInfo struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+	Role    string `json:"role"`
+}
+
 // Node represents a node in the CRAQ chain
 type Node struct {
 	ID       string
@@ -69,11 +96,13 @@ type Chain struct {
 	head          *Node
 	tail          *Node
 	blocks        map[string]*Block
+	logger        *slog.Logger
+	pending       sync.WaitGroup
 	mu            sync.RWMutex
 }
 
 // NewChain creates a new CRAQ chain
-func NewChain(chainLength, replicaFactor int) (*Chain, error) {
+func NewChain(chainLength, replicaFactor int, logger *slog.Logger) (*Chain, error) {
 	if chainLength <= 0 {
 		return nil, errors.New("chain length must be greater than zero")
 	}
@@ -87,6 +116,7 @@ func NewChain(chainLength, replicaFactor int) (*Chain, error) {
 		replicaFactor: replicaFactor,
 		nodes:         make([]*Node, 0, chainLength),
 		blocks:        make(map[string]*Block),
+		logger:        logging.Component(logger, "craq"),
 	}, nil
 }
 
@@ -121,6 +151,7 @@ func (c *Chain) AddNode(id, address string) error {
 	}
 
 	c.nodes = append(c.nodes, node)
+	c.logger.Debug("added node to chain", "node", id, "address", address, "position", len(c.nodes)-1)
 	return nil
 }
 
@@ -138,7 +169,10 @@ func (c *Chain) Initialize() error {
 }
 
 // Write writes a block to the CRAQ chain
-func (c *Chain) Write(blockID string, data []byte, metadata []byte) error {
+func (c *Chain) Write(ctx context.Context, blockID string, data []byte, metadata []byte) (err error) {
+	ctx, span := tracing.Start(ctx, "craq.write", attribute.String("block.id", blockID))
+	defer func() { tracing.End(span, err) }()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -176,10 +210,17 @@ func (c *Chain) Write(blockID string, data []byte, metadata []byte) error {
 
 	// Add new version
 	block.Versions = append(block.Versions, version)
+	span.SetAttributes(attribute.Int("block.version", nextVersion))
 
 	// In a real implementation, we would propagate to all nodes in the chain
 	// For this mock implementation, we'll just mark it clean after a delay
+	_, commitSpan := tracing.Start(ctx, "craq.commit",
+		attribute.String("block.id", blockID),
+		attribute.Int("block.version", nextVersion))
+	c.pending.Add(1)
 	go func() {
+		defer c.pending.Done()
+		defer commitSpan.End()
 		time.Sleep(100 * time.Millisecond) // Simulate propagation delay
 		block.mu.Lock()
 		defer block.mu.Unlock()
@@ -189,13 +230,17 @@ func (c *Chain) Write(blockID string, data []byte, metadata []byte) error {
 				break
 			}
 		}
+		c.logger.Debug("block version committed", "block", blockID, "version", nextVersion)
 	}()
 
 	return nil
 }
 
 // Read reads a block from the CRAQ chain
-func (c *Chain) Read(blockID string) ([]byte, []byte, error) {
+func (c *Chain) Read(ctx context.Context, blockID string) ([]byte, []byte, error) {
+	_, span := tracing.Start(ctx, "craq.read", attribute.String("block.id", blockID))
+	defer span.End()
+
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
@@ -229,7 +274,10 @@ func (c *Chain) Read(blockID string) ([]byte, []byte, error) {
 }
 
 // Delete deletes a block from the CRAQ chain
-func (c *Chain) Delete(blockID string) error {
+func (c *Chain) Delete(ctx context.Context, blockID string) error {
+	_, span := tracing.Start(ctx, "craq.delete", attribute.String("block.id", blockID))
+	defer span.End()
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -238,40 +286,61 @@ func (c *Chain) Delete(blockID string) error {
 	}
 
 	delete(c.blocks, blockID)
+	c.logger.Debug("deleted block from chain", "block", blockID)
 
 	// In a real implementation, we would propagate the delete to all nodes
 	return nil
 }
 
+// ChainStats reports the size of the CRAQ chain and the versions it
+// tracks. DirtyVersions are written but not yet committed by the tail, and
+// OldestDirtyNanos is how long the oldest of them has waited, which is how
+// far commits lag behind writes.
+type ChainStats struct {
+	NodeCount        int   `json:"node_count"`
+	BlockCount       int   `json:"block_count"`
+	TotalVersions    int   `json:"total_versions"`
+	DirtyVersions    int   `json:"dirty_versions"`
+	OldestDirtyNanos int64 `json:"oldest_dirty_ns"`
+}
+
 // GetStats returns statistics about the CRAQ chain
-func (c *Chain) GetStats() (map[string]interface{}, error) {
+func (c *Chain) GetStats() *ChainStats {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	stats := make(map[string]interface{})
-	stats["node_count"] = len(c.nodes)
-	stats["block_count"] = len(c.blocks)
-
-	var totalVersions int
+	stats := &ChainStats{
+		NodeCount:  len(c.nodes),
+		BlockCount: len(c.blocks),
+	}
+	now := time.Now().UnixNano()
 	for _, block := range c.blocks {
 		block.mu.RLock()
-		totalVersions += len(block.Versions)
+		stats.TotalVersions += len(block.Versions)
+		for _, v := range block.Versions {
+			if v.Clean {
+				continue
+			}
+			stats.DirtyVersions++
+			if age := now - v.Timestamp; age > stats.OldestDirtyNanos {
+				stats.OldestDirtyNanos = age
+			}
+		}
 		block.mu.RUnlock()
 	}
-	stats["total_versions"] = totalVersions
 
-	return stats, nil
+	return stats
 }
 
 // IsHeadNode returns true if the node with the given ID is the head node
 func (c *Chain) IsHeadNode(nodeID string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	
+
 	if c.head == nil {
 		return false
 	}
-	
+
 	return c.head.ID == nodeID
 }
 
@@ -279,11 +348,11 @@ func (c *Chain) IsHeadNode(nodeID string) bool {
 func (c *Chain) IsTailNode(nodeID string) bool {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	
+
 	if c.tail == nil {
 		return false
 	}
-	
+
 	return c.tail.ID == nodeID
 }
 
@@ -291,6 +360,43 @@ func (c *Chain) IsTailNode(nodeID string) bool {
 func (c *Chain) GetNodeCount() int {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
-	
+
 	return len(c.nodes)
-} 
\ No newline at end of file
+}
+
+// GetNodes returns the chain members in order from head to tail. A single
+// node chain reports its only member as the head.
+func (c *Chain) GetNodes() []NodeInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	nodes := make([]NodeInfo, 0, len(c.nodes))
+	for _, node := range c.nodes {
+		role := NodeRoleMiddle
+		if node.IsHead {
+			role = NodeRoleHead
+		} else if node.IsTail {
+			role = NodeRoleTail
+		}
+		nodes = append(nodes, NodeInfo{ID: node.ID, Address: node.Address, Role: role.String()})
+	}
+
+	return nodes
+}
+
+// WaitForCommits waits until every write issued so far has been
+// acknowledged by the chain, or until ctx expires
+func (c *Chain) WaitForCommits(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		c.pending.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("timed out waiting for chain commits: %w", ctx.Err())
+	}
+}
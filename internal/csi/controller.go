@@ -0,0 +1,203 @@
+package csi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strconv"
+
+	csipb "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// capacityKey is the metadata of a volume's marker holding the capacity
+// it was created with. Capacity is recorded for the orchestrator; the
+// store does not enforce it.
+const capacityKey = "csi-capacity"
+
+// controllerServer creates and deletes volumes
+type controllerServer struct {
+	*Driver
+	csipb.UnimplementedControllerServer
+}
+
+// ControllerGetCapabilities reports that volumes are created and deleted
+// by the driver, and need no attaching to nodes
+func (s controllerServer) ControllerGetCapabilities(context.Context, *csipb.ControllerGetCapabilitiesRequest) (*csipb.ControllerGetCapabilitiesResponse, error) {
+	return &csipb.ControllerGetCapabilitiesResponse{
+		Capabilities: []*csipb.ControllerServiceCapability{{
+			Type: &csipb.ControllerServiceCapability_Rpc{
+				Rpc: &csipb.ControllerServiceCapability_RPC{
+					Type: csipb.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+				},
+			},
+		}},
+	}, nil
+}
+
+// CreateVolume creates a volume as the marker of a directory named after
+// the volume in the storage class's namespace. Creating a volume again
+// with the same capacity succeeds, as the orchestrator retries.
+func (s controllerServer) CreateVolume(ctx context.Context, req *csipb.CreateVolumeRequest) (*csipb.CreateVolumeResponse, error) {
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "the volume name cannot be empty")
+	}
+	if err := checkCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return nil, err
+	}
+	namespace := req.GetParameters()["namespace"]
+	if err := checkNamespace(namespace); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid namespace parameter: %v", err)
+	}
+	v := volume{namespace: namespace, path: req.GetName()}
+	capacity := req.GetCapacityRange().GetRequiredBytes()
+
+	c, err := s.dial(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer c.Close()
+	objects, err := store(c, namespace)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	manifest, err := objects.HeadObject(ctx, v.marker())
+	switch {
+	case err == nil:
+		if manifest.Metadata[capacityKey] != strconv.FormatInt(capacity, 10) {
+			return nil, status.Errorf(codes.AlreadyExists, "volume %s exists with another capacity", v.id())
+		}
+	case errors.Is(err, block.ErrBlockNotFound):
+		attrs := block.ObjectAttributes{Metadata: map[string]string{capacityKey: strconv.FormatInt(capacity, 10)}}
+		if _, err := objects.PutObject(ctx, v.marker(), bytes.NewReader(nil), attrs); err != nil {
+			return nil, toStatus(err)
+		}
+		s.logger.Info("volume created", "volume", v.id(), "capacity", capacity)
+	default:
+		return nil, toStatus(err)
+	}
+
+	return &csipb.CreateVolumeResponse{
+		Volume: &csipb.Volume{
+			VolumeId:      v.id(),
+			CapacityBytes: capacity,
+			VolumeContext: map[string]string{"namespace": namespace},
+		},
+	}, nil
+}
+
+// DeleteVolume deletes a volume's directory and every file under it.
+// Deleting a volume that does not exist succeeds.
+func (s controllerServer) DeleteVolume(ctx context.Context, req *csipb.DeleteVolumeRequest) (*csipb.DeleteVolumeResponse, error) {
+	v, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		// A volume this driver could not have created does not exist
+		return &csipb.DeleteVolumeResponse{}, nil
+	}
+
+	c, err := s.dial(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer c.Close()
+	objects, err := store(c, v.namespace)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	names, err := objects.ListObjects(ctx, v.marker())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	// The marker sorts first; deleting it last keeps the volume listed
+	// until its files are gone, so that a failed deletion is retried
+	for i := len(names) - 1; i >= 0; i-- {
+		if err := objects.DeleteObject(ctx, names[i]); err != nil && !errors.Is(err, block.ErrBlockNotFound) {
+			return nil, toStatus(err)
+		}
+	}
+	s.logger.Info("volume deleted", "volume", v.id(), "objects", len(names))
+	return &csipb.DeleteVolumeResponse{}, nil
+}
+
+// ValidateVolumeCapabilities confirms the capabilities the driver supports
+// for an existing volume
+func (s controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csipb.ValidateVolumeCapabilitiesRequest) (*csipb.ValidateVolumeCapabilitiesResponse, error) {
+	v, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no volume capabilities given")
+	}
+
+	c, err := s.dial(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	defer c.Close()
+	objects, err := store(c, v.namespace)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if _, err := objects.HeadObject(ctx, v.marker()); err != nil {
+		return nil, toStatus(err)
+	}
+
+	if err := checkCapabilities(req.GetVolumeCapabilities()); err != nil {
+		return &csipb.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+	return &csipb.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csipb.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// checkCapabilities refuses capabilities the driver does not support.
+// Volumes are filesystems that any number of nodes can mount, as files
+// are objects shared through the store; they cannot be raw block devices.
+func checkCapabilities(caps []*csipb.VolumeCapability) error {
+	if len(caps) == 0 {
+		return status.Error(codes.InvalidArgument, "no volume capabilities given")
+	}
+	for _, c := range caps {
+		if c.GetBlock() != nil {
+			return status.Error(codes.InvalidArgument, "block volumes are not supported")
+		}
+		if c.GetMount() == nil {
+			return status.Error(codes.InvalidArgument, "a volume capability needs an access type")
+		}
+		if fsType := c.GetMount().GetFsType(); fsType != "" && fsType != "fuse.3fs" {
+			return status.Errorf(codes.InvalidArgument, "unsupported filesystem type %q", fsType)
+		}
+		if c.GetAccessMode().GetMode() == csipb.VolumeCapability_AccessMode_UNKNOWN {
+			return status.Error(codes.InvalidArgument, "a volume capability needs an access mode")
+		}
+	}
+	return nil
+}
+
+// toStatus returns the gRPC status of an error of the store
+func toStatus(err error) error {
+	switch {
+	case errors.Is(err, block.ErrBlockNotFound):
+		return status.Error(codes.NotFound, err.Error())
+	case errors.Is(err, api.ErrForbidden):
+		return status.Error(codes.PermissionDenied, err.Error())
+	case errors.Is(err, api.ErrUnauthenticated):
+		return status.Error(codes.Unauthenticated, err.Error())
+	case errors.Is(err, api.ErrThrottled), errors.Is(err, api.ErrReadOnly):
+		return status.Error(codes.Unavailable, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
@@ -0,0 +1,205 @@
+// Package csi is a Container Storage Interface driver, so that Kubernetes
+// workloads can use the store through persistent volume claims. A volume
+// is a directory of a block namespace, named by the storage class's
+// namespace parameter, and is mounted into pods through the FUSE client:
+// pods see the volume's objects as files, as a mount command would show
+// them.
+//
+// The driver runs the controller and node services in one process. The
+// filesystems it mounts are served by that process, so restarting the
+// driver on a node breaks the mounts of the pods running there until they
+// are restarted.
+package csi
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+
+	csipb "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/fusefs"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// DefaultName is the driver's name, which storage classes give as their
+// provisioner
+const DefaultName = "csi.3fs-storage"
+
+// Options configures the driver
+type Options struct {
+	// Name is the name the driver registers under
+	Name string
+	// NodeID identifies the node the driver runs on; empty runs only the
+	// controller service
+	NodeID string
+	// Address is the data address of the storage node holding the volumes
+	Address string
+	// Client configures the connections to the node. A token in the
+	// secrets of a request replaces Client.Token.
+	Client client.Options
+	// StagingDir is where the files being written are staged; empty uses
+	// the system's temporary directory
+	StagingDir string
+}
+
+// Driver serves the CSI identity, controller and node services
+type Driver struct {
+	opts   Options
+	logger *slog.Logger
+	mu     sync.Mutex
+	// mounts are the filesystems served for pods, by target path
+	mounts map[string]*fusefs.Mount
+}
+
+// New creates a driver
+func New(opts Options, logger *slog.Logger) (*Driver, error) {
+	if opts.Address == "" {
+		return nil, errors.New("the storage node address cannot be empty")
+	}
+	if opts.Name == "" {
+		opts.Name = DefaultName
+	}
+	return &Driver{
+		opts:   opts,
+		logger: logging.Component(logger, "csi"),
+		mounts: make(map[string]*fusefs.Mount),
+	}, nil
+}
+
+// Serve serves the driver's services on an endpoint, a unix:// socket or
+// tcp:// address as the container orchestrator passes it, until the
+// context ends. The mounts still served are then unmounted.
+func (d *Driver) Serve(ctx context.Context, endpoint string) error {
+	network, address, err := parseEndpoint(endpoint)
+	if err != nil {
+		return err
+	}
+	if network == "unix" {
+		if err := os.Remove(address); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove stale socket %s: %w", address, err)
+		}
+	}
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", endpoint, err)
+	}
+
+	server := grpc.NewServer(grpc.UnaryInterceptor(d.logCalls))
+	csipb.RegisterIdentityServer(server, identityServer{Driver: d})
+	csipb.RegisterControllerServer(server, controllerServer{Driver: d})
+	if d.opts.NodeID != "" {
+		csipb.RegisterNodeServer(server, nodeServer{Driver: d})
+	}
+	go func() {
+		<-ctx.Done()
+		server.GracefulStop()
+	}()
+
+	d.logger.Info("CSI driver listening", "endpoint", endpoint, "name", d.opts.Name, "node", d.opts.NodeID)
+	err = server.Serve(listener)
+	d.unmountAll()
+	if err != nil {
+		return fmt.Errorf("failed to serve %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// parseEndpoint splits an endpoint into the network and address to listen
+// on
+func parseEndpoint(endpoint string) (string, string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid endpoint %q: %w", endpoint, err)
+	}
+	switch u.Scheme {
+	case "unix":
+		p := u.Path
+		if p == "" {
+			p = u.Host
+		}
+		return "unix", p, nil
+	case "tcp":
+		return "tcp", u.Host, nil
+	}
+	return "", "", fmt.Errorf("invalid endpoint %q: the scheme must be unix or tcp", endpoint)
+}
+
+// logCalls logs the calls the orchestrator makes and the errors they fail
+// with
+func (d *Driver) logCalls(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	d.logger.Debug("CSI call", "method", info.FullMethod)
+	resp, err := handler(ctx, req)
+	if err != nil {
+		d.logger.Warn("CSI call failed", "method", info.FullMethod, "error", err)
+	}
+	return resp, err
+}
+
+// dial connects to the storage node with the token in a request's secrets,
+// if it has one
+func (d *Driver) dial(secrets map[string]string) (*client.Client, error) {
+	opts := d.opts.Client
+	if token, ok := secrets["token"]; ok {
+		opts.Token = token
+	}
+	return client.DialWithOptions(d.opts.Address, opts)
+}
+
+// store returns the object store of a namespace over a client connection
+func store(c *client.Client, namespace string) (*block.ObjectStore, error) {
+	return block.NewNamespacedObjectStore(block.NewClientBlocks(c), 0, namespace)
+}
+
+// volume is a directory of a namespace given to a claim. Its ID is the
+// namespace and the directory's path joined by a '/'.
+type volume struct {
+	namespace string
+	path      string
+}
+
+// parseVolumeID returns the volume a volume ID names
+func parseVolumeID(id string) (volume, error) {
+	namespace, p, ok := strings.Cut(id, "/")
+	if !ok || p == "" {
+		return volume{}, fmt.Errorf("invalid volume ID %q", id)
+	}
+	if err := checkNamespace(namespace); err != nil {
+		return volume{}, fmt.Errorf("invalid volume ID %q: %w", id, err)
+	}
+	return volume{namespace: namespace, path: p}, nil
+}
+
+// checkNamespace checks that a namespace can hold volumes
+func checkNamespace(namespace string) error {
+	if namespace == "" || strings.Contains(namespace, api.NamespaceSeparator) {
+		return errors.New("the namespace cannot be empty or hold a separator")
+	}
+	return api.ValidateBlockID(namespace + api.NamespaceSeparator)
+}
+
+// id returns the volume's ID
+func (v volume) id() string {
+	return v.namespace + "/" + v.path
+}
+
+// marker returns the name of the volume's directory marker, which keeps
+// the volume while it is empty and records its capacity
+func (v volume) marker() string {
+	return block.EscapeName(v.path + "/")
+}
+
+// source names the volume in the mount table
+func (d *Driver) source(v volume) string {
+	return d.opts.Address + "/" + v.id()
+}
@@ -0,0 +1,44 @@
+package csi
+
+import (
+	"context"
+
+	csipb "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+
+	"github.com/3fs-storage/internal/version"
+)
+
+// identityServer tells the orchestrator what the driver is
+type identityServer struct {
+	*Driver
+	csipb.UnimplementedIdentityServer
+}
+
+// GetPluginInfo returns the driver's name and version
+func (s identityServer) GetPluginInfo(context.Context, *csipb.GetPluginInfoRequest) (*csipb.GetPluginInfoResponse, error) {
+	return &csipb.GetPluginInfoResponse{Name: s.opts.Name, VendorVersion: version.Version}, nil
+}
+
+// GetPluginCapabilities reports the controller service. Every node reaches
+// the same store, so volumes are accessible from all of them.
+func (s identityServer) GetPluginCapabilities(context.Context, *csipb.GetPluginCapabilitiesRequest) (*csipb.GetPluginCapabilitiesResponse, error) {
+	return &csipb.GetPluginCapabilitiesResponse{
+		Capabilities: []*csipb.PluginCapability{{
+			Type: &csipb.PluginCapability_Service_{
+				Service: &csipb.PluginCapability_Service{Type: csipb.PluginCapability_Service_CONTROLLER_SERVICE},
+			},
+		}},
+	}, nil
+}
+
+// Probe reports the driver ready once it can reach the storage node
+func (s identityServer) Probe(context.Context, *csipb.ProbeRequest) (*csipb.ProbeResponse, error) {
+	c, err := s.dial(nil)
+	if err != nil {
+		s.logger.Warn("storage node unreachable", "address", s.opts.Address, "error", err)
+		return &csipb.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
+	}
+	c.Close()
+	return &csipb.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+}
@@ -0,0 +1,150 @@
+package csi
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	csipb "github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/3fs-storage/internal/fusefs"
+)
+
+// nodeServer mounts volumes into pods on the driver's node
+type nodeServer struct {
+	*Driver
+	csipb.UnimplementedNodeServer
+}
+
+// NodeGetInfo returns the node's ID
+func (s nodeServer) NodeGetInfo(context.Context, *csipb.NodeGetInfoRequest) (*csipb.NodeGetInfoResponse, error) {
+	return &csipb.NodeGetInfoResponse{NodeId: s.opts.NodeID}, nil
+}
+
+// NodeGetCapabilities reports no optional capabilities: volumes are
+// mounted straight into each pod, without staging
+func (s nodeServer) NodeGetCapabilities(context.Context, *csipb.NodeGetCapabilitiesRequest) (*csipb.NodeGetCapabilitiesResponse, error) {
+	return &csipb.NodeGetCapabilitiesResponse{}, nil
+}
+
+// NodePublishVolume mounts a volume's directory on a pod's target path
+// through FUSE. Publishing a volume already mounted there succeeds.
+func (s nodeServer) NodePublishVolume(ctx context.Context, req *csipb.NodePublishVolumeRequest) (*csipb.NodePublishVolumeResponse, error) {
+	v, err := parseVolumeID(req.GetVolumeId())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	target := req.GetTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "the target path cannot be empty")
+	}
+	if err := checkCapabilities([]*csipb.VolumeCapability{req.GetVolumeCapability()}); err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.mounts[target]; ok {
+		return &csipb.NodePublishVolumeResponse{}, nil
+	}
+	if err := os.MkdirAll(target, 0o750); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to create target path: %v", err)
+	}
+
+	c, err := s.dial(req.GetSecrets())
+	if err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	objects, err := store(c, v.namespace)
+	if err != nil {
+		c.Close()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if _, err := objects.HeadObject(ctx, v.marker()); err != nil {
+		c.Close()
+		return nil, toStatus(err)
+	}
+	readOnly := req.GetReadonly() ||
+		req.GetVolumeCapability().GetAccessMode().GetMode() == csipb.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY ||
+		req.GetVolumeCapability().GetAccessMode().GetMode() == csipb.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY
+	filesystem := fusefs.New(objects, fusefs.Options{
+		ReadOnly: readOnly,
+		// Pods run as users other than the driver's
+		AllowOther: true,
+		TempDir:    s.opts.StagingDir,
+		Subdir:     v.path,
+	}, s.logger)
+	m, err := filesystem.Mount(target, s.source(v))
+	if err != nil {
+		c.Close()
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.mounts[target] = m
+
+	// The connection serves the mount until it is unmounted, whether by
+	// NodeUnpublishVolume or by the system
+	go func() {
+		if err := m.Wait(); err != nil {
+			s.logger.Error("volume mount failed", "volume", v.id(), "target", target, "error", err)
+		}
+		c.Close()
+		s.mu.Lock()
+		if s.mounts[target] == m {
+			delete(s.mounts, target)
+		}
+		s.mu.Unlock()
+	}()
+	s.logger.Info("volume published", "volume", v.id(), "target", target, "read_only", readOnly)
+	return &csipb.NodePublishVolumeResponse{}, nil
+}
+
+// NodeUnpublishVolume unmounts a volume from a pod's target path and
+// removes the path. Unpublishing a volume that is not mounted succeeds.
+func (s nodeServer) NodeUnpublishVolume(_ context.Context, req *csipb.NodeUnpublishVolumeRequest) (*csipb.NodeUnpublishVolumeResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "the volume ID cannot be empty")
+	}
+	target := req.GetTargetPath()
+	if target == "" {
+		return nil, status.Error(codes.InvalidArgument, "the target path cannot be empty")
+	}
+
+	s.mu.Lock()
+	m, ok := s.mounts[target]
+	s.mu.Unlock()
+	if ok {
+		if err := m.Unmount(); err != nil {
+			return nil, status.Errorf(codes.Internal, "failed to unmount %s: %v", target, err)
+		}
+		if err := m.Wait(); err != nil {
+			s.logger.Warn("volume mount failed", "volume", req.GetVolumeId(), "target", target, "error", err)
+		}
+	} else {
+		// A mount left by a previous run of the driver is no longer
+		// served, and only needs removing from the mount table
+		_ = fusefs.Unmount(target)
+	}
+
+	if err := os.Remove(target); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.Internal, "failed to remove target path: %v", err)
+	}
+	s.logger.Info("volume unpublished", "volume", req.GetVolumeId(), "target", target)
+	return &csipb.NodeUnpublishVolumeResponse{}, nil
+}
+
+// unmountAll unmounts the volumes still served when the driver stops
+func (d *Driver) unmountAll() {
+	d.mu.Lock()
+	mounts := make(map[string]*fusefs.Mount, len(d.mounts))
+	for target, m := range d.mounts {
+		mounts[target] = m
+	}
+	d.mu.Unlock()
+	for target, m := range mounts {
+		if err := m.Unmount(); err != nil {
+			d.logger.Error("failed to unmount volume", "target", target, "error", err)
+		}
+	}
+}
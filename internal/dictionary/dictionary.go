@@ -0,0 +1,228 @@
+// Package dictionary trains zstd dictionaries from sample blocks. Many small
+// blocks of the same kind compress poorly one at a time, since each starts
+// without any history; a dictionary built from what they have in common
+// gives every block that history.
+//
+// Training picks the segments of the samples whose d-mers occur in the most
+// samples, greedily and without counting a d-mer twice, after the cover
+// algorithm of the zstd reference library, and builds the dictionary's
+// entropy tables from the samples compressed with those segments.
+package dictionary
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// DefaultSize is the size of a dictionary, as the zstd tools default to
+	DefaultSize = 112 << 10
+	// MinSamples is the fewest samples a dictionary is trained from
+	MinSamples = 8
+
+	// segmentSize is the length of the sample segments a dictionary is
+	// made of
+	segmentSize = 256
+	// dmerSize is the length of the substrings whose frequency scores a
+	// segment
+	dmerSize = 8
+	// countBits sizes the table counting the samples each d-mer hashes into
+	countBits = 20
+
+	// minID and maxID bound the IDs zstd leaves to private dictionaries
+	minID = 1 << 15
+	maxID = 1<<31 - 1
+)
+
+// ErrTooFewSamples is returned when the samples are too few or too small
+// to train a dictionary from
+var ErrTooFewSamples = errors.New("too few samples to train a dictionary")
+
+// Train returns a zstd dictionary of at most size bytes trained from
+// samples, and its ID, which compressed frames record
+func Train(samples [][]byte, size int) ([]byte, uint32, error) {
+	if size <= 0 {
+		size = DefaultSize
+	}
+	usable := make([][]byte, 0, len(samples))
+	for _, sample := range samples {
+		if len(sample) >= dmerSize {
+			usable = append(usable, sample)
+		}
+	}
+	if len(usable) < MinSamples {
+		return nil, 0, ErrTooFewSamples
+	}
+
+	history := selectSegments(usable, size)
+	if len(history) < dmerSize {
+		return nil, 0, ErrTooFewSamples
+	}
+	id := dictionaryID(history)
+	dict, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: usable,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to build dictionary: %w", err)
+	}
+	return dict, id, nil
+}
+
+// dictionaryID derives an ID in the private range from a dictionary's
+// content, so that training the same content gives the same ID
+func dictionaryID(history []byte) uint32 {
+	sum := sha256.Sum256(history)
+	return minID + binary.BigEndian.Uint32(sum[:4])%(maxID-minID+1)
+}
+
+// segment is a candidate range of a sample, scored by the d-mers in it
+// not yet covered by the segments picked
+type segment struct {
+	sample int
+	start  int
+	end    int
+	score  int
+}
+
+// segmentHeap orders segments by score, best first
+type segmentHeap []segment
+
+func (h segmentHeap) Len() int { return len(h) }
+func (h segmentHeap) Less(i, j int) bool {
+	if h[i].score != h[j].score {
+		return h[i].score > h[j].score
+	}
+	if h[i].sample != h[j].sample {
+		return h[i].sample < h[j].sample
+	}
+	return h[i].start < h[j].start
+}
+func (h segmentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x interface{}) { *h = append(*h, x.(segment)) }
+func (h *segmentHeap) Pop() interface{} {
+	old := *h
+	s := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return s
+}
+
+// trainer scores sample segments by the counts of their d-mers
+type trainer struct {
+	samples [][]byte
+	// counts holds the number of samples each d-mer hash occurs in
+	counts []uint32
+	// marks dedupes a segment's d-mers while it is scored, by epoch
+	marks []uint32
+	epoch uint32
+}
+
+// selectSegments returns the dictionary content: the segments of the
+// samples covering the most frequent d-mers, up to size bytes, the best
+// last, where zstd finds the closest and cheapest matches
+func selectSegments(samples [][]byte, size int) []byte {
+	t := &trainer{
+		samples: samples,
+		counts:  make([]uint32, 1<<countBits),
+		marks:   make([]uint32, 1<<countBits),
+	}
+	t.countDmers()
+
+	h := make(segmentHeap, 0)
+	for i, sample := range samples {
+		for start := 0; start+dmerSize <= len(sample); start += segmentSize / 2 {
+			end := start + segmentSize
+			if end > len(sample) {
+				end = len(sample)
+			}
+			if s := (segment{sample: i, start: start, end: end}); t.score(&s) > 0 {
+				h = append(h, s)
+			}
+		}
+	}
+	heap.Init(&h)
+
+	// Greedily pick the best segment, rescoring it first since the
+	// segments picked before may have covered some of its d-mers
+	picked := make([]segment, 0)
+	total := 0
+	for h.Len() > 0 && total < size {
+		best := heap.Pop(&h).(segment)
+		if t.score(&best) == 0 {
+			continue
+		}
+		if h.Len() > 0 && best.score < h[0].score {
+			heap.Push(&h, best)
+			continue
+		}
+		if room := size - total; best.end-best.start > room {
+			best.end = best.start + room
+		}
+		picked = append(picked, best)
+		total += best.end - best.start
+		t.cover(best)
+	}
+
+	history := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		s := picked[i]
+		history = append(history, samples[s.sample][s.start:s.end]...)
+	}
+	return history
+}
+
+// countDmers counts the samples each d-mer occurs in, by hash
+func (t *trainer) countDmers() {
+	for _, sample := range t.samples {
+		t.epoch++
+		for j := 0; j+dmerSize <= len(sample); j++ {
+			k := dmerHash(sample[j:])
+			if t.marks[k] != t.epoch {
+				t.marks[k] = t.epoch
+				t.counts[k]++
+			}
+		}
+	}
+}
+
+// score sets a segment's score to the sum of the counts of its distinct
+// d-mers, leaving out those seen in a single sample, and returns it
+func (t *trainer) score(s *segment) int {
+	data := t.samples[s.sample][s.start:s.end]
+	t.epoch++
+	s.score = 0
+	for j := 0; j+dmerSize <= len(data); j++ {
+		k := dmerHash(data[j:])
+		if t.marks[k] == t.epoch {
+			continue
+		}
+		t.marks[k] = t.epoch
+		if c := t.counts[k]; c > 1 {
+			s.score += int(c)
+		}
+	}
+	return s.score
+}
+
+// cover clears the counts of a picked segment's d-mers, so that the same
+// content is not picked twice
+func (t *trainer) cover(s segment) {
+	data := t.samples[s.sample][s.start:s.end]
+	for j := 0; j+dmerSize <= len(data); j++ {
+		t.counts[dmerHash(data[j:])] = 0
+	}
+}
+
+// dmerHash hashes the d-mer at the start of b into the count table
+func dmerHash(b []byte) uint32 {
+	const prime = 0xcf1bbcdcb7a56463
+	return uint32((binary.LittleEndian.Uint64(b) * prime) >> (64 - countBits))
+}
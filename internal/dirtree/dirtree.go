@@ -0,0 +1,277 @@
+// Package dirtree stores a local directory tree in the cluster and
+// rebuilds it, so that a tree of files can be moved as one. Files are
+// uploaded in parallel, as streams or as objects of a namespace, and a
+// manifest, itself a stream, maps each file's path to what holds it along
+// with its size, mode, modification time and checksum. An upload records
+// the files it stored in a progress file, and a download skips the files
+// already in place, so that either resumes where it stopped.
+package dirtree
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// ManifestFormat identifies a tree's manifest, telling it from other
+// streams
+const ManifestFormat = "3fs-dir/1"
+
+// emptyChecksum is the SHA-256 of no data, that of empty files, which
+// are not stored
+const emptyChecksum = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// DefaultWorkers is the number of files transferred at the same time
+const DefaultWorkers = 8
+
+// File is a regular file of a tree. ID is the stream holding its data,
+// or its object's name in the manifest's namespace; empty files outside a
+// namespace have none. Path is relative to
+// the root of the tree, with '/' separating directories.
+type File struct {
+	Path     string      `json:"path"`
+	ID       string      `json:"id"`
+	Size     int64       `json:"size"`
+	Mode     os.FileMode `json:"mode"`
+	ModTime  int64       `json:"mod_time"`
+	Checksum string      `json:"checksum"`
+}
+
+// Dir is a directory of a tree, kept so that empty directories and the
+// modes of all are restored
+type Dir struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+}
+
+// Manifest describes a stored tree
+type Manifest struct {
+	Format string `json:"format"`
+	// Namespace is set when the files are objects of a namespace
+	Namespace string `json:"namespace,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	Size      int64  `json:"size"`
+	Dirs      []Dir  `json:"dirs"`
+	Files     []File `json:"files"`
+}
+
+// Result counts the files of a transfer
+type Result struct {
+	Transferred int64 `json:"transferred"`
+	Skipped     int64 `json:"skipped"`
+	Failed      int64 `json:"failed"`
+	Bytes       int64 `json:"bytes"`
+}
+
+// Dial opens a connection for a worker
+type Dial func() (*client.Client, error)
+
+// fileStreamID returns the name of the stream holding a file of the tree
+// whose manifest is manifestID. Hashing the path keeps the name a valid
+// block ID whatever the path, and the same across runs, so that a file
+// uploaded again replaces its previous stream.
+func fileStreamID(manifestID, path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return manifestID + ".f" + hex.EncodeToString(sum[:8])
+}
+
+// store is where a tree's files are kept: streams, or objects of a
+// namespace
+type store struct {
+	c       *client.Client
+	objects *block.ObjectStore
+}
+
+// newStore creates the store of a worker's connection
+func newStore(c *client.Client, namespace string) (*store, error) {
+	s := &store{c: c}
+	if namespace != "" {
+		objects, err := block.NewNamespacedObjectStore(block.NewClientBlocks(c), 0, namespace)
+		if err != nil {
+			return nil, err
+		}
+		s.objects = objects
+	}
+	return s, nil
+}
+
+// put stores a file's data read from r under its ID, returning its size
+// and SHA-256
+func (s *store) put(ctx context.Context, file File, r io.Reader, chunkSize int) (int64, string, error) {
+	digest := sha256.New()
+	r = io.TeeReader(r, digest)
+	var size int64
+	if s.objects != nil {
+		manifest, err := s.objects.PutObject(ctx, file.ID, r, block.ObjectAttributes{})
+		if err != nil {
+			return 0, "", err
+		}
+		size = manifest.Size
+	} else {
+		w, err := s.c.PutStream(ctx, file.ID, chunkSize)
+		if err != nil {
+			return 0, "", err
+		}
+		if size, err = w.ReadFrom(r); err == nil {
+			err = w.Close()
+		}
+		if err != nil {
+			w.Abort()
+			return 0, "", err
+		}
+	}
+	return size, hex.EncodeToString(digest.Sum(nil)), nil
+}
+
+// get writes a file's data to w, checking it against the file's checksum
+func (s *store) get(ctx context.Context, file File, w io.Writer) error {
+	digest := sha256.New()
+	w = io.MultiWriter(w, digest)
+	if s.objects != nil {
+		if _, err := s.objects.GetObject(ctx, file.ID, w); err != nil {
+			return err
+		}
+	} else {
+		r, err := s.c.GetStream(ctx, file.ID, 0)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		if _, err := io.Copy(w, r); err != nil {
+			return err
+		}
+	}
+	if sum := hex.EncodeToString(digest.Sum(nil)); sum != file.Checksum {
+		return fmt.Errorf("checksum %s, the manifest records %s", sum, file.Checksum)
+	}
+	return nil
+}
+
+// writeManifest stores a manifest as the stream named id
+func writeManifest(ctx context.Context, c *client.Client, id string, manifest *Manifest) error {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	w, err := c.PutStream(ctx, id, 0)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err == nil {
+		err = w.Close()
+	}
+	if err != nil {
+		w.Abort()
+		return fmt.Errorf("failed to write manifest %s: %w", id, err)
+	}
+	return nil
+}
+
+// ReadManifest reads the manifest of a stored tree
+func ReadManifest(ctx context.Context, c *client.Client, id string) (*Manifest, error) {
+	r, err := c.GetStream(ctx, id, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest %s: %w", id, err)
+	}
+	defer r.Close()
+	var manifest Manifest
+	if err := json.NewDecoder(r).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode manifest %s: %w", id, err)
+	}
+	if manifest.Format != ManifestFormat {
+		return nil, fmt.Errorf("%s is not a directory manifest", id)
+	}
+	return &manifest, nil
+}
+
+// validateManifestID checks that a manifest ID leaves room for the names
+// of the streams under it
+func validateManifestID(id string) error {
+	if err := api.ValidateBlockID(fileStreamID(id, "") + ".0123456789abcdef.00000000"); err != nil {
+		return fmt.Errorf("invalid manifest ID %q: %w", id, err)
+	}
+	return nil
+}
+
+// journal records the files an upload stored, one JSON line each, so
+// that an interrupted upload resumes with the files it had not stored
+type journal struct {
+	file *os.File
+	mu   sync.Mutex
+	done map[string]File
+}
+
+// openJournal opens a progress file, creating it if it does not exist
+func openJournal(path string) (*journal, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open progress file: %w", err)
+	}
+	j := &journal{file: f, done: make(map[string]File)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var file File
+		// A line torn by a crash is ignored, and its file stored again
+		if err := json.Unmarshal(scanner.Bytes(), &file); err != nil {
+			continue
+		}
+		j.done[file.Path] = file
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read progress file: %w", err)
+	}
+	return j, nil
+}
+
+// lookup returns the record of a file stored unchanged since
+func (j *journal) lookup(file File) (File, bool) {
+	if j == nil {
+		return File{}, false
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	done, ok := j.done[file.Path]
+	if !ok || done.ID != file.ID || done.Size != file.Size || done.ModTime != file.ModTime {
+		return File{}, false
+	}
+	return done, true
+}
+
+// record records a stored file
+func (j *journal) record(file File) error {
+	if j == nil {
+		return nil
+	}
+	line, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to record progress: %w", err)
+	}
+	j.done[file.Path] = file
+	return nil
+}
+
+// close closes the progress file
+func (j *journal) close() error {
+	if j == nil {
+		return nil
+	}
+	return j.file.Close()
+}
@@ -0,0 +1,174 @@
+package dirtree
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// partSuffix is appended to the name of a file being downloaded, which is
+// renamed into place once complete
+const partSuffix = ".3fs-part"
+
+// GetOptions configures a download
+type GetOptions struct {
+	// Workers is the number of files downloaded at the same time, each
+	// over its own connection
+	Workers int
+}
+
+// Get rebuilds the tree whose manifest is the stream manifestID under
+// dest, creating it if needed. Files already there with the size and
+// modification time of the manifest's are skipped, so that a download
+// run again resumes. A file that fails to download is logged and counted,
+// and the others are still downloaded. Ending ctx stops the download once
+// the files being downloaded are.
+func Get(ctx context.Context, manifestID, dest string, dial Dial, opts GetOptions, logger *slog.Logger) (*Manifest, *Result, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	c, err := dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	manifest, err := ReadManifest(ctx, c, manifestID)
+	c.Close()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, dir := range manifest.Dirs {
+		if !filepath.IsLocal(filepath.FromSlash(dir.Path)) {
+			return nil, nil, fmt.Errorf("manifest %s holds the unsafe path %q", manifestID, dir.Path)
+		}
+	}
+	for _, file := range manifest.Files {
+		if !filepath.IsLocal(filepath.FromSlash(file.Path)) {
+			return nil, nil, fmt.Errorf("manifest %s holds the unsafe path %q", manifestID, file.Path)
+		}
+	}
+
+	// Directories are writable until the files are in, and get their
+	// modes last
+	if err := os.MkdirAll(dest, 0o755); err != nil {
+		return nil, nil, err
+	}
+	for _, dir := range manifest.Dirs {
+		if err := os.MkdirAll(filepath.Join(dest, filepath.FromSlash(dir.Path)), 0o755); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var result Result
+	downloadCtx := context.WithoutCancel(ctx)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var setupErr atomic.Value
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := dialStore(dial, manifest.Namespace)
+			if err != nil {
+				setupErr.CompareAndSwap(nil, err)
+				// Drain the files so that the feed is not blocked
+				for range indexes {
+				}
+				return
+			}
+			defer s.c.Close()
+			for i := range indexes {
+				file := manifest.Files[i]
+				path := filepath.Join(dest, filepath.FromSlash(file.Path))
+				if inPlace(path, file) {
+					atomic.AddInt64(&result.Skipped, 1)
+					continue
+				}
+				if err := downloadFile(downloadCtx, s, path, file); err != nil {
+					atomic.AddInt64(&result.Failed, 1)
+					logger.Error("failed to download file", "path", file.Path, "error", err)
+					continue
+				}
+				atomic.AddInt64(&result.Transferred, 1)
+				atomic.AddInt64(&result.Bytes, file.Size)
+				logger.Debug("file downloaded", "path", file.Path, "bytes", file.Size)
+			}
+		}()
+	}
+
+feed:
+	for i := range manifest.Files {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err, ok := setupErr.Load().(error); ok {
+		return manifest, &result, err
+	}
+	// Deeper directories first, so that a parent's mode does not keep a
+	// child from being changed
+	for i := len(manifest.Dirs) - 1; i >= 0; i-- {
+		dir := manifest.Dirs[i]
+		if err := os.Chmod(filepath.Join(dest, filepath.FromSlash(dir.Path)), dir.Mode); err != nil {
+			logger.Warn("failed to set directory mode", "path", dir.Path, "error", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return manifest, &result, err
+	}
+	if result.Failed > 0 {
+		return manifest, &result, fmt.Errorf("%d files failed to download; run the download again to retry them", result.Failed)
+	}
+	return manifest, &result, nil
+}
+
+// inPlace reports whether a file was already downloaded: it exists with
+// the size and modification time the manifest records, which a download
+// sets last
+func inPlace(path string, file File) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular() && info.Size() == file.Size && info.ModTime().UnixNano() == file.ModTime
+}
+
+// downloadFile downloads a file next to its path and renames it into
+// place once its checksum is verified, with its mode and modification
+// time
+func downloadFile(ctx context.Context, s *store, path string, file File) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	part := path + partSuffix
+	f, err := os.OpenFile(part, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	if file.ID != "" {
+		err = s.get(ctx, file, f)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(part, file.Mode)
+	}
+	if err == nil {
+		modTime := time.Unix(0, file.ModTime)
+		err = os.Chtimes(part, modTime, modTime)
+	}
+	if err == nil {
+		err = os.Rename(part, path)
+	}
+	if err != nil {
+		os.Remove(part)
+	}
+	return err
+}
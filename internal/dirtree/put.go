@@ -0,0 +1,238 @@
+package dirtree
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// PutOptions configures an upload
+type PutOptions struct {
+	// Workers is the number of files uploaded at the same time, each over
+	// its own connection
+	Workers int
+	// Namespace stores the files as objects of a namespace, named by their
+	// paths, instead of as streams named after the manifest
+	Namespace string
+	// ChunkSize is the size of the chunks of the files' streams; zero uses
+	// the client's default
+	ChunkSize int
+	// Progress is the path of a file recording the files uploaded, so that
+	// an interrupted upload resumes; empty uploads every file
+	Progress string
+}
+
+// Put uploads the tree under root and then writes its manifest as the
+// stream manifestID. A file that fails to upload is logged and counted,
+// and the manifest is then not written: run the upload again with the
+// same progress file to retry the failures. Ending ctx stops the upload
+// once the files being uploaded are.
+func Put(ctx context.Context, root, manifestID string, dial Dial, opts PutOptions, logger *slog.Logger) (*Manifest, *Result, error) {
+	if err := validateManifestID(manifestID); err != nil {
+		return nil, nil, err
+	}
+	if opts.Namespace != "" {
+		if strings.Contains(opts.Namespace, api.NamespaceSeparator) {
+			return nil, nil, fmt.Errorf("namespace %q cannot hold a separator", opts.Namespace)
+		}
+		if err := api.ValidateBlockID(opts.Namespace + api.NamespaceSeparator); err != nil {
+			return nil, nil, fmt.Errorf("invalid namespace: %w", err)
+		}
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+
+	manifest := &Manifest{Format: ManifestFormat, Namespace: opts.Namespace}
+	if err := walk(root, manifestID, manifest, logger); err != nil {
+		return nil, nil, err
+	}
+	var progress *journal
+	if opts.Progress != "" {
+		var err error
+		if progress, err = openJournal(opts.Progress); err != nil {
+			return nil, nil, err
+		}
+		defer progress.close()
+	}
+
+	c, err := dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.Close()
+
+	var result Result
+	uploadCtx := context.WithoutCancel(ctx)
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	var setupErr atomic.Value
+	for i := 0; i < opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := dialStore(dial, opts.Namespace)
+			if err != nil {
+				setupErr.CompareAndSwap(nil, err)
+				// Drain the files so that the feed is not blocked
+				for range indexes {
+				}
+				return
+			}
+			defer s.c.Close()
+			for i := range indexes {
+				file := &manifest.Files[i]
+				if done, ok := progress.lookup(*file); ok {
+					*file = done
+					atomic.AddInt64(&result.Skipped, 1)
+					continue
+				}
+				if err := uploadFile(uploadCtx, s, root, file, opts.ChunkSize); err != nil {
+					atomic.AddInt64(&result.Failed, 1)
+					logger.Error("failed to upload file", "path", file.Path, "error", err)
+					continue
+				}
+				atomic.AddInt64(&result.Transferred, 1)
+				atomic.AddInt64(&result.Bytes, file.Size)
+				logger.Debug("file uploaded", "path", file.Path, "id", file.ID, "bytes", file.Size)
+				if err := progress.record(*file); err != nil {
+					logger.Warn("failed to record progress", "path", file.Path, "error", err)
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := range manifest.Files {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	if err, ok := setupErr.Load().(error); ok {
+		return nil, &result, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, &result, err
+	}
+	if result.Failed > 0 {
+		return nil, &result, fmt.Errorf("%d files failed to upload, so the manifest was not written", result.Failed)
+	}
+
+	for _, file := range manifest.Files {
+		manifest.Size += file.Size
+	}
+	manifest.CreatedAt = time.Now().UnixNano()
+	if err := writeManifest(ctx, c, manifestID, manifest); err != nil {
+		return nil, &result, err
+	}
+	return manifest, &result, nil
+}
+
+// walk lists the directories and regular files under root into the
+// manifest, sorted by path, naming each file's stream or object. Other
+// kinds of files, such as symbolic links, are skipped.
+func walk(root, manifestID string, manifest *Manifest, logger *slog.Logger) error {
+	info, err := os.Stat(root)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", root)
+	}
+
+	err = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !d.IsDir() && !d.Type().IsRegular() {
+			logger.Warn("skipping file that is not regular", "path", rel, "type", d.Type().String())
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			manifest.Dirs = append(manifest.Dirs, Dir{Path: rel, Mode: info.Mode().Perm()})
+			return nil
+		}
+
+		file := File{
+			Path:    rel,
+			ID:      fileStreamID(manifestID, rel),
+			Size:    info.Size(),
+			Mode:    info.Mode().Perm(),
+			ModTime: info.ModTime().UnixNano(),
+		}
+		if manifest.Namespace != "" {
+			file.ID = block.EscapeName(rel)
+		} else if file.Size == 0 {
+			// Empty files need no stream
+			file.ID = ""
+		}
+		manifest.Files = append(manifest.Files, file)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", root, err)
+	}
+	sort.Slice(manifest.Dirs, func(i, j int) bool { return manifest.Dirs[i].Path < manifest.Dirs[j].Path })
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Path < manifest.Files[j].Path })
+	return nil
+}
+
+// dialStore opens a worker's connection and the store over it
+func dialStore(dial Dial, namespace string) (*store, error) {
+	c, err := dial()
+	if err != nil {
+		return nil, err
+	}
+	s, err := newStore(c, namespace)
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// uploadFile uploads a file of the tree, recording the size and checksum
+// of the data stored, which differ from those listed if the file changed
+// since
+func uploadFile(ctx context.Context, s *store, root string, file *File, chunkSize int) error {
+	f, err := os.Open(filepath.Join(root, filepath.FromSlash(file.Path)))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if file.ID == "" {
+		file.Checksum = emptyChecksum
+		return nil
+	}
+	size, checksum, err := s.put(ctx, *file, f, chunkSize)
+	if err != nil {
+		return err
+	}
+	file.Size, file.Checksum = size, checksum
+	return nil
+}
@@ -0,0 +1,116 @@
+package discovery
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// consulRegistry registers nodes as Consul agent services guarded by a TTL
+// check, so Consul marks a node critical and eventually removes it if the
+// keepalives stop
+type consulRegistry struct {
+	http    *httpClient
+	service string
+}
+
+// serviceID returns the Consul service ID of a node
+func (c *consulRegistry) serviceID(id string) string {
+	return c.service + "-" + id
+}
+
+// Register registers the node as an instance of the service
+func (c *consulRegistry) Register(ctx context.Context, reg *Registration, ttl time.Duration) error {
+	host, portStr, err := net.SplitHostPort(reg.Address)
+	if err != nil {
+		return fmt.Errorf("invalid node address %q: %w", reg.Address, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return fmt.Errorf("invalid node port %q: %w", portStr, err)
+	}
+
+	record, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration: %w", err)
+	}
+
+	service := map[string]interface{}{
+		"ID":      c.serviceID(reg.ID),
+		"Name":    c.service,
+		"Address": host,
+		"Port":    port,
+		"Meta": map[string]string{
+			"node_id":      reg.ID,
+			"registration": string(record),
+		},
+		"Check": map[string]interface{}{
+			"CheckID":                        "service:" + c.serviceID(reg.ID),
+			"TTL":                            ttl.String(),
+			"DeregisterCriticalServiceAfter": (10 * ttl).String(),
+		},
+	}
+	tags := make([]string, 0, 3)
+	for _, label := range []struct{ key, value string }{
+		{"zone", reg.Zone}, {"rack", reg.Rack}, {"host", reg.Host},
+	} {
+		if label.value != "" {
+			tags = append(tags, label.key+"="+label.value)
+		}
+	}
+	if len(tags) > 0 {
+		service["Tags"] = tags
+	}
+
+	if err := c.http.do(ctx, "PUT", "/v1/agent/service/register", service, nil); err != nil {
+		return fmt.Errorf("failed to register service: %w", err)
+	}
+
+	return c.KeepAlive(ctx, reg)
+}
+
+// KeepAlive marks the node's TTL check as passing
+func (c *consulRegistry) KeepAlive(ctx context.Context, reg *Registration) error {
+	path := "/v1/agent/check/pass/" + url.PathEscape("service:"+c.serviceID(reg.ID))
+	if err := c.http.do(ctx, "PUT", path, nil, nil); err != nil {
+		return fmt.Errorf("failed to pass TTL check: %w", err)
+	}
+	return nil
+}
+
+// Deregister removes the node's service instance
+func (c *consulRegistry) Deregister(ctx context.Context, reg *Registration) error {
+	path := "/v1/agent/service/deregister/" + url.PathEscape(c.serviceID(reg.ID))
+	if err := c.http.do(ctx, "PUT", path, nil, nil); err != nil {
+		return fmt.Errorf("failed to deregister service: %w", err)
+	}
+	return nil
+}
+
+// List returns the healthy instances of the service
+func (c *consulRegistry) List(ctx context.Context) ([]*Registration, error) {
+	var entries []struct {
+		Service struct {
+			Meta map[string]string `json:"Meta"`
+		} `json:"Service"`
+	}
+	path := "/v1/health/service/" + url.PathEscape(c.service) + "?passing=true"
+	if err := c.http.do(ctx, "GET", path, nil, &entries); err != nil {
+		return nil, fmt.Errorf("failed to list services: %w", err)
+	}
+
+	regs := make([]*Registration, 0, len(entries))
+	for _, entry := range entries {
+		var reg Registration
+		if err := json.Unmarshal([]byte(entry.Service.Meta["registration"]), &reg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal registration: %w", err)
+		}
+		regs = append(regs, &reg)
+	}
+
+	return regs, nil
+}
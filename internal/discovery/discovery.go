@@ -0,0 +1,215 @@
+package discovery
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// DefaultTTL is how long a registration survives without a keepalive
+const DefaultTTL = 15 * time.Second
+
+// Registration is the record a node publishes about itself
+type Registration struct {
+	ID            string `json:"id"`
+	Address       string `json:"address"`
+	AdminAddress  string `json:"admin_address,omitempty"`
+	CapacityBytes int64  `json:"capacity_bytes"`
+	Zone          string `json:"zone,omitempty"`
+	Rack          string `json:"rack,omitempty"`
+	Host          string `json:"host,omitempty"`
+	StartedAt     int64  `json:"started_at"`
+}
+
+// Registry is a service discovery backend
+type Registry interface {
+	// Register publishes the registration with the given TTL
+	Register(ctx context.Context, reg *Registration, ttl time.Duration) error
+	// KeepAlive refreshes the TTL of a published registration
+	KeepAlive(ctx context.Context, reg *Registration) error
+	// Deregister removes a published registration
+	Deregister(ctx context.Context, reg *Registration) error
+	// List returns all live registrations
+	List(ctx context.Context) ([]*Registration, error)
+}
+
+// NewRegistry creates the registry backend selected in the configuration
+func NewRegistry(cfg config.DiscoveryConfig) (Registry, error) {
+	if len(cfg.Endpoints) == 0 {
+		return nil, errors.New("discovery requires at least one endpoint")
+	}
+
+	client := &httpClient{
+		endpoints: cfg.Endpoints,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+
+	switch strings.ToLower(cfg.Backend) {
+	case "etcd":
+		prefix := cfg.Prefix
+		if prefix == "" {
+			prefix = "/3fs/nodes/"
+		}
+		return &etcdRegistry{http: client, prefix: prefix}, nil
+	case "consul":
+		service := cfg.Prefix
+		if service == "" {
+			service = "3fs-storage"
+		}
+		return &consulRegistry{http: client, service: service}, nil
+	default:
+		return nil, fmt.Errorf("unknown discovery backend %q", cfg.Backend)
+	}
+}
+
+// httpClient sends JSON requests to the first reachable endpoint
+type httpClient struct {
+	endpoints []string
+	client    *http.Client
+}
+
+// do sends a request with an optional JSON body and decodes an optional
+// JSON response, failing over between endpoints on transport errors
+func (c *httpClient) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return fmt.Errorf("failed to marshal request: %w", err)
+		}
+	}
+
+	var lastErr error
+	for _, endpoint := range c.endpoints {
+		req, err := http.NewRequestWithContext(ctx, method, strings.TrimSuffix(endpoint, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to build request: %w", err)
+		}
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		resp, err := c.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(respBody)))
+		}
+
+		if out != nil && len(respBody) > 0 {
+			if err := json.Unmarshal(respBody, out); err != nil {
+				return fmt.Errorf("failed to unmarshal response: %w", err)
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("no discovery endpoint reachable: %w", lastErr)
+}
+
+// Registrar keeps a node registered for as long as it runs
+type Registrar struct {
+	registry Registry
+	reg      *Registration
+	ttl      time.Duration
+	logger   *slog.Logger
+	cancel   context.CancelFunc
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+// NewRegistrar creates a registrar publishing reg to the registry
+func NewRegistrar(registry Registry, reg *Registration, ttl time.Duration, logger *slog.Logger) *Registrar {
+	if ttl <= 0 {
+		ttl = DefaultTTL
+	}
+
+	return &Registrar{
+		registry: registry,
+		reg:      reg,
+		ttl:      ttl,
+		logger:   logging.Component(logger, "discovery"),
+	}
+}
+
+// Start registers the node and begins refreshing its TTL in the background
+func (r *Registrar) Start(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.registry.Register(ctx, r.reg, r.ttl); err != nil {
+		return fmt.Errorf("failed to register node: %w", err)
+	}
+
+	loopCtx, cancel := context.WithCancel(context.Background())
+	r.cancel = cancel
+	r.done = make(chan struct{})
+	go r.keepAlive(loopCtx)
+
+	r.logger.Info("registered with service discovery", "id", r.reg.ID, "ttl", r.ttl)
+	return nil
+}
+
+// keepAlive refreshes the registration until cancelled, re-registering if
+// the backend has expired it in the meantime
+func (r *Registrar) keepAlive(ctx context.Context) {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.registry.KeepAlive(ctx, r.reg); err != nil {
+				r.logger.Warn("registration keepalive failed, re-registering", "error", err)
+				if err := r.registry.Register(ctx, r.reg, r.ttl); err != nil {
+					r.logger.Error("failed to re-register node", "error", err)
+				}
+			}
+		}
+	}
+}
+
+// Stop stops refreshing the registration and removes it
+func (r *Registrar) Stop(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel == nil {
+		return nil
+	}
+	r.cancel()
+	<-r.done
+	r.cancel = nil
+
+	if err := r.registry.Deregister(ctx, r.reg); err != nil {
+		return fmt.Errorf("failed to deregister node: %w", err)
+	}
+
+	r.logger.Info("deregistered from service discovery", "id", r.reg.ID)
+	return nil
+}
@@ -0,0 +1,160 @@
+package discovery
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// etcdRegistry stores registrations as leased keys through the etcd v3
+// JSON gateway, so a node that dies without deregistering disappears once
+// its lease expires
+type etcdRegistry struct {
+	http   *httpClient
+	prefix string
+	leases map[string]string
+	mu     sync.Mutex
+}
+
+// etcdKey returns the key holding a node's registration
+func (e *etcdRegistry) etcdKey(id string) string {
+	return e.prefix + id
+}
+
+// b64 encodes a key or value for the JSON gateway
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+// prefixEnd returns the range end that selects every key with the prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+// Register grants a lease and writes the registration under it
+func (e *etcdRegistry) Register(ctx context.Context, reg *Registration, ttl time.Duration) error {
+	var grant struct {
+		ID string `json:"ID"`
+	}
+	if err := e.http.do(ctx, "POST", "/v3/lease/grant", map[string]interface{}{"TTL": int64(ttl.Seconds())}, &grant); err != nil {
+		return fmt.Errorf("failed to grant lease: %w", err)
+	}
+
+	value, err := json.Marshal(reg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal registration: %w", err)
+	}
+
+	put := map[string]interface{}{
+		"key":   b64(e.etcdKey(reg.ID)),
+		"value": base64.StdEncoding.EncodeToString(value),
+		"lease": grant.ID,
+	}
+	if err := e.http.do(ctx, "POST", "/v3/kv/put", put, nil); err != nil {
+		return fmt.Errorf("failed to write registration: %w", err)
+	}
+
+	e.mu.Lock()
+	if e.leases == nil {
+		e.leases = make(map[string]string)
+	}
+	e.leases[reg.ID] = grant.ID
+	e.mu.Unlock()
+
+	return nil
+}
+
+// lease returns the lease ID held for a registration
+func (e *etcdRegistry) lease(id string) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	lease, ok := e.leases[id]
+	if !ok {
+		return "", fmt.Errorf("node %s is not registered", id)
+	}
+	return lease, nil
+}
+
+// KeepAlive renews the registration's lease
+func (e *etcdRegistry) KeepAlive(ctx context.Context, reg *Registration) error {
+	lease, err := e.lease(reg.ID)
+	if err != nil {
+		return err
+	}
+
+	var resp struct {
+		Result struct {
+			TTL string `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := e.http.do(ctx, "POST", "/v3/lease/keepalive", map[string]interface{}{"ID": lease}, &resp); err != nil {
+		return fmt.Errorf("failed to renew lease: %w", err)
+	}
+
+	// An expired lease is reported with a zero or missing TTL
+	if resp.Result.TTL == "" || resp.Result.TTL == "0" {
+		return fmt.Errorf("lease %s has expired", lease)
+	}
+	return nil
+}
+
+// Deregister revokes the lease, which deletes the registration with it
+func (e *etcdRegistry) Deregister(ctx context.Context, reg *Registration) error {
+	lease, err := e.lease(reg.ID)
+	if err != nil {
+		return err
+	}
+
+	if err := e.http.do(ctx, "POST", "/v3/lease/revoke", map[string]interface{}{"ID": lease}, nil); err != nil {
+		return fmt.Errorf("failed to revoke lease: %w", err)
+	}
+
+	e.mu.Lock()
+	delete(e.leases, reg.ID)
+	e.mu.Unlock()
+
+	return nil
+}
+
+// List reads every registration under the prefix
+func (e *etcdRegistry) List(ctx context.Context) ([]*Registration, error) {
+	var resp struct {
+		KVs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	rangeReq := map[string]interface{}{
+		"key":       b64(e.prefix),
+		"range_end": b64(prefixEnd(e.prefix)),
+	}
+	if err := e.http.do(ctx, "POST", "/v3/kv/range", rangeReq, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list registrations: %w", err)
+	}
+
+	regs := make([]*Registration, 0, len(resp.KVs))
+	for _, kv := range resp.KVs {
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode registration: %w", err)
+		}
+
+		var reg Registration
+		if err := json.Unmarshal(value, &reg); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal registration: %w", err)
+		}
+		regs = append(regs, &reg)
+	}
+
+	return regs, nil
+}
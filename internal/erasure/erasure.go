@@ -0,0 +1,197 @@
+// Package erasure implements systematic Reed-Solomon erasure coding over
+// GF(2^8). A block is split into data shards, and parity shards are
+// computed from them, so that the block can be rebuilt from any data-many
+// of the shards: losing up to parity-many of them loses no data, at a cost
+// of (data+parity)/data times the block's size rather than a full copy per
+// replica.
+package erasure
+
+import (
+	"errors"
+	"fmt"
+)
+
+// MaxShards is the most shards, data and parity together, a code can have
+const MaxShards = 256
+
+// ErrTooFewShards is returned when fewer shards survive than a block needs
+// to be rebuilt
+var ErrTooFewShards = errors.New("too few shards to reconstruct")
+
+// Code is a Reed-Solomon code with a fixed number of data and parity
+// shards. It is safe for concurrent use.
+type Code struct {
+	data   int
+	parity int
+	// encoding is the systematic encoding matrix: its first data rows are
+	// the identity, and the rest compute the parity shards
+	encoding matrix
+}
+
+// New returns a code of data data shards and parity parity shards
+func New(data, parity int) (*Code, error) {
+	if data <= 0 || parity <= 0 {
+		return nil, errors.New("data and parity shards must be positive")
+	}
+	if data+parity > MaxShards {
+		return nil, fmt.Errorf("data and parity shards cannot exceed %d together", MaxShards)
+	}
+
+	// Multiplying a Vandermonde matrix by the inverse of its top square
+	// keeps any data rows independent and makes the top the identity
+	v := vandermonde(data+parity, data)
+	top, err := v[:data].invert()
+	if err != nil {
+		return nil, err
+	}
+	return &Code{data: data, parity: parity, encoding: v.multiply(top)}, nil
+}
+
+// DataShards returns the number of data shards
+func (c *Code) DataShards() int {
+	return c.data
+}
+
+// ParityShards returns the number of parity shards
+func (c *Code) ParityShards() int {
+	return c.parity
+}
+
+// Shards returns the number of shards, data and parity
+func (c *Code) Shards() int {
+	return c.data + c.parity
+}
+
+// ShardSize returns the size of each shard of a block of size bytes
+func (c *Code) ShardSize(size int) int {
+	return (size + c.data - 1) / c.data
+}
+
+// Split cuts a block into its data shards, zero-padding the last, and
+// allocates its parity shards, ready for Encode
+func (c *Code) Split(block []byte) [][]byte {
+	size := c.ShardSize(len(block))
+	buf := make([]byte, size*c.Shards())
+	copy(buf, block)
+
+	shards := make([][]byte, c.Shards())
+	for i := range shards {
+		shards[i] = buf[i*size : (i+1)*size : (i+1)*size]
+	}
+	return shards
+}
+
+// Encode computes the parity shards from the data shards
+func (c *Code) Encode(shards [][]byte) error {
+	if err := c.checkShards(shards, false); err != nil {
+		return err
+	}
+	for i := c.data; i < c.Shards(); i++ {
+		c.computeShard(c.encoding[i], shards[:c.data], shards[i])
+	}
+	return nil
+}
+
+// Reconstruct rebuilds the missing shards, those that are nil, from any
+// data-many of the others
+func (c *Code) Reconstruct(shards [][]byte) error {
+	if err := c.checkShards(shards, true); err != nil {
+		return err
+	}
+
+	present := make([]int, 0, c.data)
+	size := 0
+	for i, shard := range shards {
+		if shard != nil && len(present) < c.data {
+			present = append(present, i)
+			size = len(shard)
+		}
+	}
+	if len(present) < c.data {
+		return fmt.Errorf("%w: %d of %d", ErrTooFewShards, len(present), c.data)
+	}
+
+	// The data shards are the inverse of the surviving shards' rows
+	// applied to the surviving shards
+	dataMissing := false
+	for i := 0; i < c.data; i++ {
+		if shards[i] == nil {
+			dataMissing = true
+		}
+	}
+	if dataMissing {
+		rows := make(matrix, c.data)
+		inputs := make([][]byte, c.data)
+		for i, shard := range present {
+			rows[i] = c.encoding[shard]
+			inputs[i] = shards[shard]
+		}
+		decoding, err := rows.invert()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < c.data; i++ {
+			if shards[i] == nil {
+				shards[i] = make([]byte, size)
+				c.computeShard(decoding[i], inputs, shards[i])
+			}
+		}
+	}
+
+	for i := c.data; i < c.Shards(); i++ {
+		if shards[i] == nil {
+			shards[i] = make([]byte, size)
+			c.computeShard(c.encoding[i], shards[:c.data], shards[i])
+		}
+	}
+	return nil
+}
+
+// Join reassembles a block of size bytes from its data shards
+func (c *Code) Join(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) < c.data {
+		return nil, fmt.Errorf("%w: %d of %d", ErrTooFewShards, len(shards), c.data)
+	}
+	block := make([]byte, 0, size)
+	for _, shard := range shards[:c.data] {
+		if shard == nil {
+			return nil, errors.New("data shard missing; reconstruct first")
+		}
+		block = append(block, shard[:min(len(shard), size-len(block))]...)
+	}
+	if len(block) < size {
+		return nil, fmt.Errorf("shards hold %d bytes, fewer than %d", len(block), size)
+	}
+	return block, nil
+}
+
+// checkShards checks that shards has a shard per row, all of one size,
+// allowing nil shards if missing is set
+func (c *Code) checkShards(shards [][]byte, missing bool) error {
+	if len(shards) != c.Shards() {
+		return fmt.Errorf("expected %d shards, got %d", c.Shards(), len(shards))
+	}
+	size := -1
+	for i, shard := range shards {
+		if shard == nil {
+			if !missing {
+				return fmt.Errorf("shard %d is missing", i)
+			}
+			continue
+		}
+		if size >= 0 && len(shard) != size {
+			return fmt.Errorf("shard %d has %d bytes, expected %d", i, len(shard), size)
+		}
+		size = len(shard)
+	}
+	return nil
+}
+
+// computeShard sets out to the combination of inputs by the coefficients
+// of row
+func (c *Code) computeShard(row []byte, inputs [][]byte, out []byte) {
+	clear(out)
+	for i, input := range inputs {
+		mulAdd(row[i], input, out)
+	}
+}
@@ -0,0 +1,152 @@
+package erasure
+
+import "errors"
+
+// errSingular reports a matrix without an inverse, which a Vandermonde
+// matrix's rows never form
+var errSingular = errors.New("matrix is singular")
+
+// polynomial is the irreducible polynomial of GF(2^8), x^8+x^4+x^3+x^2+1
+const polynomial = 0x11d
+
+// expTable and logTable hold the powers and logarithms of the field's
+// generator, 2. expTable is doubled so that products need no modulo.
+var (
+	expTable [510]byte
+	logTable [256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		expTable[i] = byte(x)
+		expTable[i+255] = byte(x)
+		logTable[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= polynomial
+		}
+	}
+}
+
+// mul multiplies two field elements
+func mul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return expTable[int(logTable[a])+int(logTable[b])]
+}
+
+// inv returns the multiplicative inverse of a non-zero field element
+func inv(a byte) byte {
+	return expTable[255-int(logTable[a])]
+}
+
+// pow raises a field element to a power
+func pow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return expTable[(int(logTable[a])*n)%255]
+}
+
+// mulAdd adds c times in to out, element by element
+func mulAdd(c byte, in, out []byte) {
+	if c == 0 {
+		return
+	}
+	if c == 1 {
+		for i, v := range in {
+			out[i] ^= v
+		}
+		return
+	}
+	lc := int(logTable[c])
+	for i, v := range in {
+		if v != 0 {
+			out[i] ^= expTable[lc+int(logTable[v])]
+		}
+	}
+}
+
+// matrix is a matrix over GF(2^8), by rows
+type matrix [][]byte
+
+// newMatrix returns a zero matrix
+func newMatrix(rows, cols int) matrix {
+	m := make(matrix, rows)
+	for i := range m {
+		m[i] = make([]byte, cols)
+	}
+	return m
+}
+
+// vandermonde returns the rows×cols matrix whose element (r, c) is r^c.
+// Any cols of its rows are linearly independent.
+func vandermonde(rows, cols int) matrix {
+	m := newMatrix(rows, cols)
+	for r := range m {
+		for c := range m[r] {
+			m[r][c] = pow(byte(r), c)
+		}
+	}
+	return m
+}
+
+// multiply returns the product m×o
+func (m matrix) multiply(o matrix) matrix {
+	product := newMatrix(len(m), len(o[0]))
+	for r := range m {
+		for c := range product[r] {
+			var v byte
+			for i := range o {
+				v ^= mul(m[r][i], o[i][c])
+			}
+			product[r][c] = v
+		}
+	}
+	return product
+}
+
+// invert returns the inverse of a square matrix by Gauss-Jordan
+// elimination
+func (m matrix) invert() (matrix, error) {
+	n := len(m)
+	work := newMatrix(n, 2*n)
+	for r := range m {
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errSingular
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		if scale := work[c][c]; scale != 1 {
+			s := inv(scale)
+			for i := range work[c] {
+				work[c][i] = mul(work[c][i], s)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				mulAdd(work[r][c], work[c], work[r])
+			}
+		}
+	}
+
+	inverse := newMatrix(n, n)
+	for r := range inverse {
+		copy(inverse[r], work[r][n:])
+	}
+	return inverse, nil
+}
@@ -0,0 +1,397 @@
+package fs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+)
+
+// maxDirtyBlocks is the most changed blocks an open file buffers before it
+// is stored
+const maxDirtyBlocks = 64
+
+// inode is an open file, shared by every handle open on its path. Its data
+// is its stored manifest overlaid with the blocks changed since, in blocks
+// of the store's block size.
+type inode struct {
+	fs       *FileSystem
+	mu       sync.Mutex
+	path     string
+	manifest *block.ObjectManifest
+	// valid is how much of the manifest's data the file still has, less
+	// than its size once the file was truncated
+	valid   int64
+	size    int64
+	dirty   map[int][]byte
+	changed bool
+	removed bool
+	modTime time.Time
+	refs    int
+}
+
+// File is a handle open on a file
+type File struct {
+	ino      *inode
+	writable bool
+	mu       sync.Mutex
+	closed   bool
+}
+
+// Create creates or truncates a file and opens it for reading and writing
+func (f *FileSystem) Create(ctx context.Context, name string) (*File, error) {
+	return f.Open(ctx, name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// Open opens a file with the os package's flags: O_RDONLY, O_WRONLY or
+// O_RDWR, with O_CREATE, O_EXCL and O_TRUNC. A file created is stored
+// empty at once, so that it can be listed and looked up.
+func (f *FileSystem) Open(ctx context.Context, name string, flag int) (*File, error) {
+	p := clean(name)
+	if p == "" {
+		return nil, pathError("open", p, ErrIsDir)
+	}
+	if flag&os.O_APPEND != 0 {
+		return nil, pathError("open", p, errors.New("appending is not supported; write at the file's size"))
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if flag&(os.O_CREATE|os.O_TRUNC) != 0 && !writable {
+		return nil, pathError("open", p, ErrPermission)
+	}
+
+	f.tree.RLock()
+	defer f.tree.RUnlock()
+
+	ino, err := f.openInode(ctx, p, flag)
+	if err != nil {
+		return nil, pathError("open", p, err)
+	}
+	if flag&os.O_TRUNC != 0 {
+		ino.truncate(0)
+	}
+	return &File{ino: ino, writable: writable}, nil
+}
+
+// openInode returns the inode of a file, loading it from its manifest or
+// creating the file, with a reference added for a new handle. It is
+// called with the tree read-locked.
+func (f *FileSystem) openInode(ctx context.Context, p string, flag int) (*inode, error) {
+	f.mu.Lock()
+	ino, ok := f.inodes[p]
+	if ok {
+		ino.refs++
+	}
+	f.mu.Unlock()
+	if ok {
+		if flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL {
+			f.release(ino)
+			return nil, ErrExist
+		}
+		return ino, nil
+	}
+
+	k, manifest, err := f.lookup(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case k == kindDir:
+		return nil, ErrIsDir
+	case k == kindFile && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, ErrExist
+	case k == kindNone && flag&os.O_CREATE == 0:
+		return nil, ErrNotExist
+	case k == kindNone:
+		if err := f.checkParent(ctx, p); err != nil {
+			return nil, err
+		}
+		if manifest, err = f.store.PatchObject(ctx, nil, objectName(p), 0, nil, block.ObjectAttributes{}); err != nil {
+			return nil, err
+		}
+	}
+
+	ino = &inode{
+		fs:       f,
+		path:     p,
+		manifest: manifest,
+		valid:    manifest.Size,
+		size:     manifest.Size,
+		dirty:    make(map[int][]byte),
+		modTime:  time.Unix(0, manifest.CreatedAt),
+		refs:     1,
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if other, ok := f.inodes[p]; ok {
+		// Opened by another handle meanwhile
+		other.refs++
+		return other, nil
+	}
+	f.inodes[p] = ino
+	return ino, nil
+}
+
+// release drops a reference to an inode, forgetting it with the last
+func (f *FileSystem) release(ino *inode) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ino.refs--
+	if ino.refs == 0 && f.inodes[ino.path] == ino {
+		delete(f.inodes, ino.path)
+	}
+}
+
+// stat describes the open file
+func (ino *inode) stat() *FileInfo {
+	ino.mu.Lock()
+	defer ino.mu.Unlock()
+	return &FileInfo{Name: path.Base(ino.path), Size: ino.size, ModTime: ino.modTime}
+}
+
+// blockSize returns the size of the blocks the file is changed by
+func (ino *inode) blockSize() int64 {
+	return int64(ino.fs.store.BlockSize())
+}
+
+// block returns block i of the file, as long as its place in the file. It
+// is called with the inode locked.
+func (ino *inode) block(ctx context.Context, i int) ([]byte, error) {
+	bs := ino.blockSize()
+	start := int64(i) * bs
+	length := max(min(bs, ino.size-start), 0)
+	if data, ok := ino.dirty[i]; ok {
+		if int64(len(data)) < length {
+			data = append(data, make([]byte, length-int64(len(data)))...)
+		}
+		return data[:length], nil
+	}
+
+	data := make([]byte, length)
+	if start < ino.valid {
+		n := min(length, ino.valid-start)
+		w := &sliceWriter{buf: data[:0]}
+		if err := ino.fs.store.GetObjectRange(ctx, ino.manifest, start, n, w); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// sliceWriter writes into a slice with room for what is written
+type sliceWriter struct {
+	buf []byte
+}
+
+// Write appends to the slice
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+// truncate changes the file's size, dropping the changes past it
+func (ino *inode) truncate(size int64) {
+	ino.mu.Lock()
+	defer ino.mu.Unlock()
+	if size == ino.size {
+		return
+	}
+	if size < ino.size {
+		bs := ino.blockSize()
+		for i, data := range ino.dirty {
+			start := int64(i) * bs
+			if start >= size {
+				delete(ino.dirty, i)
+			} else if start+int64(len(data)) > size {
+				ino.dirty[i] = data[:size-start]
+			}
+		}
+		ino.valid = min(ino.valid, size)
+	}
+	ino.size = size
+	ino.changed = true
+	ino.modTime = time.Now()
+}
+
+// commit stores the file's changes as a new version of its object, taking
+// the tree's read lock unless the caller holds the tree
+func (ino *inode) commit(ctx context.Context, lockTree bool) error {
+	if lockTree {
+		ino.fs.tree.RLock()
+		defer ino.fs.tree.RUnlock()
+	}
+	ino.mu.Lock()
+	defer ino.mu.Unlock()
+	if !ino.changed || ino.removed {
+		return nil
+	}
+
+	// Past valid, the stored data was truncated away and reads as zeros
+	previous := *ino.manifest
+	previous.Size = ino.valid
+	manifest, err := ino.fs.store.PatchObject(ctx, &previous, objectName(ino.path), ino.size, ino.dirty, ino.manifest.ObjectAttributes)
+	if err != nil {
+		return err
+	}
+	ino.manifest = manifest
+	ino.valid = manifest.Size
+	ino.dirty = make(map[int][]byte)
+	ino.changed = false
+	ino.modTime = time.Unix(0, manifest.CreatedAt)
+	return nil
+}
+
+// Name returns the path the file is open on
+func (h *File) Name() string {
+	return "/" + h.path()
+}
+
+// path returns the clean path the file is open on, which changes when the
+// file is renamed
+func (h *File) path() string {
+	h.ino.mu.Lock()
+	defer h.ino.mu.Unlock()
+	return h.ino.path
+}
+
+// check fails for a closed handle, or a read-only one when writing
+func (h *File) check(write bool) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return ErrClosed
+	}
+	if write && !h.writable {
+		return ErrPermission
+	}
+	return nil
+}
+
+// Stat describes the file as written so far
+func (h *File) Stat() (*FileInfo, error) {
+	if err := h.check(false); err != nil {
+		return nil, err
+	}
+	return h.ino.stat(), nil
+}
+
+// ReadAt reads len(p) bytes of the file from off, with the changes not yet
+// stored. Like io.ReaderAt, it returns io.EOF when it reads fewer.
+func (h *File) ReadAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := h.check(false); err != nil {
+		return 0, err
+	}
+	ino := h.ino
+	ino.mu.Lock()
+	defer ino.mu.Unlock()
+	if off < 0 {
+		return 0, pathError("read", ino.path, ErrInvalid)
+	}
+
+	bs := ino.blockSize()
+	n := 0
+	for n < len(p) && off < ino.size {
+		i := int(off / bs)
+		data, err := ino.block(ctx, i)
+		if err != nil {
+			return n, pathError("read", ino.path, err)
+		}
+		copied := copy(p[n:], data[off-int64(i)*bs:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// WriteAt writes p to the file at off, growing the file if it ends past
+// it. The change is buffered until the file is synced or closed; a file
+// buffering too many changed blocks is stored at once.
+func (h *File) WriteAt(ctx context.Context, p []byte, off int64) (int, error) {
+	if err := h.check(true); err != nil {
+		return 0, err
+	}
+	ino := h.ino
+	ino.mu.Lock()
+	if off < 0 {
+		ino.mu.Unlock()
+		return 0, pathError("write", ino.path, ErrInvalid)
+	}
+	if end := off + int64(len(p)); end > ino.size {
+		ino.size = end
+	}
+
+	bs := ino.blockSize()
+	n := 0
+	for n < len(p) {
+		i := int(off / bs)
+		data, err := ino.block(ctx, i)
+		if err != nil {
+			ino.mu.Unlock()
+			return n, pathError("write", ino.path, err)
+		}
+		copied := copy(data[off-int64(i)*bs:], p[n:])
+		ino.dirty[i] = data
+		n += copied
+		off += int64(copied)
+	}
+	ino.changed = true
+	ino.modTime = time.Now()
+	full := len(ino.dirty) >= maxDirtyBlocks
+	ino.mu.Unlock()
+
+	if full {
+		if err := ino.commit(ctx, true); err != nil {
+			return n, pathError("write", h.path(), err)
+		}
+	}
+	return n, nil
+}
+
+// Truncate changes the size of the file, zero-filling it if it grows
+func (h *File) Truncate(size int64) error {
+	if err := h.check(true); err != nil {
+		return err
+	}
+	if size < 0 {
+		return ErrInvalid
+	}
+	h.ino.truncate(size)
+	return nil
+}
+
+// Sync stores the file's changes
+func (h *File) Sync(ctx context.Context) error {
+	if err := h.check(false); err != nil {
+		return err
+	}
+	if err := h.ino.commit(ctx, true); err != nil {
+		return pathError("sync", h.path(), err)
+	}
+	return nil
+}
+
+// Close stores the file's changes and closes the handle, which is closed
+// even if storing them fails
+func (h *File) Close(ctx context.Context) error {
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		return ErrClosed
+	}
+	h.closed = true
+	h.mu.Unlock()
+
+	err := h.ino.commit(ctx, true)
+	h.ino.fs.release(h.ino)
+	if err != nil {
+		return pathError("close", h.path(), err)
+	}
+	return nil
+}
@@ -0,0 +1,433 @@
+// Package fs is a file system on top of the object layer: files and
+// directories with Create, Open, ReadAt, WriteAt, Mkdir, ReadDir, Rename
+// and Remove, for programs that need file semantics rather than whole
+// objects. Each file is an inode whose data is an object's manifest, kept
+// in the metadata service, so that renames are atomic and a write to part
+// of a large file stores only the blocks it touches.
+//
+// Files are laid out as the FUSE mount and the S3 gateway lay them out: a
+// file is the object named by its escaped path, a directory is implied by
+// the '/' in the names under it, and an empty one is kept as a marker
+// object whose name ends in '/'. A namespace can therefore be used through
+// this package, mounted and served over S3 at once, all with the same
+// metadata service.
+//
+// Writes to an open file are buffered per block and stored when the file
+// is synced or closed, or when too many blocks are buffered; readers see
+// a file's stored versions whole. A file should have one writer at a time:
+// handles of one FileSystem share a file's inode, but writers in other
+// processes replace each other's versions.
+package fs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	iofs "io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+)
+
+var (
+	// ErrNotExist is returned for a path that does not exist
+	ErrNotExist = iofs.ErrNotExist
+	// ErrExist is returned for a path that exists when it should not
+	ErrExist = iofs.ErrExist
+	// ErrClosed is returned for a file already closed
+	ErrClosed = iofs.ErrClosed
+	// ErrPermission is returned for a write to a file opened read-only
+	ErrPermission = iofs.ErrPermission
+	// ErrNotDir is returned when a path names a file where a directory is
+	// needed
+	ErrNotDir = errors.New("not a directory")
+	// ErrIsDir is returned when a path names a directory where a file is
+	// needed
+	ErrIsDir = errors.New("is a directory")
+	// ErrNotEmpty is returned for removing or replacing a directory that
+	// has entries
+	ErrNotEmpty = errors.New("directory not empty")
+	// ErrInvalid is returned for an operation on the root directory that
+	// it does not allow
+	ErrInvalid = iofs.ErrInvalid
+)
+
+// FileInfo describes a file or directory
+type FileInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	Dir     bool
+}
+
+// DirEntry is an entry of a directory
+type DirEntry struct {
+	Name string
+	Dir  bool
+}
+
+// kind is what a path names
+type kind int
+
+const (
+	kindNone kind = iota
+	kindFile
+	kindDir
+)
+
+// FileSystem is a file system kept in an object store with a metadata
+// service
+type FileSystem struct {
+	store *block.ObjectStore
+	// tree is held for reading while a file is stored, and for writing
+	// while paths are renamed or removed, so that a file is never stored
+	// under a name it no longer has
+	tree   sync.RWMutex
+	mu     sync.Mutex
+	inodes map[string]*inode
+}
+
+// New creates a file system over an object store. The store must keep its
+// manifests in the metadata service, or another index, for files to be
+// renamed.
+func New(store *block.ObjectStore) (*FileSystem, error) {
+	if store == nil {
+		return nil, errors.New("object store cannot be nil")
+	}
+	if !store.Indexed() {
+		return nil, errors.New("the file system needs an object store with a metadata service")
+	}
+	return &FileSystem{store: store, inodes: make(map[string]*inode)}, nil
+}
+
+// clean returns the canonical form of a path: slash-separated, without a
+// leading slash, and empty for the root
+func clean(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// objectName returns the name of the object holding the file at a path
+func objectName(p string) string {
+	return block.EscapeName(p)
+}
+
+// dirMarker returns the name of the marker object of a directory
+func dirMarker(p string) string {
+	return block.EscapeName(p + "/")
+}
+
+// parent returns the path of the directory holding a path
+func parent(p string) string {
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// pathError returns an error for an operation on a path
+func pathError(op, p string, err error) error {
+	return &iofs.PathError{Op: op, Path: "/" + p, Err: err}
+}
+
+// lookup returns what a path names, and the manifest of a file. A name
+// that is both a file and a prefix of others is the file, as it is in
+// listings.
+func (f *FileSystem) lookup(ctx context.Context, p string) (kind, *block.ObjectManifest, error) {
+	if p == "" {
+		return kindDir, nil, nil
+	}
+	manifest, err := f.store.HeadObject(ctx, objectName(p))
+	if err == nil {
+		return kindFile, manifest, nil
+	}
+	if !errors.Is(err, block.ErrBlockNotFound) {
+		return kindNone, nil, err
+	}
+	names, err := f.store.ListObjects(ctx, dirMarker(p))
+	if err != nil {
+		return kindNone, nil, err
+	}
+	if len(names) == 0 {
+		return kindNone, nil, nil
+	}
+	return kindDir, nil, nil
+}
+
+// checkParent checks that the directory holding a path exists
+func (f *FileSystem) checkParent(ctx context.Context, p string) error {
+	k, _, err := f.lookup(ctx, parent(p))
+	switch {
+	case err != nil:
+		return err
+	case k == kindNone:
+		return ErrNotExist
+	case k == kindFile:
+		return ErrNotDir
+	}
+	return nil
+}
+
+// Stat describes the file or directory at a path. An open file is
+// described as written so far.
+func (f *FileSystem) Stat(ctx context.Context, name string) (*FileInfo, error) {
+	p := clean(name)
+	if ino := f.inode(p); ino != nil {
+		return ino.stat(), nil
+	}
+	k, manifest, err := f.lookup(ctx, p)
+	switch {
+	case err != nil:
+		return nil, pathError("stat", p, err)
+	case k == kindNone:
+		return nil, pathError("stat", p, ErrNotExist)
+	case k == kindDir:
+		return &FileInfo{Name: path.Base("/" + p), Dir: true}, nil
+	}
+	return &FileInfo{Name: path.Base(p), Size: manifest.Size, ModTime: time.Unix(0, manifest.CreatedAt)}, nil
+}
+
+// Mkdir creates a directory by storing its marker. Its parent must exist.
+func (f *FileSystem) Mkdir(ctx context.Context, name string) error {
+	p := clean(name)
+	if p == "" {
+		return pathError("mkdir", p, ErrExist)
+	}
+	if err := f.checkParent(ctx, p); err != nil {
+		return pathError("mkdir", p, err)
+	}
+	k, _, err := f.lookup(ctx, p)
+	if err != nil {
+		return pathError("mkdir", p, err)
+	}
+	if k != kindNone || f.inode(p) != nil {
+		return pathError("mkdir", p, ErrExist)
+	}
+	if _, err := f.store.PutObject(ctx, dirMarker(p), bytes.NewReader(nil), block.ObjectAttributes{}); err != nil {
+		return pathError("mkdir", p, err)
+	}
+	return nil
+}
+
+// ReadDir lists a directory's entries, sorted by name
+func (f *FileSystem) ReadDir(ctx context.Context, name string) ([]DirEntry, error) {
+	p := clean(name)
+	k, _, err := f.lookup(ctx, p)
+	switch {
+	case err != nil:
+		return nil, pathError("readdir", p, err)
+	case k == kindNone:
+		return nil, pathError("readdir", p, ErrNotExist)
+	case k == kindFile:
+		return nil, pathError("readdir", p, ErrNotDir)
+	}
+
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+	names, err := f.store.ListObjects(ctx, block.EscapeName(prefix))
+	if err != nil {
+		return nil, pathError("readdir", p, err)
+	}
+
+	var entries []DirEntry
+	index := make(map[string]int)
+	add := func(name string, dir bool) {
+		i, ok := index[name]
+		if !ok {
+			index[name] = len(entries)
+			entries = append(entries, DirEntry{Name: name, Dir: dir})
+			return
+		}
+		// A file shadows a directory of the same name
+		entries[i].Dir = entries[i].Dir && dir
+	}
+	for _, n := range names {
+		key, err := block.UnescapeName(n)
+		if err != nil {
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if rest == "" {
+			continue
+		}
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			if i > 0 {
+				add(rest[:i], true)
+			}
+			continue
+		}
+		add(rest, false)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	return entries, nil
+}
+
+// Remove removes a file, or an empty directory. Handles still open on a
+// removed file keep its buffered writes but no longer store them.
+func (f *FileSystem) Remove(ctx context.Context, name string) error {
+	p := clean(name)
+	if p == "" {
+		return pathError("remove", p, ErrInvalid)
+	}
+	f.tree.Lock()
+	defer f.tree.Unlock()
+
+	k, _, err := f.lookup(ctx, p)
+	switch {
+	case err != nil:
+		return pathError("remove", p, err)
+	case k == kindNone:
+		return pathError("remove", p, ErrNotExist)
+	case k == kindFile:
+		if err := f.store.DeleteObject(ctx, objectName(p)); err != nil {
+			return pathError("remove", p, err)
+		}
+		f.detach(p)
+		return nil
+	}
+
+	names, err := f.store.ListObjects(ctx, dirMarker(p))
+	if err != nil {
+		return pathError("remove", p, err)
+	}
+	for _, n := range names {
+		if n != dirMarker(p) {
+			return pathError("remove", p, ErrNotEmpty)
+		}
+	}
+	if err := f.store.DeleteObject(ctx, dirMarker(p)); err != nil {
+		return pathError("remove", p, err)
+	}
+	return nil
+}
+
+// Rename moves a file or a directory with everything in it, replacing a
+// file or an empty directory of the same kind at the new path. Only
+// manifests move, in one transaction of the metadata service.
+func (f *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	from, to := clean(oldName), clean(newName)
+	if from == "" || to == "" {
+		return pathError("rename", from, ErrInvalid)
+	}
+	if from == to {
+		return nil
+	}
+	f.tree.Lock()
+	defer f.tree.Unlock()
+
+	// Open files are stored first, so that their manifests move too
+	if err := f.syncUnder(ctx, from); err != nil {
+		return pathError("rename", from, err)
+	}
+	k, _, err := f.lookup(ctx, from)
+	if err != nil {
+		return pathError("rename", from, err)
+	}
+	if k == kindNone {
+		return pathError("rename", from, ErrNotExist)
+	}
+	if err := f.checkParent(ctx, to); err != nil {
+		return pathError("rename", to, err)
+	}
+	target, _, err := f.lookup(ctx, to)
+	if err != nil {
+		return pathError("rename", to, err)
+	}
+
+	if k == kindFile {
+		if target == kindDir {
+			return pathError("rename", to, ErrIsDir)
+		}
+		if err := f.store.RenameObject(ctx, objectName(from), objectName(to)); err != nil {
+			return pathError("rename", from, err)
+		}
+		f.move(from, to)
+		return nil
+	}
+
+	if strings.HasPrefix(to+"/", from+"/") {
+		return pathError("rename", to, ErrInvalid)
+	}
+	switch target {
+	case kindFile:
+		return pathError("rename", to, ErrNotDir)
+	case kindDir:
+		names, err := f.store.ListObjects(ctx, dirMarker(to))
+		if err != nil {
+			return pathError("rename", to, err)
+		}
+		for _, n := range names {
+			if n != dirMarker(to) {
+				return pathError("rename", to, ErrNotEmpty)
+			}
+		}
+	}
+	if err := f.store.RenamePrefix(ctx, dirMarker(from), dirMarker(to)); err != nil {
+		return pathError("rename", from, err)
+	}
+	f.move(from, to)
+	return nil
+}
+
+// inode returns the inode of an open file, or nil
+func (f *FileSystem) inode(p string) *inode {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.inodes[p]
+}
+
+// syncUnder stores the open files at a path and under it. It is called
+// with the tree locked.
+func (f *FileSystem) syncUnder(ctx context.Context, p string) error {
+	f.mu.Lock()
+	var open []*inode
+	for q, ino := range f.inodes {
+		if q == p || strings.HasPrefix(q, p+"/") {
+			open = append(open, ino)
+		}
+	}
+	f.mu.Unlock()
+
+	for _, ino := range open {
+		if err := ino.commit(ctx, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// move gives the open files at a renamed path and under it their new
+// paths
+func (f *FileSystem) move(from, to string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for q, ino := range f.inodes {
+		if q != from && !strings.HasPrefix(q, from+"/") {
+			continue
+		}
+		delete(f.inodes, q)
+		ino.mu.Lock()
+		ino.path = to + q[len(from):]
+		ino.mu.Unlock()
+		f.inodes[ino.path] = ino
+	}
+}
+
+// detach marks the open file at a removed path as removed and forgets it,
+// so that a file created in its place gets an inode of its own
+func (f *FileSystem) detach(p string) {
+	f.mu.Lock()
+	ino := f.inodes[p]
+	delete(f.inodes, p)
+	f.mu.Unlock()
+	if ino != nil {
+		ino.mu.Lock()
+		ino.removed = true
+		ino.mu.Unlock()
+	}
+}
@@ -0,0 +1,295 @@
+package fusefs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/meta"
+)
+
+// dir is a directory: the objects whose names start with its path and a
+// '/'. The root directory has the empty path. Like a file's, a directory's
+// node keeps its path when it is renamed, guarded by the filesystem's lock.
+type dir struct {
+	fs   *FS
+	path string
+}
+
+// dirNode returns the node of the directory at a path
+func (f *FS) dirNode(p string) *dir {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.dirs[p]; ok {
+		return n
+	}
+	n := &dir{fs: f, path: p}
+	f.dirs[p] = n
+	return n
+}
+
+// name returns the directory's path
+func (d *dir) name() string {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	return d.path
+}
+
+// Forget drops the node once the kernel no longer refers to it
+func (d *dir) Forget() {
+	d.fs.mu.Lock()
+	defer d.fs.mu.Unlock()
+	if d.fs.dirs[d.path] == d {
+		delete(d.fs.dirs, d.path)
+	}
+}
+
+// Attr describes the directory. Directories have no object of their own
+// to take times from.
+func (d *dir) Attr(_ context.Context, attr *fuse.Attr) error {
+	attr.Valid = attrValid
+	attr.Mode = os.ModeDir | 0o755
+	attr.Uid = d.fs.uid
+	attr.Gid = d.fs.gid
+	return nil
+}
+
+// Lookup finds an entry of the directory. A name that is both an object
+// and a prefix of others is the file, as it is in listings.
+func (d *dir) Lookup(ctx context.Context, req *fuse.LookupRequest, resp *fuse.LookupResponse) (fs.Node, error) {
+	resp.EntryValid = attrValid
+	p := childPath(d.name(), req.Name)
+	if d.fs.writing(p) {
+		return d.fs.fileNode(p), nil
+	}
+
+	_, err := d.fs.store.HeadObject(ctx, objectName(p))
+	if err == nil {
+		return d.fs.fileNode(p), nil
+	}
+	if !errors.Is(err, block.ErrBlockNotFound) {
+		return nil, d.fs.fail("lookup", p, err)
+	}
+
+	names, err := d.fs.store.ListObjects(ctx, dirMarker(p))
+	if err != nil {
+		return nil, d.fs.fail("lookup", p, err)
+	}
+	if len(names) == 0 {
+		return nil, fuse.ENOENT
+	}
+	return d.fs.dirNode(p), nil
+}
+
+// prefix returns the path prefix of the directory's entries
+func (d *dir) prefix() string {
+	p := d.name()
+	if p == "" {
+		return ""
+	}
+	return p + "/"
+}
+
+// ReadDirAll lists the directory from the names of the objects under it,
+// with the files being written that are not stored yet
+func (d *dir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
+	prefix := d.prefix()
+	names, err := d.fs.store.ListObjects(ctx, block.EscapeName(prefix))
+	if err != nil {
+		return nil, d.fs.fail("readdir", prefix, err)
+	}
+
+	types := make(map[string]fuse.DirentType)
+	var order []string
+	add := func(name string, typ fuse.DirentType) {
+		previous, ok := types[name]
+		if !ok {
+			order = append(order, name)
+		}
+		if !ok || previous == fuse.DT_Dir {
+			types[name] = typ
+		}
+	}
+	for _, name := range names {
+		key, err := block.UnescapeName(name)
+		if err != nil {
+			d.fs.logger.Warn("skipping object with an invalid name", "name", name, "error", err)
+			continue
+		}
+		rest := strings.TrimPrefix(key, prefix)
+		if rest == "" {
+			// The directory's own marker
+			continue
+		}
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			if i > 0 {
+				add(rest[:i], fuse.DT_Dir)
+			}
+			continue
+		}
+		add(rest, fuse.DT_File)
+	}
+	for _, p := range d.fs.writingUnder(prefix) {
+		add(strings.TrimPrefix(p, prefix), fuse.DT_File)
+	}
+
+	entries := make([]fuse.Dirent, 0, len(order))
+	for _, name := range order {
+		entries = append(entries, fuse.Dirent{Name: name, Type: types[name]})
+	}
+	return entries, nil
+}
+
+// Create creates a file and opens it for writing. The file is stored when
+// it is first flushed, even if nothing was written to it.
+func (d *dir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fs.Node, fs.Handle, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, nil, err
+	}
+	p := childPath(d.name(), req.Name)
+	w, err := d.fs.openWriter(ctx, p, true)
+	if err != nil {
+		return nil, nil, d.fs.fail("create", p, err)
+	}
+	resp.EntryValid = attrValid
+	return d.fs.fileNode(p), w, nil
+}
+
+// Mkdir creates a directory by storing its marker object
+func (d *dir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fs.Node, error) {
+	if err := d.fs.checkWritable(); err != nil {
+		return nil, err
+	}
+	p := childPath(d.name(), req.Name)
+	if _, err := d.fs.store.PutObject(ctx, dirMarker(p), bytes.NewReader(nil), block.ObjectAttributes{}); err != nil {
+		return nil, d.fs.fail("mkdir", p, err)
+	}
+	return d.fs.dirNode(p), nil
+}
+
+// Remove deletes a file, or an empty directory's marker
+func (d *dir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if err := d.fs.checkWritable(); err != nil {
+		return err
+	}
+	p := childPath(d.name(), req.Name)
+	if !req.Dir {
+		if err := d.fs.store.DeleteObject(ctx, objectName(p)); err != nil {
+			return d.fs.fail("unlink", p, err)
+		}
+		d.fs.removeFile(p)
+		return nil
+	}
+
+	marker := dirMarker(p)
+	names, err := d.fs.store.ListObjects(ctx, marker)
+	if err != nil {
+		return d.fs.fail("rmdir", p, err)
+	}
+	for _, name := range names {
+		if name != marker {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	if len(names) == 0 {
+		return fuse.ENOENT
+	}
+	if err := d.fs.store.DeleteObject(ctx, marker); err != nil {
+		return d.fs.fail("rmdir", p, err)
+	}
+	d.fs.removeDir(p)
+	return nil
+}
+
+// Rename moves a file or directory. In a store with an index, such as the
+// metadata service, only manifests move, atomically. Otherwise a file is
+// moved by copying its object to the new name and deleting the old one,
+// which is not atomic: a failure part way leaves the file under both
+// names. Directories would then have to be moved object by object, so
+// renaming one fails with EXDEV, on which mv falls back to copying the
+// tree itself.
+func (d *dir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fs.Node) error {
+	if err := d.fs.checkWritable(); err != nil {
+		return err
+	}
+	target, ok := newDir.(*dir)
+	if !ok {
+		return fuse.EIO
+	}
+	from, to := childPath(d.name(), req.OldName), childPath(target.name(), req.NewName)
+	if d.fs.writing(from) || d.fs.writingBelow(from+"/") {
+		// Renaming a file still being written would lose its later writes
+		return fuse.Errno(syscall.EBUSY)
+	}
+	if d.fs.store.Indexed() {
+		return d.fs.renameIndexed(ctx, from, to)
+	}
+
+	manifest, err := d.fs.store.HeadObject(ctx, objectName(from))
+	if errors.Is(err, block.ErrBlockNotFound) {
+		return fuse.Errno(syscall.EXDEV)
+	}
+	if err != nil {
+		return d.fs.fail("rename", from, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := d.fs.store.GetObject(ctx, objectName(from), pw)
+		pw.CloseWithError(err)
+	}()
+	_, err = d.fs.store.PutObject(ctx, objectName(to), pr, manifest.ObjectAttributes)
+	pr.CloseWithError(err)
+	if err != nil {
+		return d.fs.fail("rename", from, err)
+	}
+	if err := d.fs.store.DeleteObject(ctx, objectName(from)); err != nil {
+		return d.fs.fail("rename", from, err)
+	}
+	d.fs.moveFile(from, to)
+	return nil
+}
+
+// renameIndexed renames a file, or else a directory with everything in it,
+// by moving manifests in the store's index
+func (f *FS) renameIndexed(ctx context.Context, from, to string) error {
+	err := f.store.RenameObject(ctx, objectName(from), objectName(to))
+	if err == nil {
+		f.moveFile(from, to)
+		return nil
+	}
+	if !errors.Is(err, block.ErrBlockNotFound) {
+		return f.fail("rename", from, err)
+	}
+
+	// Not a file, so a directory, which may only replace an empty one
+	names, err := f.store.ListObjects(ctx, dirMarker(to))
+	if err != nil {
+		return f.fail("rename", from, err)
+	}
+	for _, name := range names {
+		if name != dirMarker(to) {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+	}
+	err = f.store.RenamePrefix(ctx, dirMarker(from), dirMarker(to))
+	switch {
+	case errors.Is(err, meta.ErrTooManyEntries):
+		// mv copies the tree itself instead
+		return fuse.Errno(syscall.EXDEV)
+	case errors.Is(err, meta.ErrInvalidRename):
+		return fuse.Errno(syscall.EINVAL)
+	case err != nil:
+		return f.fail("rename", from, err)
+	}
+	f.moveTree(from, to)
+	return nil
+}
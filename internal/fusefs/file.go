@@ -0,0 +1,459 @@
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/3fs-storage/internal/block"
+)
+
+// file is a regular file: the object named by its path. The kernel keeps
+// a file's node when it is renamed, so a path has one node, whose path
+// changes with the file's; it is guarded by the filesystem's lock.
+type file struct {
+	fs   *FS
+	path string
+}
+
+// fileNode returns the node of the file at a path
+func (f *FS) fileNode(p string) *file {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.files[p]; ok {
+		return n
+	}
+	n := &file{fs: f, path: p}
+	f.files[p] = n
+	return n
+}
+
+// moveFile gives the node of a renamed file its new path
+func (f *FS) moveFile(from, to string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.files[from]; ok {
+		delete(f.files, from)
+		n.path = to
+		f.files[to] = n
+	}
+}
+
+// moveTree gives the nodes of a renamed directory, and of everything in
+// it, their new paths
+func (f *FS) moveTree(from, to string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if n, ok := f.dirs[from]; ok {
+		delete(f.dirs, from)
+		n.path = to
+		f.dirs[to] = n
+	}
+	prefix := from + "/"
+	for p, n := range f.files {
+		if strings.HasPrefix(p, prefix) {
+			delete(f.files, p)
+			n.path = to + "/" + p[len(prefix):]
+			f.files[n.path] = n
+		}
+	}
+	for p, n := range f.dirs {
+		if strings.HasPrefix(p, prefix) {
+			delete(f.dirs, p)
+			n.path = to + "/" + p[len(prefix):]
+			f.dirs[n.path] = n
+		}
+	}
+}
+
+// removeFile drops the node of a deleted file, so that a file created in
+// its place gets a node of its own
+func (f *FS) removeFile(p string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.files, p)
+}
+
+// removeDir drops the node of a deleted directory
+func (f *FS) removeDir(p string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.dirs, p)
+}
+
+// name returns the file's path
+func (f *file) name() string {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.path
+}
+
+// Forget drops the node once the kernel no longer refers to it
+func (f *file) Forget() {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if f.fs.files[f.path] == f {
+		delete(f.fs.files, f.path)
+	}
+}
+
+// Attr describes the file from its manifest, or from its staged contents
+// while it is being written
+func (f *file) Attr(ctx context.Context, attr *fuse.Attr) error {
+	p := f.name()
+	attr.Valid = attrValid
+	attr.Mode = 0o644
+	attr.Uid = f.fs.uid
+	attr.Gid = f.fs.gid
+	attr.BlockSize = uint32(block.DefaultObjectBlockSize)
+
+	if w := f.fs.writerFor(p); w != nil {
+		size, err := w.size()
+		if err != nil {
+			return f.fs.fail("getattr", p, err)
+		}
+		attr.Size = uint64(size)
+		attr.Blocks = (attr.Size + 511) / 512
+		attr.Mtime = time.Now()
+		attr.Ctime = attr.Mtime
+		return nil
+	}
+
+	manifest, err := f.fs.store.HeadObject(ctx, objectName(p))
+	if err != nil {
+		return f.fs.fail("getattr", p, err)
+	}
+	attr.Size = uint64(manifest.Size)
+	attr.Blocks = (attr.Size + 511) / 512
+	attr.Mtime = time.Unix(0, manifest.CreatedAt)
+	attr.Ctime = attr.Mtime
+	attr.Crtime = attr.Mtime
+	return nil
+}
+
+// Open opens the file. Reading handles read the object as it was when
+// opened; writing handles stage the file locally until it is flushed.
+func (f *file) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fs.Handle, error) {
+	p := f.name()
+	if !req.Flags.IsReadOnly() {
+		if err := f.fs.checkWritable(); err != nil {
+			return nil, err
+		}
+		w, err := f.fs.openWriter(ctx, p, req.Flags&fuse.OpenTruncate != 0)
+		if err != nil {
+			return nil, f.fs.fail("open", p, err)
+		}
+		return w, nil
+	}
+
+	if w := f.fs.retainWriter(p); w != nil {
+		// Opened for reading while being written: read the staged data
+		return w, nil
+	}
+	manifest, err := f.fs.store.HeadObject(ctx, objectName(p))
+	if err != nil {
+		return nil, f.fs.fail("open", p, err)
+	}
+	return &reader{fs: f.fs, manifest: manifest, index: -1}, nil
+}
+
+// Setattr changes the file's size. Other attributes are fixed, and
+// changes to them are accepted and ignored, so that tools setting modes
+// or times on copied files work.
+func (f *file) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if req.Valid.Size() {
+		p := f.name()
+		if err := f.fs.checkWritable(); err != nil {
+			return err
+		}
+		w, err := f.fs.openWriter(ctx, p, false)
+		if err != nil {
+			return f.fs.fail("truncate", p, err)
+		}
+		err = w.truncate(int64(req.Size))
+		if releaseErr := w.release(ctx); err == nil {
+			err = releaseErr
+		}
+		if err != nil {
+			return f.fs.fail("truncate", p, err)
+		}
+	}
+	return f.Attr(ctx, &resp.Attr)
+}
+
+// Fsync stores the file if it is being written
+func (f *file) Fsync(ctx context.Context, _ *fuse.FsyncRequest) error {
+	p := f.name()
+	if w := f.fs.writerFor(p); w != nil {
+		if err := w.commit(ctx); err != nil {
+			return f.fs.fail("fsync", p, err)
+		}
+	}
+	return nil
+}
+
+// reader reads an object opened for reading. It keeps the last block it
+// read, as the kernel reads far less than a block at a time.
+type reader struct {
+	fs       *FS
+	manifest *block.ObjectManifest
+	mu       sync.Mutex
+	index    int
+	data     []byte
+}
+
+// Read reads from the blocks covering the requested range
+func (r *reader) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	offset := req.Offset
+	buf := make([]byte, 0, req.Size)
+	for len(buf) < req.Size && offset < r.manifest.Size {
+		index, start := r.manifest.BlockAt(offset)
+		if index != r.index {
+			data, err := r.fs.store.ReadObjectBlock(ctx, r.manifest, index)
+			if err != nil {
+				return r.fs.fail("read", r.manifest.Name, err)
+			}
+			r.index, r.data = index, data
+		}
+		n := len(r.data) - int(offset-start)
+		if n > req.Size-len(buf) {
+			n = req.Size - len(buf)
+		}
+		buf = append(buf, r.data[offset-start:offset-start+int64(n)]...)
+		offset += int64(n)
+	}
+	resp.Data = buf
+	return nil
+}
+
+// writer stages a file being written in a temporary file. Every handle
+// open for writing on a path shares its writer, which stores the file on
+// each flush that follows a change and is discarded with the last handle.
+type writer struct {
+	fs    *FS
+	path  string
+	attrs block.ObjectAttributes
+	mu    sync.Mutex
+	tmp   *os.File
+	dirty bool
+	refs  int
+}
+
+// openWriter returns the writer of a path, creating it from the stored
+// object unless the file is truncated
+func (f *FS) openWriter(ctx context.Context, p string, truncate bool) (*writer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if w, ok := f.writers[p]; ok {
+		w.retain()
+		if truncate {
+			if err := w.truncate(0); err != nil {
+				w.mu.Lock()
+				w.refs--
+				w.mu.Unlock()
+				return nil, err
+			}
+		}
+		return w, nil
+	}
+
+	tmp, err := os.CreateTemp(f.opts.TempDir, "3fs-mount-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create staging file: %w", err)
+	}
+	os.Remove(tmp.Name())
+	w := &writer{fs: f, path: p, tmp: tmp, refs: 1, dirty: truncate}
+
+	if !truncate {
+		manifest, err := f.store.GetObject(ctx, objectName(p), tmp)
+		switch {
+		case err == nil:
+			w.attrs = manifest.ObjectAttributes
+		case errors.Is(err, block.ErrBlockNotFound):
+			w.dirty = true
+		default:
+			tmp.Close()
+			return nil, err
+		}
+	}
+	f.writers[p] = w
+	return w, nil
+}
+
+// writerFor returns the writer of a path, or nil if it is not being
+// written
+func (f *FS) writerFor(p string) *writer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.writers[p]
+}
+
+// retainWriter adds a handle to the writer of a path, returning nil if
+// it is not being written
+func (f *FS) retainWriter(p string) *writer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	w := f.writers[p]
+	if w != nil {
+		w.retain()
+	}
+	return w
+}
+
+// writing reports whether a path is being written
+func (f *FS) writing(p string) bool {
+	return f.writerFor(p) != nil
+}
+
+// writingUnder returns the paths being written directly in the directory
+// with a prefix
+func (f *FS) writingUnder(prefix string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var paths []string
+	for p := range f.writers {
+		if strings.HasPrefix(p, prefix) && !strings.Contains(p[len(prefix):], "/") {
+			paths = append(paths, p)
+		}
+	}
+	return paths
+}
+
+// writingBelow reports whether any path under a prefix is being written
+func (f *FS) writingBelow(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for p := range f.writers {
+		if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// retain adds a handle to the writer
+func (w *writer) retain() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.refs++
+}
+
+// size returns the size of the staged file
+func (w *writer) size() (int64, error) {
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// truncate changes the size of the staged file
+func (w *writer) truncate(size int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err := w.tmp.Truncate(size); err != nil {
+		return fmt.Errorf("failed to truncate staging file: %w", err)
+	}
+	w.dirty = true
+	return nil
+}
+
+// Read reads the staged file
+func (w *writer) Read(_ context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
+	buf := make([]byte, req.Size)
+	n, err := w.tmp.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return w.fs.fail("read", w.path, err)
+	}
+	resp.Data = buf[:n]
+	return nil
+}
+
+// Write writes to the staged file
+func (w *writer) Write(_ context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n, err := w.tmp.WriteAt(req.Data, req.Offset)
+	resp.Size = n
+	w.dirty = true
+	if err != nil {
+		return w.fs.fail("write", w.path, err)
+	}
+	return nil
+}
+
+// Flush stores the file when a descriptor of it is closed, so that close
+// reports a failure to store it
+func (w *writer) Flush(ctx context.Context, _ *fuse.FlushRequest) error {
+	if err := w.commit(ctx); err != nil {
+		return w.fs.fail("flush", w.path, err)
+	}
+	return nil
+}
+
+// Release drops a handle, storing the file if it changed since the last
+// flush
+func (w *writer) Release(ctx context.Context, _ *fuse.ReleaseRequest) error {
+	if err := w.release(ctx); err != nil {
+		return w.fs.fail("release", w.path, err)
+	}
+	return nil
+}
+
+// commit stores the staged file as the file's object if it changed
+func (w *writer) commit(ctx context.Context) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.dirty {
+		return nil
+	}
+
+	info, err := w.tmp.Stat()
+	if err != nil {
+		return err
+	}
+	data := io.NewSectionReader(w.tmp, 0, info.Size())
+	if _, err := w.fs.store.PutObject(ctx, objectName(w.path), data, w.attrs); err != nil {
+		return fmt.Errorf("failed to store %s: %w", w.path, err)
+	}
+	w.dirty = false
+	return nil
+}
+
+// release drops a handle. The last one stores the file and discards the
+// writer, even if storing it failed, so that a failing file does not stay
+// open forever. A writer reopened while it was being stored is kept.
+func (w *writer) release(ctx context.Context) error {
+	w.mu.Lock()
+	w.refs--
+	last := w.refs == 0
+	w.mu.Unlock()
+	if !last {
+		return nil
+	}
+
+	err := w.commit(ctx)
+
+	w.fs.mu.Lock()
+	defer w.fs.mu.Unlock()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.refs == 0 {
+		delete(w.fs.writers, w.path)
+		w.tmp.Close()
+	}
+	return err
+}
@@ -0,0 +1,208 @@
+// Package fusefs mounts an object store as a filesystem through FUSE, so
+// that programs can read and write objects with ordinary file IO. A file
+// is the object named by its path, escaped as the S3 gateway escapes keys,
+// so a bucket uploaded through the gateway can be mounted and read as a
+// directory tree. Directories are implied by the '/' in object names; an
+// empty directory is kept as a marker object whose name ends in '/', as S3
+// tools do.
+//
+// Objects are written whole: a file opened for writing is staged in a
+// local temporary file and stored as a new object when it is flushed, so
+// readers see either the previous or the new contents of a file and never
+// a partial write.
+package fusefs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	"bazil.org/fuse/fs"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// attrValid is how long the kernel caches attributes and lookups. Objects
+// written by other clients appear after at most this long.
+const attrValid = time.Second
+
+// Options configures a mount
+type Options struct {
+	// ReadOnly refuses every change to the filesystem
+	ReadOnly bool
+	// AllowOther lets users other than the one mounting access the files
+	AllowOther bool
+	// TempDir is where files being written are staged; empty uses the
+	// system's temporary directory
+	TempDir string
+	// Subdir is the directory mounted as the root, so that a namespace
+	// can hold several filesystems; empty mounts the whole namespace
+	Subdir string
+}
+
+// FS is a filesystem backed by an object store
+type FS struct {
+	store   *block.ObjectStore
+	opts    Options
+	logger  *slog.Logger
+	uid     uint32
+	gid     uint32
+	mu      sync.Mutex
+	files   map[string]*file
+	dirs    map[string]*dir
+	writers map[string]*writer
+}
+
+// New creates a filesystem over an object store kept in a namespace
+func New(store *block.ObjectStore, opts Options, logger *slog.Logger) *FS {
+	return &FS{
+		store:   store,
+		opts:    opts,
+		logger:  logging.Component(logger, "fuse"),
+		uid:     uint32(os.Getuid()),
+		gid:     uint32(os.Getgid()),
+		files:   make(map[string]*file),
+		dirs:    make(map[string]*dir),
+		writers: make(map[string]*writer),
+	}
+}
+
+// Root returns the root directory
+func (f *FS) Root() (fs.Node, error) {
+	return &dir{fs: f, path: strings.Trim(f.opts.Subdir, "/")}, nil
+}
+
+// Mount is a mounted filesystem being served
+type Mount struct {
+	mountpoint string
+	done       chan struct{}
+	err        error
+}
+
+// Mount mounts the filesystem on a directory and serves it in the
+// background until it is unmounted, with Unmount or by the system
+func (f *FS) Mount(mountpoint, fsName string) (*Mount, error) {
+	options := []fuse.MountOption{
+		fuse.FSName(fsName),
+		fuse.Subtype("3fs"),
+		fuse.MaxReadahead(uint32(block.DefaultObjectBlockSize)),
+	}
+	if f.opts.ReadOnly {
+		options = append(options, fuse.ReadOnly())
+	}
+	if f.opts.AllowOther {
+		options = append(options, fuse.AllowOther())
+	}
+
+	conn, err := fuse.Mount(mountpoint, options...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to mount %s: %w", mountpoint, err)
+	}
+
+	m := &Mount{mountpoint: mountpoint, done: make(chan struct{})}
+	go func() {
+		defer close(m.done)
+		defer conn.Close()
+		if err := fs.Serve(conn, f); err != nil {
+			m.err = fmt.Errorf("failed to serve %s: %w", mountpoint, err)
+		}
+		f.logger.Info("filesystem unmounted", "mountpoint", mountpoint)
+	}()
+
+	// The mount is complete once the kernel has initialised it, which
+	// needs the connection to be served
+	<-conn.Ready
+	if conn.MountError != nil {
+		Unmount(mountpoint)
+		<-m.done
+		return nil, fmt.Errorf("failed to mount %s: %w", mountpoint, conn.MountError)
+	}
+	f.logger.Info("filesystem mounted", "mountpoint", mountpoint, "source", fsName)
+	return m, nil
+}
+
+// Wait blocks until the filesystem is unmounted
+func (m *Mount) Wait() error {
+	<-m.done
+	return m.err
+}
+
+// Unmount unmounts the filesystem, which fails while files are open on it
+func (m *Mount) Unmount() error {
+	return Unmount(m.mountpoint)
+}
+
+// Unmount unmounts the filesystem mounted on a directory
+func Unmount(mountpoint string) error {
+	return fuse.Unmount(mountpoint)
+}
+
+// objectName returns the name of the object holding the file at a path
+func objectName(p string) string {
+	return block.EscapeName(p)
+}
+
+// dirMarker returns the name of the marker object of a directory
+func dirMarker(p string) string {
+	return block.EscapeName(p + "/")
+}
+
+// childPath returns the path of an entry of a directory
+func childPath(dir, name string) string {
+	if dir == "" {
+		return name
+	}
+	return path.Join(dir, name)
+}
+
+// toErrno turns an error of the object store into the errno the kernel
+// returns to the program
+func toErrno(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, block.ErrBlockNotFound):
+		return fuse.ENOENT
+	case errors.Is(err, api.ErrForbidden), errors.Is(err, api.ErrUnauthenticated):
+		return fuse.Errno(syscall.EACCES)
+	case errors.Is(err, api.ErrReadOnly):
+		return fuse.Errno(syscall.EROFS)
+	case errors.Is(err, api.ErrThrottled):
+		return fuse.Errno(syscall.EAGAIN)
+	case errors.Is(err, context.Canceled):
+		return fuse.EINTR
+	}
+	var errno fuse.ErrorNumber
+	if errors.As(err, &errno) {
+		return err
+	}
+	return fuse.EIO
+}
+
+// fail logs an error that the kernel only sees as an errno, and returns
+// the errno
+func (f *FS) fail(op, p string, err error) error {
+	errno := toErrno(err)
+	if errno == fuse.EIO {
+		f.logger.Warn("filesystem operation failed", "op", op, "path", p, "error", err)
+	}
+	return errno
+}
+
+// checkWritable refuses changes to a read-only mount
+func (f *FS) checkWritable() error {
+	if f.opts.ReadOnly {
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
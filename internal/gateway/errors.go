@@ -0,0 +1,132 @@
+package gateway
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// s3Error is an error reported to the client with an S3 error code
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+// Error returns the error's code and message
+func (e *s3Error) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// newError creates an S3 error with a formatted message
+func newError(status int, code, format string, args ...interface{}) *s3Error {
+	return &s3Error{Code: code, Message: fmt.Sprintf(format, args...), Status: status}
+}
+
+// Errors the gateway reports, named after their S3 error codes
+var (
+	errSignatureDoesNotMatch = newError(http.StatusForbidden, "SignatureDoesNotMatch",
+		"The request signature we calculated does not match the signature you provided")
+	errInvalidAccessKeyID = newError(http.StatusForbidden, "InvalidAccessKeyId",
+		"The access key ID you provided does not exist in our records")
+	errRequestTimeTooSkewed = newError(http.StatusForbidden, "RequestTimeTooSkewed",
+		"The difference between the request time and the server's time is too large")
+	errContentSHA256Mismatch = newError(http.StatusBadRequest, "XAmzContentSHA256Mismatch",
+		"The provided 'x-amz-content-sha256' header does not match what was computed")
+	errBadDigest = newError(http.StatusBadRequest, "BadDigest",
+		"The checksum you specified did not match what we received")
+	errIncompleteBody = newError(http.StatusBadRequest, "IncompleteBody",
+		"You did not provide the number of bytes specified by the Content-Length HTTP header")
+	errEntityTooLarge = newError(http.StatusBadRequest, "EntityTooLarge",
+		"Your proposed upload exceeds the maximum allowed object size")
+	errKeyTooLong = newError(http.StatusBadRequest, "KeyTooLongError",
+		"Your key is too long")
+	errNoSuchKey = newError(http.StatusNotFound, "NoSuchKey",
+		"The specified key does not exist")
+	errNoSuchBucket = newError(http.StatusNotFound, "NoSuchBucket",
+		"The specified bucket does not exist")
+	errMethodNotAllowed = newError(http.StatusMethodNotAllowed, "MethodNotAllowed",
+		"The specified method is not allowed against this resource")
+	errNotImplemented = newError(http.StatusNotImplemented, "NotImplemented",
+		"A header or query you provided implies functionality that is not implemented")
+)
+
+// errAccessDenied reports a request refused for the reason given
+func errAccessDenied(format string, args ...interface{}) *s3Error {
+	return newError(http.StatusForbidden, "AccessDenied", format, args...)
+}
+
+// errInvalidArgument reports a request argument that cannot be used
+func errInvalidArgument(format string, args ...interface{}) *s3Error {
+	return newError(http.StatusBadRequest, "InvalidArgument", format, args...)
+}
+
+// errMalformedAuthorization reports an Authorization header that cannot be
+// parsed or names the wrong scope
+func errMalformedAuthorization(format string, args ...interface{}) *s3Error {
+	return newError(http.StatusBadRequest, "AuthorizationHeaderMalformed", format, args...)
+}
+
+// errorBody is the XML body of an error response
+type errorBody struct {
+	XMLName   xml.Name `xml:"Error"`
+	Code      string   `xml:"Code"`
+	Message   string   `xml:"Message"`
+	Resource  string   `xml:"Resource"`
+	RequestID string   `xml:"RequestId"`
+}
+
+// toS3Error translates an error of the block layer to the S3 error the
+// client sees
+func toS3Error(err error) *s3Error {
+	var s3Err *s3Error
+	var redirect *api.RedirectError
+	switch {
+	case errors.As(err, &s3Err):
+		return s3Err
+	case errors.Is(err, block.ErrBlockNotFound):
+		return errNoSuchKey
+	case errors.Is(err, api.ErrForbidden), errors.Is(err, api.ErrUnauthenticated):
+		return errAccessDenied("Access Denied")
+	case errors.Is(err, api.ErrThrottled), errors.Is(err, api.ErrBackpressure):
+		return newError(http.StatusServiceUnavailable, "SlowDown", "Please reduce your request rate")
+	case errors.Is(err, api.ErrNoSpace), errors.Is(err, api.ErrQuotaExceeded):
+		return newError(http.StatusInsufficientStorage, "InsufficientStorage", "%s", err)
+	case errors.Is(err, api.ErrReadOnly), errors.As(err, &redirect), errors.Is(err, block.ErrEpochExpired):
+		return newError(http.StatusServiceUnavailable, "ServiceUnavailable", "%s", err)
+	}
+	return newError(http.StatusInternalServerError, "InternalError", "%s", err)
+}
+
+// writeError writes an S3 error response. Responses to HEAD requests have
+// no body, so they only carry the status.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	s3Err := toS3Error(err)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(s3Err.Status)
+		return
+	}
+	writeXML(w, s3Err.Status, &errorBody{
+		Code:      s3Err.Code,
+		Message:   s3Err.Message,
+		Resource:  r.URL.Path,
+		RequestID: w.Header().Get(requestIDHeader),
+	})
+}
+
+// writeXML writes v as an XML response body
+func writeXML(w http.ResponseWriter, status int, v interface{}) {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	w.Write([]byte(xml.Header))
+	w.Write(data)
+}
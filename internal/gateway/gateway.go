@@ -0,0 +1,204 @@
+// Package gateway serves the cluster's objects over a subset of the S3
+// API, so that existing S3 tools and libraries can read and write them.
+// Each bucket is an object store kept in the block namespace of the same
+// name; requests reach it as the client identity their signature proves,
+// so the node's ACL decides what they may do.
+package gateway
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/auth"
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/meta"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// requestIDHeader is the response header carrying the request's ID
+const requestIDHeader = "X-Amz-Request-Id"
+
+// Backend is the storage the gateway keeps its objects in
+type Backend interface {
+	// Blocks returns the block API objects are stored through. Calls carry
+	// the client's identity in their context.
+	Blocks() block.Blocks
+	// AuditDelete records an object deleted by a client
+	AuditDelete(identity *auth.Identity, remote, blockID string, err error)
+}
+
+// Server is the S3-compatible gateway
+type Server struct {
+	cfg         config.GatewayConfig
+	backend     Backend
+	logger      *slog.Logger
+	buckets     map[string]*block.ObjectStore
+	credentials map[string]config.S3CredentialConfig
+	server      *http.Server
+}
+
+// New creates a gateway serving the configured buckets from a backend
+func New(cfg config.GatewayConfig, backend Backend, logger *slog.Logger) (*Server, error) {
+	s := &Server{
+		cfg:         cfg,
+		backend:     backend,
+		logger:      logging.Component(logger, "gateway"),
+		buckets:     make(map[string]*block.ObjectStore, len(cfg.Buckets)),
+		credentials: make(map[string]config.S3CredentialConfig, len(cfg.Credentials)),
+	}
+	for _, bucket := range cfg.Buckets {
+		store, err := block.NewNamespacedObjectStore(backend.Blocks(), 0, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open bucket %s: %w", bucket, err)
+		}
+		if err := store.SetStripeWidth(cfg.StripeWidth); err != nil {
+			return nil, err
+		}
+		if cfg.Metadata.Backend != "" {
+			index, err := meta.Open(cfg.Metadata, backend.Blocks(), bucket)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open the metadata of bucket %s: %w", bucket, err)
+			}
+			store.SetIndex(index)
+		}
+		s.buckets[bucket] = store
+	}
+	for _, c := range cfg.Credentials {
+		s.credentials[c.AccessKey] = c
+	}
+	s.server = &http.Server{
+		Handler:           s,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	return s, nil
+}
+
+// Start begins serving the gateway on the given address
+func (s *Server) Start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+
+	go func() {
+		if err := s.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Error("gateway server failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop shuts the gateway down, waiting briefly for active requests
+func (s *Server) Stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return s.server.Shutdown(ctx)
+}
+
+// ServeHTTP authenticates a request and routes it to the bucket or object
+// operation it names
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set(requestIDHeader, newRequestID())
+	w.Header().Set("Server", "3fs-storage")
+
+	identity, sig, err := s.authenticate(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	ctx := auth.WithIdentity(r.Context(), identity)
+	req := &request{
+		w:        w,
+		r:        r.WithContext(ctx),
+		identity: identity,
+		signing:  sig,
+	}
+	req.bucket, req.key = s.route(r)
+
+	if req.bucket == "" {
+		if r.Method != http.MethodGet {
+			writeError(w, r, errMethodNotAllowed)
+			return
+		}
+		s.listBuckets(req)
+		return
+	}
+	store, ok := s.buckets[req.bucket]
+	if !ok {
+		writeError(w, r, errNoSuchBucket)
+		return
+	}
+	req.store = store
+
+	if req.key == "" {
+		s.serveBucket(req)
+	} else {
+		s.serveObject(req)
+	}
+}
+
+// route returns the bucket and key a request names, from the host of a
+// virtual-hosted-style request or the path of a path-style one
+func (s *Server) route(r *http.Request) (string, string) {
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	if s.cfg.Domain != "" {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if bucket := strings.TrimSuffix(host, "."+s.cfg.Domain); bucket != host && bucket != "" {
+			return bucket, path
+		}
+	}
+	bucket, key, _ := strings.Cut(path, "/")
+	return bucket, key
+}
+
+// authenticate returns the identity a request is signed by, in its
+// Authorization header or in the query of a pre-signed URL, or the
+// anonymous identity for an unsigned request if the gateway allows them
+func (s *Server) authenticate(r *http.Request) (*auth.Identity, *signing, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" && !presigned(r) {
+		if !s.cfg.Anonymous {
+			return nil, nil, errAccessDenied("Anonymous access is not allowed")
+		}
+		return auth.Anonymous(), nil, nil
+	}
+
+	verify := s.verifySignature
+	authz, err := parseAuthorization(header)
+	if header == "" {
+		verify = s.verifyPresigned
+		authz, err = parsePresigned(r.URL.Query())
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	credential, ok := s.credentials[authz.accessKey]
+	if !ok {
+		return nil, nil, errInvalidAccessKeyID
+	}
+	sig, err := verify(r, authz, credential.SecretKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &auth.Identity{Name: credential.Identity, Method: auth.MethodSigV4}, sig, nil
+}
+
+// newRequestID returns a random ID for a request
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return strings.ToUpper(hex.EncodeToString(buf))
+}
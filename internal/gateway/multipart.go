@@ -0,0 +1,313 @@
+package gateway
+
+import (
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+)
+
+// Limits of multipart uploads the gateway keeps to, as S3 does
+const (
+	// maxPartNumber is the highest part number of an upload
+	maxPartNumber = 10000
+	// maxPartSize is the largest part
+	maxPartSize = 5 << 30
+	// minPartSize is the smallest part other than the last
+	minPartSize = 5 << 20
+	// maxCompleteBodySize bounds the body listing the parts of an upload
+	maxCompleteBodySize = 2 << 20
+	// maxListParts is the most parts a listing returns at once
+	maxListParts = 1000
+)
+
+// Errors of multipart uploads, named after their S3 error codes
+var (
+	errNoSuchUpload = newError(http.StatusNotFound, "NoSuchUpload",
+		"The specified upload does not exist. The upload ID may be invalid, or the upload may have been aborted or completed.")
+	errInvalidPart = newError(http.StatusBadRequest, "InvalidPart",
+		"One or more of the specified parts could not be found. The part may not have been uploaded, or the specified entity tag may not match the part's entity tag.")
+	errInvalidPartOrder = newError(http.StatusBadRequest, "InvalidPartOrder",
+		"The list of parts was not in ascending order. Parts must be ordered by part number.")
+	errEntityTooSmall = newError(http.StatusBadRequest, "EntityTooSmall",
+		"Your proposed upload is smaller than the minimum allowed object size.")
+	errMalformedXML = newError(http.StatusBadRequest, "MalformedXML",
+		"The XML you provided was not well-formed or did not validate against our published schema")
+)
+
+// serveMultipart serves the multipart upload operations on an object,
+// returning false if the request is not one
+func (s *Server) serveMultipart(req *request, name string) bool {
+	query := req.r.URL.Query()
+	switch {
+	case query.Has("uploads") && req.r.Method == http.MethodPost:
+		s.createUpload(req, name)
+	case query.Has("uploads"):
+		writeError(req.w, req.r, errMethodNotAllowed)
+	case !query.Has("uploadId"):
+		return false
+	case req.r.Method == http.MethodPut:
+		s.uploadPart(req, name)
+	case req.r.Method == http.MethodPost:
+		s.completeUpload(req, name)
+	case req.r.Method == http.MethodDelete:
+		s.abortUpload(req, name)
+	case req.r.Method == http.MethodGet:
+		s.listParts(req, name)
+	default:
+		writeError(req.w, req.r, errMethodNotAllowed)
+	}
+	return true
+}
+
+// initiateResult is the response of CreateMultipartUpload
+type initiateResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadID string   `xml:"UploadId"`
+}
+
+// createUpload starts a multipart upload of an object, which will carry
+// the content type and metadata of this request
+func (s *Server) createUpload(req *request, name string) {
+	upload, err := req.store.CreateUpload(req.r.Context(), name, objectAttributes(req.r))
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	writeXML(req.w, http.StatusOK, &initiateResult{
+		Xmlns:    s3Namespace,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		UploadID: upload.ID,
+	})
+}
+
+// upload loads the upload a request names, which must be of the object
+// it names. It sends the error and returns nil if there is none.
+func (s *Server) upload(req *request, name string) *block.Upload {
+	upload, err := req.store.GetUpload(req.r.Context(), req.r.URL.Query().Get("uploadId"))
+	if errors.Is(err, block.ErrBlockNotFound) || err == nil && upload.Name != name {
+		writeError(req.w, req.r, errNoSuchUpload)
+		return nil
+	}
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return nil
+	}
+	return upload
+}
+
+// uploadPart stores the request body as a part of an upload. A part
+// uploaded again replaces the earlier one, so failed parts are retried
+// on their own.
+func (s *Server) uploadPart(req *request, name string) {
+	number, err := strconv.Atoi(req.r.URL.Query().Get("partNumber"))
+	if err != nil || number < 1 || number > maxPartNumber {
+		writeError(req.w, req.r, errInvalidArgument("Part number must be an integer between 1 and %d, inclusive", maxPartNumber))
+		return
+	}
+	upload := s.upload(req, name)
+	if upload == nil {
+		return
+	}
+	body, size, err := requestBody(req.r, req.signing)
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	if size > maxPartSize {
+		writeError(req.w, req.r, errEntityTooLarge)
+		return
+	}
+
+	part, err := req.store.UploadPart(req.r.Context(), upload.ID, number, &limitedReader{r: body, left: maxPartSize})
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	req.w.Header().Set("ETag", `"`+part.MD5+`"`)
+	req.w.WriteHeader(http.StatusOK)
+}
+
+// completeRequest is the body of CompleteMultipartUpload
+type completeRequest struct {
+	XMLName xml.Name       `xml:"CompleteMultipartUpload"`
+	Parts   []completePart `xml:"Part"`
+}
+
+// completePart is a part named in CompleteMultipartUpload
+type completePart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// completeResult is the response of CompleteMultipartUpload
+type completeResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:"Location"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	ETag     string   `xml:"ETag"`
+}
+
+// completeUpload makes the object of an upload from the parts the request
+// lists, which must have been uploaded with the ETags given, in ascending
+// order and, but for the last, of at least 5MiB
+func (s *Server) completeUpload(req *request, name string) {
+	upload := s.upload(req, name)
+	if upload == nil {
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(req.r.Body, maxCompleteBodySize+1))
+	if err != nil {
+		writeError(req.w, req.r, errIncompleteBody)
+		return
+	}
+	var complete completeRequest
+	if len(body) > maxCompleteBodySize || xml.Unmarshal(body, &complete) != nil || len(complete.Parts) == 0 {
+		writeError(req.w, req.r, errMalformedXML)
+		return
+	}
+
+	numbers := make([]int, len(complete.Parts))
+	for i, p := range complete.Parts {
+		if i > 0 && p.PartNumber <= complete.Parts[i-1].PartNumber {
+			writeError(req.w, req.r, errInvalidPartOrder)
+			return
+		}
+		part, ok := upload.Parts[p.PartNumber]
+		if !ok || strings.Trim(p.ETag, `"`) != part.MD5 {
+			writeError(req.w, req.r, errInvalidPart)
+			return
+		}
+		if i < len(complete.Parts)-1 && part.Size < minPartSize {
+			writeError(req.w, req.r, errEntityTooSmall)
+			return
+		}
+		numbers[i] = p.PartNumber
+	}
+
+	manifest, err := req.store.CompleteUpload(req.r.Context(), upload.ID, numbers)
+	if errors.Is(err, block.ErrInvalidPart) {
+		err = errInvalidPart
+	}
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	location := "http://" + req.r.Host + req.r.URL.Path
+	if req.r.TLS != nil {
+		location = "https://" + req.r.Host + req.r.URL.Path
+	}
+	writeXML(req.w, http.StatusOK, &completeResult{
+		Xmlns:    s3Namespace,
+		Location: location,
+		Bucket:   req.bucket,
+		Key:      req.key,
+		ETag:     etag(manifest),
+	})
+}
+
+// abortUpload discards an upload and the parts uploaded so far
+func (s *Server) abortUpload(req *request, name string) {
+	upload := s.upload(req, name)
+	if upload == nil {
+		return
+	}
+	if err := req.store.AbortUpload(req.r.Context(), upload.ID); err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+}
+
+// listPartsResult is the response of ListParts
+type listPartsResult struct {
+	XMLName              xml.Name   `xml:"ListPartsResult"`
+	Xmlns                string     `xml:"xmlns,attr"`
+	Bucket               string     `xml:"Bucket"`
+	Key                  string     `xml:"Key"`
+	UploadID             string     `xml:"UploadId"`
+	PartNumberMarker     int        `xml:"PartNumberMarker"`
+	NextPartNumberMarker int        `xml:"NextPartNumberMarker"`
+	MaxParts             int        `xml:"MaxParts"`
+	IsTruncated          bool       `xml:"IsTruncated"`
+	Parts                []partInfo `xml:"Part"`
+}
+
+// partInfo describes a part in ListParts
+type partInfo struct {
+	PartNumber   int    `xml:"PartNumber"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+}
+
+// listParts lists the parts of an upload after part-number-marker, so
+// that a client resuming an upload can tell which parts it still needs
+// to send
+func (s *Server) listParts(req *request, name string) {
+	query := req.r.URL.Query()
+	maxParts := maxListParts
+	if value := query.Get("max-parts"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(req.w, req.r, errInvalidArgument("Provided max-parts not an integer or within integer range"))
+			return
+		}
+		maxParts = min(n, maxListParts)
+	}
+	marker := 0
+	if value := query.Get("part-number-marker"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(req.w, req.r, errInvalidArgument("Provided part-number-marker not an integer or within integer range"))
+			return
+		}
+		marker = n
+	}
+
+	upload := s.upload(req, name)
+	if upload == nil {
+		return
+	}
+	parts, err := req.store.ListParts(req.r.Context(), upload.ID)
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	result := &listPartsResult{
+		Xmlns:            s3Namespace,
+		Bucket:           req.bucket,
+		Key:              req.key,
+		UploadID:         upload.ID,
+		PartNumberMarker: marker,
+		MaxParts:         maxParts,
+	}
+	for _, part := range parts {
+		if part.Number <= marker {
+			continue
+		}
+		if len(result.Parts) == maxParts {
+			result.IsTruncated = true
+			break
+		}
+		result.Parts = append(result.Parts, partInfo{
+			PartNumber:   part.Number,
+			LastModified: time.Unix(0, part.UploadedAt).UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         `"` + part.MD5 + `"`,
+			Size:         part.Size,
+		})
+		result.NextPartNumberMarker = part.Number
+	}
+	writeXML(req.w, http.StatusOK, result)
+}
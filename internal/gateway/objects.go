@@ -0,0 +1,465 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/auth"
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// Limits of the S3 API the gateway keeps to
+const (
+	// maxObjectSize is the largest object a single PUT may upload
+	maxObjectSize = 5 << 30
+	// maxListKeys is the most keys a listing returns at once
+	maxListKeys = 1000
+)
+
+// s3Namespace is the XML namespace of S3 responses
+const s3Namespace = "http://s3.amazonaws.com/doc/2006-03-01/"
+
+// metadataPrefix leads the headers carrying an object's user metadata
+const metadataPrefix = "X-Amz-Meta-"
+
+// defaultContentType is the content type of objects uploaded without one
+const defaultContentType = "binary/octet-stream"
+
+// request is a request being served, with what the gateway learned of it
+type request struct {
+	w        http.ResponseWriter
+	r        *http.Request
+	identity *auth.Identity
+	signing  *signing
+	bucket   string
+	key      string
+	store    *block.ObjectStore
+}
+
+// Query parameters of object and bucket operations the gateway does not
+// implement, which must not fall through to the plain operations
+var unsupportedQueries = []string{
+	"acl", "cors", "delete", "lifecycle", "policy", "tagging", "torrent",
+	"versioning", "versionId", "versions", "website",
+}
+
+// unsupported reports whether a request asks for an operation the gateway
+// does not implement
+func (req *request) unsupported() bool {
+	query := req.r.URL.Query()
+	for _, name := range unsupportedQueries {
+		if _, ok := query[name]; ok {
+			return true
+		}
+	}
+	return req.r.Header.Get("X-Amz-Copy-Source") != ""
+}
+
+// serveObject serves the operations on an object
+func (s *Server) serveObject(req *request) {
+	if req.unsupported() {
+		writeError(req.w, req.r, errNotImplemented)
+		return
+	}
+	name := block.EscapeName(req.key)
+	if len(req.bucket)+len(api.NamespaceSeparator)+len(name) > api.MaxBlockIDLength {
+		writeError(req.w, req.r, errKeyTooLong)
+		return
+	}
+	if s.serveMultipart(req, name) {
+		return
+	}
+
+	switch req.r.Method {
+	case http.MethodPut:
+		s.putObject(req, name)
+	case http.MethodGet:
+		s.getObject(req, name)
+	case http.MethodHead:
+		s.headObject(req, name)
+	case http.MethodDelete:
+		s.deleteObject(req, name)
+	default:
+		writeError(req.w, req.r, errMethodNotAllowed)
+	}
+}
+
+// putObject stores the request body as an object
+func (s *Server) putObject(req *request, name string) {
+	body, size, err := requestBody(req.r, req.signing)
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	if size > maxObjectSize {
+		writeError(req.w, req.r, errEntityTooLarge)
+		return
+	}
+
+	manifest, err := req.store.PutObject(req.r.Context(), name, &limitedReader{r: body, left: maxObjectSize}, objectAttributes(req.r))
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	req.w.Header().Set("ETag", etag(manifest))
+	req.w.WriteHeader(http.StatusOK)
+}
+
+// objectAttributes returns the content type and user metadata a request
+// gives an object
+func objectAttributes(r *http.Request) block.ObjectAttributes {
+	attrs := block.ObjectAttributes{ContentType: r.Header.Get("Content-Type")}
+	for header, values := range r.Header {
+		if strings.HasPrefix(header, metadataPrefix) && len(values) > 0 {
+			if attrs.Metadata == nil {
+				attrs.Metadata = make(map[string]string)
+			}
+			attrs.Metadata[strings.ToLower(strings.TrimPrefix(header, metadataPrefix))] = values[0]
+		}
+	}
+	return attrs
+}
+
+// limitedReader fails a body that grows past the largest object size, so
+// that an upload without a known size cannot store a larger object
+type limitedReader struct {
+	r    io.Reader
+	left int64
+}
+
+// Read reads the body until it ends or passes the limit
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.left -= int64(n)
+	if l.left < 0 {
+		return n, errEntityTooLarge
+	}
+	return n, err
+}
+
+// getObject sends an object's data, or the range of it the request asks
+// for. Once the first block is sent the status can no longer change, so a
+// failure past it cuts the response short, which the client notices from
+// the missing bytes.
+func (s *Server) getObject(req *request, name string) {
+	manifest, rng, ok := s.objectHeaders(req, name)
+	if !ok {
+		return
+	}
+
+	// The data is read by the manifest the headers describe, even if the
+	// object is replaced meanwhile
+	if rng == nil {
+		rng = &byteRange{start: 0, length: manifest.Size}
+	}
+	if err := req.store.GetObjectRange(req.r.Context(), manifest, rng.start, rng.length, req.w); err != nil {
+		s.logger.Warn("failed to send object", "bucket", req.bucket, "key", req.key, "error", err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// headObject sends an object's headers without its data
+func (s *Server) headObject(req *request, name string) {
+	s.objectHeaders(req, name)
+}
+
+// objectHeaders sends the status and headers of a GET or HEAD of an
+// object: the whole object's, or with a satisfiable Range those of the
+// part asked for. It returns the object's manifest and the range, or
+// false if it sent an error instead.
+func (s *Server) objectHeaders(req *request, name string) (*block.ObjectManifest, *byteRange, bool) {
+	manifest, err := req.store.HeadObject(req.r.Context(), name)
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return nil, nil, false
+	}
+	rng, err := requestedRange(req.r, manifest)
+	if err != nil {
+		req.w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", manifest.Size))
+		writeError(req.w, req.r, err)
+		return nil, nil, false
+	}
+
+	setObjectHeaders(req.w, manifest)
+	if rng == nil {
+		req.w.WriteHeader(http.StatusOK)
+		return manifest, nil, true
+	}
+	req.w.Header().Set("Content-Length", strconv.FormatInt(rng.length, 10))
+	req.w.Header().Set("Content-Range", rng.contentRange(manifest.Size))
+	req.w.WriteHeader(http.StatusPartialContent)
+	return manifest, rng, true
+}
+
+// deleteObject deletes an object. Deleting an object that does not exist
+// succeeds, as in S3.
+func (s *Server) deleteObject(req *request, name string) {
+	err := req.store.DeleteObject(req.r.Context(), name)
+	if errors.Is(err, block.ErrBlockNotFound) {
+		err = nil
+	}
+	s.backend.AuditDelete(req.identity, req.r.RemoteAddr, req.bucket+api.NamespaceSeparator+name, err)
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	req.w.WriteHeader(http.StatusNoContent)
+}
+
+// setObjectHeaders sets the headers describing an object
+func setObjectHeaders(w http.ResponseWriter, manifest *block.ObjectManifest) {
+	header := w.Header()
+	contentType := manifest.ContentType
+	if contentType == "" {
+		contentType = defaultContentType
+	}
+	header.Set("Content-Type", contentType)
+	header.Set("Content-Length", strconv.FormatInt(manifest.Size, 10))
+	header.Set("Accept-Ranges", "bytes")
+	header.Set("ETag", etag(manifest))
+	header.Set("Last-Modified", time.Unix(0, manifest.CreatedAt).UTC().Format(http.TimeFormat))
+	for name, value := range manifest.Metadata {
+		header.Set(metadataPrefix+name, value)
+	}
+}
+
+// etag returns an object's ETag: the MD5 of its data in quotes
+func etag(manifest *block.ObjectManifest) string {
+	if manifest.MD5 == "" {
+		return `"` + manifest.Checksum + `"`
+	}
+	return `"` + manifest.MD5 + `"`
+}
+
+// serveBucket serves the operations on a bucket
+func (s *Server) serveBucket(req *request) {
+	query := req.r.URL.Query()
+	switch req.r.Method {
+	case http.MethodHead:
+		req.w.WriteHeader(http.StatusOK)
+	case http.MethodGet:
+		switch {
+		case query.Has("location"):
+			writeXML(req.w, http.StatusOK, &locationResult{Xmlns: s3Namespace, Location: s.cfg.Region})
+		case req.unsupported(), query.Has("uploads"):
+			writeError(req.w, req.r, errNotImplemented)
+		case query.Get("list-type") == "2":
+			s.listObjects(req)
+		default:
+			writeError(req.w, req.r, errNotImplemented)
+		}
+	default:
+		writeError(req.w, req.r, errNotImplemented)
+	}
+}
+
+// locationResult is the response of GetBucketLocation
+type locationResult struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+// listBucketsResult is the response of ListBuckets
+type listBucketsResult struct {
+	XMLName xml.Name     `xml:"ListAllMyBucketsResult"`
+	Xmlns   string       `xml:"xmlns,attr"`
+	Owner   owner        `xml:"Owner"`
+	Buckets []bucketInfo `xml:"Buckets>Bucket"`
+}
+
+// owner names the owner of buckets and objects, the client's identity
+type owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+// bucketInfo describes a bucket in ListBuckets
+type bucketInfo struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+// listBuckets lists the buckets the gateway serves. They are configured
+// rather than created, so they carry no creation date of their own.
+func (s *Server) listBuckets(req *request) {
+	result := &listBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: owner{ID: req.identity.Name, DisplayName: req.identity.Name},
+	}
+	for _, bucket := range s.cfg.Buckets {
+		result.Buckets = append(result.Buckets, bucketInfo{
+			Name:         bucket,
+			CreationDate: time.Unix(0, 0).UTC().Format(time.RFC3339),
+		})
+	}
+	writeXML(req.w, http.StatusOK, result)
+}
+
+// listObjectsResult is the response of ListObjectsV2
+type listObjectsResult struct {
+	XMLName               xml.Name       `xml:"ListBucketResult"`
+	Xmlns                 string         `xml:"xmlns,attr"`
+	Name                  string         `xml:"Name"`
+	Prefix                string         `xml:"Prefix"`
+	Delimiter             string         `xml:"Delimiter,omitempty"`
+	StartAfter            string         `xml:"StartAfter,omitempty"`
+	ContinuationToken     string         `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string         `xml:"NextContinuationToken,omitempty"`
+	EncodingType          string         `xml:"EncodingType,omitempty"`
+	KeyCount              int            `xml:"KeyCount"`
+	MaxKeys               int            `xml:"MaxKeys"`
+	IsTruncated           bool           `xml:"IsTruncated"`
+	Contents              []objectInfo   `xml:"Contents"`
+	CommonPrefixes        []commonPrefix `xml:"CommonPrefixes"`
+}
+
+// objectInfo describes an object in a listing
+type objectInfo struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+// commonPrefix is a group of keys sharing the part up to a delimiter
+type commonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+// listObjects serves ListObjectsV2. Continuation tokens carry the last key
+// or common prefix returned, so that a listing resumes after it even if
+// objects were added or removed in between.
+func (s *Server) listObjects(req *request) {
+	query := req.r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	encodingType := query.Get("encoding-type")
+	if encodingType != "" && encodingType != "url" {
+		writeError(req.w, req.r, errInvalidArgument("Invalid Encoding Method specified in Request"))
+		return
+	}
+
+	maxKeys := maxListKeys
+	if value := query.Get("max-keys"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			writeError(req.w, req.r, errInvalidArgument("Provided max-keys not an integer or within integer range"))
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := query.Get("start-after")
+	token := query.Get("continuation-token")
+	if token != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			writeError(req.w, req.r, errInvalidArgument("The continuation token provided is incorrect"))
+			return
+		}
+		after = string(decoded)
+	}
+
+	names, err := req.store.ListObjects(req.r.Context(), block.EscapeName(prefix))
+	if err != nil {
+		writeError(req.w, req.r, err)
+		return
+	}
+	keys := make([]string, 0, len(names))
+	for _, name := range names {
+		key, err := block.UnescapeName(name)
+		if err != nil {
+			s.logger.Warn("skipping object with an invalid name", "bucket", req.bucket, "name", name, "error", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	encode := func(s string) string { return s }
+	if encodingType == "url" {
+		encode = func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "+", "%20") }
+	}
+	result := &listObjectsResult{
+		Xmlns:             s3Namespace,
+		Name:              req.bucket,
+		Prefix:            encode(prefix),
+		Delimiter:         encode(delimiter),
+		StartAfter:        encode(query.Get("start-after")),
+		ContinuationToken: token,
+		EncodingType:      encodingType,
+		MaxKeys:           maxKeys,
+	}
+
+	// A common prefix resumed after covers every key starting with it
+	skipPrefix := ""
+	if delimiter != "" && len(after) > len(prefix) && strings.HasSuffix(after[len(prefix):], delimiter) {
+		skipPrefix = after
+	}
+	last, lastPrefix := "", ""
+	for _, key := range keys {
+		if key <= after || skipPrefix != "" && strings.HasPrefix(key, skipPrefix) {
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) {
+			continue
+		}
+
+		common := ""
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				common = key[:len(prefix)+i+len(delimiter)]
+			}
+		}
+		if common != "" && common == lastPrefix {
+			continue
+		}
+		if result.KeyCount == maxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		if common != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes, commonPrefix{Prefix: encode(common)})
+			last, lastPrefix = common, common
+			result.KeyCount++
+			continue
+		}
+		manifest, err := req.store.HeadObject(req.r.Context(), block.EscapeName(key))
+		if errors.Is(err, block.ErrBlockNotFound) {
+			// Deleted since it was listed
+			continue
+		}
+		if err != nil {
+			writeError(req.w, req.r, err)
+			return
+		}
+		result.Contents = append(result.Contents, objectInfo{
+			Key:          encode(key),
+			LastModified: time.Unix(0, manifest.CreatedAt).UTC().Format("2006-01-02T15:04:05.000Z"),
+			ETag:         etag(manifest),
+			Size:         manifest.Size,
+			StorageClass: "STANDARD",
+		})
+		last = key
+		result.KeyCount++
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+	}
+	writeXML(req.w, http.StatusOK, result)
+}
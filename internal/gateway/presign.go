@@ -0,0 +1,160 @@
+package gateway
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/sigv4"
+)
+
+// MaxPresignExpiry is the longest a pre-signed URL may stay valid, as in S3
+const MaxPresignExpiry = 7 * 24 * time.Hour
+
+// Query parameters carrying the signature of a pre-signed URL
+const (
+	queryAlgorithm     = "X-Amz-Algorithm"
+	queryCredential    = "X-Amz-Credential"
+	queryDate          = "X-Amz-Date"
+	queryExpires       = "X-Amz-Expires"
+	querySignedHeaders = "X-Amz-SignedHeaders"
+	querySignature     = "X-Amz-Signature"
+)
+
+// errPresignExpired reports a pre-signed URL used after it expired
+var errPresignExpired = errAccessDenied("Request has expired")
+
+// PresignURL returns u signed with Signature Version 4 in its query, so
+// that whoever holds it can send a request of the given method to it
+// until it expires, without credentials of their own. The signature
+// covers the method, the path, the query and the host, but not the body,
+// so a pre-signed PUT accepts any data.
+func PresignURL(method string, u *url.URL, accessKey, secretKey, region string, expires time.Duration) (string, error) {
+	if expires <= 0 || expires > MaxPresignExpiry {
+		return "", errors.New("a pre-signed URL must expire within 7 days")
+	}
+	now := time.Now().UTC()
+	amzDate := now.Format(sigv4.DateFormat)
+	date := now.Format(sigv4.ScopeDateFormat)
+	scope := strings.Join([]string{date, region, sigv4.Service, sigv4.Terminator}, "/")
+
+	signed := *u
+	query := signed.Query()
+	query.Set(queryAlgorithm, sigv4.Algorithm)
+	query.Set(queryCredential, accessKey+"/"+scope)
+	query.Set(queryDate, amzDate)
+	query.Set(queryExpires, strconv.Itoa(int(expires/time.Second)))
+	query.Set(querySignedHeaders, "host")
+
+	r := &http.Request{Method: method, URL: &signed, Host: u.Host, Header: http.Header{}}
+	canonical := strings.Join([]string{
+		method,
+		sigv4.Escape(signed.Path, false),
+		sigv4.CanonicalQuery(query),
+		sigv4.CanonicalHeaders(r, []string{"host"}),
+		"host",
+		unsignedPayload,
+	}, "\n")
+	stringToSign := strings.Join([]string{sigv4.Algorithm, amzDate, scope, sigv4.HexSHA256([]byte(canonical))}, "\n")
+	signature := hex.EncodeToString(sigv4.HMACSHA256(sigv4.SigningKey(secretKey, date, region, sigv4.Service), stringToSign))
+
+	query.Set(querySignature, signature)
+	signed.RawQuery = query.Encode()
+	return signed.String(), nil
+}
+
+// presigned reports whether a request is signed in its query
+func presigned(r *http.Request) bool {
+	return r.URL.Query().Has(querySignature)
+}
+
+// parsePresigned parses the signature in the query of a pre-signed URL
+func parsePresigned(query url.Values) (*authorization, error) {
+	if query.Get(queryAlgorithm) != sigv4.Algorithm {
+		return nil, errAccessDenied("Only the %s signature algorithm is supported", sigv4.Algorithm)
+	}
+	credential := query.Get(queryCredential)
+	parts := strings.Split(credential, "/")
+	if len(parts) != 5 || parts[4] != sigv4.Terminator {
+		return nil, errMalformedAuthorization("The credential %q is malformed", credential)
+	}
+	authz := &authorization{
+		accessKey:     parts[0],
+		date:          parts[1],
+		region:        parts[2],
+		service:       parts[3],
+		signedHeaders: strings.Split(query.Get(querySignedHeaders), ";"),
+		signature:     query.Get(querySignature),
+	}
+	if authz.accessKey == "" || authz.signature == "" {
+		return nil, errMalformedAuthorization("The query string authorization is malformed")
+	}
+	return authz, nil
+}
+
+// verifyPresigned checks the signature in the query of a pre-signed URL
+// and that it has not expired. Its body is unsigned.
+func (s *Server) verifyPresigned(r *http.Request, authz *authorization, secretKey string) (*signing, error) {
+	if authz.service != sigv4.Service {
+		return nil, errMalformedAuthorization("The credential should be scoped to the %s service", sigv4.Service)
+	}
+	if authz.region != s.cfg.Region {
+		return nil, errMalformedAuthorization("The credential should be scoped to a valid region, expecting %q", s.cfg.Region)
+	}
+
+	query := r.URL.Query()
+	amzDate := query.Get(queryDate)
+	signedAt, err := time.Parse(sigv4.DateFormat, amzDate)
+	if err != nil {
+		return nil, errAccessDenied("The URL must carry a valid %s", queryDate)
+	}
+	if signedAt.Format(sigv4.ScopeDateFormat) != authz.date {
+		return nil, errMalformedAuthorization("The credential date does not match the request date")
+	}
+	seconds, err := strconv.Atoi(query.Get(queryExpires))
+	if err != nil || seconds <= 0 || time.Duration(seconds)*time.Second > MaxPresignExpiry {
+		return nil, errAccessDenied("%s must be a number of seconds up to %d", queryExpires, int(MaxPresignExpiry/time.Second))
+	}
+	now := time.Now()
+	if now.Before(signedAt.Add(-maxClockSkew)) {
+		return nil, errRequestTimeTooSkewed
+	}
+	if now.After(signedAt.Add(time.Duration(seconds) * time.Second)) {
+		return nil, errPresignExpired
+	}
+	if !containsHost(authz.signedHeaders) {
+		return nil, errAccessDenied("The host header must be signed")
+	}
+
+	query.Del(querySignature)
+	canonical := strings.Join([]string{
+		r.Method,
+		sigv4.Escape(r.URL.Path, false),
+		sigv4.CanonicalQuery(query),
+		sigv4.CanonicalHeaders(r, authz.signedHeaders),
+		strings.Join(authz.signedHeaders, ";"),
+		unsignedPayload,
+	}, "\n")
+	scope := strings.Join([]string{authz.date, authz.region, authz.service, sigv4.Terminator}, "/")
+	stringToSign := strings.Join([]string{sigv4.Algorithm, amzDate, scope, sigv4.HexSHA256([]byte(canonical))}, "\n")
+	key := sigv4.SigningKey(secretKey, authz.date, authz.region, authz.service)
+	if !hmac.Equal([]byte(hex.EncodeToString(sigv4.HMACSHA256(key, stringToSign))), []byte(authz.signature)) {
+		return nil, errSignatureDoesNotMatch
+	}
+	return &signing{key: key, amzDate: amzDate, scope: scope, signature: authz.signature}, nil
+}
+
+// containsHost reports whether the host header is among signed headers
+func containsHost(signedHeaders []string) bool {
+	for _, name := range signedHeaders {
+		if name == "host" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package gateway
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/3fs-storage/internal/block"
+)
+
+// errInvalidRange reports a Range header none of whose bytes lie in the
+// object
+var errInvalidRange = newError(http.StatusRequestedRangeNotSatisfiable, "InvalidRange",
+	"The requested range is not satisfiable")
+
+// byteRange is a range of an object's bytes a request asked for
+type byteRange struct {
+	start, length int64
+}
+
+// contentRange returns the Content-Range header of the range of an object
+// of size bytes
+func (b byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", b.start, b.start+b.length-1, size)
+}
+
+// requestedRange returns the range of an object a request asks for, or
+// nil if it asks for the whole object. As in S3, a Range header the
+// gateway cannot parse, or one with several ranges, is ignored, and an
+// If-Range naming another version of the object asks for all of it.
+func requestedRange(r *http.Request, manifest *block.ObjectManifest) (*byteRange, error) {
+	header := r.Header.Get("Range")
+	if header == "" {
+		return nil, nil
+	}
+	if ifRange := r.Header.Get("If-Range"); ifRange != "" && !ifRangeMatches(ifRange, manifest) {
+		return nil, nil
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return nil, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(spec), "-")
+	if !ok {
+		return nil, nil
+	}
+
+	size := manifest.Size
+	if first == "" {
+		// A suffix: the last bytes of the object
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < 0 {
+			return nil, nil
+		}
+		if n == 0 || size == 0 {
+			return nil, errInvalidRange
+		}
+		n = min(n, size)
+		return &byteRange{start: size - n, length: n}, nil
+	}
+
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 {
+		return nil, nil
+	}
+	end := size - 1
+	if last != "" {
+		if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+			return nil, nil
+		}
+		end = min(end, size-1)
+	}
+	if start >= size {
+		return nil, errInvalidRange
+	}
+	return &byteRange{start: start, length: end - start + 1}, nil
+}
+
+// ifRangeMatches reports whether an If-Range header names the object as
+// it is, by its ETag or by a date no earlier than its last change
+func ifRangeMatches(ifRange string, manifest *block.ObjectManifest) bool {
+	if strings.HasPrefix(ifRange, `"`) || strings.HasPrefix(ifRange, `W/`) {
+		return ifRange == etag(manifest)
+	}
+	date, err := http.ParseTime(ifRange)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have whole seconds
+	return manifest.CreatedAt/1e9 <= date.Unix()
+}
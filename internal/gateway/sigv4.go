@@ -0,0 +1,401 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/sigv4"
+)
+
+// Signature Version 4 constants
+const (
+	maxClockSkew      = 15 * time.Minute
+	emptySHA256       = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayload   = "UNSIGNED-PAYLOAD"
+	streamingSigned   = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	streamingTrailer  = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+	streamingUnsigned = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+// maxChunkSize bounds the chunks of an aws-chunked body, which are held in
+// memory until their signature is checked
+const maxChunkSize = 16 << 20
+
+// signing holds what a request was signed with, to check the signatures of
+// the chunks of its body
+type signing struct {
+	key       []byte
+	amzDate   string
+	scope     string
+	signature string
+}
+
+// authorization is a parsed Authorization header
+type authorization struct {
+	accessKey     string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+}
+
+// parseAuthorization parses a Signature Version 4 Authorization header
+func parseAuthorization(header string) (*authorization, error) {
+	if !strings.HasPrefix(header, sigv4.Algorithm+" ") {
+		return nil, errAccessDenied("Only the %s signature algorithm is supported", sigv4.Algorithm)
+	}
+	authz := &authorization{}
+	for _, field := range strings.Split(strings.TrimPrefix(header, sigv4.Algorithm+" "), ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			return nil, errMalformedAuthorization("The authorization header is malformed")
+		}
+		switch name {
+		case "Credential":
+			parts := strings.Split(value, "/")
+			if len(parts) != 5 || parts[4] != sigv4.Terminator {
+				return nil, errMalformedAuthorization("The credential %q is malformed", value)
+			}
+			authz.accessKey, authz.date, authz.region, authz.service = parts[0], parts[1], parts[2], parts[3]
+		case "SignedHeaders":
+			authz.signedHeaders = strings.Split(value, ";")
+		case "Signature":
+			authz.signature = value
+		}
+	}
+	if authz.accessKey == "" || len(authz.signedHeaders) == 0 || authz.signature == "" {
+		return nil, errMalformedAuthorization("The authorization header is malformed")
+	}
+	return authz, nil
+}
+
+// verifySignature checks the Signature Version 4 signature of a request
+// against the secret key of its access key, and returns what it was signed
+// with
+func (s *Server) verifySignature(r *http.Request, authz *authorization, secretKey string) (*signing, error) {
+	if authz.service != sigv4.Service {
+		return nil, errMalformedAuthorization("The credential should be scoped to the %s service", sigv4.Service)
+	}
+	if authz.region != s.cfg.Region {
+		return nil, errMalformedAuthorization("The credential should be scoped to a valid region, expecting %q", s.cfg.Region)
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	if amzDate == "" {
+		amzDate = r.Header.Get("Date")
+	}
+	signedAt, err := time.Parse(sigv4.DateFormat, amzDate)
+	if err != nil {
+		return nil, errAccessDenied("The request must carry a valid X-Amz-Date header")
+	}
+	if skew := time.Since(signedAt); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	if signedAt.Format(sigv4.ScopeDateFormat) != authz.date {
+		return nil, errMalformedAuthorization("The credential date does not match the request date")
+	}
+
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash == "" {
+		return nil, errInvalidArgument("The x-amz-content-sha256 header is required")
+	}
+
+	if !containsHost(authz.signedHeaders) {
+		return nil, errAccessDenied("The host header must be signed")
+	}
+
+	canonical := strings.Join([]string{
+		r.Method,
+		sigv4.Escape(r.URL.Path, false),
+		sigv4.CanonicalQuery(r.URL.Query()),
+		sigv4.CanonicalHeaders(r, authz.signedHeaders),
+		strings.Join(authz.signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{authz.date, authz.region, authz.service, sigv4.Terminator}, "/")
+	stringToSign := strings.Join([]string{sigv4.Algorithm, amzDate, scope, sigv4.HexSHA256([]byte(canonical))}, "\n")
+	key := sigv4.SigningKey(secretKey, authz.date, authz.region, authz.service)
+	if !hmac.Equal([]byte(hex.EncodeToString(sigv4.HMACSHA256(key, stringToSign))), []byte(authz.signature)) {
+		return nil, errSignatureDoesNotMatch
+	}
+	return &signing{key: key, amzDate: amzDate, scope: scope, signature: authz.signature}, nil
+}
+
+// requestBody returns the body of a request, decoding aws-chunked bodies
+// and checking the payload hash and checksums the client sent as the body
+// is read. Errors reading the body are S3 errors.
+func requestBody(r *http.Request, sig *signing) (io.Reader, int64, error) {
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	body := io.Reader(r.Body)
+	size := r.ContentLength
+	check := &checkedReader{}
+
+	switch payloadHash {
+	case streamingSigned, streamingTrailer, streamingUnsigned:
+		decoded, err := strconv.ParseInt(r.Header.Get("X-Amz-Decoded-Content-Length"), 10, 64)
+		if err != nil || decoded < 0 {
+			return nil, 0, errInvalidArgument("The x-amz-decoded-content-length header is required with %s", payloadHash)
+		}
+		if payloadHash != streamingUnsigned && sig == nil {
+			return nil, 0, errAccessDenied("Signed chunks need a signed request")
+		}
+		chunked := &chunkedReader{r: bufio.NewReader(r.Body), size: decoded}
+		if payloadHash != streamingUnsigned {
+			chunked.signing = sig
+			chunked.previous = sig.signature
+		}
+		chunked.trailer = payloadHash != streamingSigned
+		body, size = chunked, decoded
+		check.trailers = chunked
+	case "", unsignedPayload:
+	default:
+		if sig != nil {
+			if _, err := hex.DecodeString(payloadHash); err != nil || len(payloadHash) != sha256.Size*2 {
+				return nil, 0, errInvalidArgument("The x-amz-content-sha256 header is invalid")
+			}
+			check.add(sha256.New(), errContentSHA256Mismatch, func() string { return payloadHash }, hex.EncodeToString)
+		}
+	}
+
+	if contentMD5 := r.Header.Get("Content-Md5"); contentMD5 != "" {
+		check.add(md5.New(), errBadDigest, func() string { return contentMD5 }, base64.StdEncoding.EncodeToString)
+	}
+	for _, algorithm := range checksumAlgorithms {
+		header := "X-Amz-Checksum-" + algorithm.name
+		if value := r.Header.Get(header); value != "" {
+			check.add(algorithm.new(), errBadDigest, func() string { return value }, base64.StdEncoding.EncodeToString)
+			continue
+		}
+		if check.trailers != nil && declaresTrailer(r, header) {
+			name := strings.ToLower(header)
+			trailers := check.trailers
+			check.add(algorithm.new(), errBadDigest, func() string { return trailers.trailerValues[name] }, base64.StdEncoding.EncodeToString)
+		}
+	}
+
+	check.r = body
+	check.size = size
+	return check, size, nil
+}
+
+// declaresTrailer reports whether a request announces a header in its
+// trailer
+func declaresTrailer(r *http.Request, header string) bool {
+	for _, value := range r.Header.Values("X-Amz-Trailer") {
+		for _, name := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(name), header) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// checksumAlgorithm is a checksum a client may send with an upload, in
+// the x-amz-checksum header of its name
+type checksumAlgorithm struct {
+	name string
+	new  func() hash.Hash
+}
+
+// checksumAlgorithms are the checksums verified on upload
+var checksumAlgorithms = []checksumAlgorithm{
+	{"Crc32", func() hash.Hash { return crc32.NewIEEE() }},
+	{"Crc32c", func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) }},
+	{"Crc64nvme", func() hash.Hash { return crc64.New(crc64.MakeTable(0x9a6c9329ac4bc9b5)) }},
+	{"Sha1", sha1.New},
+	{"Sha256", sha256.New},
+}
+
+// expectedDigest is a digest of the body the client sent, compared with
+// the body once it has been read
+type expectedDigest struct {
+	hash   hash.Hash
+	err    *s3Error
+	want   func() string
+	encode func([]byte) string
+}
+
+// checkedReader reads a request body, failing at its end if it differs
+// from the digests or the size the client announced
+type checkedReader struct {
+	r        io.Reader
+	size     int64
+	read     int64
+	digests  []expectedDigest
+	trailers *chunkedReader
+}
+
+// add checks the body against a digest, read by want once the body has
+// been read
+func (c *checkedReader) add(h hash.Hash, err *s3Error, want func() string, encode func([]byte) string) {
+	c.digests = append(c.digests, expectedDigest{hash: h, err: err, want: want, encode: encode})
+}
+
+// Read reads the body, checking it once it ends
+func (c *checkedReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += int64(n)
+	for _, digest := range c.digests {
+		digest.hash.Write(p[:n])
+	}
+	if c.size >= 0 && c.read > c.size {
+		return n, errIncompleteBody
+	}
+	if err == io.EOF {
+		if c.size >= 0 && c.read != c.size {
+			return n, errIncompleteBody
+		}
+		for _, digest := range c.digests {
+			if digest.encode(digest.hash.Sum(nil)) != digest.want() {
+				return n, digest.err
+			}
+		}
+	}
+	return n, err
+}
+
+// chunkedReader decodes an aws-chunked body, checking the signature of
+// each chunk against the previous one if the body is signed. Each chunk
+// is read whole, so that none of its data is returned before it is known
+// to be signed.
+type chunkedReader struct {
+	r        *bufio.Reader
+	size     int64
+	signing  *signing
+	previous string
+	trailer  bool
+
+	chunk         []byte
+	done          bool
+	err           error
+	trailerValues map[string]string
+}
+
+// Read returns the data of the body's chunks
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.chunk) == 0 {
+		if c.err != nil {
+			return 0, c.err
+		}
+		if c.done {
+			return 0, io.EOF
+		}
+		if err := c.nextChunk(); err != nil {
+			c.err = err
+		}
+	}
+	n := copy(p, c.chunk)
+	c.chunk = c.chunk[n:]
+	return n, nil
+}
+
+// nextChunk reads the next chunk of the body, and the trailer after the
+// last one
+func (c *chunkedReader) nextChunk() error {
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	sizeField, extension, _ := strings.Cut(line, ";")
+	size, err := strconv.ParseInt(strings.TrimSpace(sizeField), 16, 64)
+	if err != nil || size < 0 || size > maxChunkSize {
+		return errInvalidArgument("The chunk size %q is invalid", sizeField)
+	}
+
+	data := make([]byte, size)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return errIncompleteBody
+	}
+	if size > 0 {
+		if crlf, err := c.readLine(); err != nil || crlf != "" {
+			return errInvalidArgument("The chunk is not terminated")
+		}
+	}
+
+	if c.signing != nil {
+		signature := strings.TrimPrefix(extension, "chunk-signature=")
+		stringToSign := strings.Join([]string{
+			sigv4.Algorithm + "-PAYLOAD", c.signing.amzDate, c.signing.scope, c.previous, emptySHA256, sigv4.HexSHA256(data),
+		}, "\n")
+		expected := hex.EncodeToString(sigv4.HMACSHA256(c.signing.key, stringToSign))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errSignatureDoesNotMatch
+		}
+		c.previous = signature
+	}
+
+	if size == 0 {
+		c.done = true
+		return c.readTrailer()
+	}
+	c.chunk = data
+	return nil
+}
+
+// readTrailer reads the headers following the last chunk, checking their
+// signature if the body is signed
+func (c *chunkedReader) readTrailer() error {
+	c.trailerValues = make(map[string]string)
+	var canonical strings.Builder
+	var signature string
+	for {
+		line, err := c.readLine()
+		if errors.Is(err, io.EOF) || line == "" {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return errInvalidArgument("The trailer %q is malformed", line)
+		}
+		name, value = strings.ToLower(strings.TrimSpace(name)), strings.TrimSpace(value)
+		if name == "x-amz-trailer-signature" {
+			signature = value
+			continue
+		}
+		c.trailerValues[name] = value
+		canonical.WriteString(name + ":" + value + "\n")
+	}
+
+	if c.signing != nil && c.trailer {
+		stringToSign := strings.Join([]string{
+			sigv4.Algorithm + "-TRAILER", c.signing.amzDate, c.signing.scope, c.previous, sigv4.HexSHA256([]byte(canonical.String())),
+		}, "\n")
+		expected := hex.EncodeToString(sigv4.HMACSHA256(c.signing.key, stringToSign))
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return errSignatureDoesNotMatch
+		}
+	}
+	return nil
+}
+
+// readLine reads a CRLF-terminated line of the body
+func (c *chunkedReader) readLine() (string, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		if errors.Is(err, io.EOF) && line == "" {
+			return "", io.EOF
+		}
+		return "", errIncompleteBody
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -0,0 +1,309 @@
+// Package georep replicates blocks asynchronously to a remote cluster, such
+// as a disaster recovery site in another datacenter. Each node journals
+// the writes and deletes of the replicated namespaces made through it, and
+// a shipper sends the blocks to the remote cluster in the background:
+// compressed, within a bandwidth budget, and from the journal's cursor, so
+// that shipping resumes where it stopped after a restart or an outage of
+// the link. The shipper sends each block as the node holds it when it is
+// shipped, so a block written many times while the link is slow is sent
+// once.
+package georep
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/pkg/api"
+)
+
+const (
+	// DefaultWorkers is the number of blocks shipped at the same time
+	DefaultWorkers = 4
+	// batchSize is the most journal entries shipped before the cursor
+	// moves
+	batchSize = 256
+	// minBackoff and maxBackoff bound the wait before a failed batch is
+	// shipped again
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// Source reads blocks as the node holds them
+type Source interface {
+	// ReadBlock returns the data of the block an entry names, and false
+	// if the block does not exist
+	ReadBlock(ctx context.Context, e Entry) ([]byte, bool, error)
+}
+
+// Remote is the cluster blocks are shipped to, such as a *client.Cluster
+type Remote interface {
+	Write(ctx context.Context, blockID string, data []byte) error
+	WriteCompressed(ctx context.Context, blockID string, compressed []byte, checksum string) error
+	Delete(ctx context.Context, blockID string) error
+}
+
+// Options configures a shipper
+type Options struct {
+	// Namespaces are the namespaces replicated
+	Namespaces []string
+	// Bandwidth caps the bytes sent per second, after compression; zero
+	// means unlimited
+	Bandwidth int64
+	// Compress sends blocks compressed with DEFLATE
+	Compress bool
+	// Workers is the number of blocks shipped at the same time
+	Workers int
+}
+
+// Stats reports the progress of a shipper. Lag is how long the oldest
+// entry not yet shipped has waited, zero once everything was shipped.
+type Stats struct {
+	Pending     uint64  `json:"pending"`
+	LagSeconds  float64 `json:"lag_seconds"`
+	Shipped     int64   `json:"shipped"`
+	Deleted     int64   `json:"deleted"`
+	Skipped     int64   `json:"skipped"`
+	Bytes       int64   `json:"bytes"`
+	SentBytes   int64   `json:"sent_bytes"`
+	Failures    int64   `json:"failures"`
+	LastShipped int64   `json:"last_shipped,omitempty"`
+	LastError   string  `json:"last_error,omitempty"`
+}
+
+// Shipper ships the blocks journaled by a node to a remote cluster
+type Shipper struct {
+	journal *Journal
+	source  Source
+	remote  Remote
+	opts    Options
+	limiter *ratelimit.Limiter
+	logger  *slog.Logger
+
+	shipped     atomic.Int64
+	deleted     atomic.Int64
+	skipped     atomic.Int64
+	bytes       atomic.Int64
+	sentBytes   atomic.Int64
+	failures    atomic.Int64
+	lastShipped atomic.Int64
+	lastError   atomic.Pointer[string]
+}
+
+// NewShipper creates a shipper of the entries of a journal
+func NewShipper(journal *Journal, source Source, remote Remote, opts Options, logger *slog.Logger) *Shipper {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	if logger == nil {
+		logger = logging.Discard()
+	}
+	return &Shipper{
+		journal: journal,
+		source:  source,
+		remote:  remote,
+		opts:    opts,
+		limiter: ratelimit.New(float64(opts.Bandwidth), 0),
+		logger:  logger,
+	}
+}
+
+// Replicated reports whether a block belongs to a replicated namespace
+func (s *Shipper) Replicated(blockID string) bool {
+	return Replicated(s.opts.Namespaces, blockID)
+}
+
+// Replicated reports whether a block belongs to one of namespaces
+func Replicated(namespaces []string, blockID string) bool {
+	if !strings.Contains(blockID, api.NamespaceSeparator) {
+		return false
+	}
+	namespace := api.Namespace(blockID)
+	for _, ns := range namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Run ships journaled blocks until ctx ends. A batch that fails is
+// shipped again after a backoff, from the journal's cursor.
+func (s *Shipper) Run(ctx context.Context) {
+	backoff := minBackoff
+	for {
+		entries, err := s.journal.Read(batchSize)
+		if err == nil && len(entries) > 0 {
+			if err = s.ship(ctx, entries); err == nil {
+				err = s.journal.Ack()
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		switch {
+		case err != nil:
+			s.failures.Add(1)
+			message := err.Error()
+			s.lastError.Store(&message)
+			s.logger.Warn("failed to ship blocks to the remote cluster", "error", err, "retry_in", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(backoff*2, maxBackoff)
+		case len(entries) == 0:
+			select {
+			case <-s.journal.Notify():
+			case <-ctx.Done():
+				return
+			}
+		default:
+			backoff = minBackoff
+			s.lastError.Store(nil)
+		}
+	}
+}
+
+// ship ships the blocks of a batch of entries, each block once, and
+// returns the first error
+func (s *Shipper) ship(ctx context.Context, entries []Entry) error {
+	// The last entry of a block decides whether it is written or deleted
+	latest := make(map[string]int, len(entries))
+	for i, e := range entries {
+		latest[e.BlockID] = i
+	}
+
+	work := make(chan Entry)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for i := 0; i < s.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for e := range work {
+				if err := s.shipBlock(ctx, e); err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("block %s: %w", e.BlockID, err)
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for i, e := range entries {
+		if latest[e.BlockID] != i {
+			continue
+		}
+		select {
+		case work <- e:
+		case <-ctx.Done():
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return firstErr
+}
+
+// shipBlock sends the block an entry names as the node now holds it. A
+// block written since it was deleted is left to the entry of its write,
+// and a block deleted since it was written to the entry of its delete,
+// which another node journaled if it went through that node.
+func (s *Shipper) shipBlock(ctx context.Context, e Entry) error {
+	data, exists, err := s.source.ReadBlock(ctx, e)
+	if err != nil {
+		return fmt.Errorf("failed to read block: %w", err)
+	}
+
+	switch {
+	case e.Op == OpDelete && !exists:
+		if err := s.remote.Delete(ctx, e.BlockID); err != nil && !errors.Is(err, api.ErrNotFound) {
+			return fmt.Errorf("failed to delete block from the remote cluster: %w", err)
+		}
+		s.deleted.Add(1)
+	case e.Op == OpWrite && exists:
+		if err := s.send(ctx, e.BlockID, data); err != nil {
+			return err
+		}
+		s.shipped.Add(1)
+		s.bytes.Add(int64(len(data)))
+	default:
+		s.skipped.Add(1)
+		return nil
+	}
+	s.lastShipped.Store(time.Now().UnixNano())
+	return nil
+}
+
+// send writes a block to the remote cluster, compressed if that makes it
+// smaller, within the bandwidth budget
+func (s *Shipper) send(ctx context.Context, blockID string, data []byte) error {
+	var compressed []byte
+	if s.opts.Compress {
+		var ok bool
+		var err error
+		if compressed, ok, err = api.Compress(data); err != nil || !ok {
+			compressed = nil
+		}
+	}
+
+	size := len(data)
+	if compressed != nil {
+		size = len(compressed)
+	}
+	if err := s.limiter.WaitN(ctx, size); err != nil {
+		return err
+	}
+
+	var err error
+	if compressed != nil {
+		sum := sha256.Sum256(data)
+		err = s.remote.WriteCompressed(ctx, blockID, compressed, hex.EncodeToString(sum[:]))
+	} else {
+		err = s.remote.Write(ctx, blockID, data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write block to the remote cluster: %w", err)
+	}
+	s.sentBytes.Add(int64(size))
+	return nil
+}
+
+// Stats returns the shipper's progress
+func (s *Shipper) Stats() *Stats {
+	pending, oldest := s.journal.Pending()
+	stats := &Stats{
+		Pending:     pending,
+		Shipped:     s.shipped.Load(),
+		Deleted:     s.deleted.Load(),
+		Skipped:     s.skipped.Load(),
+		Bytes:       s.bytes.Load(),
+		SentBytes:   s.sentBytes.Load(),
+		Failures:    s.failures.Load(),
+		LastShipped: s.lastShipped.Load(),
+	}
+	if !oldest.IsZero() {
+		stats.LagSeconds = time.Since(oldest).Seconds()
+	}
+	if message := s.lastError.Load(); message != nil {
+		stats.LastError = *message
+	}
+	return stats
+}
@@ -0,0 +1,328 @@
+package georep
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// journalFile is the journal of writes to ship, in the journal's
+	// directory
+	journalFile = "journal.log"
+	// cursorFile records the last entry the remote cluster acknowledged
+	cursorFile = "cursor.json"
+	// compactSize is how much of the journal may have been shipped before
+	// the entries left are moved to a new file
+	compactSize = 16 << 20
+)
+
+// Journal operations
+const (
+	OpWrite  = "write"
+	OpDelete = "delete"
+)
+
+// Entry is one line of the journal: a block written or deleted through the
+// node, to be shipped to the remote cluster
+type Entry struct {
+	Seq     uint64 `json:"seq"`
+	Op      string `json:"op"`
+	BlockID string `json:"block_id"`
+	// Target is the storage target the block was written to
+	Target string `json:"target,omitempty"`
+	Time   int64  `json:"time"`
+}
+
+// cursor is the persisted position of the shipper in the journal
+type cursor struct {
+	Shipped uint64 `json:"shipped"`
+}
+
+// Journal is an append-only log of the writes waiting to be shipped, with
+// a cursor past the last entry the remote cluster acknowledged. Entries
+// are synced before the write they record is acknowledged, and the cursor
+// only moves once the remote cluster stored them, so that shipping resumes
+// where it stopped after a restart or a crash.
+type Journal struct {
+	dir  string
+	file *os.File
+	// seq is the last entry appended and shipped the last acknowledged
+	seq     uint64
+	shipped uint64
+	// offset is where the first entry not acknowledged starts, and size
+	// the length of the file
+	offset int64
+	size   int64
+	// oldest is the time of the first entry not acknowledged, or zero
+	// when it is not known yet
+	oldest int64
+	// readSeq and readEnd are the last entry returned by Read and where
+	// it ends, for Ack
+	readSeq uint64
+	readEnd int64
+	notify  chan struct{}
+	mu      sync.Mutex
+}
+
+// OpenJournal opens the journal in dir, creating it if needed. An entry
+// torn by a crash at the end of the file is dropped: the write it
+// recorded was never acknowledged.
+func OpenJournal(dir string) (*Journal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create journal directory: %w", err)
+	}
+	j := &Journal{dir: dir, notify: make(chan struct{}, 1)}
+
+	data, err := os.ReadFile(filepath.Join(dir, cursorFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read journal cursor: %w", err)
+	}
+	if err == nil {
+		var c cursor
+		if err := json.Unmarshal(data, &c); err != nil {
+			return nil, fmt.Errorf("failed to parse journal cursor: %w", err)
+		}
+		j.shipped = c.Shipped
+	}
+	j.seq = j.shipped
+
+	file, err := os.OpenFile(filepath.Join(dir, journalFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	if err := j.scan(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if err := file.Truncate(j.size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to truncate journal: %w", err)
+	}
+	if _, err := file.Seek(j.size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to open journal: %w", err)
+	}
+	j.file = file
+	return j, nil
+}
+
+// scan reads the journal on opening, finding its last entry and the first
+// one not acknowledged. The file's size is set to the end of the last
+// whole entry.
+func (j *Journal) scan(file *os.File) error {
+	j.offset = -1
+	r := bufio.NewReader(file)
+	var pos int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read journal: %w", err)
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			break
+		}
+		if e.Seq > j.shipped && j.offset < 0 {
+			j.offset = pos
+			j.oldest = e.Time
+		}
+		if e.Seq > j.seq {
+			j.seq = e.Seq
+		}
+		pos += int64(len(line))
+	}
+	j.size = pos
+	if j.offset < 0 {
+		j.offset = pos
+	}
+	return nil
+}
+
+// Append records a block written or deleted, syncing the entry before it
+// returns
+func (j *Journal) Append(op, blockID, target string) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	e := Entry{Seq: j.seq + 1, Op: op, BlockID: blockID, Target: target, Time: time.Now().UnixNano()}
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err := j.file.Write(line); err != nil {
+		// Drop what was written of the entry, so that it does not tear
+		// the journal
+		j.file.Truncate(j.size)
+		j.file.Seek(j.size, io.SeekStart)
+		return fmt.Errorf("failed to append to journal: %w", err)
+	}
+	j.seq = e.Seq
+	j.size += int64(len(line))
+	if j.seq == j.shipped+1 {
+		j.oldest = e.Time
+	}
+	select {
+	case j.notify <- struct{}{}:
+	default:
+	}
+
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync journal: %w", err)
+	}
+	return nil
+}
+
+// Notify returns a channel that receives after entries are appended
+func (j *Journal) Notify() <-chan struct{} {
+	return j.notify
+}
+
+// Read returns up to max entries following the last acknowledged one
+func (j *Journal) Read(max int) ([]Entry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	start := j.offset
+	if start >= j.size {
+		return nil, nil
+	}
+	r := bufio.NewReader(io.NewSectionReader(j.file, start, j.size-start))
+	entries := make([]Entry, 0, max)
+	pos := start
+	for len(entries) < max {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read journal: %w", err)
+		}
+		var e Entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return nil, fmt.Errorf("failed to parse journal entry at offset %d: %w", pos, err)
+		}
+		pos += int64(len(line))
+		entries = append(entries, e)
+	}
+	if len(entries) > 0 {
+		j.readSeq = entries[len(entries)-1].Seq
+		j.readEnd = pos
+		j.oldest = entries[0].Time
+	}
+	return entries, nil
+}
+
+// Ack records that the remote cluster stored every entry up to the last
+// one Read returned, moving the cursor past them. Once enough of the
+// journal was shipped, the entries left are moved to a new file.
+func (j *Journal) Ack() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.readSeq <= j.shipped {
+		return nil
+	}
+	if err := writeCursor(j.dir, cursor{Shipped: j.readSeq}); err != nil {
+		return err
+	}
+	j.shipped = j.readSeq
+	j.offset = j.readEnd
+	j.oldest = 0
+	if j.offset > compactSize && j.offset > j.size/2 {
+		return j.compact()
+	}
+	return nil
+}
+
+// compact moves the entries not yet acknowledged to a new journal file,
+// dropping the shipped ones. It is called with the journal locked.
+func (j *Journal) compact() error {
+	path := filepath.Join(j.dir, journalFile)
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	n, err := io.Copy(out, io.NewSectionReader(j.file, j.offset, j.size-j.offset))
+	if err == nil {
+		err = out.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+	if _, err := out.Seek(n, io.SeekStart); err != nil {
+		out.Close()
+		return fmt.Errorf("failed to compact journal: %w", err)
+	}
+
+	j.file.Close()
+	j.file = out
+	j.offset = 0
+	j.readEnd = 0
+	j.size = n
+	return nil
+}
+
+// writeCursor persists the cursor, replacing the previous one atomically
+func writeCursor(dir string, c cursor) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal cursor: %w", err)
+	}
+	path := filepath.Join(dir, cursorFile)
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write journal cursor: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write journal cursor: %w", err)
+	}
+	return nil
+}
+
+// Pending returns the number of entries not yet acknowledged, and the
+// time of the oldest of them if it is known
+func (j *Journal) Pending() (uint64, time.Time) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var oldest time.Time
+	if j.seq > j.shipped && j.oldest > 0 {
+		oldest = time.Unix(0, j.oldest)
+	}
+	return j.seq - j.shipped, oldest
+}
+
+// Close closes the journal file
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
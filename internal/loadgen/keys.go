@@ -0,0 +1,63 @@
+package loadgen
+
+import (
+	"fmt"
+	"math/rand"
+	"sync/atomic"
+)
+
+// zipfExponent is the skew of the zipfian distribution: with it, the
+// hottest 1% of 100,000 keys draw about half of the operations
+const zipfExponent = 1.1
+
+// keyPicker picks the index of the key an operation uses. A picker is
+// used by one worker; sequential pickers share their position so that
+// the workers walk the keys together.
+type keyPicker interface {
+	next() int
+}
+
+// newKeyPicker returns a picker of a distribution over n keys
+func newKeyPicker(distribution string, n int, rnd *rand.Rand, position *atomic.Uint64) keyPicker {
+	switch distribution {
+	case Zipfian:
+		return zipfPicker{rand.NewZipf(rnd, zipfExponent, 1, uint64(n-1))}
+	case Sequential:
+		return sequentialPicker{position: position, n: uint64(n)}
+	}
+	return uniformPicker{rnd: rnd, n: n}
+}
+
+// uniformPicker picks keys with the same probability
+type uniformPicker struct {
+	rnd *rand.Rand
+	n   int
+}
+
+func (p uniformPicker) next() int {
+	return p.rnd.Intn(p.n)
+}
+
+// zipfPicker picks low keys much more often than high ones
+type zipfPicker struct {
+	zipf *rand.Zipf
+}
+
+func (p zipfPicker) next() int {
+	return int(p.zipf.Uint64())
+}
+
+// sequentialPicker walks the keys in order, wrapping around
+type sequentialPicker struct {
+	position *atomic.Uint64
+	n        uint64
+}
+
+func (p sequentialPicker) next() int {
+	return int((p.position.Add(1) - 1) % p.n)
+}
+
+// keyID returns the block ID of a key of a run
+func keyID(prefix, profile string, key int) string {
+	return fmt.Sprintf("%s%s.%08d", prefix, profile, key)
+}
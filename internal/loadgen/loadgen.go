@@ -0,0 +1,288 @@
+// Package loadgen generates load against a storage node from workload
+// profiles, and reports the throughput and latencies it measured.
+package loadgen
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/pkg/client"
+)
+
+// DefaultPrefix is the prefix of the block IDs a run uses
+const DefaultPrefix = "bench:"
+
+// DefaultWorkers is the default number of concurrent workers
+const DefaultWorkers = 16
+
+// Operation names
+const (
+	OpRead   = "read"
+	OpWrite  = "write"
+	OpDelete = "delete"
+)
+
+// Options configures a run
+type Options struct {
+	Profile Profile
+	// Workers is the number of operations in flight, each worker over a
+	// connection of its own
+	Workers int
+	// Prefix is prepended to the block IDs, such as a namespace
+	Prefix string
+	// WarmUp runs the workload unmeasured first, so that caches and
+	// connections settle
+	WarmUp time.Duration
+	// Duration bounds the measured phase
+	Duration time.Duration
+	// Ops, if positive, ends the measured phase after that many operations
+	Ops int64
+	// Seed seeds the random choices, so that runs can be repeated
+	Seed int64
+	// Cleanup deletes the run's keys at the end
+	Cleanup bool
+}
+
+// Dial opens a connection for a worker
+type Dial func() (*client.Client, error)
+
+// sample is what a worker measured of one kind of operation
+type sample struct {
+	count     int64
+	errors    int64
+	bytes     int64
+	latencies []time.Duration
+}
+
+// worker runs operations over its own connection and records them
+type worker struct {
+	c       *client.Client
+	rnd     *rand.Rand
+	keys    keyPicker
+	data    []byte
+	profile Profile
+	prefix  string
+	samples map[string]*sample
+	seq     uint64
+}
+
+// Run prepares the keys the profile reads, warms up, and then measures the
+// workload for the duration or number of operations, returning the
+// report. A run interrupted by ctx reports what it measured so far.
+func Run(ctx context.Context, dial Dial, opts Options, logger *slog.Logger) (*Report, error) {
+	if err := opts.Profile.Validate(); err != nil {
+		return nil, err
+	}
+	if opts.Workers < 1 {
+		opts.Workers = DefaultWorkers
+	}
+	if opts.Duration <= 0 && opts.Ops <= 0 {
+		return nil, errors.New("a run needs a duration or a number of operations")
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = DefaultPrefix
+	}
+
+	var position atomic.Uint64
+	workers := make([]*worker, opts.Workers)
+	for i := range workers {
+		c, err := dial()
+		if err != nil {
+			closeWorkers(workers)
+			return nil, fmt.Errorf("failed to connect worker %d: %w", i, err)
+		}
+		rnd := rand.New(rand.NewSource(opts.Seed + int64(i)))
+		w := &worker{
+			c:       c,
+			rnd:     rnd,
+			keys:    newKeyPicker(opts.Profile.Distribution, opts.Profile.Keys, rnd, &position),
+			data:    make([]byte, opts.Profile.MaxSize),
+			profile: opts.Profile,
+			prefix:  opts.Prefix,
+		}
+		rnd.Read(w.data)
+		workers[i] = w
+	}
+	defer closeWorkers(workers)
+
+	if opts.Profile.Prepare {
+		logger.Info("preparing keys", "keys", opts.Profile.Keys)
+		if err := prepare(ctx, workers); err != nil {
+			return nil, err
+		}
+	}
+	if opts.WarmUp > 0 && ctx.Err() == nil {
+		logger.Info("warming up", "duration", opts.WarmUp)
+		runPhase(ctx, workers, opts.WarmUp, 0)
+	}
+
+	logger.Info("measuring", "duration", opts.Duration, "ops", opts.Ops, "workers", opts.Workers)
+	started := time.Now()
+	runPhase(ctx, workers, opts.Duration, opts.Ops)
+	elapsed := time.Since(started)
+	report := newReport(opts, started, elapsed, workers)
+
+	if opts.Cleanup {
+		logger.Info("deleting keys", "keys", opts.Profile.Keys)
+		cleanup(context.WithoutCancel(ctx), workers)
+	}
+	return report, nil
+}
+
+// closeWorkers closes the workers' connections
+func closeWorkers(workers []*worker) {
+	for _, w := range workers {
+		if w != nil {
+			w.c.Close()
+		}
+	}
+}
+
+// prepare writes every key of the profile, spread over the workers
+func prepare(ctx context.Context, workers []*worker) error {
+	var next atomic.Int64
+	keys := int64(workers[0].profile.Keys)
+	errs := make(chan error, len(workers))
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				key := next.Add(1) - 1
+				if key >= keys {
+					return
+				}
+				id := keyID(w.prefix, w.profile.Name, int(key))
+				if err := w.c.Write(ctx, id, w.payload()); err != nil {
+					errs <- fmt.Errorf("failed to prepare %s: %w", id, err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// runPhase runs the workload on every worker until the duration passes,
+// ops operations were run in all, or ctx ends. The workers' samples are
+// reset first. Requests run under ctx rather than the phase's deadline,
+// as a request cut short would leave its connection unusable; the
+// operations in flight at the deadline complete and are recorded.
+func runPhase(ctx context.Context, workers []*worker, duration time.Duration, ops int64) {
+	phase := ctx
+	if duration > 0 {
+		var cancel context.CancelFunc
+		phase, cancel = context.WithTimeout(ctx, duration)
+		defer cancel()
+	}
+
+	var issued atomic.Int64
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		w.samples = map[string]*sample{OpRead: {}, OpWrite: {}, OpDelete: {}}
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			for phase.Err() == nil {
+				if ops > 0 && issued.Add(1) > ops {
+					return
+				}
+				w.runOne(ctx)
+			}
+		}(w)
+	}
+	wg.Wait()
+}
+
+// runOne runs one operation picked as the profile says and records it.
+// Operations cut short by an interruption are not recorded.
+func (w *worker) runOne(ctx context.Context) {
+	id := keyID(w.prefix, w.profile.Name, w.keys.next())
+	op := OpWrite
+	switch roll := w.rnd.Intn(100); {
+	case roll < w.profile.ReadPercent:
+		op = OpRead
+	case roll < w.profile.ReadPercent+w.profile.DeletePercent:
+		op = OpDelete
+	}
+
+	var bytes int
+	var err error
+	start := time.Now()
+	switch op {
+	case OpRead:
+		var data []byte
+		data, err = w.c.Read(ctx, id)
+		bytes = len(data)
+	case OpWrite:
+		data := w.payload()
+		err = w.c.Write(ctx, id, data)
+		bytes = len(data)
+	case OpDelete:
+		err = w.c.Delete(ctx, id)
+	}
+	elapsed := time.Since(start)
+	if ctx.Err() != nil {
+		return
+	}
+
+	s := w.samples[op]
+	s.count++
+	if err != nil {
+		s.errors++
+		return
+	}
+	s.bytes += int64(bytes)
+	s.latencies = append(s.latencies, elapsed)
+}
+
+// payload returns the data of a write: a random size within the profile's
+// bounds, and a sequence number up front so that no two writes carry the
+// same data
+func (w *worker) payload() []byte {
+	size := w.profile.MinSize
+	if w.profile.MaxSize > w.profile.MinSize {
+		size += w.rnd.Intn(w.profile.MaxSize - w.profile.MinSize + 1)
+	}
+	data := w.data[:size]
+	w.seq++
+	if size >= 8 {
+		binary.BigEndian.PutUint64(data, w.seq)
+	}
+	return data
+}
+
+// cleanup deletes every key of the profile, ignoring failures such as keys
+// never written
+func cleanup(ctx context.Context, workers []*worker) {
+	var next atomic.Int64
+	keys := int64(workers[0].profile.Keys)
+	var wg sync.WaitGroup
+	for _, w := range workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			for {
+				key := next.Add(1) - 1
+				if key >= keys {
+					return
+				}
+				w.c.Delete(ctx, keyID(w.prefix, w.profile.Name, int(key)))
+			}
+		}(w)
+	}
+	wg.Wait()
+}
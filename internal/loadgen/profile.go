@@ -0,0 +1,118 @@
+package loadgen
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// Key distributions
+const (
+	// Uniform picks every key with the same probability
+	Uniform = "uniform"
+	// Zipfian picks a few hot keys much more often than the rest, as
+	// caches and key-value workloads see
+	Zipfian = "zipfian"
+	// Sequential walks the keys in order, wrapping around, as checkpoints
+	// and dataset epochs do
+	Sequential = "sequential"
+)
+
+// Profile describes a workload: the mix of operations, the size of the
+// blocks written, and how many keys the operations spread over
+type Profile struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// ReadPercent and DeletePercent are the shares of reads and deletes
+	// among the operations; the rest are writes
+	ReadPercent   int `json:"read_percent"`
+	DeletePercent int `json:"delete_percent"`
+	// MinSize and MaxSize bound the size of the blocks written, picked
+	// uniformly between them
+	MinSize int `json:"min_size"`
+	MaxSize int `json:"max_size"`
+	// Keys is the number of distinct keys
+	Keys int `json:"keys"`
+	// Distribution is how keys are picked: uniform, zipfian or sequential
+	Distribution string `json:"distribution"`
+	// Prepare writes every key before the run, so that reads find them
+	Prepare bool `json:"prepare"`
+}
+
+// profiles are the built-in workloads
+var profiles = map[string]Profile{
+	"checkpoint-write": {
+		Name:         "checkpoint-write",
+		Description:  "Large sequential writes, as a training job saving checkpoint shards",
+		MinSize:      16 << 20,
+		MaxSize:      16 << 20,
+		Keys:         256,
+		Distribution: Sequential,
+	},
+	"dataset-read": {
+		Name:         "dataset-read",
+		Description:  "Reads of 1MiB samples spread evenly over a dataset, as training epochs",
+		ReadPercent:  100,
+		MinSize:      1 << 20,
+		MaxSize:      1 << 20,
+		Keys:         4096,
+		Distribution: Uniform,
+		Prepare:      true,
+	},
+	"mixed-small-kv": {
+		Name:         "mixed-small-kv",
+		Description:  "Small values read and written with hot keys, as a key-value store",
+		ReadPercent:  70,
+		MinSize:      512,
+		MaxSize:      8 << 10,
+		Keys:         100000,
+		Distribution: Zipfian,
+		Prepare:      true,
+	},
+}
+
+// Profiles returns the built-in profiles, by name
+func Profiles() []Profile {
+	list := make([]Profile, 0, len(profiles))
+	for _, p := range profiles {
+		list = append(list, p)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// LookupProfile returns a built-in profile
+func LookupProfile(name string) (Profile, error) {
+	p, ok := profiles[name]
+	if !ok {
+		names := make([]string, 0, len(profiles))
+		for n := range profiles {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return Profile{}, fmt.Errorf("unknown profile %q; expected one of %s", name, strings.Join(names, ", "))
+	}
+	return p, nil
+}
+
+// Validate checks that the profile describes a workload that can run
+func (p Profile) Validate() error {
+	switch {
+	case p.ReadPercent < 0 || p.DeletePercent < 0 || p.ReadPercent+p.DeletePercent > 100:
+		return fmt.Errorf("profile %s: read and delete percentages must add up to at most 100", p.Name)
+	case p.MinSize < 0 || p.MaxSize < p.MinSize:
+		return fmt.Errorf("profile %s: invalid block sizes %d to %d", p.Name, p.MinSize, p.MaxSize)
+	case p.MaxSize > api.MaxDataSize:
+		return fmt.Errorf("profile %s: blocks cannot be larger than %d bytes", p.Name, api.MaxDataSize)
+	case p.Keys < 1:
+		return fmt.Errorf("profile %s: needs at least one key", p.Name)
+	}
+	switch p.Distribution {
+	case Uniform, Zipfian, Sequential:
+	default:
+		return fmt.Errorf("profile %s: unknown key distribution %q", p.Name, p.Distribution)
+	}
+	return nil
+}
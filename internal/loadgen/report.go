@@ -0,0 +1,221 @@
+package loadgen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/3fs-storage/pkg/config"
+)
+
+// ReportFormat identifies a load generator report, telling it from other
+// JSON documents
+const ReportFormat = "3fs-loadgen/1"
+
+// Report is the outcome of a run, in a format that runs of the same
+// profile can be compared in
+type Report struct {
+	Format    string    `json:"format"`
+	Profile   Profile   `json:"profile"`
+	Workers   int       `json:"workers"`
+	Prefix    string    `json:"prefix"`
+	Seed      int64     `json:"seed"`
+	WarmUp    float64   `json:"warm_up_seconds"`
+	StartedAt time.Time `json:"started_at"`
+	// Elapsed is the length of the measured phase in seconds
+	Elapsed float64 `json:"elapsed_seconds"`
+	// Ops reports each kind of operation run, and Total all of them
+	Ops   map[string]*OpReport `json:"ops"`
+	Total *OpReport            `json:"total"`
+}
+
+// OpReport is the throughput and latencies of one kind of operation.
+// Latencies are of the successful operations, in milliseconds.
+type OpReport struct {
+	Count     int64     `json:"count"`
+	Errors    int64     `json:"errors"`
+	Bytes     int64     `json:"bytes"`
+	OpsPerSec float64   `json:"ops_per_sec"`
+	MBPerSec  float64   `json:"mb_per_sec"`
+	LatencyMs Latencies `json:"latency_ms"`
+}
+
+// Latencies summarises a distribution of latencies
+type Latencies struct {
+	Mean float64 `json:"mean"`
+	P50  float64 `json:"p50"`
+	P90  float64 `json:"p90"`
+	P99  float64 `json:"p99"`
+	P999 float64 `json:"p999"`
+	Max  float64 `json:"max"`
+}
+
+// newReport builds the report of the measured phase from the workers'
+// samples
+func newReport(opts Options, started time.Time, elapsed time.Duration, workers []*worker) *Report {
+	r := &Report{
+		Format:    ReportFormat,
+		Profile:   opts.Profile,
+		Workers:   opts.Workers,
+		Prefix:    opts.Prefix,
+		Seed:      opts.Seed,
+		WarmUp:    opts.WarmUp.Seconds(),
+		StartedAt: started.UTC(),
+		Elapsed:   elapsed.Seconds(),
+		Ops:       make(map[string]*OpReport),
+	}
+
+	var all []time.Duration
+	total := &OpReport{}
+	for _, op := range []string{OpRead, OpWrite, OpDelete} {
+		var latencies []time.Duration
+		report := &OpReport{}
+		for _, w := range workers {
+			s := w.samples[op]
+			report.Count += s.count
+			report.Errors += s.errors
+			report.Bytes += s.bytes
+			latencies = append(latencies, s.latencies...)
+		}
+		if report.Count == 0 {
+			continue
+		}
+		report.finish(latencies, elapsed)
+		r.Ops[op] = report
+
+		total.Count += report.Count
+		total.Errors += report.Errors
+		total.Bytes += report.Bytes
+		all = append(all, latencies...)
+	}
+	total.finish(all, elapsed)
+	r.Total = total
+	return r
+}
+
+// finish computes the rates and latency percentiles of an operation
+func (o *OpReport) finish(latencies []time.Duration, elapsed time.Duration) {
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		o.OpsPerSec = float64(o.Count) / seconds
+		o.MBPerSec = float64(o.Bytes) / 1e6 / seconds
+	}
+	if len(latencies) == 0 {
+		return
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	var sum time.Duration
+	for _, l := range latencies {
+		sum += l
+	}
+	percentile := func(q float64) float64 {
+		i := int(q*float64(len(latencies))+0.5) - 1
+		i = max(0, min(i, len(latencies)-1))
+		return ms(latencies[i])
+	}
+	o.LatencyMs = Latencies{
+		Mean: ms(sum / time.Duration(len(latencies))),
+		P50:  percentile(0.5),
+		P90:  percentile(0.9),
+		P99:  percentile(0.99),
+		P999: percentile(0.999),
+		Max:  ms(latencies[len(latencies)-1]),
+	}
+}
+
+// ms returns a duration in milliseconds
+func ms(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// ReadReport reads a report written as JSON, such as that of an earlier
+// run to compare with
+func ReadReport(path string) (*Report, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r Report
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("failed to decode report %s: %w", path, err)
+	}
+	if r.Format != ReportFormat {
+		return nil, fmt.Errorf("%s is not a load generator report", path)
+	}
+	return &r, nil
+}
+
+// WriteText prints a report as a table per operation. With base, the
+// report of an earlier run, each figure is followed by its change from it.
+func WriteText(out io.Writer, r *Report, base *Report) error {
+	fmt.Fprintf(out, "profile %s: %s\n", r.Profile.Name, r.Profile.Description)
+	fmt.Fprintf(out, "%d workers, %d keys (%s), blocks of %s, %.1fs measured after %.1fs of warm-up\n",
+		r.Workers, r.Profile.Keys, r.Profile.Distribution, sizeRange(r.Profile), r.Elapsed, r.WarmUp)
+	if base != nil {
+		fmt.Fprintf(out, "compared with the run of %s\n", base.StartedAt.Format(time.RFC3339))
+		if base.Profile.Name != r.Profile.Name {
+			fmt.Fprintf(out, "warning: that run used profile %s\n", base.Profile.Name)
+		}
+	}
+	fmt.Fprintln(out)
+
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "OP\tCOUNT\tERRORS\tOPS/S\tMB/S\tMEAN\tP50\tP90\tP99\tP99.9\tMAX\t")
+	names := make([]string, 0, len(r.Ops)+1)
+	for _, op := range []string{OpRead, OpWrite, OpDelete} {
+		if _, ok := r.Ops[op]; ok {
+			names = append(names, op)
+		}
+	}
+	names = append(names, "total")
+	for _, name := range names {
+		cur, prev := r.opReport(name), base.opReport(name)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t\n", name, cur.Count, cur.Errors,
+			compare("%.0f", cur.OpsPerSec, prev, func(o *OpReport) float64 { return o.OpsPerSec }),
+			compare("%.1f", cur.MBPerSec, prev, func(o *OpReport) float64 { return o.MBPerSec }),
+			compare("%.2fms", cur.LatencyMs.Mean, prev, func(o *OpReport) float64 { return o.LatencyMs.Mean }),
+			compare("%.2fms", cur.LatencyMs.P50, prev, func(o *OpReport) float64 { return o.LatencyMs.P50 }),
+			compare("%.2fms", cur.LatencyMs.P90, prev, func(o *OpReport) float64 { return o.LatencyMs.P90 }),
+			compare("%.2fms", cur.LatencyMs.P99, prev, func(o *OpReport) float64 { return o.LatencyMs.P99 }),
+			compare("%.2fms", cur.LatencyMs.P999, prev, func(o *OpReport) float64 { return o.LatencyMs.P999 }),
+			compare("%.2fms", cur.LatencyMs.Max, prev, func(o *OpReport) float64 { return o.LatencyMs.Max }))
+	}
+	return w.Flush()
+}
+
+// opReport returns the report of an operation, or the total, and nil for
+// operations the run did not do or a missing report
+func (r *Report) opReport(name string) *OpReport {
+	if r == nil {
+		return nil
+	}
+	if name == "total" {
+		return r.Total
+	}
+	return r.Ops[name]
+}
+
+// compare formats a figure, followed by its change from the same figure
+// of prev if there is one
+func compare(format string, value float64, prev *OpReport, figure func(*OpReport) float64) string {
+	s := fmt.Sprintf(format, value)
+	if prev == nil {
+		return s
+	}
+	before := figure(prev)
+	if before == 0 {
+		return s
+	}
+	return fmt.Sprintf("%s (%+.0f%%)", s, (value-before)/before*100)
+}
+
+// sizeRange describes the sizes of the blocks a profile writes
+func sizeRange(p Profile) string {
+	if p.MinSize == p.MaxSize {
+		return config.Size(p.MinSize).String()
+	}
+	return config.Size(p.MinSize).String() + " to " + config.Size(p.MaxSize).String()
+}
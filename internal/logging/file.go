@@ -0,0 +1,173 @@
+package logging
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/config"
+)
+
+// DefaultMaxSize is the size at which a log file is rotated by default
+const DefaultMaxSize = 100 << 20
+
+// rotatedTimeFormat names rotated files so that they sort by age
+const rotatedTimeFormat = "20060102T150405.000000000"
+
+// Output opens the destination of the logging configuration: stderr,
+// stdout, or a log file rotated by size. Closing stderr or stdout does
+// nothing.
+func Output(cfg config.LoggingConfig) (io.WriteCloser, error) {
+	switch cfg.Output {
+	case "", "stderr":
+		return nopCloser{os.Stderr}, nil
+	case "stdout":
+		return nopCloser{os.Stdout}, nil
+	default:
+		return OpenFile(cfg.Output, int64(cfg.MaxSize), time.Duration(cfg.MaxAge), cfg.MaxFiles)
+	}
+}
+
+// nopCloser leaves the standard streams open
+type nopCloser struct {
+	io.Writer
+}
+
+// Close does nothing
+func (nopCloser) Close() error {
+	return nil
+}
+
+// File is a log file that is rotated once it grows past its maximum size:
+// it is renamed with a timestamp and a new file is started. Rotated files
+// past the maximum age or count are removed.
+type File struct {
+	path     string
+	maxSize  int64
+	maxAge   time.Duration
+	maxFiles int
+	file     *os.File
+	size     int64
+	mu       sync.Mutex
+}
+
+// OpenFile opens the log file at path for appending, creating it and its
+// directory if needed. maxSize is the size in bytes at which the file is
+// rotated, zero meaning DefaultMaxSize. maxAge and maxFiles bound the
+// rotated files kept, zero keeping them all.
+func OpenFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*File, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+
+	f := &File{path: path, maxSize: maxSize, maxAge: maxAge, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open opens the current file for appending
+func (f *File) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to stat log file: %w", err)
+	}
+
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+// Write appends a record, rotating the file first if the record would take
+// it past its maximum size
+func (f *File) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, fmt.Errorf("log file %s is closed", f.path)
+	}
+	if f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		// Keep logging to the current file if it cannot be rotated
+		if err := f.rotate(); err != nil && f.file == nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate renames the current file and opens a new one. Must be called with
+// the lock held.
+func (f *File) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close log file: %w", err)
+	}
+	f.file = nil
+
+	ext := filepath.Ext(f.path)
+	rotated := strings.TrimSuffix(f.path, ext) + "-" + time.Now().UTC().Format(rotatedTimeFormat) + ext
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return fmt.Errorf("failed to rotate log file: %w", renameErr)
+	}
+	return f.prune()
+}
+
+// prune removes the rotated files past the maximum age or count
+func (f *File) prune() error {
+	ext := filepath.Ext(f.path)
+	files, err := filepath.Glob(strings.TrimSuffix(f.path, ext) + "-*" + ext)
+	if err != nil {
+		return err
+	}
+	// Timestamps sort by age, oldest first
+	sort.Strings(files)
+
+	for i, file := range files {
+		expired := f.maxFiles > 0 && i < len(files)-f.maxFiles
+		if !expired && f.maxAge > 0 {
+			if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				expired = true
+			}
+		}
+		if expired {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove rotated log file: %w", err)
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes the file
+func (f *File) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
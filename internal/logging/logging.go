@@ -0,0 +1,151 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/3fs-storage/pkg/config"
+)
+
+// ParseLevel converts a configured level name into a slog level
+func ParseLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "", "info":
+		return slog.LevelInfo, nil
+	case "debug":
+		return slog.LevelDebug, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("unknown log level %q", level)
+	}
+}
+
+// ComponentKey is the attribute naming the subsystem a record comes from
+const ComponentKey = "component"
+
+// levels holds the level of the root logger and the overrides of
+// individual components, which SetLevels changes while the process runs
+var levels = &levelTable{root: slog.LevelInfo}
+
+// levelTable maps components to their level
+type levelTable struct {
+	root       slog.Level
+	components map[string]slog.Level
+	mu         sync.RWMutex
+}
+
+// level returns the level of a component
+func (t *levelTable) level(component string) slog.Level {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if l, ok := t.components[component]; ok {
+		return l
+	}
+	return t.root
+}
+
+// New creates the root logger described by the logging configuration,
+// writing to w
+func New(w io.Writer, cfg config.LoggingConfig) (*slog.Logger, error) {
+	// Records are filtered by componentHandler, so the handler itself
+	// lets everything through
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug}
+
+	var handler slog.Handler
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %q", cfg.Format)
+	}
+
+	if err := SetLevels(cfg); err != nil {
+		return nil, err
+	}
+	return slog.New(&componentHandler{inner: handler}), nil
+}
+
+// SetLevels changes the level of the root logger and of the components
+// with an override, for every logger derived from it. Nothing is changed
+// if a level is unknown.
+func SetLevels(cfg config.LoggingConfig) error {
+	root, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	components := make(map[string]slog.Level, len(cfg.Components))
+	for component, name := range cfg.Components {
+		l, err := ParseLevel(name)
+		if err != nil {
+			return fmt.Errorf("component %s: %w", component, err)
+		}
+		components[component] = l
+	}
+
+	levels.mu.Lock()
+	defer levels.mu.Unlock()
+
+	levels.root = root
+	levels.components = components
+	return nil
+}
+
+// componentHandler filters records by the level of the component that
+// logs them, so that one subsystem can log at debug without flooding the
+// log with every other one
+type componentHandler struct {
+	inner     slog.Handler
+	component string
+}
+
+// Enabled reports whether the component logs at the level
+func (h *componentHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= levels.level(h.component)
+}
+
+// Handle writes the record
+func (h *componentHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+// WithAttrs returns a handler with the attributes, taking the component
+// from them if they name one
+func (h *componentHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	component := h.component
+	for _, attr := range attrs {
+		if attr.Key == ComponentKey {
+			component = attr.Value.String()
+		}
+	}
+	return &componentHandler{inner: h.inner.WithAttrs(attrs), component: component}
+}
+
+// WithGroup returns a handler nesting attributes under the group
+func (h *componentHandler) WithGroup(name string) slog.Handler {
+	return &componentHandler{inner: h.inner.WithGroup(name), component: h.component}
+}
+
+// Component returns a child logger tagged with the subsystem name. A nil
+// logger yields one that discards everything, so subsystems can be
+// constructed without logging in tools and tests.
+func Component(logger *slog.Logger, name string) *slog.Logger {
+	if logger == nil {
+		logger = Discard()
+	}
+	return logger.With(ComponentKey, name)
+}
+
+// Discard returns a logger that drops all records
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelError + 1}))
+}
@@ -0,0 +1,269 @@
+// Package memory shares one byte budget among the consumers of a node's
+// memory, so that the node slows down instead of running out of it.
+//
+// Consumers are of two kinds. Caches admit what fits in the budget and
+// evict their own least recently used entries to make room; they never
+// wait. Buffers held for the duration of an operation, such as request
+// frames and buffered writes, reserve what they hold: when the budget is
+// short, the caches registered as reclaimers are shrunk first, and the
+// reservation then waits for memory to be released, failing with
+// ErrExhausted once its context is done.
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// ErrExhausted is returned when a reservation cannot be met within the
+// budget
+var ErrExhausted = errors.New("memory budget exhausted")
+
+// PressureRatio is the share of the budget in use past which the budget
+// reports pressure, and optional work such as prefetching is skipped
+const PressureRatio = 0.9
+
+// Reclaimer is a cache that frees memory on demand
+type Reclaimer interface {
+	// ReclaimMemory evicts entries until at least bytes are freed or the
+	// cache is empty, returning the bytes freed. The budget calls it
+	// without holding its lock; the reclaimer must release what it frees.
+	ReclaimMemory(bytes int64) int64
+}
+
+// reclaimer is a registered reclaimer and its consumer's name
+type reclaimer struct {
+	name string
+	r    Reclaimer
+}
+
+// Budget is a byte budget shared by named consumers, safe for concurrent
+// use. A nil budget is unlimited.
+type Budget struct {
+	limit int64
+
+	mu         sync.Mutex
+	used       int64
+	consumers  map[string]int64
+	reclaimers []reclaimer
+	// released is closed, and replaced, whenever memory is released, to
+	// wake the reservations waiting for it
+	released  chan struct{}
+	reclaimed int64
+	waits     uint64
+	rejected  uint64
+}
+
+// NewBudget creates a budget of limit bytes
+func NewBudget(limit int64) (*Budget, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("memory budget must be greater than zero, got %d", limit)
+	}
+	return &Budget{
+		limit:     limit,
+		consumers: make(map[string]int64),
+		released:  make(chan struct{}),
+	}, nil
+}
+
+// Register adds a cache to shrink when a reservation does not fit
+func (b *Budget) Register(name string, r Reclaimer) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reclaimers = append(b.reclaimers, reclaimer{name: name, r: r})
+}
+
+// Admit takes n bytes for a cache if they fit in the budget, without
+// shrinking anything or waiting. It may be called with the cache's lock
+// held.
+func (b *Budget) Admit(name string, n int64) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.takeLocked(name, n)
+	return true
+}
+
+// Charge takes n bytes whether or not they fit, for memory that is already
+// held, such as buffered writes read back at startup
+func (b *Budget) Charge(name string, n int64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.takeLocked(name, n)
+}
+
+// TryReserve takes n bytes, shrinking the caches if they do not fit, and
+// reports false if they still do not. It must not be called with the lock
+// of a reclaimer held.
+func (b *Budget) TryReserve(name string, n int64) bool {
+	if b == nil {
+		return true
+	}
+	if b.reserve(name, n) {
+		return true
+	}
+	b.mu.Lock()
+	b.rejected++
+	b.mu.Unlock()
+	return false
+}
+
+// Reserve takes n bytes, shrinking the caches if they do not fit, and
+// otherwise waiting for memory to be released until ctx is done. It must
+// not be called with the lock of a reclaimer held.
+func (b *Budget) Reserve(ctx context.Context, name string, n int64) error {
+	if b == nil {
+		return nil
+	}
+	if n > b.limit {
+		b.mu.Lock()
+		b.rejected++
+		b.mu.Unlock()
+		return fmt.Errorf("%s needs %d bytes, more than the whole budget of %d: %w", name, n, b.limit, ErrExhausted)
+	}
+	waited := false
+	for {
+		b.mu.Lock()
+		released := b.released
+		b.mu.Unlock()
+
+		if b.reserve(name, n) {
+			return nil
+		}
+		if !waited {
+			waited = true
+			b.mu.Lock()
+			b.waits++
+			b.mu.Unlock()
+		}
+		select {
+		case <-released:
+		case <-ctx.Done():
+			b.mu.Lock()
+			b.rejected++
+			b.mu.Unlock()
+			return fmt.Errorf("%s could not reserve %d bytes: %w: %w", name, n, ErrExhausted, ctx.Err())
+		}
+	}
+}
+
+// reserve takes n bytes if they fit, or fit once the caches are shrunk by
+// the excess
+func (b *Budget) reserve(name string, n int64) bool {
+	b.mu.Lock()
+	excess := b.used + n - b.limit
+	if excess <= 0 {
+		b.takeLocked(name, n)
+		b.mu.Unlock()
+		return true
+	}
+	reclaimers := append([]reclaimer(nil), b.reclaimers...)
+	b.mu.Unlock()
+
+	// Shrink the caches in the order they registered, each releasing
+	// what it frees
+	for _, rc := range reclaimers {
+		if excess <= 0 {
+			break
+		}
+		freed := rc.r.ReclaimMemory(excess)
+		excess -= freed
+		b.mu.Lock()
+		b.reclaimed += freed
+		b.mu.Unlock()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > b.limit {
+		return false
+	}
+	b.takeLocked(name, n)
+	return true
+}
+
+// takeLocked accounts n bytes to a consumer. Must be called with the lock
+// held.
+func (b *Budget) takeLocked(name string, n int64) {
+	b.used += n
+	b.consumers[name] += n
+}
+
+// Release gives back n bytes a consumer took
+func (b *Budget) Release(name string, n int64) {
+	if b == nil || n == 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+	b.consumers[name] -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// Pressure reports whether the budget is nearly used up
+func (b *Budget) Pressure() bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return float64(b.used) >= float64(b.limit)*PressureRatio
+}
+
+// Stats reports a budget's use, by consumer. Waits counts the reservations
+// that had to wait for memory, and Rejected those refused.
+type Stats struct {
+	Limit          int64            `json:"limit"`
+	Used           int64            `json:"used"`
+	Consumers      map[string]int64 `json:"consumers"`
+	Reclaimers     []string         `json:"reclaimers"`
+	ReclaimedBytes int64            `json:"reclaimed_bytes"`
+	Waits          uint64           `json:"waits"`
+	Rejected       uint64           `json:"rejected"`
+}
+
+// Stats returns the budget's use, by consumer
+func (b *Budget) Stats() *Stats {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := &Stats{
+		Limit:          b.limit,
+		Used:           b.used,
+		Consumers:      make(map[string]int64, len(b.consumers)),
+		Reclaimers:     make([]string, 0, len(b.reclaimers)),
+		ReclaimedBytes: b.reclaimed,
+		Waits:          b.waits,
+		Rejected:       b.rejected,
+	}
+	for name, n := range b.consumers {
+		stats.Consumers[name] = n
+	}
+	seen := make(map[string]bool)
+	for _, rc := range b.reclaimers {
+		if !seen[rc.name] {
+			seen[rc.name] = true
+			stats.Reclaimers = append(stats.Reclaimers, rc.name)
+		}
+	}
+	sort.Strings(stats.Reclaimers)
+	return stats
+}
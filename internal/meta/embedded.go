@@ -0,0 +1,204 @@
+package meta
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/kv"
+)
+
+const (
+	// dataPrefix is the prefix of the embedded store's keys holding the
+	// backend's keys
+	dataPrefix = "k/"
+	// intentPrefix is the prefix of the keys of transactions being applied
+	intentPrefix = "i/"
+)
+
+// embedded is a backend kept in a key-value store in blocks. The store
+// changes one key at a time, so a transaction is first written as an
+// intent, then applied, then removed; an intent left by a failure is
+// applied again before the store is next used. Transactions are
+// serialised within the process, so a namespace using the embedded
+// backend must have a single writer.
+type embedded struct {
+	blocks kv.Blocks
+	name   string
+	mu     sync.Mutex
+	store  *kv.Store
+	// pending is set while an intent may be left unapplied
+	pending bool
+}
+
+// NewEmbedded returns a backend kept in the key-value store named name,
+// which is created when first used
+func NewEmbedded(blocks kv.Blocks, name string) Backend {
+	return &embedded{blocks: blocks, name: name}
+}
+
+// open opens or creates the store and applies the intents left in it. It
+// is called with the lock held.
+func (e *embedded) open(ctx context.Context) (*kv.Store, error) {
+	if e.store == nil {
+		store, err := kv.Open(ctx, e.blocks, e.name)
+		if errors.Is(err, kv.ErrNoStore) {
+			store, err = kv.Create(ctx, e.blocks, e.name, kv.Options{})
+			if errors.Is(err, kv.ErrExists) {
+				store, err = kv.Open(ctx, e.blocks, e.name)
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to open metadata store %s: %w", e.name, err)
+		}
+		e.store = store
+		e.pending = true
+	}
+	if e.pending {
+		intents, err := e.store.Scan(ctx, intentPrefix, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pending transactions: %w", err)
+		}
+		for _, intent := range intents {
+			var ops []Op
+			if err := json.Unmarshal(intent.Value, &ops); err != nil {
+				return nil, fmt.Errorf("failed to decode transaction %s: %w", intent.Key, err)
+			}
+			if err := e.apply(ctx, intent.Key, ops); err != nil {
+				return nil, err
+			}
+		}
+		e.pending = false
+	}
+	return e.store, nil
+}
+
+// apply makes a transaction's changes and removes its intent
+func (e *embedded) apply(ctx context.Context, intent string, ops []Op) error {
+	for _, op := range ops {
+		var err error
+		if op.Value == nil {
+			err = e.store.Delete(ctx, dataPrefix+op.Key)
+		} else {
+			err = e.store.Put(ctx, dataPrefix+op.Key, op.Value)
+		}
+		if err != nil {
+			e.pending = true
+			return fmt.Errorf("failed to apply transaction: %w", err)
+		}
+	}
+	if err := e.store.Delete(ctx, intent); err != nil {
+		e.pending = true
+		return fmt.Errorf("failed to complete transaction: %w", err)
+	}
+	return nil
+}
+
+// Get returns the value of a key
+func (e *embedded) Get(ctx context.Context, key string) ([]byte, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store, err := e.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, err := store.Get(ctx, dataPrefix+key)
+	if errors.Is(err, kv.ErrNotFound) {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return value, err
+}
+
+// Scan returns the keys starting with prefix and their values
+func (e *embedded) Scan(ctx context.Context, prefix string) ([]KeyValue, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store, err := e.open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := store.Scan(ctx, dataPrefix+prefix, 0)
+	if err != nil {
+		return nil, err
+	}
+	kvs := make([]KeyValue, len(entries))
+	for i, entry := range entries {
+		kvs[i] = KeyValue{Key: strings.TrimPrefix(entry.Key, dataPrefix), Value: entry.Value}
+	}
+	return kvs, nil
+}
+
+// Commit checks the conditions and applies the changes of a transaction
+func (e *embedded) Commit(ctx context.Context, conds []Cond, ops []Op) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	store, err := e.open(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, cond := range conds {
+		value, err := store.Get(ctx, dataPrefix+cond.Key)
+		if errors.Is(err, kv.ErrNotFound) {
+			value, err = nil, nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", cond.Key, err)
+		}
+		if (value == nil) != (cond.Value == nil) || !bytes.Equal(value, cond.Value) {
+			return fmt.Errorf("%w: %s changed", ErrConflict, cond.Key)
+		}
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	intent := intentPrefix + hex.EncodeToString(nonce)
+	data, err := json.Marshal(ops)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction: %w", err)
+	}
+	if err := store.Put(ctx, intent, data); err != nil {
+		return fmt.Errorf("failed to write transaction: %w", err)
+	}
+	return e.apply(ctx, intent, ops)
+}
+
+// kvBlocks adapts the block API of an object store to the one a key-value
+// store is kept in
+type kvBlocks struct {
+	blocks block.Blocks
+}
+
+// Read reads a block, reporting a missing one as api.ErrNotFound
+func (b kvBlocks) Read(ctx context.Context, blockID string) ([]byte, error) {
+	data, err := b.blocks.ReadBlock(ctx, blockID)
+	if errors.Is(err, block.ErrBlockNotFound) {
+		return nil, fmt.Errorf("%w: %s", api.ErrNotFound, blockID)
+	}
+	return data, err
+}
+
+// Write writes a block
+func (b kvBlocks) Write(ctx context.Context, blockID string, data []byte) error {
+	return b.blocks.WriteBlock(ctx, blockID, data)
+}
+
+// Delete deletes a block
+func (b kvBlocks) Delete(ctx context.Context, blockID string) error {
+	return b.blocks.DeleteBlock(ctx, blockID)
+}
+
+// List lists the blocks with IDs starting with prefix
+func (b kvBlocks) List(ctx context.Context, prefix string) ([]string, error) {
+	return b.blocks.ListBlocks(ctx, prefix)
+}
@@ -0,0 +1,171 @@
+package meta
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// etcd is a backend kept in etcd through its v3 JSON gateway, whose
+// transactions compare and change keys at once
+type etcd struct {
+	endpoints []string
+	prefix    string
+	client    *http.Client
+}
+
+// NewEtcd returns a backend keeping its keys under prefix in the etcd
+// cluster serving endpoints
+func NewEtcd(endpoints []string, prefix string) Backend {
+	return &etcd{
+		endpoints: endpoints,
+		prefix:    prefix,
+		client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// etcdKV is a key and value in a range response
+type etcdKV struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// b64 encodes a key or value for the JSON gateway
+func b64(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// prefixEnd returns the range end that selects every key with the prefix
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return "\x00"
+}
+
+// Get returns the value of a key
+func (e *etcd) Get(ctx context.Context, key string) ([]byte, error) {
+	var resp struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	req := map[string]interface{}{"key": b64([]byte(e.prefix + key))}
+	if err := e.do(ctx, "/v3/kv/range", req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", key, err)
+	}
+	if len(resp.KVs) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNotFound, key)
+	}
+	return base64.StdEncoding.DecodeString(resp.KVs[0].Value)
+}
+
+// Scan returns the keys starting with prefix and their values
+func (e *etcd) Scan(ctx context.Context, prefix string) ([]KeyValue, error) {
+	var resp struct {
+		KVs []etcdKV `json:"kvs"`
+	}
+	req := map[string]interface{}{
+		"key":       b64([]byte(e.prefix + prefix)),
+		"range_end": b64([]byte(prefixEnd(e.prefix + prefix))),
+	}
+	if err := e.do(ctx, "/v3/kv/range", req, &resp); err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", prefix, err)
+	}
+
+	kvs := make([]KeyValue, len(resp.KVs))
+	for i, kv := range resp.KVs {
+		key, err := base64.StdEncoding.DecodeString(kv.Key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode key: %w", err)
+		}
+		value, err := base64.StdEncoding.DecodeString(kv.Value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode the value of %s: %w", key, err)
+		}
+		kvs[i] = KeyValue{Key: strings.TrimPrefix(string(key), e.prefix), Value: value}
+	}
+	return kvs, nil
+}
+
+// Commit runs a transaction comparing the conditions' keys and applying
+// the ops if they all hold
+func (e *etcd) Commit(ctx context.Context, conds []Cond, ops []Op) error {
+	compare := make([]map[string]interface{}, len(conds))
+	for i, cond := range conds {
+		key := b64([]byte(e.prefix + cond.Key))
+		if cond.Value == nil {
+			// A key that does not exist was never created
+			compare[i] = map[string]interface{}{"key": key, "target": "CREATE", "result": "EQUAL", "create_revision": "0"}
+		} else {
+			compare[i] = map[string]interface{}{"key": key, "target": "VALUE", "result": "EQUAL", "value": b64(cond.Value)}
+		}
+	}
+	success := make([]map[string]interface{}, len(ops))
+	for i, op := range ops {
+		key := b64([]byte(e.prefix + op.Key))
+		if op.Value == nil {
+			success[i] = map[string]interface{}{"request_delete_range": map[string]interface{}{"key": key}}
+		} else {
+			success[i] = map[string]interface{}{"request_put": map[string]interface{}{"key": key, "value": b64(op.Value)}}
+		}
+	}
+
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	req := map[string]interface{}{"compare": compare, "success": success}
+	if err := e.do(ctx, "/v3/kv/txn", req, &resp); err != nil {
+		return fmt.Errorf("failed to commit transaction: %w", err)
+	}
+	if !resp.Succeeded {
+		return ErrConflict
+	}
+	return nil
+}
+
+// do posts a JSON request to the first reachable endpoint and decodes its
+// JSON response
+func (e *etcd) do(ctx context.Context, path string, in, out interface{}) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	var lastErr error
+	for _, endpoint := range e.endpoints {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+path, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to build request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+
+		resp, err := e.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		respBody, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("POST %s returned %s: %s", path, resp.Status, strings.TrimSpace(string(respBody)))
+		}
+		if err := json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to unmarshal response: %w", err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no etcd endpoint reachable: %w", lastErr)
+}
@@ -0,0 +1,338 @@
+// Package meta is the metadata service: it maps the names of a namespace's
+// objects, and so the paths of the files the FUSE mount and the S3
+// gateway serve from it, to their manifests. Renaming an object or a whole
+// directory moves only manifests, in one transaction, so it is atomic and
+// copies no data, and directories are listed from the service rather than
+// by listing blocks.
+//
+// The service keeps its entries in a transactional key-value backend: an
+// embedded store kept in the namespace's own blocks, for a namespace with
+// a single writer, or etcd, which any number of gateways and mounts can
+// share. Other stores, such as FoundationDB, plug in by implementing
+// Backend.
+package meta
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// MaxRenameEntries is the most objects a directory rename moves in one
+// transaction
+const MaxRenameEntries = 1000
+
+// maxAttempts bounds the retries of a change that conflicts with others
+const maxAttempts = 8
+
+// objectPrefix is the prefix of the keys of object manifests
+const objectPrefix = "o/"
+
+var (
+	// ErrNotFound is returned by a backend for a key it does not hold
+	ErrNotFound = errors.New("key not found")
+	// ErrConflict is returned when a transaction's conditions no longer
+	// hold, as another client changed the keys it read
+	ErrConflict = errors.New("transaction conflict")
+	// ErrTooManyEntries is returned for a directory rename moving more
+	// than MaxRenameEntries objects
+	ErrTooManyEntries = errors.New("too many objects to rename at once")
+	// ErrInvalidRename is returned for a rename of a directory into itself
+	ErrInvalidRename = errors.New("cannot rename a directory into itself")
+)
+
+// KeyValue is a key and its value
+type KeyValue struct {
+	Key   string
+	Value []byte
+}
+
+// Cond is a condition a transaction holds on a key: that it has Value, or
+// that it does not exist if Value is nil
+type Cond struct {
+	Key   string
+	Value []byte
+}
+
+// Op is a change a transaction makes: setting a key to Value, or deleting
+// it if Value is nil
+type Op struct {
+	Key   string
+	Value []byte
+}
+
+// Backend is the transactional key-value store the service keeps its
+// entries in
+type Backend interface {
+	// Get returns the value of a key, or an error wrapping ErrNotFound
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Scan returns the keys starting with prefix and their values, sorted
+	// by key
+	Scan(ctx context.Context, prefix string) ([]KeyValue, error)
+	// Commit applies ops at once if every condition holds, and returns an
+	// error wrapping ErrConflict otherwise
+	Commit(ctx context.Context, conds []Cond, ops []Op) error
+}
+
+// Service maps object names to manifests. It implements block.Index.
+type Service struct {
+	backend Backend
+}
+
+// New creates a service keeping its entries in a backend
+func New(backend Backend) *Service {
+	return &Service{backend: backend}
+}
+
+// Open opens the metadata service configured for a namespace. An embedded
+// store is kept in the namespace's blocks, reached through blocks.
+func Open(cfg config.MetadataConfig, blocks block.Blocks, namespace string) (*Service, error) {
+	switch cfg.Backend {
+	case "embedded":
+		name := namespace + api.NamespaceSeparator + api.NamespaceSeparator + "meta"
+		return New(NewEmbedded(kvBlocks{blocks: blocks}, name)), nil
+	case "etcd":
+		if len(cfg.Endpoints) == 0 {
+			return nil, errors.New("the etcd metadata backend requires at least one endpoint")
+		}
+		prefix := cfg.Prefix
+		if prefix == "" {
+			prefix = "/3fs/meta/"
+		}
+		return New(NewEtcd(cfg.Endpoints, prefix+namespace+"/")), nil
+	default:
+		return nil, fmt.Errorf("unknown metadata backend %q", cfg.Backend)
+	}
+}
+
+// key returns the key of an object's manifest
+func key(name string) string {
+	return objectPrefix + name
+}
+
+// read returns an object's manifest and its encoding, or nils if the
+// service does not hold it
+func (s *Service) read(ctx context.Context, name string) (*block.ObjectManifest, []byte, error) {
+	data, err := s.backend.Get(ctx, key(name))
+	if errors.Is(err, ErrNotFound) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read the entry of %s: %w", name, err)
+	}
+	var manifest block.ObjectManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, nil, fmt.Errorf("failed to decode the entry of %s: %w", name, err)
+	}
+	return &manifest, data, nil
+}
+
+// retry runs a change until it commits without a conflict, at most
+// maxAttempts times
+func retry(fn func() error) error {
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		if err = fn(); !errors.Is(err, ErrConflict) {
+			return err
+		}
+	}
+	return err
+}
+
+// notFound returns the error for an object the service does not hold
+func notFound(name string) error {
+	return fmt.Errorf("%w: %s", block.ErrBlockNotFound, name)
+}
+
+// Get returns the manifest of an object
+func (s *Service) Get(ctx context.Context, name string) (*block.ObjectManifest, error) {
+	manifest, _, err := s.read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return nil, notFound(name)
+	}
+	return manifest, nil
+}
+
+// Put stores the manifest of an object, returning the manifest it
+// replaces
+func (s *Service) Put(ctx context.Context, manifest *block.ObjectManifest) (*block.ObjectManifest, error) {
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode the entry of %s: %w", manifest.Name, err)
+	}
+	var previous *block.ObjectManifest
+	err = retry(func() error {
+		var raw []byte
+		var err error
+		if previous, raw, err = s.read(ctx, manifest.Name); err != nil {
+			return err
+		}
+		k := key(manifest.Name)
+		return s.backend.Commit(ctx, []Cond{{Key: k, Value: raw}}, []Op{{Key: k, Value: data}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return previous, nil
+}
+
+// Delete removes the manifest of an object, returning it
+func (s *Service) Delete(ctx context.Context, name string) (*block.ObjectManifest, error) {
+	var manifest *block.ObjectManifest
+	err := retry(func() error {
+		var raw []byte
+		var err error
+		if manifest, raw, err = s.read(ctx, name); err != nil {
+			return err
+		}
+		if manifest == nil {
+			return notFound(name)
+		}
+		k := key(name)
+		return s.backend.Commit(ctx, []Cond{{Key: k, Value: raw}}, []Op{{Key: k}})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// Rename moves an object to a new name, replacing the object there, and
+// returns the replaced object's manifest
+func (s *Service) Rename(ctx context.Context, from, to string) (*block.ObjectManifest, error) {
+	var replaced *block.ObjectManifest
+	err := retry(func() error {
+		manifest, raw, err := s.read(ctx, from)
+		if err != nil {
+			return err
+		}
+		if manifest == nil {
+			return notFound(from)
+		}
+		replaced = nil
+		if from == to {
+			return nil
+		}
+		target, targetRaw, err := s.read(ctx, to)
+		if err != nil {
+			return err
+		}
+
+		manifest.Name = to
+		data, err := json.Marshal(manifest)
+		if err != nil {
+			return fmt.Errorf("failed to encode the entry of %s: %w", to, err)
+		}
+		conds := []Cond{{Key: key(from), Value: raw}, {Key: key(to), Value: targetRaw}}
+		ops := []Op{{Key: key(from)}, {Key: key(to), Value: data}}
+		if err := s.backend.Commit(ctx, conds, ops); err != nil {
+			return err
+		}
+		replaced = target
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// RenamePrefix moves every object whose name starts with from to the same
+// name starting with to, in one transaction, returning the manifests of
+// the objects replaced. Objects created under from while the rename runs
+// stay there.
+func (s *Service) RenamePrefix(ctx context.Context, from, to string) ([]*block.ObjectManifest, error) {
+	if from == to {
+		return nil, nil
+	}
+	if strings.HasPrefix(to, from) {
+		return nil, fmt.Errorf("%w: %s to %s", ErrInvalidRename, from, to)
+	}
+	var replaced []*block.ObjectManifest
+	err := retry(func() error {
+		replaced = nil
+		entries, err := s.backend.Scan(ctx, key(from))
+		if err != nil {
+			return fmt.Errorf("failed to list %s: %w", from, err)
+		}
+		if len(entries) == 0 {
+			return notFound(from)
+		}
+		if len(entries) > MaxRenameEntries {
+			return fmt.Errorf("%w: %d under %s", ErrTooManyEntries, len(entries), from)
+		}
+
+		// A target may itself be moved, when to is a prefix of from; each
+		// key is changed once, by its last op
+		values := make(map[string][]byte, 2*len(entries))
+		var order []string
+		set := func(k string, value []byte) {
+			if _, ok := values[k]; !ok {
+				order = append(order, k)
+			}
+			values[k] = value
+		}
+		conds := make([]Cond, 0, 2*len(entries))
+		moved := make(map[string]bool, len(entries))
+		for _, e := range entries {
+			conds = append(conds, Cond{Key: e.Key, Value: e.Value})
+			moved[e.Key] = true
+			set(e.Key, nil)
+		}
+		for _, e := range entries {
+			var manifest block.ObjectManifest
+			if err := json.Unmarshal(e.Value, &manifest); err != nil {
+				return fmt.Errorf("failed to decode the entry of %s: %w", e.Key, err)
+			}
+			manifest.Name = to + strings.TrimPrefix(manifest.Name, from)
+			data, err := json.Marshal(&manifest)
+			if err != nil {
+				return fmt.Errorf("failed to encode the entry of %s: %w", manifest.Name, err)
+			}
+			k := key(manifest.Name)
+			if !moved[k] {
+				target, raw, err := s.read(ctx, manifest.Name)
+				if err != nil {
+					return err
+				}
+				conds = append(conds, Cond{Key: k, Value: raw})
+				if target != nil {
+					replaced = append(replaced, target)
+				}
+			}
+			set(k, data)
+		}
+
+		ops := make([]Op, len(order))
+		for i, k := range order {
+			ops[i] = Op{Key: k, Value: values[k]}
+		}
+		return s.backend.Commit(ctx, conds, ops)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return replaced, nil
+}
+
+// List returns the names of the objects starting with prefix, sorted
+func (s *Service) List(ctx context.Context, prefix string) ([]string, error) {
+	entries, err := s.backend.Scan(ctx, key(prefix))
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(entries))
+	for i, e := range entries {
+		names[i] = strings.TrimPrefix(e.Key, objectPrefix)
+	}
+	return names, nil
+}
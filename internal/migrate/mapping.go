@@ -0,0 +1,68 @@
+package migrate
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Rule renames the source keys its pattern matches. An empty replacement
+// skips the keys instead.
+type Rule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// ParseRule parses a rule written as pattern=replacement. The pattern is a
+// regular expression that must match the whole key, and the replacement
+// may refer to its groups as $1 or ${name}.
+func ParseRule(s string) (Rule, error) {
+	pattern, replacement, ok := strings.Cut(s, "=")
+	if !ok {
+		return Rule{}, fmt.Errorf("invalid mapping rule %q; use pattern=replacement", s)
+	}
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return Rule{}, fmt.Errorf("invalid mapping rule %q: %w", s, err)
+	}
+	return Rule{pattern: re, replacement: replacement}, nil
+}
+
+// Mapper maps source keys to the names they are imported under, with the
+// first rule that matches a key. A key no rule matches keeps its name.
+type Mapper []Rule
+
+// Map returns the name a key is imported under, and false if it is skipped
+func (m Mapper) Map(key string) (string, bool) {
+	for _, rule := range m {
+		match := rule.pattern.FindStringSubmatchIndex(key)
+		if match == nil {
+			continue
+		}
+		if rule.replacement == "" {
+			return "", false
+		}
+		return string(rule.pattern.ExpandString(nil, rule.replacement, key, match)), true
+	}
+	return key, true
+}
+
+// String returns the rules, comma-separated
+func (m *Mapper) String() string {
+	rules := make([]string, len(*m))
+	for i, rule := range *m {
+		pattern := strings.TrimSuffix(strings.TrimPrefix(rule.pattern.String(), "^(?:"), ")$")
+		rules[i] = pattern + "=" + rule.replacement
+	}
+	return strings.Join(rules, ",")
+}
+
+// Set adds a rule, so that a Mapper can be a repeatable flag
+func (m *Mapper) Set(value string) error {
+	rule, err := ParseRule(value)
+	if err != nil {
+		return err
+	}
+	*m = append(*m, rule)
+	return nil
+}
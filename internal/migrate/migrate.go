@@ -0,0 +1,192 @@
+// Package migrate imports the files of an existing store, a local
+// directory, an S3 bucket or HDFS, into the cluster, so that a dataset can
+// be moved in without writing a tool for it. Files are imported as objects
+// of a namespace, which the S3 gateway and FUSE mounts show under their
+// keys, or as single blocks. Mapping rules rename source keys on the way,
+// a pool of workers imports files in parallel, and a progress file lets an
+// interrupted import resume where it stopped.
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// DefaultWorkers is the number of files imported at the same time
+const DefaultWorkers = 8
+
+// Options configures an import
+type Options struct {
+	// Workers is the number of files imported at the same time, each over
+	// its own connection
+	Workers int
+	// Namespace is the namespace files are imported into as objects
+	Namespace string
+	// Blocks imports each file as a block named by its mapped key, instead
+	// of as an object. Files must then fit in a block.
+	Blocks bool
+	// Mapper renames source keys
+	Mapper Mapper
+	// Progress, if set, skips the files already imported and records the
+	// files imported
+	Progress *Progress
+}
+
+// Result counts the files of an import
+type Result struct {
+	Imported int64 `json:"imported"`
+	Skipped  int64 `json:"skipped"`
+	Failed   int64 `json:"failed"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// task is a file to import under a name
+type task struct {
+	item Item
+	name string
+}
+
+// Run imports the files of a source through connections dial opens. A
+// file that fails to import is logged and counted, and the others are
+// still imported; run the import again with the same progress file to
+// retry the failures. Ending ctx stops the import once the files being
+// imported are, so that each is recorded.
+func Run(ctx context.Context, src Source, dial func() (*client.Client, error), opts Options, logger *slog.Logger) (*Result, error) {
+	if opts.Blocks == (opts.Namespace != "") {
+		return nil, errors.New("import into either a namespace or blocks")
+	}
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+
+	var result Result
+	importCtx := context.WithoutCancel(ctx)
+	tasks := make(chan task, opts.Workers)
+	var wg sync.WaitGroup
+	workerErrs := make(chan error, opts.Workers)
+	for i := 0; i < opts.Workers; i++ {
+		c, err := dial()
+		if err != nil {
+			close(tasks)
+			wg.Wait()
+			return nil, err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.Close()
+			w, err := newWorker(c, opts)
+			if err != nil {
+				workerErrs <- err
+				// Drain the tasks so that the walk is not blocked
+				for range tasks {
+				}
+				return
+			}
+			for t := range tasks {
+				n, err := w.importFile(importCtx, src, t)
+				if err != nil {
+					atomic.AddInt64(&result.Failed, 1)
+					logger.Error("failed to import file", "key", t.item.Key, "name", t.name, "error", err)
+					continue
+				}
+				atomic.AddInt64(&result.Imported, 1)
+				atomic.AddInt64(&result.Bytes, n)
+				logger.Debug("file imported", "key", t.item.Key, "name", t.name, "bytes", n)
+				if opts.Progress != nil {
+					if err := opts.Progress.Record(t.item, t.name); err != nil {
+						logger.Warn("failed to record progress", "key", t.item.Key, "error", err)
+					}
+				}
+			}
+		}()
+	}
+
+	walkErr := src.Walk(ctx, func(item Item) error {
+		name, ok := opts.Mapper.Map(item.Key)
+		if !ok || (opts.Progress != nil && opts.Progress.Done(item, name)) {
+			atomic.AddInt64(&result.Skipped, 1)
+			return nil
+		}
+		select {
+		case tasks <- task{item: item, name: name}:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	close(tasks)
+	wg.Wait()
+	close(workerErrs)
+
+	if err := <-workerErrs; err != nil {
+		return &result, err
+	}
+	if walkErr != nil {
+		return &result, fmt.Errorf("failed to list the source: %w", walkErr)
+	}
+	return &result, nil
+}
+
+// worker imports files over its own connection
+type worker struct {
+	client  *client.Client
+	objects *block.ObjectStore
+}
+
+// newWorker creates a worker importing files as the options say
+func newWorker(c *client.Client, opts Options) (*worker, error) {
+	w := &worker{client: c}
+	if !opts.Blocks {
+		objects, err := block.NewNamespacedObjectStore(block.NewClientBlocks(c), 0, opts.Namespace)
+		if err != nil {
+			return nil, err
+		}
+		w.objects = objects
+	}
+	return w, nil
+}
+
+// importFile imports a file under its name, returning its size
+func (w *worker) importFile(ctx context.Context, src Source, t task) (int64, error) {
+	if w.objects == nil && t.item.Size > api.MaxDataSize {
+		return 0, fmt.Errorf("%d bytes do not fit in a block", t.item.Size)
+	}
+	r, err := src.Open(ctx, t.item.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	if w.objects != nil {
+		manifest, err := w.objects.PutObject(ctx, block.EscapeName(t.name), r, block.ObjectAttributes{})
+		if err != nil {
+			return 0, err
+		}
+		return manifest.Size, nil
+	}
+
+	if err := api.ValidateBlockID(t.name); err != nil {
+		return 0, err
+	}
+	data, err := io.ReadAll(io.LimitReader(r, api.MaxDataSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if len(data) > api.MaxDataSize {
+		return 0, errors.New("the file grew too large for a block")
+	}
+	if err := w.client.Write(ctx, t.name, data); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
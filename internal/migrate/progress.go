@@ -0,0 +1,83 @@
+package migrate
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// progressRecord is a line of a progress file: a file imported, with the
+// size and time it had then
+type progressRecord struct {
+	Key     string `json:"key"`
+	Name    string `json:"name"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mod_time"`
+}
+
+// Progress records the files imported in a file, one JSON line each, so
+// that an interrupted import resumes with the files it had not imported.
+// A file that changed since it was imported is imported again.
+type Progress struct {
+	file *os.File
+	mu   sync.Mutex
+	done map[string]progressRecord
+}
+
+// OpenProgress opens a progress file, creating it if it does not exist
+func OpenProgress(path string) (*Progress, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open progress file: %w", err)
+	}
+
+	p := &Progress{file: f, done: make(map[string]progressRecord)}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var record progressRecord
+		// A line torn by a crash is ignored, and its file imported again
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue
+		}
+		p.done[record.Key] = record
+	}
+	if err := scanner.Err(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to read progress file: %w", err)
+	}
+	return p, nil
+}
+
+// Done reports whether an item was imported under a name and has not
+// changed since
+func (p *Progress) Done(item Item, name string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	record, ok := p.done[item.Key]
+	return ok && record.Name == name && record.Size == item.Size && record.ModTime == item.ModTime.UnixNano()
+}
+
+// Record records an item imported under a name
+func (p *Progress) Record(item Item, name string) error {
+	record := progressRecord{Key: item.Key, Name: name, Size: item.Size, ModTime: item.ModTime.UnixNano()}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if _, err := p.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to record progress: %w", err)
+	}
+	p.done[item.Key] = record
+	return nil
+}
+
+// Close closes the progress file
+func (p *Progress) Close() error {
+	return p.file.Close()
+}
@@ -0,0 +1,240 @@
+package migrate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/s3client"
+)
+
+// Item is a file of a source, named by its key: its path relative to the
+// root of the source, with '/' separating directories
+type Item struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Source is an existing store data is imported from
+type Source interface {
+	// Walk calls fn with each file under the source's root
+	Walk(ctx context.Context, fn func(Item) error) error
+	// Open opens a file by its key
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// Kinds of sources
+const (
+	FromDir  = "dir"
+	FromS3   = "s3"
+	FromHDFS = "hdfs"
+)
+
+// SourceConfig configures the connections to sources
+type SourceConfig struct {
+	// S3 reaches the service of s3:// sources
+	S3 s3client.Config
+	// HDFSUser is the user WebHDFS requests are made as
+	HDFSUser string
+}
+
+// OpenSource opens a source of a kind: a directory, an s3://bucket/prefix
+// location, or a WebHDFS URL such as hdfs://namenode:9870/datasets
+func OpenSource(kind, location string, cfg SourceConfig) (Source, error) {
+	switch kind {
+	case FromDir:
+		info, err := os.Stat(location)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open source: %w", err)
+		}
+		if !info.IsDir() {
+			return nil, fmt.Errorf("source %s is not a directory", location)
+		}
+		return dirSource{root: location}, nil
+	case FromS3:
+		bucket, prefix, ok := s3client.ParseLocation(location)
+		if !ok {
+			return nil, fmt.Errorf("invalid S3 source %q; use s3://bucket/prefix", location)
+		}
+		c, err := s3client.New(cfg.S3)
+		if err != nil {
+			return nil, err
+		}
+		return s3Source{client: c, bucket: bucket, prefix: prefix}, nil
+	case FromHDFS:
+		u, err := url.Parse(location)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid HDFS source %q; use hdfs://namenode:port/path", location)
+		}
+		// WebHDFS is served over HTTP by the namenode
+		if u.Scheme == "hdfs" || u.Scheme == "webhdfs" {
+			u.Scheme = "http"
+		}
+		return &hdfsSource{base: u, root: path.Clean("/" + u.Path), user: cfg.HDFSUser, http: &http.Client{}}, nil
+	}
+	return nil, fmt.Errorf("unknown source %q; sources are %s, %s and %s", kind, FromDir, FromS3, FromHDFS)
+}
+
+// dirSource imports the files of a local directory tree
+type dirSource struct {
+	root string
+}
+
+// Walk walks the directory tree, skipping everything but regular files
+func (s dirSource) Walk(ctx context.Context, fn func(Item) error) error {
+	return filepath.WalkDir(s.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.root, p)
+		if err != nil {
+			return err
+		}
+		return fn(Item{Key: filepath.ToSlash(rel), Size: info.Size(), ModTime: info.ModTime()})
+	})
+}
+
+// Open opens a file of the tree
+func (s dirSource) Open(_ context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(s.root, filepath.FromSlash(key)))
+}
+
+// s3Source imports the objects under a prefix of a bucket, keyed by the
+// rest of their keys
+type s3Source struct {
+	client *s3client.Client
+	bucket string
+	prefix string
+}
+
+// Walk lists the objects under the prefix
+func (s s3Source) Walk(ctx context.Context, fn func(Item) error) error {
+	return s.client.List(ctx, s.bucket, s.prefix, func(object s3client.Object) error {
+		key := strings.TrimPrefix(object.Key, s.prefix)
+		if key == "" || strings.HasSuffix(key, "/") {
+			// The prefix itself, or a directory marker
+			return nil
+		}
+		return fn(Item{Key: key, Size: object.Size, ModTime: object.LastModified})
+	})
+}
+
+// Open fetches an object
+func (s s3Source) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.client.Get(ctx, s.bucket, s.prefix+key)
+}
+
+// hdfsSource imports the files under a directory of HDFS through the
+// namenode's WebHDFS API
+type hdfsSource struct {
+	base *url.URL
+	root string
+	user string
+	http *http.Client
+}
+
+// hdfsStatus is a file status of a WebHDFS listing
+type hdfsStatus struct {
+	PathSuffix       string `json:"pathSuffix"`
+	Type             string `json:"type"`
+	Length           int64  `json:"length"`
+	ModificationTime int64  `json:"modificationTime"`
+}
+
+// request sends a WebHDFS operation on a path
+func (s *hdfsSource) request(ctx context.Context, p, op string) (*http.Response, error) {
+	u := *s.base
+	u.Path = "/webhdfs/v1" + p
+	query := url.Values{"op": {op}}
+	if s.user != "" {
+		query.Set("user.name", s.user)
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	// OPEN redirects to a datanode holding the file, which the client
+	// follows
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("WebHDFS %s %s: %s: %s", op, p, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// Walk lists the directory tree, one directory at a time
+func (s *hdfsSource) Walk(ctx context.Context, fn func(Item) error) error {
+	return s.walk(ctx, "", fn)
+}
+
+// walk lists a directory, given by its key, and the directories under it
+func (s *hdfsSource) walk(ctx context.Context, dir string, fn func(Item) error) error {
+	resp, err := s.request(ctx, path.Join(s.root, dir), "LISTSTATUS")
+	if err != nil {
+		return err
+	}
+	var listing struct {
+		FileStatuses struct {
+			FileStatus []hdfsStatus `json:"FileStatus"`
+		} `json:"FileStatuses"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&listing)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("invalid WebHDFS listing of %s: %w", dir, err)
+	}
+
+	for _, status := range listing.FileStatuses.FileStatus {
+		if status.PathSuffix == "" {
+			return errors.New("the HDFS source must be a directory")
+		}
+		key := path.Join(dir, status.PathSuffix)
+		switch status.Type {
+		case "DIRECTORY":
+			if err := s.walk(ctx, key, fn); err != nil {
+				return err
+			}
+		case "FILE":
+			if err := fn(Item{Key: key, Size: status.Length, ModTime: time.UnixMilli(status.ModificationTime)}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Open reads a file
+func (s *hdfsSource) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.request(ctx, path.Join(s.root, key), "OPEN")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
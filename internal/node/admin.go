@@ -0,0 +1,518 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/version"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// gcGracePeriod is how old an orphaned file must be before GC removes it
+const gcGracePeriod = 10 * time.Minute
+
+// adminServer serves the admin HTTP API of a storage node
+type adminServer struct {
+	node     *StorageNode
+	server   *http.Server
+	listener net.Listener
+}
+
+// newAdminServer creates the admin API server for a node
+func newAdminServer(n *StorageNode) *adminServer {
+	a := &adminServer{node: n}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/node", a.handleNode)
+	mux.HandleFunc("/v1/version", a.handleVersion)
+	mux.HandleFunc("/v1/chain", a.handleChain)
+	mux.HandleFunc("/v1/stats", a.handleStats)
+	mux.HandleFunc("/v1/blocks/", a.handleBlock)
+	mux.HandleFunc("/v1/scrub", a.handleScrub)
+	mux.HandleFunc("/v1/gc", a.handleGC)
+	mux.HandleFunc("/v1/fsck", a.handleFsck)
+	mux.HandleFunc("/v1/maintenance", a.handleMaintenance)
+	mux.HandleFunc("/v1/routing", a.handleRouting)
+	mux.HandleFunc("/v1/ready", a.handleReady)
+	mux.HandleFunc("/v1/decommission", a.handleDecommission)
+	mux.HandleFunc("/v1/readonly", a.handleReadOnly)
+	mux.HandleFunc("/v1/repair", a.handleRepair)
+	mux.HandleFunc(coordinator.UsagePath, a.handleUsage)
+	mux.HandleFunc("/v1/usage/namespaces", a.handleNamespaceUsage)
+	mux.HandleFunc("/v1/clients", a.handleClients)
+	mux.HandleFunc("/v1/targets", a.handleTargets)
+	mux.HandleFunc("/v1/recovery", a.handleRecovery)
+	mux.HandleFunc("/v1/jobs", a.handleJobs)
+	mux.HandleFunc("/v1/jobs/", a.handleJob)
+	mux.HandleFunc("/v1/tunables", a.handleTunables)
+	mux.HandleFunc("/v1/audit", a.handleAudit)
+	mux.HandleFunc("/v1/audit/rotate", a.handleAuditRotate)
+	mux.HandleFunc("/v1/config", a.handleConfig)
+	mux.HandleFunc(api.EventsPath, a.handleEvents)
+	mux.HandleFunc("/v1/events/sinks", a.handleEventSinks)
+	mux.HandleFunc(api.CDCPath, a.handleCDC)
+	mux.HandleFunc("/v1/cache", a.handleCache)
+	mux.HandleFunc("/v1/writeback", a.handleWriteBack)
+	if n.coordinator != nil {
+		mux.Handle(coordinator.PathPrefix+"/", http.StripPrefix(coordinator.PathPrefix, n.coordinator.Handler()))
+	}
+
+	a.server = &http.Server{
+		Handler:           a.audited(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	return a
+}
+
+// start begins serving the admin API on the given address
+func (a *adminServer) start(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", address, err)
+	}
+	a.listener = listener
+
+	go func() {
+		if err := a.server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			a.node.logger.Error("admin API server failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// stop shuts the admin API down, waiting briefly for active requests
+func (a *adminServer) stop() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	return a.server.Shutdown(ctx)
+}
+
+// writeJSON writes v as a JSON response body
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError writes an error as a JSON response body
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// allowMethods rejects requests whose method is not one of methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	return false
+}
+
+// handleNode reports basic information about the node
+func (a *adminServer) handleNode(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	n := a.node
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"id":              n.GetNodeID(),
+		"version":         version.Version,
+		"commit":          version.Get(nil).Commit,
+		"protocol":        api.ProtocolVersion,
+		"min_protocol":    api.MinProtocolVersion,
+		"listen_address":  n.cfg.Storage.Node.ListenAddress,
+		"admin_address":   n.cfg.Storage.Admin.ListenAddress,
+		"running":         n.IsRunning(),
+		"ready":           n.IsReady(),
+		"maintenance":     n.InMaintenance(),
+		"read_only":       n.IsReadOnly(),
+		"decommissioning": n.IsDecommissioning(),
+		"rdma_available":  n.rdmaTransport != nil && n.rdmaTransport.IsRDMAAvailable(),
+		"features":        n.cfg.Storage.FeatureFlags.List(),
+	})
+}
+
+// handleVersion reports the node's build and the features it enables
+func (a *adminServer) handleVersion(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, version.Get(a.node.cfg.Storage.FeatureFlags.List()))
+}
+
+// handleChain reports the CRAQ chain topology
+func (a *adminServer) handleChain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	policies := make(map[string]*api.ReplicationPolicy)
+	if table := a.node.cachedTable(); table != nil && table.Policies != nil {
+		policies = table.Policies
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"chain_length":   a.node.cfg.Storage.Replication.ChainLength,
+		"replica_factor": a.node.cfg.Storage.Replication.Factor,
+		"consistency":    a.node.cfg.Storage.Replication.Consistency,
+		"namespaces":     policies,
+		"nodes":          a.node.craqChain.GetNodes(),
+	})
+}
+
+// handleStats reports the node's storage, cache, chain, transport and
+// scheduler stats, in total and per target
+func (a *adminServer) handleStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.node.GetStats())
+}
+
+// handleBlock looks up the metadata of a single block
+func (a *adminServer) handleBlock(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	blockID := strings.TrimPrefix(r.URL.Path, "/v1/blocks/")
+	if blockID == "" || strings.Contains(blockID, "/") {
+		writeError(w, http.StatusBadRequest, errors.New("invalid block ID"))
+		return
+	}
+
+	t, err := a.node.targetFor(blockID, r.URL.Query().Get("target"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	metadata, err := t.service.ReadBlockMetadata(r.Context(), blockID)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, metadata)
+}
+
+// handleScrub starts a background scrub (POST) or reports the last one (GET)
+func (a *adminServer) handleScrub(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	a.serveJob(w, r, jobScrub)
+}
+
+// handleGC starts a background GC pass (POST) or reports the last one (GET)
+func (a *adminServer) handleGC(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	a.serveJob(w, r, jobGC)
+}
+
+// handleFsck starts an fsck of the node's targets (POST) or reports the
+// last one (GET). The repair, quarantine, replicas and target query
+// parameters set the options of the run.
+func (a *adminServer) handleFsck(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		opts, err := fsckOptions(r.URL.Query())
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		if status, _ := a.node.jobs.Status(jobFsck); !status.Running {
+			if err := a.node.SetFsckOptions(opts); err != nil {
+				writeError(w, http.StatusBadRequest, err)
+				return
+			}
+		}
+	}
+	a.serveJob(w, r, jobFsck)
+}
+
+// fsckOptions reads the options of an fsck from query parameters
+func fsckOptions(query url.Values) (FsckOptions, error) {
+	opts := DefaultFsckOptions()
+	opts.Target = query.Get("target")
+	for name, field := range map[string]*bool{
+		"repair":     &opts.Repair,
+		"quarantine": &opts.Quarantine,
+		"replicas":   &opts.Replicas,
+	} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return opts, fmt.Errorf("invalid %s: %q", name, value)
+		}
+		*field = b
+	}
+	return opts, nil
+}
+
+// serveJob starts a run of a background job (POST) or reports its last run
+// (GET). A job that is already running is not started again.
+func (a *adminServer) serveJob(w http.ResponseWriter, r *http.Request, name string) {
+	status, ok := a.node.jobs.Status(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown job %s", name))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if status.Running {
+			writeError(w, http.StatusConflict, fmt.Errorf("%s is already running", name))
+			return
+		}
+		if err := a.node.jobs.Trigger(name); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"running": true})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, jobStatus(status))
+}
+
+// jobStatus builds the status body of a background job's last run
+func jobStatus(status JobStatus) map[string]interface{} {
+	body := map[string]interface{}{
+		"running": status.Running,
+		"report":  status.LastResult,
+	}
+	if status.LastError != "" {
+		body["error"] = status.LastError
+	}
+	return body
+}
+
+// handleJobs reports the schedule and last run of every background job
+func (a *adminServer) handleJobs(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.node.Jobs())
+}
+
+// handleJob reports the status of one background job (GET) or runs it now,
+// outside its time window (POST)
+func (a *adminServer) handleJob(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/v1/jobs/")
+	status, ok := a.node.jobs.Status(name)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown job %s", name))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := a.node.jobs.Trigger(name); err != nil {
+			writeError(w, http.StatusNotFound, err)
+			return
+		}
+		status, _ = a.node.jobs.Status(name)
+		writeJSON(w, http.StatusAccepted, status)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, status)
+}
+
+// handleMaintenance reports (GET) or sets (PUT) maintenance mode
+func (a *adminServer) handleMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+			writeError(w, http.StatusBadRequest, errors.New(`request body must be {"enabled": true|false}`))
+			return
+		}
+		a.node.SetMaintenance(*body.Enabled)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"enabled": a.node.InMaintenance()})
+}
+
+// handleReadOnly reports (GET) or sets (PUT) read-only mode
+func (a *adminServer) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var body struct {
+			Enabled *bool  `json:"enabled"`
+			Reason  string `json:"reason"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Enabled == nil {
+			writeError(w, http.StatusBadRequest, errors.New(`request body must be {"enabled": true|false, "reason": "..."}`))
+			return
+		}
+		if err := a.node.SetReadOnly(*body.Enabled, body.Reason); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, a.node.ReadOnlyState())
+}
+
+// handleRouting reports the routing table this node last received
+func (a *adminServer) handleRouting(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	table := a.node.RoutingTable()
+	if table == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("no routing table received yet"))
+		return
+	}
+	writeJSON(w, http.StatusOK, table)
+}
+
+// handleReady answers 200 once the node serves requests and 503 before
+func (a *adminServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	if !a.node.IsReady() {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"ready": false})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"ready": true})
+}
+
+// handleDecommission starts migrating the node's data off (POST) or reports
+// the migration's progress (GET)
+func (a *adminServer) handleDecommission(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		if err := a.node.Decommission(); err != nil {
+			writeError(w, http.StatusConflict, err)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, a.node.DecommissionStatus())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.node.DecommissionStatus())
+}
+
+// handleRepair triggers a re-replication pass (POST) or reports the last
+// one (GET)
+func (a *adminServer) handleRepair(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+
+	repair := a.node.repair
+	if repair == nil {
+		writeError(w, http.StatusServiceUnavailable, errors.New("repair requires a coordinator"))
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		repair.Trigger()
+		writeJSON(w, http.StatusAccepted, repair.Status())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, repair.Status())
+}
+
+// handleUsage reports the data held by the node, or by one of its targets,
+// per chain
+func (a *adminServer) handleUsage(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	target := r.URL.Query().Get("target")
+	if target != "" && !a.node.isLocalTarget(target) {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown storage target %s", target))
+		return
+	}
+
+	usage, err := a.node.Usage(target)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, usage)
+}
+
+// handleEventSinks reports the cluster events each sink was sent
+func (a *adminServer) handleEventSinks(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.node.notifier.Stats())
+}
+
+// handleNamespaceUsage reports the use of each namespace since the node
+// started
+func (a *adminServer) handleNamespaceUsage(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.node.NamespaceUsage())
+}
+
+// handleTargets reports the health, usage and chains of each storage target
+func (a *adminServer) handleTargets(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.node.Targets())
+}
+
+// handleRecovery reports the write-ahead log replay and catch-up performed
+// when the node started
+func (a *adminServer) handleRecovery(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.node.RecoveryStatus())
+}
+
+// handleClients reports the connections and throttling of each client
+func (a *adminServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	writeJSON(w, http.StatusOK, a.node.limits.stats())
+}
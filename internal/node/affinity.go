@@ -0,0 +1,105 @@
+package node
+
+import (
+	"fmt"
+
+	"github.com/3fs-storage/internal/affinity"
+	"github.com/3fs-storage/internal/storage"
+)
+
+// startAffinity starts the pinned worker pools when affinity is enabled:
+// one serving the data port, on the CPUs of its network interface's NUMA
+// node, and one for each target's disk operations, on the CPUs of the
+// disk's. A pool is left out where the node is not known, or where the
+// machine has a single node and no CPUs are listed for it.
+func (n *StorageNode) startAffinity() error {
+	cfg := n.cfg.Storage.Tuning.Affinity
+	if !cfg.Enabled {
+		return nil
+	}
+	nodes, err := affinity.Nodes()
+	if err != nil {
+		return fmt.Errorf("failed to read NUMA topology: %w", err)
+	}
+
+	cpus, numaNode, err := affinityCPUs(nodes, cfg.NetworkCPUs, func() (int, error) {
+		node, err := affinity.AddressNode(n.cfg.Storage.Node.ListenAddress)
+		if node < 0 && err == nil && n.cfg.Storage.Node.AdvertiseAddress != "" {
+			node, err = affinity.AddressNode(n.cfg.Storage.Node.AdvertiseAddress)
+		}
+		return node, err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to place data port workers: %w", err)
+	}
+	if cpus != nil {
+		workers := cfg.NetworkWorkers
+		if workers == 0 {
+			workers = n.cfg.Storage.Tuning.IOWorkers * len(n.targets)
+		}
+		if n.netWorkers, err = affinity.NewPool("network", workers, cpus); err != nil {
+			return err
+		}
+		n.logger.Info("pinned data port workers", "cpus", cpus.String(), "numa_node", numaNode, "workers", workers)
+	} else {
+		n.logger.Info("no NUMA node found for the data port, leaving its workers unpinned")
+	}
+
+	for _, t := range n.targets {
+		t := t
+		cpus, numaNode, err := affinityCPUs(nodes, cfg.TargetCPUs[t.id], func() (int, error) {
+			return affinity.PathNode(t.dataPath)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to place workers of storage target %s: %w", t.id, err)
+		}
+		if cpus == nil {
+			n.logger.Info("no NUMA node found for storage target, leaving its workers unpinned", "target", t.id)
+			continue
+		}
+		// One worker for each disk operation the target runs at a time
+		workers := n.cfg.Storage.Tuning.DiskQueueDepth
+		if workers == 0 {
+			workers = storage.DefaultDiskLimits().QueueDepth
+		}
+		pool, err := affinity.NewPool("disk "+t.id, workers, cpus)
+		if err != nil {
+			return err
+		}
+		t.service.SetWorkers(pool)
+		n.logger.Info("pinned storage target workers", "target", t.id, "cpus", cpus.String(), "numa_node", numaNode, "workers", workers)
+	}
+	return nil
+}
+
+// affinityCPUs returns the CPUs a pool is pinned to, and their NUMA node
+// if they are a node's: the CPUs listed, or else those of the node find
+// returns. It returns no CPUs when the node is not known, or when the
+// machine has a single node, where pinning would change nothing.
+func affinityCPUs(nodes []affinity.NUMANode, list string, find func() (int, error)) (affinity.CPUSet, int, error) {
+	if list != "" {
+		cpus, err := affinity.ParseCPUList(list)
+		return cpus, -1, err
+	}
+	if len(nodes) < 2 {
+		return nil, -1, nil
+	}
+	node, err := find()
+	if err != nil {
+		return nil, -1, err
+	}
+	cpus, ok := affinity.NodeCPUs(nodes, node)
+	if !ok {
+		return nil, -1, nil
+	}
+	return cpus, node, nil
+}
+
+// stopAffinity stops the pinned worker pools; work handed to them after
+// runs unpinned
+func (n *StorageNode) stopAffinity() {
+	n.netWorkers.Close()
+	for _, t := range n.targets {
+		t.service.Workers().Close()
+	}
+}
@@ -0,0 +1,238 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/audit"
+	"github.com/3fs-storage/internal/auth"
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/pkg/api"
+)
+
+const (
+	// auditFile is the default audit log within the data path
+	auditFile = "audit.log"
+	// maxAuditBody is the most of an admin request body recorded with it
+	maxAuditBody = 64 * 1024
+	// maxAuditError is the most of a failed admin response kept to find
+	// its error message
+	maxAuditError = 4 * 1024
+)
+
+// openAuditLog opens the audit log if it is enabled
+func (n *StorageNode) openAuditLog() error {
+	cfg := n.cfg.Storage.Audit
+	if !cfg.Enabled {
+		return nil
+	}
+
+	path := cfg.Path
+	if path == "" {
+		path = filepath.Join(n.cfg.Storage.Local.DataPath, auditFile)
+	}
+	log, err := audit.Open(path, int64(cfg.MaxSize), cfg.MaxFiles)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	n.audit = log
+	return nil
+}
+
+// recordAudit appends an event to the audit log, if it is enabled. A
+// failure to record is logged but does not fail the operation, which has
+// already been carried out.
+func (n *StorageNode) recordAudit(e audit.Event) {
+	if n.audit == nil {
+		return
+	}
+	e.Node = n.GetNodeID()
+	if err := n.audit.Record(e); err != nil {
+		n.logger.Error("failed to record audit event", "action", e.Action, "actor", e.Actor, "error", err)
+	}
+}
+
+// auditDelete records a client's delete request and its outcome
+func (n *StorageNode) auditDelete(cc *clientConn, identity *auth.Identity, req *api.Request, resp *api.Response) {
+	n.recordAudit(audit.Event{
+		Actor:    identity.Name,
+		Method:   identity.Method,
+		Remote:   cc.remote,
+		Action:   "delete",
+		Resource: req.BlockID,
+		Success:  resp.Status == api.StatusOK,
+		Error:    resp.Error,
+	})
+}
+
+// auditRecorder captures the status of an admin response, and the start of
+// its body if it failed
+type auditRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// WriteHeader records the response status
+func (r *auditRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// Write keeps the start of a failed response's body
+func (r *auditRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	if r.status >= http.StatusBadRequest {
+		if room := maxAuditError - r.body.Len(); room > 0 {
+			if len(p) < room {
+				room = len(p)
+			}
+			r.body.Write(p[:room])
+		}
+	}
+	return r.ResponseWriter.Write(p)
+}
+
+// audited records every admin request that changes something. Reads are
+// not recorded, nor are the heartbeats and election messages nodes
+// exchange, nor requests redirected to the coordinator leader, which
+// records them itself.
+func (a *adminServer) audited(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.node.audit == nil || !auditedRequest(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditBody))
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("failed to read request body: %w", err))
+			return
+		}
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+
+		rec := &auditRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= 300 && rec.status < 400 {
+			return
+		}
+
+		identity := a.actor(r)
+		e := audit.Event{
+			Actor:   identity.Name,
+			Method:  identity.Method,
+			Remote:  r.RemoteAddr,
+			Action:  r.Method + " " + r.URL.Path,
+			Success: rec.status < http.StatusBadRequest,
+		}
+		if json.Valid(body) {
+			e.Details = body
+		}
+		if !e.Success {
+			var failure struct {
+				Error string `json:"error"`
+			}
+			if json.Unmarshal(rec.body.Bytes(), &failure) != nil || failure.Error == "" {
+				failure.Error = http.StatusText(rec.status)
+			}
+			e.Error = failure.Error
+		}
+		a.node.recordAudit(e)
+	})
+}
+
+// auditedRequest reports whether an admin request is recorded in the audit
+// log
+func auditedRequest(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+
+	path := r.URL.Path
+	if strings.HasPrefix(path, coordinator.PathPrefix+"/election") {
+		return false
+	}
+	if strings.HasPrefix(path, coordinator.PathPrefix+"/nodes/") && strings.HasSuffix(path, "/heartbeat") {
+		return false
+	}
+	return true
+}
+
+// actor identifies who made an admin request. The admin API does not
+// require credentials, but a bearer token that checks out names the actor.
+func (a *adminServer) actor(r *http.Request) *auth.Identity {
+	token := r.Header.Get("Authorization")
+	if token == "" {
+		return auth.Anonymous()
+	}
+	identity, err := a.node.auth.Authenticate(r.Context(), auth.Anonymous(), map[string]string{api.AuthorizationHeader: token})
+	if err != nil {
+		return auth.Anonymous()
+	}
+	return identity
+}
+
+// handleAudit exports the audit log as JSON lines, oldest first. The since
+// and until parameters (RFC 3339) bound the time, actor selects one actor,
+// and action selects actions by prefix.
+func (a *adminServer) handleAudit(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	log := a.node.audit
+	if log == nil {
+		writeError(w, http.StatusNotFound, errors.New("the audit log is disabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	filter := audit.Filter{Actor: query.Get("actor"), Action: query.Get("action")}
+	for name, t := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		if value := query.Get(name); value != "" {
+			parsed, err := time.Parse(time.RFC3339, value)
+			if err != nil {
+				writeError(w, http.StatusBadRequest, fmt.Errorf("invalid %s: %w", name, err))
+				return
+			}
+			*t = parsed
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	if err := log.Export(w, filter); err != nil {
+		a.node.logger.Error("failed to export audit log", "error", err)
+	}
+}
+
+// handleAuditRotate starts a new audit log file, so that the current one
+// can be archived
+func (a *adminServer) handleAuditRotate(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+
+	log := a.node.audit
+	if log == nil {
+		writeError(w, http.StatusNotFound, errors.New("the audit log is disabled"))
+		return
+	}
+	if err := log.Rotate(); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"path": log.Path()})
+}
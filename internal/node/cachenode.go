@@ -0,0 +1,424 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/readcache"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+const (
+	// cacheFetchers is the number of connections to each chain member a
+	// cache node reads misses through, as requests to one node are
+	// serialised on a connection
+	cacheFetchers = 8
+	// cacheRefetchers is the number of workers fetching the new version of
+	// blocks invalidated by the change log
+	cacheRefetchers = 2
+	// cacheRefetchQueue bounds the invalidated blocks waiting to be
+	// fetched again; beyond it they are fetched on their next read
+	cacheRefetchQueue = 1024
+	// cacheFollowInterval is how often the nodes whose change logs are
+	// followed are updated from the routing table
+	cacheFollowInterval = 5 * time.Second
+	// cacheFollowWait is how long each read of a change log waits for
+	// records
+	cacheFollowWait = 30 * time.Second
+	// cacheFollowRetry is how long a follower waits after a failed read
+	cacheFollowRetry = 5 * time.Second
+)
+
+// CacheStats reports what a cache node holds and how it served reads
+type CacheStats struct {
+	readcache.Stats
+	Revalidations uint64 `json:"revalidations"`
+	Refetches     uint64 `json:"refetches"`
+	// RefetchesSkipped counts the refetches dropped while the memory
+	// budget was under pressure
+	RefetchesSkipped uint64 `json:"refetches_skipped"`
+	// Following are the admin addresses of the nodes whose change logs
+	// invalidate the cache
+	Following []string `json:"following"`
+}
+
+// cacheNode serves reads from a cache of hot blocks on a node holding no
+// replicas. Misses are read from the block's chain and kept; the change
+// logs of the storage nodes invalidate blocks as they are rewritten or
+// deleted, and a block cached for longer than the max age is checked
+// against its chain before it is served, in case an invalidation was
+// missed.
+type cacheNode struct {
+	node     *StorageNode
+	cache    *readcache.Cache
+	maxAge   time.Duration
+	clusters chan *client.Cluster
+	refetch  chan string
+	http     *http.Client
+
+	revalidations    atomic.Uint64
+	refetches        atomic.Uint64
+	refetchesSkipped atomic.Uint64
+
+	mu        sync.Mutex
+	followers map[string]context.CancelFunc
+}
+
+// startCacheNode opens the cache of a node in the cache role and starts
+// following the change logs of the storage nodes
+func (n *StorageNode) startCacheNode() error {
+	cfg := n.cfg.Storage.Cache
+	cache, err := readcache.Open(readcache.Options{
+		MemoryBytes: int64(cfg.MemorySize),
+		Dir:         cfg.DiskPath,
+		DiskBytes:   int64(cfg.DiskSize),
+		Budget:      n.memory,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open block cache: %w", err)
+	}
+
+	table := n.cachedTable()
+	if table == nil {
+		table = &api.RoutingTable{Nodes: map[string]*api.NodeRecord{}}
+	}
+	c := &cacheNode{
+		node:      n,
+		cache:     cache,
+		maxAge:    time.Duration(cfg.MaxAge),
+		clusters:  make(chan *client.Cluster, cacheFetchers),
+		refetch:   make(chan string, cacheRefetchQueue),
+		http:      &http.Client{Timeout: cacheFollowWait + 10*time.Second},
+		followers: make(map[string]context.CancelFunc),
+	}
+	for i := 0; i < cacheFetchers; i++ {
+		c.clusters <- client.NewCluster(table, n.peerOptions, client.ReadTail)
+	}
+	n.cacheNode = c
+	n.memory.Register("read_cache", cache)
+
+	for i := 0; i < cacheRefetchers; i++ {
+		go c.refetchLoop(n.ctx)
+	}
+	go c.followLoop(n.ctx)
+
+	stats := cache.Stats()
+	n.logger.Info("serving as a cache node",
+		"memory_size", cfg.MemorySize, "disk_path", cfg.DiskPath, "disk_blocks", stats.DiskEntries)
+	return nil
+}
+
+// stopCacheNode stops following change logs and closes the connections to
+// the chains, once nothing reads
+func (n *StorageNode) stopCacheNode() {
+	c := n.cacheNode
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	for admin, cancel := range c.followers {
+		cancel()
+		delete(c.followers, admin)
+	}
+	c.mu.Unlock()
+	for i := 0; i < cacheFetchers; i++ {
+		(<-c.clusters).Close()
+	}
+}
+
+// serve executes a request on a cache node: reads, fetches and stats are
+// served from the cache, and anything else is redirected to the block's
+// chain
+func (c *cacheNode) serve(ctx context.Context, req *api.Request) *api.Response {
+	switch req.Op {
+	case api.OpRead, api.OpFetch, api.OpStat:
+	default:
+		return c.node.redirect(req, "cache node holds no replicas")
+	}
+
+	entry, err := c.get(ctx, req.BlockID, req.Version)
+	if err != nil {
+		return errorResponse(err)
+	}
+	stat := &api.BlockStat{
+		Checksum:     entry.Checksum,
+		Size:         len(entry.Data),
+		Version:      entry.Version,
+		CreatedAt:    entry.CreatedAt,
+		LastModified: entry.LastModified,
+	}
+	switch req.Op {
+	case api.OpRead:
+		return &api.Response{Status: api.StatusOK, Data: entry.Data}
+	case api.OpFetch:
+		return &api.Response{Status: api.StatusOK, Data: entry.Data, Stat: stat}
+	default:
+		return &api.Response{Status: api.StatusOK, Stat: stat}
+	}
+}
+
+// get returns a block of at least version from the cache, checking it
+// with its chain once it is older than the max age, or reads it from its
+// chain and caches it
+func (c *cacheNode) get(ctx context.Context, blockID string, version int) (*readcache.Entry, error) {
+	entry, ok := c.cache.Get(blockID)
+	if ok && entry.Version >= version {
+		if time.Since(entry.Validated) <= c.maxAge {
+			return entry, nil
+		}
+		c.revalidations.Add(1)
+		stat, err := c.stat(ctx, blockID)
+		if err != nil {
+			if errors.Is(err, api.ErrNotFound) {
+				c.cache.Invalidate(blockID, 0)
+			}
+			return nil, err
+		}
+		if stat.Version == entry.Version && stat.Checksum == entry.Checksum {
+			c.cache.Validate(blockID, entry.Version)
+			return entry, nil
+		}
+		c.cache.Invalidate(blockID, 0)
+	}
+	return c.load(ctx, blockID, version)
+}
+
+// load reads a block from its chain and caches it
+func (c *cacheNode) load(ctx context.Context, blockID string, version int) (*readcache.Entry, error) {
+	cluster := c.cluster()
+	data, stat, err := cluster.Fetch(ctx, blockID, version)
+	c.clusters <- cluster
+	if err != nil {
+		return nil, err
+	}
+	entry := &readcache.Entry{
+		BlockID:      blockID,
+		Version:      stat.Version,
+		Checksum:     stat.Checksum,
+		CreatedAt:    stat.CreatedAt,
+		LastModified: stat.LastModified,
+		Validated:    time.Now(),
+		Data:         data,
+	}
+	if err := c.cache.Put(entry); err != nil {
+		c.node.logger.Warn("failed to cache block", "block", blockID, "error", err)
+	}
+	return entry, nil
+}
+
+// stat reads a block's metadata from its chain
+func (c *cacheNode) stat(ctx context.Context, blockID string) (*api.BlockStat, error) {
+	cluster := c.cluster()
+	defer func() { c.clusters <- cluster }()
+	return cluster.Stat(ctx, blockID)
+}
+
+// cluster takes a client of the chains from the pool, routing along the
+// node's current routing table. It must be put back once used.
+func (c *cacheNode) cluster() *client.Cluster {
+	cluster := <-c.clusters
+	if table := c.node.cachedTable(); table != nil && table.Version != cluster.Table().Version {
+		cluster.SetTable(table)
+	}
+	return cluster
+}
+
+// refetchLoop fetches the new version of blocks invalidated by the change
+// log, so that hot blocks are read from the cache again right away
+func (c *cacheNode) refetchLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case blockID := <-c.refetch:
+			// Refetching is optional; the block is read on its next miss
+			if c.node.memory.Pressure() {
+				c.refetchesSkipped.Add(1)
+				continue
+			}
+			if _, err := c.load(ctx, blockID, 0); err != nil {
+				if ctx.Err() == nil {
+					c.node.logger.Debug("failed to refetch invalidated block", "block", blockID, "error", err)
+				}
+				continue
+			}
+			c.refetches.Add(1)
+		}
+	}
+}
+
+// followLoop keeps a follower running for the change log of every healthy
+// storage node in the routing table
+func (c *cacheNode) followLoop(ctx context.Context) {
+	ticker := time.NewTicker(cacheFollowInterval)
+	defer ticker.Stop()
+	for {
+		c.updateFollowers(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// updateFollowers starts following the nodes that appeared in the routing
+// table and stops following the ones that left it
+func (c *cacheNode) updateFollowers(ctx context.Context) {
+	admins := make(map[string]bool)
+	if table := c.node.cachedTable(); table != nil {
+		for _, record := range table.Nodes {
+			if record.Healthy() && !record.IsCache() && record.AdminAddress != "" {
+				admins[record.AdminAddress] = true
+			}
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for admin, cancel := range c.followers {
+		if !admins[admin] {
+			cancel()
+			delete(c.followers, admin)
+		}
+	}
+	for admin := range admins {
+		if _, ok := c.followers[admin]; !ok {
+			followCtx, cancel := context.WithCancel(ctx)
+			c.followers[admin] = cancel
+			go c.follow(followCtx, admin)
+		}
+	}
+}
+
+// follow invalidates cached blocks as the records of a node's change log
+// say they were rewritten or deleted. It starts at the end of the log, so
+// blocks changed before are checked with their chains on their next read,
+// as are all of them whenever records were missed. While the log cannot
+// be read, cached blocks are served for up to the max age.
+func (c *cacheNode) follow(ctx context.Context, admin string) {
+	logger := c.node.logger.With("admin_address", admin)
+	c.cache.Expire()
+	token := api.CDCEnd
+	failing := false
+	for ctx.Err() == nil {
+		batch, err := c.readChanges(ctx, admin, token)
+		if errors.Is(err, errChangesGone) {
+			logger.Warn("change records were missed; cached blocks will be checked with their chains")
+			c.cache.Expire()
+			token = api.CDCEnd
+			continue
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			if !failing {
+				logger.Warn("failed to follow change log", "error", err)
+				failing = true
+			}
+			token = api.CDCEnd
+			select {
+			case <-ctx.Done():
+			case <-time.After(cacheFollowRetry):
+			}
+			continue
+		}
+		if failing {
+			logger.Info("following change log again; cached blocks will be checked with their chains")
+			c.cache.Expire()
+			failing = false
+		}
+		for _, rec := range batch.Records {
+			c.apply(rec)
+		}
+		token = batch.Next
+	}
+}
+
+// apply drops the cached copy of a block a change record made stale, and
+// queues the block to be fetched again if it was rewritten
+func (c *cacheNode) apply(rec api.ChangeRecord) {
+	if !c.cache.Invalidate(rec.BlockID, rec.Version) || rec.Op == api.ChangeDelete {
+		return
+	}
+	select {
+	case c.refetch <- rec.BlockID:
+	default:
+	}
+}
+
+// errChangesGone is returned when the records following a token were
+// pruned from the change log, or the log was replaced
+var errChangesGone = errors.New("change records were pruned")
+
+// readChanges reads the records of a node's change log following a token,
+// waiting for them when there are none yet
+func (c *cacheNode) readChanges(ctx context.Context, admin, token string) (*api.ChangeBatch, error) {
+	query := url.Values{"after": {token}, "wait": {cacheFollowWait.String()}}
+	u := "http://" + strings.TrimPrefix(strings.TrimPrefix(admin, "http://"), "https://") + api.CDCPath + "?" + query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build request: %w", err)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return nil, errChangesGone
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("node returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	var batch api.ChangeBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to decode change records: %w", err)
+	}
+	return &batch, nil
+}
+
+// stats returns the cache's contents and counters
+func (c *cacheNode) stats() CacheStats {
+	c.mu.Lock()
+	following := make([]string, 0, len(c.followers))
+	for admin := range c.followers {
+		following = append(following, admin)
+	}
+	c.mu.Unlock()
+	sort.Strings(following)
+	return CacheStats{
+		Stats:            c.cache.Stats(),
+		Revalidations:    c.revalidations.Load(),
+		Refetches:        c.refetches.Load(),
+		RefetchesSkipped: c.refetchesSkipped.Load(),
+		Following:        following,
+	}
+}
+
+// handleCache serves the block cache's stats on a cache node
+func (a *adminServer) handleCache(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	c := a.node.cacheNode
+	if c == nil {
+		writeError(w, http.StatusNotFound, errors.New("the node is not a cache node"))
+		return
+	}
+	writeJSON(w, http.StatusOK, c.stats())
+}
@@ -0,0 +1,172 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/3fs-storage/internal/cdc"
+	"github.com/3fs-storage/pkg/api"
+)
+
+const (
+	// cdcDir is the directory of the change log in the node's data path
+	cdcDir = "cdc"
+	// defaultCDCLimit and maxCDCLimit bound the records of a page of the
+	// change log
+	defaultCDCLimit = 1000
+	maxCDCLimit     = 10000
+	// maxCDCWait bounds how long a read of the change log waits for records
+	maxCDCWait = time.Minute
+)
+
+// startCDC opens the change log when it is enabled
+func (n *StorageNode) startCDC() error {
+	cfg := n.cfg.Storage.CDC
+	if !cfg.Enabled {
+		return nil
+	}
+	log, err := cdc.Open(filepath.Join(n.cfg.Storage.Local.DataPath, cdcDir), cdc.Options{
+		Retention: time.Duration(cfg.Retention),
+		MaxSize:   int64(cfg.MaxSize),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to open change log: %w", err)
+	}
+	n.cdc = log
+	n.logger.Info("change log opened", "last_offset", log.Last())
+	return nil
+}
+
+// stopCDC closes the change log, once nothing writes
+func (n *StorageNode) stopCDC() {
+	if n.cdc == nil {
+		return
+	}
+	if err := n.cdc.Close(); err != nil {
+		n.logger.Warn("failed to close change log", "error", err)
+	}
+}
+
+// logChange records a client's committed write or delete of a block in
+// the change log, before the client is answered. As with geo-replication,
+// writes that members replicate to each other carry a fencing token and
+// are left to the member the client wrote to.
+func (n *StorageNode) logChange(ctx context.Context, t *target, req *api.Request, existed bool) error {
+	if n.cdc == nil {
+		return nil
+	}
+	if _, ok := req.Headers[api.FenceHeader]; ok {
+		return nil
+	}
+	rec := api.ChangeRecord{Op: api.ChangeDelete, BlockID: req.BlockID, Target: t.id}
+	if req.Op == api.OpWrite {
+		metadata, err := t.service.ReadBlockMetadata(ctx, req.BlockID)
+		if err != nil {
+			return fmt.Errorf("failed to read written block for the change log: %w", err)
+		}
+		rec.Op = api.ChangeCreate
+		if existed {
+			rec.Op = api.ChangeUpdate
+		}
+		rec.Version = metadata.Version
+		rec.Size = metadata.Size
+		rec.Checksum = metadata.Checksum
+		rec.Time = metadata.LastModified
+	}
+	if _, err := n.cdc.Append(rec); err != nil {
+		return fmt.Errorf("failed to record change: %w", err)
+	}
+	return nil
+}
+
+// logErasureChange records a client's write or delete of an erasure-coded
+// block. Whether the block existed is not known without reading it, so
+// writes are recorded as updates, and the checksum is that of the data.
+func (n *StorageNode) logErasureChange(t *target, req *api.Request) error {
+	if n.cdc == nil {
+		return nil
+	}
+	if _, ok := req.Headers[api.FenceHeader]; ok {
+		return nil
+	}
+	rec := api.ChangeRecord{Op: api.ChangeDelete, BlockID: req.BlockID, Target: t.id}
+	if req.Op == api.OpWrite {
+		sum := sha256.Sum256(req.Data)
+		rec.Op = api.ChangeUpdate
+		rec.Size = len(req.Data)
+		rec.Checksum = hex.EncodeToString(sum[:])
+	}
+	if _, err := n.cdc.Append(rec); err != nil {
+		return fmt.Errorf("failed to record change: %w", err)
+	}
+	return nil
+}
+
+// handleCDC serves a page of the change log following the resume token
+// of the after query parameter, or from the oldest record without one;
+// after=end skips to the records appended from now on. With wait, it waits up to that long for records when there are none
+// yet. Records pruned since the token was issued, or a token of another
+// log, answer 410 Gone: the consumer has to start over.
+func (a *adminServer) handleCDC(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	log := a.node.cdc
+	if log == nil {
+		writeError(w, http.StatusNotFound, errors.New("the change log is disabled"))
+		return
+	}
+
+	query := r.URL.Query()
+	var after uint64
+	var err error
+	if value := query.Get("after"); value == api.CDCEnd {
+		after = log.Last()
+	} else {
+		after, err = log.ParseToken(value)
+	}
+	if errors.Is(err, cdc.ErrUnknownLog) {
+		writeError(w, http.StatusGone, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	limit := defaultCDCLimit
+	if value := query.Get("limit"); value != "" {
+		if limit, err = strconv.Atoi(value); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", value))
+			return
+		}
+		limit = min(limit, maxCDCLimit)
+	}
+	if value := query.Get("wait"); value != "" {
+		wait, err := time.ParseDuration(value)
+		if err != nil || wait < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid wait %q", value))
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), min(wait, maxCDCWait))
+		log.Wait(ctx, after)
+		cancel()
+	}
+
+	records, last, err := log.Read(after, limit, query.Get("prefix"))
+	if errors.Is(err, cdc.ErrTruncated) {
+		writeError(w, http.StatusGone, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, api.ChangeBatch{Records: records, Next: log.Token(last), Oldest: log.Oldest()})
+}
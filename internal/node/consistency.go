@@ -0,0 +1,170 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/tracing"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// writePeers are the connections used to copy strongly consistent writes
+// to the other members of their chains, and to move erasure-coded shards
+// between them, kept for the life of the node
+type writePeers struct {
+	peers map[string]*client.Client
+	mu    sync.Mutex
+}
+
+// get returns a connection to a chain member, dialing it if needed
+func (p *writePeers) get(n *StorageNode, table *api.RoutingTable, member string) (*client.Client, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[member]; ok {
+		return peer, nil
+	}
+	peer, err := n.dialPeer(table.NodeAddress(member))
+	if err != nil {
+		return nil, err
+	}
+	if p.peers == nil {
+		p.peers = make(map[string]*client.Client)
+	}
+	p.peers[member] = peer
+	return peer, nil
+}
+
+// drop closes the connection to a member after a failure, so that the next
+// write dials it again
+func (p *writePeers) drop(member string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if peer, ok := p.peers[member]; ok {
+		peer.Close()
+		delete(p.peers, member)
+	}
+}
+
+// close closes every connection
+func (p *writePeers) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for member, peer := range p.peers {
+		peer.Close()
+		delete(p.peers, member)
+	}
+}
+
+// replicationOf returns the replication factor and consistency of a
+// block: its namespace's policy in the routing table, or the node's
+// configuration
+func (n *StorageNode) replicationOf(table *api.RoutingTable, blockID string) (int, string) {
+	if table != nil {
+		if policy := table.Policy(api.Namespace(blockID)); policy != nil {
+			return policy.Factor, policy.Consistency
+		}
+	}
+	cfg := n.cfg.Storage.Replication
+	return cfg.Factor, cfg.Consistency
+}
+
+// replicateWrite copies a client's write to the other up members of the
+// block's chain before it is acknowledged, when the block's namespace asks
+// for strong consistency, until the replication factor is met or every up
+// member has a copy. Writes from other nodes carry a fencing token and are
+// not copied again.
+func (n *StorageNode) replicateWrite(ctx context.Context, t *target, req *api.Request) error {
+	if _, ok := req.Headers[api.FenceHeader]; ok {
+		return nil
+	}
+	table := n.cachedTable()
+	if table == nil {
+		return nil
+	}
+	if _, ok := table.Nodes[t.id]; !ok {
+		return nil
+	}
+	if table.Erasure(api.Namespace(req.BlockID)) != nil {
+		// Shards are written to their members by the node coding them
+		return nil
+	}
+	factor, consistency := n.replicationOf(table, req.BlockID)
+	if consistency != api.ConsistencyStrong {
+		return nil
+	}
+	chain := table.ChainForBlock(req.BlockID)
+	if chain == nil {
+		return nil
+	}
+
+	fenced, err := n.fence(ctx, table, t.id)
+	if err != nil {
+		return err
+	}
+	replicas := 0
+	if isMember(chain, t.id) {
+		replicas++
+	}
+	for hop, member := range chain.Members {
+		if replicas >= factor {
+			break
+		}
+		record, ok := table.Nodes[member]
+		if member == t.id || !ok || record.State != api.NodeStateUp || record.Suspect {
+			continue
+		}
+
+		// One span per copy, so that a slow write can be attributed to the
+		// chain member that held it up
+		hopCtx, span := tracing.Start(fenced, "node.replicate",
+			attribute.String("node.id", member),
+			attribute.String("block.id", req.BlockID),
+			attribute.Int("hop", hop))
+		peer, err := n.writePeers.get(n, table, member)
+		if err == nil {
+			err = peer.Write(client.WithTarget(hopCtx, member), req.BlockID, req.Data)
+		}
+		tracing.End(span, err)
+		if err != nil {
+			n.writePeers.drop(member)
+			return fmt.Errorf("failed to replicate block to %s: %w", member, err)
+		}
+		replicas++
+	}
+	return nil
+}
+
+// namespacePolicies builds the coordinator's namespace policies from the
+// configuration
+func namespacePolicies(cfg config.StorageConfig) (map[string]coordinator.NamespacePolicy, error) {
+	policies := make(map[string]coordinator.NamespacePolicy, len(cfg.Replication.Namespaces))
+	for name, ns := range cfg.Replication.Namespaces {
+		placement, err := coordinator.ParsePlacementPolicy(ns.Placement.FailureDomain, ns.Placement.Strict)
+		if err != nil {
+			return nil, fmt.Errorf("namespace %s: %w", name, err)
+		}
+		placement.Zones = ns.Placement.Zones
+		replication := api.ReplicationPolicy{
+			Factor:      ns.Factor,
+			ChainLength: ns.ChainLength,
+			Consistency: ns.Consistency,
+		}
+		if ns.Erasure.Enabled() {
+			replication.Erasure = &api.ErasurePolicy{Data: ns.Erasure.Data, Parity: ns.Erasure.Parity}
+		}
+		policies[name] = coordinator.NamespacePolicy{
+			Replication: replication,
+			NumChains:   ns.NumChains,
+			Placement:   placement,
+		}
+	}
+	return policies, nil
+}
@@ -0,0 +1,269 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// DecommissionStatus reports the progress of migrating a node's data off
+// before it is retired
+type DecommissionStatus struct {
+	Running        bool   `json:"running"`
+	StartedAt      int64  `json:"started_at,omitempty"`
+	FinishedAt     int64  `json:"finished_at,omitempty"`
+	TotalBlocks    int    `json:"total_blocks"`
+	MigratedBlocks int    `json:"migrated_blocks"`
+	SkippedBlocks  int    `json:"skipped_blocks"`
+	FailedBlocks   int    `json:"failed_blocks"`
+	SafeToShutdown bool   `json:"safe_to_shutdown"`
+	Error          string `json:"error,omitempty"`
+}
+
+// Decommission marks the node as draining with the coordinator and starts
+// migrating its blocks to the other members of their chains in the
+// background. Writes are refused from then on so that no block is missed.
+// Progress is available from DecommissionStatus.
+func (n *StorageNode) Decommission() error {
+	n.decommissionMu.Lock()
+	defer n.decommissionMu.Unlock()
+
+	if n.decommission.Running {
+		return errors.New("decommission is already running")
+	}
+
+	// Stop taking new chain assignments before looking at the table, so
+	// that the chains this node is in already have their replacements
+	ctx, cancel := context.WithTimeout(n.ctx, 10*time.Second)
+	defer cancel()
+	if err := n.setOwnState(ctx, api.NodeStateDraining); err != nil {
+		return fmt.Errorf("failed to mark node as draining: %w", err)
+	}
+	n.decommissioning.Store(true)
+
+	n.decommission = DecommissionStatus{
+		Running:   true,
+		StartedAt: time.Now().UnixNano(),
+	}
+	go n.runDecommission()
+
+	n.logger.Info("decommission started")
+	return nil
+}
+
+// DecommissionStatus returns the progress of the current or last decommission
+func (n *StorageNode) DecommissionStatus() DecommissionStatus {
+	n.decommissionMu.Lock()
+	defer n.decommissionMu.Unlock()
+	return n.decommission
+}
+
+// IsDecommissioning returns whether the node has been marked as draining
+func (n *StorageNode) IsDecommissioning() bool {
+	return n.decommissioning.Load()
+}
+
+// runDecommission copies every local block to the up members of its chain
+func (n *StorageNode) runDecommission() {
+	err := n.migrateBlocks(n.ctx)
+
+	n.decommissionMu.Lock()
+	defer n.decommissionMu.Unlock()
+
+	status := &n.decommission
+	status.Running = false
+	status.FinishedAt = time.Now().UnixNano()
+	if err != nil {
+		status.Error = err.Error()
+	}
+	status.SafeToShutdown = err == nil && status.FailedBlocks == 0
+
+	n.logger.Info("decommission finished",
+		"migrated", status.MigratedBlocks,
+		"skipped", status.SkippedBlocks,
+		"failed", status.FailedBlocks,
+		"safe_to_shutdown", status.SafeToShutdown)
+	n.reportDrain(*status)
+}
+
+// migrateBlocks copies each block of the healthy targets to the up members
+// of its chain that do not already hold an identical copy
+func (n *StorageNode) migrateBlocks(ctx context.Context) error {
+	table, err := n.fetchRouting(ctx)
+	if err != nil {
+		return err
+	}
+
+	items := make([]targetBlock, 0)
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		blockIDs, err := t.storage.ListBlocks("")
+		if err != nil {
+			return fmt.Errorf("failed to list blocks of target %s: %w", t.id, err)
+		}
+		for _, blockID := range blockIDs {
+			items = append(items, targetBlock{target: t, blockID: blockID})
+		}
+	}
+	n.updateDecommission(func(s *DecommissionStatus) { s.TotalBlocks = len(items) })
+
+	peers := make(map[string]*client.Client)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for _, item := range items {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		blockID := item.blockID
+		if isShard(table, blockID) {
+			// Erasure-coded shards are rebuilt by repair on the member
+			// that replaces this one, as a copy would be one too many
+			n.updateDecommission(func(s *DecommissionStatus) { s.SkippedBlocks++ })
+			continue
+		}
+		members := make([]string, 0)
+		if chain := table.ChainForBlock(blockID); chain != nil {
+			for _, member := range chain.Members {
+				if node, ok := table.Nodes[member]; ok && !n.isLocalTarget(member) && node.Healthy() {
+					members = append(members, member)
+				}
+			}
+		}
+		if len(members) == 0 {
+			n.logger.Warn("no replica target for block", "block", blockID)
+			n.updateDecommission(func(s *DecommissionStatus) { s.FailedBlocks++ })
+			continue
+		}
+
+		copied, err := n.migrateBlock(ctx, table, peers, item.target, blockID, members)
+		if err != nil {
+			n.logger.Warn("failed to migrate block", "block", blockID, "error", err)
+			n.updateDecommission(func(s *DecommissionStatus) { s.FailedBlocks++ })
+			continue
+		}
+		n.updateDecommission(func(s *DecommissionStatus) {
+			if copied {
+				s.MigratedBlocks++
+			} else {
+				s.SkippedBlocks++
+			}
+		})
+	}
+
+	return nil
+}
+
+// migrateBlock makes sure every member holds the block, returning whether
+// any copy had to be written
+func (n *StorageNode) migrateBlock(ctx context.Context, table *api.RoutingTable, peers map[string]*client.Client, t *target, blockID string, members []string) (bool, error) {
+	data, _, err := t.storage.ReadBlock(blockID)
+	if err != nil {
+		return false, fmt.Errorf("failed to read block: %w", err)
+	}
+
+	fenced, err := n.fence(ctx, table, t.id)
+	if err != nil {
+		return false, err
+	}
+
+	copied := false
+	for _, member := range members {
+		peer, ok := peers[member]
+		if !ok {
+			peer, err = n.dialPeer(table.NodeAddress(member))
+			if err != nil {
+				return copied, err
+			}
+			peers[member] = peer
+		}
+
+		// Skip members that already hold an identical copy
+		memberCtx := client.WithTarget(ctx, member)
+		if stat, err := peer.Stat(memberCtx, blockID); err == nil && t.hasBlock(blockID, stat.Checksum) {
+			continue
+		}
+
+		if err := peer.Write(client.WithTarget(fenced, member), blockID, data); err != nil {
+			// Drop the connection in case the stream is broken
+			peer.Close()
+			delete(peers, member)
+			return copied, fmt.Errorf("failed to copy block to %s: %w", member, err)
+		}
+		copied = true
+	}
+
+	return copied, nil
+}
+
+// updateDecommission applies fn to the decommission status
+func (n *StorageNode) updateDecommission(fn func(*DecommissionStatus)) {
+	n.decommissionMu.Lock()
+	defer n.decommissionMu.Unlock()
+	fn(&n.decommission)
+}
+
+// coordinatorClient returns a client for the configured coordinators
+func (n *StorageNode) coordinatorClient() (*coordinator.Client, error) {
+	addresses := n.coordinatorAddresses()
+	if len(addresses) == 0 {
+		return nil, errors.New("no coordinator configured")
+	}
+	return coordinator.NewClient(addresses)
+}
+
+// setOwnState records the state of this node's healthy targets with the
+// coordinator
+func (n *StorageNode) setOwnState(ctx context.Context, state api.NodeState) error {
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		if err := n.setState(ctx, t.id, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setState records the state of one of this node's targets with the
+// coordinator
+func (n *StorageNode) setState(ctx context.Context, targetID string, state api.NodeState) error {
+	if coord := n.leaderCoordinator(); coord != nil {
+		return coord.SetNodeState(targetID, state)
+	}
+
+	coord, err := n.coordinatorClient()
+	if err != nil {
+		return err
+	}
+	return coord.SetNodeState(ctx, targetID, state)
+}
+
+// fetchRouting returns the coordinator's current routing table
+func (n *StorageNode) fetchRouting(ctx context.Context) (*api.RoutingTable, error) {
+	if n.coordinator != nil {
+		return n.coordinator.Routing(), nil
+	}
+
+	coord, err := n.coordinatorClient()
+	if err != nil {
+		return nil, err
+	}
+	table, err := coord.FetchRouting(ctx, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch routing table: %w", err)
+	}
+	return table, nil
+}
@@ -0,0 +1,292 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/3fs-storage/internal/auth"
+	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// digestCache keeps the digests of a target's shards by chain, so that
+// comparing replicas reads again only the shards changed since. The zero
+// value is ready to use.
+type digestCache struct {
+	mu     sync.Mutex
+	shards [storage.Shards]*shardDigests
+}
+
+// shardDigests is the digests of a shard's blocks by chain, as of a
+// generation of the shard and a chain layout
+type shardDigests struct {
+	generation uint64
+	layout     [sha256.Size]byte
+	chains     map[uint32][sha256.Size]byte
+}
+
+// chainLayout fingerprints what maps blocks to chains in a routing table:
+// the chains of each namespace, and the namespaces with policies and
+// whether they are erasure-coded. Tables that differ only in node states
+// share a layout.
+func chainLayout(table *api.RoutingTable) [sha256.Size]byte {
+	h := sha256.New()
+	for _, chain := range table.Chains {
+		fmt.Fprintf(h, "chain %d %s\n", chain.ID, chain.Namespace)
+	}
+	namespaces := make([]string, 0, len(table.Policies))
+	for namespace := range table.Policies {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		policy := table.Policies[namespace]
+		fmt.Fprintf(h, "policy %s %t\n", namespace, policy != nil && policy.Erasure != nil)
+	}
+
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// shardEntries returns the blocks of a shard of the target by chain, with
+// the shard's generation as of the listing. Blocks of erasure-coded
+// namespaces are left out, since each member holds different shards of
+// them, as are blocks whose metadata cannot be read, so that the reference
+// copy is fetched over them.
+func (t *target) shardEntries(table *api.RoutingTable, shard int) (map[uint32][]api.BlockDigest, uint64, error) {
+	blockIDs, generation, err := t.storage.ListShard(shard)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	entries := make(map[uint32][]api.BlockDigest)
+	for _, blockID := range blockIDs {
+		chain := table.ChainForBlock(blockID)
+		if chain == nil || table.Erasure(api.Namespace(blockID)) != nil {
+			continue
+		}
+		exists, metadataBytes, err := t.storage.ReadBlockMetadata(blockID)
+		if err != nil || !exists {
+			continue
+		}
+		var metadata storage.BlockMetadata
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			continue
+		}
+		entries[chain.ID] = append(entries[chain.ID], api.BlockDigest{
+			BlockID:  blockID,
+			Version:  metadata.Version,
+			Checksum: metadata.Checksum,
+		})
+	}
+	return entries, generation, nil
+}
+
+// shardDigest returns the digest of the blocks of the given chains in a
+// shard of the target, reading the shard only if it changed since its
+// digests were last computed
+func (t *target) shardDigest(table *api.RoutingTable, layout [sha256.Size]byte, shard int, chains []uint32) ([sha256.Size]byte, error) {
+	t.digests.mu.Lock()
+	cached := t.digests.shards[shard]
+	t.digests.mu.Unlock()
+
+	if cached == nil || cached.layout != layout || cached.generation != t.storage.ShardGeneration(shard) {
+		entries, generation, err := t.shardEntries(table, shard)
+		if err != nil {
+			return [sha256.Size]byte{}, err
+		}
+		cached = &shardDigests{generation: generation, layout: layout, chains: make(map[uint32][sha256.Size]byte, len(entries))}
+		for chainID, blocks := range entries {
+			var digest [sha256.Size]byte
+			for _, b := range blocks {
+				xorDigest(&digest, b.Sum())
+			}
+			cached.chains[chainID] = digest
+		}
+
+		t.digests.mu.Lock()
+		t.digests.shards[shard] = cached
+		t.digests.mu.Unlock()
+	}
+
+	var digest [sha256.Size]byte
+	for _, chainID := range chains {
+		xorDigest(&digest, cached.chains[chainID])
+	}
+	return digest, nil
+}
+
+// xorDigest folds sum into digest
+func xorDigest(digest *[sha256.Size]byte, sum [sha256.Size]byte) {
+	for i := range digest {
+		digest[i] ^= sum[i]
+	}
+}
+
+// digestChildren returns the hex digests of the children of a node of the
+// target's digest tree for the given chains: the groups under the root at
+// depth 0, or the shards of group index at depth 1. A group's digest hashes
+// the digests of its shards.
+func (t *target) digestChildren(table *api.RoutingTable, chains []uint32, depth, index int) ([]string, error) {
+	layout := chainLayout(table)
+	shard := func(i int) ([sha256.Size]byte, error) {
+		return t.shardDigest(table, layout, i, chains)
+	}
+
+	digests := make([]string, api.DigestFanout)
+	for i := range digests {
+		var sum [sha256.Size]byte
+		if depth == 0 {
+			h := sha256.New()
+			for j := 0; j < api.DigestFanout; j++ {
+				digest, err := shard(i*api.DigestFanout + j)
+				if err != nil {
+					return nil, err
+				}
+				h.Write(digest[:])
+			}
+			copy(sum[:], h.Sum(nil))
+		} else {
+			var err error
+			if sum, err = shard(index*api.DigestFanout + i); err != nil {
+				return nil, err
+			}
+		}
+		digests[i] = hex.EncodeToString(sum[:])
+	}
+	return digests, nil
+}
+
+// digestEntries returns the blocks of the given chains in a shard of the
+// target, sorted by ID
+func (t *target) digestEntries(table *api.RoutingTable, chains []uint32, shard int) ([]api.BlockDigest, error) {
+	byChain, _, err := t.shardEntries(table, shard)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]api.BlockDigest, 0)
+	for _, chainID := range chains {
+		entries = append(entries, byChain[chainID]...)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].BlockID < entries[j].BlockID })
+	return entries, nil
+}
+
+// serveDigest answers a digest request for a node of the target's digest
+// tree. Digests span namespaces, so they need read permission on all of
+// them.
+func (n *StorageNode) serveDigest(ctx context.Context, targetID string, req *api.Request) *api.Response {
+	if !n.acl.Allowed(auth.FromContext(ctx), auth.Wildcard, auth.PermRead) {
+		return &api.Response{Status: api.StatusForbidden, Error: api.ErrForbidden.Error()}
+	}
+	if targetID == "" && len(n.targets) > 1 {
+		return badRequest("digest requests must name a storage target")
+	}
+	chains, err := api.ParseChains(req.Headers[api.ChainsHeader])
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	depth, index, err := api.ParseDigestPath(req.Prefix)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+	t, err := n.targetFor("", targetID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	table := n.cachedTable()
+	if table == nil {
+		return errorResponse(errors.New("routing table unavailable"))
+	}
+
+	if depth == 2 {
+		entries, err := t.digestEntries(table, chains, index)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &api.Response{Status: api.StatusOK, Entries: entries}
+	}
+	digests, err := t.digestChildren(table, chains, depth, index)
+	if err != nil {
+		return errorResponse(err)
+	}
+	return &api.Response{Status: api.StatusOK, Digests: digests}
+}
+
+// reconcileDigests fetches the blocks of the given chains that member
+// holds and target lacks or holds an older or different copy of. The two
+// digest trees are compared from the root down, so that only the shards
+// whose digests differ are listed block by block.
+func (n *StorageNode) reconcileDigests(ctx context.Context, table *api.RoutingTable, peer *client.Client, t *target, member string, chains map[uint32]bool) (int, error) {
+	ids := make([]uint32, 0, len(chains))
+	for id := range chains {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	// differing returns the children of a tree node whose digests differ
+	differing := func(path string, depth, index int) ([]int, error) {
+		theirs, _, err := peer.Digest(ctx, ids, path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read digests: %w", err)
+		}
+		ours, err := t.digestChildren(table, ids, depth, index)
+		if err != nil {
+			return nil, err
+		}
+		if len(theirs) != len(ours) {
+			return nil, fmt.Errorf("member returned %d digests, expected %d", len(theirs), len(ours))
+		}
+		children := make([]int, 0)
+		for i := range ours {
+			if ours[i] != theirs[i] {
+				children = append(children, index*api.DigestFanout+i)
+			}
+		}
+		return children, nil
+	}
+
+	groups, err := differing("", 0, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	fetched := 0
+	for _, group := range groups {
+		shards, err := differing(fmt.Sprintf("%x", group), 1, group)
+		if err != nil {
+			return fetched, err
+		}
+		for _, shard := range shards {
+			_, entries, err := peer.Digest(ctx, ids, fmt.Sprintf("%02x", shard))
+			if err != nil {
+				return fetched, fmt.Errorf("failed to read the blocks of shard %02x: %w", shard, err)
+			}
+			n.updateRecovery(func(s *RecoveryStatus) { s.ShardsCompared++ })
+
+			for _, entry := range entries {
+				if chain := table.ChainForBlock(entry.BlockID); chain == nil || !chains[chain.ID] {
+					continue
+				}
+				n.updateRecovery(func(s *RecoveryStatus) { s.Checked++ })
+				stat := &api.BlockStat{Checksum: entry.Checksum, Version: entry.Version}
+				ok, err := n.fetchStale(ctx, peer, t, member, entry.BlockID, stat)
+				if ok {
+					fetched++
+				}
+				if err != nil {
+					return fetched, err
+				}
+			}
+		}
+	}
+	return fetched, nil
+}
@@ -0,0 +1,387 @@
+package node
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/3fs-storage/internal/auth"
+	"github.com/3fs-storage/internal/tracing"
+	"github.com/3fs-storage/pkg/api"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// serveRequest runs a request under a span that continues the trace
+// carried in the request's frame headers
+func (n *StorageNode) serveRequest(ctx context.Context, req *api.Request) *api.Response {
+	ctx = tracing.Extract(ctx, req.Headers)
+	ctx, span := tracing.Start(ctx, "node."+req.Op.String(),
+		attribute.String("node.id", n.GetNodeID()),
+		attribute.String("block.id", req.BlockID),
+		attribute.Int64("request.id", int64(req.ID)))
+
+	resp := n.dispatch(ctx, req)
+
+	var err error
+	if resp.Status != api.StatusOK {
+		err = resp.Err()
+	}
+	tracing.End(span, err)
+
+	return resp
+}
+
+// clientConn holds what is known about the client of a connection
+type clientConn struct {
+	// key identifies the client for limits: its certificate identity, or
+	// its IP address
+	key string
+	// remote is the address of the connection
+	remote string
+	// identity is the identity proven by the connection itself
+	identity *auth.Identity
+}
+
+// serveClient authenticates a request and serves it within the client's
+// limits. Requests over the client's rate are refused; payloads over its
+// bandwidth are delayed. Blocks fetched by other nodes are charged to the
+// node's peer bandwidth instead.
+func (n *StorageNode) serveClient(cc *clientConn, req *api.Request) *api.Response {
+	if req.Op == api.OpHello {
+		return n.hello(req)
+	}
+	if err := checkRequestProtocol(req); err != nil {
+		return badRequest(err.Error())
+	}
+
+	identity, err := n.auth.Authenticate(n.ctx, cc.identity, req.Headers)
+	if err != nil {
+		return &api.Response{Status: api.StatusUnauthenticated, Error: api.ErrUnauthenticated.Error()}
+	}
+
+	key := cc.key
+	if !identity.IsAnonymous() {
+		key = identity.Name
+	}
+
+	if !n.limits.allowRequest(key) {
+		n.reportQuotaBreach(key, "requests")
+		return &api.Response{Status: api.StatusThrottled, Error: api.ErrThrottled.Error()}
+	}
+	if err := n.limits.waitBandwidth(n.ctx, key, len(req.Data)); err != nil {
+		return errorResponse(err)
+	}
+	// Bandwidth and usage are charged for the data as it was sent
+	in := len(req.Data)
+	if err := req.DecodeData(); err != nil {
+		return badRequest(err.Error())
+	}
+
+	resp := n.serveRequest(auth.WithIdentity(n.ctx, identity), req)
+	n.meterRequest(req, resp, in)
+	if req.Op == api.OpDelete {
+		n.auditDelete(cc, identity, req, resp)
+	}
+
+	if req.Op == api.OpFetch {
+		err = n.limits.waitPeerBandwidth(n.ctx, len(resp.Data))
+	} else {
+		err = n.limits.waitBandwidth(n.ctx, key, len(resp.Data))
+	}
+	if err != nil {
+		return errorResponse(err)
+	}
+	return resp
+}
+
+// dispatch executes a decoded request against the block service and builds
+// the response. Errors are reported in the response so that a failing
+// request does not tear down the connection.
+func (n *StorageNode) dispatch(ctx context.Context, req *api.Request) *api.Response {
+	if n.InMaintenance() {
+		return n.redirect(req, "node is in maintenance mode")
+	}
+
+	// Check the block ID before it reaches the file system, and enforce
+	// the ACL before any call reaches the block service. Listings are
+	// filtered by namespace instead.
+	identity := auth.FromContext(ctx)
+	if perm, ok := requiredPermission(req.Op); ok && req.Op != api.OpList {
+		if err := api.ValidateBlockID(req.BlockID); err != nil {
+			return badRequest(err.Error())
+		}
+		if !n.acl.Allowed(identity, auth.Namespace(req.BlockID), perm) {
+			return &api.Response{Status: api.StatusForbidden, Error: api.ErrForbidden.Error()}
+		}
+	}
+
+	// A cache node serves reads from its cache and holds nothing else
+	if n.cacheNode != nil {
+		return n.cacheNode.serve(ctx, req)
+	}
+
+	// Listings span targets; digests cover a target named in the request;
+	// other operations go to the block's target
+	targetID := req.Headers[api.TargetHeader]
+	if req.Op == api.OpDigest {
+		return n.serveDigest(ctx, targetID, req)
+	}
+	if req.Op == api.OpList {
+		blockIDs, err := n.listBlocks(ctx, targetID, req.Prefix)
+		if err != nil {
+			return errorResponse(err)
+		}
+		blockIDs = n.bufferedBlocks(targetID, req.Prefix, blockIDs)
+		blockIDs = erasureListing(n.cachedTable(), blockIDs)
+		return &api.Response{Status: api.StatusOK, Blocks: n.readableBlocks(identity, blockIDs)}
+	}
+	t, err := n.targetFor(req.BlockID, targetID)
+	if err != nil {
+		return errorResponse(err)
+	}
+	if table := n.cachedTable(); erasureOf(table, req.BlockID) != nil {
+		return n.dispatchErasure(ctx, t, table, req)
+	}
+
+	switch req.Op {
+	case api.OpRead:
+		if data, ok := n.bufferedData(req.BlockID); ok {
+			return &api.Response{Status: api.StatusOK, Data: data}
+		}
+		data, err := t.service.ReadBlock(ctx, req.BlockID)
+		if err != nil {
+			if data, err = n.readRepair(ctx, t, req.BlockID, err); err != nil {
+				return errorResponse(err)
+			}
+		}
+		return &api.Response{Status: api.StatusOK, Data: data}
+
+	case api.OpFetch:
+		if err := n.settleWrite(ctx, req.BlockID); err != nil {
+			return errorResponse(err)
+		}
+		return n.serveFetch(ctx, t, req)
+
+	case api.OpWrite:
+		if n.IsReadOnly() {
+			return readOnlyResponse()
+		}
+		if n.IsDecommissioning() {
+			return n.redirect(req, "node is being decommissioned")
+		}
+		if resp := n.checkFence(ctx, t, req); resp != nil {
+			return resp
+		}
+		if err := checkWriteChecksum(req); err != nil {
+			return &api.Response{Status: api.StatusBadRequest, Error: err.Error(), Code: api.CodeCorrupted}
+		}
+		if buffered, err := n.bufferWrite(t, req); err != nil {
+			return errorResponse(err)
+		} else if buffered {
+			return &api.Response{Status: api.StatusOK}
+		}
+		if err := n.settleWrite(ctx, req.BlockID); err != nil {
+			return errorResponse(err)
+		}
+		existed := n.blockExists(t, req.BlockID)
+		if err := t.service.WriteBlock(ctx, req.BlockID, req.Data); err != nil {
+			return errorResponse(err)
+		}
+		t.written.Add(int64(len(req.Data)))
+		n.publishWrite(ctx, t, req.BlockID, existed)
+		if err := n.journalGeo(t, req); err != nil {
+			return errorResponse(err)
+		}
+		if err := n.replicateWrite(ctx, t, req); err != nil {
+			return errorResponse(err)
+		}
+		if err := n.logChange(ctx, t, req, existed); err != nil {
+			return errorResponse(err)
+		}
+		return &api.Response{Status: api.StatusOK}
+
+	case api.OpDelete:
+		if n.IsReadOnly() {
+			return readOnlyResponse()
+		}
+		if resp := n.checkFence(ctx, t, req); resp != nil {
+			return resp
+		}
+		if err := n.settleWrite(ctx, req.BlockID); err != nil {
+			return errorResponse(err)
+		}
+		if err := t.service.DeleteBlock(ctx, req.BlockID); err != nil {
+			return errorResponse(err)
+		}
+		n.publishDelete(t, req.BlockID)
+		if err := n.journalGeo(t, req); err != nil {
+			return errorResponse(err)
+		}
+		if err := n.logChange(ctx, t, req, true); err != nil {
+			return errorResponse(err)
+		}
+		return &api.Response{Status: api.StatusOK}
+
+	case api.OpStat:
+		if err := n.settleWrite(ctx, req.BlockID); err != nil {
+			return errorResponse(err)
+		}
+		metadata, err := t.service.ReadBlockMetadata(ctx, req.BlockID)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &api.Response{
+			Status: api.StatusOK,
+			Stat: &api.BlockStat{
+				Checksum:     metadata.Checksum,
+				Size:         metadata.Size,
+				Version:      metadata.Version,
+				CreatedAt:    metadata.CreatedAt,
+				LastModified: metadata.LastModified,
+			},
+		}
+
+	default:
+		return badRequest(fmt.Sprintf("unsupported operation %s", req.Op))
+	}
+}
+
+// dispatchErasure executes a request for a block of an erasure-coded
+// namespace, whose shards are kept by the members of its chain rather
+// than by the target the request reached
+func (n *StorageNode) dispatchErasure(ctx context.Context, t *target, table *api.RoutingTable, req *api.Request) *api.Response {
+	policy := erasureOf(table, req.BlockID)
+	switch req.Op {
+	case api.OpRead, api.OpFetch:
+		data, header, _, err := n.readErasure(ctx, table, policy, req.BlockID)
+		if err != nil {
+			return errorResponse(err)
+		}
+		resp := &api.Response{Status: api.StatusOK, Data: data}
+		if req.Op == api.OpFetch {
+			resp.Stat = header.stat()
+		}
+		return resp
+
+	case api.OpWrite:
+		if n.IsReadOnly() {
+			return readOnlyResponse()
+		}
+		if n.IsDecommissioning() {
+			return n.redirect(req, "node is being decommissioned")
+		}
+		if resp := n.checkFence(ctx, t, req); resp != nil {
+			return resp
+		}
+		if err := checkWriteChecksum(req); err != nil {
+			return &api.Response{Status: api.StatusBadRequest, Error: err.Error(), Code: api.CodeCorrupted}
+		}
+		if err := n.writeErasure(ctx, t, table, policy, req.BlockID, req.Data); err != nil {
+			return errorResponse(err)
+		}
+		t.written.Add(int64(len(req.Data)))
+		if err := n.journalGeo(t, req); err != nil {
+			return errorResponse(err)
+		}
+		if err := n.logErasureChange(t, req); err != nil {
+			return errorResponse(err)
+		}
+		return &api.Response{Status: api.StatusOK}
+
+	case api.OpDelete:
+		if n.IsReadOnly() {
+			return readOnlyResponse()
+		}
+		if resp := n.checkFence(ctx, t, req); resp != nil {
+			return resp
+		}
+		if err := n.deleteErasure(ctx, t, table, policy, req.BlockID); err != nil {
+			return errorResponse(err)
+		}
+		if err := n.journalGeo(t, req); err != nil {
+			return errorResponse(err)
+		}
+		if err := n.logErasureChange(t, req); err != nil {
+			return errorResponse(err)
+		}
+		return &api.Response{Status: api.StatusOK}
+
+	case api.OpStat:
+		_, header, _, err := n.readErasure(ctx, table, policy, req.BlockID)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return &api.Response{Status: api.StatusOK, Stat: header.stat()}
+
+	default:
+		return badRequest(fmt.Sprintf("unsupported operation %s", req.Op))
+	}
+}
+
+// checkWriteChecksum checks a write's data against the checksum the client
+// sent with it, if any
+func checkWriteChecksum(req *api.Request) error {
+	checksum, ok := req.Headers[api.ChecksumHeader]
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256(req.Data)
+	if hex.EncodeToString(sum[:]) != strings.ToLower(checksum) {
+		return fmt.Errorf("data of %s does not match its checksum: %w", req.BlockID, api.ErrCorrupted)
+	}
+	return nil
+}
+
+// requiredPermission returns the ACL permission an operation needs
+func requiredPermission(op api.Op) (auth.Permission, bool) {
+	switch op {
+	case api.OpRead, api.OpStat, api.OpList, api.OpFetch:
+		return auth.PermRead, true
+	case api.OpWrite:
+		return auth.PermWrite, true
+	case api.OpDelete:
+		return auth.PermDelete, true
+	default:
+		return "", false
+	}
+}
+
+// readableBlocks filters a listing down to the namespaces the identity may
+// read
+func (n *StorageNode) readableBlocks(identity *auth.Identity, blockIDs []string) []string {
+	if !n.acl.Enabled() {
+		return blockIDs
+	}
+
+	allowed := make(map[string]bool)
+	readable := make([]string, 0, len(blockIDs))
+	for _, blockID := range blockIDs {
+		namespace := auth.Namespace(blockID)
+		ok, seen := allowed[namespace]
+		if !seen {
+			ok = n.acl.Allowed(identity, namespace, auth.PermRead)
+			allowed[namespace] = ok
+		}
+		if ok {
+			readable = append(readable, blockID)
+		}
+	}
+	return readable
+}
+
+// errorResponse builds a response for a failed request
+func errorResponse(err error) *api.Response {
+	return &api.Response{Status: api.StatusError, Error: err.Error(), Code: api.CodeOf(err)}
+}
+
+// readOnlyResponse builds the response for a write refused in read-only mode
+func readOnlyResponse() *api.Response {
+	return &api.Response{Status: api.StatusReadOnly, Error: api.ErrReadOnly.Error(), Code: api.CodeReadOnly}
+}
+
+// badRequest builds a response for a malformed request
+func badRequest(msg string) *api.Response {
+	return &api.Response{Status: api.StatusBadRequest, Error: msg}
+}
@@ -0,0 +1,114 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// DefaultDrainTimeout bounds how long shutdown waits for in-flight work
+const DefaultDrainTimeout = 30 * time.Second
+
+// requestTracker counts in-flight client requests so shutdown can wait for
+// them to finish. Once draining starts no new requests are admitted.
+type requestTracker struct {
+	inflight int
+	draining bool
+	idle     chan struct{}
+	mu       sync.Mutex
+}
+
+// begin admits a request, returning false if the node is draining
+func (t *requestTracker) begin() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.draining {
+		return false
+	}
+	t.inflight++
+	return true
+}
+
+// end marks an admitted request as finished
+func (t *requestTracker) end() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.inflight--
+	if t.inflight == 0 && t.idle != nil {
+		close(t.idle)
+		t.idle = nil
+	}
+}
+
+// isDraining returns whether draining has started
+func (t *requestTracker) isDraining() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.draining
+}
+
+// count returns the number of in-flight requests
+func (t *requestTracker) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.inflight
+}
+
+// drain stops admitting requests and waits until the in-flight ones have
+// finished or ctx expires
+func (t *requestTracker) drain(ctx context.Context) error {
+	t.mu.Lock()
+	t.draining = true
+	if t.inflight == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	if t.idle == nil {
+		t.idle = make(chan struct{})
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// drain stops the node taking new work and waits, bounded by the configured
+// drain timeout, for in-flight requests and chain commits to complete
+func (n *StorageNode) drain() {
+	timeout := DefaultDrainTimeout
+	if configured := time.Duration(n.cfg.Storage.Node.DrainTimeout); configured > 0 {
+		timeout = configured
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	n.logger.Info("draining node", "inflight", n.requests.count(), "timeout", timeout)
+
+	// Stop accepting new connections
+	if n.rdmaTransport != nil {
+		if err := n.rdmaTransport.CloseListener(); err != nil {
+			n.logger.Warn("failed to close transport listener", "error", err)
+		}
+	} else if n.listener != nil {
+		if err := n.listener.Close(); err != nil {
+			n.logger.Warn("failed to close TCP listener", "error", err)
+		}
+	}
+
+	if err := n.requests.drain(ctx); err != nil {
+		n.logger.Warn("abandoning in-flight requests", "inflight", n.requests.count(), "error", err)
+	}
+
+	if err := n.craqChain.WaitForCommits(ctx); err != nil {
+		n.logger.Warn("abandoning pending chain commits", "error", err)
+	}
+
+	n.logger.Info("drain complete")
+}
@@ -0,0 +1,635 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/erasure"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+const (
+	// shardMagic starts every erasure-coded shard, "3EC1"
+	shardMagic = 0x33454331
+	// shardHeaderSize is the size of a shard's header: magic, data and
+	// parity shard counts, index, the block's size, write stamp and
+	// checksum
+	shardHeaderSize = 4 + 3 + 1 + 8 + 8 + sha256.Size
+)
+
+// errCorruptShard reports a shard block without a valid header
+var errCorruptShard = errors.New("invalid erasure-coded shard")
+
+// shardHeader precedes the data of each shard. Every shard of one write of
+// a block carries the same header but for its index, so that shards of
+// different writes are never decoded together.
+type shardHeader struct {
+	data, parity, index int
+	// size is the size of the block
+	size int64
+	// stamp is when the block was written, in nanoseconds
+	stamp int64
+	// checksum is the SHA-256 of the block
+	checksum [sha256.Size]byte
+}
+
+// encode returns the shard's block: its header followed by its data
+func (h shardHeader) encode(shard []byte) []byte {
+	buf := make([]byte, shardHeaderSize+len(shard))
+	binary.BigEndian.PutUint32(buf[0:4], shardMagic)
+	buf[4] = byte(h.data - 1)
+	buf[5] = byte(h.parity - 1)
+	buf[6] = byte(h.index)
+	binary.BigEndian.PutUint64(buf[8:16], uint64(h.size))
+	binary.BigEndian.PutUint64(buf[16:24], uint64(h.stamp))
+	copy(buf[24:shardHeaderSize], h.checksum[:])
+	copy(buf[shardHeaderSize:], shard)
+	return buf
+}
+
+// decodeShard splits a shard's block into its header and data
+func decodeShard(buf []byte) (shardHeader, []byte, error) {
+	if len(buf) < shardHeaderSize || binary.BigEndian.Uint32(buf[0:4]) != shardMagic {
+		return shardHeader{}, nil, errCorruptShard
+	}
+	h := shardHeader{
+		data:   int(buf[4]) + 1,
+		parity: int(buf[5]) + 1,
+		index:  int(buf[6]),
+		size:   int64(binary.BigEndian.Uint64(buf[8:16])),
+		stamp:  int64(binary.BigEndian.Uint64(buf[16:24])),
+	}
+	copy(h.checksum[:], buf[24:shardHeaderSize])
+	if h.data+h.parity > erasure.MaxShards || h.index >= h.data+h.parity || h.size < 0 {
+		return shardHeader{}, nil, errCorruptShard
+	}
+	return h, buf[shardHeaderSize:], nil
+}
+
+// ErasureStats counts the erasure-coded blocks a node has coded and
+// decoded
+type ErasureStats struct {
+	Writes        uint64 `json:"writes"`
+	Reads         uint64 `json:"reads"`
+	DegradedReads uint64 `json:"degraded_reads"`
+	Reconstructed uint64 `json:"reconstructed"`
+}
+
+// erasureCoder holds the codes of the erasure-coded namespaces and counts
+// their use
+type erasureCoder struct {
+	codes         map[api.ErasurePolicy]*erasure.Code
+	mu            sync.Mutex
+	writes        atomic.Uint64
+	reads         atomic.Uint64
+	degradedReads atomic.Uint64
+	reconstructed atomic.Uint64
+}
+
+// code returns the code of a policy, building it on first use
+func (e *erasureCoder) code(policy api.ErasurePolicy) (*erasure.Code, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if code, ok := e.codes[policy]; ok {
+		return code, nil
+	}
+	code, err := erasure.New(policy.Data, policy.Parity)
+	if err != nil {
+		return nil, err
+	}
+	if e.codes == nil {
+		e.codes = make(map[api.ErasurePolicy]*erasure.Code)
+	}
+	e.codes[policy] = code
+	return code, nil
+}
+
+// stats returns a snapshot of the counters
+func (e *erasureCoder) stats() ErasureStats {
+	return ErasureStats{
+		Writes:        e.writes.Load(),
+		Reads:         e.reads.Load(),
+		DegradedReads: e.degradedReads.Load(),
+		Reconstructed: e.reconstructed.Load(),
+	}
+}
+
+// erasureOf returns the erasure coding of a block a client names, or nil
+// if its namespace is replicated. Shards are stored as they are.
+func erasureOf(table *api.RoutingTable, blockID string) *api.ErasurePolicy {
+	if table == nil {
+		return nil
+	}
+	policy := table.Erasure(api.Namespace(blockID))
+	if policy == nil {
+		return nil
+	}
+	if _, _, ok := api.ParseShardBlockID(blockID); ok {
+		return nil
+	}
+	return policy
+}
+
+// isShard reports whether a block is a shard of an erasure-coded block
+func isShard(table *api.RoutingTable, blockID string) bool {
+	base, _, ok := api.ParseShardBlockID(blockID)
+	return ok && table != nil && table.Erasure(api.Namespace(base)) != nil
+}
+
+// stripe returns the chain members keeping the shards of a block, member
+// i keeping shard i
+func stripe(table *api.RoutingTable, policy *api.ErasurePolicy, blockID string) ([]string, error) {
+	chain := table.ChainForBlock(blockID)
+	if chain == nil {
+		return nil, fmt.Errorf("no chain for block %s", blockID)
+	}
+	shards := policy.Data + policy.Parity
+	if len(chain.Members) < shards {
+		return nil, fmt.Errorf("chain %d has %d members, fewer than the %d shards of block %s", chain.ID, len(chain.Members), shards, blockID)
+	}
+	return chain.Members[:shards], nil
+}
+
+// writeErasure splits a block into its shards and writes each to its chain
+// member, in parallel. Members that are down are passed over, and their
+// shards rebuilt by repair once they are replaced, but the write fails if
+// an up member's shard does or fewer than the data shards are stored.
+func (n *StorageNode) writeErasure(ctx context.Context, t *target, table *api.RoutingTable, policy *api.ErasurePolicy, blockID string, data []byte) error {
+	if _, _, ok := api.ParseShardBlockID(blockID); ok {
+		return fmt.Errorf("block ID %s is reserved for erasure-coded shards", blockID)
+	}
+	code, err := n.erasure.code(*policy)
+	if err != nil {
+		return err
+	}
+	members, err := stripe(table, policy, blockID)
+	if err != nil {
+		return err
+	}
+	fenced, err := n.fence(ctx, table, t.id)
+	if err != nil {
+		return err
+	}
+
+	shards := code.Split(data)
+	if err := code.Encode(shards); err != nil {
+		return err
+	}
+	header := shardHeader{
+		data:     policy.Data,
+		parity:   policy.Parity,
+		size:     int64(len(data)),
+		stamp:    time.Now().UnixNano(),
+		checksum: sha256.Sum256(data),
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(members))
+	written := make([]bool, len(members))
+	for i, member := range members {
+		if record, ok := table.Nodes[member]; !ok || !record.Healthy() {
+			continue
+		}
+		h := header
+		h.index = i
+		wg.Add(1)
+		go func(i int, member string, shard []byte) {
+			defer wg.Done()
+			errs[i] = n.writeShard(fenced, table, member, api.ShardBlockID(blockID, i), shard)
+			written[i] = errs[i] == nil
+		}(i, member, h.encode(shards[i]))
+	}
+	wg.Wait()
+
+	stored := 0
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("failed to write shard %d to %s: %w", i, members[i], err)
+		}
+		if written[i] {
+			stored++
+		}
+	}
+	if stored < policy.Data {
+		return fmt.Errorf("stored %d shards of block %s, fewer than the %d it needs", stored, blockID, policy.Data)
+	}
+	n.erasure.writes.Add(1)
+	return nil
+}
+
+// writeShard stores a shard on a chain member, directly if the member is
+// a local target
+func (n *StorageNode) writeShard(ctx context.Context, table *api.RoutingTable, member, shardID string, data []byte) error {
+	if t := n.target(member); t != nil {
+		if err := t.available(); err != nil {
+			return err
+		}
+		return t.service.WriteBlock(ctx, shardID, data)
+	}
+	peer, err := n.writePeers.get(n, table, member)
+	if err == nil {
+		err = peer.Write(client.WithTarget(ctx, member), shardID, data)
+	}
+	if err != nil {
+		n.writePeers.drop(member)
+	}
+	return err
+}
+
+// readShard reads a shard from a chain member, directly if the member is
+// a local target
+func (n *StorageNode) readShard(ctx context.Context, table *api.RoutingTable, member, shardID string) ([]byte, error) {
+	if t := n.target(member); t != nil {
+		if err := t.available(); err != nil {
+			return nil, err
+		}
+		return t.service.ReadBlockWithClass(ctx, block.IOClassInteractive, shardID)
+	}
+	peer, err := n.writePeers.get(n, table, member)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := n.fetchBlock(ctx, peer, member, shardID, 0)
+	if err != nil && !errors.Is(err, api.ErrNotFound) {
+		n.writePeers.drop(member)
+	}
+	return data, err
+}
+
+// stripeShard is a shard read back from a chain member
+type stripeShard struct {
+	header shardHeader
+	data   []byte
+}
+
+// shardSet collects the shards of a block read so far
+type shardSet struct {
+	shards []stripeShard
+	// notFound counts the reads that found no shard, and failed those
+	// that could not tell
+	notFound int
+	failed   int
+	mu       sync.Mutex
+}
+
+// read reads the shards at the given indices from the given members,
+// concurrently, and adds those found to the set
+func (s *shardSet) read(ctx context.Context, n *StorageNode, table *api.RoutingTable, blockID string, reads map[string][]int) {
+	var wg sync.WaitGroup
+	for member, indices := range reads {
+		if record, ok := table.Nodes[member]; !ok || !record.Healthy() {
+			continue
+		}
+		wg.Add(1)
+		go func(member string, indices []int) {
+			defer wg.Done()
+			for _, index := range indices {
+				buf, err := n.readShard(ctx, table, member, api.ShardBlockID(blockID, index))
+				var header shardHeader
+				var data []byte
+				if err == nil {
+					header, data, err = decodeShard(buf)
+				}
+
+				s.mu.Lock()
+				switch {
+				case errors.Is(err, api.ErrNotFound):
+					s.notFound++
+				case err != nil:
+					s.failed++
+				case header.index == index:
+					s.shards = append(s.shards, stripeShard{header: header, data: data})
+				}
+				s.mu.Unlock()
+			}
+		}(member, indices)
+	}
+	wg.Wait()
+}
+
+// newest returns the shards of the latest write of the block that left
+// enough of them to rebuild it, by index, and their header
+func (s *shardSet) newest() ([][]byte, *shardHeader) {
+	var best *shardHeader
+	for i := range s.shards {
+		h := &s.shards[i].header
+		if best != nil && h.stamp <= best.stamp {
+			continue
+		}
+		if len(s.of(h)) >= h.data {
+			best = h
+		}
+	}
+	if best == nil {
+		return nil, nil
+	}
+	shards := make([][]byte, best.data+best.parity)
+	for index, data := range s.of(best) {
+		shards[index] = data
+	}
+	return shards, best
+}
+
+// of returns the shards of the same write as a header, by index
+func (s *shardSet) of(h *shardHeader) map[int][]byte {
+	shards := make(map[int][]byte)
+	for _, shard := range s.shards {
+		other := shard.header
+		if other.stamp == h.stamp && other.checksum == h.checksum && other.data == h.data && other.parity == h.parity {
+			shards[other.index] = shard.data
+		}
+	}
+	return shards
+}
+
+// readErasure reads an erasure-coded block. The data shards are read
+// first, and are the block itself when they are all there. Otherwise the
+// parity shards are read too and the block is decoded; if that is still
+// too few, as when chain members have moved since the block was written,
+// every member is asked for every missing shard. It returns the block's
+// header and whether the read was degraded.
+func (n *StorageNode) readErasure(ctx context.Context, table *api.RoutingTable, policy *api.ErasurePolicy, blockID string) ([]byte, *shardHeader, bool, error) {
+	members, err := stripe(table, policy, blockID)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	set := &shardSet{}
+	reads := make(map[string][]int)
+	for i := 0; i < policy.Data; i++ {
+		reads[members[i]] = []int{i}
+	}
+	set.read(ctx, n, table, blockID, reads)
+	if shards, header := set.newest(); header != nil && allPresent(shards[:header.data]) {
+		data, err := n.joinShards(shards, header)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		n.erasure.reads.Add(1)
+		return data, header, false, nil
+	}
+
+	reads = make(map[string][]int)
+	for i := policy.Data; i < len(members); i++ {
+		reads[members[i]] = []int{i}
+	}
+	set.read(ctx, n, table, blockID, reads)
+	shards, header := set.newest()
+	if header == nil {
+		found := make(map[int]bool, len(set.shards))
+		for _, shard := range set.shards {
+			found[shard.header.index] = true
+		}
+		reads = make(map[string][]int)
+		for p, member := range members {
+			for i := range members {
+				if i != p && !found[i] {
+					reads[member] = append(reads[member], i)
+				}
+			}
+		}
+		set.read(ctx, n, table, blockID, reads)
+		shards, header = set.newest()
+	}
+	if header == nil {
+		if len(set.shards) == 0 && set.failed == 0 {
+			return nil, nil, false, fmt.Errorf("block %s: %w", blockID, api.ErrNotFound)
+		}
+		return nil, nil, false, fmt.Errorf("block %s: %w: found %d, %d reads failed", blockID, erasure.ErrTooFewShards, len(set.shards), set.failed)
+	}
+
+	data, err := n.joinShards(shards, header)
+	if err != nil {
+		return nil, nil, false, err
+	}
+	n.erasure.reads.Add(1)
+	n.erasure.degradedReads.Add(1)
+	return data, header, true, nil
+}
+
+// allPresent reports whether none of shards is missing
+func allPresent(shards [][]byte) bool {
+	for _, shard := range shards {
+		if shard == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// joinShards rebuilds a block from its shards, decoding any missing data
+// shard, and checks it against its checksum. shards is filled in.
+func (n *StorageNode) joinShards(shards [][]byte, header *shardHeader) ([]byte, error) {
+	code, err := n.erasure.code(api.ErasurePolicy{Data: header.data, Parity: header.parity})
+	if err != nil {
+		return nil, err
+	}
+	if err := code.Reconstruct(shards); err != nil {
+		return nil, err
+	}
+	data, err := code.Join(shards, int(header.size))
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(data); !bytes.Equal(sum[:], header.checksum[:]) {
+		return nil, fmt.Errorf("decoded block does not match its checksum: %w", api.ErrCorrupted)
+	}
+	return data, nil
+}
+
+// stat describes the block a shard is of. Stating an erasure-coded block
+// reads it, to find the latest write with enough shards to rebuild.
+func (h *shardHeader) stat() *api.BlockStat {
+	return &api.BlockStat{
+		Checksum:     hex.EncodeToString(h.checksum[:]),
+		Size:         int(h.size),
+		CreatedAt:    h.stamp,
+		LastModified: h.stamp,
+	}
+}
+
+// deleteErasure deletes the shards of a block from every up member of its
+// stripe
+func (n *StorageNode) deleteErasure(ctx context.Context, t *target, table *api.RoutingTable, policy *api.ErasurePolicy, blockID string) error {
+	members, err := stripe(table, policy, blockID)
+	if err != nil {
+		return err
+	}
+	fenced, err := n.fence(ctx, table, t.id)
+	if err != nil {
+		return err
+	}
+
+	for i, member := range members {
+		if record, ok := table.Nodes[member]; !ok || !record.Healthy() {
+			continue
+		}
+		if err := n.deleteShard(fenced, table, member, api.ShardBlockID(blockID, i)); err != nil {
+			return fmt.Errorf("failed to delete shard %d from %s: %w", i, member, err)
+		}
+	}
+	return nil
+}
+
+// deleteShard deletes a shard from a chain member, directly if the member
+// is a local target
+func (n *StorageNode) deleteShard(ctx context.Context, table *api.RoutingTable, member, shardID string) error {
+	if t := n.target(member); t != nil {
+		if err := t.available(); err != nil {
+			return err
+		}
+		return t.service.DeleteBlock(ctx, shardID)
+	}
+	peer, err := n.writePeers.get(n, table, member)
+	if err == nil {
+		err = peer.Delete(client.WithTarget(ctx, member), shardID)
+	}
+	if err != nil {
+		n.writePeers.drop(member)
+	}
+	return err
+}
+
+// erasureListing replaces the shards in a listing by the blocks they are
+// shards of, once each
+func erasureListing(table *api.RoutingTable, blockIDs []string) []string {
+	if table == nil || len(table.Policies) == 0 {
+		return blockIDs
+	}
+	listed := make([]string, 0, len(blockIDs))
+	seen := make(map[string]bool)
+	for _, blockID := range blockIDs {
+		if isShard(table, blockID) {
+			base, _, _ := api.ParseShardBlockID(blockID)
+			if seen[base] {
+				continue
+			}
+			seen[base] = true
+			blockID = base
+		}
+		listed = append(listed, blockID)
+	}
+	return listed
+}
+
+// repairShard rebuilds the missing shards of the erasure-coded block a
+// local shard belongs to. The member keeping shard i checks the stripe
+// when it holds shard i, and the first such member in stripe order is
+// responsible for decoding the block and writing the shards of the up
+// members that lack theirs. A shard held by a member that no longer keeps
+// its index, as after chain members moved, is deleted once the member now
+// keeping it has it. It returns whether the stripe was short of shards
+// and how many bytes were written.
+func (r *repairController) repairShard(ctx context.Context, table *api.RoutingTable, budget *ratelimit.Limiter, peers map[string]*client.Client, t *target, shardID string) (bool, int64, error) {
+	blockID, index, _ := api.ParseShardBlockID(shardID)
+	policy := table.Erasure(api.Namespace(blockID))
+	members, err := stripe(table, policy, blockID)
+	if err != nil {
+		return false, 0, nil
+	}
+
+	if index >= len(members) || members[index] != t.id {
+		if index >= len(members) {
+			return false, 0, nil
+		}
+		holder := members[index]
+		if record, ok := table.Nodes[holder]; !ok || !record.Healthy() {
+			return false, 0, nil
+		}
+		peer, err := r.peer(table, peers, holder)
+		if err != nil {
+			return false, 0, err
+		}
+		if _, err := peer.Stat(client.WithTarget(ctx, holder), shardID); err != nil {
+			return false, 0, nil
+		}
+		return false, 0, t.service.DeleteBlock(ctx, shardID)
+	}
+
+	// Find which up members lack their shard
+	responsible := true
+	missing := make([]int, 0)
+	for i, member := range members {
+		if member == t.id {
+			continue
+		}
+		record, ok := table.Nodes[member]
+		if !ok || !record.Healthy() {
+			continue
+		}
+		peer, err := r.peer(table, peers, member)
+		if err != nil {
+			return false, 0, err
+		}
+		if _, err := peer.Stat(client.WithTarget(ctx, member), api.ShardBlockID(blockID, i)); err == nil {
+			if i < index {
+				// An earlier member holds its shard and will repair
+				responsible = false
+			}
+			continue
+		} else if !errors.Is(err, api.ErrNotFound) {
+			return false, 0, err
+		}
+		missing = append(missing, i)
+	}
+	if len(missing) == 0 {
+		return false, 0, nil
+	}
+	if !responsible {
+		return true, 0, nil
+	}
+
+	data, header, _, err := r.node.readErasure(ctx, table, policy, blockID)
+	if err != nil {
+		return true, 0, err
+	}
+	code, err := r.node.erasure.code(api.ErasurePolicy{Data: header.data, Parity: header.parity})
+	if err != nil {
+		return true, 0, err
+	}
+	shards := code.Split(data)
+	if err := code.Encode(shards); err != nil {
+		return true, 0, err
+	}
+	fenced, err := r.node.fence(ctx, table, t.id)
+	if err != nil {
+		return true, 0, err
+	}
+
+	var written int64
+	for _, i := range missing {
+		if i >= len(shards) {
+			continue
+		}
+		h := *header
+		h.index = i
+		buf := h.encode(shards[i])
+		if err := budget.WaitN(ctx, len(buf)); err != nil {
+			return true, written, err
+		}
+		peer, err := r.peer(table, peers, members[i])
+		if err != nil {
+			return true, written, err
+		}
+		if err := peer.Write(client.WithTarget(fenced, members[i]), api.ShardBlockID(blockID, i), buf); err != nil {
+			peer.Close()
+			delete(peers, members[i])
+			return true, written, fmt.Errorf("failed to write shard %d to %s: %w", i, members[i], err)
+		}
+		written += int64(len(buf))
+		r.node.erasure.reconstructed.Add(1)
+	}
+	return true, written, nil
+}
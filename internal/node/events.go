@@ -0,0 +1,170 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// eventBuffer is how many events a subscriber may fall behind before
+// further events are dropped for it
+const eventBuffer = 1024
+
+// eventHub fans the node's block events out to the subscribers of the
+// event stream. Publishing never blocks: a subscriber that falls behind
+// loses events, and is told how many. The zero value is ready to use.
+type eventHub struct {
+	mu   sync.Mutex
+	subs map[*eventSubscription]struct{}
+	seq  atomic.Uint64
+	// count is the number of subscribers, so that writes can skip
+	// building events nobody reads
+	count atomic.Int64
+}
+
+// eventSubscription receives the events of blocks with a prefix
+type eventSubscription struct {
+	prefix  string
+	events  chan api.BlockEvent
+	dropped atomic.Int64
+}
+
+// active reports whether anyone subscribes to events
+func (h *eventHub) active() bool {
+	return h.count.Load() > 0
+}
+
+// subscribe returns a subscription to the events of blocks with a prefix
+func (h *eventHub) subscribe(prefix string) *eventSubscription {
+	sub := &eventSubscription{prefix: prefix, events: make(chan api.BlockEvent, eventBuffer)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs == nil {
+		h.subs = make(map[*eventSubscription]struct{})
+	}
+	h.subs[sub] = struct{}{}
+	h.count.Add(1)
+	return sub
+}
+
+// unsubscribe ends a subscription
+func (h *eventHub) unsubscribe(sub *eventSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		h.count.Add(-1)
+	}
+}
+
+// publish numbers an event and hands it to the subscribers of its block
+func (h *eventHub) publish(e api.BlockEvent) {
+	e.Seq = h.seq.Add(1)
+	if e.Time == 0 {
+		e.Time = time.Now().UnixNano()
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		if !strings.HasPrefix(e.BlockID, sub.prefix) {
+			continue
+		}
+		select {
+		case sub.events <- e:
+		default:
+			sub.dropped.Add(1)
+		}
+	}
+}
+
+// blockExists reports whether a target holds a block, for the event and
+// change record of a write about to replace it. It is only checked while
+// anyone subscribes to events or the change log is enabled.
+func (n *StorageNode) blockExists(t *target, blockID string) bool {
+	if !n.events.active() && n.cdc == nil {
+		return false
+	}
+	exists, _, err := t.storage.ReadBlockMetadata(blockID)
+	return err == nil && exists
+}
+
+// publishWrite publishes the event of a block written to a target, as
+// updated if the target held it before the write
+func (n *StorageNode) publishWrite(ctx context.Context, t *target, blockID string, existed bool) {
+	if !n.events.active() {
+		return
+	}
+	metadata, err := t.service.ReadBlockMetadata(ctx, blockID)
+	if err != nil {
+		return
+	}
+	e := api.BlockEvent{
+		Type:     api.EventCreated,
+		BlockID:  blockID,
+		Target:   t.id,
+		Version:  metadata.Version,
+		Size:     metadata.Size,
+		Checksum: metadata.Checksum,
+		Time:     metadata.LastModified,
+	}
+	if existed {
+		e.Type = api.EventUpdated
+	}
+	n.events.publish(e)
+}
+
+// publishDelete publishes the event of a block deleted from a target
+func (n *StorageNode) publishDelete(t *target, blockID string) {
+	if n.events.active() {
+		n.events.publish(api.BlockEvent{Type: api.EventDeleted, BlockID: blockID, Target: t.id})
+	}
+}
+
+// handleEvents streams the node's block events, optionally only those of
+// blocks with the prefix query parameter, as a JSON object per line until
+// the client goes away
+func (a *adminServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	hub := &a.node.events
+	sub := hub.subscribe(r.URL.Query().Get("prefix"))
+	defer hub.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case e := <-sub.events:
+			if dropped := sub.dropped.Swap(0); dropped > 0 {
+				lost := api.BlockEvent{Type: api.EventDropped, Count: int(dropped), Time: time.Now().UnixNano()}
+				if err := enc.Encode(lost); err != nil {
+					return
+				}
+			}
+			if err := enc.Encode(e); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-a.node.ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// fence returns a context whose writes to other nodes carry the fencing
+// token of a local target. Without a routing table entry for the target
+// there is no token to send. A target the coordinator has declared down
+// is fenced off and must not write to other nodes at all.
+func (n *StorageNode) fence(ctx context.Context, table *api.RoutingTable, targetID string) (context.Context, error) {
+	record, ok := table.Nodes[targetID]
+	if !ok {
+		return ctx, nil
+	}
+	if record.State == api.NodeStateDown {
+		return nil, fmt.Errorf("%w: target %s has been declared down", api.ErrFenced, targetID)
+	}
+	return client.WithFence(ctx, api.FencingToken{NodeID: targetID, Epoch: record.Epoch}), nil
+}
+
+// checkFence refuses a write or delete if the coordinator has declared
+// the receiving target down, or if it comes from another node whose
+// fencing token is older than the epoch in the routing table. A token
+// newer than the table means the table is behind, so it is refreshed
+// before the token is judged. It returns nil if the request may proceed.
+func (n *StorageNode) checkFence(ctx context.Context, t *target, req *api.Request) *api.Response {
+	table := n.cachedTable()
+	if table == nil {
+		return nil
+	}
+	if record, ok := table.Nodes[t.id]; ok && record.State == api.NodeStateDown {
+		return fencedResponse(fmt.Sprintf("target %s has been declared down", t.id))
+	}
+
+	value, ok := req.Headers[api.FenceHeader]
+	if !ok {
+		return nil
+	}
+	token, err := api.ParseFencingToken(value)
+	if err != nil {
+		return badRequest(err.Error())
+	}
+
+	record, ok := table.Nodes[token.NodeID]
+	if (!ok || record.Epoch < token.Epoch) && n.routing != nil {
+		if err := n.routing.Refresh(ctx); err != nil {
+			n.logger.Warn("failed to refresh routing table", "error", err)
+		} else if table = n.cachedTable(); table != nil {
+			record, ok = table.Nodes[token.NodeID]
+		}
+	}
+
+	switch {
+	case !ok:
+		return fencedResponse(fmt.Sprintf("node %s is not in the routing table", token.NodeID))
+	case record.Epoch > token.Epoch:
+		n.logger.Warn("refused write with stale fencing epoch", "node", token.NodeID, "epoch", token.Epoch, "current_epoch", record.Epoch, "block", req.BlockID)
+		return fencedResponse(fmt.Sprintf("node %s is at epoch %d, the write carried epoch %d", token.NodeID, record.Epoch, token.Epoch))
+	case record.State == api.NodeStateDown:
+		return fencedResponse(fmt.Sprintf("node %s has been declared down", token.NodeID))
+	}
+	return nil
+}
+
+// fencedResponse builds the response for a write refused by fencing
+func fencedResponse(reason string) *api.Response {
+	return &api.Response{Status: api.StatusFenced, Error: reason}
+}
@@ -0,0 +1,130 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// readRepairTimeout bounds fetching a missing block from a chain member
+// while a client waits for it
+const readRepairTimeout = 10 * time.Second
+
+// PeerTrafficStats reports block fetches between nodes, which are
+// accounted separately from client traffic
+type PeerTrafficStats struct {
+	FetchesServed uint64 `json:"fetches_served"`
+	BytesServed   uint64 `json:"bytes_served"`
+	Fetches       uint64 `json:"fetches"`
+	BytesFetched  uint64 `json:"bytes_fetched"`
+	FetchFailures uint64 `json:"fetch_failures"`
+	ReadRepairs   uint64 `json:"read_repairs"`
+}
+
+// peerTraffic counts block fetches served to and made from other nodes
+type peerTraffic struct {
+	fetchesServed atomic.Uint64
+	bytesServed   atomic.Uint64
+	fetches       atomic.Uint64
+	bytesFetched  atomic.Uint64
+	fetchFailures atomic.Uint64
+	readRepairs   atomic.Uint64
+}
+
+// stats returns a snapshot of the counters
+func (p *peerTraffic) stats() PeerTrafficStats {
+	return PeerTrafficStats{
+		FetchesServed: p.fetchesServed.Load(),
+		BytesServed:   p.bytesServed.Load(),
+		Fetches:       p.fetches.Load(),
+		BytesFetched:  p.bytesFetched.Load(),
+		FetchFailures: p.fetchFailures.Load(),
+		ReadRepairs:   p.readRepairs.Load(),
+	}
+}
+
+// serveFetch hands a block and its metadata to a peer copying it
+func (n *StorageNode) serveFetch(ctx context.Context, t *target, req *api.Request) *api.Response {
+	data, metadata, err := t.service.FetchBlock(ctx, req.BlockID, req.Version)
+	if err != nil {
+		return errorResponse(err)
+	}
+
+	n.peerTraffic.fetchesServed.Add(1)
+	n.peerTraffic.bytesServed.Add(uint64(len(data)))
+	return &api.Response{
+		Status: api.StatusOK,
+		Data:   data,
+		Stat: &api.BlockStat{
+			Checksum:     metadata.Checksum,
+			Size:         metadata.Size,
+			Version:      metadata.Version,
+			CreatedAt:    metadata.CreatedAt,
+			LastModified: metadata.LastModified,
+		},
+	}
+}
+
+// fetchBlock copies a block from a chain member, refusing copies older
+// than version. The data has been verified against its checksum.
+func (n *StorageNode) fetchBlock(ctx context.Context, peer *client.Client, member, blockID string, version int) ([]byte, *api.BlockStat, error) {
+	data, stat, err := peer.Fetch(client.WithTarget(ctx, member), blockID, version)
+	if err != nil {
+		n.peerTraffic.fetchFailures.Add(1)
+		return nil, nil, err
+	}
+
+	n.peerTraffic.fetches.Add(1)
+	n.peerTraffic.bytesFetched.Add(uint64(len(data)))
+	return data, stat, nil
+}
+
+// readRepair restores a block that a target should hold as a member of
+// the block's chain but lacks, such as one assigned to the target before
+// repair copied the chain's data. The block is fetched from the chain's
+// reference member and stored before it is served. readErr is returned
+// unchanged if the target holds the block or is not a member of its chain.
+func (n *StorageNode) readRepair(ctx context.Context, t *target, blockID string, readErr error) ([]byte, error) {
+	if exists, _, err := t.storage.ReadBlockMetadata(blockID); err != nil || exists {
+		return nil, readErr
+	}
+
+	table := n.cachedTable()
+	if table == nil {
+		return nil, readErr
+	}
+	chain := table.ChainForBlock(blockID)
+	if !isMember(chain, t.id) || isShard(table, blockID) {
+		return nil, readErr
+	}
+	member := n.referenceMember(table, chain)
+	if member == "" {
+		return nil, readErr
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readRepairTimeout)
+	defer cancel()
+
+	peer, err := n.dialPeer(table.NodeAddress(member))
+	if err != nil {
+		return nil, readErr
+	}
+	defer peer.Close()
+
+	data, stat, err := n.fetchBlock(ctx, peer, member, blockID, 0)
+	if err != nil {
+		// The block most likely does not exist
+		return nil, readErr
+	}
+	if err := t.storeReplica(blockID, data, stat); err != nil {
+		return nil, fmt.Errorf("failed to store repaired block: %w", err)
+	}
+
+	n.peerTraffic.readRepairs.Add(1)
+	n.logger.Info("repaired missing block on read", "block", blockID, "target", t.id, "member", member)
+	return data, nil
+}
@@ -0,0 +1,362 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// Kinds of disagreement between a block and its replicas
+const (
+	// ReplicaMissing is a chain member that does not hold the block
+	ReplicaMissing = "missing"
+	// ReplicaMismatch is a chain member holding other content at the same
+	// or an older version
+	ReplicaMismatch = "mismatch"
+	// ReplicaStale is a target holding an older version of the block than
+	// a chain member
+	ReplicaStale = "stale"
+	// ReplicaUnreachable is a chain member that could not be asked
+	ReplicaUnreachable = "unreachable"
+)
+
+// Actions taken by fsck beyond those of the storage check
+const (
+	// FsckRestored is a damaged or stale block replaced by a replica
+	FsckRestored = "restored"
+	// FsckRepairScheduled is a replica left to the next repair pass
+	FsckRepairScheduled = "repair_scheduled"
+)
+
+// FsckOptions select what an fsck of the node checks and fixes
+type FsckOptions struct {
+	storage.FsckOptions
+	// Target limits the check to one storage target; empty checks them all
+	Target string `json:"target,omitempty"`
+	// Replicas compares each block with its replicas on the other members
+	// of its chain
+	Replicas bool `json:"replicas"`
+}
+
+// DefaultFsckOptions returns the options of an fsck that only reports
+func DefaultFsckOptions() FsckOptions {
+	return FsckOptions{Replicas: true}
+}
+
+// ReplicaProblem is a disagreement between a target's copy of a block and
+// a chain member's
+type ReplicaProblem struct {
+	Target  string `json:"target"`
+	BlockID string `json:"block_id,omitempty"`
+	Member  string `json:"member"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail,omitempty"`
+	Action  string `json:"action,omitempty"`
+}
+
+// FsckReport summarises an fsck of the node's targets
+type FsckReport struct {
+	Options    FsckOptions                    `json:"options"`
+	StartedAt  int64                          `json:"started_at"`
+	FinishedAt int64                          `json:"finished_at"`
+	Targets    map[string]*storage.FsckReport `json:"targets"`
+	// ReplicasChecked counts the blocks compared with their replicas
+	ReplicasChecked int              `json:"replicas_checked"`
+	Replicas        []ReplicaProblem `json:"replicas"`
+	// ReplicasSkipped says why replicas were not compared, if they were not
+	ReplicasSkipped string `json:"replicas_skipped,omitempty"`
+	// Unresolved counts the problems left as they were found
+	Unresolved int `json:"unresolved"`
+}
+
+// newFsckReport creates the report of an fsck with the given options
+func newFsckReport(opts FsckOptions) *FsckReport {
+	return &FsckReport{
+		Options:   opts,
+		StartedAt: time.Now().UnixNano(),
+		Targets:   make(map[string]*storage.FsckReport),
+		Replicas:  make([]ReplicaProblem, 0),
+	}
+}
+
+// finish records the end of the fsck and counts what it left unresolved
+func (r *FsckReport) finish() {
+	r.FinishedAt = time.Now().UnixNano()
+	r.Unresolved = 0
+	for _, report := range r.Targets {
+		r.Unresolved += report.Unresolved()
+	}
+	for _, problem := range r.Replicas {
+		if problem.Action == "" {
+			r.Unresolved++
+		}
+	}
+}
+
+// SetFsckOptions sets the options of the next fsck job run, which then
+// reverts to DefaultFsckOptions
+func (n *StorageNode) SetFsckOptions(opts FsckOptions) error {
+	if opts.Target != "" && n.target(opts.Target) == nil {
+		return fmt.Errorf("unknown storage target %s", opts.Target)
+	}
+	n.fsckOptions.Store(&opts)
+	return nil
+}
+
+// Fsck checks the files of every healthy target and, if asked, compares
+// each block with its replicas on the other members of its chain. With
+// Repair, damaged blocks are quarantined and replaced by a replica, stale
+// blocks are refreshed from the member holding the newer version, and
+// members missing blocks are left to a repair pass triggered at the end.
+func (n *StorageNode) Fsck(ctx context.Context, budget *ratelimit.Limiter, opts FsckOptions) (*FsckReport, error) {
+	report := newFsckReport(opts)
+	defer report.finish()
+
+	checkOpts := opts.FsckOptions
+	checkOpts.Grace = gcGracePeriod
+	if opts.Repair {
+		// Damaged blocks are moved aside so that replicas can replace them
+		checkOpts.Quarantine = true
+	}
+
+	table := n.cachedTable()
+	if opts.Replicas && table == nil {
+		report.ReplicasSkipped = "no routing table"
+	}
+
+	scheduleRepair := false
+	for _, t := range n.targets {
+		if opts.Target != "" && t.id != opts.Target {
+			continue
+		}
+		if err := t.available(); err != nil {
+			if opts.Target != "" {
+				return report, fmt.Errorf("storage target %s: %w", t.id, err)
+			}
+			continue
+		}
+
+		targetReport, err := t.service.Fsck(ctx, budget, checkOpts)
+		if targetReport != nil {
+			report.Targets[t.id] = targetReport
+			var corrupted []string
+			for _, problem := range targetReport.Problems {
+				if problem.Kind == storage.FsckCorrupt {
+					corrupted = append(corrupted, problem.BlockID)
+				}
+			}
+			n.reportCorruption(t.id, "fsck", corrupted)
+		}
+		if err != nil {
+			return report, fmt.Errorf("storage target %s: %w", t.id, err)
+		}
+		if table == nil {
+			continue
+		}
+
+		if opts.Repair {
+			n.restoreQuarantined(ctx, table, t, targetReport)
+		}
+		if opts.Replicas {
+			scheduled, err := n.fsckReplicas(ctx, table, t, opts.Repair, report)
+			if err != nil {
+				return report, fmt.Errorf("storage target %s: %w", t.id, err)
+			}
+			scheduleRepair = scheduleRepair || scheduled
+		}
+	}
+
+	if scheduleRepair && n.repair != nil {
+		n.repair.Trigger()
+	}
+	return report, nil
+}
+
+// restoreQuarantined replaces the blocks fsck quarantined with copies from
+// the reference member of their chain
+func (n *StorageNode) restoreQuarantined(ctx context.Context, table *api.RoutingTable, t *target, report *storage.FsckReport) {
+	for i := range report.Problems {
+		problem := &report.Problems[i]
+		if problem.Action != storage.FsckQuarantined {
+			continue
+		}
+		if err := n.restoreBlock(ctx, table, t, problem.BlockID, ""); err != nil {
+			n.logger.Warn("failed to restore quarantined block", "block", problem.BlockID, "target", t.id, "error", err)
+			continue
+		}
+		problem.Action = FsckRestored
+	}
+}
+
+// restoreBlock copies a block to a target from a member of its chain, the
+// reference member unless one is named
+func (n *StorageNode) restoreBlock(ctx context.Context, table *api.RoutingTable, t *target, blockID, member string) error {
+	chain := table.ChainForBlock(blockID)
+	if !isMember(chain, t.id) {
+		return fmt.Errorf("target %s is not a member of the block's chain", t.id)
+	}
+	if member == "" {
+		if member = n.referenceMember(table, chain); member == "" {
+			return fmt.Errorf("no member of chain %d is up", chain.ID)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, readRepairTimeout)
+	defer cancel()
+
+	peer, err := n.dialPeer(table.NodeAddress(member))
+	if err != nil {
+		return err
+	}
+	defer peer.Close()
+
+	data, stat, err := n.fetchBlock(ctx, peer, member, blockID, 0)
+	if err != nil {
+		return err
+	}
+	if err := t.storeReplica(blockID, data, stat); err != nil {
+		return err
+	}
+	n.logger.Info("restored block from replica", "block", blockID, "target", t.id, "member", member)
+	return nil
+}
+
+// fsckReplicas compares every block a target holds as a chain member with
+// the copies of the chain's other up members. It returns whether members
+// were found lacking the block, for a repair pass to fix.
+func (n *StorageNode) fsckReplicas(ctx context.Context, table *api.RoutingTable, t *target, repair bool, report *FsckReport) (bool, error) {
+	blockIDs, err := t.storage.ListBlocks("")
+	if err != nil {
+		return false, err
+	}
+
+	peers := make(map[string]*client.Client)
+	unreachable := make(map[string]bool)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	scheduleRepair := false
+	for _, blockID := range blockIDs {
+		if err := ctx.Err(); err != nil {
+			return scheduleRepair, err
+		}
+		chain := table.ChainForBlock(blockID)
+		if !isMember(chain, t.id) {
+			continue
+		}
+		local, ok := t.blockMetadata(blockID)
+		if !ok {
+			continue
+		}
+		report.ReplicasChecked++
+
+		for _, member := range chain.Members {
+			node, ok := table.Nodes[member]
+			if member == t.id || unreachable[member] || !ok || node.State != api.NodeStateUp {
+				continue
+			}
+
+			peer, ok := peers[member]
+			if !ok {
+				if peer, err = n.dialPeer(table.NodeAddress(member)); err != nil {
+					unreachable[member] = true
+					report.Replicas = append(report.Replicas, ReplicaProblem{
+						Target: t.id,
+						Member: member,
+						Kind:   ReplicaUnreachable,
+						Detail: err.Error(),
+					})
+					continue
+				}
+				peers[member] = peer
+			}
+
+			problem := ReplicaProblem{Target: t.id, BlockID: blockID, Member: member}
+			stat, err := peer.Stat(client.WithTarget(ctx, member), blockID)
+			switch {
+			case err != nil:
+				problem.Kind, problem.Detail = ReplicaMissing, err.Error()
+			case stat.Checksum == local.Checksum:
+				continue
+			case stat.Version > local.Version:
+				problem.Kind = ReplicaStale
+				problem.Detail = fmt.Sprintf("version %d, member holds version %d", local.Version, stat.Version)
+			default:
+				problem.Kind = ReplicaMismatch
+				problem.Detail = fmt.Sprintf("version %d checksum %s, member holds version %d checksum %s",
+					local.Version, local.Checksum, stat.Version, stat.Checksum)
+			}
+
+			if repair {
+				if problem.Kind == ReplicaStale {
+					if err := n.restoreBlock(ctx, table, t, blockID, member); err != nil {
+						problem.Detail += "; restore failed: " + err.Error()
+					} else {
+						problem.Action = FsckRestored
+					}
+				} else if n.repair != nil {
+					problem.Action = FsckRepairScheduled
+					scheduleRepair = true
+				}
+			}
+			report.Replicas = append(report.Replicas, problem)
+		}
+	}
+	return scheduleRepair, nil
+}
+
+// blockMetadata returns the metadata of a block on the target
+func (t *target) blockMetadata(blockID string) (*storage.BlockMetadata, bool) {
+	exists, metadataBytes, err := t.storage.ReadBlockMetadata(blockID)
+	if err != nil || !exists {
+		return nil, false
+	}
+	var metadata storage.BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, false
+	}
+	return &metadata, true
+}
+
+// FsckOffline checks the targets of a node that is not running, reading
+// their data paths from the node's configuration. Replicas are not
+// compared, as that needs the cluster's routing table.
+func FsckOffline(ctx context.Context, cfg *config.Config, opts FsckOptions) (*FsckReport, error) {
+	opts.Replicas = false
+	report := newFsckReport(opts)
+	defer report.finish()
+
+	found := false
+	for _, tc := range targetConfigs(cfg) {
+		if opts.Target != "" && tc.ID != opts.Target {
+			continue
+		}
+		found = true
+
+		localStorage, err := storage.NewLocalStorage(tc.DataPath, int64(tc.MaxSpace))
+		if err != nil {
+			return report, fmt.Errorf("storage target %s: %w", tc.ID, err)
+		}
+		targetReport, err := localStorage.Fsck(ctx, nil, opts.FsckOptions)
+		if targetReport != nil {
+			report.Targets[tc.ID] = targetReport
+		}
+		if err != nil {
+			return report, fmt.Errorf("storage target %s: %w", tc.ID, err)
+		}
+	}
+	if !found {
+		return report, fmt.Errorf("unknown storage target %s", opts.Target)
+	}
+	return report, nil
+}
@@ -0,0 +1,124 @@
+package node
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/3fs-storage/internal/audit"
+	"github.com/3fs-storage/internal/auth"
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/gateway"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// gatewayBackend serves the S3 gateway from the node. Its block calls take
+// the path of client requests on the data port, so that the ACL, read-only
+// mode, replication and read repair apply to them alike.
+type gatewayBackend struct {
+	node *StorageNode
+}
+
+// Blocks returns the block API of the gateway's objects
+func (b gatewayBackend) Blocks() block.Blocks {
+	return gatewayBlocks{node: b.node}
+}
+
+// AuditDelete records an object deleted through the gateway
+func (b gatewayBackend) AuditDelete(identity *auth.Identity, remote, blockID string, err error) {
+	event := audit.Event{
+		Actor:    identity.Name,
+		Method:   identity.Method,
+		Remote:   remote,
+		Action:   "delete",
+		Resource: blockID,
+		Success:  err == nil,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	b.node.recordAudit(event)
+}
+
+// gatewayBlocks implements the block API by serving requests on the node
+type gatewayBlocks struct {
+	node *StorageNode
+}
+
+// do serves a request as the identity carried by ctx
+func (b gatewayBlocks) do(ctx context.Context, req *api.Request) (*api.Response, error) {
+	identity := auth.FromContext(ctx)
+	key := identity.Name
+	if !b.node.limits.allowRequest(key) {
+		return nil, api.ErrThrottled
+	}
+	if err := b.node.limits.waitBandwidth(ctx, key, len(req.Data)); err != nil {
+		return nil, err
+	}
+
+	resp := b.node.serveRequest(ctx, req)
+	if err := b.node.limits.waitBandwidth(ctx, key, len(resp.Data)); err != nil {
+		return nil, err
+	}
+	if err := resp.Err(); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// ReadBlock reads a block, telling a block that does not exist from one
+// that cannot be read
+func (b gatewayBlocks) ReadBlock(ctx context.Context, blockID string) ([]byte, error) {
+	resp, err := b.do(ctx, &api.Request{Op: api.OpRead, BlockID: blockID})
+	if err != nil {
+		if b.missing(blockID) {
+			return nil, fmt.Errorf("%w: %s", block.ErrBlockNotFound, blockID)
+		}
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// missing reports whether a block is known not to exist on the node
+func (b gatewayBlocks) missing(blockID string) bool {
+	t, err := b.node.targetFor(blockID, "")
+	if err != nil {
+		return false
+	}
+	exists, _, err := t.storage.ReadBlockMetadata(blockID)
+	return err == nil && !exists
+}
+
+// WriteBlock writes a block
+func (b gatewayBlocks) WriteBlock(ctx context.Context, blockID string, data []byte) error {
+	_, err := b.do(ctx, &api.Request{Op: api.OpWrite, BlockID: blockID, Data: data})
+	return err
+}
+
+// DeleteBlock deletes a block
+func (b gatewayBlocks) DeleteBlock(ctx context.Context, blockID string) error {
+	_, err := b.do(ctx, &api.Request{Op: api.OpDelete, BlockID: blockID})
+	return err
+}
+
+// ListBlocks lists the blocks with IDs starting with prefix
+func (b gatewayBlocks) ListBlocks(ctx context.Context, prefix string) ([]string, error) {
+	resp, err := b.do(ctx, &api.Request{Op: api.OpList, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Blocks, nil
+}
+
+// startGateway starts the S3 gateway on its own listener
+func (n *StorageNode) startGateway() error {
+	cfg := n.cfg.Storage.Gateway
+	server, err := gateway.New(cfg, gatewayBackend{node: n}, n.logger)
+	if err != nil {
+		return fmt.Errorf("failed to create gateway: %w", err)
+	}
+	if err := server.Start(cfg.ListenAddress); err != nil {
+		return fmt.Errorf("failed to start gateway: %w", err)
+	}
+	n.gateway = server
+	return nil
+}
@@ -0,0 +1,201 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/georep"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// geoJournalDir is the directory of the geo-replication journal in the
+// node's data path
+const geoJournalDir = "georep"
+
+// errRemoteUnknown is returned while the remote cluster's routing table
+// has not been fetched yet
+var errRemoteUnknown = errors.New("the remote cluster's routing table is not known yet")
+
+// geoReplication is the node's half of replicating to a remote cluster:
+// the journal of the writes made through the node and the shipper sending
+// them
+type geoReplication struct {
+	journal *georep.Journal
+	shipper *georep.Shipper
+	remote  *remoteCluster
+}
+
+// remoteCluster sends requests to the remote cluster along the routing
+// table its coordinator serves, once the table was fetched
+type remoteCluster struct {
+	opts    client.Options
+	cluster atomic.Pointer[client.Cluster]
+}
+
+// update routes requests along a new version of the remote routing table
+func (r *remoteCluster) update(table *api.RoutingTable) {
+	if cluster := r.cluster.Load(); cluster != nil {
+		cluster.SetTable(table)
+		return
+	}
+	r.cluster.Store(client.NewCluster(table, r.opts, client.ReadTail))
+}
+
+// get returns the client of the remote cluster
+func (r *remoteCluster) get() (*client.Cluster, error) {
+	cluster := r.cluster.Load()
+	if cluster == nil {
+		return nil, errRemoteUnknown
+	}
+	return cluster, nil
+}
+
+// Write writes a block to the remote cluster
+func (r *remoteCluster) Write(ctx context.Context, blockID string, data []byte) error {
+	cluster, err := r.get()
+	if err != nil {
+		return err
+	}
+	return cluster.Write(ctx, blockID, data)
+}
+
+// WriteCompressed writes a block compressed to the remote cluster
+func (r *remoteCluster) WriteCompressed(ctx context.Context, blockID string, compressed []byte, checksum string) error {
+	cluster, err := r.get()
+	if err != nil {
+		return err
+	}
+	return cluster.WriteCompressed(ctx, blockID, compressed, checksum)
+}
+
+// Delete deletes a block from the remote cluster
+func (r *remoteCluster) Delete(ctx context.Context, blockID string) error {
+	cluster, err := r.get()
+	if err != nil {
+		return err
+	}
+	return cluster.Delete(ctx, blockID)
+}
+
+// close closes the connections to the remote cluster
+func (r *remoteCluster) close() {
+	if cluster := r.cluster.Load(); cluster != nil {
+		cluster.Close()
+	}
+}
+
+// geoSource reads the blocks the shipper sends from the node
+type geoSource struct {
+	node *StorageNode
+}
+
+// ReadBlock reads a block from the target it was written to, or decodes
+// it from its shards if its namespace is erasure-coded
+func (s geoSource) ReadBlock(ctx context.Context, e georep.Entry) ([]byte, bool, error) {
+	n := s.node
+	var data []byte
+	var err error
+	table := n.cachedTable()
+	if policy := erasureOf(table, e.BlockID); policy != nil {
+		data, _, _, err = n.readErasure(ctx, table, policy, e.BlockID)
+	} else {
+		t := n.target(e.Target)
+		if t == nil {
+			if t, err = n.targetFor(e.BlockID, ""); err != nil {
+				return nil, false, err
+			}
+		}
+		data, err = t.service.ReadBlock(ctx, e.BlockID)
+	}
+	if errors.Is(err, api.ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// startGeoReplication opens the journal of the writes to ship to the
+// remote cluster and starts shipping them, when geo-replication is
+// configured. The remote cluster need not be reachable: the writes are
+// journaled until it is.
+func (n *StorageNode) startGeoReplication() error {
+	cfg := n.cfg.Storage.GeoReplication
+	if len(cfg.Remote) == 0 {
+		return nil
+	}
+
+	coord, err := coordinator.NewClient(cfg.Remote)
+	if err != nil {
+		return fmt.Errorf("failed to create remote coordinator client: %w", err)
+	}
+	journal, err := georep.OpenJournal(filepath.Join(n.cfg.Storage.Local.DataPath, geoJournalDir))
+	if err != nil {
+		return fmt.Errorf("failed to open geo-replication journal: %w", err)
+	}
+
+	remote := &remoteCluster{opts: client.Options{TLS: n.peerOptions.TLS, Token: cfg.Token}}
+	shipper := georep.NewShipper(journal, geoSource{node: n}, remote, georep.Options{
+		Namespaces: cfg.Namespaces,
+		Bandwidth:  int64(cfg.Bandwidth),
+		Compress:   cfg.Compression != "none",
+		Workers:    cfg.Workers,
+	}, n.logger)
+	n.geo = &geoReplication{journal: journal, shipper: shipper, remote: remote}
+
+	interval := time.Duration(n.cfg.Storage.Coordinator.RefreshInterval)
+	watcher := coordinator.NewWatcher(coord, interval, remote.update, n.logger)
+	go watcher.Run(n.ctx)
+	go shipper.Run(n.ctx)
+	n.logger.Info("geo-replication started", "remote", cfg.Remote, "namespaces", cfg.Namespaces)
+	return nil
+}
+
+// stopGeoReplication closes the journal and the connections to the remote
+// cluster, once the node's context ended
+func (n *StorageNode) stopGeoReplication() {
+	if n.geo == nil {
+		return
+	}
+	n.geo.remote.close()
+	if err := n.geo.journal.Close(); err != nil {
+		n.logger.Warn("failed to close geo-replication journal", "error", err)
+	}
+}
+
+// journalGeo records a client's write or delete of a block of a
+// geo-replicated namespace, before the client is answered. Writes that
+// members replicate to each other carry a fencing token and are left to
+// the member the client wrote to.
+func (n *StorageNode) journalGeo(t *target, req *api.Request) error {
+	if n.geo == nil || !n.geo.shipper.Replicated(req.BlockID) {
+		return nil
+	}
+	if _, ok := req.Headers[api.FenceHeader]; ok {
+		return nil
+	}
+	op := georep.OpWrite
+	if req.Op == api.OpDelete {
+		op = georep.OpDelete
+	}
+	if err := n.geo.journal.Append(op, req.BlockID, t.id); err != nil {
+		return fmt.Errorf("failed to journal block for geo-replication: %w", err)
+	}
+	return nil
+}
+
+// geoStats reports the progress of geo-replication, or nil if it is not
+// configured
+func (n *StorageNode) geoStats() *georep.Stats {
+	if n.geo == nil {
+		return nil
+	}
+	return n.geo.shipper.Stats()
+}
@@ -0,0 +1,156 @@
+package node
+
+import (
+	"context"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/version"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultHeartbeatInterval is how often nodes report their load when no
+// interval is configured
+const DefaultHeartbeatInterval = 5 * time.Second
+
+// heartbeater reports the capacity and load of the node's targets to the
+// coordinator
+type heartbeater struct {
+	node     *StorageNode
+	client   *coordinator.Client
+	interval time.Duration
+
+	// Request counters at the previous heartbeat, for rates
+	lastServed uint64
+	lastFailed uint64
+	lastAt     time.Time
+	// lastWritten are the bytes written to each target at the previous
+	// heartbeat
+	lastWritten map[string]int64
+}
+
+// startHeartbeats begins reporting to the embedded or configured coordinator
+func (n *StorageNode) startHeartbeats() error {
+	h := &heartbeater{
+		node:        n,
+		interval:    DefaultHeartbeatInterval,
+		lastAt:      time.Now(),
+		lastWritten: make(map[string]int64),
+	}
+	if configured := time.Duration(n.cfg.Storage.Coordinator.HeartbeatInterval); configured > 0 {
+		h.interval = configured
+	}
+
+	if n.coordinator == nil && len(n.cfg.Storage.Coordinator.Addresses) == 0 {
+		return nil
+	}
+	client, err := n.coordinatorClient()
+	if err != nil {
+		return err
+	}
+	h.client = client
+
+	go h.run(n.ctx)
+	return nil
+}
+
+// run sends a heartbeat every interval until ctx is done
+func (h *heartbeater) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, hb := range h.collect() {
+			if err := h.send(ctx, hb); err != nil && ctx.Err() == nil {
+				h.node.logger.Warn("failed to send heartbeat", "target", hb.NodeID, "error", err)
+			}
+		}
+	}
+}
+
+// send delivers a heartbeat to the coordinator
+func (h *heartbeater) send(ctx context.Context, hb *api.Heartbeat) error {
+	if coord := h.node.leaderCoordinator(); coord != nil {
+		return coord.Heartbeat(hb)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, h.interval)
+	defer cancel()
+	return h.client.Heartbeat(ctx, hb)
+}
+
+// collect gathers the current capacity and load of each healthy target.
+// Request and error rates are those of the whole node; write rates are
+// each target's own.
+func (h *heartbeater) collect() []*api.Heartbeat {
+	n := h.node
+	now := time.Now()
+
+	var requestRate, errorRate float64
+	served, failed := n.served.Load(), n.failed.Load()
+	elapsed := now.Sub(h.lastAt).Seconds()
+	if elapsed > 0 {
+		requestRate = float64(served-h.lastServed) / elapsed
+		errorRate = float64(failed-h.lastFailed) / elapsed
+	}
+	h.lastServed, h.lastFailed, h.lastAt = served, failed, now
+
+	var tableVersion uint64
+	if table := n.cachedTable(); table != nil {
+		tableVersion = table.Version
+	}
+
+	build := version.Get(n.cfg.Storage.FeatureFlags.List())
+	heartbeats := make([]*api.Heartbeat, 0, len(n.targets))
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+
+		hb := &api.Heartbeat{
+			NodeID:        t.id,
+			Timestamp:     now.UnixNano(),
+			TableVersion:  tableVersion,
+			CapacityBytes: t.capacity,
+			RequestRate:   requestRate,
+			ErrorRate:     errorRate,
+
+			ProtocolVersion: api.ProtocolVersion,
+			SoftwareVersion: build.Version,
+			Commit:          build.Commit,
+			Features:        build.Features,
+		}
+
+		if used, err := t.storage.GetUsedSpace(); err == nil {
+			hb.UsedBytes = used
+			hb.FreeBytes = hb.CapacityBytes - used
+			if hb.FreeBytes < 0 {
+				hb.FreeBytes = 0
+			}
+		} else {
+			n.logger.Warn("failed to measure used space", "target", t.id, "error", err)
+		}
+
+		written := t.written.Load()
+		if elapsed > 0 {
+			hb.WriteRate = float64(written-h.lastWritten[t.id]) / elapsed
+		}
+		h.lastWritten[t.id] = written
+
+		inflight, queued, maxInflight := t.service.SchedulerLoad()
+		hb.QueueDepth = queued
+		if maxInflight > 0 {
+			hb.IOUtilization = float64(inflight) / float64(maxInflight)
+		}
+
+		heartbeats = append(heartbeats, hb)
+	}
+
+	return heartbeats
+}
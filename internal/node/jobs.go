@@ -0,0 +1,531 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// Names of the node's background jobs
+const (
+	jobScrub       = "scrub"
+	jobGC          = "gc"
+	jobRepair      = "repair"
+	jobRebalance   = "rebalance"
+	jobFsck        = "fsck"
+	jobUsage       = "usage"
+	jobUsageExport = "usage-export"
+	jobDictionary  = "dictionary"
+	jobDedup       = "dedup"
+)
+
+const (
+	// DefaultMaxConcurrentJobs is the number of background jobs that may
+	// run at the same time
+	DefaultMaxConcurrentJobs = 2
+	// DefaultScrubInterval is how often every block is verified
+	DefaultScrubInterval = 24 * time.Hour
+	// DefaultGCInterval is how often files left by interrupted operations
+	// are collected
+	DefaultGCInterval = time.Hour
+	// DefaultDictionaryInterval is how often compression dictionaries are
+	// retrained
+	DefaultDictionaryInterval = 24 * time.Hour
+	// DefaultDedupInterval is how often blocks with the same content are
+	// made to share a copy
+	DefaultDedupInterval = 24 * time.Hour
+)
+
+// JobFunc runs one pass of a background job. Its disk and network traffic
+// should be paced by budget, which admits everything when the job has no
+// IO budget. The result is reported in the job's status.
+type JobFunc func(ctx context.Context, budget *ratelimit.Limiter) (interface{}, error)
+
+// JobSpec describes a background job and its default schedule, which the
+// jobs configuration may override
+type JobSpec struct {
+	Name string
+	// Interval is how often the job runs; zero only runs it on demand
+	Interval time.Duration
+	// Window restricts scheduled runs to a daily range of local time
+	Window *TimeWindow
+	// BandwidthBytes caps the job's traffic in bytes per second; zero
+	// means unlimited
+	BandwidthBytes int64
+	Run            JobFunc
+}
+
+// JobStatus reports the schedule and the last run of a background job
+type JobStatus struct {
+	Name    string `json:"name"`
+	Running bool   `json:"running"`
+	// Waiting is set while a run waits for another job to finish
+	Waiting         bool        `json:"waiting"`
+	IntervalSeconds int64       `json:"interval_seconds"`
+	Window          string      `json:"window,omitempty"`
+	BandwidthBytes  int64       `json:"bandwidth_bytes"`
+	Runs            int         `json:"runs"`
+	Failures        int         `json:"failures"`
+	LastStartedAt   int64       `json:"last_started_at,omitempty"`
+	LastFinishedAt  int64       `json:"last_finished_at,omitempty"`
+	NextRunAt       int64       `json:"next_run_at,omitempty"`
+	LastError       string      `json:"last_error,omitempty"`
+	LastResult      interface{} `json:"last_result,omitempty"`
+}
+
+// TimeWindow is a daily range of local time. A window whose end is before
+// its start wraps past midnight.
+type TimeWindow struct {
+	// Start and End are offsets from midnight
+	Start time.Duration
+	End   time.Duration
+}
+
+// ParseTimeWindow parses a window such as "22:00-06:00"
+func ParseTimeWindow(s string) (*TimeWindow, error) {
+	start, end, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("invalid time window %q: expected HH:MM-HH:MM", s)
+	}
+
+	var w TimeWindow
+	var err error
+	if w.Start, err = parseTimeOfDay(strings.TrimSpace(start)); err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %w", s, err)
+	}
+	if w.End, err = parseTimeOfDay(strings.TrimSpace(end)); err != nil {
+		return nil, fmt.Errorf("invalid time window %q: %w", s, err)
+	}
+	if w.Start == w.End {
+		return nil, fmt.Errorf("invalid time window %q: start and end are the same", s)
+	}
+	return &w, nil
+}
+
+// parseTimeOfDay parses HH:MM into an offset from midnight
+func parseTimeOfDay(s string) (time.Duration, error) {
+	hours, minutes, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	h, err := strconv.Atoi(hours)
+	if err != nil || h < 0 || h > 23 {
+		return 0, fmt.Errorf("invalid hour in %q", s)
+	}
+	m, err := strconv.Atoi(minutes)
+	if err != nil || m < 0 || m > 59 {
+		return 0, fmt.Errorf("invalid minute in %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// String formats the window as HH:MM-HH:MM
+func (w *TimeWindow) String() string {
+	format := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+	}
+	return format(w.Start) + "-" + format(w.End)
+}
+
+// midnight returns the start of the day of t
+func midnight(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+// Contains reports whether t falls within the window
+func (w *TimeWindow) Contains(t time.Time) bool {
+	offset := t.Sub(midnight(t))
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// Next returns t if it falls within the window, and otherwise the time the
+// window next opens
+func (w *TimeWindow) Next(t time.Time) time.Time {
+	if w.Contains(t) {
+		return t
+	}
+	open := midnight(t).Add(w.Start)
+	if open.Before(t) {
+		open = midnight(t).AddDate(0, 0, 1).Add(w.Start)
+	}
+	return open
+}
+
+// Close returns the time the window that contains t closes
+func (w *TimeWindow) Close(t time.Time) time.Time {
+	closes := midnight(t).Add(w.End)
+	if !closes.After(t) {
+		closes = midnight(t).AddDate(0, 0, 1).Add(w.End)
+	}
+	return closes
+}
+
+// job is a registered background job
+type job struct {
+	spec    JobSpec
+	budget  *ratelimit.Limiter
+	trigger chan struct{}
+	status  JobStatus
+}
+
+// jobScheduler runs the node's background jobs: each on its interval and
+// within its time window, on demand, and never more than a fixed number at
+// a time. Each job runs one pass at a time and paces its IO with its own
+// budget.
+type jobScheduler struct {
+	cfg       config.JobsConfig
+	overrides map[string]*TimeWindow
+	jobs      map[string]*job
+	slots     chan struct{}
+	ctx       context.Context
+	logger    *slog.Logger
+	mu        sync.Mutex
+}
+
+// newJobScheduler creates a scheduler from the jobs configuration. Jobs
+// are registered with register and run once start is called.
+func newJobScheduler(cfg config.JobsConfig, logger *slog.Logger) (*jobScheduler, error) {
+	overrides := make(map[string]*TimeWindow)
+	for name, jc := range cfg.Schedule {
+		if jc.Window == "" {
+			continue
+		}
+		window, err := ParseTimeWindow(jc.Window)
+		if err != nil {
+			return nil, fmt.Errorf("job %s: %w", name, err)
+		}
+		overrides[name] = window
+	}
+
+	concurrency := cfg.MaxConcurrent
+	if concurrency <= 0 {
+		concurrency = DefaultMaxConcurrentJobs
+	}
+
+	return &jobScheduler{
+		cfg:       cfg,
+		overrides: overrides,
+		jobs:      make(map[string]*job),
+		slots:     make(chan struct{}, concurrency),
+		logger:    logging.Component(logger, "jobs"),
+	}, nil
+}
+
+// register adds a job, applying the configured overrides to its defaults,
+// and returns the budget its runs are given. Jobs registered after start
+// begin running straight away.
+func (s *jobScheduler) register(spec JobSpec) *ratelimit.Limiter {
+	if jc, ok := s.cfg.Schedule[spec.Name]; ok {
+		if jc.Interval > 0 {
+			spec.Interval = time.Duration(jc.Interval)
+		} else if jc.Interval < 0 {
+			spec.Interval = 0
+		}
+		if window, ok := s.overrides[spec.Name]; ok {
+			spec.Window = window
+		}
+		if jc.Bandwidth > 0 {
+			spec.BandwidthBytes = int64(jc.Bandwidth)
+		}
+	}
+
+	// Bandwidth is capped in bytes per second, with one second of burst
+	rate := float64(spec.BandwidthBytes)
+	j := &job{
+		spec:    spec,
+		budget:  ratelimit.New(rate, int(rate)),
+		trigger: make(chan struct{}, 1),
+		status: JobStatus{
+			Name:            spec.Name,
+			IntervalSeconds: int64(spec.Interval / time.Second),
+			BandwidthBytes:  spec.BandwidthBytes,
+		},
+	}
+	if spec.Window != nil {
+		j.status.Window = spec.Window.String()
+	}
+
+	s.mu.Lock()
+	s.jobs[spec.Name] = j
+	ctx := s.ctx
+	s.mu.Unlock()
+
+	if ctx != nil {
+		go s.run(ctx, j)
+	}
+	return j.budget
+}
+
+// start runs the registered jobs until ctx is done
+func (s *jobScheduler) start(ctx context.Context) {
+	s.mu.Lock()
+	s.ctx = ctx
+	jobs := make([]*job, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		jobs = append(jobs, j)
+	}
+	s.mu.Unlock()
+
+	for _, j := range jobs {
+		go s.run(ctx, j)
+	}
+}
+
+// Trigger asks for a run of the named job as soon as a slot is free,
+// regardless of its time window. A trigger while the job is running
+// queues one more run.
+func (s *jobScheduler) Trigger(name string) error {
+	s.mu.Lock()
+	j, ok := s.jobs[name]
+	s.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown job %s", name)
+	}
+
+	select {
+	case j.trigger <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// SetBandwidth changes the IO budget of the named job, in bytes per second
+// with one second of burst. Zero means unlimited. A run in progress is
+// paced by the new budget from now on.
+func (s *jobScheduler) SetBandwidth(name string, bytes int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return fmt.Errorf("unknown job %s", name)
+	}
+
+	j.status.BandwidthBytes = bytes
+	j.budget.SetRate(float64(bytes), int(bytes))
+	return nil
+}
+
+// Status returns the status of the named job
+func (s *jobScheduler) Status(name string) (JobStatus, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[name]
+	if !ok {
+		return JobStatus{}, false
+	}
+	return j.status, true
+}
+
+// Statuses returns the status of every job, by name
+func (s *jobScheduler) Statuses() []JobStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	statuses := make([]JobStatus, 0, len(s.jobs))
+	for _, j := range s.jobs {
+		statuses = append(statuses, j.status)
+	}
+	sort.Slice(statuses, func(i, k int) bool { return statuses[i].Name < statuses[k].Name })
+	return statuses
+}
+
+// update applies fn to a job's status
+func (s *jobScheduler) update(j *job, fn func(*JobStatus)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fn(&j.status)
+}
+
+// nextRun returns when a job is next due after a run started at last, or
+// the zero time if it only runs on demand
+func (j *job) nextRun(last, now time.Time) time.Time {
+	if j.spec.Interval <= 0 {
+		return time.Time{}
+	}
+	next := last.Add(j.spec.Interval)
+	if next.Before(now) {
+		next = now
+	}
+	if j.spec.Window != nil {
+		next = j.spec.Window.Next(next)
+	}
+	return next
+}
+
+// run runs a job whenever it is due or triggered until ctx is done. The
+// first scheduled run is one interval after the scheduler starts, so that
+// restarts do not set off every job at once.
+func (s *jobScheduler) run(ctx context.Context, j *job) {
+	last := time.Now()
+	for {
+		var due <-chan time.Time
+		var timer *time.Timer
+		next := j.nextRun(last, time.Now())
+		if !next.IsZero() {
+			timer = time.NewTimer(time.Until(next))
+			due = timer.C
+		}
+		s.update(j, func(st *JobStatus) {
+			st.NextRunAt = 0
+			if !next.IsZero() {
+				st.NextRunAt = next.UnixNano()
+			}
+		})
+
+		forced := false
+		select {
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case <-j.trigger:
+			forced = true
+		case <-due:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if started, ok := s.execute(ctx, j, forced); ok {
+			last = started
+		}
+	}
+}
+
+// execute waits for a free slot and runs one pass of a job. A scheduled
+// pass is skipped if its window closed while it waited, and is stopped
+// when its window closes. It returns when the pass started and whether it
+// ran.
+func (s *jobScheduler) execute(ctx context.Context, j *job, forced bool) (time.Time, bool) {
+	s.update(j, func(st *JobStatus) { st.Waiting = true })
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		s.update(j, func(st *JobStatus) { st.Waiting = false })
+		return time.Time{}, false
+	}
+	defer func() { <-s.slots }()
+
+	started := time.Now()
+	window := j.spec.Window
+	if !forced && window != nil && !window.Contains(started) {
+		s.update(j, func(st *JobStatus) { st.Waiting = false })
+		return time.Time{}, false
+	}
+
+	runCtx := ctx
+	if !forced && window != nil {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithDeadline(ctx, window.Close(started))
+		defer cancel()
+	}
+
+	s.update(j, func(st *JobStatus) {
+		st.Waiting = false
+		st.Running = true
+		st.LastStartedAt = started.UnixNano()
+	})
+
+	result, err := j.spec.Run(runCtx, j.budget)
+	if ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		err = errors.New("stopped when its time window closed")
+	}
+
+	s.update(j, func(st *JobStatus) {
+		st.Running = false
+		st.Runs++
+		st.LastFinishedAt = time.Now().UnixNano()
+		st.LastResult = result
+		st.LastError = ""
+		if err != nil {
+			st.Failures++
+			st.LastError = err.Error()
+		}
+	})
+	if err != nil && ctx.Err() == nil {
+		s.logger.Warn("background job failed", "job", j.spec.Name, "error", err)
+	}
+
+	return started, true
+}
+
+// registerJobs registers the node's scrub, garbage collection, fsck,
+// usage, dictionary and dedup jobs. Repair and rebalancing are registered when the routing watcher and
+// the embedded coordinator start.
+func (n *StorageNode) registerJobs() {
+	n.jobs.register(JobSpec{
+		Name:           jobScrub,
+		Interval:       DefaultScrubInterval,
+		BandwidthBytes: int64(n.cfg.Storage.Tuning.ScrubBandwidth),
+		Run: func(ctx context.Context, budget *ratelimit.Limiter) (interface{}, error) {
+			return n.Scrub(ctx, budget)
+		},
+	})
+	n.jobs.register(JobSpec{
+		Name:     jobGC,
+		Interval: DefaultGCInterval,
+		Run: func(ctx context.Context, _ *ratelimit.Limiter) (interface{}, error) {
+			return n.CollectGarbage(ctx, gcGracePeriod)
+		},
+	})
+	n.jobs.register(JobSpec{
+		Name:           jobFsck,
+		BandwidthBytes: int64(n.cfg.Storage.Tuning.ScrubBandwidth),
+		Run: func(ctx context.Context, budget *ratelimit.Limiter) (interface{}, error) {
+			opts := DefaultFsckOptions()
+			if requested := n.fsckOptions.Swap(nil); requested != nil {
+				opts = *requested
+			}
+			return n.Fsck(ctx, budget, opts)
+		},
+	})
+	n.jobs.register(JobSpec{
+		Name:     jobUsage,
+		Interval: DefaultUsageMeasureInterval,
+		Run: func(ctx context.Context, _ *ratelimit.Limiter) (interface{}, error) {
+			return n.measureUsage(ctx)
+		},
+	})
+	if n.cfg.Storage.Compression.Dictionaries {
+		n.jobs.register(JobSpec{
+			Name:           jobDictionary,
+			Interval:       DefaultDictionaryInterval,
+			BandwidthBytes: int64(n.cfg.Storage.Tuning.ScrubBandwidth),
+			Run: func(ctx context.Context, budget *ratelimit.Limiter) (interface{}, error) {
+				return n.TrainDictionaries(ctx, budget)
+			},
+		})
+	}
+	if n.cfg.Storage.FeatureFlags.Enabled(config.FeatureDedup) {
+		n.jobs.register(JobSpec{
+			Name:           jobDedup,
+			Interval:       DefaultDedupInterval,
+			BandwidthBytes: int64(n.cfg.Storage.Tuning.ScrubBandwidth),
+			Run: func(ctx context.Context, budget *ratelimit.Limiter) (interface{}, error) {
+				return n.Dedup(ctx, budget)
+			},
+		})
+	}
+}
+
+// Jobs returns the status of the node's background jobs
+func (n *StorageNode) Jobs() []JobStatus {
+	return n.jobs.Statuses()
+}
@@ -0,0 +1,132 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// DefaultJoinTimeout bounds the whole join flow, including the data sync
+const DefaultJoinTimeout = 30 * time.Minute
+
+// advertiseAddress returns the data address other nodes should use
+func (n *StorageNode) advertiseAddress() string {
+	if addr := n.cfg.Storage.Node.AdvertiseAddress; addr != "" {
+		return addr
+	}
+	return n.cfg.Storage.Node.ListenAddress
+}
+
+// dialPeer connects to another node's data port with this node's
+// credentials
+func (n *StorageNode) dialPeer(address string) (*client.Client, error) {
+	return client.DialWithOptions(address, n.peerOptions)
+}
+
+// join registers this node's targets with the coordinator, receives their
+// chain assignments, and copies the blocks of those chains from the other
+// chain members before the node starts serving
+func (n *StorageNode) join() error {
+	cfg := n.cfg.Storage
+	if len(cfg.Coordinator.Addresses) == 0 {
+		return errors.New("joining a cluster requires coordinator.addresses")
+	}
+
+	coord, err := coordinator.NewClient(cfg.Coordinator.Addresses)
+	if err != nil {
+		return fmt.Errorf("failed to create coordinator client: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(n.ctx, DefaultJoinTimeout)
+	defer cancel()
+
+	var table *api.RoutingTable
+	for _, record := range n.targetRecords() {
+		if table, err = coord.AddNode(ctx, record); err != nil {
+			return fmt.Errorf("failed to join cluster: %w", err)
+		}
+	}
+
+	chains := 0
+	for _, t := range n.targets {
+		chains += len(assignedChains(table, t.id))
+	}
+	n.logger.Info("joined cluster", "routing_version", table.Version, "chains", chains)
+
+	copied, err := n.reconcile(ctx, table)
+	if err != nil {
+		return fmt.Errorf("failed to sync assigned blocks: %w", err)
+	}
+
+	n.logger.Info("initial sync complete", "blocks_copied", copied)
+	return nil
+}
+
+// assignedChains returns the chains a node is a member of
+func assignedChains(table *api.RoutingTable, nodeID string) []*api.ChainRecord {
+	chains := make([]*api.ChainRecord, 0)
+	for _, chain := range table.Chains {
+		for _, member := range chain.Members {
+			if member == nodeID {
+				chains = append(chains, chain)
+				break
+			}
+		}
+	}
+	return chains
+}
+
+// isMember reports whether nodeID is a member of the chain
+func isMember(chain *api.ChainRecord, nodeID string) bool {
+	if chain == nil {
+		return false
+	}
+	for _, member := range chain.Members {
+		if member == nodeID {
+			return true
+		}
+	}
+	return false
+}
+
+// hasBlock reports whether a block with the given checksum is stored on the
+// target
+func (t *target) hasBlock(blockID, checksum string) bool {
+	exists, metadataBytes, err := t.storage.ReadBlockMetadata(blockID)
+	if err != nil || !exists {
+		return false
+	}
+
+	var metadata storage.BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return false
+	}
+	return metadata.Checksum == checksum
+}
+
+// storeReplica writes a block copied from a peer directly to the target's
+// storage, preserving the peer's metadata
+func (t *target) storeReplica(blockID string, data []byte, stat *api.BlockStat) error {
+	metadataBytes, err := json.Marshal(&storage.BlockMetadata{
+		Checksum:     stat.Checksum,
+		Size:         stat.Size,
+		Version:      stat.Version,
+		CreatedAt:    stat.CreatedAt,
+		LastModified: stat.LastModified,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to marshal block metadata: %w", err)
+	}
+
+	if err := t.storage.WriteBlock(blockID, data, metadataBytes); err != nil {
+		return fmt.Errorf("failed to store block %s: %w", blockID, err)
+	}
+	return nil
+}
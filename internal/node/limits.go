@@ -0,0 +1,241 @@
+package node
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// quotaIdleTimeout is how long the quota of a client without connections
+// is kept, so that reconnecting does not reset its rate limits
+const quotaIdleTimeout = 10 * time.Minute
+
+// quotaBreachInterval is the least time between two reports of a client
+// breaching its limits
+const quotaBreachInterval = time.Minute
+
+// clientQuota tracks the usage of one client identity
+type clientQuota struct {
+	limits    config.ClientLimits
+	requests  *ratelimit.Limiter
+	bandwidth *ratelimit.Limiter
+	conns     int
+	throttled uint64
+	rejected  uint64
+	lastSeen  time.Time
+	// reportedAt is when the client was last reported breaching its limits
+	reportedAt time.Time
+}
+
+// ClientQuotaStats reports the usage of one client identity
+type ClientQuotaStats struct {
+	Identity            string  `json:"identity"`
+	Connections         int     `json:"connections"`
+	MaxConnections      int     `json:"max_connections"`
+	RequestsPerSecond   float64 `json:"requests_per_second"`
+	BandwidthBytes      int64   `json:"bandwidth_bytes"`
+	ThrottledRequests   uint64  `json:"throttled_requests"`
+	RejectedConnections uint64  `json:"rejected_connections"`
+}
+
+// clientLimiter enforces per-client request rates, bandwidth and
+// connection counts. Clients are identified by source IP unless a stronger
+// identity is available. Blocks fetched by other nodes share one peer
+// bandwidth budget.
+type clientLimiter struct {
+	defaults  config.ClientLimits
+	overrides map[string]config.ClientLimits
+	clients   map[string]*clientQuota
+	peer      *ratelimit.Limiter
+	lastPrune time.Time
+	mu        sync.Mutex
+}
+
+// newClientLimiter creates a limiter from the limits configuration
+func newClientLimiter(cfg config.LimitsConfig) *clientLimiter {
+	peer := float64(cfg.PeerBandwidth)
+	return &clientLimiter{
+		defaults:  cfg.Default,
+		overrides: cfg.Clients,
+		clients:   make(map[string]*clientQuota),
+		peer:      ratelimit.New(peer, int(peer)),
+		lastPrune: time.Now(),
+	}
+}
+
+// update applies a new limits configuration. Known clients keep their
+// connections and counters and are held to their new limits from now on.
+func (l *clientLimiter) update(cfg config.LimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.defaults = cfg.Default
+	l.overrides = cfg.Clients
+	for identity, q := range l.clients {
+		limits := l.limitsOf(identity)
+		bandwidth := float64(limits.Bandwidth)
+		q.limits = limits
+		q.requests.SetRate(limits.RequestsPerSecond, int(limits.RequestsPerSecond))
+		q.bandwidth.SetRate(bandwidth, int(bandwidth))
+	}
+
+	peer := float64(cfg.PeerBandwidth)
+	l.peer.SetRate(peer, int(peer))
+}
+
+// limitsOf returns the limits that apply to an identity. Must be called
+// with the lock held.
+func (l *clientLimiter) limitsOf(identity string) config.ClientLimits {
+	if override, ok := l.overrides[identity]; ok {
+		return override
+	}
+	return l.defaults
+}
+
+// quota returns the quota of an identity, creating it on first use. Must be
+// called with the lock held.
+func (l *clientLimiter) quota(identity string) *clientQuota {
+	if q, ok := l.clients[identity]; ok {
+		return q
+	}
+
+	limits := l.limitsOf(identity)
+	bandwidth := float64(limits.Bandwidth)
+	q := &clientQuota{
+		limits:    limits,
+		requests:  ratelimit.New(limits.RequestsPerSecond, int(limits.RequestsPerSecond)),
+		bandwidth: ratelimit.New(bandwidth, int(bandwidth)),
+		lastSeen:  time.Now(),
+	}
+	l.clients[identity] = q
+	return q
+}
+
+// prune forgets idle clients. Must be called with the lock held.
+func (l *clientLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < time.Minute {
+		return
+	}
+	l.lastPrune = now
+
+	for identity, q := range l.clients {
+		if q.conns == 0 && now.Sub(q.lastSeen) > quotaIdleTimeout {
+			delete(l.clients, identity)
+		}
+	}
+}
+
+// openConn admits a new connection from identity, returning false if the
+// client is at its connection limit
+func (l *clientLimiter) openConn(identity string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.prune(now)
+
+	q := l.quota(identity)
+	q.lastSeen = now
+	if q.limits.MaxConnections > 0 && q.conns >= q.limits.MaxConnections {
+		q.rejected++
+		return false
+	}
+	q.conns++
+	return true
+}
+
+// closeConn releases a connection admitted by openConn
+func (l *clientLimiter) closeConn(identity string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if q, ok := l.clients[identity]; ok {
+		q.conns--
+		q.lastSeen = time.Now()
+	}
+}
+
+// allowRequest consumes one request from the client's rate, returning
+// false if the client is over its limit
+func (l *clientLimiter) allowRequest(identity string) bool {
+	l.mu.Lock()
+	q := l.quota(identity)
+	q.lastSeen = time.Now()
+	l.mu.Unlock()
+
+	if q.requests.AllowN(1) {
+		return true
+	}
+
+	l.mu.Lock()
+	q.throttled++
+	l.mu.Unlock()
+	return false
+}
+
+// waitBandwidth delays the client until n bytes fit within its bandwidth
+func (l *clientLimiter) waitBandwidth(ctx context.Context, identity string, n int) error {
+	l.mu.Lock()
+	q := l.quota(identity)
+	l.mu.Unlock()
+
+	return q.bandwidth.WaitN(ctx, n)
+}
+
+// waitPeerBandwidth delays a block fetch by another node until n bytes fit
+// within the peer bandwidth
+func (l *clientLimiter) waitPeerBandwidth(ctx context.Context, n int) error {
+	return l.peer.WaitN(ctx, n)
+}
+
+// reportBreach reports whether a client's breach of its limits is to be
+// reported, which it is at most once per quotaBreachInterval
+func (l *clientLimiter) reportBreach(identity string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	q := l.quota(identity)
+	now := time.Now()
+	if now.Sub(q.reportedAt) < quotaBreachInterval {
+		return false
+	}
+	q.reportedAt = now
+	return true
+}
+
+// stats reports every known client, sorted by identity
+func (l *clientLimiter) stats() []ClientQuotaStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	stats := make([]ClientQuotaStats, 0, len(l.clients))
+	for identity, q := range l.clients {
+		stats = append(stats, ClientQuotaStats{
+			Identity:            identity,
+			Connections:         q.conns,
+			MaxConnections:      q.limits.MaxConnections,
+			RequestsPerSecond:   q.limits.RequestsPerSecond,
+			BandwidthBytes:      int64(q.limits.Bandwidth),
+			ThrottledRequests:   q.throttled,
+			RejectedConnections: q.rejected,
+		})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Identity < stats[j].Identity
+	})
+	return stats
+}
+
+// remoteIdentity identifies a client by the IP address of its connection
+func remoteIdentity(conn net.Conn) string {
+	host, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return host
+}
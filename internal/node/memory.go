@@ -0,0 +1,79 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/3fs-storage/internal/memory"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// transportConsumer names the data of requests and responses in the
+// memory budget
+const transportConsumer = "transport"
+
+// newMemoryBudget creates the node's memory budget when memory_limit is
+// set, and takes the targets' block caches from it
+func newMemoryBudget(tuning config.TuningConfig, targets []*target) (*memory.Budget, error) {
+	if tuning.MemoryLimit == 0 {
+		return nil, nil
+	}
+	budget, err := memory.NewBudget(int64(tuning.MemoryLimit))
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		t.storage.SetMemoryBudget(budget)
+	}
+	return budget, nil
+}
+
+// readAdmitted reads a client's request, reserving its data in the memory
+// budget from the length in the frame header before the payload is read,
+// and waiting up to memory_wait for the caches to shrink or other requests
+// to finish. A request the budget cannot hold has its payload skipped, so
+// the stream stays in step, and is returned with an error wrapping
+// api.ErrBackpressure. Otherwise the caller must release len(req.Data)
+// once done with the request, as serveAdmitted does.
+func (n *StorageNode) readAdmitted(r io.Reader) (*api.Request, error) {
+	var req api.Request
+	size, err := api.ReadFrameHeader(r, &req)
+	if err != nil {
+		return nil, err
+	}
+
+	if n.memory != nil && size > 0 {
+		ctx, cancel := context.WithTimeout(n.ctx, time.Duration(n.cfg.Storage.Tuning.MemoryWait))
+		err := n.memory.Reserve(ctx, transportConsumer, int64(size))
+		cancel()
+		if err != nil {
+			if _, skipErr := io.CopyN(io.Discard, r, int64(size)); skipErr != nil {
+				return nil, fmt.Errorf("failed to skip frame data: %w", skipErr)
+			}
+			return &req, fmt.Errorf("failed to admit request: %w: %w", api.ErrBackpressure, err)
+		}
+	}
+
+	if req.Data, err = api.ReadFrameData(r, size); err != nil {
+		n.memory.Release(transportConsumer, int64(size))
+		return nil, err
+	}
+	return &req, nil
+}
+
+// serveAdmitted serves a request read by readAdmitted on the data port's
+// workers. The response's data is charged to the budget as well. The
+// returned function gives back both the request's and the response's data
+// once the response is written.
+func (n *StorageNode) serveAdmitted(cc *clientConn, req *api.Request) (*api.Response, func()) {
+	var resp *api.Response
+	if err := n.netWorkers.Run(n.ctx, func() { resp = n.serveClient(cc, req) }); err != nil {
+		resp = n.redirect(req, "node is shutting down")
+	}
+	size := int64(len(req.Data) + len(resp.Data))
+	n.memory.Charge(transportConsumer, int64(len(resp.Data)))
+	return resp, func() { n.memory.Release(transportConsumer, size) }
+}
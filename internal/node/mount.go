@@ -0,0 +1,181 @@
+package node
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/3fs-storage/pkg/config"
+)
+
+// mountsFile lists the mounted filesystems of the process
+const mountsFile = "/proc/self/mounts"
+
+// mount is one entry of the mount table
+type mount struct {
+	device string
+	point  string
+	fsType string
+}
+
+// mountExpectation is what a target requires of the filesystem under its
+// data path, so that blocks never land on the root filesystem of a node
+// whose disk failed to mount
+type mountExpectation struct {
+	required bool
+	fsType   string
+	device   string
+}
+
+// expectMount returns the mount expectation of a target's configuration
+func expectMount(tc config.TargetConfig) mountExpectation {
+	return mountExpectation{required: tc.RequireMount, fsType: tc.FSType, device: tc.Device}
+}
+
+// enabled reports whether the expectation checks anything
+func (e mountExpectation) enabled() bool {
+	return e.required || e.fsType != "" || e.device != ""
+}
+
+// check returns an error if the filesystem holding path does not meet the
+// expectation
+func (e mountExpectation) check(path string) error {
+	if !e.enabled() {
+		return nil
+	}
+
+	mounts, err := readMounts()
+	if err != nil {
+		return err
+	}
+	resolved, err := resolveExisting(path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve data path: %w", err)
+	}
+	m, ok := mountOf(mounts, resolved)
+	if !ok {
+		return fmt.Errorf("no filesystem is mounted at %s", path)
+	}
+
+	if e.required && m.point == "/" {
+		return fmt.Errorf("%s is on the root filesystem, expected a mounted disk", path)
+	}
+	if e.fsType != "" && m.fsType != e.fsType {
+		return fmt.Errorf("%s is on a %s filesystem at %s, expected %s", path, m.fsType, m.point, e.fsType)
+	}
+	if e.device != "" && !sameDevice(m.device, e.device) {
+		return fmt.Errorf("%s is on %s mounted at %s, expected %s", path, m.device, m.point, e.device)
+	}
+	return nil
+}
+
+// readMounts reads the mount table
+func readMounts() ([]mount, error) {
+	f, err := os.Open(mountsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the mount table: %w", err)
+	}
+	defer f.Close()
+
+	mounts := make([]mount, 0)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 {
+			continue
+		}
+		mounts = append(mounts, mount{
+			device: unescapeMount(fields[0]),
+			point:  unescapeMount(fields[1]),
+			fsType: fields[2],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read the mount table: %w", err)
+	}
+	return mounts, nil
+}
+
+// unescapeMount decodes the octal escapes the mount table uses for spaces,
+// tabs and backslashes
+func unescapeMount(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+4 <= len(s) {
+			if c, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// mountOf returns the mount holding path: the last mounted of those with
+// the longest mount point that contains it
+func mountOf(mounts []mount, path string) (mount, bool) {
+	var found mount
+	ok := false
+	for _, m := range mounts {
+		if !within(path, m.point) {
+			continue
+		}
+		if !ok || len(m.point) >= len(found.point) {
+			found, ok = m, true
+		}
+	}
+	return found, ok
+}
+
+// within reports whether path is dir or lies under it
+func within(path, dir string) bool {
+	if dir == "/" || path == dir {
+		return true
+	}
+	return strings.HasPrefix(path, dir+"/")
+}
+
+// resolveExisting resolves the symlinks of path, or of its closest existing
+// parent when it has not been created yet
+func resolveExisting(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return "", err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+// sameDevice reports whether a mounted device is the expected one, which
+// may be named through a link such as /dev/disk/by-uuid/...
+func sameDevice(mounted, expected string) bool {
+	if mounted == expected {
+		return true
+	}
+	a, errA := filepath.EvalSymlinks(mounted)
+	b, errB := filepath.EvalSymlinks(expected)
+	return errA == nil && errB == nil && a == b
+}
@@ -1,71 +1,139 @@
 package node
 
 import (
+	"bufio"
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/affinity"
+	"github.com/3fs-storage/internal/audit"
+	"github.com/3fs-storage/internal/auth"
+	"github.com/3fs-storage/internal/cdc"
+	"github.com/3fs-storage/internal/coordinator"
 	"github.com/3fs-storage/internal/craq"
+	"github.com/3fs-storage/internal/discovery"
+	"github.com/3fs-storage/internal/gateway"
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/internal/memory"
+	"github.com/3fs-storage/internal/notify"
 	"github.com/3fs-storage/internal/rdma"
-	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/internal/ring"
+	"github.com/3fs-storage/internal/usage"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
 	"github.com/3fs-storage/pkg/config"
 )
 
 // StorageNode represents a node in the storage service cluster
 type StorageNode struct {
 	cfg           *config.Config
-	blockService  *block.Service
+	targets       []*target
+	targetRing    *ring.Ring
 	craqChain     *craq.Chain
 	rdmaTransport *rdma.Transport
-	localStorage  *storage.LocalStorage
-	
-	listener      net.Listener
-	isRunning     bool
-	mu            sync.Mutex
-	ctx           context.Context
-	cancel        context.CancelFunc
+	logger        *slog.Logger
+
+	listener    net.Listener
+	admin       *adminServer
+	gateway     *gateway.Server
+	registrar   *discovery.Registrar
+	coordinator *coordinator.Coordinator
+	election    *coordinator.Election
+	detector    *coordinator.FailureDetector
+	routing     *coordinator.Watcher
+	repair      *repairController
+	jobs        *jobScheduler
+	requests    requestTracker
+	connections atomic.Int64
+	served      atomic.Uint64
+	ops         opTracker
+	failed      atomic.Uint64
+	peerTraffic peerTraffic
+	events      eventHub
+	limits      *clientLimiter
+	auth        *auth.Authenticator
+	acl         *auth.ACL
+	audit       *audit.Log
+	peerOptions client.Options
+	writePeers  writePeers
+	erasure     erasureCoder
+	geo         *geoReplication
+	meter       *usage.Meter
+	notifier    *notify.Notifier
+	cdc         *cdc.Log
+	cacheNode   *cacheNode
+	writeBack   *writeBack
+	netWorkers  *affinity.Pool
+	memory      *memory.Budget
+	reloads     atomic.Pointer[config.Watcher]
+	fsckOptions atomic.Pointer[FsckOptions]
+	maintenance atomic.Bool
+	ready       atomic.Bool
+
+	readOnly        atomic.Bool
+	readOnlyState   ReadOnlyState
+	readOnlyMu      sync.Mutex
+	decommissioning atomic.Bool
+	decommission    DecommissionStatus
+	decommissionMu  sync.Mutex
+	recovery        RecoveryStatus
+	recoveryMu      sync.Mutex
+	tunablesMu      sync.Mutex
+
+	isRunning bool
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
 }
 
 // NewStorageNode creates a new storage node with the provided configuration
-func NewStorageNode(cfg *config.Config) (*StorageNode, error) {
+func NewStorageNode(cfg *config.Config, logger *slog.Logger) (*StorageNode, error) {
 	if cfg == nil {
 		return nil, errors.New("configuration cannot be nil")
 	}
+	if logger == nil {
+		logger = logging.Discard()
+	}
+	logger = logger.With("node", cfg.Storage.Node.ID)
 
 	ctx, cancel := context.WithCancel(context.Background())
-	
-	// Initialize local storage
-	localStorage, err := storage.NewLocalStorage(cfg.Storage.Local.DataPath, cfg.Storage.Local.MaxSpaceGB)
-	if err != nil {
-		cancel()
-		return nil, fmt.Errorf("failed to initialize local storage: %w", err)
-	}
-	
-	// Initialize RDMA transport (if available)
+
+	// Initialize RDMA transport (if enabled and available)
 	var rdmaTransport *rdma.Transport
-	rdmaTransport, err = rdma.NewTransport(ctx)
-	if err != nil {
-		// Fall back to TCP if RDMA is not available
-		fmt.Printf("Warning: RDMA not available, falling back to TCP: %v\n", err)
-		rdmaTransport = nil
+	if cfg.Storage.FeatureFlags.Enabled(config.FeatureRDMA) {
+		var err error
+		rdmaTransport, err = rdma.NewTransport(ctx, logger)
+		if err != nil {
+			// Fall back to TCP if RDMA is not available
+			logger.Warn("RDMA not available, falling back to TCP", "error", err)
+			rdmaTransport = nil
+		}
+	}
+	if features := cfg.Storage.FeatureFlags.List(); len(features) > 0 {
+		logger.Info("experimental features enabled", "features", features)
 	}
-	
+
 	// Initialize CRAQ chain
-	craqChain, err := craq.NewChain(cfg.Storage.Replication.ChainLength, cfg.Storage.Replication.Factor)
+	craqChain, err := craq.NewChain(cfg.Storage.Replication.ChainLength, cfg.Storage.Replication.Factor, logger)
 	if err != nil {
 		cancel()
 		return nil, fmt.Errorf("failed to initialize CRAQ chain: %w", err)
 	}
-	
+
 	// Add this node to the chain
 	if err := craqChain.AddNode(cfg.Storage.Node.ID, cfg.Storage.Node.ListenAddress); err != nil {
 		cancel()
 		return nil, fmt.Errorf("failed to add node to CRAQ chain: %w", err)
 	}
-	
+
 	// Add other nodes from the configuration
 	for _, nodeInfo := range cfg.Storage.Cluster.Nodes {
 		if nodeInfo.ID != cfg.Storage.Node.ID {
@@ -75,20 +143,68 @@ func NewStorageNode(cfg *config.Config) (*StorageNode, error) {
 			}
 		}
 	}
-	
-	// Initialize block service
-	blockService, err := block.NewService(localStorage, craqChain)
+
+	// Initialize local storage and a block service for each storage target
+	targets, err := newTargets(cfg, craqChain, logger)
 	if err != nil {
 		cancel()
-		return nil, fmt.Errorf("failed to initialize block service: %w", err)
+		return nil, fmt.Errorf("failed to initialize local storage: %w", err)
 	}
-	
+
+	// Share one memory budget among the block caches and the buffers of
+	// requests and writes, if one is configured
+	budget, err := newMemoryBudget(cfg.Storage.Tuning, targets)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize memory budget: %w", err)
+	}
+
+	// Initialize client authentication and the credentials used for peers
+	authenticator, err := auth.New(cfg.Storage.Auth, nil)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize authentication: %w", err)
+	}
+	acl, err := auth.NewACL(cfg.Storage.ACL)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize ACL: %w", err)
+	}
+	peerTLS, err := auth.ClientTLSConfig(cfg.Storage.Auth.TLS)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize peer TLS: %w", err)
+	}
+
+	// Initialize the scheduler of background jobs
+	jobs, err := newJobScheduler(cfg.Storage.Jobs, logger)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize background jobs: %w", err)
+	}
+
+	// Publish cluster events to the configured sinks
+	notifier, err := notify.New(cfg.Storage.Events, cfg.Storage.Node.ID, logger)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to initialize event sinks: %w", err)
+	}
+
 	return &StorageNode{
 		cfg:           cfg,
-		blockService:  blockService,
+		targets:       targets,
+		targetRing:    newTargetRing(targets),
 		craqChain:     craqChain,
 		rdmaTransport: rdmaTransport,
-		localStorage:  localStorage,
+		limits:        newClientLimiter(cfg.Storage.Limits),
+		auth:          authenticator,
+		acl:           acl,
+		peerOptions:   client.Options{TLS: peerTLS, Token: cfg.Storage.Auth.PeerToken},
+		jobs:          jobs,
+		meter:         usage.NewMeter(),
+		memory:        budget,
+		notifier:      notifier,
+		logger:        logging.Component(logger, "node"),
 		ctx:           ctx,
 		cancel:        cancel,
 	}, nil
@@ -98,23 +214,60 @@ func NewStorageNode(cfg *config.Config) (*StorageNode, error) {
 func (n *StorageNode) Start() error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	
+
 	if n.isRunning {
 		return errors.New("node is already running")
 	}
-	
-	// Initialize local storage
-	if err := n.localStorage.Initialize(); err != nil {
-		return fmt.Errorf("failed to initialize local storage: %w", err)
+
+	// Initialize local storage and block services
+	if err := n.initializeTargets(); err != nil {
+		return err
 	}
-	
-	// Initialize block service
-	if err := n.blockService.Initialize(); err != nil {
-		return fmt.Errorf("failed to initialize block service: %w", err)
+	n.registerJobs()
+
+	// Record admin operations and client deletes
+	if err := n.openAuditLog(); err != nil {
+		return err
+	}
+
+	// Restore read-only mode if it was left enabled
+	if err := n.loadReadOnly(); err != nil {
+		return err
+	}
+
+	// Start the embedded coordinator first, so that recovery can consult it
+	if n.cfg.Storage.Coordinator.Enabled {
+		if err := n.startCoordinator(); err != nil {
+			return err
+		}
+	}
+
+	// Join the cluster, or catch up after a restart, before serving
+	if err := n.recoverState(); err != nil {
+		return err
+	}
+
+	// Serve reads from the block cache on a cache node
+	if n.cfg.Storage.Node.Role == api.RoleCache {
+		if err := n.startCacheNode(); err != nil {
+			return err
+		}
 	}
-	
+
+	// Open the write-back buffer before serving, so that no write bypasses
+	// the writes it still holds
+	if err := n.startWriteBack(); err != nil {
+		return err
+	}
+
+	// Pin the request and disk workers before serving
+	if err := n.startAffinity(); err != nil {
+		return err
+	}
+
 	// Start RDMA transport if available
 	if n.rdmaTransport != nil {
+		n.rdmaTransport.SetHandler(n.handleConnection)
 		if err := n.rdmaTransport.Start(n.cfg.Storage.Node.ListenAddress); err != nil {
 			return fmt.Errorf("failed to start RDMA transport: %w", err)
 		}
@@ -125,13 +278,85 @@ func (n *StorageNode) Start() error {
 		if err != nil {
 			return fmt.Errorf("failed to start TCP listener: %w", err)
 		}
-		
+
 		// Start accepting connections
 		go n.acceptConnections()
 	}
-	
+
+	// Start the admin API if configured
+	if addr := n.cfg.Storage.Admin.ListenAddress; addr != "" {
+		n.admin = newAdminServer(n)
+		if err := n.admin.start(addr); err != nil {
+			return fmt.Errorf("failed to start admin API: %w", err)
+		}
+	}
+
+	// Journal the writes to ship to a remote cluster before serving any
+	if err := n.startGeoReplication(); err != nil {
+		return err
+	}
+
+	// Open the change log before serving any write
+	if err := n.startCDC(); err != nil {
+		return err
+	}
+
+	// Flush buffered writes once they are journaled and logged like others
+	if n.writeBack != nil {
+		go n.flushWriteBackLoop(n.ctx)
+	}
+
+	// Start the S3 gateway if configured
+	if n.cfg.Storage.Gateway.ListenAddress != "" {
+		if err := n.startGateway(); err != nil {
+			return err
+		}
+	}
+
+	// Elect a coordinator leader once peers can reach the election API
+	if n.election != nil {
+		go n.election.Run(n.ctx)
+	}
+
+	// Follow routing table updates from the coordinator
+	if err := n.startRoutingWatcher(); err != nil {
+		return err
+	}
+
+	// Report capacity and load to the coordinator
+	if err := n.startHeartbeats(); err != nil {
+		return err
+	}
+
+	// Report the use of each namespace to the coordinator
+	if err := n.startUsageReports(); err != nil {
+		return err
+	}
+	// Detect failed nodes from the heartbeats the coordinator receives
+	if n.detector != nil {
+		go n.detector.Run(n.ctx)
+	}
+
+	// Register with service discovery once the node can serve requests
+	if n.cfg.Storage.Discovery.Backend != "" {
+		if err := n.startRegistrar(); err != nil {
+			return err
+		}
+	}
+
+	// Watch for failing disks
+	go n.checkTargets(n.ctx)
+
+	// Log node stats periodically
+	go n.logStats(n.ctx)
+
+	// Run scrub, garbage collection, repair and rebalancing in the
+	// background
+	n.jobs.start(n.ctx)
+
 	n.isRunning = true
-	
+	n.ready.Store(true)
+
 	return nil
 }
 
@@ -139,33 +364,101 @@ func (n *StorageNode) Start() error {
 func (n *StorageNode) Stop() error {
 	n.mu.Lock()
 	defer n.mu.Unlock()
-	
+
 	if !n.isRunning {
 		return errors.New("node is not running")
 	}
-	
+
+	n.ready.Store(false)
+
+	// Deregister first so that clients stop discovering the node
+	if n.registrar != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := n.registrar.Stop(ctx); err != nil {
+			n.logger.Warn("failed to deregister from service discovery", "error", err)
+		}
+		cancel()
+	}
+
+	// Stop accepting new connections and requests, then give in-flight
+	// requests and chain propagations a bounded time to complete
+	n.drain()
+
 	// Cancel the context to stop background operations
 	n.cancel()
-	
+
+	// Stop the S3 gateway
+	if n.gateway != nil {
+		if err := n.gateway.Stop(); err != nil {
+			return fmt.Errorf("failed to stop gateway: %w", err)
+		}
+	}
+
+	// Stop the admin API
+	if n.admin != nil {
+		if err := n.admin.stop(); err != nil {
+			return fmt.Errorf("failed to stop admin API: %w", err)
+		}
+	}
+
 	// Stop RDMA transport if available
 	if n.rdmaTransport != nil {
 		if err := n.rdmaTransport.Stop(); err != nil {
 			return fmt.Errorf("failed to stop RDMA transport: %w", err)
 		}
 	} else if n.listener != nil {
-		// Close TCP listener if used
-		if err := n.listener.Close(); err != nil {
+		// Close TCP listener if used; draining has normally closed it already
+		if err := n.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			return fmt.Errorf("failed to close TCP listener: %w", err)
 		}
 	}
-	
+
+	// Flush what the write-back buffer still holds while writes are
+	// journaled and logged
+	n.stopWriteBack()
+
+	// Close the geo-replication journal now that nothing writes
+	n.stopGeoReplication()
+
+	// Close the change log now that nothing writes
+	n.stopCDC()
+
+	// Stop following change logs now that nothing reads
+	n.stopCacheNode()
+
+	// Persist the usage the embedded coordinator added up
+	if n.coordinator != nil {
+		if err := n.coordinator.FlushUsage(); err != nil {
+			n.logger.Warn("failed to persist usage ledger", "error", err)
+		}
+	}
+
+	// Stop the pinned workers now that no requests run
+	n.stopAffinity()
+
 	// Flush local storage
-	if err := n.localStorage.Flush(); err != nil {
-		return fmt.Errorf("failed to flush local storage: %w", err)
+	for _, t := range n.targets {
+		if err := t.storage.Flush(); err != nil {
+			return fmt.Errorf("failed to flush storage target %s: %w", t.id, err)
+		}
+		if err := t.storage.Close(); err != nil {
+			return fmt.Errorf("failed to close storage target %s: %w", t.id, err)
+		}
+	}
+
+	n.writePeers.close()
+
+	if err := n.audit.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log: %w", err)
+	}
+
+	// Give the event sinks a moment to be sent the last events
+	if err := n.notifier.Close(); err != nil {
+		n.logger.Warn("failed to close event sinks", "error", err)
 	}
-	
+
 	n.isRunning = false
-	
+
 	return nil
 }
 
@@ -175,26 +468,132 @@ func (n *StorageNode) acceptConnections() {
 		conn, err := n.listener.Accept()
 		if err != nil {
 			// Check if we're shutting down
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
 			select {
 			case <-n.ctx.Done():
 				return
 			default:
-				fmt.Printf("Error accepting connection: %v\n", err)
+				n.logger.Error("failed to accept connection", "error", err)
 				continue
 			}
 		}
-		
+
 		go n.handleConnection(conn)
 	}
 }
 
-// handleConnection handles an incoming TCP connection
+// handleConnection serves framed requests on an incoming connection until
+// the peer disconnects, sends a malformed frame, or the node stops
 func (n *StorageNode) handleConnection(conn net.Conn) {
 	defer conn.Close()
-	
-	// In a real implementation, we would handle protocol-specific commands
-	// For this mock implementation, we'll just close the connection
-	fmt.Printf("Received connection from %s\n", conn.RemoteAddr().String())
+
+	// Secure the connection and identify the client by its certificate
+	cc := &clientConn{key: remoteIdentity(conn), remote: conn.RemoteAddr().String(), identity: auth.Anonymous()}
+	if tlsConfig := n.auth.TLSConfig(); tlsConfig != nil {
+		tlsConn := tls.Server(conn, tlsConfig)
+		tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		if err := tlsConn.Handshake(); err != nil {
+			n.logger.Warn("TLS handshake failed", "remote", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		state := tlsConn.ConnectionState()
+		cc.identity = n.auth.ConnIdentity(&state)
+		if !cc.identity.IsAnonymous() {
+			cc.key = cc.identity.Name
+		}
+		conn = tlsConn
+		defer conn.Close()
+	}
+
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	// Enforce the client's connection quota
+	if !n.limits.openConn(cc.key) {
+		n.reportQuotaBreach(cc.key, "connections")
+		api.WriteResponse(writer, &api.Response{Status: api.StatusThrottled, Error: "too many connections", Code: api.CodeQuotaExceeded})
+		writer.Flush()
+		return
+	}
+	defer n.limits.closeConn(cc.key)
+	n.connections.Add(1)
+	defer n.connections.Add(-1)
+
+	// Unblock the request loop when the node shuts down
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-n.ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	for {
+		req, err := n.readAdmitted(reader)
+		if errors.Is(err, api.ErrBackpressure) {
+			// The payload was skipped, so the connection can carry on
+			resp := errorResponse(err)
+			resp.ID = req.ID
+			n.served.Add(1)
+			n.failed.Add(1)
+			err = api.WriteResponse(writer, resp)
+			if err == nil {
+				err = writer.Flush()
+			}
+			if err != nil {
+				n.logger.Warn("failed to write response", "remote", conn.RemoteAddr().String(), "error", err)
+				return
+			}
+			continue
+		}
+		if err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				n.logger.Warn("failed to read request", "remote", conn.RemoteAddr().String(), "error", err)
+
+				// The stream cannot be resynchronised after a bad frame, so
+				// report the error and drop the connection
+				api.WriteResponse(writer, &api.Response{Status: api.StatusBadRequest, Error: err.Error()})
+				writer.Flush()
+			}
+			return
+		}
+
+		// Refuse new work once the node has started draining
+		if !n.requests.begin() {
+			n.memory.Release(transportConsumer, int64(len(req.Data)))
+			resp := n.redirect(req, "node is shutting down")
+			resp.ID = req.ID
+			api.WriteResponse(writer, resp)
+			writer.Flush()
+			return
+		}
+		start := time.Now()
+		resp, release := n.serveAdmitted(cc, req)
+		resp.ID = req.ID
+		n.requests.end()
+
+		n.served.Add(1)
+		if resp.Status != api.StatusOK {
+			n.failed.Add(1)
+		}
+		n.ops.record(req.Op, resp.Status == api.StatusOK, len(req.Data), len(resp.Data), time.Since(start))
+
+		err = api.WriteResponse(writer, resp)
+		if err == nil {
+			err = writer.Flush()
+		}
+		release()
+		if err != nil {
+			n.logger.Warn("failed to write response", "remote", conn.RemoteAddr().String(), "error", err)
+			return
+		}
+	}
 }
 
 // GetNodeID returns the ID of this node
@@ -207,4 +606,71 @@ func (n *StorageNode) IsRunning() bool {
 	n.mu.Lock()
 	defer n.mu.Unlock()
 	return n.isRunning
-} 
\ No newline at end of file
+}
+
+// CheckAlive reports whether the node is running and responsive: its
+// lifecycle lock, which a hung start, stop or reload would hold, is taken
+// within timeout.
+func (n *StorageNode) CheckAlive(timeout time.Duration) error {
+	running := make(chan bool, 1)
+	go func() {
+		running <- n.IsRunning()
+	}()
+	select {
+	case ok := <-running:
+		if !ok {
+			return errors.New("node is not running")
+		}
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("node did not respond within %s", timeout)
+	}
+}
+
+// SetMaintenance enables or disables maintenance mode. While in maintenance
+// mode the node refuses client requests but keeps its admin API available.
+func (n *StorageNode) SetMaintenance(enabled bool) {
+	n.maintenance.Store(enabled)
+}
+
+// IsReady returns whether the node has finished starting up, including any
+// initial sync, and is serving requests
+func (n *StorageNode) IsReady() bool {
+	return n.ready.Load()
+}
+
+// InMaintenance returns whether the node is in maintenance mode
+func (n *StorageNode) InMaintenance() bool {
+	return n.maintenance.Load()
+}
+
+// startRegistrar registers the node with the configured discovery backend
+func (n *StorageNode) startRegistrar() error {
+	cfg := n.cfg.Storage
+	registry, err := discovery.NewRegistry(cfg.Discovery)
+	if err != nil {
+		return fmt.Errorf("failed to create discovery registry: %w", err)
+	}
+
+	reg := &discovery.Registration{
+		ID:            cfg.Node.ID,
+		Address:       cfg.Node.ListenAddress,
+		AdminAddress:  cfg.Admin.ListenAddress,
+		CapacityBytes: n.capacityBytes(),
+		Zone:          cfg.Node.Zone,
+		Rack:          cfg.Node.Rack,
+		Host:          cfg.Node.Host,
+		StartedAt:     time.Now().UnixNano(),
+	}
+	ttl := time.Duration(cfg.Discovery.TTL)
+
+	registrar := discovery.NewRegistrar(registry, reg, ttl, n.logger)
+	ctx, cancel := context.WithTimeout(n.ctx, 10*time.Second)
+	defer cancel()
+	if err := registrar.Start(ctx); err != nil {
+		return err
+	}
+
+	n.registrar = registrar
+	return nil
+}
@@ -0,0 +1,65 @@
+package node
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// maxCorruptionEvents is the most corrupted blocks of a pass over a target
+// reported one by one; the rest are reported together
+const maxCorruptionEvents = 100
+
+// reportCorruption reports the blocks of a target a scrub or fsck found
+// corrupted
+func (n *StorageNode) reportCorruption(targetID, check string, blockIDs []string) {
+	for i, blockID := range blockIDs {
+		if i == maxCorruptionEvents {
+			n.notifier.Publish(api.ClusterEvent{
+				Type:    api.ClusterEventBlockCorrupted,
+				Message: fmt.Sprintf("%s found %d more corrupted blocks on target %s", check, len(blockIDs)-i, targetID),
+				Details: map[string]string{"target": targetID, "check": check, "count": strconv.Itoa(len(blockIDs) - i)},
+			})
+			return
+		}
+		n.notifier.Publish(api.ClusterEvent{
+			Type:    api.ClusterEventBlockCorrupted,
+			Message: fmt.Sprintf("%s found block %s corrupted on target %s", check, blockID, targetID),
+			Details: map[string]string{"target": targetID, "check": check, "block": blockID},
+		})
+	}
+}
+
+// reportQuotaBreach reports a client held back by one of its limits, at
+// most once a minute per client
+func (n *StorageNode) reportQuotaBreach(identity, limit string) {
+	if n.notifier == nil || !n.limits.reportBreach(identity) {
+		return
+	}
+	n.notifier.Publish(api.ClusterEvent{
+		Type:    api.ClusterEventQuotaBreached,
+		Message: fmt.Sprintf("client %s exceeded its %s limit", identity, limit),
+		Details: map[string]string{"client": identity, "limit": limit},
+	})
+}
+
+// reportDrain reports a decommission that finished
+func (n *StorageNode) reportDrain(status DecommissionStatus) {
+	message := fmt.Sprintf("node %s finished draining", n.GetNodeID())
+	if !status.SafeToShutdown {
+		message = fmt.Sprintf("node %s finished draining but is not safe to shut down", n.GetNodeID())
+	}
+	n.notifier.Publish(api.ClusterEvent{
+		Type:    api.ClusterEventDrainCompleted,
+		Message: message,
+		Details: map[string]string{
+			"node":             n.GetNodeID(),
+			"migrated":         strconv.Itoa(status.MigratedBlocks),
+			"skipped":          strconv.Itoa(status.SkippedBlocks),
+			"failed":           strconv.Itoa(status.FailedBlocks),
+			"safe_to_shutdown": strconv.FormatBool(status.SafeToShutdown),
+			"error":            status.Error,
+		},
+	})
+}
@@ -0,0 +1,181 @@
+package node
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// latencyBuckets is the number of bounded buckets of latency histograms
+const latencyBuckets = 20
+
+// latencyBounds are the upper bounds of the latency histogram's buckets,
+// doubling from 50µs to about 26s; a last bucket holds slower requests
+var latencyBounds = func() []int64 {
+	bounds := make([]int64, latencyBuckets)
+	bound := int64(50 * time.Microsecond)
+	for i := range bounds {
+		bounds[i] = bound
+		bound *= 2
+	}
+	return bounds
+}()
+
+// LatencyStats is a histogram of request latencies. Buckets counts the
+// requests at most as slow as the bound of the same index, and above the
+// previous bound; the last bucket counts those slower than every bound.
+// Counts only grow, so the difference of two snapshots is the histogram
+// of the requests in between.
+type LatencyStats struct {
+	Count    uint64   `json:"count"`
+	SumNanos uint64   `json:"sum_ns"`
+	BoundsNs []int64  `json:"bounds_ns"`
+	Buckets  []uint64 `json:"buckets"`
+}
+
+// Sub returns the histogram of the requests recorded since prev, an
+// earlier snapshot of the same histogram
+func (l LatencyStats) Sub(prev LatencyStats) LatencyStats {
+	diff := LatencyStats{
+		Count:    l.Count - prev.Count,
+		SumNanos: l.SumNanos - prev.SumNanos,
+		BoundsNs: l.BoundsNs,
+		Buckets:  make([]uint64, len(l.Buckets)),
+	}
+	copy(diff.Buckets, l.Buckets)
+	if len(prev.Buckets) == len(l.Buckets) {
+		for i := range diff.Buckets {
+			diff.Buckets[i] -= prev.Buckets[i]
+		}
+	}
+	return diff
+}
+
+// Add accumulates the counts of other, a histogram with the same bounds,
+// into l
+func (l *LatencyStats) Add(other LatencyStats) {
+	if l.Buckets == nil {
+		l.BoundsNs = other.BoundsNs
+		l.Buckets = make([]uint64, len(other.Buckets))
+	}
+	if len(other.Buckets) != len(l.Buckets) {
+		return
+	}
+	l.Count += other.Count
+	l.SumNanos += other.SumNanos
+	for i, n := range other.Buckets {
+		l.Buckets[i] += n
+	}
+}
+
+// Percentile estimates the latency below which a fraction q of the
+// requests completed, as the upper bound of the bucket it falls in. It is
+// zero without requests.
+func (l LatencyStats) Percentile(q float64) time.Duration {
+	if l.Count == 0 || len(l.BoundsNs) == 0 {
+		return 0
+	}
+	rank := uint64(q*float64(l.Count) + 0.5)
+	if rank < 1 {
+		rank = 1
+	}
+	var seen uint64
+	for i, n := range l.Buckets {
+		seen += n
+		if seen < rank {
+			continue
+		}
+		if i < len(l.BoundsNs) {
+			return time.Duration(l.BoundsNs[i])
+		}
+		break
+	}
+	// Beyond the last bound, report twice it as a floor
+	return time.Duration(2 * l.BoundsNs[len(l.BoundsNs)-1])
+}
+
+// Mean returns the average latency
+func (l LatencyStats) Mean() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return time.Duration(l.SumNanos / l.Count)
+}
+
+// OpStats reports the requests of one operation served on the data port:
+// how many, how many failed, the payload bytes received and sent, and
+// their latencies
+type OpStats struct {
+	Requests uint64       `json:"requests"`
+	Failed   uint64       `json:"failed"`
+	BytesIn  uint64       `json:"bytes_in"`
+	BytesOut uint64       `json:"bytes_out"`
+	Latency  LatencyStats `json:"latency"`
+}
+
+// opCounters counts the requests of one operation
+type opCounters struct {
+	requests atomic.Uint64
+	failed   atomic.Uint64
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+	sum      atomic.Uint64
+	buckets  [latencyBuckets + 1]atomic.Uint64
+}
+
+// opTracker counts requests by operation. The zero value is ready to use.
+type opTracker struct {
+	ops [api.OpDigest + 1]opCounters
+}
+
+// record counts a served request
+func (t *opTracker) record(op api.Op, ok bool, bytesIn, bytesOut int, elapsed time.Duration) {
+	if int(op) >= len(t.ops) {
+		return
+	}
+	c := &t.ops[op]
+	c.requests.Add(1)
+	if !ok {
+		c.failed.Add(1)
+	}
+	c.bytesIn.Add(uint64(bytesIn))
+	c.bytesOut.Add(uint64(bytesOut))
+	c.sum.Add(uint64(elapsed))
+	i := sort.Search(len(latencyBounds), func(i int) bool { return int64(elapsed) <= latencyBounds[i] })
+	c.buckets[i].Add(1)
+}
+
+// stats returns a snapshot of the counters of the operations that served
+// requests, by operation name
+func (t *opTracker) stats() map[string]*OpStats {
+	stats := make(map[string]*OpStats)
+	for op := api.OpRead; op <= api.OpDigest; op++ {
+		if op == api.OpHello {
+			continue
+		}
+		c := &t.ops[op]
+		requests := c.requests.Load()
+		if requests == 0 {
+			continue
+		}
+		s := &OpStats{
+			Requests: requests,
+			Failed:   c.failed.Load(),
+			BytesIn:  c.bytesIn.Load(),
+			BytesOut: c.bytesOut.Load(),
+			Latency: LatencyStats{
+				SumNanos: c.sum.Load(),
+				BoundsNs: latencyBounds,
+				Buckets:  make([]uint64, len(c.buckets)),
+			},
+		}
+		for i := range c.buckets {
+			s.Latency.Buckets[i] = c.buckets[i].Load()
+			s.Latency.Count += s.Latency.Buckets[i]
+		}
+		stats[op.String()] = s
+	}
+	return stats
+}
@@ -0,0 +1,35 @@
+package node
+
+import (
+	"strconv"
+
+	"github.com/3fs-storage/internal/version"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// hello answers a client's handshake with the node's protocol and
+// software versions, refusing clients too old to talk to. It needs no
+// credentials, so that a client can tell an incompatible node from a
+// failed login.
+func (n *StorageNode) hello(req *api.Request) *api.Response {
+	headers := map[string]string{
+		api.ProtocolHeader: strconv.Itoa(api.ProtocolVersion),
+		api.VersionHeader:  version.Version,
+	}
+
+	if err := checkRequestProtocol(req); err != nil {
+		n.logger.Warn("refused client with incompatible protocol", "error", err)
+		return &api.Response{Status: api.StatusBadRequest, Error: err.Error(), Headers: headers}
+	}
+	return &api.Response{Status: api.StatusOK, Headers: headers}
+}
+
+// checkRequestProtocol checks that a request's protocol version is one
+// the node speaks
+func checkRequestProtocol(req *api.Request) error {
+	peer, err := api.HeaderProtocol(req.Headers)
+	if err != nil {
+		return err
+	}
+	return api.CheckProtocol(peer)
+}
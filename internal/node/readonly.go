@@ -0,0 +1,100 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// readOnlyFile is the file in the data directory that records read-only
+// mode, so that it survives restarts until explicitly cleared
+const readOnlyFile = "readonly.json"
+
+// ReadOnlyState describes the node's read-only mode
+type ReadOnlyState struct {
+	Enabled bool   `json:"enabled"`
+	Reason  string `json:"reason,omitempty"`
+	Since   int64  `json:"since,omitempty"`
+}
+
+// readOnlyPath returns the path of the read-only state file
+func (n *StorageNode) readOnlyPath() string {
+	return filepath.Join(n.cfg.Storage.Local.DataPath, readOnlyFile)
+}
+
+// loadReadOnly restores read-only mode from the data directory
+func (n *StorageNode) loadReadOnly() error {
+	data, err := ioutil.ReadFile(n.readOnlyPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read read-only state: %w", err)
+	}
+
+	var state ReadOnlyState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("failed to unmarshal read-only state: %w", err)
+	}
+
+	n.readOnlyMu.Lock()
+	n.readOnlyState = state
+	n.readOnlyMu.Unlock()
+	n.readOnly.Store(state.Enabled)
+
+	if state.Enabled {
+		n.logger.Warn("node is in read-only mode", "reason", state.Reason)
+	}
+	return nil
+}
+
+// SetReadOnly enables or disables read-only mode. While read-only, writes
+// and deletes are rejected with api.ErrReadOnly and reads are still served.
+// The mode is persisted in the data directory before it takes effect.
+func (n *StorageNode) SetReadOnly(enabled bool, reason string) error {
+	n.readOnlyMu.Lock()
+	defer n.readOnlyMu.Unlock()
+
+	if !enabled {
+		if err := os.Remove(n.readOnlyPath()); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to clear read-only state: %w", err)
+		}
+		n.readOnly.Store(false)
+		n.readOnlyState = ReadOnlyState{}
+		n.logger.Info("read-only mode cleared")
+		return nil
+	}
+
+	state := ReadOnlyState{Enabled: true, Reason: reason, Since: time.Now().UnixNano()}
+	if n.readOnlyState.Enabled {
+		state.Since = n.readOnlyState.Since
+	}
+
+	data, err := json.Marshal(&state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal read-only state: %w", err)
+	}
+	if err := ioutil.WriteFile(n.readOnlyPath(), data, 0644); err != nil {
+		return fmt.Errorf("failed to persist read-only state: %w", err)
+	}
+
+	n.readOnlyState = state
+	n.readOnly.Store(true)
+	n.logger.Info("read-only mode enabled", "reason", reason)
+	return nil
+}
+
+// IsReadOnly returns whether the node rejects writes
+func (n *StorageNode) IsReadOnly() bool {
+	return n.readOnly.Load()
+}
+
+// ReadOnlyState returns the node's read-only mode
+func (n *StorageNode) ReadOnlyState() ReadOnlyState {
+	n.readOnlyMu.Lock()
+	defer n.readOnlyMu.Unlock()
+	return n.readOnlyState
+}
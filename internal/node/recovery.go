@@ -0,0 +1,292 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// RecoveryStatus reports the node's startup recovery: the replay of each
+// target's write-ahead log, and the reconciliation of its blocks with the
+// other members of its chains
+type RecoveryStatus struct {
+	Running      bool                               `json:"running"`
+	StartedAt    int64                              `json:"started_at,omitempty"`
+	FinishedAt   int64                              `json:"finished_at,omitempty"`
+	TableVersion uint64                             `json:"table_version"`
+	Replay       map[string]*storage.RecoveryReport `json:"replay"`
+	Checked      int                                `json:"checked"`
+	Fetched      int                                `json:"fetched"`
+	Failed       int                                `json:"failed"`
+	BytesFetched int64                              `json:"bytes_fetched"`
+	// ShardsCompared counts the shards whose digests differed from the
+	// reference member's, and whose blocks were compared one by one
+	ShardsCompared int    `json:"shards_compared"`
+	Error          string `json:"error,omitempty"`
+}
+
+// RecoveryStatus returns the state of the startup recovery
+func (n *StorageNode) RecoveryStatus() RecoveryStatus {
+	n.recoveryMu.Lock()
+	defer n.recoveryMu.Unlock()
+	return n.recovery
+}
+
+// updateRecovery applies fn to the recovery status
+func (n *StorageNode) updateRecovery(fn func(*RecoveryStatus)) {
+	n.recoveryMu.Lock()
+	defer n.recoveryMu.Unlock()
+	fn(&n.recovery)
+}
+
+// recoverState catches the node up after a restart, or joins the cluster,
+// before it serves. Each target's write-ahead log has already been
+// replayed, which may have discarded torn blocks; the blocks of the node's
+// chains are then compared with the committed copies of the other chain
+// members and fetched where missing or stale. When restarting, a
+// coordinator that cannot be reached is logged and skipped, so that a
+// cluster can still start from cold.
+func (n *StorageNode) recoverState() error {
+	replay := make(map[string]*storage.RecoveryReport, len(n.targets))
+	discarded := 0
+	for _, t := range n.targets {
+		if t.recovery != nil {
+			replay[t.id] = t.recovery
+			discarded += len(t.recovery.Discarded)
+		}
+	}
+	n.updateRecovery(func(s *RecoveryStatus) {
+		*s = RecoveryStatus{Running: true, StartedAt: time.Now().UnixNano(), Replay: replay}
+	})
+	if discarded > 0 {
+		n.logger.Warn("discarded blocks torn by a crash", "blocks", discarded)
+	}
+
+	var err error
+	if n.cfg.Storage.Cluster.Join {
+		err = n.join()
+	} else if n.coordinator != nil || len(n.cfg.Storage.Coordinator.Addresses) > 0 {
+		err = n.catchUp()
+	}
+
+	n.updateRecovery(func(s *RecoveryStatus) {
+		s.Running = false
+		s.FinishedAt = time.Now().UnixNano()
+		if err != nil {
+			s.Error = err.Error()
+		}
+	})
+	return err
+}
+
+// catchUp reconciles the node's chains with the other chain members
+func (n *StorageNode) catchUp() error {
+	ctx, cancel := context.WithTimeout(n.ctx, DefaultJoinTimeout)
+	defer cancel()
+
+	table, err := n.fetchRouting(ctx)
+	if err != nil {
+		n.logger.Warn("skipping catch-up, routing table unavailable", "error", err)
+		n.updateRecovery(func(s *RecoveryStatus) { s.Error = err.Error() })
+		return nil
+	}
+
+	fetched, err := n.reconcile(ctx, table)
+	if err != nil {
+		return fmt.Errorf("failed to catch up with chain members: %w", err)
+	}
+
+	status := n.RecoveryStatus()
+	n.logger.Info("caught up with chain members",
+		"routing_version", table.Version,
+		"checked", status.Checked,
+		"fetched", fetched,
+		"failed", status.Failed)
+	return nil
+}
+
+// reconcile fetches the blocks of the local targets' chains that are
+// missing or stale locally. Each chain's tail holds its committed data, so
+// it is the reference unless it is a local target, not up or suspected of
+// failing, in which case the first healthy member is. A member that cannot be reached is skipped, since
+// repair later brings the chain back to its replication factor. It returns
+// the number of blocks fetched.
+func (n *StorageNode) reconcile(ctx context.Context, table *api.RoutingTable) (int, error) {
+	n.updateRecovery(func(s *RecoveryStatus) { s.TableVersion = table.Version })
+
+	// Group each target's chains by the member to compare them with
+	type source struct {
+		target *target
+		member string
+	}
+	sources := make(map[source]map[uint32]bool)
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		for _, chain := range assignedChains(table, t.id) {
+			member := n.referenceMember(table, chain)
+			if member == "" {
+				continue
+			}
+			key := source{target: t, member: member}
+			if sources[key] == nil {
+				sources[key] = make(map[uint32]bool)
+			}
+			sources[key][chain.ID] = true
+		}
+	}
+
+	peers := make(map[string]*client.Client)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	fetched := 0
+	for src, chains := range sources {
+		addr := table.NodeAddress(src.member)
+		peer, ok := peers[addr]
+		if !ok {
+			var err error
+			if peer, err = n.dialPeer(addr); err != nil {
+				n.logger.Warn("failed to reach chain member", "member", src.member, "address", addr, "error", err)
+				continue
+			}
+			peers[addr] = peer
+		}
+
+		count, err := n.reconcileWith(ctx, table, peer, src.target, src.member, chains)
+		fetched += count
+		if err != nil {
+			if ctx.Err() != nil {
+				return fetched, ctx.Err()
+			}
+			n.logger.Warn("failed to reconcile with chain member", "member", src.member, "target", src.target.id, "error", err)
+			peer.Close()
+			delete(peers, addr)
+		}
+	}
+
+	return fetched, nil
+}
+
+// referenceMember returns the member whose copy of a chain's blocks is
+// authoritative for this node, or "" if there is none
+func (n *StorageNode) referenceMember(table *api.RoutingTable, chain *api.ChainRecord) string {
+	up := func(id string, healthy bool) bool {
+		node, ok := table.Nodes[id]
+		if !ok || n.isLocalTarget(id) {
+			return false
+		}
+		if healthy {
+			return node.Healthy()
+		}
+		return node.State == api.NodeStateUp
+	}
+
+	// Prefer members that are not suspected of failing
+	for _, healthy := range []bool{true, false} {
+		if tail := chain.Tail(); up(tail, healthy) {
+			return tail
+		}
+		for _, member := range chain.Members {
+			if up(member, healthy) {
+				return member
+			}
+		}
+	}
+	return ""
+}
+
+// reconcileWith fetches the blocks of the given chains that member holds
+// and target lacks or holds an older or different copy of. Members that
+// predate digests list every block and are asked for each one's metadata.
+func (n *StorageNode) reconcileWith(ctx context.Context, table *api.RoutingTable, peer *client.Client, t *target, member string, chains map[uint32]bool) (int, error) {
+	ctx = client.WithTarget(ctx, member)
+	if peer.Protocol() >= api.ProtocolDigest {
+		return n.reconcileDigests(ctx, table, peer, t, member, chains)
+	}
+
+	blockIDs, err := peer.List(ctx, "")
+	if err != nil {
+		return 0, err
+	}
+
+	fetched := 0
+	for _, blockID := range blockIDs {
+		if chain := table.ChainForBlock(blockID); chain == nil || !chains[chain.ID] {
+			continue
+		}
+		if table.Erasure(api.Namespace(blockID)) != nil {
+			// Members keep different shards; repair rebuilds the target's
+			continue
+		}
+
+		stat, err := peer.Stat(ctx, blockID)
+		if err != nil {
+			n.updateRecovery(func(s *RecoveryStatus) { s.Failed++ })
+			return fetched, fmt.Errorf("failed to stat block %s: %w", blockID, err)
+		}
+		n.updateRecovery(func(s *RecoveryStatus) { s.Checked++ })
+		ok, err := n.fetchStale(ctx, peer, t, member, blockID, stat)
+		if ok {
+			fetched++
+		}
+		if err != nil {
+			return fetched, err
+		}
+	}
+
+	return fetched, nil
+}
+
+// fetchStale fetches a block from member if the target's copy is stale
+// against the reference copy described by stat, reporting whether it did
+func (n *StorageNode) fetchStale(ctx context.Context, peer *client.Client, t *target, member, blockID string, stat *api.BlockStat) (bool, error) {
+	if !t.stale(blockID, stat) {
+		return false, nil
+	}
+
+	// The block may have been rewritten since it was described; the fetch
+	// returns the metadata matching the data it carries
+	data, stat, err := n.fetchBlock(ctx, peer, member, blockID, stat.Version)
+	if err != nil {
+		n.updateRecovery(func(s *RecoveryStatus) { s.Failed++ })
+		return false, fmt.Errorf("failed to fetch block %s: %w", blockID, err)
+	}
+
+	if err := t.storeReplica(blockID, data, stat); err != nil {
+		n.updateRecovery(func(s *RecoveryStatus) { s.Failed++ })
+		return false, err
+	}
+	n.updateRecovery(func(s *RecoveryStatus) {
+		s.Fetched++
+		s.BytesFetched += int64(len(data))
+	})
+	return true, nil
+}
+
+// stale reports whether the target's copy of a block is missing, or older
+// than or different from the reference copy described by stat
+func (t *target) stale(blockID string, stat *api.BlockStat) bool {
+	exists, metadataBytes, err := t.storage.ReadBlockMetadata(blockID)
+	if err != nil || !exists {
+		return true
+	}
+
+	var metadata storage.BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return true
+	}
+	if metadata.Version > stat.Version {
+		return false
+	}
+	return metadata.Version < stat.Version || metadata.Checksum != stat.Checksum
+}
@@ -0,0 +1,66 @@
+package node
+
+import (
+	"github.com/3fs-storage/pkg/api"
+)
+
+// redirect builds the response refusing a request while the node is
+// shutting down or draining. It names the other nodes that can serve the
+// request, so that clients retry there at once instead of timing out.
+func (n *StorageNode) redirect(req *api.Request, reason string) *api.Response {
+	return api.RedirectResponse(reason, n.alternatives(req))
+}
+
+// alternatives returns the data addresses of other nodes that can serve a
+// request. A block request goes to the healthy members of the block's
+// chain, head first for writes and deletes and tail first otherwise, as
+// CRAQ commits at the tail. Other requests, and blocks whose chain has no
+// healthy member left, go to any other healthy node but cache nodes.
+// Without a routing table, the other nodes of the static cluster are
+// named.
+func (n *StorageNode) alternatives(req *api.Request) []string {
+	table := n.cachedTable()
+	if table == nil {
+		addresses := make([]string, 0, len(n.cfg.Storage.Cluster.Nodes))
+		for _, node := range n.cfg.Storage.Cluster.Nodes {
+			if node.ID != n.GetNodeID() && node.Address != "" {
+				addresses = append(addresses, node.Address)
+			}
+		}
+		return addresses
+	}
+
+	seen := make(map[string]bool)
+	addresses := make([]string, 0)
+	add := func(id string) {
+		record, ok := table.Nodes[id]
+		if !ok || !record.Healthy() || record.IsCache() || n.isLocalTarget(id) || record.Node == n.GetNodeID() {
+			return
+		}
+		if record.Address != "" && !seen[record.Address] {
+			seen[record.Address] = true
+			addresses = append(addresses, record.Address)
+		}
+	}
+
+	if req.BlockID != "" {
+		if chain := table.ChainForBlock(req.BlockID); chain != nil {
+			members := chain.Members
+			if req.Op != api.OpWrite && req.Op != api.OpDelete {
+				members = make([]string, len(chain.Members))
+				for i, member := range chain.Members {
+					members[len(members)-1-i] = member
+				}
+			}
+			for _, member := range members {
+				add(member)
+			}
+		}
+	}
+	if len(addresses) == 0 {
+		for id := range table.Nodes {
+			add(id)
+		}
+	}
+	return addresses
+}
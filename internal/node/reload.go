@@ -0,0 +1,118 @@
+package node
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// RegisterReloadHooks registers the hooks applying configuration changes
+// to the running node: the cache limit, write concurrency, scrub and repair
+// bandwidth tunables, the client limits, the ACL and the auth tokens.
+// Other fields take effect on restart.
+func (n *StorageNode) RegisterReloadHooks(w *config.Watcher) {
+	n.reloads.Store(w)
+	w.OnChange("tunables", n.reloadTunables,
+		"storage.tuning.cache_size",
+		"storage.tuning.write_concurrency",
+		"storage.tuning.scrub_bandwidth",
+		"storage.replication.repair_bandwidth")
+	w.OnChange("limits", n.reloadLimits, "storage.limits")
+	w.OnChange("acl", n.reloadACL, "storage.acl")
+	w.OnChange("auth tokens", n.reloadTokens, "storage.auth.tokens")
+}
+
+// EffectiveConfig returns the configuration the node runs with: the one it
+// was started with, or the one last reloaded
+func (n *StorageNode) EffectiveConfig() *config.Config {
+	if w := n.reloads.Load(); w != nil {
+		return w.Current()
+	}
+	return n.cfg
+}
+
+// reloadTunables applies changed tunables as SetTunables does, overriding
+// values set through the admin API
+func (n *StorageNode) reloadTunables(_, cfg *config.Config, changes []config.Change) error {
+	var update TunablesUpdate
+	for _, change := range changes {
+		switch change.Path {
+		case "storage.tuning.cache_size":
+			cache := mebibytes(cfg.Storage.Tuning.CacheSize)
+			update.CacheMB = &cache
+		case "storage.tuning.write_concurrency":
+			concurrency := cfg.Storage.Tuning.WriteConcurrency
+			if concurrency == 0 {
+				concurrency = block.DefaultClassLimits()[block.IOClassBulk].MaxConcurrent
+			}
+			update.WriteConcurrency = &concurrency
+		case "storage.tuning.scrub_bandwidth":
+			// A bandwidth set on the scrub job's schedule takes precedence
+			if cfg.Storage.Jobs.Schedule[jobScrub].Bandwidth <= 0 {
+				bandwidth := mebibytes(cfg.Storage.Tuning.ScrubBandwidth)
+				update.ScrubBandwidthMB = &bandwidth
+			}
+		case "storage.replication.repair_bandwidth":
+			// Without a coordinator there is no repair to pace
+			if _, ok := n.jobs.Status(jobRepair); ok {
+				bandwidth := mebibytes(cfg.Storage.Replication.RepairBandwidth)
+				update.RepairBandwidthMB = &bandwidth
+			}
+		}
+	}
+
+	_, err := n.SetTunables(update)
+	return err
+}
+
+// mebibytes converts a configured size to the whole MiB of the tunables,
+// rounding up so that a small limit does not become unlimited
+func mebibytes(size config.Size) int {
+	return int((size + config.MiB - 1) / config.MiB)
+}
+
+// reloadLimits applies changed client limits
+func (n *StorageNode) reloadLimits(_, cfg *config.Config, _ []config.Change) error {
+	n.limits.update(cfg.Storage.Limits)
+	return nil
+}
+
+// reloadACL replaces the ACL rules
+func (n *StorageNode) reloadACL(_, cfg *config.Config, _ []config.Change) error {
+	return n.acl.Update(cfg.Storage.ACL)
+}
+
+// reloadTokens replaces the accepted auth tokens, so that a rotated token is
+// accepted as soon as the configuration, or the secret it refers to, is
+// reloaded
+func (n *StorageNode) reloadTokens(_, cfg *config.Config, _ []config.Change) error {
+	return n.auth.UpdateTokens(cfg.Storage.Auth.Tokens)
+}
+
+// handleConfig reports the effective configuration, with the secrets
+// redacted, as JSON or in the format given by ?format=yaml|json|toml
+func (a *adminServer) handleConfig(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+
+	format := config.FormatJSON
+	if f := r.URL.Query().Get("format"); f != "" {
+		format = config.Format(f)
+	}
+	if format != config.FormatJSON && format != config.FormatYAML && format != config.FormatTOML {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("unsupported format %q, expected yaml, json or toml", format))
+		return
+	}
+
+	data, err := a.node.EffectiveConfig().Dump(format)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/"+string(format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
@@ -0,0 +1,330 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+const (
+	// DefaultRepairConcurrency is the number of blocks repaired in parallel
+	DefaultRepairConcurrency = 4
+	// DefaultRepairInterval is how often a full repair pass runs even when
+	// the routing table has not changed
+	DefaultRepairInterval = 10 * time.Minute
+)
+
+// RepairStatus reports the outcome of the current or last repair pass
+type RepairStatus struct {
+	Running         bool   `json:"running"`
+	TableVersion    uint64 `json:"table_version"`
+	StartedAt       int64  `json:"started_at,omitempty"`
+	FinishedAt      int64  `json:"finished_at,omitempty"`
+	Checked         int    `json:"checked"`
+	UnderReplicated int    `json:"under_replicated"`
+	Repaired        int    `json:"repaired"`
+	Failed          int    `json:"failed"`
+	BytesCopied     int64  `json:"bytes_copied"`
+	Error           string `json:"error,omitempty"`
+}
+
+// targetBlock is a block and the target holding it
+type targetBlock struct {
+	target  *target
+	blockID string
+}
+
+// repairController restores the replication factor of blocks after chain
+// members are replaced. Each member of a chain checks the blocks it holds
+// against the other up members; the first member in chain order that holds
+// a block is responsible for copying it to the members that lack it, so
+// that the surviving replicas do not all push the same block.
+//
+// Passes run as the node's repair job, periodically and whenever the
+// routing table changes.
+type repairController struct {
+	node        *StorageNode
+	concurrency int
+	status      RepairStatus
+	mu          sync.Mutex
+}
+
+// newRepairController creates the repair controller of a node and
+// registers its passes with the node's job scheduler
+func newRepairController(n *StorageNode) *repairController {
+	cfg := n.cfg.Storage.Replication
+
+	concurrency := cfg.RepairConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultRepairConcurrency
+	}
+	interval := DefaultRepairInterval
+	if cfg.RepairInterval > 0 {
+		interval = time.Duration(cfg.RepairInterval)
+	}
+
+	r := &repairController{
+		node:        n,
+		concurrency: concurrency,
+	}
+	n.jobs.register(JobSpec{
+		Name:           jobRepair,
+		Interval:       interval,
+		BandwidthBytes: int64(cfg.RepairBandwidth),
+		Run:            r.run,
+	})
+	return r
+}
+
+// Trigger asks for a repair pass as soon as possible
+func (r *repairController) Trigger() {
+	r.node.jobs.Trigger(jobRepair)
+}
+
+// Status returns the state of the current or last repair pass
+func (r *repairController) Status() RepairStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.status
+}
+
+// run performs a repair pass against the current routing table, copying
+// no faster than budget allows
+func (r *repairController) run(ctx context.Context, budget *ratelimit.Limiter) (interface{}, error) {
+	table := r.node.RoutingTable()
+	if table == nil {
+		return nil, nil
+	}
+	r.pass(ctx, table, budget)
+
+	status := r.Status()
+	if status.Error != "" {
+		return status, errors.New(status.Error)
+	}
+	return status, nil
+}
+
+// update applies fn to the repair status
+func (r *repairController) update(fn func(*RepairStatus)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fn(&r.status)
+}
+
+// pass checks every block of the healthy targets once against the given
+// routing table
+func (r *repairController) pass(ctx context.Context, table *api.RoutingTable, budget *ratelimit.Limiter) {
+	logger := r.node.logger
+	r.mu.Lock()
+	r.status = RepairStatus{
+		Running:      true,
+		TableVersion: table.Version,
+		StartedAt:    time.Now().UnixNano(),
+	}
+	r.mu.Unlock()
+
+	items := make([]targetBlock, 0)
+	for _, t := range r.node.targets {
+		if t.available() != nil {
+			continue
+		}
+		blockIDs, err := t.storage.ListBlocks("")
+		if err != nil {
+			r.update(func(s *RepairStatus) {
+				s.Running = false
+				s.FinishedAt = time.Now().UnixNano()
+				s.Error = fmt.Sprintf("failed to list blocks of target %s: %v", t.id, err)
+			})
+			return
+		}
+		for _, blockID := range blockIDs {
+			items = append(items, targetBlock{target: t, blockID: blockID})
+		}
+	}
+
+	work := make(chan targetBlock)
+	var wg sync.WaitGroup
+	for i := 0; i < r.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r.worker(ctx, table, budget, work)
+		}()
+	}
+
+feed:
+	for _, item := range items {
+		select {
+		case work <- item:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	r.update(func(s *RepairStatus) {
+		s.Running = false
+		s.FinishedAt = time.Now().UnixNano()
+		if ctx.Err() != nil {
+			s.Error = ctx.Err().Error()
+		}
+	})
+
+	status := r.Status()
+	if status.UnderReplicated > 0 {
+		logger.Info("repair pass finished",
+			"table_version", status.TableVersion,
+			"under_replicated", status.UnderReplicated,
+			"repaired", status.Repaired,
+			"failed", status.Failed,
+			"bytes_copied", status.BytesCopied)
+	}
+}
+
+// worker repairs blocks from the work channel, keeping one connection per
+// peer for the duration of the pass
+func (r *repairController) worker(ctx context.Context, table *api.RoutingTable, budget *ratelimit.Limiter, work <-chan targetBlock) {
+	peers := make(map[string]*client.Client)
+	defer func() {
+		for _, peer := range peers {
+			peer.Close()
+		}
+	}()
+
+	for item := range work {
+		under, copied, err := r.repairBlock(ctx, table, budget, peers, item.target, item.blockID)
+		r.update(func(s *RepairStatus) {
+			s.Checked++
+			if under {
+				s.UnderReplicated++
+			}
+			if err != nil {
+				s.Failed++
+			} else if copied > 0 {
+				s.Repaired++
+				s.BytesCopied += copied
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			r.node.logger.Warn("failed to repair block", "block", item.blockID, "target", item.target.id, "error", err)
+		}
+	}
+}
+
+// peer returns a cached connection to a chain member
+func (r *repairController) peer(table *api.RoutingTable, peers map[string]*client.Client, nodeID string) (*client.Client, error) {
+	if peer, ok := peers[nodeID]; ok {
+		return peer, nil
+	}
+	peer, err := r.node.dialPeer(table.NodeAddress(nodeID))
+	if err != nil {
+		return nil, err
+	}
+	peers[nodeID] = peer
+	return peer, nil
+}
+
+// repairBlock counts the replicas of a block among the up members of its
+// chain and, if the target holding it is responsible, copies it to the
+// members missing it. Members suspected of failing are passed over, so
+// that the next member takes responsibility rather than waiting on them. Requests to members name them, since they may be
+// targets of a node with several. It returns whether the block was
+// under-replicated and how many bytes were copied.
+func (r *repairController) repairBlock(ctx context.Context, table *api.RoutingTable, budget *ratelimit.Limiter, peers map[string]*client.Client, t *target, blockID string) (bool, int64, error) {
+	if isShard(table, blockID) {
+		return r.repairShard(ctx, table, budget, peers, t, blockID)
+	}
+	self := t.id
+	chain := table.ChainForBlock(blockID)
+	if !isMember(chain, self) {
+		return false, 0, nil
+	}
+
+	exists, _, err := t.storage.ReadBlockMetadata(blockID)
+	if err != nil || !exists {
+		return false, 0, err
+	}
+
+	// Find which up members hold the block
+	responsible := true
+	seenSelf := false
+	missing := make([]string, 0)
+	replicas := 0
+	for _, member := range chain.Members {
+		node, ok := table.Nodes[member]
+		if !ok || node.State != api.NodeStateUp {
+			continue
+		}
+		if member == self {
+			replicas++
+			seenSelf = true
+			continue
+		}
+		if node.Suspect {
+			continue
+		}
+
+		peer, err := r.peer(table, peers, member)
+		if err != nil {
+			return false, 0, err
+		}
+		stat, err := peer.Stat(client.WithTarget(ctx, member), blockID)
+		if err == nil && t.hasBlock(blockID, stat.Checksum) {
+			replicas++
+			if !seenSelf {
+				// An earlier member holds the block and will repair it
+				responsible = false
+			}
+			continue
+		}
+		missing = append(missing, member)
+	}
+
+	want, _ := r.node.replicationOf(table, blockID)
+	if want > replicas+len(missing) {
+		want = replicas + len(missing)
+	}
+	if replicas >= want {
+		return false, 0, nil
+	}
+	if !responsible {
+		return true, 0, nil
+	}
+
+	fenced, err := r.node.fence(ctx, table, self)
+	if err != nil {
+		return true, 0, err
+	}
+	data, err := t.service.ReadBlockWithClass(ctx, block.IOClassBackground, blockID)
+	if err != nil {
+		return true, 0, err
+	}
+
+	var copied int64
+	for _, member := range missing[:want-replicas] {
+		if err := budget.WaitN(ctx, len(data)); err != nil {
+			return true, copied, err
+		}
+
+		peer, err := r.peer(table, peers, member)
+		if err != nil {
+			return true, copied, err
+		}
+		if err := peer.Write(client.WithTarget(fenced, member), blockID, data); err != nil {
+			peer.Close()
+			delete(peers, member)
+			return true, copied, fmt.Errorf("failed to copy block to %s: %w", member, err)
+		}
+		copied += int64(len(data))
+	}
+
+	return true, copied, nil
+}
@@ -0,0 +1,316 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/internal/usage"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// startCoordinator starts the embedded coordinator, seeding a fresh chain
+// table from the statically configured cluster nodes
+func (n *StorageNode) startCoordinator() error {
+	cfg := n.cfg.Storage
+	if cfg.Admin.ListenAddress == "" {
+		return errors.New("the embedded coordinator requires admin.listen_address")
+	}
+
+	statePath := cfg.Coordinator.StatePath
+	if statePath == "" {
+		statePath = filepath.Join(cfg.Local.DataPath, "coordinator.json")
+	}
+
+	coord, err := coordinator.New(statePath, cfg.Coordinator.NumChains, cfg.Replication.ChainLength, n.logger)
+	if err != nil {
+		return fmt.Errorf("failed to start coordinator: %w", err)
+	}
+	if err := coord.SetHashing(cfg.Coordinator.Hashing); err != nil {
+		return fmt.Errorf("invalid hashing: %w", err)
+	}
+	placement, err := coordinator.ParsePlacementPolicy(cfg.Coordinator.Placement.FailureDomain, cfg.Coordinator.Placement.Strict)
+	if err != nil {
+		return fmt.Errorf("invalid placement policy: %w", err)
+	}
+	placement.Zones = cfg.Coordinator.Placement.Zones
+	coord.SetPlacement(placement)
+	if err := coord.SetPlacementRules(placementRules(cfg.Coordinator.PlacementRules)); err != nil {
+		return fmt.Errorf("invalid placement rules: %w", err)
+	}
+	balance := cfg.Coordinator.Balance
+	if err := coord.SetBalance(coordinator.BalancePolicy{
+		FullnessWeight: balance.FullnessWeight,
+		WriteWeight:    balance.WriteWeight,
+		MaxFullness:    balance.MaxFullness,
+	}); err != nil {
+		return fmt.Errorf("invalid balance policy: %w", err)
+	}
+	namespaces, err := namespacePolicies(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid replication policy: %w", err)
+	}
+	if err := coord.SetNamespaces(namespaces); err != nil {
+		return fmt.Errorf("failed to set namespace replication policies: %w", err)
+	}
+	ledger, err := usage.OpenLedger(filepath.Join(filepath.Dir(statePath), "usage.json"), time.Duration(cfg.Usage.Window), time.Duration(cfg.Usage.Retention))
+	if err != nil {
+		return fmt.Errorf("failed to open usage ledger: %w", err)
+	}
+	coord.SetUsage(ledger)
+	if n.notifier != nil {
+		coord.SetNotifier(n.notifier.Publish)
+	}
+	coord.SetUsageMetrics(cfg.Usage.Export.Prometheus)
+	if err := n.registerUsageExport(coord, ledger, filepath.Dir(statePath)); err != nil {
+		return err
+	}
+
+	// Nodes with several storage targets are seeded with one record per
+	// target
+	seeds := make([]*api.NodeRecord, 0, len(cfg.Cluster.Nodes))
+	for _, node := range cfg.Cluster.Nodes {
+		seed := api.NodeRecord{
+			ID:           node.ID,
+			Address:      node.Address,
+			AdminAddress: node.AdminAddress,
+			Zone:         node.Zone,
+			Rack:         node.Rack,
+			Hostname:     node.Host,
+			Labels:       node.Labels,
+			Role:         node.Role,
+		}
+		if len(node.Targets) == 0 {
+			seeds = append(seeds, &seed)
+			continue
+		}
+		for _, targetID := range node.Targets {
+			record := seed
+			record.ID = targetID
+			record.Node = node.ID
+			seeds = append(seeds, &record)
+		}
+	}
+
+	// With several coordinators, only the elected leader seeds the table;
+	// the others copy it from the leader
+	if el := cfg.Coordinator.Election; el.Enabled {
+		peers := el.Peers
+		if len(peers) == 0 {
+			peers = cfg.Coordinator.Addresses
+		}
+		election, err := coordinator.NewElection(coord, coordinator.ElectionOptions{
+			ID:            cfg.Node.ID,
+			Address:       cfg.Admin.ListenAddress,
+			Peers:         peers,
+			LeaseDuration: time.Duration(el.Lease),
+			OnLeader: func() {
+				if err := coord.Bootstrap(seeds); err != nil {
+					n.logger.Error("failed to bootstrap coordinator", "error", err)
+				}
+			},
+		}, n.logger)
+		if err != nil {
+			return fmt.Errorf("failed to start coordinator election: %w", err)
+		}
+		n.election = election
+	} else if err := coord.Bootstrap(seeds); err != nil {
+		return fmt.Errorf("failed to bootstrap coordinator: %w", err)
+	}
+
+	// Rebalance passes run as one of the node's background jobs, within
+	// the job's bandwidth budget, on the coordinator leader only
+	if rb := cfg.Coordinator.Rebalance; rb.Enabled {
+		var rebalancer *coordinator.Rebalancer
+		budget := n.jobs.register(JobSpec{
+			Name:           jobRebalance,
+			Interval:       time.Duration(rb.Interval),
+			BandwidthBytes: int64(rb.Bandwidth),
+			Run: func(ctx context.Context, _ *ratelimit.Limiter) (interface{}, error) {
+				if !coord.IsLeader() {
+					return nil, nil
+				}
+				err := rebalancer.RunPass(ctx)
+				return rebalancer.Status(), err
+			},
+		})
+		rebalancer = coordinator.NewRebalancer(coord, coordinator.RebalanceOptions{
+			Threshold:   rb.Threshold,
+			MaxMoves:    rb.MaxMoves,
+			Concurrency: rb.Concurrency,
+			Limiter:     budget,
+			Schedule:    func() { n.jobs.Trigger(jobRebalance) },
+			Dial:        n.dialPeer,
+		}, n.logger)
+	}
+
+	fd := cfg.Coordinator.FailureDetector
+	n.detector = coordinator.NewFailureDetector(coord, coordinator.DetectorOptions{
+		SuspectPhi:      fd.SuspectPhi,
+		DownPhi:         fd.DownPhi,
+		Window:          fd.Window,
+		MinStdDev:       time.Duration(fd.MinStdDev),
+		AcceptablePause: time.Duration(fd.AcceptablePause),
+	}, n.logger)
+
+	n.coordinator = coord
+	return nil
+}
+
+// coordinatorAddresses returns the admin addresses of the coordinators. A
+// node running the embedded coordinator uses itself and its election peers
+// when no coordinator addresses are configured.
+func (n *StorageNode) coordinatorAddresses() []string {
+	cfg := n.cfg.Storage
+	addresses := cfg.Coordinator.Addresses
+	if len(addresses) == 0 && n.coordinator != nil {
+		addresses = append([]string{cfg.Admin.ListenAddress}, cfg.Coordinator.Election.Peers...)
+	}
+	return addresses
+}
+
+// leaderCoordinator returns the embedded coordinator if it may change the
+// chain table directly, or nil if changes must go to the elected leader
+// or to a remote coordinator
+func (n *StorageNode) leaderCoordinator() *coordinator.Coordinator {
+	if n.coordinator != nil && n.coordinator.IsLeader() {
+		return n.coordinator
+	}
+	return nil
+}
+
+// startRoutingWatcher begins polling the coordinator for routing updates.
+// A node running the embedded coordinator polls itself when no other
+// coordinator addresses are configured.
+func (n *StorageNode) startRoutingWatcher() error {
+	cfg := n.cfg.Storage
+	addresses := n.coordinatorAddresses()
+	if len(addresses) == 0 {
+		return nil
+	}
+
+	client, err := coordinator.NewClient(addresses)
+	if err != nil {
+		return fmt.Errorf("failed to create coordinator client: %w", err)
+	}
+
+	// Re-replicate blocks whenever chain membership changes
+	n.repair = newRepairController(n)
+
+	interval := time.Duration(cfg.Coordinator.RefreshInterval)
+	n.routing = coordinator.NewWatcher(client, interval, func(*api.RoutingTable) {
+		n.repair.Trigger()
+	}, n.logger)
+	go n.routing.Run(n.ctx)
+
+	return nil
+}
+
+// Usage reports the data held by one of the node's targets, or by all of
+// them when targetID is empty, in total, per chain of the current routing
+// table and per namespace
+func (n *StorageNode) Usage(targetID string) (*api.NodeUsage, error) {
+	usage := &api.NodeUsage{
+		NodeID:     n.GetNodeID(),
+		Chains:     make(map[uint32]api.ChainUsage),
+		Namespaces: make(map[string]api.ChainUsage),
+	}
+	targets := n.targets
+	if targetID != "" {
+		t := n.target(targetID)
+		if t == nil {
+			return nil, fmt.Errorf("unknown storage target %s", targetID)
+		}
+		usage.NodeID = targetID
+		targets = []*target{t}
+	}
+
+	table := n.RoutingTable()
+	if table != nil {
+		usage.TableVersion = table.Version
+	}
+
+	for _, t := range targets {
+		if t.available() != nil {
+			continue
+		}
+		if err := t.addUsage(usage, table); err != nil {
+			return nil, err
+		}
+	}
+
+	return usage, nil
+}
+
+// addUsage adds the blocks of the target to usage
+func (t *target) addUsage(usage *api.NodeUsage, table *api.RoutingTable) error {
+	blockIDs, err := t.storage.ListBlocks("")
+	if err != nil {
+		return fmt.Errorf("failed to list blocks of target %s: %w", t.id, err)
+	}
+
+	for _, blockID := range blockIDs {
+		exists, metadataBytes, err := t.storage.ReadBlockMetadata(blockID)
+		if err != nil || !exists {
+			continue
+		}
+		var metadata storage.BlockMetadata
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			continue
+		}
+
+		usage.Bytes += int64(metadata.Size)
+		usage.Blocks++
+		nu := usage.Namespaces[api.Namespace(blockID)]
+		nu.Bytes += int64(metadata.Size)
+		nu.Blocks++
+		usage.Namespaces[api.Namespace(blockID)] = nu
+		if table == nil {
+			continue
+		}
+		if chain := table.ChainForBlock(blockID); chain != nil {
+			cu := usage.Chains[chain.ID]
+			cu.Bytes += int64(metadata.Size)
+			cu.Blocks++
+			usage.Chains[chain.ID] = cu
+		}
+	}
+
+	return nil
+}
+
+// RoutingTable returns the latest routing table known to this node, or nil
+// if the node does not follow a coordinator
+func (n *StorageNode) RoutingTable() *api.RoutingTable {
+	if n.coordinator != nil {
+		return n.coordinator.Routing()
+	}
+	if n.routing != nil {
+		return n.routing.Table()
+	}
+	return nil
+}
+
+// placementRules converts the configured placement rules
+func placementRules(configs []config.PlacementRuleConfig) []coordinator.PlacementRule {
+	rules := make([]coordinator.PlacementRule, 0, len(configs))
+	for _, rc := range configs {
+		rules = append(rules, coordinator.PlacementRule{
+			Name:        rc.Name,
+			Type:        rc.Type,
+			Namespaces:  rc.Namespaces,
+			Domain:      rc.Domain,
+			MaxFullness: rc.MaxFullness,
+			Labels:      rc.Labels,
+			Soft:        rc.Soft,
+		})
+	}
+	return rules
+}
@@ -0,0 +1,163 @@
+package node
+
+import (
+	"context"
+	"time"
+
+	"github.com/3fs-storage/internal/affinity"
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/craq"
+	"github.com/3fs-storage/internal/georep"
+	"github.com/3fs-storage/internal/memory"
+	"github.com/3fs-storage/internal/rdma"
+	"github.com/3fs-storage/internal/storage"
+)
+
+// DefaultStatsInterval is how often a node logs its stats
+const DefaultStatsInterval = time.Minute
+
+// NodeStats aggregates the stats of a node's storage targets, block cache,
+// CRAQ chain, transport, request schedulers, erasure coding and
+// geo-replication. Storage
+// and scheduler totals are summed over the healthy targets.
+type NodeStats struct {
+	NodeID    string                  `json:"node_id"`
+	Timestamp int64                   `json:"timestamp"`
+	Storage   storage.Stats           `json:"storage"`
+	Chain     *craq.ChainStats        `json:"chain"`
+	Transport TransportStats          `json:"transport"`
+	Scheduler block.SchedulerStats    `json:"scheduler"`
+	Targets   map[string]*TargetStats `json:"targets"`
+	Erasure   ErasureStats            `json:"erasure"`
+	// GeoReplication reports the shipping of blocks to a remote cluster,
+	// when it is configured
+	GeoReplication *georep.Stats `json:"geo_replication,omitempty"`
+	// Memory reports the memory budget's use by consumer, when one is
+	// configured
+	Memory *memory.Stats `json:"memory,omitempty"`
+}
+
+// TargetStats reports the stats of one storage target
+type TargetStats struct {
+	Healthy   bool                  `json:"healthy"`
+	Error     string                `json:"error,omitempty"`
+	Storage   *storage.Stats        `json:"storage,omitempty"`
+	Scheduler *block.SchedulerStats `json:"scheduler,omitempty"`
+	Disk      *storage.DiskStats    `json:"disk,omitempty"`
+	Workers   *affinity.PoolStats   `json:"workers,omitempty"`
+}
+
+// TransportStats reports the node's data port. Ops breaks the requests
+// served down by operation, and Peer counts the blocks fetched between
+// nodes, apart from client traffic.
+type TransportStats struct {
+	// Kind is rdma or tcp
+	Kind           string              `json:"kind"`
+	Connections    int64               `json:"connections"`
+	Inflight       int                 `json:"inflight"`
+	RequestsServed uint64              `json:"requests_served"`
+	RequestsFailed uint64              `json:"requests_failed"`
+	Ops            map[string]*OpStats `json:"ops"`
+	Peer           PeerTrafficStats    `json:"peer"`
+	RDMA           *rdma.Stats         `json:"rdma,omitempty"`
+	Workers        *affinity.PoolStats `json:"workers,omitempty"`
+}
+
+// GetStats returns the node's stats. A target whose stats cannot be read
+// is reported with the error rather than failing the whole call.
+func (n *StorageNode) GetStats() *NodeStats {
+	stats := &NodeStats{
+		NodeID:    n.GetNodeID(),
+		Timestamp: time.Now().UnixNano(),
+		Chain:     n.craqChain.GetStats(),
+		Transport: TransportStats{
+			Kind:           "tcp",
+			Connections:    n.connections.Load(),
+			Inflight:       n.requests.count(),
+			RequestsServed: n.served.Load(),
+			RequestsFailed: n.failed.Load(),
+			Ops:            n.ops.stats(),
+			Peer:           n.peerTraffic.stats(),
+			Workers:        n.netWorkers.Stats(),
+		},
+		Targets:        make(map[string]*TargetStats, len(n.targets)),
+		Erasure:        n.erasure.stats(),
+		GeoReplication: n.geoStats(),
+		Memory:         n.memory.Stats(),
+	}
+	if n.rdmaTransport != nil {
+		stats.Transport.RDMA = n.rdmaTransport.GetStats()
+		if stats.Transport.RDMA.RDMAAvailable {
+			stats.Transport.Kind = "rdma"
+		}
+	}
+
+	for _, t := range n.targets {
+		if err := t.available(); err != nil {
+			stats.Targets[t.id] = &TargetStats{Error: err.Error()}
+			continue
+		}
+		serviceStats, err := t.service.GetStats()
+		if err != nil {
+			stats.Targets[t.id] = &TargetStats{Error: err.Error()}
+			continue
+		}
+
+		stats.Targets[t.id] = &TargetStats{
+			Healthy:   true,
+			Storage:   serviceStats.Storage,
+			Scheduler: serviceStats.Scheduler,
+			Disk:      serviceStats.Disk,
+			Workers:   serviceStats.Workers,
+		}
+		stats.Storage.Add(serviceStats.Storage)
+		stats.Scheduler.Add(serviceStats.Scheduler)
+	}
+
+	return stats
+}
+
+// logStats logs a line of node stats on an interval until ctx is done
+func (n *StorageNode) logStats(ctx context.Context) {
+	configured := time.Duration(n.cfg.Storage.Logging.StatsInterval)
+	if configured < 0 {
+		return
+	}
+	interval := DefaultStatsInterval
+	if configured > 0 {
+		interval = configured
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		stats := n.GetStats()
+		healthy := 0
+		for _, t := range stats.Targets {
+			if t.Healthy {
+				healthy++
+			}
+		}
+		n.logger.Info("node stats",
+			"used_bytes", stats.Storage.UsedBytes,
+			"capacity_bytes", stats.Storage.CapacityBytes,
+			"cached_blocks", stats.Storage.CachedBlocks,
+			"cache_hits", stats.Storage.CacheHits,
+			"cache_misses", stats.Storage.CacheMisses,
+			"chain_blocks", stats.Chain.BlockCount,
+			"connections", stats.Transport.Connections,
+			"inflight", stats.Transport.Inflight,
+			"requests_served", stats.Transport.RequestsServed,
+			"requests_failed", stats.Transport.RequestsFailed,
+			"queued", stats.Scheduler.Queued,
+			"targets", len(stats.Targets),
+			"healthy_targets", healthy)
+	}
+}
@@ -0,0 +1,577 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/craq"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/internal/ring"
+	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// DefaultTargetCheckInterval is how often each target's disk is probed
+const DefaultTargetCheckInterval = 10 * time.Second
+
+// TargetStatus reports the state of one storage target
+type TargetStatus struct {
+	ID            string   `json:"id"`
+	DataPath      string   `json:"data_path"`
+	CapacityBytes int64    `json:"capacity_bytes"`
+	UsedBytes     int64    `json:"used_bytes"`
+	Healthy       bool     `json:"healthy"`
+	Error         string   `json:"error,omitempty"`
+	FailedAt      int64    `json:"failed_at,omitempty"`
+	Chains        []uint32 `json:"chains"`
+}
+
+// target is one data directory of the node, normally a disk of its own.
+// Each target has its own storage and block service, is a chain member
+// under its own ID in the routing table, and fails independently of the
+// node's other targets.
+type target struct {
+	id       string
+	dataPath string
+	capacity int64
+	labels   map[string]string
+	mount    mountExpectation
+	storage  *storage.LocalStorage
+	service  *block.Service
+
+	recovery *storage.RecoveryReport
+	digests  digestCache
+
+	// written counts the bytes written to the target, for its write rate
+	written atomic.Int64
+
+	healthy  atomic.Bool
+	failure  string
+	failedAt int64
+	mu       sync.Mutex
+}
+
+// targetConfigs returns the node's storage targets, defaulting to a single
+// target named after the node on local.data_path
+func targetConfigs(cfg *config.Config) []config.TargetConfig {
+	local := cfg.Storage.Local
+	if len(local.Targets) == 0 {
+		return []config.TargetConfig{{
+			ID:       cfg.Storage.Node.ID,
+			DataPath: local.DataPath,
+			MaxSpace: local.MaxSpace,
+		}}
+	}
+
+	targets := make([]config.TargetConfig, 0, len(local.Targets))
+	for _, tc := range local.Targets {
+		if tc.MaxSpace <= 0 {
+			tc.MaxSpace = local.MaxSpace
+		}
+		targets = append(targets, tc)
+	}
+	return targets
+}
+
+// newTargets creates the storage and block service of each target
+func newTargets(cfg *config.Config, craqChain *craq.Chain, logger *slog.Logger) ([]*target, error) {
+	if cfg.Storage.Local.DataPath == "" {
+		return nil, errors.New("local.data_path is required to hold the node's state")
+	}
+	configs := targetConfigs(cfg)
+
+	ids := make(map[string]bool, len(configs))
+	paths := make(map[string]bool, len(configs))
+	targets := make([]*target, 0, len(configs))
+	for _, tc := range configs {
+		if tc.ID == "" {
+			return nil, errors.New("storage target ID cannot be empty")
+		}
+		if ids[tc.ID] {
+			return nil, fmt.Errorf("duplicate storage target %s", tc.ID)
+		}
+		path := filepath.Clean(tc.DataPath)
+		if paths[path] {
+			return nil, fmt.Errorf("storage target %s shares data path %s with another target", tc.ID, tc.DataPath)
+		}
+		ids[tc.ID], paths[path] = true, true
+
+		localStorage, err := storage.NewLocalStorage(tc.DataPath, int64(tc.MaxSpace))
+		if err != nil {
+			return nil, fmt.Errorf("storage target %s: %w", tc.ID, err)
+		}
+		service, err := block.NewService(localStorage, craqChain, logger.With("target", tc.ID))
+		if err != nil {
+			return nil, fmt.Errorf("storage target %s: %w", tc.ID, err)
+		}
+		if err := configureTarget(cfg.Storage.Tuning, localStorage, service); err != nil {
+			return nil, fmt.Errorf("storage target %s: %w", tc.ID, err)
+		}
+		if cfg.Storage.Compression.Dictionaries {
+			localStorage.SetDictionaryCompression(int(cfg.Storage.Compression.MaxBlockSize))
+		}
+
+		t := &target{
+			id:       tc.ID,
+			dataPath: tc.DataPath,
+			capacity: int64(tc.MaxSpace),
+			labels:   mergeLabels(cfg.Storage.Node.Labels, tc.Labels),
+			mount:    expectMount(tc),
+			storage:  localStorage,
+			service:  service,
+		}
+		t.healthy.Store(true)
+		targets = append(targets, t)
+	}
+
+	return targets, nil
+}
+
+// fail marks the target as failed, returning false if it already was
+func (t *target) fail(err error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failure = err.Error()
+	if !t.healthy.Load() {
+		return false
+	}
+	t.failedAt = time.Now().UnixNano()
+	t.healthy.Store(false)
+	return true
+}
+
+// recover marks the target as healthy, returning false if it already was
+func (t *target) recover() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.healthy.Load() {
+		return false
+	}
+	t.failure, t.failedAt = "", 0
+	t.healthy.Store(true)
+	return true
+}
+
+// available returns an error if the target has failed
+func (t *target) available() error {
+	if t.healthy.Load() {
+		return nil
+	}
+	return fmt.Errorf("storage target %s has failed", t.id)
+}
+
+// status reports the target's state and its chains in table
+func (t *target) status(table *api.RoutingTable) TargetStatus {
+	t.mu.Lock()
+	status := TargetStatus{
+		ID:            t.id,
+		DataPath:      t.dataPath,
+		CapacityBytes: t.capacity,
+		Healthy:       t.healthy.Load(),
+		Error:         t.failure,
+		FailedAt:      t.failedAt,
+		Chains:        make([]uint32, 0),
+	}
+	t.mu.Unlock()
+
+	if used, err := t.storage.GetUsedSpace(); err == nil {
+		status.UsedBytes = used
+	}
+	if table != nil {
+		for _, chain := range assignedChains(table, t.id) {
+			status.Chains = append(status.Chains, chain.ID)
+		}
+	}
+	return status
+}
+
+// Targets reports the state of each of the node's storage targets
+func (n *StorageNode) Targets() []TargetStatus {
+	table := n.RoutingTable()
+	statuses := make([]TargetStatus, 0, len(n.targets))
+	for _, t := range n.targets {
+		statuses = append(statuses, t.status(table))
+	}
+	return statuses
+}
+
+// target returns the local target with the given ID, or nil
+func (n *StorageNode) target(id string) *target {
+	for _, t := range n.targets {
+		if t.id == id {
+			return t
+		}
+	}
+	return nil
+}
+
+// isLocalTarget reports whether id names one of this node's targets
+func (n *StorageNode) isLocalTarget(id string) bool {
+	return n.target(id) != nil
+}
+
+// memberTarget returns the local target that is a member of chain, or nil
+func (n *StorageNode) memberTarget(chain *api.ChainRecord) *target {
+	for _, t := range n.targets {
+		if isMember(chain, t.id) {
+			return t
+		}
+	}
+	return nil
+}
+
+// cachedTable returns the latest routing table without copying it, for
+// lookups on the request path. The table must not be modified.
+func (n *StorageNode) cachedTable() *api.RoutingTable {
+	if n.routing != nil {
+		if table := n.routing.Table(); table != nil {
+			return table
+		}
+	}
+	if n.coordinator != nil {
+		return n.coordinator.Routing()
+	}
+	return nil
+}
+
+// targetFor returns the target that holds a block. A request may name its
+// target; otherwise the target that is a member of the block's chain holds
+// it, and blocks outside this node's chains are spread over the healthy
+// targets by consistent hashing. A failed named or member target is reported as an error
+// so that its blocks are not silently looked up elsewhere.
+func (n *StorageNode) targetFor(blockID, targetID string) (*target, error) {
+	t, err := n.locateTarget(blockID, targetID)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.available(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// locateTarget picks a block's target without checking its health
+func (n *StorageNode) locateTarget(blockID, targetID string) (*target, error) {
+	if targetID != "" {
+		if t := n.target(targetID); t != nil {
+			return t, nil
+		}
+		return nil, fmt.Errorf("unknown storage target %s", targetID)
+	}
+	if len(n.targets) == 1 {
+		return n.targets[0], nil
+	}
+
+	if table := n.cachedTable(); table != nil {
+		if t := n.memberTarget(table.ChainForBlock(blockID)); t != nil {
+			return t, nil
+		}
+	}
+
+	// Walk the target ring from the block to the first healthy target, so
+	// that a failed target only sends its own blocks elsewhere
+	var found *target
+	n.targetRing.Walk(blockID, func(id string) bool {
+		if t := n.target(id); t != nil && t.available() == nil {
+			found = t
+			return false
+		}
+		return true
+	})
+	if found == nil {
+		id, _ := n.targetRing.Locate(blockID)
+		found = n.target(id)
+	}
+	return found, nil
+}
+
+// newTargetRing returns a consistent-hash ring of a node's targets,
+// weighted by their capacity, that spreads the blocks outside the node's
+// chains over them
+func newTargetRing(targets []*target) *ring.Ring {
+	members := make([]ring.Member, len(targets))
+	for i, t := range targets {
+		members[i] = ring.Member{ID: t.id, Weight: float64(t.capacity)}
+	}
+	return ring.New(ring.DefaultVirtualNodes, members)
+}
+
+// listBlocks lists the blocks of one target, or of all healthy targets when
+// targetID is empty
+func (n *StorageNode) listBlocks(ctx context.Context, targetID, prefix string) ([]string, error) {
+	if targetID != "" {
+		t, err := n.targetFor("", targetID)
+		if err != nil {
+			return nil, err
+		}
+		return t.service.ListBlocks(ctx, prefix)
+	}
+
+	blockIDs := make([]string, 0)
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		ids, err := t.service.ListBlocks(ctx, prefix)
+		if err != nil {
+			return nil, fmt.Errorf("storage target %s: %w", t.id, err)
+		}
+		blockIDs = append(blockIDs, ids...)
+	}
+	if len(n.targets) > 1 {
+		sort.Strings(blockIDs)
+	}
+	return blockIDs, nil
+}
+
+// targetRecords returns the routing table records announcing this node's
+// targets. A node with a single default target is announced as itself.
+func (n *StorageNode) targetRecords() []*api.NodeRecord {
+	cfg := n.cfg.Storage
+	records := make([]*api.NodeRecord, 0, len(n.targets))
+	for _, t := range n.targets {
+		record := &api.NodeRecord{
+			ID:            t.id,
+			Address:       n.advertiseAddress(),
+			AdminAddress:  cfg.Admin.ListenAddress,
+			Zone:          cfg.Node.Zone,
+			Rack:          cfg.Node.Rack,
+			Hostname:      cfg.Node.Host,
+			CapacityBytes: t.capacity,
+			Labels:        t.labels,
+			Role:          cfg.Node.Role,
+		}
+		if t.id != cfg.Node.ID {
+			record.Node = cfg.Node.ID
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+// mergeLabels returns the labels of a node overridden by those of one of
+// its targets, or nil if there are none
+func mergeLabels(node, target map[string]string) map[string]string {
+	if len(node)+len(target) == 0 {
+		return nil
+	}
+	labels := make(map[string]string, len(node)+len(target))
+	for key, value := range node {
+		labels[key] = value
+	}
+	for key, value := range target {
+		labels[key] = value
+	}
+	return labels
+}
+
+// checkTargets probes each target's disk periodically until ctx is done.
+// A failed target is marked down with the coordinator so that only its
+// chains get new members; it is marked up again once its disk recovers.
+func (n *StorageNode) checkTargets(ctx context.Context) {
+	interval := DefaultTargetCheckInterval
+	if configured := time.Duration(n.cfg.Storage.Local.TargetCheckInterval); configured > 0 {
+		interval = configured
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for _, t := range n.targets {
+			n.checkTarget(ctx, t)
+		}
+	}
+}
+
+// checkTarget probes one target and reports a change in its health
+func (n *StorageNode) checkTarget(ctx context.Context, t *target) {
+	err := t.mount.check(t.dataPath)
+	if err == nil {
+		err = t.storage.CheckHealth()
+	}
+	state := api.NodeStateUp
+	if err != nil {
+		if !t.fail(err) {
+			return
+		}
+		n.logger.Error("storage target failed", "target", t.id, "path", t.dataPath, "error", err)
+		state = api.NodeStateDown
+	} else {
+		if !t.recover() {
+			return
+		}
+		n.logger.Info("storage target recovered", "target", t.id, "path", t.dataPath)
+
+		// A draining node keeps its targets draining
+		if n.IsDecommissioning() {
+			return
+		}
+	}
+
+	if n.coordinator == nil && len(n.cfg.Storage.Coordinator.Addresses) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	if err := n.setState(ctx, t.id, state); err != nil {
+		n.logger.Warn("failed to report storage target state", "target", t.id, "state", state, "error", err)
+	}
+}
+
+// initializeTargets prepares each target's storage and block service. A
+// target whose disk cannot be initialized is marked as failed so that the
+// node still serves its other targets; the node fails to start only if no
+// target is usable.
+func (n *StorageNode) initializeTargets() error {
+	var lastErr error
+	usable := 0
+	for _, t := range n.targets {
+		err := t.initialize()
+		if err != nil {
+			if len(n.targets) == 1 {
+				return fmt.Errorf("failed to initialize local storage: %w", err)
+			}
+			t.fail(err)
+			lastErr = err
+			n.logger.Error("failed to initialize storage target", "target", t.id, "path", t.dataPath, "error", err)
+			continue
+		}
+		usable++
+	}
+
+	if usable == 0 {
+		return fmt.Errorf("no usable storage target: %w", lastErr)
+	}
+	return nil
+}
+
+// initialize prepares the target's storage, replaying the write-ahead log
+// left by the previous run, and its block service
+func (t *target) initialize() error {
+	// Check the mount before creating the data directory, so that an
+	// unmounted disk's directory is not recreated on the root filesystem
+	if err := t.mount.check(t.dataPath); err != nil {
+		return err
+	}
+	if err := t.storage.Initialize(); err != nil {
+		return err
+	}
+
+	report, err := t.storage.Recover()
+	if err != nil {
+		return err
+	}
+	t.recovery = report
+
+	return t.service.Initialize()
+}
+
+// capacityBytes returns the combined capacity of the node's targets
+func (n *StorageNode) capacityBytes() int64 {
+	var capacity int64
+	for _, t := range n.targets {
+		capacity += t.capacity
+	}
+	return capacity
+}
+
+// Scrub verifies the blocks of every healthy target against their
+// checksums, reporting per target. Reads of all targets share budget.
+func (n *StorageNode) Scrub(ctx context.Context, budget *ratelimit.Limiter) (map[string]*storage.ScrubReport, error) {
+	reports := make(map[string]*storage.ScrubReport, len(n.targets))
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		report, err := t.service.Scrub(ctx, budget)
+		if report != nil {
+			reports[t.id] = report
+			n.reportCorruption(t.id, "scrub", report.Corrupted)
+		}
+		if err != nil {
+			return reports, fmt.Errorf("storage target %s: %w", t.id, err)
+		}
+	}
+	return reports, nil
+}
+
+// TrainDictionaries trains the compression dictionaries of the namespaces
+// on every healthy target, reporting per target
+func (n *StorageNode) TrainDictionaries(ctx context.Context, budget *ratelimit.Limiter) (map[string]*storage.DictionaryReport, error) {
+	cfg := n.cfg.Storage.Compression
+	opts := storage.DictionaryOptions{
+		Namespaces:   cfg.Namespaces,
+		MaxBlockSize: int(cfg.MaxBlockSize),
+		Size:         int(cfg.DictionarySize),
+		SampleSize:   int64(cfg.SampleSize),
+		MinSamples:   cfg.MinSamples,
+	}
+	reports := make(map[string]*storage.DictionaryReport, len(n.targets))
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		report, err := t.storage.TrainDictionaries(ctx, budget, opts)
+		if report != nil {
+			reports[t.id] = report
+		}
+		if err != nil {
+			return reports, fmt.Errorf("storage target %s: %w", t.id, err)
+		}
+	}
+	return reports, nil
+}
+
+// Dedup makes the blocks with the same content share a copy on every
+// healthy target, reporting per target
+func (n *StorageNode) Dedup(ctx context.Context, budget *ratelimit.Limiter) (map[string]*storage.DedupReport, error) {
+	reports := make(map[string]*storage.DedupReport, len(n.targets))
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		report, err := t.storage.Dedup(ctx, budget)
+		if report != nil {
+			reports[t.id] = report
+		}
+		if err != nil {
+			return reports, fmt.Errorf("storage target %s: %w", t.id, err)
+		}
+	}
+	return reports, nil
+}
+
+// CollectGarbage reclaims files left behind by interrupted operations on
+// every healthy target, reporting per target
+func (n *StorageNode) CollectGarbage(ctx context.Context, grace time.Duration) (map[string]*storage.GCReport, error) {
+	reports := make(map[string]*storage.GCReport, len(n.targets))
+	for _, t := range n.targets {
+		if t.available() != nil {
+			continue
+		}
+		report, err := t.service.CollectGarbage(ctx, grace)
+		if err != nil {
+			return reports, fmt.Errorf("storage target %s: %w", t.id, err)
+		}
+		reports[t.id] = report
+	}
+	return reports, nil
+}
@@ -0,0 +1,227 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/3fs-storage/internal/block"
+	"github.com/3fs-storage/internal/storage"
+	"github.com/3fs-storage/pkg/config"
+)
+
+// Tunables are the settings that can be changed while the node runs, to
+// react to an incident without a restart. Changes last until the node
+// restarts; the configuration must be updated to keep them.
+type Tunables struct {
+	// CacheMB caps the block cache of each target; zero means unlimited
+	CacheMB int `json:"cache_mb"`
+	// WriteConcurrency caps the writes and deletes each target runs at the
+	// same time
+	WriteConcurrency int `json:"write_concurrency"`
+	// ScrubBandwidthMB caps the disk reads of scrubbing, in MiB per
+	// second; zero means unlimited
+	ScrubBandwidthMB int `json:"scrub_bandwidth_mb"`
+	// RepairBandwidthMB caps re-replication traffic, in MiB per second;
+	// zero means unlimited
+	RepairBandwidthMB int `json:"repair_bandwidth_mb"`
+}
+
+// TunablesUpdate holds the tunables to change. Nil fields are left as they
+// are.
+type TunablesUpdate struct {
+	CacheMB           *int `json:"cache_mb"`
+	WriteConcurrency  *int `json:"write_concurrency"`
+	ScrubBandwidthMB  *int `json:"scrub_bandwidth_mb"`
+	RepairBandwidthMB *int `json:"repair_bandwidth_mb"`
+}
+
+// Tunables returns the current values of the node's tunables
+func (n *StorageNode) Tunables() Tunables {
+	var tunables Tunables
+	if len(n.targets) > 0 {
+		t := n.targets[0]
+		tunables.CacheMB = int(t.storage.CacheLimit() >> 20)
+		tunables.WriteConcurrency = t.service.Scheduler().MaxConcurrent(block.IOClassBulk)
+	}
+	if status, ok := n.jobs.Status(jobScrub); ok {
+		tunables.ScrubBandwidthMB = int(status.BandwidthBytes >> 20)
+	}
+	if status, ok := n.jobs.Status(jobRepair); ok {
+		tunables.RepairBandwidthMB = int(status.BandwidthBytes >> 20)
+	}
+	return tunables
+}
+
+// SetTunables validates the update and applies it right away. Nothing is
+// changed if any value is invalid.
+func (n *StorageNode) SetTunables(update TunablesUpdate) (Tunables, error) {
+	n.tunablesMu.Lock()
+	defer n.tunablesMu.Unlock()
+
+	if err := n.validateTunables(update); err != nil {
+		return n.Tunables(), err
+	}
+
+	if update.CacheMB != nil {
+		for _, t := range n.targets {
+			t.storage.SetCacheLimit(int64(*update.CacheMB) << 20)
+		}
+	}
+	if update.WriteConcurrency != nil {
+		for _, t := range n.targets {
+			if err := t.service.Scheduler().SetMaxConcurrent(block.IOClassBulk, *update.WriteConcurrency); err != nil {
+				return n.Tunables(), err
+			}
+		}
+	}
+	if update.ScrubBandwidthMB != nil {
+		if err := n.jobs.SetBandwidth(jobScrub, int64(*update.ScrubBandwidthMB)<<20); err != nil {
+			return n.Tunables(), err
+		}
+	}
+	if update.RepairBandwidthMB != nil {
+		if err := n.jobs.SetBandwidth(jobRepair, int64(*update.RepairBandwidthMB)<<20); err != nil {
+			return n.Tunables(), err
+		}
+	}
+
+	tunables := n.Tunables()
+	n.logger.Info("tunables changed", "cache_mb", tunables.CacheMB, "write_concurrency", tunables.WriteConcurrency,
+		"scrub_bandwidth_mb", tunables.ScrubBandwidthMB, "repair_bandwidth_mb", tunables.RepairBandwidthMB)
+	return tunables, nil
+}
+
+// validateTunables checks every value of an update
+func (n *StorageNode) validateTunables(update TunablesUpdate) error {
+	if update.CacheMB != nil && *update.CacheMB < 0 {
+		return errors.New("cache_mb cannot be negative")
+	}
+	if update.WriteConcurrency != nil {
+		if err := n.validateWriteConcurrency(*update.WriteConcurrency); err != nil {
+			return err
+		}
+	}
+	if update.ScrubBandwidthMB != nil && *update.ScrubBandwidthMB < 0 {
+		return errors.New("scrub_bandwidth_mb cannot be negative")
+	}
+	if update.RepairBandwidthMB != nil {
+		if *update.RepairBandwidthMB < 0 {
+			return errors.New("repair_bandwidth_mb cannot be negative")
+		}
+		if _, ok := n.jobs.Status(jobRepair); !ok {
+			return errors.New("repair requires a coordinator")
+		}
+	}
+	return nil
+}
+
+// validateWriteConcurrency checks a write concurrency limit against the
+// schedulers of the node's targets
+func (n *StorageNode) validateWriteConcurrency(limit int) error {
+	for _, t := range n.targets {
+		if err := checkWriteConcurrency(limit, t.service.Scheduler()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkWriteConcurrency checks a write concurrency limit against the
+// requests a scheduler runs at a time
+func checkWriteConcurrency(limit int, scheduler *block.Scheduler) error {
+	if limit <= 0 {
+		return errors.New("write_concurrency must be greater than zero")
+	}
+	if max := scheduler.MaxInflight(); limit > max {
+		return fmt.Errorf("write_concurrency cannot exceed the %d requests a target runs at a time", max)
+	}
+	return nil
+}
+
+// configureTarget applies the tuning settings to a new target: its cache
+// limit, IO workers, write concurrency, disk scheduling, fsync policy and
+// direct IO
+func configureTarget(tuning config.TuningConfig, localStorage *storage.LocalStorage, service *block.Service) error {
+	if tuning.CacheSize < 0 {
+		return errors.New("cache_size cannot be negative")
+	}
+	localStorage.SetCacheLimit(int64(tuning.CacheSize))
+
+	if err := localStorage.SetSyncPolicy(storage.SyncPolicy(tuning.FSync)); err != nil {
+		return err
+	}
+	if err := localStorage.SetDirectIO(tuning.DirectIO); err != nil {
+		return err
+	}
+	if err := configureDisk(tuning, localStorage); err != nil {
+		return err
+	}
+
+	if tuning.IOWorkers > 0 && tuning.IOWorkers != service.Scheduler().MaxInflight() {
+		scheduler, err := block.NewScheduler(tuning.IOWorkers, block.ClassLimitsFor(tuning.IOWorkers))
+		if err != nil {
+			return fmt.Errorf("invalid io_workers: %w", err)
+		}
+		service.SetScheduler(scheduler)
+	}
+
+	if tuning.WriteConcurrency == 0 {
+		return nil
+	}
+	if err := checkWriteConcurrency(tuning.WriteConcurrency, service.Scheduler()); err != nil {
+		return err
+	}
+	return service.Scheduler().SetMaxConcurrent(block.IOClassBulk, tuning.WriteConcurrency)
+}
+
+// configureDisk replaces a target's disk scheduler with one set up by the
+// tuning settings; those left unset keep their defaults
+func configureDisk(tuning config.TuningConfig, localStorage *storage.LocalStorage) error {
+	limits := storage.DefaultDiskLimits()
+	if tuning.DiskQueueDepth > 0 {
+		limits.QueueDepth = tuning.DiskQueueDepth
+	}
+	if tuning.BackgroundDiskOps > 0 {
+		limits.MaxBackground = tuning.BackgroundDiskOps
+	}
+	limits.Deadlines[storage.DiskRead] = time.Duration(tuning.ReadDeadline)
+	limits.Deadlines[storage.DiskWrite] = time.Duration(tuning.WriteDeadline)
+	limits.Deadlines[storage.DiskBackground] = time.Duration(tuning.BackgroundDeadline)
+
+	scheduler, err := storage.NewDiskScheduler(limits)
+	if err != nil {
+		return fmt.Errorf("invalid disk scheduling: %w", err)
+	}
+	localStorage.SetDiskScheduler(scheduler)
+	return nil
+}
+
+// handleTunables reports (GET) or changes (PUT) the node's tunables. A PUT
+// body only needs the tunables to change.
+func (a *adminServer) handleTunables(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPut) {
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var update TunablesUpdate
+		decoder := json.NewDecoder(r.Body)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&update); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid tunables: %w", err))
+			return
+		}
+		tunables, err := a.node.SetTunables(update)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, tunables)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, a.node.Tunables())
+}
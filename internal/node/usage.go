@@ -0,0 +1,138 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/3fs-storage/internal/coordinator"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/internal/usage"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultUsageMeasureInterval is how often the bytes each namespace stores
+// on the node are measured
+const DefaultUsageMeasureInterval = 15 * time.Minute
+
+// UsageMeasurement is the result of a pass of the usage job
+type UsageMeasurement struct {
+	Namespaces int   `json:"namespaces"`
+	Blocks     int   `json:"blocks"`
+	Bytes      int64 `json:"bytes"`
+}
+
+// meterRequest counts a client's request in the usage of its namespace.
+// Requests members send each other carry a fencing token and are not
+// counted, so that a write is counted once, on the head.
+func (n *StorageNode) meterRequest(req *api.Request, resp *api.Response, in int) {
+	if req.Headers[api.FenceHeader] != "" {
+		return
+	}
+	namespace := api.Namespace(req.BlockID)
+	if req.Op == api.OpList {
+		namespace = api.Namespace(req.Prefix)
+	}
+	n.meter.Record(namespace, req.Op, in, len(resp.Data))
+}
+
+// measureUsage measures the bytes and blocks each namespace stores on the
+// node's targets
+func (n *StorageNode) measureUsage(ctx context.Context) (*UsageMeasurement, error) {
+	held, err := n.Usage("")
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	stored := make(map[string]api.NamespaceUsage, len(held.Namespaces))
+	for namespace, u := range held.Namespaces {
+		stored[namespace] = api.NamespaceUsage{StoredBytes: u.Bytes, Blocks: int64(u.Blocks)}
+	}
+	n.meter.SetStored(stored)
+	return &UsageMeasurement{Namespaces: len(stored), Blocks: held.Blocks, Bytes: held.Bytes}, nil
+}
+
+// startUsageReports measures the node's usage once, and reports it to the
+// embedded or configured coordinator every report interval
+func (n *StorageNode) startUsageReports() error {
+	n.jobs.Trigger(jobUsage)
+	if n.coordinator == nil && len(n.cfg.Storage.Coordinator.Addresses) == 0 {
+		return nil
+	}
+	client, err := n.coordinatorClient()
+	if err != nil {
+		return err
+	}
+	go n.reportUsage(n.ctx, client, time.Duration(n.cfg.Storage.Usage.ReportInterval))
+	return nil
+}
+
+// reportUsage sends the node's usage report every interval until ctx is
+// done
+func (n *StorageNode) reportUsage(ctx context.Context, client *coordinator.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report := n.meter.Report(n.GetNodeID())
+		var err error
+		if coord := n.leaderCoordinator(); coord != nil {
+			err = coord.RecordUsage(report)
+		} else {
+			sendCtx, cancel := context.WithTimeout(ctx, interval)
+			err = client.ReportUsage(sendCtx, report)
+			cancel()
+		}
+		if err != nil && ctx.Err() == nil {
+			n.logger.Warn("failed to report usage", "error", err)
+		}
+	}
+}
+
+// NamespaceUsage returns the use of each namespace since the node started,
+// with the bytes they store on it as last measured
+func (n *StorageNode) NamespaceUsage() *api.UsageReport {
+	return n.meter.Report(n.GetNodeID())
+}
+
+// registerUsageExport registers the job exporting the windows of the
+// embedded coordinator's usage ledger to the configured sinks, which runs
+// on the coordinator leader only
+func (n *StorageNode) registerUsageExport(coord *coordinator.Coordinator, ledger *usage.Ledger, dir string) error {
+	cfg := n.cfg.Storage.Usage.Export
+	var sinks []usage.Sink
+	if cfg.CSV != "" {
+		sinks = append(sinks, usage.NewCSVSink(cfg.CSV))
+	}
+	if cfg.Webhook != "" {
+		sinks = append(sinks, usage.NewWebhookSink(cfg.Webhook, cfg.WebhookToken))
+	}
+	if len(sinks) == 0 {
+		return nil
+	}
+
+	exporter, err := usage.NewExporter(ledger, time.Duration(cfg.Window), sinks, filepath.Join(dir, "usage-export.json"), n.logger)
+	if err != nil {
+		return fmt.Errorf("failed to start usage export: %w", err)
+	}
+	n.jobs.register(JobSpec{
+		Name:     jobUsageExport,
+		Interval: time.Duration(cfg.Interval),
+		Run: func(ctx context.Context, _ *ratelimit.Limiter) (interface{}, error) {
+			if !coord.IsLeader() {
+				return nil, nil
+			}
+			return exporter.Export(ctx)
+		},
+	})
+	return nil
+}
@@ -0,0 +1,260 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/3fs-storage/internal/writeback"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// writeBackDir is the default directory of the write-back buffer in the
+// node's data path
+const writeBackDir = "writeback"
+
+// writeBack acknowledges small client writes once they are synced to the
+// write-back buffer, and flushes them to their targets, and on to their
+// chains, in batches
+type writeBack struct {
+	buffer       *writeback.Buffer
+	maxBlockSize int
+	batchSize    int
+	interval     time.Duration
+}
+
+// startWriteBack opens the write-back buffer when it is enabled. Writes
+// left in it by the previous run are flushed along with new ones once the
+// flush loop starts.
+func (n *StorageNode) startWriteBack() error {
+	cfg := n.cfg.Storage.WriteBack
+	if !cfg.Enabled {
+		return nil
+	}
+	dir := cfg.Path
+	if dir == "" {
+		dir = filepath.Join(n.cfg.Storage.Local.DataPath, writeBackDir)
+	}
+	buffer, err := writeback.Open(dir, writeback.Options{MaxBytes: int64(cfg.MaxSize), Budget: n.memory})
+	if err != nil {
+		return fmt.Errorf("failed to open write-back buffer: %w", err)
+	}
+	n.writeBack = &writeBack{
+		buffer:       buffer,
+		maxBlockSize: int(cfg.MaxBlockSize),
+		batchSize:    cfg.BatchSize,
+		interval:     time.Duration(cfg.FlushInterval),
+	}
+	if pending := buffer.Len(); pending > 0 {
+		n.logger.Info("write-back buffer holds writes of the previous run", "pending", pending)
+	}
+	return nil
+}
+
+// stopWriteBack flushes what it can of the write-back buffer within the
+// drain timeout and closes it; what is left is flushed on the next start
+func (n *StorageNode) stopWriteBack() {
+	if n.writeBack == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(n.cfg.Storage.Node.DrainTimeout))
+	defer cancel()
+	if err := n.flushWriteBack(ctx, true); err != nil {
+		n.logger.Warn("failed to flush write-back buffer", "error", err, "pending", n.writeBack.buffer.Len())
+	}
+	if err := n.writeBack.buffer.Close(); err != nil {
+		n.logger.Warn("failed to close write-back buffer", "error", err)
+	}
+}
+
+// bufferWrite buffers a client's write, reporting whether it did. Writes
+// replicated from other nodes, writes larger than the buffer takes and
+// writes to namespaces asking for strong consistency are made directly,
+// as are writes arriving while the buffer is full.
+func (n *StorageNode) bufferWrite(t *target, req *api.Request) (bool, error) {
+	wb := n.writeBack
+	if wb == nil || len(req.Data) > wb.maxBlockSize {
+		return false, nil
+	}
+	if _, ok := req.Headers[api.FenceHeader]; ok {
+		return false, nil
+	}
+	if _, consistency := n.replicationOf(n.cachedTable(), req.BlockID); consistency == api.ConsistencyStrong {
+		return false, nil
+	}
+	ok, err := wb.buffer.Append(req.BlockID, t.id, req.Data)
+	if err != nil {
+		return false, fmt.Errorf("failed to buffer write: %w", err)
+	}
+	return ok, nil
+}
+
+// bufferedData returns the data of a block's buffered write, if any, so
+// that a client reads its own writes before they are flushed
+func (n *StorageNode) bufferedData(blockID string) ([]byte, bool) {
+	if n.writeBack == nil {
+		return nil, false
+	}
+	e, ok := n.writeBack.buffer.Get(blockID)
+	if !ok {
+		return nil, false
+	}
+	return e.Data, true
+}
+
+// bufferedBlocks adds the blocks with buffered writes to a target, or to
+// any target when targetID is empty, to a listing
+func (n *StorageNode) bufferedBlocks(targetID, prefix string, blockIDs []string) []string {
+	if n.writeBack == nil {
+		return blockIDs
+	}
+	added := false
+	seen := make(map[string]bool, len(blockIDs))
+	for _, id := range blockIDs {
+		seen[id] = true
+	}
+	for _, t := range n.targets {
+		if targetID != "" && t.id != targetID {
+			continue
+		}
+		for _, id := range n.writeBack.buffer.Blocks(t.id, prefix) {
+			if !seen[id] {
+				seen[id] = true
+				blockIDs = append(blockIDs, id)
+				added = true
+			}
+		}
+	}
+	if added {
+		sort.Strings(blockIDs)
+	}
+	return blockIDs
+}
+
+// settleWrite flushes the buffered write of a block, if any, before the
+// block is read with its metadata or written directly, so that operations
+// on the block keep their order
+func (n *StorageNode) settleWrite(ctx context.Context, blockID string) error {
+	if n.writeBack == nil {
+		return nil
+	}
+	e := n.writeBack.buffer.Claim(blockID)
+	if e == nil {
+		return nil
+	}
+	if err := n.applyBuffered(ctx, e); err != nil {
+		n.writeBack.buffer.Release([]*writeback.Entry{e})
+		return err
+	}
+	return n.writeBack.buffer.Done([]*writeback.Entry{e})
+}
+
+// flushWriteBackLoop flushes the buffer every flush interval, or as soon
+// as a batch is buffered
+func (n *StorageNode) flushWriteBackLoop(ctx context.Context) {
+	wb := n.writeBack
+	ticker := time.NewTicker(wb.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-wb.buffer.Notify():
+			if wb.buffer.Len() < wb.batchSize {
+				continue
+			}
+		}
+		if err := n.flushWriteBack(ctx, false); err != nil && ctx.Err() == nil {
+			n.logger.Warn("failed to flush write-back buffer", "error", err, "pending", wb.buffer.Len())
+		}
+	}
+}
+
+// flushWriteBack writes buffered writes to their targets, a batch at a
+// time, until the buffer is empty, or with all unset until less than a
+// batch is left. A batch that cannot be written entirely stops the flush;
+// the writes that failed are retried on the next one.
+func (n *StorageNode) flushWriteBack(ctx context.Context, all bool) error {
+	wb := n.writeBack
+	for ctx.Err() == nil {
+		batch := wb.buffer.Next(wb.batchSize)
+		if len(batch) == 0 {
+			return nil
+		}
+		done := make([]*writeback.Entry, 0, len(batch))
+		failed := make([]*writeback.Entry, 0)
+		var firstErr error
+		for _, e := range batch {
+			if err := n.applyBuffered(ctx, e); err != nil {
+				failed = append(failed, e)
+				if firstErr == nil {
+					firstErr = fmt.Errorf("block %s: %w", e.BlockID, err)
+				}
+				continue
+			}
+			done = append(done, e)
+		}
+		wb.buffer.Release(failed)
+		if err := wb.buffer.Done(done); err != nil {
+			return err
+		}
+		if firstErr != nil {
+			return firstErr
+		}
+		if !all && wb.buffer.Len() < wb.batchSize {
+			return nil
+		}
+	}
+	return ctx.Err()
+}
+
+// applyBuffered writes a buffered write to its target as a client's write
+// is written: published, journaled for geo-replication and recorded in
+// the change log
+func (n *StorageNode) applyBuffered(ctx context.Context, e *writeback.Entry) error {
+	t := n.target(e.Target)
+	if t == nil {
+		var err error
+		if t, err = n.targetFor(e.BlockID, ""); err != nil {
+			return err
+		}
+	} else if err := t.available(); err != nil {
+		return err
+	}
+
+	req := &api.Request{Op: api.OpWrite, BlockID: e.BlockID, Data: e.Data}
+	existed := n.blockExists(t, e.BlockID)
+	if err := t.service.WriteBlock(ctx, e.BlockID, e.Data); err != nil {
+		return err
+	}
+	t.written.Add(int64(len(e.Data)))
+	n.publishWrite(ctx, t, e.BlockID, existed)
+	if err := n.journalGeo(t, req); err != nil {
+		return err
+	}
+	return n.logChange(ctx, t, req, existed)
+}
+
+// handleWriteBack serves the write-back buffer's stats, and flushes it
+// on POST
+func (a *adminServer) handleWriteBack(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	wb := a.node.writeBack
+	if wb == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("the write-back buffer is disabled"))
+		return
+	}
+	if r.Method == http.MethodPost {
+		if err := a.node.flushWriteBack(r.Context(), true); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, wb.buffer.Stats())
+}
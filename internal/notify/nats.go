@@ -0,0 +1,193 @@
+package notify
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// defaultNATSPort is the port of a NATS server whose URL names none
+const defaultNATSPort = "4222"
+
+// natsSink publishes each event to a NATS subject, the sink's subject
+// followed by the event's type, over the NATS client protocol. The
+// connection is made on first use and made again after it fails. Each
+// publish is followed by a PING, so that an event only counts as sent once
+// the server answered.
+type natsSink struct {
+	address  string
+	subject  string
+	token    string
+	user     string
+	password string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// natsConnect is the CONNECT message of the client protocol
+type natsConnect struct {
+	Verbose   bool   `json:"verbose"`
+	Pedantic  bool   `json:"pedantic"`
+	Name      string `json:"name"`
+	Lang      string `json:"lang"`
+	Version   string `json:"version"`
+	AuthToken string `json:"auth_token,omitempty"`
+	User      string `json:"user,omitempty"`
+	Pass      string `json:"pass,omitempty"`
+}
+
+// newNATSSink creates a sink publishing under subject to the server at a
+// nats:// URL, which may carry a token or a user and password
+func newNATSSink(rawURL, subject, token string) (*natsSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "nats" || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q", redactURL(rawURL))
+	}
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), defaultNATSPort)
+	}
+	sink := &natsSink{address: address, subject: subject, token: token}
+	// As with NATS clients, a user without a password is a token
+	if password, ok := u.User.Password(); ok {
+		sink.user, sink.password = u.User.Username(), password
+	} else if u.User != nil && token == "" {
+		sink.token = u.User.Username()
+	}
+	return sink, nil
+}
+
+// Name identifies the sink
+func (s *natsSink) Name() string {
+	return "nats " + s.subject
+}
+
+// Send publishes an event and waits for the server to answer a PING
+func (s *natsSink) Send(ctx context.Context, event *api.ClusterEvent) error {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		if err := s.connect(ctx); err != nil {
+			return err
+		}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		s.conn.SetDeadline(deadline)
+	}
+
+	subject := s.subject + "." + event.Type
+	msg := fmt.Sprintf("PUB %s %d\r\n%s\r\nPING\r\n", subject, len(payload), payload)
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		s.closeConn()
+		return fmt.Errorf("failed to publish event: %w", err)
+	}
+	if err := s.awaitPong(); err != nil {
+		s.closeConn()
+		return err
+	}
+	return nil
+}
+
+// connect dials the server, reads its INFO and sends CONNECT. Must be
+// called with the lock held.
+func (s *natsSink) connect(ctx context.Context) error {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", s.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS server %s: %w", s.address, err)
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	s.conn = conn
+	s.reader = bufio.NewReader(conn)
+
+	line, err := s.reader.ReadString('\n')
+	if err != nil {
+		s.closeConn()
+		return fmt.Errorf("failed to read NATS server info: %w", err)
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		s.closeConn()
+		return fmt.Errorf("unexpected NATS server greeting %q", strings.TrimSpace(line))
+	}
+
+	connect, err := json.Marshal(natsConnect{
+		Name:      "3fs-storage",
+		Lang:      "go",
+		Version:   "1.0",
+		AuthToken: s.token,
+		User:      s.user,
+		Pass:      s.password,
+	})
+	if err != nil {
+		s.closeConn()
+		return fmt.Errorf("failed to marshal NATS connect: %w", err)
+	}
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		s.closeConn()
+		return fmt.Errorf("failed to connect to NATS server %s: %w", s.address, err)
+	}
+	if err := s.awaitPong(); err != nil {
+		s.closeConn()
+		return err
+	}
+	return nil
+}
+
+// awaitPong reads the server's messages until it answers a PING, replying
+// to its own PINGs. Must be called with the lock held.
+func (s *natsSink) awaitPong() error {
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("failed to read from NATS server: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "PONG":
+			return nil
+		case line == "PING":
+			if _, err := s.conn.Write([]byte("PONG\r\n")); err != nil {
+				return fmt.Errorf("failed to answer NATS server: %w", err)
+			}
+		case line == "+OK", strings.HasPrefix(line, "INFO "):
+		case strings.HasPrefix(line, "-ERR"):
+			return errors.New("NATS server error: " + strings.Trim(strings.TrimPrefix(line, "-ERR"), " '"))
+		default:
+			return fmt.Errorf("unexpected NATS server message %q", line)
+		}
+	}
+}
+
+// closeConn closes the connection, to be made again on the next event.
+// Must be called with the lock held.
+func (s *natsSink) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+	}
+}
+
+// Close closes the connection to the server
+func (s *natsSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeConn()
+	return nil
+}
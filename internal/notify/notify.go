@@ -0,0 +1,261 @@
+// Package notify publishes cluster events, such as node failures, chain
+// reconfigurations and corrupted blocks, to external sinks: webhooks, Kafka
+// through its REST proxy, and NATS. Each sink has a queue of its own, so a
+// slow or unreachable sink neither holds up the node nor the other sinks;
+// it loses the events that do not fit in its queue.
+package notify
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/internal/logging"
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/config"
+)
+
+const (
+	// DefaultBuffer is how many events may wait for a sink
+	DefaultBuffer = 1024
+	// sendTimeout bounds one attempt to send an event
+	sendTimeout = 10 * time.Second
+	// maxAttempts is how many times an event is sent before it is dropped
+	maxAttempts = 3
+	// retryBackoff is the wait before the second attempt, doubled for each
+	// further one
+	retryBackoff = time.Second
+	// closeTimeout bounds how long closing waits for queued events
+	closeTimeout = 5 * time.Second
+)
+
+// Sink sends events to an external system
+type Sink interface {
+	// Name identifies the sink in logs and stats
+	Name() string
+	Send(ctx context.Context, event *api.ClusterEvent) error
+	Close() error
+}
+
+// SinkStats reports the events a sink was sent
+type SinkStats struct {
+	Name   string `json:"name"`
+	Queued int    `json:"queued"`
+	Sent   int64  `json:"sent"`
+	// Failed counts the events dropped after every attempt failed, and
+	// Dropped those that did not fit in the queue
+	Failed  int64 `json:"failed"`
+	Dropped int64 `json:"dropped"`
+}
+
+// queue holds the events waiting for a sink
+type queue struct {
+	sink Sink
+	// types are the event types sent to the sink; nil sends every type
+	types   map[string]bool
+	events  chan api.ClusterEvent
+	sent    atomic.Int64
+	failed  atomic.Int64
+	dropped atomic.Int64
+}
+
+// Notifier publishes events to its sinks. A nil notifier drops events, so
+// that callers need not check whether events are configured.
+type Notifier struct {
+	source string
+	queues []*queue
+	logger *slog.Logger
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// New creates a notifier sending the events published by source to the
+// configured sinks, or nil if none is configured
+func New(cfg config.EventsConfig, source string, logger *slog.Logger) (*Notifier, error) {
+	if len(cfg.Sinks) == 0 {
+		return nil, nil
+	}
+	buffer := cfg.Buffer
+	if buffer <= 0 {
+		buffer = DefaultBuffer
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &Notifier{
+		source: source,
+		logger: logging.Component(logger, "notify"),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	for _, sc := range cfg.Sinks {
+		sink, err := newSink(sc)
+		if err != nil {
+			n.Close()
+			return nil, err
+		}
+		q := &queue{sink: sink, events: make(chan api.ClusterEvent, buffer)}
+		if len(sc.Events) > 0 {
+			q.types = make(map[string]bool, len(sc.Events))
+			for _, t := range sc.Events {
+				q.types[t] = true
+			}
+		}
+		n.queues = append(n.queues, q)
+	}
+	for _, q := range n.queues {
+		n.wg.Add(1)
+		go n.deliver(q)
+	}
+	return n, nil
+}
+
+// newSink creates the sink a configuration describes
+func newSink(sc config.EventSinkConfig) (Sink, error) {
+	switch sc.Type {
+	case "webhook":
+		return newWebhookSink(sc.URL, sc.Token), nil
+	case "kafka":
+		return newKafkaSink(sc.URL, sc.Topic, sc.Token), nil
+	case "nats":
+		return newNATSSink(sc.URL, sc.Subject, sc.Token)
+	default:
+		return nil, fmt.Errorf("unknown event sink type %q", sc.Type)
+	}
+}
+
+// Publish queues an event for the sinks that take its type, with an ID,
+// the notifier's source and the current time. It never blocks: a sink
+// whose queue is full loses the event.
+func (n *Notifier) Publish(event api.ClusterEvent) {
+	if n == nil {
+		return
+	}
+	event.ID = newEventID()
+	event.Source = n.source
+	if event.Time == 0 {
+		event.Time = time.Now().UnixNano()
+	}
+
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	if n.closed {
+		return
+	}
+	for _, q := range n.queues {
+		if q.types != nil && !q.types[event.Type] {
+			continue
+		}
+		select {
+		case q.events <- event:
+		default:
+			q.dropped.Add(1)
+			n.logger.Warn("event sink queue full, dropping event", "sink", q.sink.Name(), "type", event.Type)
+		}
+	}
+}
+
+// deliver sends a sink its queued events until the queue is closed
+func (n *Notifier) deliver(q *queue) {
+	defer n.wg.Done()
+	for event := range q.events {
+		if err := n.send(q.sink, &event); err != nil {
+			q.failed.Add(1)
+			n.logger.Warn("failed to send event", "sink", q.sink.Name(), "type", event.Type, "id", event.ID, "error", err)
+			continue
+		}
+		q.sent.Add(1)
+	}
+}
+
+// send sends an event, retrying with a backoff
+func (n *Notifier) send(sink Sink, event *api.ClusterEvent) error {
+	backoff := retryBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(n.ctx, sendTimeout)
+		err = sink.Send(ctx, event)
+		cancel()
+		if err == nil || attempt == maxAttempts {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-n.ctx.Done():
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// Stats reports the events each sink was sent
+func (n *Notifier) Stats() []SinkStats {
+	if n == nil {
+		return []SinkStats{}
+	}
+	stats := make([]SinkStats, 0, len(n.queues))
+	for _, q := range n.queues {
+		stats = append(stats, SinkStats{
+			Name:    q.sink.Name(),
+			Queued:  len(q.events),
+			Sent:    q.sent.Load(),
+			Failed:  q.failed.Load(),
+			Dropped: q.dropped.Load(),
+		})
+	}
+	return stats
+}
+
+// Close stops taking events, gives the sinks a bounded time to be sent
+// those queued, and closes them
+func (n *Notifier) Close() error {
+	if n == nil {
+		return nil
+	}
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return nil
+	}
+	n.closed = true
+	for _, q := range n.queues {
+		close(q.events)
+	}
+	n.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(closeTimeout):
+		n.cancel()
+		<-done
+	}
+	n.cancel()
+
+	var firstErr error
+	for _, q := range n.queues {
+		if err := q.sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// newEventID returns a random event ID
+func newEventID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
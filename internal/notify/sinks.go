@@ -0,0 +1,154 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// webhookSink posts each event to a URL as JSON
+type webhookSink struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// newWebhookSink creates a sink posting to url, presenting token as a
+// bearer token if it is set
+func newWebhookSink(url, token string) *webhookSink {
+	return &webhookSink{url: url, token: token, http: &http.Client{}}
+}
+
+// Name identifies the sink
+func (s *webhookSink) Name() string {
+	return "webhook " + redactURL(s.url)
+}
+
+// Send posts an event, failing unless the webhook accepts it
+func (s *webhookSink) Send(ctx context.Context, event *api.ClusterEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	_, err = post(ctx, s.http, s.url, "application/json", s.token, body)
+	return err
+}
+
+// Close releases the sink's connections
+func (s *webhookSink) Close() error {
+	s.http.CloseIdleConnections()
+	return nil
+}
+
+// kafkaSink produces each event to a Kafka topic through a Kafka REST
+// proxy, keyed by the node that published it so that the events of a node
+// stay in order
+type kafkaSink struct {
+	url   string
+	topic string
+	token string
+	http  *http.Client
+}
+
+// kafkaRecords is the body of a produce request to the REST proxy
+type kafkaRecords struct {
+	Records []kafkaRecord `json:"records"`
+}
+
+// kafkaRecord is a record produced through the REST proxy
+type kafkaRecord struct {
+	Key   string            `json:"key"`
+	Value *api.ClusterEvent `json:"value"`
+}
+
+// kafkaOffsets is the REST proxy's answer to a produce request, with an
+// error for each record that was not produced
+type kafkaOffsets struct {
+	Offsets []struct {
+		Error string `json:"error"`
+	} `json:"offsets"`
+}
+
+// newKafkaSink creates a sink producing to topic through the REST proxy at
+// url
+func newKafkaSink(url, topic, token string) *kafkaSink {
+	return &kafkaSink{url: strings.TrimSuffix(url, "/"), topic: topic, token: token, http: &http.Client{}}
+}
+
+// Name identifies the sink
+func (s *kafkaSink) Name() string {
+	return "kafka " + s.topic
+}
+
+// Send produces an event, failing unless the proxy produced it
+func (s *kafkaSink) Send(ctx context.Context, event *api.ClusterEvent) error {
+	body, err := json.Marshal(kafkaRecords{Records: []kafkaRecord{{Key: event.Source, Value: event}}})
+	if err != nil {
+		return fmt.Errorf("failed to marshal event: %w", err)
+	}
+	resp, err := post(ctx, s.http, s.url+"/topics/"+url.PathEscape(s.topic), "application/vnd.kafka.json.v2+json", s.token, body)
+	if err != nil {
+		return err
+	}
+	var offsets kafkaOffsets
+	if err := json.Unmarshal(resp, &offsets); err != nil {
+		return fmt.Errorf("failed to parse Kafka REST proxy response: %w", err)
+	}
+	for _, offset := range offsets.Offsets {
+		if offset.Error != "" {
+			return fmt.Errorf("failed to produce event: %s", offset.Error)
+		}
+	}
+	return nil
+}
+
+// Close releases the sink's connections
+func (s *kafkaSink) Close() error {
+	s.http.CloseIdleConnections()
+	return nil
+}
+
+// post sends a body to a URL and returns the response body, failing unless
+// the status is 2xx
+func post(ctx context.Context, client *http.Client, url, contentType, token string, body []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", contentType)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send event: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("%s answered %s: %s", redactURL(url), resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+// redactURL returns a URL without its user information and query, which
+// may hold credentials
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "invalid URL"
+	}
+	u.User = nil
+	u.RawQuery = ""
+	return u.String()
+}
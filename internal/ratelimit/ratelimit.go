@@ -0,0 +1,152 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// maxWait bounds each sleep of a waiting request, so that a rate raised
+// while it waits takes effect soon
+const maxWait = time.Second
+
+// Limiter is a token bucket. Tokens accrue at a fixed rate up to the
+// bucket's burst size, and each admitted unit of work consumes tokens.
+type Limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+	mu     sync.Mutex
+}
+
+// New creates a limiter that admits rate tokens per second with bursts of
+// up to burst tokens. A rate of zero or less disables limiting.
+func New(rate float64, burst int) *Limiter {
+	b := burstSize(rate, burst)
+	return &Limiter{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+		last:   time.Now(),
+	}
+}
+
+// burstSize returns the burst size of a limiter, defaulting to one second
+// of tokens
+func burstSize(rate float64, burst int) float64 {
+	if burst <= 0 {
+		burst = int(rate)
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return float64(burst)
+}
+
+// SetRate changes the rate and burst size of the limiter. Waiting requests
+// are paced by the new rate from now on. A rate of zero or less disables
+// limiting.
+func (l *Limiter) SetRate(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+	l.rate = rate
+	l.burst = burstSize(rate, burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// Rate returns the tokens admitted per second, zero or less meaning
+// unlimited
+func (l *Limiter) Rate() float64 {
+	if l == nil {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.rate
+}
+
+// unlimited reports whether the limiter admits everything. Must be called
+// with the lock held.
+func (l *Limiter) unlimited() bool {
+	return l.rate <= 0
+}
+
+// refill adds the tokens accrued since the last call. Must be called with
+// the lock held.
+func (l *Limiter) refill(now time.Time) {
+	if l.unlimited() {
+		l.last = now
+		return
+	}
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+}
+
+// AllowN consumes n tokens if they are available right now
+func (l *Limiter) AllowN(n int) bool {
+	if l == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.unlimited() {
+		return true
+	}
+	l.refill(time.Now())
+	if l.tokens < float64(n) {
+		return false
+	}
+	l.tokens -= float64(n)
+	return true
+}
+
+// WaitN blocks until n tokens are available or ctx is done. Requests larger
+// than the burst size are admitted once the bucket is full, leaving it in
+// debt, so that large units of work are slowed rather than refused.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+
+	for {
+		l.mu.Lock()
+		if l.unlimited() {
+			l.mu.Unlock()
+			return nil
+		}
+		need := float64(n)
+		if need > l.burst {
+			need = l.burst
+		}
+		l.refill(time.Now())
+		if l.tokens >= need {
+			l.tokens -= float64(n)
+			l.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((need - l.tokens) / l.rate * float64(time.Second))
+		if wait > maxWait {
+			wait = maxWait
+		}
+		l.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"net"
 	"sync"
 	"time"
+
+	"github.com/3fs-storage/internal/logging"
 )
 
 // ConnectionState represents the state of an RDMA connection
@@ -24,6 +27,9 @@ const (
 	ConnectionStateError
 )
 
+// ConnHandler serves an accepted connection
+type ConnHandler func(conn net.Conn)
+
 // Connection represents an RDMA connection to a remote node
 type Connection struct {
 	Address      string
@@ -38,15 +44,17 @@ type Transport struct {
 	connections     map[string]*Connection
 	isRDMAAvailable bool
 	listener        net.Listener
+	handler         ConnHandler
+	logger          *slog.Logger
 	ctx             context.Context
 	cancel          context.CancelFunc
 	mu              sync.RWMutex
 }
 
 // NewTransport creates a new RDMA transport
-func NewTransport(ctx context.Context) (*Transport, error) {
+func NewTransport(ctx context.Context, logger *slog.Logger) (*Transport, error) {
 	childCtx, cancel := context.WithCancel(ctx)
-	
+
 	// In a real implementation, we would check if RDMA is available
 	// For this mock implementation, we'll just simulate it
 	isRDMAAvailable := false
@@ -54,6 +62,7 @@ func NewTransport(ctx context.Context) (*Transport, error) {
 	return &Transport{
 		connections:     make(map[string]*Connection),
 		isRDMAAvailable: isRDMAAvailable,
+		logger:          logging.Component(logger, "rdma"),
 		ctx:             childCtx,
 		cancel:          cancel,
 	}, nil
@@ -63,17 +72,40 @@ func NewTransport(ctx context.Context) (*Transport, error) {
 func (t *Transport) Start(address string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	
+
 	// Start the listener
 	var err error
 	t.listener, err = net.Listen("tcp", address)
 	if err != nil {
 		return fmt.Errorf("failed to start listener: %w", err)
 	}
-	
+
 	// Start the accept loop
 	go t.acceptLoop()
-	
+
+	return nil
+}
+
+// SetHandler sets the handler that serves accepted connections. Without a
+// handler the transport echoes received data back to the sender.
+func (t *Transport) SetHandler(handler ConnHandler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.handler = handler
+}
+
+// CloseListener stops accepting new connections while leaving established
+// connections open, so in-flight requests can finish during a drain
+func (t *Transport) CloseListener() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.listener == nil {
+		return nil
+	}
+	if err := t.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		return fmt.Errorf("failed to close listener: %w", err)
+	}
 	return nil
 }
 
@@ -81,17 +113,17 @@ func (t *Transport) Start(address string) error {
 func (t *Transport) Stop() error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	
+
 	// Cancel the context
 	t.cancel()
-	
+
 	// Close the listener
 	if t.listener != nil {
-		if err := t.listener.Close(); err != nil {
+		if err := t.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
 			return fmt.Errorf("failed to close listener: %w", err)
 		}
 	}
-	
+
 	// Close all connections
 	for _, conn := range t.connections {
 		conn.mu.Lock()
@@ -101,7 +133,7 @@ func (t *Transport) Stop() error {
 		conn.State = ConnectionStateDisconnected
 		conn.mu.Unlock()
 	}
-	
+
 	return nil
 }
 
@@ -115,11 +147,11 @@ func (t *Transport) acceptLoop() {
 			conn, err := t.listener.Accept()
 			if err != nil {
 				if !errors.Is(err, net.ErrClosed) {
-					fmt.Printf("Error accepting connection: %v\n", err)
+					t.logger.Error("failed to accept connection", "error", err)
 				}
 				return
 			}
-			
+
 			go t.handleConnection(conn)
 		}
 	}
@@ -127,11 +159,20 @@ func (t *Transport) acceptLoop() {
 
 // handleConnection handles an incoming connection
 func (t *Transport) handleConnection(conn net.Conn) {
+	t.mu.RLock()
+	handler := t.handler
+	t.mu.RUnlock()
+
+	if handler != nil {
+		handler(conn)
+		return
+	}
+
 	// In a real implementation, we would handle RDMA connection setup
 	// For this mock implementation, we'll just read and write data
-	
+
 	defer conn.Close()
-	
+
 	buf := make([]byte, 1024)
 	for {
 		select {
@@ -141,16 +182,16 @@ func (t *Transport) handleConnection(conn net.Conn) {
 			n, err := conn.Read(buf)
 			if err != nil {
 				if err != io.EOF {
-					fmt.Printf("Error reading from connection: %v\n", err)
+					t.logger.Warn("failed to read from connection", "remote", conn.RemoteAddr().String(), "error", err)
 				}
 				return
 			}
-			
+
 			// Process the data
 			// In a real implementation, we would handle RDMA commands
 			// For this mock implementation, we'll just echo the data back
 			if _, err := conn.Write(buf[:n]); err != nil {
-				fmt.Printf("Error writing to connection: %v\n", err)
+				t.logger.Warn("failed to write to connection", "remote", conn.RemoteAddr().String(), "error", err)
 				return
 			}
 		}
@@ -161,35 +202,36 @@ func (t *Transport) handleConnection(conn net.Conn) {
 func (t *Transport) Connect(address string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	
+
 	// Check if already connected
 	if conn, ok := t.connections[address]; ok {
 		conn.mu.Lock()
 		defer conn.mu.Unlock()
-		
+
 		if conn.State == ConnectionStateConnected {
 			return nil
 		}
 	}
-	
+
 	// Create a new connection
 	connection := &Connection{
 		Address: address,
 		State:   ConnectionStateConnecting,
 	}
 	t.connections[address] = connection
-	
+
 	// Connect to the remote node
 	conn, err := net.Dial("tcp", address)
 	if err != nil {
 		connection.State = ConnectionStateError
 		return fmt.Errorf("failed to connect to %s: %w", address, err)
 	}
-	
+
 	connection.conn = conn
 	connection.State = ConnectionStateConnected
 	connection.LastActivity = time.Now()
-	
+	t.logger.Debug("connected to remote node", "address", address)
+
 	return nil
 }
 
@@ -197,27 +239,27 @@ func (t *Transport) Connect(address string) error {
 func (t *Transport) Disconnect(address string) error {
 	t.mu.Lock()
 	defer t.mu.Unlock()
-	
+
 	conn, ok := t.connections[address]
 	if !ok {
 		return fmt.Errorf("no connection to %s", address)
 	}
-	
+
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
-	
+
 	if conn.State != ConnectionStateConnected {
 		return nil
 	}
-	
+
 	if conn.conn != nil {
 		if err := conn.conn.Close(); err != nil {
 			return fmt.Errorf("failed to close connection to %s: %w", address, err)
 		}
 	}
-	
+
 	conn.State = ConnectionStateDisconnected
-	
+
 	return nil
 }
 
@@ -226,25 +268,25 @@ func (t *Transport) WriteData(address string, data []byte) error {
 	t.mu.RLock()
 	conn, ok := t.connections[address]
 	t.mu.RUnlock()
-	
+
 	if !ok {
 		return fmt.Errorf("no connection to %s", address)
 	}
-	
+
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
-	
+
 	if conn.State != ConnectionStateConnected {
 		return fmt.Errorf("connection to %s is not connected", address)
 	}
-	
+
 	if _, err := conn.conn.Write(data); err != nil {
 		conn.State = ConnectionStateError
 		return fmt.Errorf("failed to write data to %s: %w", address, err)
 	}
-	
+
 	conn.LastActivity = time.Now()
-	
+
 	return nil
 }
 
@@ -253,18 +295,18 @@ func (t *Transport) ReadData(address string) ([]byte, error) {
 	t.mu.RLock()
 	conn, ok := t.connections[address]
 	t.mu.RUnlock()
-	
+
 	if !ok {
 		return nil, fmt.Errorf("no connection to %s", address)
 	}
-	
+
 	conn.mu.Lock()
 	defer conn.mu.Unlock()
-	
+
 	if conn.State != ConnectionStateConnected {
 		return nil, fmt.Errorf("connection to %s is not connected", address)
 	}
-	
+
 	buf := make([]byte, 4096)
 	n, err := conn.conn.Read(buf)
 	if err != nil {
@@ -273,13 +315,30 @@ func (t *Transport) ReadData(address string) ([]byte, error) {
 		}
 		return nil, fmt.Errorf("failed to read data from %s: %w", address, err)
 	}
-	
+
 	conn.LastActivity = time.Now()
-	
+
 	return buf[:n], nil
 }
 
 // IsRDMAAvailable returns whether RDMA is available
 func (t *Transport) IsRDMAAvailable() bool {
 	return t.isRDMAAvailable
-} 
\ No newline at end of file
+}
+
+// Stats reports whether RDMA is in use and the transport's connections
+type Stats struct {
+	RDMAAvailable bool `json:"rdma_available"`
+	Connections   int  `json:"connections"`
+}
+
+// GetStats returns the transport's statistics
+func (t *Transport) GetStats() *Stats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return &Stats{
+		RDMAAvailable: t.isRDMAAvailable,
+		Connections:   len(t.connections),
+	}
+}
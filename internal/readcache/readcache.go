@@ -0,0 +1,495 @@
+// Package readcache keeps the blocks a cache node serves in two tiers: the
+// most recently read in memory, and more of them on a local disk, such as
+// an SSD. Every block put in the cache is written to the disk tier as well,
+// so that blocks evicted from memory are still served without asking the
+// chain, and so that a restarted cache node starts warm.
+//
+// Entries carry the version of the block they hold. A newer version of a
+// block invalidates the older one, and blocks read back from disk after a
+// restart are marked unvalidated, since invalidations were missed while
+// the node was down.
+package readcache
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/memory"
+)
+
+// memoryConsumer names the memory tier in the node's memory budget
+const memoryConsumer = "read_cache"
+
+// tempSuffix marks the files of blocks being written to the disk tier
+const tempSuffix = ".tmp"
+
+// Options configures a cache
+type Options struct {
+	// MemoryBytes bounds the data kept in memory
+	MemoryBytes int64
+	// Dir is the directory of the disk tier; empty keeps blocks in memory
+	// only
+	Dir string
+	// DiskBytes bounds the data kept on disk
+	DiskBytes int64
+	// Budget is the node's memory budget the memory tier is taken from, if
+	// any; blocks it has no room for are kept on disk only
+	Budget *memory.Budget
+}
+
+// Entry is a cached block and its metadata. Validated is when the block
+// was last known to be current, zero for blocks read back from disk after
+// a restart.
+type Entry struct {
+	BlockID      string    `json:"block_id"`
+	Version      int       `json:"version"`
+	Checksum     string    `json:"checksum"`
+	CreatedAt    int64     `json:"created_at,omitempty"`
+	LastModified int64     `json:"last_modified,omitempty"`
+	Validated    time.Time `json:"-"`
+	Data         []byte    `json:"-"`
+}
+
+// Stats reports a cache's contents and effectiveness
+type Stats struct {
+	MemoryHits    uint64 `json:"memory_hits"`
+	DiskHits      uint64 `json:"disk_hits"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	MemoryEntries int    `json:"memory_entries"`
+	MemoryBytes   int64  `json:"memory_bytes"`
+	DiskEntries   int    `json:"disk_entries"`
+	DiskBytes     int64  `json:"disk_bytes"`
+}
+
+// diskEntry indexes a block in the disk tier
+type diskEntry struct {
+	blockID   string
+	version   int
+	size      int64
+	validated time.Time
+}
+
+// Cache is a two-tier block cache, safe for concurrent use
+type Cache struct {
+	opts Options
+
+	mu       sync.Mutex
+	mem      map[string]*list.Element
+	memLRU   *list.List
+	memBytes int64
+	disk     map[string]*list.Element
+	diskLRU  *list.List
+	diskSize int64
+	// pending are the entries being written to disk, which an
+	// invalidation in the meantime keeps from landing there
+	pending map[string]*Entry
+	stats   Stats
+}
+
+// Open creates a cache, indexing the blocks left in the disk tier by a
+// previous run
+func Open(opts Options) (*Cache, error) {
+	c := &Cache{
+		opts:    opts,
+		mem:     make(map[string]*list.Element),
+		memLRU:  list.New(),
+		disk:    make(map[string]*list.Element),
+		diskLRU: list.New(),
+		pending: make(map[string]*Entry),
+	}
+	if opts.Dir == "" {
+		return c, nil
+	}
+	if err := os.MkdirAll(opts.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// load indexes the disk tier, least recently written last, and removes
+// the files of writes that did not complete
+func (c *Cache) load() error {
+	type found struct {
+		entry diskEntry
+		mtime time.Time
+	}
+	var files []found
+	err := filepath.WalkDir(c.opts.Dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, tempSuffix) {
+			os.Remove(path)
+			return nil
+		}
+		header, size, err := readHeader(path)
+		if err != nil || c.path(header.BlockID) != path {
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		files = append(files, found{
+			entry: diskEntry{blockID: header.BlockID, version: header.Version, size: size},
+			mtime: info.ModTime(),
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to index cache directory: %w", err)
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].mtime.After(files[j].mtime) })
+	for _, f := range files {
+		entry := f.entry
+		c.disk[entry.blockID] = c.diskLRU.PushBack(&entry)
+		c.diskSize += entry.size
+	}
+	c.evictDisk()
+	return nil
+}
+
+// Get returns a cached block, from memory or else from disk, reporting
+// false if the cache does not hold it. The entry's data must not be
+// modified.
+func (c *Cache) Get(blockID string) (*Entry, bool) {
+	c.mu.Lock()
+	if elem, ok := c.mem[blockID]; ok {
+		c.memLRU.MoveToFront(elem)
+		c.stats.MemoryHits++
+		entry := *elem.Value.(*Entry)
+		c.mu.Unlock()
+		return &entry, true
+	}
+	elem, ok := c.disk[blockID]
+	if !ok {
+		c.stats.Misses++
+		c.mu.Unlock()
+		return nil, false
+	}
+	indexed := *elem.Value.(*diskEntry)
+	c.mu.Unlock()
+
+	entry, err := readEntry(c.path(blockID))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok = c.disk[blockID]
+	if err != nil || entry.BlockID != blockID || entry.Version != indexed.version ||
+		!ok || elem.Value.(*diskEntry).version != indexed.version {
+		// The block was replaced, evicted or damaged while it was read
+		if err != nil && ok {
+			c.removeDisk(blockID)
+		}
+		c.stats.Misses++
+		return nil, false
+	}
+	c.diskLRU.MoveToFront(elem)
+	c.stats.DiskHits++
+	entry.Validated = elem.Value.(*diskEntry).validated
+	if _, ok := c.mem[blockID]; !ok {
+		stored := *entry
+		c.addMemory(&stored)
+	}
+	return entry, true
+}
+
+// Put caches a block, in memory and on disk, replacing any older version
+func (c *Cache) Put(entry *Entry) error {
+	stored := *entry
+	if stored.Validated.IsZero() {
+		stored.Validated = time.Now()
+	}
+
+	c.mu.Lock()
+	if elem, ok := c.mem[stored.BlockID]; ok {
+		if elem.Value.(*Entry).Version > stored.Version {
+			c.mu.Unlock()
+			return nil
+		}
+		c.removeMemory(stored.BlockID)
+	}
+	c.addMemory(&stored)
+	if c.opts.Dir == "" || int64(len(stored.Data)) > c.opts.DiskBytes {
+		c.mu.Unlock()
+		return nil
+	}
+	c.pending[stored.BlockID] = &stored
+	c.mu.Unlock()
+
+	path := c.path(stored.BlockID)
+	tmp, err := writeEntry(path, &stored)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending[stored.BlockID] != &stored {
+		// Invalidated, or replaced by a newer put, while it was written
+		if err == nil {
+			os.Remove(tmp)
+		}
+		return nil
+	}
+	delete(c.pending, stored.BlockID)
+	if err != nil {
+		return fmt.Errorf("failed to cache block %s on disk: %w", stored.BlockID, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to cache block %s on disk: %w", stored.BlockID, err)
+	}
+	c.removeDisk(stored.BlockID)
+	size := int64(len(stored.Data))
+	c.disk[stored.BlockID] = c.diskLRU.PushFront(&diskEntry{
+		blockID:   stored.BlockID,
+		version:   stored.Version,
+		size:      size,
+		validated: stored.Validated,
+	})
+	c.diskSize += size
+	c.evictDisk()
+	return nil
+}
+
+// Validate records that the cached copy of a block is current, as of now,
+// if it is of version
+func (c *Cache) Validate(blockID string, version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if elem, ok := c.mem[blockID]; ok && elem.Value.(*Entry).Version == version {
+		elem.Value.(*Entry).Validated = now
+	}
+	if elem, ok := c.disk[blockID]; ok && elem.Value.(*diskEntry).version == version {
+		elem.Value.(*diskEntry).validated = now
+	}
+}
+
+// Invalidate drops a block from the cache if the cached copy is older than
+// version, or whatever its version if version is zero, reporting whether
+// the cache held a copy it dropped
+func (c *Cache) Invalidate(blockID string, version int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stale := func(v int) bool { return version == 0 || v < version }
+
+	dropped := false
+	if elem, ok := c.mem[blockID]; ok && stale(elem.Value.(*Entry).Version) {
+		c.removeMemory(blockID)
+		dropped = true
+	}
+	if elem, ok := c.disk[blockID]; ok && stale(elem.Value.(*diskEntry).version) {
+		c.removeDisk(blockID)
+		dropped = true
+	}
+	if entry, ok := c.pending[blockID]; ok && stale(entry.Version) {
+		delete(c.pending, blockID)
+		dropped = true
+	}
+	if dropped {
+		c.stats.Invalidations++
+	}
+	return dropped
+}
+
+// Expire marks every cached block unvalidated, for when invalidations may
+// have been missed
+func (c *Cache) Expire() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, elem := range c.mem {
+		elem.Value.(*Entry).Validated = time.Time{}
+	}
+	for _, elem := range c.disk {
+		elem.Value.(*diskEntry).validated = time.Time{}
+	}
+}
+
+// Stats returns the cache's counters and contents
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.MemoryEntries = len(c.mem)
+	stats.MemoryBytes = c.memBytes
+	stats.DiskEntries = len(c.disk)
+	stats.DiskBytes = c.diskSize
+	return stats
+}
+
+// addMemory adds an entry to the memory tier, evicting the least recently
+// read beyond its bound. Must be called with the lock held.
+func (c *Cache) addMemory(entry *Entry) {
+	size := int64(len(entry.Data))
+	if size > c.opts.MemoryBytes {
+		return
+	}
+	for !c.opts.Budget.Admit(memoryConsumer, size) {
+		oldest := c.memLRU.Back()
+		if oldest == nil {
+			return
+		}
+		c.removeMemory(oldest.Value.(*Entry).BlockID)
+		c.stats.Evictions++
+	}
+	c.mem[entry.BlockID] = c.memLRU.PushFront(entry)
+	c.memBytes += size
+	for c.memBytes > c.opts.MemoryBytes {
+		oldest := c.memLRU.Back()
+		c.removeMemory(oldest.Value.(*Entry).BlockID)
+		c.stats.Evictions++
+	}
+}
+
+// removeMemory drops a block from the memory tier. Must be called with the
+// lock held.
+func (c *Cache) removeMemory(blockID string) {
+	elem, ok := c.mem[blockID]
+	if !ok {
+		return
+	}
+	c.memLRU.Remove(elem)
+	delete(c.mem, blockID)
+	size := int64(len(elem.Value.(*Entry).Data))
+	c.memBytes -= size
+	c.opts.Budget.Release(memoryConsumer, size)
+}
+
+// ReclaimMemory evicts the least recently read blocks from the memory tier
+// until at least bytes are freed, returning the bytes freed. The blocks
+// are still served from disk.
+func (c *Cache) ReclaimMemory(bytes int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	freed := int64(0)
+	for freed < bytes && c.memLRU.Len() > 0 {
+		oldest := c.memLRU.Back().Value.(*Entry)
+		freed += int64(len(oldest.Data))
+		c.removeMemory(oldest.BlockID)
+		c.stats.Evictions++
+	}
+	return freed
+}
+
+// evictDisk removes the least recently read blocks from disk beyond its
+// bound. Must be called with the lock held.
+func (c *Cache) evictDisk() {
+	for c.diskSize > c.opts.DiskBytes && c.diskLRU.Len() > 0 {
+		c.removeDisk(c.diskLRU.Back().Value.(*diskEntry).blockID)
+		c.stats.Evictions++
+	}
+}
+
+// removeDisk drops a block from the disk tier and removes its file. Must
+// be called with the lock held.
+func (c *Cache) removeDisk(blockID string) {
+	elem, ok := c.disk[blockID]
+	if !ok {
+		return
+	}
+	c.diskLRU.Remove(elem)
+	delete(c.disk, blockID)
+	c.diskSize -= elem.Value.(*diskEntry).size
+	os.Remove(c.path(blockID))
+}
+
+// path returns the file of a block in the disk tier, named after the hash
+// of its ID so that any block ID makes a valid file name
+func (c *Cache) path(blockID string) string {
+	sum := sha256.Sum256([]byte(blockID))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.opts.Dir, name[:2], name)
+}
+
+// writeEntry writes an entry to a temporary file next to path: a line of
+// JSON with its metadata followed by its data. It returns the temporary
+// file, to be renamed over path.
+func writeEntry(path string, entry *Entry) (string, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", err
+	}
+	header, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*"+tempSuffix)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.Write(append(header, '\n'))
+	if err == nil {
+		_, err = f.Write(entry.Data)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// readHeader reads the metadata of a cached block file, and the size of
+// its data
+func readHeader(path string) (*Entry, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	if err != nil {
+		return nil, 0, fmt.Errorf("truncated cache file %s", path)
+	}
+	var entry Entry
+	if err := json.Unmarshal(line, &entry); err != nil {
+		return nil, 0, err
+	}
+	return &entry, info.Size() - int64(len(line)), nil
+}
+
+// readEntry reads a cached block file, verifying its data against its
+// checksum
+func readEntry(path string) (*Entry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	i := bytes.IndexByte(data, '\n')
+	if i < 0 {
+		return nil, fmt.Errorf("truncated cache file %s", path)
+	}
+	var entry Entry
+	if err := json.Unmarshal(data[:i], &entry); err != nil {
+		return nil, err
+	}
+	entry.Data = data[i+1:]
+	sum := sha256.Sum256(entry.Data)
+	if hex.EncodeToString(sum[:]) != entry.Checksum {
+		return nil, errors.New("cached block does not match its checksum")
+	}
+	return &entry, nil
+}
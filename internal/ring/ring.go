@@ -0,0 +1,178 @@
+// Package ring implements a consistent-hash ring. Each member owns a number
+// of virtual nodes, points on the ring in proportion to its weight, and a
+// key belongs to the member of the first point at or after the key's hash.
+// Adding or removing a member only moves the keys of the points it gains
+// or loses, instead of remapping nearly every key as a modulo would.
+//
+// The points of a member follow from its ID alone, so every process that
+// builds a ring from the same members and weights maps keys the same way.
+package ring
+
+import (
+	"hash/fnv"
+	"math"
+	"sort"
+	"strconv"
+)
+
+// DefaultVirtualNodes is the number of points a member of average weight
+// owns when none is given
+const DefaultVirtualNodes = 128
+
+// Member is a member of a ring. Weight is relative to the other members',
+// such as a capacity in bytes; a member without a positive weight counts
+// as having the average weight of the others.
+type Member struct {
+	ID     string
+	Weight float64
+}
+
+// point is a virtual node: a position on the ring and the index of the
+// member owning it
+type point struct {
+	hash   uint64
+	member int
+}
+
+// Ring maps keys to members. It is immutable once built, so it may be
+// shared between goroutines.
+type Ring struct {
+	members []string
+	points  []point
+}
+
+// New builds a ring of members, giving a member of average weight vnodes
+// points and every member at least one. Members are identified by ID, so
+// repeated IDs are counted once.
+func New(vnodes int, members []Member) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+
+	seen := make(map[string]bool, len(members))
+	unique := make([]Member, 0, len(members))
+	var total float64
+	weighted := 0
+	for _, m := range members {
+		if seen[m.ID] {
+			continue
+		}
+		seen[m.ID] = true
+		unique = append(unique, m)
+		if m.Weight > 0 {
+			total += m.Weight
+			weighted++
+		}
+	}
+	avg := 1.0
+	if weighted > 0 {
+		avg = total / float64(weighted)
+	}
+
+	r := &Ring{members: make([]string, 0, len(unique))}
+	for i, m := range unique {
+		weight := m.Weight
+		if weight <= 0 {
+			weight = avg
+		}
+		count := max(int(math.Round(float64(vnodes)*weight/avg)), 1)
+		r.members = append(r.members, m.ID)
+		for v := 0; v < count; v++ {
+			r.points = append(r.points, point{hash: hashKey(m.ID + "#" + strconv.Itoa(v)), member: i})
+		}
+	}
+
+	// Break the rare ties between points by member ID, so that the order
+	// does not depend on the order members were given in
+	sort.Slice(r.points, func(i, j int) bool {
+		a, b := r.points[i], r.points[j]
+		if a.hash != b.hash {
+			return a.hash < b.hash
+		}
+		return r.members[a.member] < r.members[b.member]
+	})
+	return r
+}
+
+// Len returns the number of members of the ring
+func (r *Ring) Len() int {
+	return len(r.members)
+}
+
+// Members returns the IDs of the ring's members
+func (r *Ring) Members() []string {
+	return append([]string(nil), r.members...)
+}
+
+// Locate returns the member a key belongs to, reporting false if the ring
+// has no members
+func (r *Ring) Locate(key string) (string, bool) {
+	if len(r.points) == 0 {
+		return "", false
+	}
+	return r.members[r.points[r.search(key)].member], true
+}
+
+// LocateN returns up to n distinct members for a key, in the order met
+// walking the ring from the key: the member the key belongs to first, then
+// the ones that would take over its keys were the members before them gone
+func (r *Ring) LocateN(key string, n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	ids := make([]string, 0, min(n, len(r.members)))
+	r.Walk(key, func(id string) bool {
+		ids = append(ids, id)
+		return len(ids) < n
+	})
+	return ids
+}
+
+// Walk calls fn with each member once, in the order met walking the ring
+// from a key, until fn returns false. It lets callers skip members that
+// cannot take a key, such as failed ones, without building a new ring.
+func (r *Ring) Walk(key string, fn func(id string) bool) {
+	if len(r.points) == 0 {
+		return
+	}
+	visited := make([]bool, len(r.members))
+	left := len(r.members)
+	start := r.search(key)
+	for i := 0; i < len(r.points) && left > 0; i++ {
+		p := r.points[(start+i)%len(r.points)]
+		if visited[p.member] {
+			continue
+		}
+		visited[p.member] = true
+		left--
+		if !fn(r.members[p.member]) {
+			return
+		}
+	}
+}
+
+// search returns the index of the first point at or after a key's hash,
+// wrapping around the ring
+func (r *Ring) search(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i].hash >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return i
+}
+
+// hashKey hashes a key onto the ring. FNV-1a is finalized with the mixer
+// of MurmurHash3, since the keys of points only differ in their last bytes
+// and FNV alone would leave their positions clustered.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
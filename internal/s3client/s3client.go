@@ -0,0 +1,192 @@
+// Package s3client is a small client of the S3 API, enough for the tools
+// of this repository to read and write objects on an S3 service, which may
+// be the gateway of another cluster. Requests are signed with Signature
+// Version 4 and address buckets in the path.
+package s3client
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/sigv4"
+)
+
+// emptySHA256 is the hex SHA-256 of an empty body
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Config reaches an S3 service
+type Config struct {
+	// Endpoint is the service's URL
+	Endpoint  string
+	Region    string
+	AccessKey string
+	SecretKey string
+}
+
+// Client sends requests to an S3 service
+type Client struct {
+	cfg      Config
+	endpoint *url.URL
+	http     *http.Client
+}
+
+// Object is an object of a listing
+type Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+}
+
+// New creates a client of the service a configuration describes
+func New(cfg Config) (*Client, error) {
+	if cfg.Endpoint == "" {
+		return nil, errors.New("an S3 endpoint is required")
+	}
+	endpoint, err := url.Parse(strings.TrimSuffix(cfg.Endpoint, "/"))
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Region == "" {
+		cfg.Region = "us-east-1"
+	}
+	return &Client{cfg: cfg, endpoint: endpoint, http: &http.Client{}}, nil
+}
+
+// ParseLocation splits an s3://bucket/key location. The key may be empty,
+// as for a prefix naming a whole bucket.
+func ParseLocation(location string) (bucket, key string, ok bool) {
+	rest, ok := strings.CutPrefix(location, "s3://")
+	if !ok {
+		return "", "", false
+	}
+	bucket, key, _ = strings.Cut(rest, "/")
+	return bucket, key, bucket != ""
+}
+
+// request builds a signed request for an object, or for the bucket itself
+// if key is empty
+func (c *Client) request(ctx context.Context, method, bucket, key string, query url.Values, body io.Reader, payloadHash string) (*http.Request, error) {
+	u := *c.endpoint
+	u.Path += "/" + bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	sigv4.SignRequest(req, c.cfg.AccessKey, c.cfg.SecretKey, c.cfg.Region, payloadHash)
+	return req, nil
+}
+
+// do sends a request, failing on any status but 200
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var s3Err struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if xml.Unmarshal(body, &s3Err) == nil && s3Err.Code != "" {
+			return nil, fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, s3Err.Code, s3Err.Message)
+		}
+		return nil, fmt.Errorf("%s %s: %s", req.Method, req.URL.Path, resp.Status)
+	}
+	return resp, nil
+}
+
+// Get returns the contents of an object
+func (c *Client) Get(ctx context.Context, bucket, key string) (io.ReadCloser, error) {
+	req, err := c.request(ctx, http.MethodGet, bucket, key, nil, nil, emptySHA256)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Put uploads an object of a known size. The body is read twice, once to
+// sign its hash and once to send it.
+func (c *Client) Put(ctx context.Context, bucket, key string, body io.ReadSeeker, size int64, contentType string) error {
+	h := sha256.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return fmt.Errorf("failed to hash upload: %w", err)
+	}
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	req, err := c.request(ctx, http.MethodPut, bucket, key, nil, body, hex.EncodeToString(h.Sum(nil)))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := c.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List calls fn with each object of a bucket whose key starts with prefix,
+// in key order, following the listing's pages
+func (c *Client) List(ctx context.Context, bucket, prefix string, fn func(Object) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		req, err := c.request(ctx, http.MethodGet, bucket, "", query, nil, emptySHA256)
+		if err != nil {
+			return err
+		}
+		resp, err := c.do(req)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Contents              []Object `xml:"Contents"`
+			IsTruncated           bool     `xml:"IsTruncated"`
+			NextContinuationToken string   `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("invalid listing of %s: %w", bucket, err)
+		}
+
+		for _, object := range page.Contents {
+			if err := fn(object); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
@@ -0,0 +1,164 @@
+// Package sigv4 implements the parts of AWS Signature Version 4 that both
+// sides of an S3 request need: the canonical request, the signing key and
+// the signature. The gateway verifies requests with it, and the S3 client
+// signs them, without depending on each other.
+package sigv4
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signature Version 4 constants
+const (
+	Algorithm       = "AWS4-HMAC-SHA256"
+	Service         = "s3"
+	Terminator      = "aws4_request"
+	DateFormat      = "20060102T150405Z"
+	ScopeDateFormat = "20060102"
+)
+
+// SignRequest signs a request to an S3 service, as the gateway verifies
+// it, so that the tools of this repository can store to the gateway or to
+// any other S3 service. payloadHash is the hex SHA-256 of the body, or
+// "UNSIGNED-PAYLOAD". The request's Host and ContentLength must be set.
+func SignRequest(r *http.Request, accessKey, secretKey, region, payloadHash string) {
+	now := time.Now().UTC()
+	amzDate := now.Format(DateFormat)
+	date := now.Format(ScopeDateFormat)
+	if r.Host == "" {
+		r.Host = r.URL.Host
+	}
+	r.Header.Set("X-Amz-Date", amzDate)
+	r.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	for name := range r.Header {
+		name = strings.ToLower(name)
+		if strings.HasPrefix(name, "x-amz-") && name != "x-amz-content-sha256" && name != "x-amz-date" {
+			signedHeaders = append(signedHeaders, name)
+		}
+	}
+	sort.Strings(signedHeaders)
+
+	canonical := strings.Join([]string{
+		r.Method,
+		Escape(r.URL.Path, false),
+		CanonicalQuery(r.URL.Query()),
+		CanonicalHeaders(r, signedHeaders),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	scope := strings.Join([]string{date, region, Service, Terminator}, "/")
+	stringToSign := strings.Join([]string{Algorithm, amzDate, scope, HexSHA256([]byte(canonical))}, "\n")
+	signature := hex.EncodeToString(HMACSHA256(SigningKey(secretKey, date, region, Service), stringToSign))
+
+	r.Header.Set("Authorization", Algorithm+
+		" Credential="+accessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signedHeaders, ";")+
+		", Signature="+signature)
+}
+
+// SigningKey derives the key of a day's signatures from a secret key
+func SigningKey(secretKey, date, region, service string) []byte {
+	key := HMACSHA256([]byte("AWS4"+secretKey), date)
+	key = HMACSHA256(key, region)
+	key = HMACSHA256(key, service)
+	return HMACSHA256(key, Terminator)
+}
+
+// HMACSHA256 returns the HMAC-SHA256 of data under key
+func HMACSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// HexSHA256 returns the hex SHA-256 of data
+func HexSHA256(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// Escape URI-encodes s the way AWS signatures do: unreserved characters
+// are kept and every other byte is percent-encoded, as is '/' unless it
+// separates path segments
+func Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// CanonicalQuery returns the query string in canonical form, sorted by name
+// and value
+func CanonicalQuery(query url.Values) string {
+	type param struct{ name, value string }
+	params := make([]param, 0, len(query))
+	for name, values := range query {
+		for _, value := range values {
+			params = append(params, param{Escape(name, true), Escape(value, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i].name != params[j].name {
+			return params[i].name < params[j].name
+		}
+		return params[i].value < params[j].value
+	})
+
+	pairs := make([]string, len(params))
+	for i, p := range params {
+		pairs[i] = p.name + "=" + p.value
+	}
+	return strings.Join(pairs, "&")
+}
+
+// CanonicalHeaders returns the signed headers in canonical form, a line of
+// lowercase name and trimmed value each
+func CanonicalHeaders(r *http.Request, names []string) string {
+	var b strings.Builder
+	for _, name := range names {
+		var values []string
+		switch name {
+		case "host":
+			values = []string{r.Host}
+		case "content-length":
+			values = r.Header.Values(name)
+			if len(values) == 0 && r.ContentLength >= 0 {
+				values = []string{strconv.FormatInt(r.ContentLength, 10)}
+			}
+		case "transfer-encoding":
+			values = r.Header.Values(name)
+			if len(values) == 0 {
+				values = r.TransferEncoding
+			}
+		default:
+			values = r.Header.Values(name)
+		}
+		trimmed := make([]string, len(values))
+		for i, value := range values {
+			trimmed[i] = strings.Join(strings.Fields(value), " ")
+		}
+		b.WriteString(name + ":" + strings.Join(trimmed, ",") + "\n")
+	}
+	return b.String()
+}
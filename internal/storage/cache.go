@@ -0,0 +1,194 @@
+package storage
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/3fs-storage/internal/memory"
+)
+
+// cacheConsumer names the block caches in the node's memory budget
+const cacheConsumer = "block_cache"
+
+// blockCache holds the data of recently used blocks in memory. Once the
+// cached data exceeds the limit, the least recently used blocks are
+// evicted.
+type blockCache struct {
+	// limit caps the cached bytes; zero means unlimited
+	limit int64
+	// budget is the node's memory budget the cached bytes are taken from,
+	// if any
+	budget  *memory.Budget
+	size    int64
+	entries map[string]*list.Element
+	// order holds the entries, most recently used first
+	order *list.List
+	mu    sync.Mutex
+}
+
+// cacheEntry is the cached data of one block
+type cacheEntry struct {
+	blockID string
+	data    []byte
+}
+
+// newBlockCache creates an unlimited cache
+func newBlockCache() *blockCache {
+	return &blockCache{
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// get returns the cached data of a block
+func (c *blockCache) get(blockID string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[blockID]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return elem.Value.(*cacheEntry).data, true
+}
+
+// put caches the data of a block. Blocks larger than the whole cache are
+// not cached, nor are blocks the memory budget has no room for once the
+// cache has evicted all it can.
+func (c *blockCache) put(blockID string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeLocked(blockID)
+	if c.limit > 0 && int64(len(data)) > c.limit {
+		return
+	}
+	for !c.budget.Admit(cacheConsumer, int64(len(data))) {
+		oldest := c.order.Back()
+		if oldest == nil {
+			return
+		}
+		c.removeLocked(oldest.Value.(*cacheEntry).blockID)
+	}
+
+	c.entries[blockID] = c.order.PushFront(&cacheEntry{blockID: blockID, data: data})
+	c.size += int64(len(data))
+	c.evict()
+}
+
+// remove drops a block from the cache
+func (c *blockCache) remove(blockID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(blockID)
+}
+
+// removeLocked drops a block from the cache. Must be called with the lock
+// held.
+func (c *blockCache) removeLocked(blockID string) {
+	elem, ok := c.entries[blockID]
+	if !ok {
+		return
+	}
+	c.order.Remove(elem)
+	delete(c.entries, blockID)
+	size := int64(len(elem.Value.(*cacheEntry).data))
+	c.size -= size
+	c.budget.Release(cacheConsumer, size)
+}
+
+// reset empties the cache
+func (c *blockCache) reset() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*list.Element)
+	c.order.Init()
+	c.budget.Release(cacheConsumer, c.size)
+	c.size = 0
+}
+
+// setBudget moves the cached bytes to a memory budget
+func (c *blockCache) setBudget(budget *memory.Budget) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.budget.Release(cacheConsumer, c.size)
+	c.budget = budget
+	c.budget.Charge(cacheConsumer, c.size)
+}
+
+// reclaim evicts the least recently used blocks until at least bytes are
+// freed or the cache is empty, returning the bytes freed
+func (c *blockCache) reclaim(bytes int64) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	freed := int64(0)
+	for freed < bytes && c.order.Len() > 0 {
+		entry := c.order.Back().Value.(*cacheEntry)
+		freed += int64(len(entry.data))
+		c.removeLocked(entry.blockID)
+	}
+	return freed
+}
+
+// setLimit changes the cache's limit, evicting blocks right away if the
+// cache is over the new one
+func (c *blockCache) setLimit(limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.limit = limit
+	c.evict()
+}
+
+// evict drops the least recently used blocks until the cache is within
+// its limit. Must be called with the lock held.
+func (c *blockCache) evict() {
+	if c.limit <= 0 {
+		return
+	}
+	for c.size > c.limit {
+		c.removeLocked(c.order.Back().Value.(*cacheEntry).blockID)
+	}
+}
+
+// usage returns the number of cached blocks, their size in bytes and the
+// cache's limit
+func (c *blockCache) usage() (blocks int, size, limit int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.entries), c.size, c.limit
+}
+
+// SetCacheLimit caps the memory the block cache may use, in bytes. Zero
+// means unlimited. Blocks are evicted right away if the cache is over the
+// new limit.
+func (s *LocalStorage) SetCacheLimit(limit int64) {
+	if limit < 0 {
+		limit = 0
+	}
+	s.cache.setLimit(limit)
+}
+
+// SetMemoryBudget takes the block cache's memory from the node's budget,
+// which shrinks the cache when other consumers need the memory
+func (s *LocalStorage) SetMemoryBudget(budget *memory.Budget) {
+	s.cache.setBudget(budget)
+	budget.Register(cacheConsumer, s)
+}
+
+// ReclaimMemory evicts the least recently used blocks from the block cache
+// until at least bytes are freed, returning the bytes freed
+func (s *LocalStorage) ReclaimMemory(bytes int64) int64 {
+	return s.cache.reclaim(bytes)
+}
+
+// CacheLimit returns the memory the block cache may use, in bytes, or zero
+// if it is unlimited
+func (s *LocalStorage) CacheLimit() int64 {
+	_, _, limit := s.cache.usage()
+	return limit
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/3fs-storage/internal/ratelimit"
+)
+
+// DedupMinSize is the size of the smallest block deduplicated; smaller
+// files take a filesystem block whether they are shared or not
+const DedupMinSize = 4096
+
+// dedupTempFile is the name a block's new link is made under before it
+// replaces the block's file. It is outside the shard directories so that
+// it is never listed as a block.
+const dedupTempFile = ".dedup"
+
+// ErrDedupUnsupported is returned where link counts are not available
+var ErrDedupUnsupported = errors.New("deduplication is not supported on this platform")
+
+// DedupReport summarises a deduplication pass over local storage. Blocks
+// with the same content share one file, linked under each of their names;
+// the file's link count is the number of blocks referencing it, and it is
+// reclaimed when the last of them is deleted or rewritten.
+type DedupReport struct {
+	StartedAt  int64 `json:"started_at"`
+	FinishedAt int64 `json:"finished_at"`
+	Scanned    int   `json:"scanned"`
+	// Duplicates counts the blocks whose content another block has
+	Duplicates int `json:"duplicates"`
+	// Linked counts the blocks made to share a copy on this pass
+	Linked int `json:"linked"`
+	// Shared counts the copies that more than one block references after
+	// the pass, and References the blocks referencing them
+	Shared     int `json:"shared"`
+	References int `json:"references"`
+	// Skipped counts the duplicates left alone because they changed while
+	// the pass ran or their content differs after all
+	Skipped        int   `json:"skipped"`
+	ReclaimedBytes int64 `json:"reclaimed_bytes"`
+}
+
+// dedupKey identifies the blocks that may share a file: those with the
+// same data, stored the same way
+type dedupKey struct {
+	checksum   string
+	size       int
+	encoding   string
+	dictionary uint32
+}
+
+// Dedup finds the blocks with the same content and makes them share one
+// file, the copy most blocks already reference. Candidates are found by
+// the checksum in their metadata and compared byte by byte before they
+// are linked. Reads are paced by budget, and the pass stops early if ctx
+// is done.
+func (s *LocalStorage) Dedup(ctx context.Context, budget *ratelimit.Limiter) (*DedupReport, error) {
+	report := &DedupReport{StartedAt: time.Now().UnixNano()}
+	if info, err := os.Stat(s.dataPath); err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	} else if _, _, ok := fileLinks(info); !ok {
+		return nil, ErrDedupUnsupported
+	}
+
+	blockIDs, err := s.ListBlocks("")
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make(map[dedupKey][]string)
+	for _, blockID := range blockIDs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		metadata, ok := s.dedupMetadata(blockID)
+		if !ok {
+			continue
+		}
+		report.Scanned++
+		key := dedupKey{metadata.Checksum, metadata.Size, metadata.Encoding, metadata.Dictionary}
+		groups[key] = append(groups[key], blockID)
+	}
+
+	keys := make([]dedupKey, 0)
+	for key, ids := range groups {
+		if len(ids) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].checksum < keys[j].checksum })
+
+	for _, key := range keys {
+		if err := s.dedupGroup(ctx, budget, key, groups[key], report); err != nil {
+			return report, err
+		}
+	}
+
+	report.FinishedAt = time.Now().UnixNano()
+	return report, nil
+}
+
+// dedupMetadata returns a block's metadata if the block is large enough
+// to deduplicate
+func (s *LocalStorage) dedupMetadata(blockID string) (*BlockMetadata, bool) {
+	hasMetadata, metadataBytes, err := s.ReadBlockMetadata(blockID)
+	if err != nil || !hasMetadata {
+		return nil, false
+	}
+	var metadata BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, false
+	}
+	if metadata.Size < DedupMinSize {
+		return nil, false
+	}
+	return &metadata, true
+}
+
+// dedupMember is a block of a group of duplicates and the file it has
+type dedupMember struct {
+	blockID string
+	path    string
+	links   uint64
+	id      fileID
+	size    int64
+}
+
+// dedupGroup links the blocks of a group of duplicates to the copy most
+// of them reference
+func (s *LocalStorage) dedupGroup(ctx context.Context, budget *ratelimit.Limiter, key dedupKey, blockIDs []string, report *DedupReport) error {
+	members := make([]dedupMember, 0, len(blockIDs))
+	references := make(map[fileID]int)
+	files := make(map[fileID]dedupMember)
+	for _, blockID := range blockIDs {
+		path := s.getBlockPath(blockID)
+		info, err := os.Lstat(path)
+		if err != nil {
+			continue
+		}
+		links, id, _ := fileLinks(info)
+		members = append(members, dedupMember{blockID: blockID, path: path, links: links, id: id, size: info.Size()})
+		references[id]++
+		files[id] = members[len(members)-1]
+	}
+	initial := make(map[fileID]int, len(references))
+	for id, n := range references {
+		initial[id] = n
+	}
+	if len(members) < 2 {
+		return nil
+	}
+	report.Duplicates += len(members) - 1
+
+	// Keep the copy most of the group references, so that the fewest
+	// blocks are relinked
+	sort.SliceStable(members, func(i, j int) bool {
+		return references[members[i].id] > references[members[j].id]
+	})
+	keep := members[0]
+	if err := budget.WaitN(ctx, int(keep.size)); err != nil {
+		return err
+	}
+	content, err := s.readDuplicate(ctx, keep.path)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		report.Skipped += len(members) - 1
+		return nil
+	}
+
+	for _, m := range members[1:] {
+		if m.id == keep.id {
+			continue
+		}
+		if err := budget.WaitN(ctx, int(m.size)); err != nil {
+			return err
+		}
+		data, err := s.readDuplicate(ctx, m.path)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil || !bytes.Equal(data, content) {
+			report.Skipped++
+			continue
+		}
+		linked, err := s.linkDuplicate(key, keep, m)
+		if err != nil {
+			return fmt.Errorf("failed to deduplicate block %s: %w", m.blockID, err)
+		}
+		if !linked {
+			report.Skipped++
+			continue
+		}
+		report.Linked++
+		references[keep.id]++
+		references[m.id]--
+	}
+
+	// A copy is reclaimed once no name links to it: when every block that
+	// referenced it was relinked
+	for id, f := range files {
+		if references[id] == 0 && f.links == uint64(initial[id]) {
+			report.ReclaimedBytes += f.size
+		}
+	}
+
+	if n := references[keep.id]; n > 1 {
+		report.Shared++
+		report.References += n
+	}
+	return nil
+}
+
+// readDuplicate reads the file of a block being deduplicated as background
+// disk IO
+func (s *LocalStorage) readDuplicate(ctx context.Context, path string) ([]byte, error) {
+	release, err := s.acquireDisk(ctx, DiskBackground)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+	return ioutil.ReadFile(path)
+}
+
+// linkDuplicate replaces a block's file with a link to the copy kept,
+// reporting false if either block changed since they were compared. The
+// link is made under a temporary name and renamed over the block's file,
+// so that a crash leaves the block with one file or the other.
+func (s *LocalStorage) linkDuplicate(key dedupKey, keep, m dedupMember) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, member := range []dedupMember{keep, m} {
+		metadata, ok := s.dedupMetadata(member.blockID)
+		if !ok || (dedupKey{metadata.Checksum, metadata.Size, metadata.Encoding, metadata.Dictionary}) != key {
+			return false, nil
+		}
+		info, err := os.Lstat(member.path)
+		if err != nil {
+			return false, nil
+		}
+		if _, id, _ := fileLinks(info); id != member.id {
+			return false, nil
+		}
+	}
+
+	temp := filepath.Join(s.dataPath, dedupTempFile)
+	if err := os.Remove(temp); err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if err := os.Link(keep.path, temp); err != nil {
+		return false, err
+	}
+	if err := os.Rename(temp, m.path); err != nil {
+		os.Remove(temp)
+		return false, err
+	}
+	if err := s.syncDir(filepath.Dir(m.path)); err != nil {
+		return false, fmt.Errorf("failed to sync block directory: %w", err)
+	}
+	return true, nil
+}
+
+// unshareBlockFile removes a block's file if other blocks share it after
+// deduplication, so that rewriting the block leaves theirs intact
+func unshareBlockFile(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if links, _, ok := fileLinks(info); ok && links > 1 {
+		return os.Remove(path)
+	}
+	return nil
+}
+
+// fileID identifies a file independently of its names
+type fileID struct {
+	dev uint64
+	ino uint64
+}
@@ -0,0 +1,560 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/3fs-storage/internal/dictionary"
+	"github.com/3fs-storage/internal/ratelimit"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DictionaryDir is the directory under the data path that holds the
+// target's compression dictionaries, and the index of the dictionary each
+// namespace's small blocks are compressed with
+const DictionaryDir = "dictionaries"
+
+// dictionaryIndexFile records the dictionaries in use and retired
+const dictionaryIndexFile = "index.json"
+
+// EncodingZstd is the encoding of block files compressed with zstd and the
+// dictionary their metadata names
+const EncodingZstd = "zstd"
+
+// maxSampledBlocks bounds the block IDs a training pass keeps per
+// namespace to sample from
+const maxSampledBlocks = 16384
+
+// DictionaryOptions tunes the training of compression dictionaries
+type DictionaryOptions struct {
+	// Namespaces limits training to these namespaces; empty trains every
+	// namespace with enough small blocks
+	Namespaces []string
+	// MaxBlockSize is the size of the largest block sampled, and
+	// compressed with its namespace's dictionary
+	MaxBlockSize int
+	// Size is the size of the dictionaries trained
+	Size int
+	// SampleSize bounds the data sampled per namespace
+	SampleSize int64
+	// MinSamples is the fewest small blocks a namespace is trained from
+	MinSamples int
+}
+
+// DictionaryReport summarises a dictionary training pass over a target
+type DictionaryReport struct {
+	StartedAt  int64                           `json:"started_at"`
+	FinishedAt int64                           `json:"finished_at"`
+	Scanned    int                             `json:"scanned"`
+	Namespaces map[string]*NamespaceDictionary `json:"namespaces"`
+}
+
+// NamespaceDictionary reports the training of a namespace's dictionary
+type NamespaceDictionary struct {
+	SmallBlocks int   `json:"small_blocks"`
+	Samples     int   `json:"samples"`
+	SampleBytes int64 `json:"sample_bytes"`
+	// Dictionary is the ID of the dictionary the namespace's small blocks
+	// are compressed with after the pass, zero without one
+	Dictionary uint32 `json:"dictionary,omitempty"`
+	// Trained is set when the pass replaced the namespace's dictionary
+	Trained bool `json:"trained"`
+	// Ratio is the compression ratio of the samples held out of training
+	// with the dictionary in use
+	Ratio float64 `json:"ratio,omitempty"`
+	// Removed lists the retired dictionaries no block uses any more
+	Removed []uint32 `json:"removed,omitempty"`
+	Skipped string   `json:"skipped,omitempty"`
+}
+
+// dictionaryIndex maps namespaces to their dictionaries
+type dictionaryIndex struct {
+	Current map[string]uint32             `json:"current"`
+	Retired map[uint32]*retiredDictionary `json:"retired"`
+}
+
+// retiredDictionary is a dictionary replaced by a newer one, kept while
+// blocks compressed with it remain
+type retiredDictionary struct {
+	Namespace string `json:"namespace"`
+	RetiredAt int64  `json:"retired_at"`
+}
+
+// dictionaries holds a target's compression dictionaries and the zstd
+// coders made from them
+type dictionaries struct {
+	dir      string
+	index    dictionaryIndex
+	encoders map[uint32]*zstd.Encoder
+	decoders map[uint32]*zstd.Decoder
+	mu       sync.Mutex
+}
+
+// newDictionaries returns the dictionaries kept in dir
+func newDictionaries(dir string) *dictionaries {
+	return &dictionaries{
+		dir: dir,
+		index: dictionaryIndex{
+			Current: make(map[string]uint32),
+			Retired: make(map[uint32]*retiredDictionary),
+		},
+		encoders: make(map[uint32]*zstd.Encoder),
+		decoders: make(map[uint32]*zstd.Decoder),
+	}
+}
+
+// load reads the index of the dictionaries
+func (d *dictionaries) load() error {
+	data, err := ioutil.ReadFile(filepath.Join(d.dir, dictionaryIndexFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read dictionary index: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := json.Unmarshal(data, &d.index); err != nil {
+		return fmt.Errorf("failed to parse dictionary index: %w", err)
+	}
+	if d.index.Current == nil {
+		d.index.Current = make(map[string]uint32)
+	}
+	if d.index.Retired == nil {
+		d.index.Retired = make(map[uint32]*retiredDictionary)
+	}
+	return nil
+}
+
+// save writes the index, replacing the previous one atomically
+func (d *dictionaries) save() error {
+	data, err := json.MarshalIndent(&d.index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode dictionary index: %w", err)
+	}
+	path := filepath.Join(d.dir, dictionaryIndexFile)
+	if err := writeFile(path+".tmp", data, true); err != nil {
+		return fmt.Errorf("failed to write dictionary index: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write dictionary index: %w", err)
+	}
+	return nil
+}
+
+// path returns the file of a dictionary
+func (d *dictionaries) path(id uint32) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%08x.dict", id))
+}
+
+// current returns the ID of a namespace's dictionary, zero without one
+func (d *dictionaries) current(namespace string) uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.index.Current[namespace]
+}
+
+// encoder returns the encoder of a namespace's dictionary and its ID, or
+// nil when the namespace has none
+func (d *dictionaries) encoder(namespace string) (*zstd.Encoder, uint32, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id, ok := d.index.Current[namespace]
+	if !ok {
+		return nil, 0, nil
+	}
+	if enc, ok := d.encoders[id]; ok {
+		return enc, id, nil
+	}
+	dict, err := ioutil.ReadFile(d.path(id))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read dictionary %08x: %w", id, err)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dict))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to load dictionary %08x: %w", id, err)
+	}
+	d.encoders[id] = enc
+	return enc, id, nil
+}
+
+// decoder returns the decoder of a dictionary; zero decodes blocks
+// compressed without one
+func (d *dictionaries) decoder(id uint32) (*zstd.Decoder, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if dec, ok := d.decoders[id]; ok {
+		return dec, nil
+	}
+	opts := []zstd.DOption{zstd.WithDecoderMaxMemory(api.MaxDataSize)}
+	if id != 0 {
+		dict, err := ioutil.ReadFile(d.path(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read dictionary %08x: %w", id, err)
+		}
+		opts = append(opts, zstd.WithDecoderDicts(dict))
+	}
+	dec, err := zstd.NewReader(nil, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load dictionary %08x: %w", id, err)
+	}
+	d.decoders[id] = dec
+	return dec, nil
+}
+
+// add makes a dictionary the one a namespace's blocks are compressed with,
+// retiring the previous one
+func (d *dictionaries) add(namespace string, id uint32, dict []byte) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return fmt.Errorf("failed to create dictionary directory: %w", err)
+	}
+	if err := writeFile(d.path(id), dict, true); err != nil {
+		return fmt.Errorf("failed to write dictionary %08x: %w", id, err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if previous, ok := d.index.Current[namespace]; ok && previous != id {
+		d.index.Retired[previous] = &retiredDictionary{Namespace: namespace, RetiredAt: time.Now().UnixNano()}
+	}
+	d.index.Current[namespace] = id
+	delete(d.index.Retired, id)
+	return d.save()
+}
+
+// retired returns the dictionaries of a namespace retired before a time
+func (d *dictionaries) retired(namespace string, before time.Time) []uint32 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	ids := make([]uint32, 0)
+	for id, r := range d.index.Retired {
+		if r.Namespace == namespace && r.RetiredAt < before.UnixNano() {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// remove deletes a retired dictionary
+func (d *dictionaries) remove(id uint32) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.index.Retired[id]; !ok {
+		return nil
+	}
+	delete(d.index.Retired, id)
+	if err := d.save(); err != nil {
+		return err
+	}
+	delete(d.encoders, id)
+	delete(d.decoders, id)
+	if err := os.Remove(d.path(id)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove dictionary %08x: %w", id, err)
+	}
+	return nil
+}
+
+// SetDictionaryCompression compresses the blocks of up to maxBlockSize
+// bytes written to a namespace that has a dictionary; zero stops
+// compressing new blocks. Blocks compressed before are read either way.
+func (s *LocalStorage) SetDictionaryCompression(maxBlockSize int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.compressBelow = maxBlockSize
+}
+
+// encodeBlock compresses a small block's data with its namespace's
+// dictionary when that makes it smaller, returning the data and metadata
+// to store. Compression is an optimisation: a block that cannot be
+// compressed is stored as it is.
+func (s *LocalStorage) encodeBlock(blockID string, data, metadata []byte) ([]byte, []byte) {
+	if len(data) == 0 || len(data) > s.compressBelow || metadata == nil {
+		return data, metadata
+	}
+	enc, id, err := s.dictionaries.encoder(api.Namespace(blockID))
+	if err != nil || enc == nil {
+		return data, metadata
+	}
+	compressed := enc.EncodeAll(data, nil)
+	if len(compressed) >= len(data) {
+		return data, metadata
+	}
+
+	var m BlockMetadata
+	if err := json.Unmarshal(metadata, &m); err != nil {
+		return data, metadata
+	}
+	m.Encoding, m.Dictionary = EncodingZstd, id
+	encoded, err := json.Marshal(&m)
+	if err != nil {
+		return data, metadata
+	}
+	return compressed, encoded
+}
+
+// decodeBlock returns the data of a block file as it was written
+func (s *LocalStorage) decodeBlock(data []byte, metadata *BlockMetadata) ([]byte, error) {
+	switch metadata.Encoding {
+	case "":
+		return data, nil
+	case EncodingZstd:
+		dec, err := s.dictionaries.decoder(metadata.Dictionary)
+		if err != nil {
+			return nil, err
+		}
+		decoded, err := dec.DecodeAll(data, make([]byte, 0, metadata.Size))
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress block data: %w", err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unknown block encoding %q", metadata.Encoding)
+	}
+}
+
+// decodeBlockFile returns the data of a block file as it was written,
+// given its metadata file
+func (s *LocalStorage) decodeBlockFile(data, metadataBytes []byte) ([]byte, error) {
+	if len(metadataBytes) == 0 {
+		return data, nil
+	}
+	var metadata BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return nil, fmt.Errorf("failed to parse block metadata: %w", err)
+	}
+	return s.decodeBlock(data, &metadata)
+}
+
+// namespaceSamples gathers what a training pass learns of a namespace
+type namespaceSamples struct {
+	small    int
+	blockIDs []string
+	used     map[uint32]bool
+}
+
+// TrainDictionaries trains a compression dictionary for each namespace
+// with enough small blocks on the target, from a sample of them. A new
+// dictionary replaces a namespace's current one only if it compresses the
+// samples held out of training better. Retired dictionaries that no block
+// uses any more are removed.
+func (s *LocalStorage) TrainDictionaries(ctx context.Context, budget *ratelimit.Limiter, opts DictionaryOptions) (*DictionaryReport, error) {
+	started := time.Now()
+	report := &DictionaryReport{
+		StartedAt:  started.UnixNano(),
+		Namespaces: make(map[string]*NamespaceDictionary),
+	}
+	wanted := make(map[string]bool, len(opts.Namespaces))
+	for _, ns := range opts.Namespaces {
+		wanted[ns] = true
+	}
+
+	blockIDs, err := s.ListBlocks("")
+	if err != nil {
+		return nil, err
+	}
+
+	// Find each namespace's small blocks and the dictionaries in use,
+	// keeping a uniform sample of the small blocks
+	rng := rand.New(rand.NewSource(started.UnixNano()))
+	namespaces := make(map[string]*namespaceSamples)
+	for _, blockID := range blockIDs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		ns := api.Namespace(blockID)
+		if len(wanted) > 0 && !wanted[ns] {
+			continue
+		}
+		hasMetadata, metadataBytes, err := s.ReadBlockMetadata(blockID)
+		if err != nil || !hasMetadata {
+			continue
+		}
+		var metadata BlockMetadata
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			continue
+		}
+		report.Scanned++
+
+		n := namespaces[ns]
+		if n == nil {
+			n = &namespaceSamples{used: make(map[uint32]bool)}
+			namespaces[ns] = n
+		}
+		if metadata.Encoding != "" {
+			n.used[metadata.Dictionary] = true
+		}
+		if metadata.Size == 0 || metadata.Size > opts.MaxBlockSize {
+			continue
+		}
+		n.small++
+		if len(n.blockIDs) < maxSampledBlocks {
+			n.blockIDs = append(n.blockIDs, blockID)
+		} else if i := rng.Intn(n.small); i < maxSampledBlocks {
+			n.blockIDs[i] = blockID
+		}
+	}
+
+	names := make([]string, 0, len(namespaces))
+	for ns := range namespaces {
+		names = append(names, ns)
+	}
+	sort.Strings(names)
+	for _, ns := range names {
+		result, err := s.trainNamespace(ctx, budget, ns, namespaces[ns], opts)
+		if result != nil {
+			report.Namespaces[ns] = result
+		}
+		if err != nil {
+			return report, fmt.Errorf("namespace %s: %w", ns, err)
+		}
+		if result.Removed, err = s.removeUnusedDictionaries(ns, namespaces[ns].used, started); err != nil {
+			return report, fmt.Errorf("namespace %s: %w", ns, err)
+		}
+	}
+
+	report.FinishedAt = time.Now().UnixNano()
+	return report, nil
+}
+
+// trainNamespace trains a dictionary from a namespace's sampled blocks and
+// adopts it if it does better than the current one
+func (s *LocalStorage) trainNamespace(ctx context.Context, budget *ratelimit.Limiter, ns string, n *namespaceSamples, opts DictionaryOptions) (*NamespaceDictionary, error) {
+	result := &NamespaceDictionary{SmallBlocks: n.small, Dictionary: s.dictionaries.current(ns)}
+	if n.small < opts.MinSamples {
+		result.Skipped = fmt.Sprintf("%d small blocks, %d needed", n.small, opts.MinSamples)
+		return result, nil
+	}
+
+	// Every tenth sample is held out to compare dictionaries on
+	train := make([][]byte, 0, len(n.blockIDs))
+	held := make([][]byte, 0, len(n.blockIDs)/10)
+	for _, blockID := range n.blockIDs {
+		if result.SampleBytes >= opts.SampleSize {
+			break
+		}
+		release, err := s.acquireDisk(ctx, DiskBackground)
+		if err != nil {
+			return result, err
+		}
+		data, _, err := s.ReadBlock(blockID)
+		release()
+		if errors.Is(err, api.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+		if err := budget.WaitN(ctx, len(data)); err != nil {
+			return result, err
+		}
+		if result.Samples%10 == 9 {
+			held = append(held, data)
+		} else {
+			train = append(train, data)
+		}
+		result.Samples++
+		result.SampleBytes += int64(len(data))
+	}
+	if len(held) == 0 {
+		held = train
+	}
+
+	dict, id, err := dictionary.Train(train, opts.Size)
+	if errors.Is(err, dictionary.ErrTooFewSamples) {
+		result.Skipped = err.Error()
+		return result, nil
+	}
+	if err != nil {
+		return result, err
+	}
+	ratio, err := compressionRatio(held, zstd.WithEncoderDict(dict))
+	if err != nil {
+		return result, err
+	}
+
+	if result.Dictionary != 0 {
+		current, _, err := s.dictionaries.encoder(ns)
+		if err == nil && current != nil {
+			if currentRatio := ratioWith(held, current); currentRatio >= ratio {
+				result.Ratio = currentRatio
+				result.Skipped = "the current dictionary compresses as well"
+				return result, nil
+			}
+		}
+	}
+	if ratio <= 1 {
+		result.Skipped = "the samples do not compress"
+		return result, nil
+	}
+
+	s.mu.Lock()
+	err = s.dictionaries.add(ns, id, dict)
+	s.mu.Unlock()
+	if err != nil {
+		return result, err
+	}
+	result.Dictionary, result.Trained, result.Ratio = id, true, ratio
+	return result, nil
+}
+
+// removeUnusedDictionaries removes the dictionaries of a namespace retired
+// before a training pass started that none of its blocks use. Blocks are
+// written under the storage lock that retiring takes, so none written
+// since uses them.
+func (s *LocalStorage) removeUnusedDictionaries(ns string, used map[uint32]bool, started time.Time) ([]uint32, error) {
+	removed := make([]uint32, 0)
+	for _, id := range s.dictionaries.retired(ns, started) {
+		if used[id] {
+			continue
+		}
+		s.mu.Lock()
+		err := s.dictionaries.remove(id)
+		s.mu.Unlock()
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, id)
+	}
+	return removed, nil
+}
+
+// compressionRatio returns the ratio samples compress by, one at a time,
+// with an encoder made with opts
+func compressionRatio(samples [][]byte, opts ...zstd.EOption) (float64, error) {
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return 0, fmt.Errorf("failed to load dictionary: %w", err)
+	}
+	defer enc.Close()
+	return ratioWith(samples, enc), nil
+}
+
+// ratioWith returns the ratio samples compress by with enc, one at a time
+func ratioWith(samples [][]byte, enc *zstd.Encoder) float64 {
+	var raw, compressed int
+	for _, sample := range samples {
+		raw += len(sample)
+		compressed += len(enc.EncodeAll(sample, nil))
+	}
+	if compressed == 0 {
+		return 0
+	}
+	return float64(raw) / float64(compressed)
+}
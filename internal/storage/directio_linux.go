@@ -0,0 +1,8 @@
+//go:build linux
+
+package storage
+
+import "syscall"
+
+// directIOFlag opens a file bypassing the page cache
+const directIOFlag = syscall.O_DIRECT
@@ -0,0 +1,6 @@
+//go:build !linux
+
+package storage
+
+// directIOFlag is zero where direct IO is not supported
+const directIOFlag = 0
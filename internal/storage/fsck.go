@@ -0,0 +1,349 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/ratelimit"
+)
+
+// QuarantineDir is the directory under the data path that damaged blocks
+// are moved to, out of reach of reads but kept for inspection
+const QuarantineDir = "quarantine"
+
+// Kinds of problem found by fsck
+const (
+	// FsckCorrupt is a block whose data does not match its metadata
+	FsckCorrupt = "corrupt"
+	// FsckUnreadable is a block whose data or metadata cannot be read
+	FsckUnreadable = "unreadable"
+	// FsckBadMetadata is a block whose metadata cannot be decoded
+	FsckBadMetadata = "bad_metadata"
+	// FsckMissingMetadata is block data without metadata
+	FsckMissingMetadata = "missing_metadata"
+	// FsckMissingData is block metadata without data
+	FsckMissingData = "missing_data"
+	// FsckMisplaced is a block stored in another shard than its ID maps to,
+	// where reads do not find it
+	FsckMisplaced = "misplaced"
+)
+
+// Actions taken by fsck on a problem
+const (
+	FsckQuarantined = "quarantined"
+	FsckRemoved     = "removed"
+	FsckMoved       = "moved"
+)
+
+// FsckOptions select what fsck does about the problems it finds. Without
+// any, it only reports them.
+type FsckOptions struct {
+	// Repair fixes what can be fixed from the target alone: misplaced
+	// blocks are moved to their shard and metadata without data removed
+	Repair bool `json:"repair"`
+	// Quarantine moves blocks whose data or metadata is damaged to the
+	// quarantine directory
+	Quarantine bool `json:"quarantine"`
+	// Grace skips files modified this recently, as a write may still be in
+	// progress
+	Grace time.Duration `json:"-"`
+}
+
+// FsckProblem is a problem fsck found with a block
+type FsckProblem struct {
+	BlockID string `json:"block_id"`
+	Kind    string `json:"kind"`
+	Detail  string `json:"detail,omitempty"`
+	Action  string `json:"action,omitempty"`
+}
+
+// FsckReport summarises an fsck pass over local storage
+type FsckReport struct {
+	StartedAt  int64         `json:"started_at"`
+	FinishedAt int64         `json:"finished_at"`
+	Scanned    int           `json:"scanned"`
+	Problems   []FsckProblem `json:"problems"`
+}
+
+// Unresolved returns the number of problems that were left as found
+func (r *FsckReport) Unresolved() int {
+	n := 0
+	for _, problem := range r.Problems {
+		if problem.Action == "" {
+			n++
+		}
+	}
+	return n
+}
+
+// fsckEntry is a block found in a shard, with the files it has there
+type fsckEntry struct {
+	shard   string
+	data    os.FileInfo
+	meta    os.FileInfo
+	blockID string
+}
+
+// Fsck checks every file of local storage: that each block has both data
+// and metadata, that the data matches the size and checksum in the
+// metadata, and that it is in the shard its ID maps to. Unlike Scrub it
+// also finds blocks reads cannot reach, and can repair or quarantine what
+// it finds. Reads are paced by budget, which may be nil, and fsck stops
+// early if ctx is done.
+func (s *LocalStorage) Fsck(ctx context.Context, budget *ratelimit.Limiter, opts FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{
+		StartedAt: time.Now().UnixNano(),
+		Problems:  make([]FsckProblem, 0),
+	}
+
+	entries, err := s.fsckEntries()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-opts.Grace)
+
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+		if entry.data != nil && entry.data.ModTime().After(cutoff) ||
+			entry.meta != nil && entry.meta.ModTime().After(cutoff) {
+			continue
+		}
+		report.Scanned++
+
+		problem, err := s.fsckBlock(ctx, budget, entry, opts)
+		if err != nil {
+			return report, err
+		}
+		if problem != nil {
+			report.Problems = append(report.Problems, *problem)
+		}
+	}
+
+	report.FinishedAt = time.Now().UnixNano()
+	return report, nil
+}
+
+// fsckEntries lists the blocks in every shard, by shard and ID
+func (s *LocalStorage) fsckEntries() ([]*fsckEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shards, err := ioutil.ReadDir(s.dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	var entries []*fsckEntry
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShardDir(shard.Name()) {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.dataPath, shard.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shard directory %s: %w", shard.Name(), err)
+		}
+
+		byID := make(map[string]*fsckEntry, len(files))
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			blockID := strings.TrimSuffix(file.Name(), ".meta")
+			entry, ok := byID[blockID]
+			if !ok {
+				entry = &fsckEntry{shard: shard.Name(), blockID: blockID}
+				byID[blockID] = entry
+				entries = append(entries, entry)
+			}
+			if blockID == file.Name() {
+				entry.data = file
+			} else {
+				entry.meta = file
+			}
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].blockID < entries[j].blockID
+	})
+	return entries, nil
+}
+
+// fsckBlock checks one block, returning the problem found with it if any
+func (s *LocalStorage) fsckBlock(ctx context.Context, budget *ratelimit.Limiter, entry *fsckEntry, opts FsckOptions) (*FsckProblem, error) {
+	dataPath := filepath.Join(s.dataPath, entry.shard, entry.blockID)
+	metaPath := dataPath + ".meta"
+
+	if home := filepath.Base(filepath.Dir(s.getBlockPath(entry.blockID))); home != entry.shard {
+		problem := &FsckProblem{
+			BlockID: entry.blockID,
+			Kind:    FsckMisplaced,
+			Detail:  fmt.Sprintf("in shard %s, expected %s", entry.shard, home),
+		}
+		if opts.Repair {
+			moved, err := s.moveToShard(entry)
+			if err != nil {
+				return nil, err
+			}
+			if moved {
+				problem.Action = FsckMoved
+			} else {
+				problem.Detail += ", which already holds the block"
+			}
+		}
+		return problem, nil
+	}
+
+	switch {
+	case entry.data == nil:
+		problem := &FsckProblem{BlockID: entry.blockID, Kind: FsckMissingData}
+		if opts.Repair {
+			if err := s.removeFile(metaPath); err != nil {
+				return nil, err
+			}
+			problem.Action = FsckRemoved
+		}
+		return problem, nil
+	case entry.meta == nil:
+		return s.fsckDamaged(entry.blockID, FsckMissingMetadata, "", opts)
+	}
+
+	release, err := s.acquireDisk(ctx, DiskBackground)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.RLock()
+	data, readErr := ioutil.ReadFile(dataPath)
+	metadataBytes, metaErr := ioutil.ReadFile(metaPath)
+	s.mu.RUnlock()
+	release()
+
+	if os.IsNotExist(readErr) || os.IsNotExist(metaErr) {
+		// Deleted while we were scanning
+		return nil, nil
+	}
+	if err := budget.WaitN(ctx, len(data)); err != nil {
+		return nil, err
+	}
+
+	if readErr != nil {
+		return s.fsckDamaged(entry.blockID, FsckUnreadable, readErr.Error(), opts)
+	}
+	if metaErr != nil {
+		return s.fsckDamaged(entry.blockID, FsckUnreadable, metaErr.Error(), opts)
+	}
+
+	var metadata BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return s.fsckDamaged(entry.blockID, FsckBadMetadata, err.Error(), opts)
+	}
+	data, err = s.decodeBlock(data, &metadata)
+	if err != nil {
+		return s.fsckDamaged(entry.blockID, FsckCorrupt, err.Error(), opts)
+	}
+	if metadata.Size != len(data) {
+		detail := fmt.Sprintf("size %d, metadata records %d", len(data), metadata.Size)
+		return s.fsckDamaged(entry.blockID, FsckCorrupt, detail, opts)
+	}
+	if checksum := hex.EncodeToString(CalculateChecksum(data)); metadata.Checksum != checksum {
+		detail := fmt.Sprintf("checksum %s, metadata records %s", checksum, metadata.Checksum)
+		return s.fsckDamaged(entry.blockID, FsckCorrupt, detail, opts)
+	}
+	return nil, nil
+}
+
+// fsckDamaged reports a block whose data or metadata is damaged, and
+// quarantines it if asked to
+func (s *LocalStorage) fsckDamaged(blockID, kind, detail string, opts FsckOptions) (*FsckProblem, error) {
+	problem := &FsckProblem{BlockID: blockID, Kind: kind, Detail: detail}
+	if opts.Quarantine {
+		if err := s.QuarantineBlock(blockID); err != nil {
+			return nil, err
+		}
+		problem.Action = FsckQuarantined
+	}
+	return problem, nil
+}
+
+// QuarantineBlock moves a block's files to the quarantine directory, so
+// that it is no longer read or replicated but can still be inspected. A
+// block quarantined before is kept under a name with the time it was
+// quarantined again.
+func (s *LocalStorage) QuarantineBlock(blockID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dir := filepath.Join(s.dataPath, QuarantineDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create quarantine directory: %w", err)
+	}
+	name := blockID
+	if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+		name = fmt.Sprintf("%s.%d", blockID, time.Now().UnixNano())
+	}
+
+	blockPath := s.getBlockPath(blockID)
+	for _, suffix := range []string{"", ".meta"} {
+		err := os.Rename(blockPath+suffix, filepath.Join(dir, name+suffix))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to quarantine block %s: %w", blockID, err)
+		}
+	}
+	s.cache.remove(blockID)
+	s.touch(blockID)
+	return s.syncDir(filepath.Dir(blockPath))
+}
+
+// moveToShard moves a misplaced block to the shard its ID maps to, unless
+// that shard already holds the block
+func (s *LocalStorage) moveToShard(entry *fsckEntry) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	from := filepath.Join(s.dataPath, entry.shard, entry.blockID)
+	to := s.getBlockPath(entry.blockID)
+	for _, path := range []string{to, to + ".meta"} {
+		if _, err := os.Stat(path); err == nil {
+			return false, nil
+		}
+	}
+
+	for _, suffix := range []string{"", ".meta"} {
+		err := os.Rename(from+suffix, to+suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return false, fmt.Errorf("failed to move block %s: %w", entry.blockID, err)
+		}
+	}
+	s.cache.remove(entry.blockID)
+	// Both shards change; the one the block left is found by its directory
+	s.generations[shardIndex(entry.shard)].Add(1)
+	s.touch(entry.blockID)
+	if err := s.syncDir(filepath.Dir(from)); err != nil {
+		return false, fmt.Errorf("failed to sync block directory: %w", err)
+	}
+	if err := s.syncDir(filepath.Dir(to)); err != nil {
+		return false, fmt.Errorf("failed to sync block directory: %w", err)
+	}
+	return true, nil
+}
+
+// removeFile removes a file of a block under the storage lock
+func (s *LocalStorage) removeFile(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
@@ -0,0 +1,353 @@
+package storage
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DiskClass classifies a disk operation for the disk scheduler
+type DiskClass int
+
+const (
+	// DiskRead is a foreground block read
+	DiskRead DiskClass = iota
+	// DiskWrite is a foreground block write or delete
+	DiskWrite
+	// DiskBackground is the IO of scrubs, fsck, compactions, repair and
+	// other maintenance
+	DiskBackground
+
+	numDiskClasses
+)
+
+// String returns the name of the disk class
+func (c DiskClass) String() string {
+	switch c {
+	case DiskRead:
+		return "read"
+	case DiskWrite:
+		return "write"
+	case DiskBackground:
+		return "background"
+	default:
+		return "unknown"
+	}
+}
+
+// DiskLimits configures a disk scheduler
+type DiskLimits struct {
+	// QueueDepth is the number of disk operations run at the same time
+	QueueDepth int
+	// MaxBackground caps the background operations among them
+	MaxBackground int
+	// Deadlines are how long each class of operation may wait, unless its
+	// context's deadline is sooner
+	Deadlines [numDiskClasses]time.Duration
+}
+
+// DefaultDiskLimits returns the default limits of a target's disk
+func DefaultDiskLimits() DiskLimits {
+	return DiskLimits{
+		QueueDepth:    32,
+		MaxBackground: 2,
+		Deadlines: [numDiskClasses]time.Duration{
+			DiskRead:       20 * time.Millisecond,
+			DiskWrite:      100 * time.Millisecond,
+			DiskBackground: 2 * time.Second,
+		},
+	}
+}
+
+// diskWaiter is a queued disk operation
+type diskWaiter struct {
+	class    DiskClass
+	queuedAt time.Time
+	deadline time.Time
+	seq      uint64
+	ready    chan struct{}
+	// index is the waiter's position in the queue, -1 once it left it
+	index int
+}
+
+// diskQueue orders waiting operations by deadline, earliest first
+type diskQueue []*diskWaiter
+
+func (q diskQueue) Len() int { return len(q) }
+func (q diskQueue) Less(i, j int) bool {
+	if !q[i].deadline.Equal(q[j].deadline) {
+		return q[i].deadline.Before(q[j].deadline)
+	}
+	return q[i].seq < q[j].seq
+}
+func (q diskQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *diskQueue) Push(x interface{}) {
+	w := x.(*diskWaiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *diskQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// diskClassState counts the operations of one class
+type diskClassState struct {
+	inflight int
+	queued   int
+	granted  uint64
+	missed   uint64
+	waited   time.Duration
+}
+
+// DiskScheduler orders a disk's operations by deadline. Each operation is
+// tagged with a class and a deadline, the sooner of its context's and its
+// class's; when the disk is busy, the operation with the earliest
+// deadline runs next, so that foreground reads overtake the background
+// operations queued before them. Background operations never take more
+// than their own share of the queue depth, and their longer deadline
+// keeps them from starving.
+type DiskScheduler struct {
+	limits   DiskLimits
+	inflight int
+	seq      uint64
+	queue    diskQueue
+	blocked  []*diskWaiter
+	classes  [numDiskClasses]diskClassState
+	mu       sync.Mutex
+}
+
+// NewDiskScheduler creates a disk scheduler
+func NewDiskScheduler(limits DiskLimits) (*DiskScheduler, error) {
+	if limits.QueueDepth <= 0 {
+		return nil, fmt.Errorf("disk queue depth must be greater than zero")
+	}
+	if limits.MaxBackground <= 0 || limits.MaxBackground > limits.QueueDepth {
+		return nil, fmt.Errorf("background disk operations must be between 1 and the queue depth %d", limits.QueueDepth)
+	}
+	defaults := DefaultDiskLimits()
+	for class := DiskClass(0); class < numDiskClasses; class++ {
+		if limits.Deadlines[class] < 0 {
+			return nil, fmt.Errorf("deadline of %s disk operations cannot be negative", class)
+		}
+		if limits.Deadlines[class] == 0 {
+			limits.Deadlines[class] = defaults.Deadlines[class]
+		}
+	}
+	return &DiskScheduler{limits: limits}, nil
+}
+
+// Acquire blocks until a disk operation of the given class may run. The
+// returned function must be called once the operation has finished. A nil
+// scheduler lets every operation run.
+func (d *DiskScheduler) Acquire(ctx context.Context, class DiskClass) (func(), error) {
+	if d == nil {
+		return func() {}, nil
+	}
+	if class < 0 || class >= numDiskClasses {
+		return nil, fmt.Errorf("unknown disk class %d", class)
+	}
+
+	now := time.Now()
+	deadline := now.Add(d.limits.Deadlines[class])
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		deadline = ctxDeadline
+	}
+
+	d.mu.Lock()
+	cs := &d.classes[class]
+
+	// Fast path: nothing queued ahead and there is capacity
+	if len(d.queue) == 0 && (class != DiskBackground || len(d.blocked) == 0) && d.canRun(class) {
+		d.grant(class, now, deadline, now)
+		d.mu.Unlock()
+		return d.releaseFunc(class), nil
+	}
+
+	d.seq++
+	w := &diskWaiter{class: class, queuedAt: now, deadline: deadline, seq: d.seq, ready: make(chan struct{})}
+	heap.Push(&d.queue, w)
+	cs.queued++
+	// Operations queued ahead may be background ones over their limit,
+	// which must not hold this one up
+	d.dispatch()
+	d.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return d.releaseFunc(class), nil
+	case <-ctx.Done():
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		select {
+		case <-w.ready:
+			// Granted concurrently with the cancellation, so give the slot
+			// back
+			d.release(class)
+		default:
+			d.remove(w)
+			cs.queued--
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// remove takes a waiter out of the queue, or out of the waiters blocked
+// by the background limit
+func (d *DiskScheduler) remove(w *diskWaiter) {
+	if w.index >= 0 {
+		heap.Remove(&d.queue, w.index)
+		return
+	}
+	for i, b := range d.blocked {
+		if b == w {
+			d.blocked = append(d.blocked[:i], d.blocked[i+1:]...)
+			return
+		}
+	}
+}
+
+// releaseFunc returns a function that releases a slot of the class exactly
+// once
+func (d *DiskScheduler) releaseFunc(class DiskClass) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.release(class)
+		})
+	}
+}
+
+// release frees a slot and hands it on
+func (d *DiskScheduler) release(class DiskClass) {
+	d.classes[class].inflight--
+	d.inflight--
+	d.dispatch()
+}
+
+// canRun reports whether an operation of the class fits within the limits
+func (d *DiskScheduler) canRun(class DiskClass) bool {
+	if d.inflight >= d.limits.QueueDepth {
+		return false
+	}
+	return class != DiskBackground || d.classes[DiskBackground].inflight < d.limits.MaxBackground
+}
+
+// grant accounts a dispatched operation against its class
+func (d *DiskScheduler) grant(class DiskClass, queuedAt, deadline, now time.Time) {
+	cs := &d.classes[class]
+	cs.inflight++
+	d.inflight++
+	cs.granted++
+	cs.waited += now.Sub(queuedAt)
+	if now.After(deadline) {
+		cs.missed++
+	}
+}
+
+// dispatch hands free slots to the waiting operations with the earliest
+// deadlines. Background operations over their limit are set aside until
+// one of theirs finishes, so that they do not hold up the others.
+func (d *DiskScheduler) dispatch() {
+	if d.classes[DiskBackground].inflight < d.limits.MaxBackground && len(d.blocked) > 0 {
+		for _, w := range d.blocked {
+			heap.Push(&d.queue, w)
+		}
+		d.blocked = d.blocked[:0]
+	}
+
+	now := time.Now()
+	for d.inflight < d.limits.QueueDepth && len(d.queue) > 0 {
+		w := heap.Pop(&d.queue).(*diskWaiter)
+		if !d.canRun(w.class) {
+			d.blocked = append(d.blocked, w)
+			continue
+		}
+		d.classes[w.class].queued--
+		d.grant(w.class, w.queuedAt, w.deadline, now)
+		close(w.ready)
+	}
+}
+
+// DiskStats reports a disk scheduler's load, overall and per class
+type DiskStats struct {
+	Inflight   int                        `json:"inflight"`
+	QueueDepth int                        `json:"queue_depth"`
+	Queued     int                        `json:"queued"`
+	Classes    map[string]*DiskClassStats `json:"classes"`
+}
+
+// DiskClassStats reports the operations of one disk class. Missed counts
+// those that waited past their deadline.
+type DiskClassStats struct {
+	Inflight    int     `json:"inflight"`
+	Queued      int     `json:"queued"`
+	Granted     uint64  `json:"granted"`
+	Missed      uint64  `json:"missed"`
+	MeanWaitMs  float64 `json:"mean_wait_ms"`
+	DeadlineMs  float64 `json:"deadline_ms"`
+	MaxInflight int     `json:"max_inflight"`
+}
+
+// Stats returns the scheduler's queue and dispatch statistics
+func (d *DiskScheduler) Stats() *DiskStats {
+	if d == nil {
+		return nil
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	stats := &DiskStats{
+		Inflight:   d.inflight,
+		QueueDepth: d.limits.QueueDepth,
+		Classes:    make(map[string]*DiskClassStats, numDiskClasses),
+	}
+	for class := DiskClass(0); class < numDiskClasses; class++ {
+		cs := d.classes[class]
+		stats.Queued += cs.queued
+		s := &DiskClassStats{
+			Inflight:    cs.inflight,
+			Queued:      cs.queued,
+			Granted:     cs.granted,
+			Missed:      cs.missed,
+			DeadlineMs:  float64(d.limits.Deadlines[class]) / float64(time.Millisecond),
+			MaxInflight: d.limits.QueueDepth,
+		}
+		if class == DiskBackground {
+			s.MaxInflight = d.limits.MaxBackground
+		}
+		if cs.granted > 0 {
+			s.MeanWaitMs = float64(cs.waited) / float64(cs.granted) / float64(time.Millisecond)
+		}
+		stats.Classes[class.String()] = s
+	}
+	return stats
+}
+
+// SetDiskScheduler replaces the scheduler of the storage's disk
+// operations; nil lets every operation run at once
+func (s *LocalStorage) SetDiskScheduler(scheduler *DiskScheduler) {
+	s.disk.Store(scheduler)
+}
+
+// DiskScheduler returns the scheduler of the storage's disk operations
+func (s *LocalStorage) DiskScheduler() *DiskScheduler {
+	return s.disk.Load()
+}
+
+// acquireDisk waits for the disk scheduler to let an operation run
+func (s *LocalStorage) acquireDisk(ctx context.Context, class DiskClass) (func(), error) {
+	return s.DiskScheduler().Acquire(ctx, class)
+}
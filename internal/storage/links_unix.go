@@ -0,0 +1,18 @@
+//go:build unix
+
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileLinks returns the number of names a file has and the identity of
+// the file they name
+func fileLinks(info os.FileInfo) (uint64, fileID, bool) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, fileID{}, false
+	}
+	return uint64(st.Nlink), fileID{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/3fs-storage/internal/ratelimit"
+)
+
+// ScrubReport summarises a scrub pass over local storage
+type ScrubReport struct {
+	StartedAt       int64    `json:"started_at"`
+	FinishedAt      int64    `json:"finished_at"`
+	Scanned         int      `json:"scanned"`
+	Corrupted       []string `json:"corrupted"`
+	MissingMetadata []string `json:"missing_metadata"`
+}
+
+// GCReport summarises a garbage collection pass over local storage
+type GCReport struct {
+	StartedAt      int64    `json:"started_at"`
+	FinishedAt     int64    `json:"finished_at"`
+	OrphanedData   []string `json:"orphaned_data"`
+	OrphanedMeta   []string `json:"orphaned_meta"`
+	ReclaimedBytes int64    `json:"reclaimed_bytes"`
+}
+
+// Scrub reads every block on disk and verifies it against the checksum
+// recorded in its metadata. Reads are paced by budget, which may be nil,
+// and the scrub stops early if ctx is done.
+func (s *LocalStorage) Scrub(ctx context.Context, budget *ratelimit.Limiter) (*ScrubReport, error) {
+	report := &ScrubReport{
+		StartedAt:       time.Now().UnixNano(),
+		Corrupted:       make([]string, 0),
+		MissingMetadata: make([]string, 0),
+	}
+
+	blockIDs, err := s.ListBlocks("")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, blockID := range blockIDs {
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		release, err := s.acquireDisk(ctx, DiskBackground)
+		if err != nil {
+			return report, err
+		}
+		s.mu.RLock()
+		data, readErr := ioutil.ReadFile(s.getBlockPath(blockID))
+		hasMetadata, metadataBytes, metaErr := s.ReadBlockMetadata(blockID)
+		s.mu.RUnlock()
+		release()
+
+		if os.IsNotExist(readErr) {
+			// Deleted while we were scanning
+			continue
+		}
+		report.Scanned++
+		if err := budget.WaitN(ctx, len(data)); err != nil {
+			return report, err
+		}
+
+		if readErr != nil || metaErr != nil {
+			report.Corrupted = append(report.Corrupted, blockID)
+			continue
+		}
+		if !hasMetadata {
+			report.MissingMetadata = append(report.MissingMetadata, blockID)
+			continue
+		}
+
+		var metadata BlockMetadata
+		if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+			report.Corrupted = append(report.Corrupted, blockID)
+			continue
+		}
+
+		if data, err = s.decodeBlock(data, &metadata); err != nil {
+			report.Corrupted = append(report.Corrupted, blockID)
+			continue
+		}
+		if metadata.Size != len(data) || metadata.Checksum != hex.EncodeToString(CalculateChecksum(data)) {
+			report.Corrupted = append(report.Corrupted, blockID)
+		}
+	}
+
+	report.FinishedAt = time.Now().UnixNano()
+	return report, nil
+}
+
+// CollectGarbage removes the halves of interrupted writes and deletes: data
+// files without metadata and metadata files without data. Files modified
+// within the grace period are left alone since a write may still be in
+// progress.
+func (s *LocalStorage) CollectGarbage(grace time.Duration) (*GCReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &GCReport{
+		StartedAt:    time.Now().UnixNano(),
+		OrphanedData: make([]string, 0),
+		OrphanedMeta: make([]string, 0),
+	}
+	cutoff := time.Now().Add(-grace)
+
+	shards, err := ioutil.ReadDir(s.dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShardDir(shard.Name()) {
+			continue
+		}
+
+		shardPath := filepath.Join(s.dataPath, shard.Name())
+		entries, err := ioutil.ReadDir(shardPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shard directory %s: %w", shard.Name(), err)
+		}
+
+		present := make(map[string]bool, len(entries))
+		for _, entry := range entries {
+			present[entry.Name()] = true
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || entry.ModTime().After(cutoff) {
+				continue
+			}
+
+			var orphan bool
+			if strings.HasSuffix(name, ".meta") {
+				orphan = !present[strings.TrimSuffix(name, ".meta")]
+			} else {
+				orphan = !present[name+".meta"]
+			}
+			if !orphan {
+				continue
+			}
+
+			if err := os.Remove(filepath.Join(shardPath, name)); err != nil && !os.IsNotExist(err) {
+				return nil, fmt.Errorf("failed to remove orphaned file %s: %w", name, err)
+			}
+
+			report.ReclaimedBytes += entry.Size()
+			if strings.HasSuffix(name, ".meta") {
+				report.OrphanedMeta = append(report.OrphanedMeta, strings.TrimSuffix(name, ".meta"))
+			} else {
+				report.OrphanedData = append(report.OrphanedData, name)
+				s.cache.remove(name)
+				s.generations[shardIndex(shard.Name())].Add(1)
+			}
+		}
+	}
+
+	report.FinishedAt = time.Now().UnixNano()
+	return report, nil
+}
+
+// healthProbeFile is written and read back to check that the disk works
+const healthProbeFile = ".health"
+
+// CheckHealth verifies that the data directory can still be written,
+// synced and read back, so that a failed or unmounted disk is noticed
+// before requests run into it
+func (s *LocalStorage) CheckHealth() error {
+	path := filepath.Join(s.dataPath, healthProbeFile)
+	probe := []byte(time.Now().UTC().Format(time.RFC3339Nano))
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create health probe: %w", err)
+	}
+	if _, err := f.Write(probe); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write health probe: %w", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to sync health probe: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to close health probe: %w", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read health probe: %w", err)
+	}
+	if string(data) != string(probe) {
+		return errors.New("health probe read back differs from what was written")
+	}
+
+	return os.Remove(path)
+}
@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Shards is the number of shard directories blocks are spread over
+const Shards = 256
+
+// touch records a change to the blocks of a block's shard. It is called
+// with the storage lock held.
+func (s *LocalStorage) touch(blockID string) {
+	s.generations[ShardOf(blockID)].Add(1)
+}
+
+// shardIndex returns the shard of a shard directory's name
+func shardIndex(name string) int {
+	shard, _ := strconv.ParseUint(name, 16, 8)
+	return int(shard)
+}
+
+// ShardGeneration returns a counter that changes whenever a block of the
+// shard is written, deleted or moved, so that what was derived from the
+// shard's blocks can be kept until it does
+func (s *LocalStorage) ShardGeneration(shard int) uint64 {
+	return s.generations[shard].Load()
+}
+
+// ListShard returns the sorted IDs of the blocks in a shard, and the
+// shard's generation as of the listing
+func (s *LocalStorage) ListShard(shard int) ([]string, uint64, error) {
+	if shard < 0 || shard >= Shards {
+		return nil, 0, fmt.Errorf("invalid shard %d", shard)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	generation := s.generations[shard].Load()
+	entries, err := ioutil.ReadDir(filepath.Join(s.dataPath, fmt.Sprintf("%02x", shard)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read shard directory %02x: %w", shard, err)
+	}
+
+	blockIDs := make([]string, 0, len(entries)/2)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasSuffix(name, ".meta") {
+			continue
+		}
+		blockIDs = append(blockIDs, name)
+	}
+	sort.Strings(blockIDs)
+	return blockIDs, generation, nil
+}
@@ -0,0 +1,43 @@
+package storage
+
+// Stats reports the disk usage and block cache of local storage
+type Stats struct {
+	UsedBytes     int64  `json:"used_bytes"`
+	CapacityBytes int64  `json:"capacity_bytes"`
+	CachedBlocks  int    `json:"cached_blocks"`
+	CachedBytes   int64  `json:"cached_bytes"`
+	CacheLimit    int64  `json:"cache_limit"`
+	CacheHits     uint64 `json:"cache_hits"`
+	CacheMisses   uint64 `json:"cache_misses"`
+}
+
+// Add accumulates the counts of other into s
+func (s *Stats) Add(other *Stats) {
+	s.UsedBytes += other.UsedBytes
+	s.CapacityBytes += other.CapacityBytes
+	s.CachedBlocks += other.CachedBlocks
+	s.CachedBytes += other.CachedBytes
+	s.CacheLimit += other.CacheLimit
+	s.CacheHits += other.CacheHits
+	s.CacheMisses += other.CacheMisses
+}
+
+// GetStats returns the space used on disk and the contents and hit counts
+// of the block cache
+func (s *LocalStorage) GetStats() (*Stats, error) {
+	used, err := s.GetUsedSpace()
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{
+		UsedBytes:     used,
+		CapacityBytes: s.maxSizeBytes,
+		CacheHits:     s.cacheHits.Load(),
+		CacheMisses:   s.cacheMisses.Load(),
+	}
+
+	stats.CachedBlocks, stats.CachedBytes, stats.CacheLimit = s.cache.usage()
+
+	return stats, nil
+}
@@ -4,35 +4,74 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
+	"hash/fnv"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+
+	"github.com/3fs-storage/pkg/api"
 )
 
 // LocalStorage provides local storage operations for blocks
 type LocalStorage struct {
-	dataPath  string
-	maxSizeGB int
-	cache     map[string][]byte
-	mu        sync.RWMutex
+	dataPath     string
+	maxSizeBytes int64
+	cache        *blockCache
+	wal          *wal
+	mu           sync.RWMutex
+
+	// syncPolicy and directIO tune block file IO to the disk
+	syncPolicy SyncPolicy
+	directIO   bool
+
+	// dictionaries compress the small blocks of namespaces trained for it,
+	// those of up to compressBelow bytes
+	dictionaries  *dictionaries
+	compressBelow int
+
+	// disk orders the disk operations of requests and background work
+	disk atomic.Pointer[DiskScheduler]
+
+	// used is the space the target's files take, counted when the storage
+	// is initialised or its usage is next walked, and kept up to date by
+	// writes and deletes in between
+	used atomic.Int64
+
+	cacheHits   atomic.Uint64
+	cacheMisses atomic.Uint64
+
+	// generations counts the changes to each shard's blocks
+	generations [Shards]atomic.Uint64
 }
 
 // NewLocalStorage creates a new local storage manager
-func NewLocalStorage(dataPath string, maxSizeGB int) (*LocalStorage, error) {
+func NewLocalStorage(dataPath string, maxSizeBytes int64) (*LocalStorage, error) {
 	if dataPath == "" {
 		return nil, fmt.Errorf("data path cannot be empty")
 	}
-	
-	if maxSizeGB <= 0 {
+
+	if maxSizeBytes <= 0 {
 		return nil, fmt.Errorf("max size must be greater than zero")
 	}
-	
-	return &LocalStorage{
-		dataPath:  dataPath,
-		maxSizeGB: maxSizeGB,
-		cache:     make(map[string][]byte),
-	}, nil
+
+	disk, err := NewDiskScheduler(DefaultDiskLimits())
+	if err != nil {
+		return nil, err
+	}
+	s := &LocalStorage{
+		dataPath:     dataPath,
+		maxSizeBytes: maxSizeBytes,
+		cache:        newBlockCache(),
+		syncPolicy:   SyncWAL,
+		dictionaries: newDictionaries(filepath.Join(dataPath, DictionaryDir)),
+	}
+	s.disk.Store(disk)
+	return s, nil
 }
 
 // Initialize creates the necessary directories for the storage
@@ -41,15 +80,27 @@ func (s *LocalStorage) Initialize() error {
 	if err := os.MkdirAll(s.dataPath, 0755); err != nil {
 		return fmt.Errorf("failed to create data directory: %w", err)
 	}
-	
+
 	// Create subdirectories for sharding
-	for i := 0; i < 256; i++ {
+	for i := 0; i < Shards; i++ {
 		subdir := filepath.Join(s.dataPath, fmt.Sprintf("%02x", i))
 		if err := os.MkdirAll(subdir, 0755); err != nil {
 			return fmt.Errorf("failed to create shard directory %s: %w", subdir, err)
 		}
 	}
-	
+
+	if err := s.checkDirectIO(); err != nil {
+		return err
+	}
+
+	if err := s.dictionaries.load(); err != nil {
+		return err
+	}
+
+	if _, err := s.GetUsedSpace(); err != nil {
+		return err
+	}
+
 	return nil
 }
 
@@ -58,8 +109,39 @@ func (s *LocalStorage) getBlockPath(blockID string) string {
 	if len(blockID) < 2 {
 		blockID = "00" + blockID
 	}
-	shard := blockID[:2]
-	return filepath.Join(s.dataPath, shard, blockID)
+	return filepath.Join(s.dataPath, fmt.Sprintf("%02x", ShardOf(blockID)), blockID)
+}
+
+// ShardOf returns the shard directory, 0 to Shards-1, holding a block
+func ShardOf(blockID string) int {
+	if len(blockID) < 2 {
+		blockID = "00" + blockID
+	}
+	if isHexShard(blockID[:2]) {
+		shard, _ := strconv.ParseUint(blockID[:2], 16, 8)
+		return int(shard)
+	}
+	// IDs that do not start with hex digits, such as namespaced IDs, are
+	// spread over the shards by hash
+	h := fnv.New32a()
+	h.Write([]byte(blockID))
+	return int(h.Sum32() % Shards)
+}
+
+// isHexShard reports whether a shard name is one of the 00-ff directories
+func isHexShard(shard string) bool {
+	for _, c := range shard {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// isShardDir reports whether a directory under the data path holds blocks,
+// as opposed to others such as the quarantine
+func isShardDir(name string) bool {
+	return len(name) == 2 && isHexShard(name)
 }
 
 // getMetadataPath returns the path to store a block's metadata
@@ -67,32 +149,69 @@ func (s *LocalStorage) getMetadataPath(blockID string) string {
 	return s.getBlockPath(blockID) + ".meta"
 }
 
-// WriteBlock writes a block to the local storage
+// WriteBlock writes a block to the local storage. A write that would take
+// the storage past its max size fails with api.ErrNoSpace.
 func (s *LocalStorage) WriteBlock(blockID string, data []byte, metadata []byte) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	
+
 	// Get the path for the block
 	blockPath := s.getBlockPath(blockID)
-	
+
+	// Compress the block data if its namespace has a dictionary, and check
+	// that it fits in what is left of the storage's space
+	stored, metadata := s.encodeBlock(blockID, data, metadata)
+	grow := int64(len(stored)) - fileSpace(blockPath)
+	if metadata != nil {
+		grow += int64(len(metadata)) - fileSpace(s.getMetadataPath(blockID))
+	}
+	if used := s.used.Load(); grow > 0 && used+grow > s.maxSizeBytes {
+		return fmt.Errorf("block %s needs %d bytes, %d of %d are used: %w", blockID, grow, used, s.maxSizeBytes, api.ErrNoSpace)
+	}
+
+	// Log the write so that a crash before it completes is detected
+	var seq uint64
+	if s.wal != nil {
+		var err error
+		if seq, err = s.wal.begin(walOpWrite, blockID, hex.EncodeToString(CalculateChecksum(data)), s.syncWAL()); err != nil {
+			return err
+		}
+	}
+
 	// Write the block data
-	if err := ioutil.WriteFile(blockPath, data, 0644); err != nil {
+	if err := unshareBlockFile(blockPath); err != nil {
+		s.abortWAL(seq)
+		return fmt.Errorf("failed to write block data: %w", err)
+	}
+	if err := s.writeBlockFile(blockPath, stored); err != nil {
+		s.abortWAL(seq)
 		return fmt.Errorf("failed to write block data: %w", err)
 	}
-	
+
 	// Write metadata if provided
 	if metadata != nil {
 		metaPath := s.getMetadataPath(blockID)
-		if err := ioutil.WriteFile(metaPath, metadata, 0644); err != nil {
+		if err := writeFile(metaPath, metadata, s.syncPolicy == SyncAlways); err != nil {
 			// Try to clean up the block file if metadata write fails
 			os.Remove(blockPath)
+			s.abortWAL(seq)
 			return fmt.Errorf("failed to write block metadata: %w", err)
 		}
 	}
-	
+
+	if err := s.syncDir(filepath.Dir(blockPath)); err != nil {
+		s.abortWAL(seq)
+		return fmt.Errorf("failed to sync block directory: %w", err)
+	}
+
 	// Update cache
-	s.cache[blockID] = data
-	
+	s.cache.put(blockID, data)
+	s.touch(blockID)
+	s.used.Add(grow)
+
+	if s.wal != nil {
+		return s.wal.commit(seq)
+	}
 	return nil
 }
 
@@ -100,61 +219,68 @@ func (s *LocalStorage) WriteBlock(blockID string, data []byte, metadata []byte)
 func (s *LocalStorage) ReadBlock(blockID string) ([]byte, []byte, error) {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	
+
 	// Check cache first
-	if data, ok := s.cache[blockID]; ok {
+	if data, ok := s.cache.get(blockID); ok {
+		s.cacheHits.Add(1)
+
 		// Still need to read metadata from disk
 		hasMetadata, metadata, err := s.ReadBlockMetadata(blockID)
 		if err != nil {
 			return nil, nil, err
 		}
 		if !hasMetadata {
-			return nil, nil, fmt.Errorf("block %s not found", blockID)
+			return nil, nil, fmt.Errorf("block %s: %w", blockID, api.ErrNotFound)
 		}
 		return data, metadata, nil
 	}
-	
+
+	s.cacheMisses.Add(1)
+
 	// Get the path for the block
 	blockPath := s.getBlockPath(blockID)
-	
+
 	// Check if the block exists
 	if _, err := os.Stat(blockPath); os.IsNotExist(err) {
-		return nil, nil, fmt.Errorf("block %s not found", blockID)
+		return nil, nil, fmt.Errorf("block %s: %w", blockID, api.ErrNotFound)
 	}
-	
+
 	// Read the block data
-	data, err := ioutil.ReadFile(blockPath)
+	data, err := s.readBlockFile(blockPath)
 	if err != nil {
 		return nil, nil, fmt.Errorf("failed to read block data: %w", err)
 	}
-	
+
 	// Read the metadata if it exists
 	_, metadata, err := s.ReadBlockMetadata(blockID)
 	if err != nil {
 		return nil, nil, err
 	}
-	
+	if data, err = s.decodeBlockFile(data, metadata); err != nil {
+		return nil, nil, fmt.Errorf("failed to read block data: %w", err)
+	}
+
 	// Update cache
-	s.cache[blockID] = data
-	
+	s.cache.put(blockID, data)
+
 	return data, metadata, nil
 }
 
 // ReadBlockMetadata reads a block's metadata from the local storage
 func (s *LocalStorage) ReadBlockMetadata(blockID string) (bool, []byte, error) {
 	metaPath := s.getMetadataPath(blockID)
-	
+
 	// Check if the metadata exists
 	if _, err := os.Stat(metaPath); os.IsNotExist(err) {
 		return false, nil, nil
 	}
-	
+
 	// Read the metadata
 	metadata, err := ioutil.ReadFile(metaPath)
 	if err != nil {
 		return true, nil, fmt.Errorf("failed to read block metadata: %w", err)
 	}
-	
+
 	return true, metadata, nil
 }
 
@@ -162,59 +288,144 @@ func (s *LocalStorage) ReadBlockMetadata(blockID string) (bool, []byte, error) {
 func (s *LocalStorage) DeleteBlock(blockID string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	
+
+	// Log the delete so that a crash before it completes is detected
+	var seq uint64
+	if s.wal != nil {
+		var err error
+		if seq, err = s.wal.begin(walOpDelete, blockID, "", s.syncWAL()); err != nil {
+			return err
+		}
+	}
+
 	// Get the paths
 	blockPath := s.getBlockPath(blockID)
 	metaPath := s.getMetadataPath(blockID)
-	
+	freed := fileSpace(blockPath) + fileSpace(metaPath)
+
 	// Delete the block data
 	if err := os.Remove(blockPath); err != nil && !os.IsNotExist(err) {
+		s.abortWAL(seq)
 		return fmt.Errorf("failed to delete block data: %w", err)
 	}
-	
+
 	// Delete the metadata
 	if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+		s.abortWAL(seq)
 		return fmt.Errorf("failed to delete block metadata: %w", err)
 	}
-	
+
 	// Remove from cache
-	delete(s.cache, blockID)
-	
+	s.cache.remove(blockID)
+	s.touch(blockID)
+	s.used.Add(-freed)
+
+	if s.wal != nil {
+		return s.wal.commit(seq)
+	}
 	return nil
 }
 
+// abortWAL ends a logged operation that failed, if the log is enabled
+func (s *LocalStorage) abortWAL(seq uint64) {
+	if s.wal != nil {
+		s.wal.abort(seq)
+	}
+}
+
+// ListBlocks returns the IDs of all blocks on disk that start with prefix
+func (s *LocalStorage) ListBlocks(prefix string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	shards, err := ioutil.ReadDir(s.dataPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read data directory: %w", err)
+	}
+
+	blockIDs := make([]string, 0)
+	for _, shard := range shards {
+		if !shard.IsDir() || !isShardDir(shard.Name()) {
+			continue
+		}
+
+		entries, err := ioutil.ReadDir(filepath.Join(s.dataPath, shard.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read shard directory %s: %w", shard.Name(), err)
+		}
+
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.IsDir() || strings.HasSuffix(name, ".meta") {
+				continue
+			}
+			if strings.HasPrefix(name, prefix) {
+				blockIDs = append(blockIDs, name)
+			}
+		}
+	}
+
+	sort.Strings(blockIDs)
+	return blockIDs, nil
+}
+
 // Flush writes all cached blocks to disk
 func (s *LocalStorage) Flush() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	
+
 	// Clear the cache
-	s.cache = make(map[string][]byte)
-	
+	s.cache.reset()
+
 	return nil
 }
 
-// GetUsedSpace returns the amount of disk space used by the storage in bytes
+// GetUsedSpace returns the amount of disk space used by the storage in
+// bytes, counting the files deduplicated blocks share once, and resets the
+// count writes are checked against to it
 func (s *LocalStorage) GetUsedSpace() (int64, error) {
 	var size int64
-	
+	shared := make(map[fileID]bool)
+
 	err := filepath.Walk(s.dataPath, func(_ string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
-			size += info.Size()
+		if info.IsDir() {
+			return nil
+		}
+		if links, id, ok := fileLinks(info); ok && links > 1 {
+			if shared[id] {
+				return nil
+			}
+			shared[id] = true
 		}
+		size += info.Size()
 		return nil
 	})
-	
+
 	if err != nil {
 		return 0, fmt.Errorf("failed to calculate used space: %w", err)
 	}
-	
+
+	s.used.Store(size)
 	return size, nil
 }
 
+// fileSpace returns the space a file takes that removing it would free:
+// its size, or nothing if it does not exist or shares its data with
+// another block
+func fileSpace(path string) int64 {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	if links, _, ok := fileLinks(info); ok && links > 1 {
+		return 0
+	}
+	return info.Size()
+}
+
 // CalculateChecksum returns the SHA-256 checksum of the provided data
 func CalculateChecksum(data []byte) []byte {
 	hash := sha256.Sum256(data)
@@ -223,22 +434,27 @@ func CalculateChecksum(data []byte) []byte {
 
 // BlockMetadata represents metadata for a block
 type BlockMetadata struct {
-	Checksum    string `json:"checksum"`
-	Size        int    `json:"size"`
-	Version     int    `json:"version"`
-	CreatedAt   int64  `json:"created_at"`
-	LastModified int64 `json:"last_modified"`
+	Checksum     string `json:"checksum"`
+	Size         int    `json:"size"`
+	Version      int    `json:"version"`
+	CreatedAt    int64  `json:"created_at"`
+	LastModified int64  `json:"last_modified"`
+	// Encoding is how the block file is compressed, empty when it is not,
+	// and Dictionary the ID of the dictionary it is compressed with. Size
+	// and Checksum describe the data as it was written.
+	Encoding   string `json:"encoding,omitempty"`
+	Dictionary uint32 `json:"dictionary,omitempty"`
 }
 
 // NewBlockMetadata creates new metadata for a block
 func NewBlockMetadata(data []byte, version int, createdAt int64) *BlockMetadata {
 	checksum := CalculateChecksum(data)
-	
+
 	return &BlockMetadata{
-		Checksum:    hex.EncodeToString(checksum),
-		Size:        len(data),
-		Version:     version,
-		CreatedAt:   createdAt,
+		Checksum:     hex.EncodeToString(checksum),
+		Size:         len(data),
+		Version:      version,
+		CreatedAt:    createdAt,
 		LastModified: createdAt,
 	}
-} 
\ No newline at end of file
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// SyncPolicy is when block writes are synced to disk
+type SyncPolicy string
+
+const (
+	// SyncWAL syncs the write-ahead log before each write and leaves the
+	// block files to the OS; replay discards torn writes after a crash
+	SyncWAL SyncPolicy = "wal"
+	// SyncAlways also syncs every block file and its directory before a
+	// write is acknowledged
+	SyncAlways SyncPolicy = "always"
+	// SyncNever leaves everything to the OS, trading durability on power
+	// loss for latency
+	SyncNever SyncPolicy = "never"
+)
+
+// directIOAlignment is the buffer, offset and size alignment direct IO
+// needs on the disks in use
+const directIOAlignment = 4096
+
+// directIOProbeFile is created to check that the filesystem supports
+// direct IO
+const directIOProbeFile = ".direct"
+
+// SetSyncPolicy sets when block writes are synced to disk
+func (s *LocalStorage) SetSyncPolicy(policy SyncPolicy) error {
+	switch policy {
+	case SyncWAL, SyncAlways, SyncNever:
+	case "":
+		policy = SyncWAL
+	default:
+		return fmt.Errorf("unknown fsync policy %q", policy)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncPolicy = policy
+	return nil
+}
+
+// SetDirectIO makes block files be read and written bypassing the page
+// cache. It must be set before the storage is initialized, which checks
+// that the filesystem supports it.
+func (s *LocalStorage) SetDirectIO(enabled bool) error {
+	if enabled && directIOFlag == 0 {
+		return errors.New("direct IO is only supported on Linux")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.directIO = enabled
+	return nil
+}
+
+// checkDirectIO returns an error if direct IO is enabled but the data
+// directory's filesystem does not support it
+func (s *LocalStorage) checkDirectIO() error {
+	if !s.directIO {
+		return nil
+	}
+	path := filepath.Join(s.dataPath, directIOProbeFile)
+	if err := writeDirect(path, []byte("probe"), false); err != nil {
+		return fmt.Errorf("direct IO is not supported at %s: %w", s.dataPath, err)
+	}
+	return os.Remove(path)
+}
+
+// syncWAL reports whether write-ahead log records are synced
+func (s *LocalStorage) syncWAL() bool {
+	return s.syncPolicy != SyncNever
+}
+
+// writeBlockFile writes a block's data following the storage's direct IO
+// and sync settings
+func (s *LocalStorage) writeBlockFile(path string, data []byte) error {
+	if s.directIO {
+		return writeDirect(path, data, s.syncPolicy == SyncAlways)
+	}
+	return writeFile(path, data, s.syncPolicy == SyncAlways)
+}
+
+// readBlockFile reads a block's data, bypassing the page cache if direct
+// IO is enabled
+func (s *LocalStorage) readBlockFile(path string) ([]byte, error) {
+	if s.directIO {
+		return readDirect(path)
+	}
+	return ioutil.ReadFile(path)
+}
+
+// syncDir syncs a directory so that the files created in it survive a
+// crash, if the policy asks for it
+func (s *LocalStorage) syncDir(dir string) error {
+	if s.syncPolicy != SyncAlways {
+		return nil
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// writeFile writes a file, syncing it if requested
+func writeFile(path string, data []byte, sync bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// writeDirect writes a file bypassing the page cache. The data is written
+// from an aligned buffer padded to the alignment, and the file is then
+// truncated to the data's size.
+func writeDirect(path string, data []byte, sync bool) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|directIOFlag, 0644)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		buf := alignedBuffer(alignUp(len(data)))
+		copy(buf, data)
+		if _, err := f.Write(buf); err != nil {
+			f.Close()
+			return err
+		}
+		if err := f.Truncate(int64(len(data))); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if sync {
+		if err := f.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// readDirect reads a file bypassing the page cache
+func readDirect(path string) ([]byte, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|directIOFlag, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := int(info.Size())
+	buf := alignedBuffer(alignUp(size))
+	n := 0
+	for n < size {
+		read, err := f.Read(buf[n:])
+		n += read
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf[:n], nil
+}
+
+// alignUp rounds a size up to a multiple of the direct IO alignment, and
+// to at least one unit
+func alignUp(size int) int {
+	if size <= 0 {
+		return directIOAlignment
+	}
+	return (size + directIOAlignment - 1) &^ (directIOAlignment - 1)
+}
+
+// alignedBuffer returns a buffer of size bytes whose address is aligned
+// for direct IO
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	offset := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1))
+	if offset != 0 {
+		offset = directIOAlignment - offset
+	}
+	return buf[offset : offset+size]
+}
@@ -0,0 +1,332 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// walFile is the write-ahead intent log in the data directory
+	walFile = "wal.log"
+	// walCompactSize is the log size above which it is truncated once no
+	// operation is in progress
+	walCompactSize = 16 << 20
+)
+
+// WAL record operations
+const (
+	walOpWrite  = "write"
+	walOpDelete = "delete"
+	walOpCommit = "commit"
+)
+
+// walRecord is one line of the write-ahead log. Write and delete records
+// announce an operation before it touches the block files; a commit record
+// marks it complete.
+type walRecord struct {
+	Seq      uint64 `json:"seq"`
+	Op       string `json:"op"`
+	BlockID  string `json:"block_id,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// RecoveryReport summarises the replay of the write-ahead log on startup
+type RecoveryReport struct {
+	StartedAt  int64 `json:"started_at"`
+	FinishedAt int64 `json:"finished_at"`
+	// Records is the number of log records read
+	Records int `json:"records"`
+	// Incomplete is the number of operations interrupted by a crash
+	Incomplete int `json:"incomplete"`
+	// Discarded lists blocks whose interrupted write left them torn; they
+	// were removed so they can be fetched again from a replica
+	Discarded []string `json:"discarded"`
+	// Completed lists blocks whose interrupted write or delete turned out
+	// to be complete, or was finished during replay
+	Completed []string `json:"completed"`
+}
+
+// wal is an append-only log of block operations in progress. An operation
+// is logged and synced before the block files change, and committed after,
+// so that a crash in between can be detected and cleaned up on restart.
+// Operations that fail are aborted: they are left uncommitted for the same
+// reason, and carried over when the log is compacted until a later
+// operation on their block commits.
+type wal struct {
+	path string
+	file *os.File
+	seq  uint64
+	size int64
+	// pending holds the operations in progress, by sequence number
+	pending map[uint64]*walRecord
+	// aborted holds the last failed operation on each block
+	aborted map[string]*walRecord
+	mu      sync.Mutex
+}
+
+// openWAL opens the log for appending, truncating any previous contents
+func openWAL(dataPath string) (*wal, error) {
+	path := filepath.Join(dataPath, walFile)
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open write-ahead log: %w", err)
+	}
+	return &wal{
+		path:    path,
+		file:    file,
+		pending: make(map[uint64]*walRecord),
+		aborted: make(map[string]*walRecord),
+	}, nil
+}
+
+// append writes a record to the log, syncing it if requested
+func (w *wal) append(record *walRecord, sync bool) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal log record: %w", err)
+	}
+	line = append(line, '\n')
+
+	if _, err := w.file.Write(line); err != nil {
+		return fmt.Errorf("failed to append to write-ahead log: %w", err)
+	}
+	w.size += int64(len(line))
+	if sync {
+		if err := w.file.Sync(); err != nil {
+			return fmt.Errorf("failed to sync write-ahead log: %w", err)
+		}
+	}
+	return nil
+}
+
+// begin logs an operation before it is applied and returns its sequence
+// number. The record is synced unless sync is false.
+func (w *wal) begin(op, blockID, checksum string, sync bool) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.seq++
+	record := &walRecord{Seq: w.seq, Op: op, BlockID: blockID, Checksum: checksum}
+	if err := w.append(record, sync); err != nil {
+		return 0, err
+	}
+	w.pending[w.seq] = record
+	return w.seq, nil
+}
+
+// commit marks an operation as complete. The commit record is not synced:
+// if it is lost, replay finds the operation complete anyway.
+func (w *wal) commit(seq uint64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if record, ok := w.pending[seq]; ok {
+		delete(w.pending, seq)
+		delete(w.aborted, record.BlockID)
+	}
+	if err := w.append(&walRecord{Seq: seq, Op: walOpCommit}, false); err != nil {
+		return err
+	}
+
+	// Nothing in the log but the aborted operations is needed once no
+	// operation is in progress
+	if len(w.pending) == 0 && w.size > walCompactSize {
+		return w.compact()
+	}
+	return nil
+}
+
+// abort ends an operation that failed without committing it, so that replay
+// still checks its block on restart
+func (w *wal) abort(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if record, ok := w.pending[seq]; ok {
+		delete(w.pending, seq)
+		w.aborted[record.BlockID] = record
+	}
+}
+
+// compact truncates the log and writes back the aborted operations. Must be
+// called with the lock held and no operation in progress.
+func (w *wal) compact() error {
+	if err := w.file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate write-ahead log: %w", err)
+	}
+	if _, err := w.file.Seek(0, 0); err != nil {
+		return fmt.Errorf("failed to rewind write-ahead log: %w", err)
+	}
+	w.size = 0
+	if len(w.aborted) == 0 {
+		return nil
+	}
+
+	records := make([]*walRecord, 0, len(w.aborted))
+	for _, record := range w.aborted {
+		records = append(records, record)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Seq < records[j].Seq
+	})
+	for i, record := range records {
+		if err := w.append(record, i == len(records)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// close closes the log file
+func (w *wal) close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// readWAL returns the operations in the log that were never committed and
+// were the last operation on their block, in log order, and the number of
+// records read. A torn final record, left by a crash during an append, is
+// ignored.
+func readWAL(dataPath string) ([]*walRecord, int, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dataPath, walFile))
+	if os.IsNotExist(err) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read write-ahead log: %w", err)
+	}
+
+	open := make(map[uint64]*walRecord)
+	last := make(map[string]uint64)
+	order := make([]uint64, 0)
+	records := 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		var record walRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			break
+		}
+		records++
+		if record.Op == walOpCommit {
+			delete(open, record.Seq)
+			continue
+		}
+		open[record.Seq] = &record
+		last[record.BlockID] = record.Seq
+		order = append(order, record.Seq)
+	}
+
+	incomplete := make([]*walRecord, 0, len(open))
+	for _, seq := range order {
+		if record, ok := open[seq]; ok && last[record.BlockID] == seq {
+			incomplete = append(incomplete, record)
+		}
+	}
+	return incomplete, records, nil
+}
+
+// Recover replays the write-ahead log left by the previous run. Interrupted
+// deletes are finished. Interrupted writes are kept if the block on disk
+// matches what was being written, and removed otherwise, so that no torn
+// block is ever served. Must be called before the storage is used.
+func (s *LocalStorage) Recover() (*RecoveryReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	report := &RecoveryReport{
+		StartedAt: time.Now().UnixNano(),
+		Discarded: make([]string, 0),
+		Completed: make([]string, 0),
+	}
+
+	incomplete, records, err := readWAL(s.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	report.Records = records
+	report.Incomplete = len(incomplete)
+
+	for _, record := range incomplete {
+		blockPath := s.getBlockPath(record.BlockID)
+		metaPath := s.getMetadataPath(record.BlockID)
+
+		if record.Op == walOpWrite && s.blockIntact(record.BlockID, record.Checksum) {
+			report.Completed = append(report.Completed, record.BlockID)
+			continue
+		}
+
+		if err := os.Remove(blockPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove block %s: %w", record.BlockID, err)
+		}
+		if err := os.Remove(metaPath); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("failed to remove block metadata %s: %w", record.BlockID, err)
+		}
+		s.cache.remove(record.BlockID)
+		s.touch(record.BlockID)
+
+		if record.Op == walOpWrite {
+			report.Discarded = append(report.Discarded, record.BlockID)
+		} else {
+			report.Completed = append(report.Completed, record.BlockID)
+		}
+	}
+
+	// The log is truncated when it is reopened
+	w, err := openWAL(s.dataPath)
+	if err != nil {
+		return nil, err
+	}
+	if s.wal != nil {
+		s.wal.close()
+	}
+	s.wal = w
+
+	report.FinishedAt = time.Now().UnixNano()
+	return report, nil
+}
+
+// blockIntact reports whether a block's data and metadata on disk both
+// match the given checksum
+func (s *LocalStorage) blockIntact(blockID, checksum string) bool {
+	data, err := ioutil.ReadFile(s.getBlockPath(blockID))
+	if err != nil {
+		return false
+	}
+
+	metadataBytes, err := ioutil.ReadFile(s.getMetadataPath(blockID))
+	if err != nil {
+		return false
+	}
+	var metadata BlockMetadata
+	if err := json.Unmarshal(metadataBytes, &metadata); err != nil {
+		return false
+	}
+	if data, err = s.decodeBlock(data, &metadata); err != nil {
+		return false
+	}
+	return metadata.Checksum == checksum && hex.EncodeToString(CalculateChecksum(data)) == checksum
+}
+
+// Close closes the write-ahead log
+func (s *LocalStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.wal == nil {
+		return nil
+	}
+	err := s.wal.close()
+	s.wal = nil
+	return err
+}
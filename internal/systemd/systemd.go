@@ -0,0 +1,100 @@
+// Package systemd tells systemd about the service's state through the
+// sd_notify protocol, so that a unit of Type=notify is only started once
+// the node serves, its dependencies are ordered after that, and a hung
+// node is restarted by the watchdog. Outside systemd, NOTIFY_SOCKET is not
+// set and every call does nothing.
+package systemd
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// States the service reports
+const (
+	// Ready tells systemd the service has started
+	Ready = "READY=1"
+	// Reloading tells systemd the service is reloading its configuration;
+	// Ready follows once it has
+	Reloading = "RELOADING=1"
+	// Stopping tells systemd the service is shutting down
+	Stopping = "STOPPING=1"
+	// Watchdog is the keepalive the watchdog expects
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends states to systemd, such as Ready, or "STATUS=" followed by a
+// line describing the service. It does nothing outside systemd.
+func Notify(states ...string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" || len(states) == 0 {
+		return nil
+	}
+	// A socket in the abstract namespace is given with a leading '@'
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("failed to connect to systemd: %w", err)
+	}
+	defer conn.Close()
+
+	var msg []byte
+	for _, state := range states {
+		msg = append(msg, state...)
+		msg = append(msg, '\n')
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return fmt.Errorf("failed to notify systemd: %w", err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns how often systemd expects a keepalive, and
+// false if the unit has no watchdog or it watches another process
+func WatchdogInterval() (time.Duration, bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0, false
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0, false
+	}
+	return time.Duration(usec) * time.Microsecond, true
+}
+
+// RunWatchdog sends keepalives at half the watchdog interval until ctx is
+// done, each only once alive reports the service responsive, so that
+// systemd restarts a service that hangs rather than one whose process
+// merely lives on. It returns at once if the unit has no watchdog.
+func RunWatchdog(ctx context.Context, alive func() error, logger *slog.Logger) {
+	interval, ok := WatchdogInterval()
+	if !ok {
+		return
+	}
+	logger.Info("systemd watchdog enabled", "interval", interval)
+
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if err := alive(); err != nil {
+			logger.Warn("withholding watchdog keepalive", "error", err)
+			continue
+		}
+		if err := Notify(Watchdog); err != nil {
+			logger.Warn("failed to send watchdog keepalive", "error", err)
+		}
+	}
+}
@@ -0,0 +1,294 @@
+package usage
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// webhookTimeout bounds a post of records to a webhook
+const webhookTimeout = 30 * time.Second
+
+// Record is the use of a namespace over an export window
+type Record struct {
+	Namespace string `json:"namespace"`
+	// Start and End bound the window, in Unix nanoseconds
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	api.NamespaceUsage
+}
+
+// Sink receives the records of each export window once it closed
+type Sink interface {
+	// Name identifies the sink, to keep where its exports are up to
+	Name() string
+	Export(ctx context.Context, records []Record) error
+}
+
+// CSVSink appends records to a CSV file, with a header line when it starts
+// the file
+type CSVSink struct {
+	path string
+}
+
+// NewCSVSink creates a sink appending to the CSV file at path
+func NewCSVSink(path string) *CSVSink {
+	return &CSVSink{path: path}
+}
+
+// csvHeader names the columns of a CSV sink
+var csvHeader = []string{"start", "end", "namespace", "stored_bytes", "blocks",
+	"requests", "reads", "writes", "deletes", "bytes_in", "bytes_out"}
+
+// Name identifies the sink
+func (s *CSVSink) Name() string {
+	return "csv"
+}
+
+// Export appends the records to the file
+func (s *CSVSink) Export(_ context.Context, records []Record) error {
+	if err := os.MkdirAll(filepath.Dir(s.path), 0755); err != nil {
+		return fmt.Errorf("failed to open usage CSV: %w", err)
+	}
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open usage CSV: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open usage CSV: %w", err)
+	}
+
+	w := csv.NewWriter(file)
+	if info.Size() == 0 {
+		w.Write(csvHeader)
+	}
+	for _, r := range records {
+		w.Write([]string{
+			time.Unix(0, r.Start).UTC().Format(time.RFC3339),
+			time.Unix(0, r.End).UTC().Format(time.RFC3339),
+			r.Namespace,
+			strconv.FormatInt(r.StoredBytes, 10),
+			strconv.FormatInt(r.Blocks, 10),
+			strconv.FormatInt(r.Requests, 10),
+			strconv.FormatInt(r.Reads, 10),
+			strconv.FormatInt(r.Writes, 10),
+			strconv.FormatInt(r.Deletes, 10),
+			strconv.FormatInt(r.BytesIn, 10),
+			strconv.FormatInt(r.BytesOut, 10),
+		})
+	}
+	w.Flush()
+	err = w.Error()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write usage CSV: %w", err)
+	}
+	return nil
+}
+
+// WebhookSink posts the records of each window to a URL as a JSON document
+type WebhookSink struct {
+	url   string
+	token string
+	http  *http.Client
+}
+
+// webhookPayload is what a webhook sink posts
+type webhookPayload struct {
+	Start   int64    `json:"start"`
+	End     int64    `json:"end"`
+	Records []Record `json:"records"`
+}
+
+// NewWebhookSink creates a sink posting to url, presenting token as a
+// bearer token if it is set
+func NewWebhookSink(url, token string) *WebhookSink {
+	return &WebhookSink{url: url, token: token, http: &http.Client{Timeout: webhookTimeout}}
+}
+
+// Name identifies the sink
+func (s *WebhookSink) Name() string {
+	return "webhook"
+}
+
+// Export posts the records, failing unless the webhook accepts them
+func (s *WebhookSink) Export(ctx context.Context, records []Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+	body, err := json.Marshal(webhookPayload{Start: records[0].Start, End: records[0].End, Records: records})
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage records: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post usage records: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("usage webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Exporter sends the records of each export window of a ledger to sinks
+// once the window closed. Each sink is exported to in turn from where it is
+// up to, kept in a file, so that a sink that fails is sent the windows it
+// missed once it recovers, and the others are not sent them twice.
+type Exporter struct {
+	ledger *Ledger
+	window time.Duration
+	sinks  []Sink
+	path   string
+	logger *slog.Logger
+
+	mu sync.Mutex
+	// cursors are the end of the last window exported to each sink, in Unix
+	// nanoseconds
+	cursors map[string]int64
+}
+
+// NewExporter creates an exporter of windows of a ledger, keeping where
+// each sink is up to at path. The window is a multiple of the ledger's; a
+// zero window takes the ledger's.
+func NewExporter(ledger *Ledger, window time.Duration, sinks []Sink, path string, logger *slog.Logger) (*Exporter, error) {
+	if window <= 0 {
+		window = ledger.Window()
+	}
+	if window%ledger.Window() != 0 {
+		return nil, fmt.Errorf("export window %s is not a multiple of the usage window %s", window, ledger.Window())
+	}
+	e := &Exporter{
+		ledger:  ledger,
+		window:  window,
+		sinks:   sinks,
+		path:    path,
+		logger:  logger,
+		cursors: make(map[string]int64),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return e, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage export cursors: %w", err)
+	}
+	if err := json.Unmarshal(data, &e.cursors); err != nil {
+		return nil, fmt.Errorf("failed to parse usage export cursors: %w", err)
+	}
+	return e, nil
+}
+
+// ExportResult describes a pass of an exporter
+type ExportResult struct {
+	// Windows counts the windows exported to each sink
+	Windows map[string]int `json:"windows"`
+	Records int            `json:"records"`
+}
+
+// Export sends each sink the windows that closed since it was last
+// exported to, oldest first. A sink stops at the first window it fails
+// to take, and is sent it again on the next pass.
+func (e *Exporter) Export(ctx context.Context) (*ExportResult, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	closed := now.Truncate(e.window).UnixNano()
+	result := &ExportResult{Windows: make(map[string]int)}
+	var errs []error
+	for _, sink := range e.sinks {
+		// A new sink is sent every window the ledger still holds, and a sink
+		// behind the ledger skips the windows it no longer holds
+		cursor, known := e.cursors[sink.Name()]
+		if oldest, ok := e.ledger.Oldest(); ok {
+			if start := oldest.Truncate(e.window).UnixNano(); !known || start > cursor {
+				cursor = start
+			}
+		} else if !known {
+			cursor = closed
+		}
+		for cursor < closed {
+			end := cursor + int64(e.window)
+			records := e.records(cursor, end)
+			if err := sink.Export(ctx, records); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", sink.Name(), err))
+				e.logger.Warn("failed to export usage", "sink", sink.Name(), "window", time.Unix(0, cursor), "error", err)
+				break
+			}
+			cursor = end
+			result.Windows[sink.Name()]++
+			result.Records += len(records)
+		}
+		e.cursors[sink.Name()] = cursor
+	}
+
+	if err := e.persist(); err != nil {
+		errs = append(errs, err)
+	}
+	return result, errors.Join(errs...)
+}
+
+// records returns the records of the window between start and end, by
+// namespace
+func (e *Exporter) records(start, end int64) []Record {
+	namespaces := e.ledger.Aggregate(time.Unix(0, start), time.Unix(0, end))
+	records := make([]Record, 0, len(namespaces))
+	for namespace, u := range namespaces {
+		records = append(records, Record{Namespace: namespace, Start: start, End: end, NamespaceUsage: *u})
+	}
+	slices.SortFunc(records, func(a, b Record) int {
+		return strings.Compare(a.Namespace, b.Namespace)
+	})
+	return records
+}
+
+// persist writes where each sink is up to. Must be called with the lock
+// held.
+func (e *Exporter) persist() error {
+	data, err := json.Marshal(e.cursors)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage export cursors: %w", err)
+	}
+	tmp := e.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write usage export cursors: %w", err)
+	}
+	if err := os.Rename(tmp, e.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write usage export cursors: %w", err)
+	}
+	return nil
+}
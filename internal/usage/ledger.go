@@ -0,0 +1,401 @@
+package usage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+const (
+	// DefaultWindow is the span of time usage is added up over
+	DefaultWindow = time.Hour
+	// DefaultRetention is how long windows are kept
+	DefaultRetention = 30 * 24 * time.Hour
+	// staleAfter is how long the stored bytes a node last reported are
+	// counted without a new report
+	staleAfter = 15 * time.Minute
+	// persistInterval is the least time between two writes of the ledger
+	persistInterval = time.Minute
+)
+
+// Window is the use of each namespace over a span of time: the requests
+// made and data transferred during it, and the bytes stored at its end,
+// or as last reported while it is the current window
+type Window struct {
+	// Start and End bound the window, in Unix nanoseconds
+	Start      int64                          `json:"start"`
+	End        int64                          `json:"end"`
+	Namespaces map[string]*api.NamespaceUsage `json:"namespaces"`
+}
+
+// Summary is the use of each namespace over a range of windows: the sum
+// of their requests and transfers, and the bytes stored at the end of the
+// last
+type Summary struct {
+	Since      int64                          `json:"since"`
+	Until      int64                          `json:"until"`
+	Namespaces map[string]*api.NamespaceUsage `json:"namespaces"`
+	Windows    []*Window                      `json:"windows"`
+}
+
+// ledgerState is what a ledger persists
+type ledgerState struct {
+	// CreatedAt is when the ledger started counting, in Unix nanoseconds
+	CreatedAt int64 `json:"created_at"`
+	// Nodes are the last report of each node, which the next is counted
+	// from
+	Nodes   map[string]*api.UsageReport `json:"nodes"`
+	Windows []*Window                   `json:"windows"`
+	// Totals are the requests and transfers of each namespace since the
+	// ledger started, which only grow
+	Totals map[string]*api.NamespaceUsage `json:"totals"`
+}
+
+// Ledger adds the usage reports of the nodes up into windows of time,
+// kept for a retention period and persisted to a file. Nodes report the
+// counts since they started, and each report is counted from the node's
+// previous one, so that a lost report is made up for by the next and a
+// node restarting counts from zero again.
+type Ledger struct {
+	path      string
+	window    time.Duration
+	retention time.Duration
+
+	mu          sync.Mutex
+	state       ledgerState
+	persistedAt time.Time
+}
+
+// OpenLedger opens the ledger persisted at path, or starts one. A zero
+// window or retention takes the default.
+func OpenLedger(path string, window, retention time.Duration) (*Ledger, error) {
+	if window <= 0 {
+		window = DefaultWindow
+	}
+	if retention <= 0 {
+		retention = DefaultRetention
+	}
+	l := &Ledger{
+		path:      path,
+		window:    window,
+		retention: retention,
+		state: ledgerState{
+			CreatedAt: time.Now().UnixNano(),
+			Nodes:     make(map[string]*api.UsageReport),
+			Totals:    make(map[string]*api.NamespaceUsage),
+		},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read usage ledger: %w", err)
+	}
+	if err := json.Unmarshal(data, &l.state); err != nil {
+		return nil, fmt.Errorf("failed to parse usage ledger: %w", err)
+	}
+	if l.state.Nodes == nil {
+		l.state.Nodes = make(map[string]*api.UsageReport)
+	}
+	if l.state.Totals == nil {
+		l.state.Totals = make(map[string]*api.NamespaceUsage)
+	}
+	return l, nil
+}
+
+// Record counts a node's report into the current window. The first report
+// of a node that started before the ledger only sets where its next
+// report is counted from, as another ledger may have counted the rest.
+func (l *Ledger) Record(report *api.UsageReport) error {
+	if report.Node == "" {
+		return errors.New("node is required")
+	}
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	previous := l.state.Nodes[report.Node]
+	current := l.current(now)
+	for namespace, u := range report.Namespaces {
+		delta := *u
+		switch {
+		case previous != nil && previous.StartedAt == report.StartedAt:
+			if last, ok := previous.Namespaces[namespace]; ok {
+				delta = subtract(*u, *last)
+			}
+		case previous == nil && report.StartedAt < l.state.CreatedAt:
+			continue
+		}
+		add(current.Namespaces, namespace, &delta)
+		add(l.state.Totals, namespace, &delta)
+	}
+
+	// The report is kept with the time it arrived, so that stored bytes go
+	// stale by the ledger's clock. Nodes whose stored bytes were not
+	// measured yet keep those they last reported.
+	kept := *report
+	if report.MeasuredAt == 0 && previous != nil && previous.MeasuredAt != 0 {
+		kept = *carryStored(report, previous)
+	}
+	kept.Timestamp = now.UnixNano()
+	l.state.Nodes[report.Node] = &kept
+	l.updateStored(current, now)
+	l.expire(now)
+
+	if now.Sub(l.persistedAt) < persistInterval {
+		return nil
+	}
+	if err := l.persist(); err != nil {
+		return err
+	}
+	l.persistedAt = now
+	return nil
+}
+
+// add adds the request and byte counts of a usage to those of a namespace
+func add(namespaces map[string]*api.NamespaceUsage, namespace string, u *api.NamespaceUsage) {
+	counted, ok := namespaces[namespace]
+	if !ok {
+		counted = &api.NamespaceUsage{}
+		namespaces[namespace] = counted
+	}
+	counted.Add(u)
+}
+
+// subtract returns the counts of a report since an earlier one of the same
+// node. A count lower than before, as if the node's counters were reset,
+// is counted whole.
+func subtract(u, last api.NamespaceUsage) api.NamespaceUsage {
+	diff := func(now, before int64) int64 {
+		if now < before {
+			return now
+		}
+		return now - before
+	}
+	return api.NamespaceUsage{
+		Requests: diff(u.Requests, last.Requests),
+		Reads:    diff(u.Reads, last.Reads),
+		Writes:   diff(u.Writes, last.Writes),
+		Deletes:  diff(u.Deletes, last.Deletes),
+		BytesIn:  diff(u.BytesIn, last.BytesIn),
+		BytesOut: diff(u.BytesOut, last.BytesOut),
+	}
+}
+
+// carryStored copies a report with the stored bytes of an earlier one
+func carryStored(report, previous *api.UsageReport) *api.UsageReport {
+	carried := *report
+	carried.MeasuredAt = previous.MeasuredAt
+	carried.Namespaces = make(map[string]*api.NamespaceUsage, len(report.Namespaces))
+	for namespace, u := range report.Namespaces {
+		copied := *u
+		carried.Namespaces[namespace] = &copied
+	}
+	for namespace, u := range previous.Namespaces {
+		copied, ok := carried.Namespaces[namespace]
+		if !ok {
+			copied = &api.NamespaceUsage{}
+			carried.Namespaces[namespace] = copied
+		}
+		copied.StoredBytes = u.StoredBytes
+		copied.Blocks = u.Blocks
+	}
+	return &carried
+}
+
+// current returns the window now falls in, starting it if needed. Must be
+// called with the lock held.
+func (l *Ledger) current(now time.Time) *Window {
+	if n := len(l.state.Windows); n > 0 {
+		if last := l.state.Windows[n-1]; now.UnixNano() < last.End {
+			return last
+		}
+	}
+	start := now.Truncate(l.window)
+	w := &Window{
+		Start:      start.UnixNano(),
+		End:        start.Add(l.window).UnixNano(),
+		Namespaces: make(map[string]*api.NamespaceUsage),
+	}
+	l.state.Windows = append(l.state.Windows, w)
+	return w
+}
+
+// updateStored sets the stored bytes of a window to the sum of those the
+// nodes reported recently. Must be called with the lock held.
+func (l *Ledger) updateStored(w *Window, now time.Time) {
+	for _, u := range w.Namespaces {
+		u.StoredBytes, u.Blocks = 0, 0
+	}
+	for _, report := range l.state.Nodes {
+		if report.MeasuredAt == 0 || now.Sub(time.Unix(0, report.Timestamp)) > staleAfter {
+			continue
+		}
+		for namespace, u := range report.Namespaces {
+			counted, ok := w.Namespaces[namespace]
+			if !ok {
+				counted = &api.NamespaceUsage{}
+				w.Namespaces[namespace] = counted
+			}
+			counted.StoredBytes += u.StoredBytes
+			counted.Blocks += u.Blocks
+		}
+	}
+}
+
+// expire drops the windows past the retention period and the nodes that
+// stopped reporting within it. Must be called with the lock held.
+func (l *Ledger) expire(now time.Time) {
+	horizon := now.Add(-l.retention).UnixNano()
+	i := 0
+	for i < len(l.state.Windows) && l.state.Windows[i].End <= horizon {
+		i++
+	}
+	l.state.Windows = l.state.Windows[i:]
+	for node, report := range l.state.Nodes {
+		if report.Timestamp < horizon {
+			delete(l.state.Nodes, node)
+		}
+	}
+}
+
+// Summary returns the use of a namespace, or of every namespace if it is
+// empty, over the windows that end after since
+func (l *Ledger) Summary(namespace string, since time.Time) *Summary {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	summary := &Summary{
+		Since:      since.UnixNano(),
+		Namespaces: make(map[string]*api.NamespaceUsage),
+		Windows:    []*Window{},
+	}
+	for _, w := range l.state.Windows {
+		if w.End <= summary.Since {
+			continue
+		}
+		copied := &Window{Start: w.Start, End: w.End, Namespaces: make(map[string]*api.NamespaceUsage)}
+		for ns, u := range w.Namespaces {
+			if namespace != "" && ns != namespace {
+				continue
+			}
+			c := *u
+			copied.Namespaces[ns] = &c
+			add(summary.Namespaces, ns, &c)
+			total := summary.Namespaces[ns]
+			total.StoredBytes, total.Blocks = c.StoredBytes, c.Blocks
+		}
+		summary.Windows = append(summary.Windows, copied)
+		summary.Until = w.End
+	}
+	return summary
+}
+
+// Aggregate returns the use of every namespace over the windows between
+// start and end: the sum of their requests and transfers, and the bytes
+// stored at the end of the last
+func (l *Ledger) Aggregate(start, end time.Time) map[string]*api.NamespaceUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	namespaces := make(map[string]*api.NamespaceUsage)
+	for _, w := range l.state.Windows {
+		if w.Start < start.UnixNano() || w.End > end.UnixNano() {
+			continue
+		}
+		for namespace, u := range w.Namespaces {
+			add(namespaces, namespace, u)
+			total := namespaces[namespace]
+			total.StoredBytes, total.Blocks = u.StoredBytes, u.Blocks
+		}
+	}
+	return namespaces
+}
+
+// Oldest returns the start of the oldest window kept, or false if the
+// ledger holds none
+func (l *Ledger) Oldest() (time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.state.Windows) == 0 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, l.state.Windows[0].Start), true
+}
+
+// Totals returns the requests and transfers of each namespace since the
+// ledger started, with the bytes stored as of the current window
+func (l *Ledger) Totals() map[string]*api.NamespaceUsage {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	totals := make(map[string]*api.NamespaceUsage, len(l.state.Totals))
+	for namespace, u := range l.state.Totals {
+		c := *u
+		totals[namespace] = &c
+	}
+	if n := len(l.state.Windows); n > 0 {
+		for namespace, u := range l.state.Windows[n-1].Namespaces {
+			c, ok := totals[namespace]
+			if !ok {
+				c = &api.NamespaceUsage{}
+				totals[namespace] = c
+			}
+			c.StoredBytes, c.Blocks = u.StoredBytes, u.Blocks
+		}
+	}
+	return totals
+}
+
+// Window returns the span of time usage is added up over
+func (l *Ledger) Window() time.Duration {
+	return l.window
+}
+
+// Flush persists the ledger
+func (l *Ledger) Flush() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.persist()
+}
+
+// persist writes the ledger to its file, replacing the previous one
+// atomically. Must be called with the lock held.
+func (l *Ledger) persist() error {
+	data, err := json.Marshal(&l.state)
+	if err != nil {
+		return fmt.Errorf("failed to marshal usage ledger: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(l.path), 0755); err != nil {
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+	tmp := l.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write usage ledger: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Package usage accounts for the use each namespace makes of the cluster:
+// the bytes it stores, the data it transfers and the requests it makes.
+// Each node meters the requests it serves and measures the blocks its
+// targets hold, and reports them to the coordinator, whose ledger adds
+// the reports of every node up into windows of time, as the basis for
+// quotas and chargeback.
+package usage
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// counters are the use of one namespace on a node
+type counters struct {
+	requests atomic.Int64
+	reads    atomic.Int64
+	writes   atomic.Int64
+	deletes  atomic.Int64
+	bytesIn  atomic.Int64
+	bytesOut atomic.Int64
+}
+
+// Meter counts the requests a node serves for each namespace since it
+// started, and holds the bytes each namespace stores on it as last
+// measured
+type Meter struct {
+	startedAt  int64
+	namespaces sync.Map // namespace -> *counters
+
+	mu         sync.Mutex
+	stored     map[string]api.NamespaceUsage
+	measuredAt int64
+}
+
+// NewMeter creates a meter counting from now
+func NewMeter() *Meter {
+	return &Meter{startedAt: time.Now().UnixNano()}
+}
+
+// Record counts a request of a namespace, with the bytes it sent and was
+// sent
+func (m *Meter) Record(namespace string, op api.Op, in, out int) {
+	value, ok := m.namespaces.Load(namespace)
+	if !ok {
+		value, _ = m.namespaces.LoadOrStore(namespace, &counters{})
+	}
+	c := value.(*counters)
+	c.requests.Add(1)
+	switch op {
+	case api.OpRead, api.OpFetch:
+		c.reads.Add(1)
+	case api.OpWrite:
+		c.writes.Add(1)
+	case api.OpDelete:
+		c.deletes.Add(1)
+	}
+	c.bytesIn.Add(int64(in))
+	c.bytesOut.Add(int64(out))
+}
+
+// SetStored replaces the bytes and blocks stored by each namespace with a
+// new measurement
+func (m *Meter) SetStored(stored map[string]api.NamespaceUsage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.stored = stored
+	m.measuredAt = time.Now().UnixNano()
+}
+
+// Report returns the use of every namespace since the node started. The
+// stored bytes are only reported once they were measured.
+func (m *Meter) Report(node string) *api.UsageReport {
+	report := &api.UsageReport{
+		Node:       node,
+		StartedAt:  m.startedAt,
+		Timestamp:  time.Now().UnixNano(),
+		Namespaces: make(map[string]*api.NamespaceUsage),
+	}
+	m.namespaces.Range(func(key, value any) bool {
+		c := value.(*counters)
+		report.Namespaces[key.(string)] = &api.NamespaceUsage{
+			Requests: c.requests.Load(),
+			Reads:    c.reads.Load(),
+			Writes:   c.writes.Load(),
+			Deletes:  c.deletes.Load(),
+			BytesIn:  c.bytesIn.Load(),
+			BytesOut: c.bytesOut.Load(),
+		}
+		return true
+	})
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	report.MeasuredAt = m.measuredAt
+	for namespace, stored := range m.stored {
+		u, ok := report.Namespaces[namespace]
+		if !ok {
+			u = &api.NamespaceUsage{}
+			report.Namespaces[namespace] = u
+		}
+		u.StoredBytes = stored.StoredBytes
+		u.Blocks = stored.Blocks
+	}
+	return report
+}
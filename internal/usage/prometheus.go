@@ -0,0 +1,65 @@
+package usage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// metricPrefix starts the names of the usage metrics
+const metricPrefix = "threefs_namespace_"
+
+// WritePrometheus writes the ledger's totals in the Prometheus text
+// exposition format: the requests and transfers of each namespace since
+// the ledger started as counters, and the bytes and blocks it stores as of
+// the current window as gauges
+func (l *Ledger) WritePrometheus(w io.Writer) error {
+	totals := l.Totals()
+	namespaces := make([]string, 0, len(totals))
+	for namespace := range totals {
+		namespaces = append(namespaces, namespace)
+	}
+	slices.Sort(namespaces)
+
+	bw := bufio.NewWriter(w)
+	metric := func(name, kind, help string, value func(namespace string) int64) {
+		fmt.Fprintf(bw, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricPrefix, name, help, metricPrefix, name, kind)
+		for _, namespace := range namespaces {
+			fmt.Fprintf(bw, "%s%s{namespace=\"%s\"} %d\n", metricPrefix, name, escapeLabel(namespace), value(namespace))
+		}
+	}
+
+	fmt.Fprintf(bw, "# HELP %srequests_total Requests served for the namespace, by kind\n", metricPrefix)
+	fmt.Fprintf(bw, "# TYPE %srequests_total counter\n", metricPrefix)
+	for _, namespace := range namespaces {
+		u := totals[namespace]
+		label := escapeLabel(namespace)
+		for _, kind := range []struct {
+			name  string
+			count int64
+		}{
+			{"read", u.Reads},
+			{"write", u.Writes},
+			{"delete", u.Deletes},
+			{"other", u.Requests - u.Reads - u.Writes - u.Deletes},
+		} {
+			fmt.Fprintf(bw, "%srequests_total{namespace=\"%s\",kind=\"%s\"} %d\n", metricPrefix, label, kind.name, kind.count)
+		}
+	}
+	metric("received_bytes_total", "counter", "Bytes clients sent for the namespace",
+		func(namespace string) int64 { return totals[namespace].BytesIn })
+	metric("sent_bytes_total", "counter", "Bytes clients were sent for the namespace",
+		func(namespace string) int64 { return totals[namespace].BytesOut })
+	metric("stored_bytes", "gauge", "Bytes the namespace stores, counting every replica",
+		func(namespace string) int64 { return totals[namespace].StoredBytes })
+	metric("blocks", "gauge", "Blocks the namespace stores, counting every replica",
+		func(namespace string) int64 { return totals[namespace].Blocks })
+	return bw.Flush()
+}
+
+// escapeLabel escapes a label value for the text exposition format
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
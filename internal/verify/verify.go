@@ -0,0 +1,534 @@
+// Package verify checks that a cluster's data is intact, from the outside:
+// that every block has the replicas its chain and replication factor call
+// for, that the replicas agree on version and checksum, and that each
+// node serves the chains the coordinator's routing table gives it. Nodes
+// are asked through their data ports and admin APIs, as any client would,
+// so a verification needs no access to their disks.
+package verify
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+	"github.com/3fs-storage/pkg/client"
+)
+
+// DefaultWorkers is the number of blocks checked at the same time
+const DefaultWorkers = 8
+
+// Kinds of problems a verification finds
+const (
+	// ProblemUnreachable is a node or target that could not be asked, so
+	// the replicas it holds were not verified
+	ProblemUnreachable = "unreachable"
+	// ProblemMembership is a target whose node disagrees with the
+	// coordinator about the chains it is a member of
+	ProblemMembership = "membership"
+	// ProblemMissing is a chain member lacking a block while the block
+	// has fewer replicas than its replication factor
+	ProblemMissing = "missing"
+	// ProblemMismatch is a replica whose version or checksum differs from
+	// the newest replica of the block
+	ProblemMismatch = "mismatch"
+	// ProblemCorrupt is a replica whose data does not match its checksum,
+	// found by deep verification
+	ProblemCorrupt = "corrupt"
+	// ProblemMisplaced is a block held by a target outside its chain
+	ProblemMisplaced = "misplaced"
+)
+
+// Options configures a verification
+type Options struct {
+	// Prefix limits the verification to blocks with IDs starting with it
+	Prefix string
+	// Deep reads every replica and checks its data against its checksum,
+	// rather than comparing metadata only
+	Deep bool
+	// Workers is the number of blocks checked at the same time
+	Workers int
+	// Factor is the cluster's replication factor. Zero asks a node for
+	// it; namespaces with a policy of their own use theirs.
+	Factor int
+}
+
+// Problem is something found wrong with the cluster
+type Problem struct {
+	Kind string `json:"kind"`
+	// Target is the target, or the node's admin address, the problem is on
+	Target  string `json:"target,omitempty"`
+	BlockID string `json:"block_id,omitempty"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// Report summarises a verification
+type Report struct {
+	Options      Options `json:"options"`
+	TableVersion uint64  `json:"table_version"`
+	StartedAt    int64   `json:"started_at"`
+	FinishedAt   int64   `json:"finished_at"`
+	Nodes        int     `json:"nodes"`
+	Targets      int     `json:"targets"`
+	Blocks       int     `json:"blocks"`
+	// Replicas counts the copies of blocks checked
+	Replicas int `json:"replicas"`
+	// Unverified counts the blocks with replicas on targets that could
+	// not be asked
+	Unverified int       `json:"unverified"`
+	Problems   []Problem `json:"problems"`
+}
+
+// Intact reports whether the verification found nothing wrong
+func (r *Report) Intact() bool {
+	return len(r.Problems) == 0
+}
+
+// Counts returns the number of problems of each kind
+func (r *Report) Counts() map[string]int {
+	counts := make(map[string]int)
+	for _, p := range r.Problems {
+		counts[p.Kind]++
+	}
+	return counts
+}
+
+// Dial opens a connection to a node's data port
+type Dial func(address string) (*client.Client, error)
+
+// AdminGet fetches a path of the admin API of the node at an admin
+// address, returning the body of a successful response
+type AdminGet func(ctx context.Context, address, path string) ([]byte, error)
+
+// targetView is what a node reports of one of its targets in /v1/targets
+type targetView struct {
+	ID      string   `json:"id"`
+	Healthy bool     `json:"healthy"`
+	Error   string   `json:"error,omitempty"`
+	Chains  []uint32 `json:"chains"`
+}
+
+// replica is a target's copy of a block, or the error asking for it
+type replica struct {
+	target string
+	stat   *api.BlockStat
+	err    error
+}
+
+// verifier holds the state of a verification
+type verifier struct {
+	table  *api.RoutingTable
+	dial   Dial
+	opts   Options
+	logger *slog.Logger
+
+	mu          sync.Mutex
+	report      *Report
+	unreachable map[string]bool
+}
+
+// Run verifies the cluster the routing table describes. Problems are in
+// the report; the error is for a verification that could not run, or was
+// interrupted by ctx, with the report of what was checked until then.
+func Run(ctx context.Context, table *api.RoutingTable, dial Dial, admin AdminGet, opts Options, logger *slog.Logger) (*Report, error) {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWorkers
+	}
+	v := &verifier{
+		table:  table,
+		dial:   dial,
+		opts:   opts,
+		logger: logger,
+		report: &Report{
+			TableVersion: table.Version,
+			StartedAt:    time.Now().UnixNano(),
+			Problems:     make([]Problem, 0),
+		},
+		unreachable: make(map[string]bool),
+	}
+	defer func() {
+		v.report.Options = v.opts
+		v.report.FinishedAt = time.Now().UnixNano()
+	}()
+
+	v.checkMembership(ctx, admin)
+	logger.Info("listing blocks", "targets", v.report.Targets, "prefix", opts.Prefix)
+	holders := v.listBlocks(ctx)
+	if err := ctx.Err(); err != nil {
+		return v.report, err
+	}
+	v.report.Blocks = len(holders)
+	logger.Info("checking blocks", "blocks", len(holders), "deep", opts.Deep)
+	v.checkBlocks(ctx, holders)
+	v.sortProblems()
+	return v.report, ctx.Err()
+}
+
+// problem records a problem
+func (v *verifier) problem(p Problem) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.report.Problems = append(v.report.Problems, p)
+}
+
+// serving reports whether a target is in a state to hold its chains'
+// blocks: up, or draining while its data migrates
+func serving(record *api.NodeRecord) bool {
+	return record.State == api.NodeStateUp || record.State == api.NodeStateDraining
+}
+
+// checkMembership asks every node which chains each of its targets is a
+// member of, comparing with the routing table, and asks one for the
+// cluster's replication factor if the options do not give it
+func (v *verifier) checkMembership(ctx context.Context, admin AdminGet) {
+	byAdmin := make(map[string][]*api.NodeRecord)
+	nodes := make(map[string]bool)
+	for _, record := range v.table.Nodes {
+		if !serving(record) {
+			continue
+		}
+		v.report.Targets++
+		nodes[record.Address] = true
+		if record.AdminAddress != "" {
+			byAdmin[record.AdminAddress] = append(byAdmin[record.AdminAddress], record)
+		}
+	}
+	v.report.Nodes = len(nodes)
+
+	addresses := make([]string, 0, len(byAdmin))
+	for address := range byAdmin {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		if ctx.Err() != nil {
+			return
+		}
+		body, err := admin(ctx, address, "/v1/targets")
+		if err != nil {
+			v.problem(Problem{Kind: ProblemUnreachable, Target: address, Detail: "admin API: " + err.Error()})
+			continue
+		}
+		var views []targetView
+		if err := json.Unmarshal(body, &views); err != nil {
+			v.problem(Problem{Kind: ProblemUnreachable, Target: address, Detail: "failed to decode targets: " + err.Error()})
+			continue
+		}
+		v.compareTargets(byAdmin[address], views)
+
+		if v.opts.Factor == 0 {
+			v.opts.Factor = replicaFactor(ctx, admin, address)
+		}
+	}
+}
+
+// compareTargets compares the targets a node reports with its records in
+// the routing table
+func (v *verifier) compareTargets(records []*api.NodeRecord, views []targetView) {
+	byID := make(map[string]targetView, len(views))
+	for _, view := range views {
+		byID[view.ID] = view
+	}
+	for _, record := range records {
+		view, ok := byID[record.ID]
+		if !ok {
+			v.problem(Problem{Kind: ProblemMembership, Target: record.ID, Detail: "the node does not serve this target"})
+			continue
+		}
+		if !view.Healthy {
+			v.problem(Problem{Kind: ProblemUnreachable, Target: record.ID, Detail: "target unhealthy: " + view.Error})
+		}
+		want := v.chainsOf(record.ID)
+		got := slices.Clone(view.Chains)
+		slices.Sort(got)
+		if !slices.Equal(want, got) {
+			v.problem(Problem{
+				Kind:   ProblemMembership,
+				Target: record.ID,
+				Detail: fmt.Sprintf("the node has it in chains %v, the coordinator in chains %v", got, want),
+			})
+		}
+	}
+}
+
+// chainsOf returns the IDs of the chains a target is a member of in the
+// routing table, sorted
+func (v *verifier) chainsOf(target string) []uint32 {
+	chains := make([]uint32, 0)
+	for _, chain := range v.table.Chains {
+		if slices.Contains(chain.Members, target) {
+			chains = append(chains, chain.ID)
+		}
+	}
+	slices.Sort(chains)
+	return chains
+}
+
+// replicaFactor asks a node for the cluster's replication factor, or
+// returns zero if it cannot tell
+func replicaFactor(ctx context.Context, admin AdminGet, address string) int {
+	body, err := admin(ctx, address, "/v1/chain")
+	if err != nil {
+		return 0
+	}
+	var chain struct {
+		Factor int `json:"replica_factor"`
+	}
+	if json.Unmarshal(body, &chain) != nil {
+		return 0
+	}
+	return chain.Factor
+}
+
+// listBlocks lists the blocks of every serving target, returning the
+// targets holding each block
+func (v *verifier) listBlocks(ctx context.Context) map[string][]string {
+	holders := make(map[string][]string)
+	conns := make(map[string]*client.Client)
+	defer closeAll(conns)
+
+	ids := make([]string, 0, len(v.table.Nodes))
+	for id, record := range v.table.Nodes {
+		if serving(record) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if ctx.Err() != nil {
+			return holders
+		}
+		c, err := v.conn(conns, v.table.Nodes[id].Address)
+		if err == nil {
+			var blockIDs []string
+			if blockIDs, err = c.List(client.WithTarget(ctx, id), v.opts.Prefix); err == nil {
+				for _, blockID := range blockIDs {
+					holders[blockID] = append(holders[blockID], id)
+				}
+				continue
+			}
+		}
+		v.unreachable[id] = true
+		v.problem(Problem{Kind: ProblemUnreachable, Target: id, Detail: "listing failed: " + err.Error()})
+	}
+	return holders
+}
+
+// conn returns a connection to a node's data port from conns, dialing it
+// if needed
+func (v *verifier) conn(conns map[string]*client.Client, address string) (*client.Client, error) {
+	if c, ok := conns[address]; ok {
+		return c, nil
+	}
+	c, err := v.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	conns[address] = c
+	return c, nil
+}
+
+// closeAll closes connections
+func closeAll(conns map[string]*client.Client) {
+	for _, c := range conns {
+		c.Close()
+	}
+}
+
+// checkBlocks checks the blocks found, spread over the workers, each with
+// connections of its own
+func (v *verifier) checkBlocks(ctx context.Context, holders map[string][]string) {
+	blockIDs := make([]string, 0, len(holders))
+	for blockID := range holders {
+		blockIDs = append(blockIDs, blockID)
+	}
+	sort.Strings(blockIDs)
+
+	work := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < v.opts.Workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conns := make(map[string]*client.Client)
+			defer closeAll(conns)
+			for blockID := range work {
+				v.verifyBlock(ctx, conns, blockID, holders[blockID])
+			}
+		}()
+	}
+
+feed:
+	for _, blockID := range blockIDs {
+		select {
+		case work <- blockID:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+}
+
+// verifyBlock checks a block, and checks it again if it looks wrong, so
+// that a write reaching the chain's members one after the other while
+// they are asked is not reported
+func (v *verifier) verifyBlock(ctx context.Context, conns map[string]*client.Client, blockID string, holders []string) {
+	var problems []Problem
+	var checked int
+	var unverified bool
+	for attempt := 0; attempt < 2; attempt++ {
+		problems, checked, unverified = v.checkBlock(ctx, conns, blockID, holders)
+		if len(problems) == 0 || ctx.Err() != nil {
+			break
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.report.Replicas += checked
+	if unverified {
+		v.report.Unverified++
+	}
+	v.report.Problems = append(v.report.Problems, problems...)
+}
+
+// checkBlock asks the serving members of a block's chain, and the targets
+// that listed it, for their copies, and returns what is wrong with them,
+// the number of replicas checked and whether some could not be asked
+func (v *verifier) checkBlock(ctx context.Context, conns map[string]*client.Client, blockID string, holders []string) ([]Problem, int, bool) {
+	chain := v.table.ChainForBlock(blockID)
+	var members []string
+	if chain != nil {
+		members = chain.Members
+	}
+	candidates := make([]string, 0, len(members)+len(holders))
+	for _, member := range members {
+		if record, ok := v.table.Nodes[member]; ok && serving(record) {
+			candidates = append(candidates, member)
+		}
+	}
+	for _, holder := range holders {
+		if !slices.Contains(candidates, holder) {
+			candidates = append(candidates, holder)
+		}
+	}
+
+	var problems []Problem
+	var held []replica
+	var lacking []string
+	unverified := false
+	reachable := 0
+	checked := 0
+	for _, target := range candidates {
+		if v.unreachable[target] {
+			unverified = true
+			continue
+		}
+		r := v.ask(ctx, conns, target, blockID)
+		member := slices.Contains(members, target)
+		if member {
+			reachable++
+		}
+		switch {
+		case r.err != nil && r.stat != nil:
+			// The metadata was read but the data failed verification
+			checked++
+			problems = append(problems, Problem{Kind: ProblemCorrupt, Target: target, BlockID: blockID, Detail: r.err.Error()})
+		case r.err != nil:
+			if member {
+				lacking = append(lacking, target)
+			}
+		case !member:
+			checked++
+			problems = append(problems, Problem{Kind: ProblemMisplaced, Target: target, BlockID: blockID,
+				Detail: fmt.Sprintf("version %d, outside its chain", r.stat.Version)})
+		default:
+			checked++
+			held = append(held, r)
+		}
+	}
+
+	// The newest replica, the first in chain order among equals, is the
+	// reference the others must match
+	if len(held) > 0 {
+		newest := held[0]
+		for _, r := range held[1:] {
+			if r.stat.Version > newest.stat.Version {
+				newest = r
+			}
+		}
+		for _, r := range held {
+			if r.stat.Checksum != newest.stat.Checksum {
+				problems = append(problems, Problem{
+					Kind:    ProblemMismatch,
+					Target:  r.target,
+					BlockID: blockID,
+					Detail: fmt.Sprintf("version %d checksum %s, %s holds version %d checksum %s",
+						r.stat.Version, r.stat.Checksum, newest.target, newest.stat.Version, newest.stat.Checksum),
+				})
+			}
+		}
+	}
+
+	want := v.opts.Factor
+	if policy := v.table.Policy(api.Namespace(blockID)); policy != nil {
+		want = policy.Factor
+	}
+	if want <= 0 || want > reachable {
+		want = reachable
+	}
+	if len(held) < want {
+		for _, target := range lacking {
+			problems = append(problems, Problem{
+				Kind:    ProblemMissing,
+				Target:  target,
+				BlockID: blockID,
+				Detail:  fmt.Sprintf("%d of %d replicas", len(held), want),
+			})
+		}
+	}
+	return problems, checked, unverified
+}
+
+// ask reads a target's metadata of a block, and with deep verification
+// its data too. A replica whose data fails verification carries both its
+// metadata and the error.
+func (v *verifier) ask(ctx context.Context, conns map[string]*client.Client, target, blockID string) replica {
+	r := replica{target: target}
+	c, err := v.conn(conns, v.table.NodeAddress(target))
+	if err != nil {
+		r.err = err
+		return r
+	}
+	targetCtx := client.WithTarget(ctx, target)
+	if r.stat, r.err = c.Stat(targetCtx, blockID); r.err != nil || !v.opts.Deep {
+		return r
+	}
+	if _, _, err := c.Fetch(targetCtx, blockID, r.stat.Version); err != nil {
+		r.err = err
+	}
+	return r
+}
+
+// sortProblems orders the problems by kind, target and block
+func (v *verifier) sortProblems() {
+	sort.Slice(v.report.Problems, func(i, j int) bool {
+		a, b := v.report.Problems[i], v.report.Problems[j]
+		if a.Kind != b.Kind {
+			return a.Kind < b.Kind
+		}
+		if a.Target != b.Target {
+			return a.Target < b.Target
+		}
+		return a.BlockID < b.BlockID
+	})
+}
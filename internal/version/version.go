@@ -0,0 +1,80 @@
+// Package version identifies the build of the storage service
+package version
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+	"strings"
+)
+
+// Version is the release of the build, set at link time with
+// -ldflags "-X github.com/3fs-storage/internal/version.Version=v1.2.3".
+// Commit and BuildDate are set alike; when they are not, they are taken
+// from the VCS information the Go toolchain stamps into the binary.
+var (
+	Version   = "dev"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info describes a build and the features a node runs it with
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"build_date,omitempty"`
+	GoVersion string `json:"go_version"`
+	Platform  string `json:"platform"`
+	// Features are the feature flags enabled, sorted
+	Features []string `json:"features"`
+}
+
+// Get returns the build's information with the enabled features
+func Get(features []string) Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+		Features:  features,
+	}
+	if info.Features == nil {
+		info.Features = []string{}
+	}
+	if build, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// String formats the information as the version command prints it
+func (i Info) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Version:    %s\n", i.Version)
+	fmt.Fprintf(&b, "Commit:     %s\n", orUnknown(i.Commit))
+	fmt.Fprintf(&b, "Build date: %s\n", orUnknown(i.BuildDate))
+	fmt.Fprintf(&b, "Go version: %s\n", i.GoVersion)
+	fmt.Fprintf(&b, "Platform:   %s\n", i.Platform)
+	features := "none"
+	if len(i.Features) > 0 {
+		features = strings.Join(i.Features, ", ")
+	}
+	fmt.Fprintf(&b, "Features:   %s\n", features)
+	return b.String()
+}
+
+// orUnknown returns s, or "unknown" if it is empty
+func orUnknown(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return s
+}
@@ -0,0 +1,591 @@
+// Package writeback buffers small block writes on a fast local device, so
+// that they can be acknowledged once synced there and written to their
+// targets, and through their chains, later and in batches.
+//
+// The buffer is a log of segment files. Each buffered write is appended
+// and synced before it is acknowledged, and a done record is appended once
+// it was written to its target, so that a crash loses nothing: the writes
+// still pending are read back when the buffer is opened again. Segments
+// are removed, oldest first, once every write in them is done.
+package writeback
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/memory"
+)
+
+const (
+	// segmentSuffix names the segment files of the buffer
+	segmentSuffix = ".wb"
+	// DefaultSegmentSize is the size past which a new segment is started
+	DefaultSegmentSize = 64 << 20
+)
+
+// Record operations
+const (
+	opWrite = "write"
+	opDone  = "done"
+	opDrop  = "drop"
+)
+
+// memoryConsumer names the buffered writes in the node's memory budget
+const memoryConsumer = "write_buffer"
+
+// ErrClosed reports the use of a closed buffer
+var ErrClosed = errors.New("write-back buffer is closed")
+
+// Options configures a buffer
+type Options struct {
+	// MaxBytes bounds the data of the writes buffered and not done yet
+	MaxBytes int64
+	// SegmentSize is the size past which a new segment is started
+	SegmentSize int64
+	// Budget is the node's memory budget the data of buffered writes is
+	// taken from, if any; a write it has no room for is not buffered
+	Budget *memory.Budget
+}
+
+// Entry is a buffered write of a block to a storage target
+type Entry struct {
+	Seq     uint64 `json:"seq"`
+	BlockID string `json:"block_id"`
+	Target  string `json:"target"`
+	Time    int64  `json:"time"`
+	Data    []byte `json:"-"`
+
+	segment *segment
+	done    bool
+}
+
+// record is the header of a record of the log: a line of JSON, followed by
+// the data of a write. Done records name the write they complete by Seq;
+// drop records discard the pending write of a block.
+type record struct {
+	Seq      uint64 `json:"seq"`
+	Op       string `json:"op"`
+	BlockID  string `json:"block_id,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Time     int64  `json:"time,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// segment is a file of the log and the number of writes in it not done
+type segment struct {
+	id   uint64
+	path string
+	live int
+}
+
+// Stats reports the writes a buffer holds and has flushed
+type Stats struct {
+	Pending  int    `json:"pending"`
+	InFlight int    `json:"in_flight"`
+	Bytes    int64  `json:"bytes"`
+	MaxBytes int64  `json:"max_bytes"`
+	Segments int    `json:"segments"`
+	Buffered uint64 `json:"buffered"`
+	Flushed  uint64 `json:"flushed"`
+	Full     uint64 `json:"full"`
+	// Oldest is when the oldest pending write was buffered, zero without
+	// any
+	Oldest int64 `json:"oldest,omitempty"`
+}
+
+// Buffer is a crash-safe buffer of block writes, safe for concurrent use
+type Buffer struct {
+	dir  string
+	opts Options
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	segments []*segment
+	seq      uint64
+	bytes    int64
+	// pending are the latest writes of each block not done yet, and
+	// inflight the ones being written, with a channel closed when they
+	// are done or released
+	pending  map[string]*Entry
+	inflight map[string]chan struct{}
+	notify   chan struct{}
+	stats    Stats
+	closed   bool
+	// broken is set when a failed append could not be undone, after which
+	// the buffer takes no more writes
+	broken error
+}
+
+// Open opens the buffer in dir, creating it if needed, and reads back the
+// writes that were buffered but not done. A record torn by a crash at the
+// end of the log is dropped: the write it held was never acknowledged.
+func Open(dir string, opts Options) (*Buffer, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create write-back directory: %w", err)
+	}
+	b := &Buffer{
+		dir:      dir,
+		opts:     opts,
+		pending:  make(map[string]*Entry),
+		inflight: make(map[string]chan struct{}),
+		notify:   make(chan struct{}, 1),
+	}
+	if err := b.replay(); err != nil {
+		return nil, err
+	}
+	b.stats.MaxBytes = opts.MaxBytes
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.startSegment(); err != nil {
+		return nil, err
+	}
+	b.prune()
+	return b, nil
+}
+
+// replay reads the segments left by a previous run, oldest first, keeping
+// the latest write of each block that was neither done nor dropped
+func (b *Buffer) replay() error {
+	names, err := filepath.Glob(filepath.Join(b.dir, "*"+segmentSuffix))
+	if err != nil {
+		return fmt.Errorf("failed to list write-back segments: %w", err)
+	}
+	for _, name := range names {
+		id, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(name), segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		b.segments = append(b.segments, &segment{id: id, path: name})
+	}
+	sort.Slice(b.segments, func(i, j int) bool { return b.segments[i].id < b.segments[j].id })
+
+	for i, seg := range b.segments {
+		valid, torn, err := b.readSegment(seg)
+		if err != nil {
+			return err
+		}
+		if !torn {
+			continue
+		}
+		if i != len(b.segments)-1 {
+			return fmt.Errorf("write-back segment %s is damaged before its end", seg.path)
+		}
+		if err := os.Truncate(seg.path, valid); err != nil {
+			return fmt.Errorf("failed to truncate write-back segment: %w", err)
+		}
+	}
+	for _, e := range b.pending {
+		e.segment.live++
+		b.bytes += int64(len(e.Data))
+	}
+	b.opts.Budget.Charge(memoryConsumer, b.bytes)
+	return nil
+}
+
+// readSegment applies the records of a segment, returning the length of
+// its intact records and whether a torn one follows them
+func (b *Buffer) readSegment(seg *segment) (int64, bool, error) {
+	f, err := os.Open(seg.path)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to open write-back segment: %w", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var valid int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return valid, false, nil
+		}
+		if err != nil {
+			return valid, true, nil
+		}
+		var rec record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return valid, true, nil
+		}
+
+		switch rec.Op {
+		case opWrite:
+			data := make([]byte, rec.Size)
+			if _, err := io.ReadFull(r, data); err != nil {
+				return valid, true, nil
+			}
+			sum := sha256.Sum256(data)
+			if hex.EncodeToString(sum[:]) != rec.Checksum {
+				return valid, true, nil
+			}
+			b.pending[rec.BlockID] = &Entry{
+				Seq:     rec.Seq,
+				BlockID: rec.BlockID,
+				Target:  rec.Target,
+				Time:    rec.Time,
+				Data:    data,
+				segment: seg,
+			}
+		case opDone:
+			if e, ok := b.pending[rec.BlockID]; ok && e.Seq == rec.Seq {
+				delete(b.pending, rec.BlockID)
+			}
+		case opDrop:
+			if e, ok := b.pending[rec.BlockID]; ok && e.Seq < rec.Seq {
+				delete(b.pending, rec.BlockID)
+			}
+		}
+		b.seq = max(b.seq, rec.Seq)
+		valid += int64(len(line) + rec.Size)
+	}
+}
+
+// startSegment starts a new segment for appends. Must be called with the
+// lock held.
+func (b *Buffer) startSegment() error {
+	var id uint64 = 1
+	if n := len(b.segments); n > 0 {
+		id = b.segments[n-1].id + 1
+	}
+	path := filepath.Join(b.dir, fmt.Sprintf("%020d%s", id, segmentSuffix))
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create write-back segment: %w", err)
+	}
+	if b.file != nil {
+		b.file.Close()
+	}
+	b.file = file
+	b.size = 0
+	b.segments = append(b.segments, &segment{id: id, path: path})
+	return nil
+}
+
+// active returns the segment appended to. Must be called with the lock
+// held.
+func (b *Buffer) active() *segment {
+	return b.segments[len(b.segments)-1]
+}
+
+// append writes a record, and the data of a write, to the active segment,
+// syncing it if requested. A record that fails to be written or synced is
+// cut off the segment, so that the records after it are not lost behind a
+// torn one on replay. Must be called with the lock held.
+func (b *Buffer) append(rec *record, data []byte, sync bool) error {
+	if b.broken != nil {
+		return b.broken
+	}
+	if b.size >= b.opts.SegmentSize {
+		if err := b.startSegment(); err != nil {
+			return err
+		}
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return fmt.Errorf("failed to marshal write-back record: %w", err)
+	}
+	line = append(line, '\n')
+	if _, err := b.file.Write(append(line, data...)); err != nil {
+		b.undo()
+		return fmt.Errorf("failed to append to write-back buffer: %w", err)
+	}
+	if sync {
+		if err := b.file.Sync(); err != nil {
+			b.undo()
+			return fmt.Errorf("failed to sync write-back buffer: %w", err)
+		}
+	}
+	b.size += int64(len(line) + len(data))
+	return nil
+}
+
+// undo truncates the active segment back to its last whole record. If it
+// cannot, the buffer is marked broken, since a record appended after the
+// torn one would be lost on replay. Must be called with the lock held.
+func (b *Buffer) undo() {
+	if err := b.file.Truncate(b.size); err != nil {
+		b.broken = fmt.Errorf("write-back buffer is damaged: %w", err)
+		return
+	}
+	if _, err := b.file.Seek(b.size, io.SeekStart); err != nil {
+		b.broken = fmt.Errorf("write-back buffer is damaged: %w", err)
+	}
+}
+
+// Append buffers a write of a block to a target once it is synced,
+// replacing any pending write of the block. It reports false, buffering
+// nothing, when the buffer is full; the write then has to be made
+// directly.
+func (b *Buffer) Append(blockID, target string, data []byte) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return false, ErrClosed
+	}
+	if b.broken != nil {
+		b.stats.Full++
+		return false, nil
+	}
+	size := int64(len(data))
+	if b.bytes+size > b.opts.MaxBytes || !b.opts.Budget.TryReserve(memoryConsumer, size) {
+		b.stats.Full++
+		return false, nil
+	}
+
+	b.seq++
+	sum := sha256.Sum256(data)
+	rec := &record{
+		Seq:      b.seq,
+		Op:       opWrite,
+		BlockID:  blockID,
+		Target:   target,
+		Time:     time.Now().UnixNano(),
+		Size:     len(data),
+		Checksum: hex.EncodeToString(sum[:]),
+	}
+	if err := b.append(rec, data, true); err != nil {
+		b.opts.Budget.Release(memoryConsumer, size)
+		return false, err
+	}
+
+	// A write being flushed is done once flushed; one still pending is
+	// superseded right away
+	if old, ok := b.pending[blockID]; ok {
+		if _, flushing := b.inflight[blockID]; !flushing {
+			b.retire(old)
+		}
+	}
+	b.pending[blockID] = &Entry{
+		Seq:     rec.Seq,
+		BlockID: blockID,
+		Target:  target,
+		Time:    rec.Time,
+		Data:    data,
+		segment: b.active(),
+	}
+	b.active().live++
+	b.bytes += size
+	b.stats.Buffered++
+	select {
+	case b.notify <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// Get returns the pending write of a block, if any
+func (b *Buffer) Get(blockID string) (*Entry, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.pending[blockID]
+	return e, ok
+}
+
+// Blocks returns the IDs of the blocks with a pending write to a target
+// starting with prefix
+func (b *Buffer) Blocks(target, prefix string) []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ids := make([]string, 0)
+	for id, e := range b.pending {
+		if e.Target == target && strings.HasPrefix(id, prefix) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// Notify returns a channel signalled when writes are buffered
+func (b *Buffer) Notify() <-chan struct{} {
+	return b.notify
+}
+
+// Next claims up to n pending writes of blocks not being flushed, oldest
+// first. Each must be passed back to Done or Release.
+func (b *Buffer) Next(n int) []*Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	entries := make([]*Entry, 0, min(n, len(b.pending)))
+	for id, e := range b.pending {
+		if _, ok := b.inflight[id]; !ok {
+			entries = append(entries, e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Seq < entries[j].Seq })
+	if len(entries) > n {
+		entries = entries[:n]
+	}
+	for _, e := range entries {
+		b.inflight[e.BlockID] = make(chan struct{})
+	}
+	return entries
+}
+
+// Claim claims the pending write of a block, waiting for it to be flushed
+// if it is being flushed already, and returns nil once the block has no
+// pending write. The write must be passed back to Done or Release.
+func (b *Buffer) Claim(blockID string) *Entry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		wait, ok := b.inflight[blockID]
+		if !ok {
+			break
+		}
+		b.mu.Unlock()
+		<-wait
+		b.mu.Lock()
+	}
+	e, ok := b.pending[blockID]
+	if !ok {
+		return nil
+	}
+	b.inflight[blockID] = make(chan struct{})
+	return e
+}
+
+// Done records that claimed writes were written to their targets, syncing
+// the records, so that they are not written again after a crash
+func (b *Buffer) Done(entries []*Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var err error
+	for i, e := range entries {
+		if err == nil {
+			err = b.append(&record{Seq: e.Seq, Op: opDone, BlockID: e.BlockID}, nil, i == len(entries)-1)
+		}
+		b.finish(e)
+		if b.pending[e.BlockID] == e {
+			delete(b.pending, e.BlockID)
+		}
+		b.retire(e)
+		b.stats.Flushed++
+	}
+	b.prune()
+	return err
+}
+
+// Release gives back claimed writes that could not be written, to be
+// flushed again later
+func (b *Buffer) Release(entries []*Entry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, e := range entries {
+		b.finish(e)
+		// A write superseded while it was being flushed is no longer
+		// needed
+		if b.pending[e.BlockID] != e {
+			b.retire(e)
+		}
+	}
+	b.prune()
+}
+
+// Drop discards the pending write of a block, such as before the block is
+// deleted, waiting for a flush of it in progress
+func (b *Buffer) Drop(blockID string) error {
+	e := b.Claim(blockID)
+	if e == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.seq++
+	err := b.append(&record{Seq: b.seq, Op: opDrop, BlockID: blockID}, nil, true)
+	b.finish(e)
+	if err != nil {
+		return err
+	}
+	delete(b.pending, blockID)
+	b.retire(e)
+	b.prune()
+	return nil
+}
+
+// finish ends the claim on a write. Must be called with the lock held.
+func (b *Buffer) finish(e *Entry) {
+	if wait, ok := b.inflight[e.BlockID]; ok {
+		close(wait)
+		delete(b.inflight, e.BlockID)
+	}
+}
+
+// retire frees a write that is done or superseded. Must be called with
+// the lock held.
+func (b *Buffer) retire(e *Entry) {
+	if e.done {
+		return
+	}
+	e.done = true
+	e.segment.live--
+	b.bytes -= int64(len(e.Data))
+	// A closed buffer gave its memory back already
+	if !b.closed {
+		b.opts.Budget.Release(memoryConsumer, int64(len(e.Data)))
+	}
+}
+
+// prune removes the oldest segments while every write in them is done.
+// Segments are removed in order, since a done record may follow its write
+// in a later segment. Must be called with the lock held.
+func (b *Buffer) prune() {
+	for len(b.segments) > 1 && b.segments[0].live == 0 {
+		os.Remove(b.segments[0].path)
+		b.segments = b.segments[1:]
+	}
+}
+
+// Stats returns the buffer's contents and counters
+func (b *Buffer) Stats() Stats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats := b.stats
+	stats.Pending = len(b.pending)
+	stats.InFlight = len(b.inflight)
+	stats.Bytes = b.bytes
+	stats.Segments = len(b.segments)
+	for _, e := range b.pending {
+		if stats.Oldest == 0 || e.Time < stats.Oldest {
+			stats.Oldest = e.Time
+		}
+	}
+	return stats
+}
+
+// Len returns the number of pending writes
+func (b *Buffer) Len() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.pending)
+}
+
+// Close closes the buffer; its pending writes are read back when it is
+// opened again
+func (b *Buffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	b.opts.Budget.Release(memoryConsumer, b.bytes)
+	return b.file.Close()
+}
@@ -1 +1,391 @@
-package api
\ No newline at end of file
+package api
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// FrameMagic marks the start of every frame on the wire ("3FS1")
+const FrameMagic uint32 = 0x33465331
+
+const (
+	// MaxHeaderSize is the largest frame header accepted from a peer
+	MaxHeaderSize = 1 << 20
+	// MaxDataSize is the largest frame payload accepted from a peer
+	MaxDataSize = 64 << 20
+)
+
+const (
+	// AuthorizationHeader is the request header carrying a bearer token
+	AuthorizationHeader = "authorization"
+	// TargetHeader is the request header naming the storage target a
+	// request is meant for, when the node serves several
+	TargetHeader = "target"
+	// RedirectHeader is the response header listing, comma-separated, the
+	// data addresses a redirected request can be retried on
+	RedirectHeader = "redirect"
+	// ChecksumHeader is the write request header carrying the hex SHA-256
+	// of the data, which the node checks before storing it, so that data
+	// corrupted on its way is refused rather than stored
+	ChecksumHeader = "checksum"
+)
+
+// Op identifies the operation carried by a request frame
+type Op uint8
+
+const (
+	// OpRead reads a block
+	OpRead Op = iota + 1
+	// OpWrite writes a block
+	OpWrite
+	// OpDelete deletes a block
+	OpDelete
+	// OpList lists block IDs
+	OpList
+	// OpStat reads a block's metadata
+	OpStat
+	// OpFetch reads a block together with its metadata, for another node
+	// copying it
+	OpFetch
+	// OpHello exchanges protocol versions when a connection is opened
+	OpHello
+	// OpDigest reads a level of the digest tree of a target's chains, for
+	// another node comparing its replicas
+	OpDigest
+)
+
+// String returns the name of the operation
+func (o Op) String() string {
+	switch o {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpDelete:
+		return "delete"
+	case OpList:
+		return "list"
+	case OpStat:
+		return "stat"
+	case OpFetch:
+		return "fetch"
+	case OpHello:
+		return "hello"
+	case OpDigest:
+		return "digest"
+	default:
+		return fmt.Sprintf("op(%d)", uint8(o))
+	}
+}
+
+// Status is the outcome of a request
+type Status uint8
+
+const (
+	// StatusOK indicates the request succeeded
+	StatusOK Status = iota
+	// StatusError indicates the request failed
+	StatusError
+	// StatusBadRequest indicates the request was malformed or unsupported
+	StatusBadRequest
+	// StatusReadOnly indicates a write was rejected because the node is
+	// in read-only mode
+	StatusReadOnly
+	// StatusThrottled indicates the client exceeded its rate limits
+	StatusThrottled
+	// StatusUnauthenticated indicates the client's credentials are missing
+	// or invalid
+	StatusUnauthenticated
+	// StatusForbidden indicates the client may not perform the operation
+	StatusForbidden
+	// StatusRedirect indicates the node is shutting down or draining and
+	// did not carry the request out; it can be retried on the nodes named
+	// in the RedirectHeader
+	StatusRedirect
+	// StatusFenced indicates a write was refused because its fencing
+	// token, or the receiving target, is out of date
+	StatusFenced
+)
+
+// ErrReadOnly is returned for writes rejected by a read-only node
+var ErrReadOnly = errors.New("node is in read-only mode")
+
+// ErrThrottled is returned for requests refused by a client's rate limits
+var ErrThrottled = errors.New("client rate limit exceeded")
+
+// ErrUnauthenticated is returned for requests without valid credentials
+var ErrUnauthenticated = errors.New("authentication required")
+
+// ErrForbidden is returned for requests denied by the node's ACL
+var ErrForbidden = errors.New("operation not permitted")
+
+// RedirectError is returned for a request refused by a node that is
+// shutting down or draining. The request was not carried out and can be
+// retried straight away on one of Addresses, which serve the same data.
+type RedirectError struct {
+	Reason    string
+	Addresses []string
+}
+
+// Error describes the refusal and where to retry
+func (e *RedirectError) Error() string {
+	if len(e.Addresses) == 0 {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s; retry on %s", e.Reason, strings.Join(e.Addresses, ", "))
+}
+
+// RedirectResponse builds the response refusing a request for reason and
+// naming the addresses to retry it on
+func RedirectResponse(reason string, addresses []string) *Response {
+	resp := &Response{Status: StatusRedirect, Error: reason}
+	if len(addresses) > 0 {
+		resp.Headers = map[string]string{RedirectHeader: strings.Join(addresses, ",")}
+	}
+	return resp
+}
+
+// MaxBlockIDLength is the longest block ID accepted
+const MaxBlockIDLength = 255
+
+// ValidateBlockID checks that a block ID is safe to use as a file name:
+// letters, digits, '-', '_', '.' and ':', not starting with a dot
+func ValidateBlockID(blockID string) error {
+	if blockID == "" {
+		return errors.New("block ID is required")
+	}
+	if len(blockID) > MaxBlockIDLength {
+		return fmt.Errorf("block ID longer than %d bytes", MaxBlockIDLength)
+	}
+	if blockID[0] == '.' {
+		return errors.New("block ID cannot start with a dot")
+	}
+	for _, c := range blockID {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.' || c == ':':
+		default:
+			return fmt.Errorf("block ID contains invalid character %q", c)
+		}
+	}
+	return nil
+}
+
+// DefaultNamespace is the namespace of block IDs without a namespace prefix
+const DefaultNamespace = "default"
+
+// NamespaceSeparator separates a block ID's namespace from the rest of it
+const NamespaceSeparator = ":"
+
+// Namespace returns the namespace a block ID belongs to: the part before
+// the first separator, or the default namespace
+func Namespace(blockID string) string {
+	if i := strings.Index(blockID, NamespaceSeparator); i > 0 {
+		return blockID[:i]
+	}
+	return DefaultNamespace
+}
+
+// BlockStat describes a stored block. Checksum is the hex-encoded SHA-256
+// of the block's data.
+type BlockStat struct {
+	Checksum     string `json:"checksum"`
+	Size         int    `json:"size"`
+	Version      int    `json:"version"`
+	CreatedAt    int64  `json:"created_at"`
+	LastModified int64  `json:"last_modified"`
+}
+
+// Request is a client request frame. Data carries the block payload for
+// writes and travels outside the JSON header. Version is the oldest
+// version of the block a fetch accepts.
+type Request struct {
+	ID      uint64            `json:"id"`
+	Op      Op                `json:"op"`
+	BlockID string            `json:"block_id,omitempty"`
+	Prefix  string            `json:"prefix,omitempty"`
+	Version int               `json:"version,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Data    []byte            `json:"-"`
+}
+
+// Response is the reply to a request frame. Data carries the block
+// payload for reads and fetches; a fetch also carries the block's
+// metadata in Stat. A digest carries a tree node's children in Digests,
+// or a leaf's blocks in Entries. A failed request may carry the kind of
+// its error in Code.
+type Response struct {
+	ID      uint64            `json:"id"`
+	Status  Status            `json:"status"`
+	Error   string            `json:"error,omitempty"`
+	Code    ErrorCode         `json:"code,omitempty"`
+	Stat    *BlockStat        `json:"stat,omitempty"`
+	Blocks  []string          `json:"blocks,omitempty"`
+	Digests []string          `json:"digests,omitempty"`
+	Entries []BlockDigest     `json:"entries,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+	Data    []byte            `json:"-"`
+}
+
+// Err returns the response's error, or nil if the request succeeded
+func (r *Response) Err() error {
+	switch r.Status {
+	case StatusOK:
+		return nil
+	case StatusReadOnly:
+		return ErrReadOnly
+	case StatusThrottled:
+		if r.Code == CodeQuotaExceeded {
+			return fmt.Errorf("%w: %w", ErrThrottled, &Error{Code: r.Code, Message: r.Error})
+		}
+		return ErrThrottled
+	case StatusUnauthenticated:
+		return ErrUnauthenticated
+	case StatusForbidden:
+		return ErrForbidden
+	case StatusRedirect:
+		redirect := &RedirectError{Reason: r.Error}
+		if addresses := r.Headers[RedirectHeader]; addresses != "" {
+			redirect.Addresses = strings.Split(addresses, ",")
+		}
+		return redirect
+	case StatusFenced:
+		return fmt.Errorf("%w: %s", ErrFenced, r.Error)
+	}
+	if r.Code != "" {
+		return &Error{Code: r.Code, Message: r.Error}
+	}
+	if r.Error == "" {
+		return fmt.Errorf("request failed with status %d", r.Status)
+	}
+	return errors.New(r.Error)
+}
+
+// WriteFrame writes a frame consisting of a JSON header and a raw payload:
+//
+//	magic (u32) | header length (u32) | data length (u32) | header | data
+func WriteFrame(w io.Writer, header interface{}, data []byte) error {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return fmt.Errorf("failed to marshal frame header: %w", err)
+	}
+
+	if len(headerBytes) > MaxHeaderSize {
+		return fmt.Errorf("frame header of %d bytes exceeds limit", len(headerBytes))
+	}
+	if len(data) > MaxDataSize {
+		return fmt.Errorf("frame data of %d bytes exceeds limit", len(data))
+	}
+
+	var prefix [12]byte
+	binary.BigEndian.PutUint32(prefix[0:4], FrameMagic)
+	binary.BigEndian.PutUint32(prefix[4:8], uint32(len(headerBytes)))
+	binary.BigEndian.PutUint32(prefix[8:12], uint32(len(data)))
+
+	if _, err := w.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := w.Write(headerBytes); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ReadFrame reads a frame, decoding its header into header and returning
+// the payload. It returns io.EOF if the stream ends cleanly between frames.
+func ReadFrame(r io.Reader, header interface{}) ([]byte, error) {
+	dataLen, err := ReadFrameHeader(r, header)
+	if err != nil {
+		return nil, err
+	}
+	return ReadFrameData(r, dataLen)
+}
+
+// ReadFrameHeader reads the start of a frame, decoding its header into
+// header, and returns the length of the payload that follows, which the
+// caller must read with ReadFrameData or skip. It returns io.EOF if the
+// stream ends cleanly between frames.
+func ReadFrameHeader(r io.Reader, header interface{}) (int, error) {
+	var prefix [12]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return 0, err
+	}
+
+	if magic := binary.BigEndian.Uint32(prefix[0:4]); magic != FrameMagic {
+		return 0, fmt.Errorf("invalid frame magic %#x", magic)
+	}
+
+	headerLen := binary.BigEndian.Uint32(prefix[4:8])
+	dataLen := binary.BigEndian.Uint32(prefix[8:12])
+	if headerLen > MaxHeaderSize {
+		return 0, fmt.Errorf("frame header of %d bytes exceeds limit", headerLen)
+	}
+	if dataLen > MaxDataSize {
+		return 0, fmt.Errorf("frame data of %d bytes exceeds limit", dataLen)
+	}
+
+	headerBytes := make([]byte, headerLen)
+	if _, err := io.ReadFull(r, headerBytes); err != nil {
+		return 0, fmt.Errorf("failed to read frame header: %w", err)
+	}
+	if err := json.Unmarshal(headerBytes, header); err != nil {
+		return 0, fmt.Errorf("failed to unmarshal frame header: %w", err)
+	}
+
+	return int(dataLen), nil
+}
+
+// ReadFrameData reads the payload of dataLen bytes that follows a frame's
+// header
+func ReadFrameData(r io.Reader, dataLen int) ([]byte, error) {
+	if dataLen == 0 {
+		return nil, nil
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("failed to read frame data: %w", err)
+	}
+	return data, nil
+}
+
+// WriteRequest writes a request frame
+func WriteRequest(w io.Writer, req *Request) error {
+	return WriteFrame(w, req, req.Data)
+}
+
+// ReadRequest reads a request frame
+func ReadRequest(r io.Reader) (*Request, error) {
+	var req Request
+	data, err := ReadFrame(r, &req)
+	if err != nil {
+		return nil, err
+	}
+	req.Data = data
+	return &req, nil
+}
+
+// WriteResponse writes a response frame
+func WriteResponse(w io.Writer, resp *Response) error {
+	return WriteFrame(w, resp, resp.Data)
+}
+
+// ReadResponse reads a response frame
+func ReadResponse(r io.Reader) (*Response, error) {
+	var resp Response
+	data, err := ReadFrame(r, &resp)
+	if err != nil {
+		return nil, err
+	}
+	resp.Data = data
+	return &resp, nil
+}
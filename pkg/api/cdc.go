@@ -0,0 +1,41 @@
+package api
+
+// CDCPath is the admin API path serving a node's change log
+const CDCPath = "/v1/cdc"
+
+// CDCEnd is the resume token of the end of a change log, skipping the
+// records already in it
+const CDCEnd = "end"
+
+// Operations of change records
+const (
+	// ChangeCreate records a block written for the first time
+	ChangeCreate = "create"
+	// ChangeUpdate records a block overwritten with a new version
+	ChangeUpdate = "update"
+	// ChangeDelete records a deleted block
+	ChangeDelete = "delete"
+)
+
+// ChangeRecord is a committed mutation of a block in a node's change log.
+// Offset numbers the records of the log from 1, and only grows; Time is in
+// Unix nanoseconds.
+type ChangeRecord struct {
+	Offset   uint64 `json:"offset"`
+	Op       string `json:"op"`
+	BlockID  string `json:"block_id"`
+	Target   string `json:"target,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Time     int64  `json:"time"`
+}
+
+// ChangeBatch is a page of a node's change log. Next is the resume token
+// to read the records following the batch with, and Oldest the offset of
+// the oldest record the log still holds.
+type ChangeBatch struct {
+	Records []ChangeRecord `json:"records"`
+	Next    string         `json:"next"`
+	Oldest  uint64         `json:"oldest"`
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Digest trees let two nodes compare their copies of a target's chains
+// without listing every block. The leaves are the storage shards, each
+// digesting the blocks it holds; the shards are grouped by their first hex
+// digit under the root. A node compares the 16 group digests, then the 16
+// shard digests of each group that differs, and lists only the shards that
+// differ.
+const (
+	// DigestFanout is the number of children of each inner node of a
+	// digest tree
+	DigestFanout = 16
+	// DigestShards is the number of leaves of a digest tree
+	DigestShards = DigestFanout * DigestFanout
+)
+
+// ChainsHeader is the digest request header listing, comma-separated, the
+// IDs of the chains whose blocks are digested
+const ChainsHeader = "chains"
+
+// BlockDigest identifies the copy of a block held in a digest tree leaf
+type BlockDigest struct {
+	BlockID  string `json:"block_id"`
+	Version  int    `json:"version"`
+	Checksum string `json:"checksum"`
+}
+
+// Sum returns the hash the block contributes to its leaf's digest. A
+// leaf's digest is the XOR of its blocks' hashes, so that it does not
+// depend on their order and the digests of several chains' blocks combine.
+func (d BlockDigest) Sum() [sha256.Size]byte {
+	return sha256.Sum256([]byte(d.BlockID + "\x00" + strconv.Itoa(d.Version) + "\x00" + d.Checksum))
+}
+
+// EncodeChains formats chain IDs for the ChainsHeader
+func EncodeChains(chains []uint32) string {
+	ids := make([]string, len(chains))
+	for i, id := range chains {
+		ids[i] = strconv.FormatUint(uint64(id), 10)
+	}
+	return strings.Join(ids, ",")
+}
+
+// ParseChains parses the chain IDs of a ChainsHeader
+func ParseChains(value string) ([]uint32, error) {
+	if value == "" {
+		return nil, nil
+	}
+	fields := strings.Split(value, ",")
+	chains := make([]uint32, len(fields))
+	for i, field := range fields {
+		id, err := strconv.ParseUint(field, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid chain ID %q", field)
+		}
+		chains[i] = uint32(id)
+	}
+	return chains, nil
+}
+
+// ParseDigestPath parses the path of a digest tree node, carried in a
+// digest request's prefix: "" for the root, one hex digit for a group, or
+// two for a shard. It returns the node's depth and index within its level.
+func ParseDigestPath(path string) (depth, index int, err error) {
+	if path == "" {
+		return 0, 0, nil
+	}
+	if len(path) > 2 {
+		return 0, 0, fmt.Errorf("invalid digest path %q", path)
+	}
+	n, err := strconv.ParseUint(path, 16, 8)
+	if err != nil || strings.ToLower(path) != path {
+		return 0, 0, fmt.Errorf("invalid digest path %q", path)
+	}
+	return len(path), int(n), nil
+}
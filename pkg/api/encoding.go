@@ -0,0 +1,71 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// EncodingHeader is the write request header naming how the request's data
+// was compressed on its way. The node decompresses it before anything else
+// looks at the data, so the checksum header is that of the data itself.
+const EncodingHeader = "encoding"
+
+// EncodingDeflate is data compressed with DEFLATE (RFC 1951)
+const EncodingDeflate = "deflate"
+
+// Compress compresses data with DEFLATE, for a write carrying it with
+// EncodingDeflate. It reports false when compressing does not make the
+// data smaller, and the data is best sent as it is.
+func Compress(data []byte) ([]byte, bool, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, false, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, false, fmt.Errorf("failed to compress data: %w", err)
+	}
+	if buf.Len() >= len(data) {
+		return nil, false, nil
+	}
+	return buf.Bytes(), true, nil
+}
+
+// Decompress restores data compressed with an encoding, refusing data that
+// expands past MaxDataSize
+func Decompress(encoding string, data []byte) ([]byte, error) {
+	if encoding != EncodingDeflate {
+		return nil, fmt.Errorf("unsupported encoding %q", encoding)
+	}
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	decoded, err := io.ReadAll(io.LimitReader(r, MaxDataSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress data: %w", err)
+	}
+	if len(decoded) > MaxDataSize {
+		return nil, fmt.Errorf("decompressed data is larger than %d bytes", MaxDataSize)
+	}
+	return decoded, nil
+}
+
+// DecodeData replaces the data of a request sent compressed with the data
+// itself, dropping the encoding header
+func (r *Request) DecodeData() error {
+	encoding, ok := r.Headers[EncodingHeader]
+	if !ok {
+		return nil
+	}
+	data, err := Decompress(encoding, r.Data)
+	if err != nil {
+		return err
+	}
+	r.Data = data
+	delete(r.Headers, EncodingHeader)
+	return nil
+}
@@ -0,0 +1,103 @@
+package api
+
+import (
+	"errors"
+	"syscall"
+)
+
+// ErrorCode identifies the kind of a failed request, carried in the
+// response next to the error's message so that clients can branch on it.
+// Nodes that predate codes send none, and their errors are only messages.
+type ErrorCode string
+
+const (
+	// CodeNotFound is the code of ErrNotFound
+	CodeNotFound ErrorCode = "not_found"
+	// CodeVersionConflict is the code of ErrVersionConflict
+	CodeVersionConflict ErrorCode = "version_conflict"
+	// CodeNoSpace is the code of ErrNoSpace
+	CodeNoSpace ErrorCode = "no_space"
+	// CodeQuotaExceeded is the code of ErrQuotaExceeded
+	CodeQuotaExceeded ErrorCode = "quota_exceeded"
+	// CodeReadOnly is the code of ErrReadOnly
+	CodeReadOnly ErrorCode = "read_only"
+	// CodeBackpressure is the code of ErrBackpressure
+	CodeBackpressure ErrorCode = "backpressure"
+	// CodeCorrupted is the code of ErrCorrupted
+	CodeCorrupted ErrorCode = "corrupted"
+)
+
+var (
+	// ErrNotFound is returned for a block that does not exist
+	ErrNotFound = errors.New("not found")
+	// ErrVersionConflict is returned when a block is not at the version a
+	// request needs, such as a fetch of a copy older than it accepts
+	ErrVersionConflict = errors.New("version conflict")
+	// ErrNoSpace is returned for a write the target has no space left for
+	ErrNoSpace = errors.New("no space left on the storage target")
+	// ErrQuotaExceeded is returned when a client is over one of its
+	// limits, such as its number of connections
+	ErrQuotaExceeded = errors.New("quota exceeded")
+	// ErrBackpressure is returned for a request the node was too busy to
+	// carry out in time; it can be retried after backing off
+	ErrBackpressure = errors.New("node is overloaded")
+	// ErrCorrupted is returned for data that failed checksum verification
+	ErrCorrupted = errors.New("data failed checksum verification")
+)
+
+// codeErrors maps each code to its error, in the order CodeOf tries them
+var codeErrors = []struct {
+	code ErrorCode
+	err  error
+}{
+	{CodeNotFound, ErrNotFound},
+	{CodeVersionConflict, ErrVersionConflict},
+	{CodeNoSpace, ErrNoSpace},
+	{CodeQuotaExceeded, ErrQuotaExceeded},
+	{CodeReadOnly, ErrReadOnly},
+	{CodeBackpressure, ErrBackpressure},
+	{CodeCorrupted, ErrCorrupted},
+}
+
+// CodeOf returns the code of an error's kind, or an empty code if it is
+// of none. A disk running out of space counts as ErrNoSpace.
+func CodeOf(err error) ErrorCode {
+	for _, ce := range codeErrors {
+		if errors.Is(err, ce.err) {
+			return ce.code
+		}
+	}
+	if errors.Is(err, syscall.ENOSPC) {
+		return CodeNoSpace
+	}
+	return ""
+}
+
+// Error is an error a node sent with a code. It matches the code's error
+// with errors.Is, and reads as the node's message.
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Error returns the node's message
+func (e *Error) Error() string {
+	if e.Message == "" {
+		if err := e.Unwrap(); err != nil {
+			return err.Error()
+		}
+		return string(e.Code)
+	}
+	return e.Message
+}
+
+// Unwrap returns the error of the code, or nil for a code this version
+// does not know
+func (e *Error) Unwrap() error {
+	for _, ce := range codeErrors {
+		if ce.code == e.Code {
+			return ce.err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,70 @@
+package api
+
+// EventsPath is the admin API path streaming a node's block events
+const EventsPath = "/v1/events"
+
+// Types of block events
+const (
+	// EventCreated reports a block written for the first time
+	EventCreated = "created"
+	// EventUpdated reports a block overwritten with a new version
+	EventUpdated = "updated"
+	// EventDeleted reports a deleted block
+	EventDeleted = "deleted"
+	// EventDropped reports that events were lost because the subscriber
+	// read them too slowly; Count says how many
+	EventDropped = "dropped"
+)
+
+// BlockEvent is a change to a block stored on a node. The event stream
+// sends one per line as JSON. Seq numbers the node's events since it
+// started, so that gaps show events a subscriber missed. Time is in Unix
+// nanoseconds.
+type BlockEvent struct {
+	Seq      uint64 `json:"seq"`
+	Type     string `json:"type"`
+	BlockID  string `json:"block_id,omitempty"`
+	Target   string `json:"target,omitempty"`
+	Version  int    `json:"version,omitempty"`
+	Size     int    `json:"size,omitempty"`
+	Checksum string `json:"checksum,omitempty"`
+	Time     int64  `json:"time"`
+	Count    int    `json:"count,omitempty"`
+}
+
+// Types of cluster events
+const (
+	// ClusterEventNodeFailed reports a node marked down
+	ClusterEventNodeFailed = "node.failed"
+	// ClusterEventChainReconfigured reports a chain whose members changed
+	ClusterEventChainReconfigured = "chain.reconfigured"
+	// ClusterEventBlockCorrupted reports a stored block that failed
+	// checksum verification
+	ClusterEventBlockCorrupted = "block.corrupted"
+	// ClusterEventQuotaBreached reports a client held back by its limits
+	ClusterEventQuotaBreached = "quota.breached"
+	// ClusterEventDrainCompleted reports a node done migrating its data off
+	ClusterEventDrainCompleted = "drain.completed"
+)
+
+// ClusterEventTypes lists the types of cluster events
+var ClusterEventTypes = []string{
+	ClusterEventNodeFailed,
+	ClusterEventChainReconfigured,
+	ClusterEventBlockCorrupted,
+	ClusterEventQuotaBreached,
+	ClusterEventDrainCompleted,
+}
+
+// ClusterEvent is a change in the cluster that automation may react to,
+// sent to the event sinks as JSON. ID is unique to the event, so that a
+// sink that is sent it twice can tell; Source is the node that published
+// it, and Details depend on the type. Time is in Unix nanoseconds.
+type ClusterEvent struct {
+	ID      string            `json:"id"`
+	Type    string            `json:"type"`
+	Time    int64             `json:"time"`
+	Source  string            `json:"source"`
+	Message string            `json:"message"`
+	Details map[string]string `json:"details,omitempty"`
+}
@@ -0,0 +1,45 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// FenceHeader is the request header carrying the fencing token of a write
+// one node sends another
+const FenceHeader = "fence"
+
+// ErrFenced is returned for writes refused because the sender, or the
+// receiving target, has been fenced off by the coordinator
+var ErrFenced = errors.New("write fenced")
+
+// FencingToken identifies the node record a write between nodes comes
+// from, and the epoch the coordinator last issued that record. The
+// coordinator issues a record a new, higher epoch whenever it is declared
+// down, comes back up or rejoins, so a process that lingers from before
+// carries an epoch older than the routing table's and its writes are
+// refused.
+type FencingToken struct {
+	NodeID string
+	Epoch  uint64
+}
+
+// String encodes the token for the FenceHeader
+func (t FencingToken) String() string {
+	return t.NodeID + ":" + strconv.FormatUint(t.Epoch, 10)
+}
+
+// ParseFencingToken decodes a token from the FenceHeader
+func ParseFencingToken(value string) (FencingToken, error) {
+	i := strings.LastIndex(value, ":")
+	if i <= 0 {
+		return FencingToken{}, fmt.Errorf("invalid fencing token %q", value)
+	}
+	epoch, err := strconv.ParseUint(value[i+1:], 10, 64)
+	if err != nil {
+		return FencingToken{}, fmt.Errorf("invalid fencing token %q", value)
+	}
+	return FencingToken{NodeID: value[:i], Epoch: epoch}, nil
+}
@@ -0,0 +1,400 @@
+package api
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/3fs-storage/internal/ring"
+)
+
+// NodeState is the coordinator's view of a storage node
+type NodeState string
+
+const (
+	// NodeStateUp is a node that serves its chains
+	NodeStateUp NodeState = "up"
+	// NodeStateDown is a node that has failed or been removed from service
+	NodeStateDown NodeState = "down"
+	// NodeStateDraining is a node being decommissioned. It keeps its chain
+	// memberships while its data is migrated but receives no new ones.
+	NodeStateDraining NodeState = "draining"
+)
+
+// NodeRecord describes a storage node in the routing table. A node with
+// several storage targets has one record per target, each naming the node
+// that serves it. Suspect is set while the coordinator's failure detector
+// suspects the node of failing; a node that is down and suspect was marked
+// down by the detector rather than by an operator. Epoch is the record's
+// fencing epoch, renewed whenever the node is declared down, comes back up
+// or rejoins.
+type NodeRecord struct {
+	ID            string    `json:"id"`
+	Node          string    `json:"node,omitempty"`
+	Address       string    `json:"address"`
+	AdminAddress  string    `json:"admin_address,omitempty"`
+	Zone          string    `json:"zone,omitempty"`
+	Rack          string    `json:"rack,omitempty"`
+	Hostname      string    `json:"host,omitempty"`
+	State         NodeState `json:"state"`
+	Suspect       bool      `json:"suspect,omitempty"`
+	CapacityBytes int64     `json:"capacity_bytes,omitempty"`
+	Epoch         uint64    `json:"epoch,omitempty"`
+	UpdatedAt     int64     `json:"updated_at"`
+	// Labels describe the node to placement rules, such as media: nvme
+	Labels map[string]string `json:"labels,omitempty"`
+	// NearlyFull is set while the node reports using more of its capacity
+	// than the coordinator's balance policy allows; it gets new chain
+	// members and object blocks only when no other node can take them
+	NearlyFull bool `json:"nearly_full,omitempty"`
+	// Role is RoleStorage or RoleCache; records from before roles were
+	// recorded are storage
+	Role string `json:"role,omitempty"`
+}
+
+// Roles of a node
+const (
+	// RoleStorage is a node holding chain replicas
+	RoleStorage = "storage"
+	// RoleCache is a node holding no replicas, which is never made a chain
+	// member but serves reads of the blocks it caches
+	RoleCache = "cache"
+)
+
+// IsCache reports whether the record is of a cache node
+func (r *NodeRecord) IsCache() bool {
+	return r.Role == RoleCache
+}
+
+// Host returns the machine serving the record: its host label, or else the
+// ID of the storage node serving it
+func (r *NodeRecord) Host() string {
+	if r.Hostname != "" {
+		return r.Hostname
+	}
+	if r.Node != "" {
+		return r.Node
+	}
+	return r.ID
+}
+
+// Healthy reports whether the node is up and not suspected of failing
+func (r *NodeRecord) Healthy() bool {
+	return r.State == NodeStateUp && !r.Suspect
+}
+
+// ChainRecord describes a replication chain. Members are node IDs ordered
+// from head to tail.
+type ChainRecord struct {
+	ID      uint32   `json:"id"`
+	Members []string `json:"members"`
+	Version uint64   `json:"version"`
+	// Namespace is set on the chains of a namespace with a replication
+	// policy of its own; other chains are shared by every namespace
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// Head returns the node ID at the head of the chain
+func (c *ChainRecord) Head() string {
+	if len(c.Members) == 0 {
+		return ""
+	}
+	return c.Members[0]
+}
+
+// Tail returns the node ID at the tail of the chain
+func (c *ChainRecord) Tail() string {
+	if len(c.Members) == 0 {
+		return ""
+	}
+	return c.Members[len(c.Members)-1]
+}
+
+// RoutingTable is the cluster layout distributed by the coordinator. Its
+// version increases with every change, so holders can tell whether their
+// copy is stale. Epoch is the last fencing epoch the coordinator issued;
+// epochs are never reused, across all records.
+type RoutingTable struct {
+	Version uint64                 `json:"version"`
+	Epoch   uint64                 `json:"epoch,omitempty"`
+	Nodes   map[string]*NodeRecord `json:"nodes"`
+	Chains  []*ChainRecord         `json:"chains"`
+	// Policies are the replication policies of namespaces that do not
+	// follow the cluster's, by namespace
+	Policies map[string]*ReplicationPolicy `json:"policies,omitempty"`
+	// Hashing is how blocks map to chains, fixed when the table is created;
+	// tables from before it was recorded map blocks by modulo
+	Hashing string `json:"hashing,omitempty"`
+
+	// rings are the chain rings of a ring-hashed table, built on first use
+	rings atomic.Pointer[chainRings]
+}
+
+// Hashings of a routing table
+const (
+	// HashingModulo maps a block to one of its chains by its hash modulo
+	// the number of chains, remapping nearly every block when chains are
+	// added
+	HashingModulo = "modulo"
+	// HashingRing maps a block to its chains by consistent hashing, so
+	// that added chains only take over their share of the blocks
+	HashingRing = "ring"
+)
+
+// chainRingVirtualNodes is the number of points of each chain on a chain
+// ring. Every holder of a table has to map blocks the same way, so it must
+// never change.
+const chainRingVirtualNodes = 128
+
+// chainRings are the consistent-hash rings of a table's chains by
+// namespace, "" holding the shared chains, and the version of the table
+// they were built from. Chains all weigh the same: a chain's share of the
+// blocks must not change with its members, or blocks would move without
+// their data.
+type chainRings struct {
+	version uint64
+	count   int
+	rings   map[string]*ring.Ring
+	chains  map[string]*ChainRecord
+}
+
+// ringFor returns the chain ring of a namespace, rebuilding the table's
+// rings when the table changed since they were built
+func (t *RoutingTable) ringFor(namespace string) (*ring.Ring, map[string]*ChainRecord) {
+	rings := t.rings.Load()
+	if rings == nil || rings.version != t.Version || rings.count != len(t.Chains) {
+		members := make(map[string][]ring.Member)
+		rings = &chainRings{
+			version: t.Version,
+			count:   len(t.Chains),
+			rings:   make(map[string]*ring.Ring),
+			chains:  make(map[string]*ChainRecord, len(t.Chains)),
+		}
+		for _, chain := range t.Chains {
+			id := strconv.FormatUint(uint64(chain.ID), 10)
+			members[chain.Namespace] = append(members[chain.Namespace], ring.Member{ID: id, Weight: 1})
+			rings.chains[id] = chain
+		}
+		for ns, m := range members {
+			rings.rings[ns] = ring.New(chainRingVirtualNodes, m)
+		}
+		t.rings.Store(rings)
+	}
+	return rings.rings[namespace], rings.chains
+}
+
+// Consistency levels of a replication policy
+const (
+	// ConsistencyEventual acknowledges a write once the target it reaches
+	// stores it; repair copies it to the other members of its chain
+	ConsistencyEventual = "eventual"
+	// ConsistencyStrong acknowledges a write only once the members of its
+	// chain needed for the replication factor store it too
+	ConsistencyStrong = "strong"
+)
+
+// ReplicationPolicy is how the blocks of a namespace are replicated
+type ReplicationPolicy struct {
+	// Factor is the number of replicas repair keeps of each block
+	Factor int `json:"factor"`
+	// ChainLength is the number of members of each of the namespace's
+	// chains
+	ChainLength int `json:"chain_length"`
+	// Consistency is eventual or strong
+	Consistency string `json:"consistency"`
+	// Erasure, when set, erasure codes the namespace's blocks across the
+	// members of their chains instead of replicating them; Factor and
+	// Consistency then do not apply
+	Erasure *ErasurePolicy `json:"erasure,omitempty"`
+}
+
+// ErasurePolicy is how the blocks of an erasure-coded namespace are
+// coded. Each block is split into Data shards plus Parity shards computed
+// from them, shard i being kept by member i of the block's chain, and any
+// Data of the shards rebuild the block.
+type ErasurePolicy struct {
+	Data   int `json:"data"`
+	Parity int `json:"parity"`
+}
+
+// ShardSeparator separates an erasure-coded block's ID from the index of
+// one of its shards in the shard's block ID
+const ShardSeparator = "..ec"
+
+// ShardBlockID returns the ID under which a member keeps shard index of an
+// erasure-coded block
+func ShardBlockID(blockID string, index int) string {
+	return blockID + ShardSeparator + strconv.Itoa(index)
+}
+
+// ParseShardBlockID splits a shard's block ID into the ID of its block and
+// its index, reporting false for an ID that does not name a shard
+func ParseShardBlockID(shardID string) (string, int, bool) {
+	i := strings.LastIndex(shardID, ShardSeparator)
+	if i <= 0 {
+		return "", 0, false
+	}
+	digits := shardID[i+len(ShardSeparator):]
+	index, err := strconv.Atoi(digits)
+	if err != nil || index < 0 || strconv.Itoa(index) != digits {
+		return "", 0, false
+	}
+	return shardID[:i], index, true
+}
+
+// Erasure returns the erasure coding of a namespace, or nil if its blocks
+// are replicated
+func (t *RoutingTable) Erasure(namespace string) *ErasurePolicy {
+	if policy := t.Policy(namespace); policy != nil {
+		return policy.Erasure
+	}
+	return nil
+}
+
+// Policy returns the replication policy of a namespace, or nil if the
+// namespace follows the cluster's
+func (t *RoutingTable) Policy(namespace string) *ReplicationPolicy {
+	return t.Policies[namespace]
+}
+
+// ChainForBlock returns the chain responsible for a block: one of its
+// namespace's chains if the namespace has any, and otherwise one of the
+// shared chains, picked as the table's hashing says. The shards of an
+// erasure-coded block map to the block's chain.
+func (t *RoutingTable) ChainForBlock(blockID string) *ChainRecord {
+	namespace := Namespace(blockID)
+	if t.Erasure(namespace) != nil {
+		if base, _, ok := ParseShardBlockID(blockID); ok {
+			blockID = base
+		}
+	}
+	namespace = t.chainNamespace(namespace)
+	count := t.countChains(namespace)
+	if count == 0 {
+		return nil
+	}
+
+	if t.Hashing == HashingRing {
+		r, chains := t.ringFor(namespace)
+		id, ok := r.Locate(blockID)
+		if !ok {
+			return nil
+		}
+		return chains[id]
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(blockID))
+	n := int(h.Sum32() % uint32(count))
+	for _, chain := range t.Chains {
+		if chain.Namespace != namespace {
+			continue
+		}
+		if n == 0 {
+			return chain
+		}
+		n--
+	}
+	return nil
+}
+
+// NearlyFull reports whether a member of a chain is nearly full
+func (t *RoutingTable) NearlyFull(chain *ChainRecord) bool {
+	for _, id := range chain.Members {
+		if node, ok := t.Nodes[id]; ok && node.NearlyFull {
+			return true
+		}
+	}
+	return false
+}
+
+// ChainsFor returns the chains a block may map to, in table order: its
+// namespace's chains if the namespace has any, and otherwise the shared
+// chains
+func (t *RoutingTable) ChainsFor(blockID string) []*ChainRecord {
+	namespace := t.chainNamespace(Namespace(blockID))
+	chains := make([]*ChainRecord, 0, t.countChains(namespace))
+	for _, chain := range t.Chains {
+		if chain.Namespace == namespace {
+			chains = append(chains, chain)
+		}
+	}
+	return chains
+}
+
+// chainNamespace returns the namespace whose chains hold the blocks of a
+// namespace: itself if it has a policy and chains of its own, and
+// otherwise "" for the shared chains
+func (t *RoutingTable) chainNamespace(namespace string) string {
+	if t.Policy(namespace) == nil || t.countChains(namespace) == 0 {
+		return ""
+	}
+	return namespace
+}
+
+// countChains counts the chains of a namespace, "" counting the shared
+// chains
+func (t *RoutingTable) countChains(namespace string) int {
+	count := 0
+	for _, chain := range t.Chains {
+		if chain.Namespace == namespace {
+			count++
+		}
+	}
+	return count
+}
+
+// NodeAddress returns the data address of a node, or "" if it is unknown
+func (t *RoutingTable) NodeAddress(nodeID string) string {
+	if node, ok := t.Nodes[nodeID]; ok {
+		return node.Address
+	}
+	return ""
+}
+
+// ChainUsage is the data a node holds for one chain, or one namespace
+type ChainUsage struct {
+	Bytes  int64 `json:"bytes"`
+	Blocks int   `json:"blocks"`
+}
+
+// NodeUsage is the data a node holds, in total, per chain and per
+// namespace
+type NodeUsage struct {
+	NodeID       string                `json:"node_id"`
+	TableVersion uint64                `json:"table_version"`
+	Bytes        int64                 `json:"bytes"`
+	Blocks       int                   `json:"blocks"`
+	Chains       map[uint32]ChainUsage `json:"chains"`
+	Namespaces   map[string]ChainUsage `json:"namespaces"`
+}
+
+// Heartbeat is a node's periodic report of its capacity and load
+type Heartbeat struct {
+	NodeID        string `json:"node_id"`
+	Timestamp     int64  `json:"timestamp"`
+	TableVersion  uint64 `json:"table_version"`
+	CapacityBytes int64  `json:"capacity_bytes"`
+	UsedBytes     int64  `json:"used_bytes"`
+	FreeBytes     int64  `json:"free_bytes"`
+	// IOUtilization is the fraction of the IO scheduler's slots in use
+	IOUtilization float64 `json:"io_utilization"`
+	// QueueDepth is the number of requests waiting for the IO scheduler
+	QueueDepth int `json:"queue_depth"`
+	// RequestRate and ErrorRate are per second over the last interval
+	RequestRate float64 `json:"request_rate"`
+	ErrorRate   float64 `json:"error_rate"`
+	// WriteRate is the bytes per second written to the node over the last
+	// interval
+	WriteRate float64 `json:"write_rate,omitempty"`
+	// ProtocolVersion and SoftwareVersion identify the node's build; nodes
+	// that predate them report neither and speak protocol 1
+	ProtocolVersion int    `json:"protocol_version,omitempty"`
+	SoftwareVersion string `json:"software_version,omitempty"`
+	// Commit is the source revision of the node's build, and Features the
+	// feature flags it enables, so that nodes built or configured apart
+	// from the rest of the cluster can be found
+	Commit   string   `json:"commit,omitempty"`
+	Features []string `json:"features,omitempty"`
+}
@@ -0,0 +1,45 @@
+package api
+
+// NamespaceUsage is the use a namespace made of the cluster. The request
+// and byte counts are since a point in time: the start of a node for the
+// reports nodes send, or the start of a window for the coordinator's
+// aggregates. StoredBytes and Blocks are what the namespace held when
+// last measured, counting every replica.
+type NamespaceUsage struct {
+	StoredBytes int64 `json:"stored_bytes"`
+	Blocks      int64 `json:"blocks"`
+	// Requests counts every request, and Reads, Writes and Deletes the
+	// requests of each kind among them
+	Requests int64 `json:"requests"`
+	Reads    int64 `json:"reads"`
+	Writes   int64 `json:"writes"`
+	Deletes  int64 `json:"deletes"`
+	// BytesIn is the data clients sent, and BytesOut the data they were
+	// sent
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// Add adds the request and byte counts of another usage
+func (u *NamespaceUsage) Add(other *NamespaceUsage) {
+	u.Requests += other.Requests
+	u.Reads += other.Reads
+	u.Writes += other.Writes
+	u.Deletes += other.Deletes
+	u.BytesIn += other.BytesIn
+	u.BytesOut += other.BytesOut
+}
+
+// UsageReport is what a node reports of the use of each namespace since it
+// started. The counts only grow while the node runs, so that a report lost
+// on the way to the coordinator is made up for by the next one.
+type UsageReport struct {
+	Node string `json:"node"`
+	// StartedAt is when the node started counting, Timestamp when the
+	// report was made, and MeasuredAt when the stored bytes were last
+	// measured, zero until they were, in Unix nanoseconds
+	StartedAt  int64                      `json:"started_at"`
+	Timestamp  int64                      `json:"timestamp"`
+	MeasuredAt int64                      `json:"measured_at,omitempty"`
+	Namespaces map[string]*NamespaceUsage `json:"namespaces"`
+}
@@ -0,0 +1,72 @@
+package api
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// ProtocolVersion is the version of the wire protocol spoken by this
+// build. It increases whenever an operation or frame field is added that
+// an older node would not understand.
+//
+// Version 1 is the original protocol. Version 2 adds the hello handshake,
+// block fetches and the protocol header. Version 3 adds fencing tokens on
+// writes between nodes and the fenced status. Version 4 adds digests.
+// Version 5 adds compressed write data.
+const ProtocolVersion = 5
+
+// MinProtocolVersion is the oldest protocol version this build still
+// speaks. A cluster can be upgraded one node at a time as long as every
+// node's version lies within [MinProtocolVersion, ProtocolVersion] of the
+// others; each connection uses the lower version of its two ends.
+const MinProtocolVersion = 1
+
+// ProtocolFetch is the first protocol version with OpFetch
+const ProtocolFetch = 2
+
+// ProtocolDigest is the first protocol version with OpDigest
+const ProtocolDigest = 4
+
+// ProtocolCompression is the first protocol version whose writes may carry
+// compressed data
+const ProtocolCompression = 5
+
+// ProtocolHeader is the request and response header carrying the sender's
+// protocol version. Peers that send none speak version 1.
+const ProtocolHeader = "protocol"
+
+// VersionHeader is the hello response header carrying the node's software
+// version
+const VersionHeader = "version"
+
+// HeaderProtocol returns the protocol version announced in headers, or 1
+// if there is none
+func HeaderProtocol(headers map[string]string) (int, error) {
+	value, ok := headers[ProtocolHeader]
+	if !ok {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid protocol version %q", value)
+	}
+	return version, nil
+}
+
+// CheckProtocol reports whether a peer speaking version can talk to this
+// build
+func CheckProtocol(version int) error {
+	if version < MinProtocolVersion {
+		return fmt.Errorf("protocol version %d is older than the oldest supported, %d", version, MinProtocolVersion)
+	}
+	return nil
+}
+
+// NegotiateProtocol returns the protocol version used with a peer
+// speaking version: the lower of the two
+func NegotiateProtocol(version int) int {
+	if version < ProtocolVersion {
+		return version
+	}
+	return ProtocolVersion
+}
@@ -0,0 +1,128 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReadPolicy says which member of a block's chain a Cluster reads from
+type ReadPolicy int
+
+const (
+	// ReadTail reads from the tail, where CRAQ commits, so that a read
+	// never sees a write that is still being replicated
+	ReadTail ReadPolicy = iota
+	// ReadRoundRobin spreads reads across every healthy member in turn
+	ReadRoundRobin
+	// ReadLeastLatency reads from the member that has answered fastest
+	// lately
+	ReadLeastLatency
+)
+
+// String returns the name of the policy
+func (p ReadPolicy) String() string {
+	switch p {
+	case ReadTail:
+		return "tail"
+	case ReadRoundRobin:
+		return "round-robin"
+	case ReadLeastLatency:
+		return "least-latency"
+	default:
+		return fmt.Sprintf("policy(%d)", int(p))
+	}
+}
+
+// ParseReadPolicy parses a policy's name
+func ParseReadPolicy(name string) (ReadPolicy, error) {
+	for _, p := range []ReadPolicy{ReadTail, ReadRoundRobin, ReadLeastLatency} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown read policy %q: use tail, round-robin or least-latency", name)
+}
+
+const (
+	// latencyWeight is the weight of the latest read in a member's moving
+	// average
+	latencyWeight = 0.2
+	// failurePenalty is the latency a read that could not reach its member
+	// counts as, so that an unreachable member is read from less
+	failurePenalty = time.Second
+	// exploreEvery is how often, in reads, the least-latency policy reads
+	// from the next member in turn instead, so that a member that was
+	// slow gets the chance to show it no longer is
+	exploreEvery = 16
+)
+
+// balancer orders the members of a chain for a read, and learns from
+// each read how fast its member answered
+type balancer struct {
+	policy ReadPolicy
+
+	mu        sync.Mutex
+	next      uint64
+	latencies map[string]time.Duration
+}
+
+// newBalancer returns a balancer following policy
+func newBalancer(policy ReadPolicy) *balancer {
+	return &balancer{policy: policy, latencies: make(map[string]time.Duration)}
+}
+
+// order reorders the healthy members of a chain, tail first, into the
+// order a read tries them: the member the policy picks, then the others
+func (b *balancer) order(members []string) []string {
+	if b.policy == ReadTail || len(members) < 2 {
+		return members
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	turn := b.next
+	b.next++
+
+	if b.policy == ReadRoundRobin || turn%exploreEvery == exploreEvery-1 {
+		start := int(turn % uint64(len(members)))
+		return append(members[start:len(members):len(members)], members[:start]...)
+	}
+	// Members not read from yet count as the fastest, so that each is
+	// measured; ties keep the tail first
+	ordered := append([]string(nil), members...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return b.latencies[ordered[i]] < b.latencies[ordered[j]]
+	})
+	return ordered
+}
+
+// observe records how long a read from a member took, or that it could
+// not reach the member
+func (b *balancer) observe(member string, elapsed time.Duration, failed bool) {
+	if b.policy != ReadLeastLatency {
+		return
+	}
+	if failed {
+		elapsed = max(elapsed, failurePenalty)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	average, ok := b.latencies[member]
+	if !ok {
+		b.latencies[member] = elapsed
+		return
+	}
+	b.latencies[member] = average + time.Duration(latencyWeight*float64(elapsed-average))
+}
+
+// snapshot returns the moving average of each member's read latency
+func (b *balancer) snapshot() map[string]time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	latencies := make(map[string]time.Duration, len(b.latencies))
+	for member, latency := range b.latencies {
+		latencies[member] = latency
+	}
+	return latencies
+}
@@ -0,0 +1,200 @@
+package client
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// CacheOptions configures a read cache
+type CacheOptions struct {
+	// MaxBytes bounds the data the cache holds; the least recently read
+	// blocks are evicted beyond it
+	MaxBytes int64
+	// TTL is how long a cached block is served without asking the node
+	// whether it changed; zero asks on every read
+	TTL time.Duration
+}
+
+// CacheStats reports a cache's effectiveness
+type CacheStats struct {
+	Hits          uint64 `json:"hits"`
+	Revalidations uint64 `json:"revalidations"`
+	Misses        uint64 `json:"misses"`
+	Evictions     uint64 `json:"evictions"`
+	Invalidations uint64 `json:"invalidations"`
+	Entries       int    `json:"entries"`
+	Bytes         int64  `json:"bytes"`
+}
+
+// Cache keeps recently read blocks in memory, for clients reading the same
+// blocks over and over, such as a training job's epochs over its shards.
+// A cached block is served for the TTL without a request; after that the
+// node is asked for the block's metadata, and the block is read again
+// only if its checksum changed.
+//
+// Writes and deletes through a client using the cache invalidate its
+// entry. Changes made by others are seen once the TTL expires, or at once
+// if the caller passes their versions to Invalidate as it learns of them.
+// A cache may be shared by clients of the same cluster.
+type Cache struct {
+	opts CacheOptions
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	stats   CacheStats
+}
+
+// cacheEntry is a cached block. version is zero until the block's
+// metadata is first read.
+type cacheEntry struct {
+	blockID   string
+	data      []byte
+	checksum  string
+	version   int
+	validated time.Time
+}
+
+// NewCache creates a read cache
+func NewCache(opts CacheOptions) *Cache {
+	return &Cache{
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Invalidate drops a block from the cache if the cached copy is older
+// than version, or whatever its version if version is zero
+func (c *Cache) Invalidate(blockID string, version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[blockID]
+	if !ok {
+		return
+	}
+	if entry := elem.Value.(*cacheEntry); version == 0 || entry.version < version {
+		c.remove(elem)
+		c.stats.Invalidations++
+	}
+}
+
+// Purge empties the cache
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.bytes = 0
+}
+
+// Stats returns a snapshot of the cache's counters
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Entries = len(c.entries)
+	stats.Bytes = c.bytes
+	return stats
+}
+
+// lookup returns a copy of a cached block and whether it is still within
+// its TTL
+func (c *Cache) lookup(blockID string) (entry cacheEntry, fresh, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[blockID]
+	if !ok {
+		c.stats.Misses++
+		return cacheEntry{}, false, false
+	}
+	c.lru.MoveToFront(elem)
+	entry = *elem.Value.(*cacheEntry)
+	fresh = c.opts.TTL > 0 && time.Since(entry.validated) < c.opts.TTL
+	if fresh {
+		c.stats.Hits++
+	}
+	return entry, fresh, true
+}
+
+// revalidated marks a cached block as unchanged at version
+func (c *Cache) revalidated(blockID, checksum string, version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.stats.Revalidations++
+	if elem, ok := c.entries[blockID]; ok {
+		entry := elem.Value.(*cacheEntry)
+		if entry.checksum == checksum {
+			entry.version = version
+			entry.validated = time.Now()
+		}
+	}
+}
+
+// add caches a block read from the node, evicting the least recently read
+// blocks to make room. Blocks larger than the whole cache are not cached.
+func (c *Cache) add(blockID string, data []byte) {
+	if int64(len(data)) > c.opts.MaxBytes {
+		c.Invalidate(blockID, 0)
+		return
+	}
+	sum := sha256.Sum256(data)
+	entry := &cacheEntry{
+		blockID:   blockID,
+		data:      append([]byte(nil), data...),
+		checksum:  hex.EncodeToString(sum[:]),
+		validated: time.Now(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[blockID]; ok {
+		c.remove(elem)
+	}
+	c.entries[blockID] = c.lru.PushFront(entry)
+	c.bytes += int64(len(entry.data))
+	for c.bytes > c.opts.MaxBytes {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove drops an entry; the caller holds the lock
+func (c *Cache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.blockID)
+	c.bytes -= int64(len(entry.data))
+}
+
+// cachedRead reads a block through the client's cache. A block past its
+// TTL is served from the cache if its checksum on the node is unchanged.
+func (c *Client) cachedRead(ctx context.Context, blockID string) ([]byte, error) {
+	cache := c.opts.Cache
+	entry, fresh, ok := cache.lookup(blockID)
+	if fresh {
+		return append([]byte(nil), entry.data...), nil
+	}
+	if ok {
+		stat, err := c.Stat(ctx, blockID)
+		if err != nil {
+			cache.Invalidate(blockID, 0)
+			return nil, err
+		}
+		if stat.Checksum == entry.checksum {
+			cache.revalidated(blockID, stat.Checksum, stat.Version)
+			return append([]byte(nil), entry.data...), nil
+		}
+	}
+
+	data, err := c.read(ctx, blockID)
+	if err != nil {
+		return nil, err
+	}
+	cache.add(blockID, data)
+	return data, nil
+}
@@ -0,0 +1,495 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/tracing"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultTimeout bounds dialing and each request when the caller's context
+// has no deadline
+const DefaultTimeout = 30 * time.Second
+
+// Options configures a client connection
+type Options struct {
+	// Timeout bounds dialing and requests without a context deadline
+	Timeout time.Duration
+	// TLS, if set, secures the connection and may carry a client
+	// certificate
+	TLS *tls.Config
+	// Token is a bearer token sent with every request
+	Token string
+	// Retry retries requests that fail transiently; the zero policy
+	// sends each request once
+	Retry RetryPolicy
+	// Cache, if set, serves repeated reads from memory
+	Cache *Cache
+}
+
+// targetKey is the context key of the storage target requests are for
+type targetKey struct{}
+
+// WithTarget returns a context whose requests are addressed to a specific
+// storage target of the node, such as a new chain member being filled
+func WithTarget(ctx context.Context, targetID string) context.Context {
+	return context.WithValue(ctx, targetKey{}, targetID)
+}
+
+// fenceKey is the context key of the fencing token of writes to other
+// nodes
+type fenceKey struct{}
+
+// WithFence returns a context whose requests carry a fencing token, for a
+// node writing to another. The receiving node refuses the write if the
+// coordinator has since issued the sender a newer epoch.
+func WithFence(ctx context.Context, token api.FencingToken) context.Context {
+	return context.WithValue(ctx, fenceKey{}, token)
+}
+
+// Client is a connection to a storage node's block API. Requests on one
+// client are serialised; open several clients for parallelism.
+//
+// On connecting, the client and node exchange protocol versions and use
+// the lower of the two, so that clients and nodes of adjacent releases
+// work together during a rolling upgrade.
+type Client struct {
+	address string
+	timeout time.Duration
+	token   string
+	opts    Options
+	// protocol is the version negotiated with the node, and version the
+	// node's software version if it reported one
+	protocol int
+	version  string
+	conn     net.Conn
+	reader   *bufio.Reader
+	writer   *bufio.Writer
+	nextID   uint64
+	closed   bool
+	mu       sync.Mutex
+}
+
+// Dial connects to the storage node at address
+func Dial(address string, timeout time.Duration) (*Client, error) {
+	return DialWithOptions(address, Options{Timeout: timeout})
+}
+
+// DialWithOptions connects to the storage node at address with TLS or
+// credentials
+func DialWithOptions(address string, opts Options) (*Client, error) {
+	timeout := opts.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	conn, err := dialConn(address, timeout, opts.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Client{
+		address:  address,
+		timeout:  timeout,
+		token:    opts.Token,
+		opts:     opts,
+		protocol: api.ProtocolVersion,
+		conn:     conn,
+		reader:   bufio.NewReader(conn),
+		writer:   bufio.NewWriter(conn),
+	}
+	if err := c.hello(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialConn opens the connection to a node, over TLS if tlsConfig is set
+func dialConn(address string, timeout time.Duration, tlsConfig *tls.Config) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if tlsConfig != nil {
+		tlsConfig = tlsConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			if host, _, splitErr := net.SplitHostPort(address); splitErr == nil {
+				tlsConfig.ServerName = host
+			}
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", address, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %w", address, err)
+	}
+	return conn, nil
+}
+
+// reconnect replaces a connection that failed with a new one to the same
+// node
+func (c *Client) reconnect() error {
+	conn, err := dialConn(c.address, c.timeout, c.opts.TLS)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		conn.Close()
+		return net.ErrClosed
+	}
+	c.conn.Close()
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.writer = bufio.NewWriter(conn)
+	c.mu.Unlock()
+
+	if err := c.hello(); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// DialRedirect follows a redirect from a node that is shutting down or
+// draining: it connects to the first of the suggested nodes that accepts
+// the connection. err is the error the request failed with; it must carry
+// an *api.RedirectError.
+func DialRedirect(err error, opts Options) (*Client, error) {
+	var redirect *api.RedirectError
+	if !errors.As(err, &redirect) {
+		return nil, fmt.Errorf("not a redirect: %w", err)
+	}
+	if len(redirect.Addresses) == 0 {
+		return nil, fmt.Errorf("redirect names no other node: %w", err)
+	}
+
+	var lastErr error
+	for _, address := range redirect.Addresses {
+		c, dialErr := DialWithOptions(address, opts)
+		if dialErr == nil {
+			return c, nil
+		}
+		lastErr = dialErr
+	}
+	return nil, fmt.Errorf("failed to follow redirect: %w", lastErr)
+}
+
+// hello negotiates the protocol version with the node. A node that does
+// not know the handshake answers with an error that carries no protocol
+// version, and speaks version 1.
+func (c *Client) hello() error {
+	resp, err := c.do(context.Background(), &api.Request{Op: api.OpHello})
+	if err != nil {
+		return fmt.Errorf("failed to open connection to %s: %w", c.address, err)
+	}
+
+	// A refusal of the whole connection, such as over the connection limit
+	// or from a node that is shutting down, is not an old node's answer
+	if resp.ID == 0 || resp.Status == api.StatusRedirect {
+		return fmt.Errorf("node %s refused connection: %w", c.address, resp.Err())
+	}
+
+	version, ok := resp.Headers[api.ProtocolHeader]
+	if !ok {
+		c.protocol = 1
+		return nil
+	}
+	if err := resp.Err(); err != nil {
+		return fmt.Errorf("node %s refused connection: %w", c.address, err)
+	}
+
+	server, err := strconv.Atoi(version)
+	if err != nil {
+		return fmt.Errorf("node %s announced invalid protocol version %q", c.address, version)
+	}
+	if err := api.CheckProtocol(server); err != nil {
+		return fmt.Errorf("node %s: %w", c.address, err)
+	}
+	c.protocol = api.NegotiateProtocol(server)
+	c.version = resp.Headers[api.VersionHeader]
+	return nil
+}
+
+// Address returns the address of the node the client is connected to
+func (c *Client) Address() string {
+	return c.address
+}
+
+// Protocol returns the protocol version used with the node
+func (c *Client) Protocol() int {
+	return c.protocol
+}
+
+// NodeVersion returns the node's software version, or "" if it predates
+// the handshake
+func (c *Client) NodeVersion() string {
+	return c.version
+}
+
+// Close closes the connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return c.conn.Close()
+}
+
+// do sends a request and waits for its response. Transport failures are
+// returned as errors; failed requests are returned as responses.
+func (c *Client) do(ctx context.Context, req *api.Request) (*api.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(c.timeout)
+	}
+	c.conn.SetDeadline(deadline)
+	defer c.conn.SetDeadline(time.Time{})
+
+	c.nextID++
+	req.ID = c.nextID
+	req.Headers = tracing.Inject(ctx, req.Headers)
+	req.Headers[api.ProtocolHeader] = strconv.Itoa(c.protocol)
+	if c.token != "" {
+		req.Headers[api.AuthorizationHeader] = "Bearer " + c.token
+	}
+	if target, ok := ctx.Value(targetKey{}).(string); ok && target != "" {
+		req.Headers[api.TargetHeader] = target
+	}
+	if token, ok := ctx.Value(fenceKey{}).(api.FencingToken); ok {
+		req.Headers[api.FenceHeader] = token.String()
+	}
+
+	if err := api.WriteRequest(c.writer, req); err != nil {
+		return nil, fmt.Errorf("failed to send %s request: %w", req.Op, err)
+	}
+	if err := c.writer.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to send %s request: %w", req.Op, err)
+	}
+
+	resp, err := api.ReadResponse(c.reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s response: %w", req.Op, err)
+	}
+	// Responses with ID 0 report connection-level failures, such as a
+	// refused connection or an unreadable frame
+	if resp.ID != req.ID && !(resp.ID == 0 && resp.Status != api.StatusOK) {
+		return nil, fmt.Errorf("response ID %d does not match request ID %d", resp.ID, req.ID)
+	}
+
+	return resp, nil
+}
+
+// call sends a request and converts a failed response into an error.
+// Requests failing transiently are retried as the client's retry policy
+// allows, over a new connection if the old one failed.
+func (c *Client) call(ctx context.Context, req *api.Request) (*api.Response, error) {
+	for attempt := 1; ; attempt++ {
+		resp, err := c.do(ctx, req)
+		lost := err != nil
+		if err == nil {
+			if err = resp.Err(); err == nil {
+				return resp, nil
+			}
+		}
+
+		if attempt >= c.opts.Retry.attempts() || !retryable(req.Op, err, lost) {
+			return nil, err
+		}
+		if waitErr := c.opts.Retry.wait(ctx, attempt); waitErr != nil {
+			return nil, err
+		}
+		if lost {
+			if dialErr := c.reconnect(); dialErr != nil {
+				return nil, fmt.Errorf("%w (reconnecting: %v)", err, dialErr)
+			}
+		}
+	}
+}
+
+// Read reads a block, from the client's cache if it has one. Reads for a
+// specific storage target bypass the cache.
+func (c *Client) Read(ctx context.Context, blockID string) ([]byte, error) {
+	if c.opts.Cache != nil && ctx.Value(targetKey{}) == nil {
+		return c.cachedRead(ctx, blockID)
+	}
+	return c.read(ctx, blockID)
+}
+
+// read reads a block from the node
+func (c *Client) read(ctx context.Context, blockID string) ([]byte, error) {
+	resp, err := c.call(ctx, &api.Request{Op: api.OpRead, BlockID: blockID})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Data, nil
+}
+
+// Write writes a block
+func (c *Client) Write(ctx context.Context, blockID string, data []byte) error {
+	defer c.invalidate(blockID)
+	_, err := c.call(ctx, &api.Request{Op: api.OpWrite, BlockID: blockID, Data: data})
+	return err
+}
+
+// writeChecked writes a block that the node checks against its checksum
+// before storing it. Nodes that predate the check store it unchecked.
+func (c *Client) writeChecked(ctx context.Context, blockID string, data []byte, checksum string) error {
+	req := &api.Request{
+		Op:      api.OpWrite,
+		BlockID: blockID,
+		Data:    data,
+		Headers: map[string]string{api.ChecksumHeader: checksum},
+	}
+	defer c.invalidate(blockID)
+	_, err := c.call(ctx, req)
+	return err
+}
+
+// WriteCompressed writes a block whose data was compressed with
+// api.Compress, so that it crosses the network compressed; checksum is the
+// hex SHA-256 of the data itself, which the node checks once it
+// decompressed it. To a node that predates compressed writes the data is
+// sent decompressed.
+func (c *Client) WriteCompressed(ctx context.Context, blockID string, compressed []byte, checksum string) error {
+	req := &api.Request{
+		Op:      api.OpWrite,
+		BlockID: blockID,
+		Data:    compressed,
+		Headers: map[string]string{api.ChecksumHeader: checksum, api.EncodingHeader: api.EncodingDeflate},
+	}
+	if c.protocol < api.ProtocolCompression {
+		if err := req.DecodeData(); err != nil {
+			return err
+		}
+	}
+	defer c.invalidate(blockID)
+	_, err := c.call(ctx, req)
+	return err
+}
+
+// Delete deletes a block
+func (c *Client) Delete(ctx context.Context, blockID string) error {
+	defer c.invalidate(blockID)
+	_, err := c.call(ctx, &api.Request{Op: api.OpDelete, BlockID: blockID})
+	return err
+}
+
+// invalidate drops a block the client changed from its cache
+func (c *Client) invalidate(blockID string) {
+	if c.opts.Cache != nil {
+		c.opts.Cache.Invalidate(blockID, 0)
+	}
+}
+
+// List lists the IDs of blocks starting with prefix
+func (c *Client) List(ctx context.Context, prefix string) ([]string, error) {
+	resp, err := c.call(ctx, &api.Request{Op: api.OpList, Prefix: prefix})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Blocks, nil
+}
+
+// Stat reads a block's metadata
+func (c *Client) Stat(ctx context.Context, blockID string) (*api.BlockStat, error) {
+	resp, err := c.call(ctx, &api.Request{Op: api.OpStat, BlockID: blockID})
+	if err != nil {
+		return nil, err
+	}
+	if resp.Stat == nil {
+		return nil, errors.New("stat response carried no metadata")
+	}
+	return resp.Stat, nil
+}
+
+// Digest reads a node of the digest tree of the given chains' blocks on
+// the node's target: the digests of a group's children, or the blocks of a
+// shard. path is "" for the root, a hex digit for a group or two for a
+// shard. Nodes that predate digests refuse it; their blocks are compared
+// by listing them instead.
+func (c *Client) Digest(ctx context.Context, chains []uint32, path string) ([]string, []api.BlockDigest, error) {
+	if c.protocol < api.ProtocolDigest {
+		return nil, nil, fmt.Errorf("node %s speaks protocol %d, which has no digests", c.address, c.protocol)
+	}
+
+	req := &api.Request{
+		Op:      api.OpDigest,
+		Prefix:  path,
+		Headers: map[string]string{api.ChainsHeader: api.EncodeChains(chains)},
+	}
+	resp, err := c.call(ctx, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Digests, resp.Entries, nil
+}
+
+// Fetch reads a block together with its metadata, as another node copying
+// the block does. The node refuses if its copy is older than version; zero
+// accepts any version. The data is verified against the checksum in the
+// metadata. Nodes that predate fetches are asked for the metadata and the
+// data separately.
+func (c *Client) Fetch(ctx context.Context, blockID string, version int) ([]byte, *api.BlockStat, error) {
+	if c.protocol < api.ProtocolFetch {
+		return c.statAndRead(ctx, blockID, version)
+	}
+
+	resp, err := c.call(ctx, &api.Request{Op: api.OpFetch, BlockID: blockID, Version: version})
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Stat == nil {
+		return nil, nil, errors.New("fetch response carried no metadata")
+	}
+
+	if err := verifyChecksum(blockID, resp.Data, resp.Stat); err != nil {
+		return nil, nil, err
+	}
+	return resp.Data, resp.Stat, nil
+}
+
+// statAndRead emulates a fetch with a stat and a read. A block rewritten
+// between the two fails checksum verification.
+func (c *Client) statAndRead(ctx context.Context, blockID string, version int) ([]byte, *api.BlockStat, error) {
+	stat, err := c.Stat(ctx, blockID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat.Version < version {
+		return nil, nil, fmt.Errorf("block %s is at version %d, older than %d: %w", blockID, stat.Version, version, api.ErrVersionConflict)
+	}
+
+	data, err := c.Read(ctx, blockID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := verifyChecksum(blockID, data, stat); err != nil {
+		return nil, nil, err
+	}
+	return data, stat, nil
+}
+
+// verifyChecksum checks data against the checksum in a block's metadata
+func verifyChecksum(blockID string, data []byte, stat *api.BlockStat) error {
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != stat.Checksum {
+		return fmt.Errorf("block %s: %w", blockID, api.ErrCorrupted)
+	}
+	return nil
+}
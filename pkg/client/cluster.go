@@ -0,0 +1,327 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/internal/ring"
+	"github.com/3fs-storage/pkg/api"
+)
+
+// ErrNoMember is returned for a block whose chain has no healthy member
+var ErrNoMember = errors.New("no healthy member of the block's chain")
+
+// Cluster sends block requests to the members of each block's chain in a
+// routing table: writes and deletes to the head, and reads to the member
+// its read policy picks, falling back to the other members. Connections
+// are opened per node as needed and kept. Requests to one node are
+// serialised, as on a Client; open several clusters for parallelism.
+//
+// A node acknowledges a write once every member of the chain has stored
+// it, so reads from any member see every acknowledged write. Only a write
+// still being replicated can be seen by a member before the tail, which
+// the tail policy avoids at the cost of reading from one node per chain.
+//
+// With cache reads, reads go first to the cache node a block maps to, if
+// the routing table has any, and to the chain when it fails.
+type Cluster struct {
+	opts    Options
+	balance *balancer
+
+	mu         sync.Mutex
+	table      *api.RoutingTable
+	conns      map[string]*Client
+	cacheReads bool
+	caches     *cacheRing
+}
+
+// cacheRing is the consistent-hash ring of the healthy cache nodes of a
+// routing table, by data address, and the version of the table it was
+// built from
+type cacheRing struct {
+	version uint64
+	ring    *ring.Ring
+}
+
+// NewCluster creates a client of the cluster a routing table describes,
+// reading as policy says
+func NewCluster(table *api.RoutingTable, opts Options, policy ReadPolicy) *Cluster {
+	return &Cluster{
+		opts:    opts,
+		balance: newBalancer(policy),
+		table:   table,
+		conns:   make(map[string]*Client),
+	}
+}
+
+// Latencies returns the moving average of the read latency of each target
+// read from, as the least-latency policy measures it
+func (c *Cluster) Latencies() map[string]time.Duration {
+	return c.balance.snapshot()
+}
+
+// Table returns the routing table requests are sent by
+func (c *Cluster) Table() *api.RoutingTable {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.table
+}
+
+// SetTable replaces the routing table, such as with a newer one from the
+// coordinator
+func (c *Cluster) SetTable(table *api.RoutingTable) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.table = table
+}
+
+// SetCacheReads sets whether reads try the cache node a block maps to
+// before its chain
+func (c *Cluster) SetCacheReads(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cacheReads = enabled
+}
+
+// cacheAddress returns the data address of the cache node a block's reads
+// go to first, or "" without cache reads or cache nodes. Blocks map to
+// cache nodes by consistent hashing, so that each block is cached once and
+// a cache node joining or leaving only moves its share of them.
+func (c *Cluster) cacheAddress(blockID string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.cacheReads {
+		return ""
+	}
+	if c.caches == nil || c.caches.version != c.table.Version {
+		var members []ring.Member
+		for _, record := range c.table.Nodes {
+			if record.IsCache() && record.Healthy() && record.Address != "" {
+				members = append(members, ring.Member{ID: record.Address, Weight: 1})
+			}
+		}
+		c.caches = &cacheRing{version: c.table.Version, ring: ring.New(ring.DefaultVirtualNodes, members)}
+	}
+	address, _ := c.caches.ring.Locate(blockID)
+	return address
+}
+
+// onCache runs fn against the cache node of a block, reporting whether it
+// succeeded
+func (c *Cluster) onCache(ctx context.Context, blockID string, fn func(ctx context.Context, conn *Client) error) bool {
+	address := c.cacheAddress(blockID)
+	if address == "" {
+		return false
+	}
+	conn, err := c.conn(address)
+	if err != nil {
+		return false
+	}
+	if err := fn(ctx, conn); err != nil {
+		if connectionLost(err) {
+			c.drop(address)
+		}
+		return false
+	}
+	return true
+}
+
+// Close closes the connections
+func (c *Cluster) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for address, conn := range c.conns {
+		conn.Close()
+		delete(c.conns, address)
+	}
+	return nil
+}
+
+// conn returns the connection to a node, dialing it if needed
+func (c *Cluster) conn(address string) (*Client, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[address]; ok {
+		return conn, nil
+	}
+	conn, err := DialWithOptions(address, c.opts)
+	if err != nil {
+		return nil, err
+	}
+	c.conns[address] = conn
+	return conn, nil
+}
+
+// drop closes the connection to a node after a transport failure, so
+// that the next request dials it again
+func (c *Cluster) drop(address string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if conn, ok := c.conns[address]; ok {
+		conn.Close()
+		delete(c.conns, address)
+	}
+}
+
+// members returns the healthy members of a block's chain, head first, or
+// tail first when reading
+func (c *Cluster) members(blockID string, reading bool) []string {
+	table := c.Table()
+	chain := table.ChainForBlock(blockID)
+	if chain == nil {
+		return nil
+	}
+	members := make([]string, 0, len(chain.Members))
+	for _, member := range chain.Members {
+		if record, ok := table.Nodes[member]; ok && record.Healthy() {
+			members = append(members, member)
+		}
+	}
+	if reading {
+		for i, j := 0, len(members)-1; i < j; i, j = i+1, j-1 {
+			members[i], members[j] = members[j], members[i]
+		}
+	}
+	return members
+}
+
+// onMember runs fn against a member of the block's chain: the head, or
+// with reading the block's cache node and then each member in the read
+// policy's order until one succeeds
+func (c *Cluster) onMember(ctx context.Context, blockID string, reading bool, fn func(ctx context.Context, conn *Client) error) error {
+	if reading && c.onCache(ctx, blockID, fn) {
+		return nil
+	}
+	members := c.members(blockID, reading)
+	if len(members) == 0 {
+		return fmt.Errorf("block %s: %w", blockID, ErrNoMember)
+	}
+	if reading {
+		members = c.balance.order(members)
+	} else {
+		members = members[:1]
+	}
+	table := c.Table()
+	var err error
+	for _, member := range members {
+		address := table.NodeAddress(member)
+		var conn *Client
+		if conn, err = c.conn(address); err != nil {
+			if reading {
+				c.balance.observe(member, 0, true)
+			}
+			continue
+		}
+		start := time.Now()
+		err = fn(WithTarget(ctx, member), conn)
+		if reading {
+			c.balance.observe(member, time.Since(start), err != nil && connectionLost(err))
+		}
+		if err == nil {
+			return nil
+		}
+		if connectionLost(err) {
+			c.drop(address)
+		}
+	}
+	return err
+}
+
+// Read reads a block from its chain
+func (c *Cluster) Read(ctx context.Context, blockID string) ([]byte, error) {
+	var data []byte
+	err := c.onMember(ctx, blockID, true, func(ctx context.Context, conn *Client) error {
+		var err error
+		data, err = conn.Read(ctx, blockID)
+		return err
+	})
+	return data, err
+}
+
+// Fetch reads a block and its metadata from its chain, verifying the data
+// against its checksum
+func (c *Cluster) Fetch(ctx context.Context, blockID string, version int) ([]byte, *api.BlockStat, error) {
+	var data []byte
+	var stat *api.BlockStat
+	err := c.onMember(ctx, blockID, true, func(ctx context.Context, conn *Client) error {
+		var err error
+		data, stat, err = conn.Fetch(ctx, blockID, version)
+		return err
+	})
+	return data, stat, err
+}
+
+// Stat reads a block's metadata from its chain
+func (c *Cluster) Stat(ctx context.Context, blockID string) (*api.BlockStat, error) {
+	var stat *api.BlockStat
+	err := c.onMember(ctx, blockID, true, func(ctx context.Context, conn *Client) error {
+		var err error
+		stat, err = conn.Stat(ctx, blockID)
+		return err
+	})
+	return stat, err
+}
+
+// Write writes a block to the head of its chain
+func (c *Cluster) Write(ctx context.Context, blockID string, data []byte) error {
+	return c.onMember(ctx, blockID, false, func(ctx context.Context, conn *Client) error {
+		return conn.Write(ctx, blockID, data)
+	})
+}
+
+// WriteCompressed writes a block whose data was compressed with
+// api.Compress to the head of its chain, as Client.WriteCompressed does
+func (c *Cluster) WriteCompressed(ctx context.Context, blockID string, compressed []byte, checksum string) error {
+	return c.onMember(ctx, blockID, false, func(ctx context.Context, conn *Client) error {
+		return conn.WriteCompressed(ctx, blockID, compressed, checksum)
+	})
+}
+
+// Delete deletes a block at the head of its chain
+func (c *Cluster) Delete(ctx context.Context, blockID string) error {
+	return c.onMember(ctx, blockID, false, func(ctx context.Context, conn *Client) error {
+		return conn.Delete(ctx, blockID)
+	})
+}
+
+// List lists the blocks with IDs starting with prefix across every
+// healthy target but cache nodes, sorted and without duplicates
+func (c *Cluster) List(ctx context.Context, prefix string) ([]string, error) {
+	table := c.Table()
+	targets := make([]string, 0, len(table.Nodes))
+	for id, record := range table.Nodes {
+		if record.Healthy() && !record.IsCache() {
+			targets = append(targets, id)
+		}
+	}
+	sort.Strings(targets)
+
+	seen := make(map[string]bool)
+	for _, target := range targets {
+		address := table.NodeAddress(target)
+		conn, err := c.conn(address)
+		if err != nil {
+			return nil, fmt.Errorf("target %s: %w", target, err)
+		}
+		blockIDs, err := conn.List(WithTarget(ctx, target), prefix)
+		if err != nil {
+			if connectionLost(err) {
+				c.drop(address)
+			}
+			return nil, fmt.Errorf("target %s: %w", target, err)
+		}
+		for _, blockID := range blockIDs {
+			seen[blockID] = true
+		}
+	}
+	blockIDs := make([]string, 0, len(seen))
+	for blockID := range seen {
+		blockIDs = append(blockIDs, blockID)
+	}
+	sort.Strings(blockIDs)
+	return blockIDs, nil
+}
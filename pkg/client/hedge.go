@@ -0,0 +1,254 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// HedgePolicy says when a read from replicas is hedged: sent to another
+// replica as well because the first is slow to answer. Hedging trades a
+// little extra load for a much shorter tail of read latencies, as a
+// replica stalled by a busy disk or a long request no longer holds the
+// read up.
+type HedgePolicy struct {
+	// After is how long a read waits for a replica before asking the next
+	// one as well; zero never hedges, trying the next replica only when
+	// one fails
+	After time.Duration
+	// MaxHedges bounds the replicas a read is hedged to; zero allows one
+	MaxHedges int
+}
+
+// maxHedges returns how many replicas a read may be hedged to
+func (p HedgePolicy) maxHedges() int {
+	if p.MaxHedges < 1 {
+		return 1
+	}
+	return p.MaxHedges
+}
+
+// Replicas reads blocks from a set of nodes holding the same data, such
+// as the members of a chain, any of which can serve a read. Reads start
+// at each replica in turn, move on to the next replica when one fails,
+// and are hedged as the policy says; the first answer wins.
+//
+// Each replica is reached over a client of its own, dialed when first
+// needed and again after its connection fails. Requests to one replica
+// are serialised as on a Client, so a hedged read that lost keeps its
+// replica busy until it completes.
+type Replicas struct {
+	addresses []string
+	opts      Options
+	hedge     HedgePolicy
+
+	mu      sync.Mutex
+	clients []*Client
+	next    int
+	closed  bool
+}
+
+// NewReplicas returns a reader of the replicas at addresses. Clients are
+// dialed with opts, whose retry policy applies to each replica.
+func NewReplicas(addresses []string, opts Options, hedge HedgePolicy) (*Replicas, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("no replica addresses")
+	}
+	return &Replicas{
+		addresses: addresses,
+		opts:      opts,
+		hedge:     hedge,
+		clients:   make([]*Client, len(addresses)),
+	}, nil
+}
+
+// replicaResult is the outcome of a request to one replica
+type replicaResult struct {
+	data []byte
+	stat *api.BlockStat
+	err  error
+}
+
+// Read reads a block from the replicas
+func (r *Replicas) Read(ctx context.Context, blockID string) ([]byte, error) {
+	res := r.hedged(ctx, func(ctx context.Context, c *Client) replicaResult {
+		data, err := c.Read(ctx, blockID)
+		return replicaResult{data: data, err: err}
+	})
+	return res.data, res.err
+}
+
+// Fetch reads a block together with its metadata from the replicas,
+// verified against its checksum as Client.Fetch does
+func (r *Replicas) Fetch(ctx context.Context, blockID string, version int) ([]byte, *api.BlockStat, error) {
+	res := r.hedged(ctx, func(ctx context.Context, c *Client) replicaResult {
+		data, stat, err := c.Fetch(ctx, blockID, version)
+		return replicaResult{data: data, stat: stat, err: err}
+	})
+	return res.data, res.stat, res.err
+}
+
+// Stat reads a block's metadata from the replicas
+func (r *Replicas) Stat(ctx context.Context, blockID string) (*api.BlockStat, error) {
+	res := r.hedged(ctx, func(ctx context.Context, c *Client) replicaResult {
+		stat, err := c.Stat(ctx, blockID)
+		return replicaResult{stat: stat, err: err}
+	})
+	return res.stat, res.err
+}
+
+// Close closes the connections to the replicas
+func (r *Replicas) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	var firstErr error
+	for i, c := range r.clients {
+		if c == nil {
+			continue
+		}
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		r.clients[i] = nil
+	}
+	return firstErr
+}
+
+// hedged runs a request on the replicas: on one first, on the next when
+// it fails or is slower than the hedge policy allows, and so on until one
+// succeeds or all have failed, in which case the last error is returned
+func (r *Replicas) hedged(ctx context.Context, fn func(ctx context.Context, c *Client) replicaResult) replicaResult {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	order := r.order()
+	results := make(chan replicaResult, len(order))
+	launched, pending, hedges := 0, 0, 0
+	launch := func() {
+		i := order[launched]
+		launched++
+		pending++
+		go func() {
+			c, err := r.client(i)
+			if err != nil {
+				results <- replicaResult{err: err}
+				return
+			}
+			res := fn(ctx, c)
+			if res.err != nil && connectionLost(res.err) {
+				r.drop(i, c)
+			}
+			results <- res
+		}()
+	}
+
+	var timer *time.Timer
+	var hedgeC <-chan time.Time
+	arm := func() {
+		if r.hedge.After <= 0 || hedges >= r.hedge.maxHedges() || launched >= len(order) {
+			hedgeC = nil
+			return
+		}
+		if timer == nil {
+			timer = time.NewTimer(r.hedge.After)
+		} else {
+			timer.Reset(r.hedge.After)
+		}
+		hedgeC = timer.C
+	}
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	launch()
+	arm()
+	var last replicaResult
+	for pending > 0 {
+		select {
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				return res
+			}
+			last = res
+			if ctx.Err() != nil {
+				return last
+			}
+			if launched < len(order) {
+				launch()
+				arm()
+			}
+		case <-hedgeC:
+			hedges++
+			launch()
+			arm()
+		case <-ctx.Done():
+			return replicaResult{err: ctx.Err()}
+		}
+	}
+	return last
+}
+
+// order returns the replicas in the order a request tries them, starting
+// at each in turn to spread the reads
+func (r *Replicas) order() []int {
+	r.mu.Lock()
+	start := r.next
+	r.next = (r.next + 1) % len(r.addresses)
+	r.mu.Unlock()
+
+	order := make([]int, len(r.addresses))
+	for i := range order {
+		order[i] = (start + i) % len(r.addresses)
+	}
+	return order
+}
+
+// client returns the client of a replica, dialing it if needed
+func (r *Replicas) client(i int) (*Client, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, errors.New("replicas are closed")
+	}
+	if c := r.clients[i]; c != nil {
+		r.mu.Unlock()
+		return c, nil
+	}
+	r.mu.Unlock()
+
+	c, err := DialWithOptions(r.addresses[i], r.opts)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		c.Close()
+		return nil, errors.New("replicas are closed")
+	}
+	if existing := r.clients[i]; existing != nil {
+		c.Close()
+		return existing, nil
+	}
+	r.clients[i] = c
+	return c, nil
+}
+
+// drop forgets the client of a replica whose connection failed, so that
+// the next request dials it again
+func (r *Replicas) drop(i int, c *Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients[i] == c {
+		r.clients[i] = nil
+	}
+	c.Close()
+}
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultRetryPolicy retries a request twice, backing off from 50ms
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 50 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// RetryPolicy says how a client retries requests that fail transiently:
+// those the node throttled or was too busy for, and those whose
+// connection failed, which are
+// sent again over a new connection. Deletes are not retried after a
+// connection failure, as the node may have carried them out.
+//
+// The wait before each retry grows exponentially from InitialBackoff up
+// to MaxBackoff, and is drawn at random below that bound so that clients
+// failing together do not retry together.
+type RetryPolicy struct {
+	// MaxAttempts is how many times a request is sent at most; zero or
+	// one sends it once
+	MaxAttempts int
+	// InitialBackoff bounds the wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff bounds the wait before any retry
+	MaxBackoff time.Duration
+	// Multiplier is the growth of the bound from one retry to the next;
+	// below one it stays at InitialBackoff
+	Multiplier float64
+}
+
+// attempts returns how many times a request is sent at most
+func (p RetryPolicy) attempts() int {
+	if p.MaxAttempts < 1 {
+		return 1
+	}
+	return p.MaxAttempts
+}
+
+// backoff returns the wait before the retry following an attempt
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	bound := float64(p.InitialBackoff)
+	for i := 1; i < attempt && p.Multiplier > 1; i++ {
+		bound *= p.Multiplier
+	}
+	if p.MaxBackoff > 0 && bound > float64(p.MaxBackoff) {
+		bound = float64(p.MaxBackoff)
+	}
+	if bound < 1 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(bound)) + 1)
+}
+
+// wait sleeps before the retry following an attempt, returning early with
+// the context's error if it ends first
+func (p RetryPolicy) wait(ctx context.Context, attempt int) error {
+	delay := p.backoff(attempt)
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// retryable reports whether a request that failed with err may be sent
+// again. lost says whether the connection failed rather than the node
+// answering with an error.
+func retryable(op api.Op, err error, lost bool) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if lost {
+		return op != api.OpDelete && connectionLost(err)
+	}
+	return errors.Is(err, api.ErrThrottled) || errors.Is(err, api.ErrBackpressure)
+}
+
+// connectionLost reports whether err is the failure of the connection
+// rather than of the request
+func connectionLost(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, net.ErrClosed)
+}
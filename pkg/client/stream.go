@@ -0,0 +1,402 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// DefaultChunkSize is the size of the chunks a stream is stored in
+const DefaultChunkSize = 8 << 20
+
+// StreamFormat identifies a stream manifest, telling it from other blocks
+const StreamFormat = "3fs-stream/1"
+
+// StreamChunk is one chunk of a stream, stored as a block of its own
+type StreamChunk struct {
+	ID       string `json:"id"`
+	Size     int    `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// StreamManifest describes a stream: its chunks in order, and the SHA-256
+// of the whole. A stream's manifest is the block named after it; its
+// chunks are blocks named after the stream and the upload that wrote
+// them, so that a stream being replaced stays readable until the new one
+// is committed.
+type StreamManifest struct {
+	Format    string        `json:"format"`
+	Name      string        `json:"name"`
+	UploadID  string        `json:"upload_id"`
+	Size      int64         `json:"size"`
+	ChunkSize int           `json:"chunk_size"`
+	Chunks    []StreamChunk `json:"chunks"`
+	Checksum  string        `json:"checksum,omitempty"`
+	CreatedAt int64         `json:"created_at"`
+	// HashState is the state of the stream's SHA-256 after the stored
+	// chunks, kept while it is being uploaded so that a resumed upload
+	// need not read them back
+	HashState []byte `json:"hash_state,omitempty"`
+}
+
+// uploadBlockID returns the ID of the block recording an upload's progress
+func uploadBlockID(name, uploadID string) string {
+	return name + "." + uploadID + ".upload"
+}
+
+// chunkBlockID returns the ID of a chunk of an upload
+func chunkBlockID(name, uploadID string, index int) string {
+	return fmt.Sprintf("%s.%s.%08d", name, uploadID, index)
+}
+
+// StreamWriter uploads a stream chunk by chunk, holding at most one chunk
+// in memory. Its progress is recorded with each chunk, so an upload cut
+// short can be resumed with ResumeStream from Offset rather than started
+// over. Nothing is visible under the stream's name until Close commits it.
+type StreamWriter struct {
+	c        *Client
+	ctx      context.Context
+	manifest StreamManifest
+	digest   hash.Hash
+	buf      []byte
+	err      error
+}
+
+// PutStream starts uploading a stream to name, in chunks of chunkSize
+// bytes, or DefaultChunkSize if chunkSize is zero
+func (c *Client) PutStream(ctx context.Context, name string, chunkSize int) (*StreamWriter, error) {
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	if chunkSize > api.MaxDataSize {
+		return nil, fmt.Errorf("chunk size %d exceeds the largest block, %d", chunkSize, api.MaxDataSize)
+	}
+
+	nonce := make([]byte, 8)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate upload ID: %w", err)
+	}
+	uploadID := hex.EncodeToString(nonce)
+	for _, id := range []string{name, chunkBlockID(name, uploadID, 0), uploadBlockID(name, uploadID)} {
+		if err := api.ValidateBlockID(id); err != nil {
+			return nil, fmt.Errorf("invalid stream name: %w", err)
+		}
+	}
+
+	w := &StreamWriter{
+		c:   c,
+		ctx: ctx,
+		manifest: StreamManifest{
+			Format:    StreamFormat,
+			Name:      name,
+			UploadID:  uploadID,
+			ChunkSize: chunkSize,
+		},
+		digest: sha256.New(),
+		buf:    make([]byte, 0, chunkSize),
+	}
+	if err := w.saveProgress(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// ResumeStream continues an upload that was cut short. Writing resumes at
+// the writer's Offset: the data before it is already stored.
+func (c *Client) ResumeStream(ctx context.Context, name, uploadID string) (*StreamWriter, error) {
+	data, err := c.Read(ctx, uploadBlockID(name, uploadID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read upload %s of %s: %w", uploadID, name, err)
+	}
+	var manifest StreamManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode upload %s of %s: %w", uploadID, name, err)
+	}
+	if manifest.Format != StreamFormat || manifest.Name != name || manifest.UploadID != uploadID {
+		return nil, fmt.Errorf("block %s is not an upload of %s", uploadBlockID(name, uploadID), name)
+	}
+	digest := sha256.New()
+	if err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(manifest.HashState); err != nil {
+		return nil, fmt.Errorf("failed to restore checksum of upload %s of %s: %w", uploadID, name, err)
+	}
+
+	return &StreamWriter{
+		c:        c,
+		ctx:      ctx,
+		manifest: manifest,
+		digest:   digest,
+		buf:      make([]byte, 0, manifest.ChunkSize),
+	}, nil
+}
+
+// UploadID returns the ID to resume the upload with
+func (w *StreamWriter) UploadID() string {
+	return w.manifest.UploadID
+}
+
+// Offset returns how much of the stream has been written, including the
+// data buffered for the next chunk. An upload resumed after a failure
+// continues from the last stored chunk.
+func (w *StreamWriter) Offset() int64 {
+	return w.manifest.Size + int64(len(w.buf))
+}
+
+// Write buffers data, storing each chunk as it fills up
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[len(w.buf):cap(w.buf)], p)
+		w.buf = w.buf[:len(w.buf)+n]
+		p = p[n:]
+		written += n
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushChunk(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// ReadFrom uploads the rest of a reader
+func (w *StreamWriter) ReadFrom(r io.Reader) (int64, error) {
+	var total int64
+	for {
+		if w.err != nil {
+			return total, w.err
+		}
+		n, err := io.ReadFull(r, w.buf[len(w.buf):cap(w.buf)])
+		w.buf = w.buf[:len(w.buf)+n]
+		total += int64(n)
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flushChunk(); err != nil {
+				return total, err
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+// flushChunk stores the buffered chunk and records the progress. A failure
+// leaves the writer unusable; the upload can then be resumed.
+func (w *StreamWriter) flushChunk() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	index := len(w.manifest.Chunks)
+	id := chunkBlockID(w.manifest.Name, w.manifest.UploadID, index)
+	sum := sha256.Sum256(w.buf)
+	checksum := hex.EncodeToString(sum[:])
+	if err := w.c.writeChecked(w.ctx, id, w.buf, checksum); err != nil {
+		w.err = fmt.Errorf("failed to store chunk %d of %s: %w", index, w.manifest.Name, err)
+		return w.err
+	}
+
+	w.manifest.Chunks = append(w.manifest.Chunks, StreamChunk{ID: id, Size: len(w.buf), Checksum: checksum})
+	w.manifest.Size += int64(len(w.buf))
+	w.digest.Write(w.buf)
+	w.buf = w.buf[:0]
+	if err := w.saveProgress(); err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// saveProgress records the chunks stored so far
+func (w *StreamWriter) saveProgress() error {
+	state, err := w.digest.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return fmt.Errorf("failed to save checksum state: %w", err)
+	}
+	w.manifest.HashState = state
+	data, err := json.Marshal(&w.manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode upload progress: %w", err)
+	}
+	if err := w.c.Write(w.ctx, uploadBlockID(w.manifest.Name, w.manifest.UploadID), data); err != nil {
+		return fmt.Errorf("failed to record upload progress: %w", err)
+	}
+	return nil
+}
+
+// Close stores the last chunk and commits the stream, replacing any
+// previous stream of the same name, whose chunks are then deleted
+func (w *StreamWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if err := w.flushChunk(); err != nil {
+		return err
+	}
+
+	w.manifest.Checksum = hex.EncodeToString(w.digest.Sum(nil))
+	w.manifest.HashState = nil
+	w.manifest.CreatedAt = time.Now().UnixNano()
+	data, err := json.Marshal(&w.manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode stream manifest: %w", err)
+	}
+
+	previous, _ := w.c.StatStream(w.ctx, w.manifest.Name)
+	if err := w.c.Write(w.ctx, w.manifest.Name, data); err != nil {
+		w.err = fmt.Errorf("failed to commit %s: %w", w.manifest.Name, err)
+		return w.err
+	}
+	w.err = errors.New("stream is closed")
+
+	w.c.Delete(w.ctx, uploadBlockID(w.manifest.Name, w.manifest.UploadID))
+	if previous != nil && previous.UploadID != w.manifest.UploadID {
+		w.c.deleteChunks(w.ctx, previous.Chunks)
+	}
+	return nil
+}
+
+// Abort deletes the chunks of an unfinished upload
+func (w *StreamWriter) Abort() error {
+	w.err = errors.New("upload was aborted")
+	w.c.deleteChunks(w.ctx, w.manifest.Chunks)
+	return w.c.Delete(w.ctx, uploadBlockID(w.manifest.Name, w.manifest.UploadID))
+}
+
+// deleteChunks deletes chunk blocks, ignoring failures, as chunks left
+// behind only take space
+func (c *Client) deleteChunks(ctx context.Context, chunks []StreamChunk) {
+	for _, chunk := range chunks {
+		c.Delete(ctx, chunk.ID)
+	}
+}
+
+// StatStream returns the manifest of a stream
+func (c *Client) StatStream(ctx context.Context, name string) (*StreamManifest, error) {
+	data, err := c.Read(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	var manifest StreamManifest
+	if err := json.Unmarshal(data, &manifest); err != nil || manifest.Format != StreamFormat {
+		return nil, fmt.Errorf("block %s is not a stream", name)
+	}
+	return &manifest, nil
+}
+
+// DeleteStream deletes a stream and its chunks
+func (c *Client) DeleteStream(ctx context.Context, name string) error {
+	manifest, err := c.StatStream(ctx, name)
+	if err != nil {
+		return err
+	}
+	if err := c.Delete(ctx, name); err != nil {
+		return err
+	}
+	c.deleteChunks(ctx, manifest.Chunks)
+	return nil
+}
+
+// StreamReader downloads a stream chunk by chunk, checking each against
+// its checksum, and the whole stream against its own when it is read from
+// the start
+type StreamReader struct {
+	c        *Client
+	ctx      context.Context
+	manifest *StreamManifest
+	offset   int64
+	// index is the chunk holding offset, and start the offset it starts at
+	index int
+	start int64
+	data  []byte
+	// digest hashes a stream read from its start
+	digest hash.Hash
+}
+
+// GetStream opens a stream for reading from offset, so that an
+// interrupted download can carry on where it stopped
+func (c *Client) GetStream(ctx context.Context, name string, offset int64) (*StreamReader, error) {
+	manifest, err := c.StatStream(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if offset < 0 || offset > manifest.Size {
+		return nil, fmt.Errorf("offset %d is outside %s, of %d bytes", offset, name, manifest.Size)
+	}
+
+	r := &StreamReader{c: c, ctx: ctx, manifest: manifest}
+	if offset == 0 && manifest.Checksum != "" {
+		r.digest = sha256.New()
+	}
+	for r.index < len(manifest.Chunks) && r.start+int64(manifest.Chunks[r.index].Size) <= offset {
+		r.start += int64(manifest.Chunks[r.index].Size)
+		r.index++
+	}
+	r.offset = offset
+	return r, nil
+}
+
+// Manifest returns the manifest of the stream being read
+func (r *StreamReader) Manifest() *StreamManifest {
+	return r.manifest
+}
+
+// Read reads the stream, fetching the next chunk when the current one is
+// used up
+func (r *StreamReader) Read(p []byte) (int, error) {
+	if r.offset >= r.manifest.Size {
+		if r.digest != nil {
+			sum := hex.EncodeToString(r.digest.Sum(nil))
+			r.digest = nil
+			if sum != r.manifest.Checksum {
+				return 0, fmt.Errorf("stream %s failed checksum verification", r.manifest.Name)
+			}
+		}
+		return 0, io.EOF
+	}
+
+	if r.data == nil {
+		chunk := r.manifest.Chunks[r.index]
+		data, err := r.c.Read(r.ctx, chunk.ID)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read chunk %d of %s: %w", r.index, r.manifest.Name, err)
+		}
+		sum := sha256.Sum256(data)
+		if len(data) != chunk.Size || hex.EncodeToString(sum[:]) != chunk.Checksum {
+			return 0, fmt.Errorf("chunk %d of %s failed checksum verification", r.index, r.manifest.Name)
+		}
+		r.data = data
+	}
+
+	n := copy(p, r.data[r.offset-r.start:])
+	if r.digest != nil {
+		r.digest.Write(p[:n])
+	}
+	r.offset += int64(n)
+	if r.offset == r.start+int64(len(r.data)) {
+		r.start = r.offset
+		r.index++
+		r.data = nil
+	}
+	return n, nil
+}
+
+// Close releases the reader
+func (r *StreamReader) Close() error {
+	r.data = nil
+	return nil
+}
@@ -1,14 +1,21 @@
 package config
 
 import (
-	"os"
-
-	"gopkg.in/yaml.v3"
+	"context"
 )
 
 // Config represents the complete application configuration
 type Config struct {
 	Storage StorageConfig `yaml:"storage"`
+
+	// warnings describe how the file was upgraded from an older version
+	warnings []string
+}
+
+// Warnings returns what was changed to upgrade the configuration from an
+// older version, for the operator to update the file
+func (c *Config) Warnings() []string {
+	return c.warnings
 }
 
 // StorageConfig holds the storage service specific configuration
@@ -17,65 +24,826 @@ type StorageConfig struct {
 	Cluster     ClusterConfig     `yaml:"cluster"`
 	Replication ReplicationConfig `yaml:"replication"`
 	Local       LocalConfig       `yaml:"local"`
+	Tuning      TuningConfig      `yaml:"tuning"`
+	Admin       AdminConfig       `yaml:"admin"`
+	Logging     LoggingConfig     `yaml:"logging"`
+	Tracing     TracingConfig     `yaml:"tracing"`
+	Discovery   DiscoveryConfig   `yaml:"discovery"`
+	Coordinator CoordinatorConfig `yaml:"coordinator"`
+	Limits      LimitsConfig      `yaml:"limits"`
+	Auth        AuthConfig        `yaml:"auth"`
+	ACL         ACLConfig         `yaml:"acl"`
+	Jobs        JobsConfig        `yaml:"jobs"`
+	Audit       AuditConfig       `yaml:"audit"`
+	Gateway     GatewayConfig     `yaml:"gateway"`
+	// GeoReplication ships the writes of chosen namespaces to a remote
+	// cluster
+	GeoReplication GeoReplicationConfig `yaml:"geo_replication"`
+	// Usage accounts for the bytes each namespace stores and transfers and
+	// the requests it makes
+	Usage UsageConfig `yaml:"usage"`
+	// Events publishes cluster events to webhooks, Kafka and NATS
+	Events EventsConfig `yaml:"events"`
+	// CDC logs the block mutations the node commits for consumers to tail
+	CDC CDCConfig `yaml:"cdc"`
+	// Cache sizes the blocks a node in the cache role keeps
+	Cache CacheConfig `yaml:"cache"`
+	// WriteBack acknowledges small writes once buffered on a fast local
+	// device, writing them through their chains later in batches
+	WriteBack WriteBackConfig `yaml:"write_back"`
+	// Compression compresses small blocks with dictionaries trained per
+	// namespace
+	Compression CompressionConfig `yaml:"compression"`
+	// FeatureFlags enables experimental subsystems on this node
+	FeatureFlags FeatureFlags `yaml:"feature_flags"`
 }
 
 // NodeConfig holds the configuration for this specific node
 type NodeConfig struct {
-	ID            string `yaml:"id"`
+	// ID names the node in the cluster; it must be unique
+	ID string `yaml:"id"`
+	// ListenAddress is the host:port the data port listens on
 	ListenAddress string `yaml:"listen_address"`
+	// DrainTimeout bounds how long shutdown waits for in-flight requests
+	// and chain commits
+	DrainTimeout Duration `yaml:"drain_timeout"`
+	// Zone, Rack and Host label the failure domains the node is deployed
+	// in, from the widest to the narrowest. Host names the machine, for
+	// several nodes sharing one; it defaults to the node itself.
+	Zone string `yaml:"zone"`
+	Rack string `yaml:"rack"`
+	Host string `yaml:"host"`
+	// AdvertiseAddress is the data address announced to the cluster when
+	// it differs from ListenAddress (for example 0.0.0.0)
+	AdvertiseAddress string `yaml:"advertise_address"`
+	// Labels describe the node to placement rules, such as media: nvme
+	Labels map[string]string `yaml:"labels"`
+	// Role is storage, for a node holding chain replicas, or cache, for a
+	// node holding none that serves reads of hot blocks on behalf of their
+	// chains; defaults to storage
+	Role string `yaml:"role"`
 }
 
 // ClusterConfig holds the configuration for the storage cluster
 type ClusterConfig struct {
+	// Nodes lists the nodes of a static cluster, this one included
 	Nodes []NodeInfo `yaml:"nodes"`
+	// Join makes the node join through the coordinator on start, syncing
+	// the data of its assigned chains before it serves requests
+	Join bool `yaml:"join"`
 }
 
 // NodeInfo represents information about a node in the cluster
 type NodeInfo struct {
-	ID      string `yaml:"id"`
+	// ID is the node's storage.node.id
+	ID string `yaml:"id"`
+	// Address is the node's data address, as host:port
 	Address string `yaml:"address"`
+	// AdminAddress is the node's admin API, used by the coordinator to
+	// collect usage for rebalancing
+	AdminAddress string `yaml:"admin_address"`
+	// Targets lists the IDs of the node's storage targets when it has
+	// more than one
+	Targets []string `yaml:"targets"`
+	// Zone, Rack and Host are the node's failure domain labels, as in
+	// NodeConfig
+	Zone string `yaml:"zone"`
+	Rack string `yaml:"rack"`
+	Host string `yaml:"host"`
+	// Labels are the node's labels, as in NodeConfig
+	Labels map[string]string `yaml:"labels"`
+	// Role is the node's role, as in NodeConfig
+	Role string `yaml:"role"`
 }
 
 // ReplicationConfig holds the configuration for data replication
 type ReplicationConfig struct {
-	Factor     int `yaml:"factor"`
+	// Factor is the number of replicas kept of each block
+	Factor int `yaml:"factor"`
+	// ChainLength is the number of nodes in each replication chain, at
+	// least the factor
+	ChainLength int `yaml:"chain_length"`
+	// RepairConcurrency is the number of blocks re-replicated in parallel
+	RepairConcurrency int `yaml:"repair_concurrency"`
+	// RepairBandwidth caps re-replication traffic per second; zero means
+	// unlimited
+	RepairBandwidth Size `yaml:"repair_bandwidth"`
+	// RepairInterval is how often a full repair pass runs in addition to
+	// the passes triggered by routing changes
+	RepairInterval Duration `yaml:"repair_interval"`
+	// Consistency is when writes are acknowledged: eventual, once the
+	// target they reach stores them, or strong, once the chain members
+	// needed for the factor do. Defaults to eventual.
+	Consistency string `yaml:"consistency"`
+	// Namespaces gives namespaces a replication policy of their own, by
+	// namespace name; their blocks are kept on chains of their own
+	Namespaces map[string]NamespaceReplicationConfig `yaml:"namespaces"`
+}
+
+// NamespaceReplicationConfig is the replication policy of one namespace.
+// Fields left unset follow the cluster's settings.
+type NamespaceReplicationConfig struct {
+	// Factor, ChainLength and Consistency override the cluster's
+	// replication settings
+	Factor      int `yaml:"factor"`
 	ChainLength int `yaml:"chain_length"`
+	// NumChains is the number of chains of the namespace; zero uses
+	// coordinator.num_chains
+	NumChains   int    `yaml:"num_chains"`
+	Consistency string `yaml:"consistency"`
+	// Placement spreads the namespace's replicas; an unset failure domain
+	// or zone list follows coordinator.placement
+	Placement PlacementConfig `yaml:"placement"`
+	// Erasure erasure codes the namespace's blocks instead of replicating
+	// them, when its data shards are set
+	Erasure ErasureConfig `yaml:"erasure"`
+}
+
+// ErasureConfig holds the erasure coding of a namespace
+type ErasureConfig struct {
+	// Data is the number of shards a block is split into, and the number
+	// needed to rebuild it
+	Data int `yaml:"data"`
+	// Parity is the number of shards computed from the data shards, and
+	// the number that can be lost without losing the block
+	Parity int `yaml:"parity"`
+}
+
+// Enabled reports whether erasure coding is configured
+func (e ErasureConfig) Enabled() bool {
+	return e.Data > 0
 }
 
 // LocalConfig holds the configuration for local storage
 type LocalConfig struct {
-	DataPath   string `yaml:"data_path"`
-	MaxSpaceGB int    `yaml:"max_space_gb"`
+	// DataPath holds the node's own state, and its blocks when no targets
+	// are configured
+	DataPath string `yaml:"data_path"`
+	// MaxSpace is the size of targets that do not set their own
+	MaxSpace Size `yaml:"max_space"`
+	// Targets lists independent data directories, normally one per disk.
+	// Without targets, DataPath is the node's only target.
+	Targets []TargetConfig `yaml:"targets"`
+	// TargetCheckInterval is how often each target's disk is probed
+	TargetCheckInterval Duration `yaml:"target_check_interval"`
+}
+
+// TargetConfig holds the configuration for one storage target
+type TargetConfig struct {
+	// ID names the target in the routing table; it must be unique in the
+	// cluster. It defaults to the node's ID.
+	ID string `yaml:"id"`
+	// DataPath defaults to local.data_path
+	DataPath string `yaml:"data_path"`
+	// MaxSpace is the space the target may use; writes past it fail with
+	// api.ErrNoSpace. It defaults to local.max_space.
+	MaxSpace Size `yaml:"max_space"`
+	// RequireMount refuses a data path on the root filesystem, so that the
+	// blocks of a disk that failed to mount do not fill it
+	RequireMount bool `yaml:"require_mount"`
+	// FSType is the filesystem the data path must be on, such as xfs;
+	// empty accepts any
+	FSType string `yaml:"fs_type"`
+	// Device is the block device that must be mounted under the data path,
+	// possibly through a link such as /dev/disk/by-uuid/...; empty accepts
+	// any
+	Device string `yaml:"device"`
+	// Labels add to the node's labels for this target, such as the media
+	// of its disk
+	Labels map[string]string `yaml:"labels"`
+}
+
+// TuningConfig adapts the IO of each target to its disk. The defaults
+// suit NVMe drives; hard disks do better with fewer IO workers and writes
+// at a time.
+type TuningConfig struct {
+	// CacheSize caps the block cache of each target; zero means unlimited
+	CacheSize Size `yaml:"cache_size"`
+	// IOWorkers is the number of requests each target runs at the same
+	// time; zero uses the default of 64
+	IOWorkers int `yaml:"io_workers"`
+	// WriteConcurrency is the depth of each target's write pipeline: the
+	// writes and deletes it runs at the same time, at most io_workers;
+	// zero uses the default of 32
+	WriteConcurrency int `yaml:"write_concurrency"`
+	// FSync is when writes are synced to disk: wal syncs the write-ahead
+	// log before each write, always also syncs every block file, and never
+	// leaves it all to the OS; empty uses wal
+	FSync string `yaml:"fsync"`
+	// DirectIO reads and writes block files bypassing the page cache; it is
+	// only supported on Linux
+	DirectIO bool `yaml:"direct_io"`
+	// ScrubBandwidth caps the disk reads of scrubbing per second; zero
+	// means unlimited. jobs.schedule.scrub.bandwidth overrides it.
+	ScrubBandwidth Size `yaml:"scrub_bandwidth"`
+	// DiskQueueDepth is the number of disk operations each target runs at
+	// the same time, ordered by deadline when more are waiting; zero uses
+	// the default of 32
+	DiskQueueDepth int `yaml:"disk_queue_depth"`
+	// BackgroundDiskOps caps the disk operations of scrubs, fsck,
+	// deduplication and repair among them; zero uses the default of 2
+	BackgroundDiskOps int `yaml:"background_disk_ops"`
+	// ReadDeadline, WriteDeadline and BackgroundDeadline are how long a
+	// read, a write or a background operation waits for the disk before
+	// the operations with later deadlines; zero uses the defaults of 20ms,
+	// 100ms and 2s
+	ReadDeadline       Duration `yaml:"read_deadline"`
+	WriteDeadline      Duration `yaml:"write_deadline"`
+	BackgroundDeadline Duration `yaml:"background_deadline"`
+	// Affinity pins the node's network and disk workers to CPUs
+	Affinity AffinityConfig `yaml:"affinity"`
+	// MemoryLimit is one budget for the memory of the block caches, the
+	// write-back buffer, request and response data and the cache node's
+	// refetches; zero leaves each to its own limit
+	MemoryLimit Size `yaml:"memory_limit"`
+	// MemoryWait is how long a request waits for the budget to hold its
+	// data before it is refused as backpressure; zero uses the default of
+	// 1s
+	MemoryWait Duration `yaml:"memory_wait"`
+}
+
+// AffinityConfig pins the workers serving the data port and each target's
+// disk to CPUs, by default those of the NUMA node of the network interface
+// or the disk, for servers with several sockets
+type AffinityConfig struct {
+	// Enabled runs requests and disk operations on pinned workers
+	Enabled bool `yaml:"enabled"`
+	// NetworkCPUs is the CPU list of the data port's workers, such as
+	// "0-15"; empty uses the NUMA node of the interface with the listen or
+	// advertise address
+	NetworkCPUs string `yaml:"network_cpus"`
+	// NetworkWorkers is the number of requests the data port's workers
+	// serve at the same time; zero uses io_workers for each target
+	NetworkWorkers int `yaml:"network_workers"`
+	// TargetCPUs maps a target ID to the CPU list of its disk workers; the
+	// targets left out use the NUMA node of their disk
+	TargetCPUs map[string]string `yaml:"target_cpus"`
+}
+
+// AdminConfig holds the configuration for the admin HTTP API
+type AdminConfig struct {
+	// ListenAddress is where the admin API listens; empty disables it
+	ListenAddress string `yaml:"listen_address"`
+}
+
+// LoggingConfig holds the configuration for structured logging
+type LoggingConfig struct {
+	// Level is one of debug, info, warn or error
+	Level string `yaml:"level"`
+	// Format is either text or json
+	Format string `yaml:"format"`
+	// StatsInterval is how often a storage node logs its stats; zero uses
+	// the default of 1m and a negative value disables the line
+	StatsInterval Duration `yaml:"stats_interval"`
+	// Output is stderr (the default), stdout, or the path of a log file
+	Output string `yaml:"output"`
+	// MaxSize is the size at which a log file is rotated; zero uses the
+	// default of 100MiB
+	MaxSize Size `yaml:"max_size"`
+	// MaxAge removes rotated log files older than this; zero keeps them
+	// whatever their age
+	MaxAge Duration `yaml:"max_age"`
+	// MaxFiles is the number of rotated log files kept; zero keeps them
+	// all
+	MaxFiles int `yaml:"max_files"`
+	// Components overrides the level of individual components, such as
+	// craq: debug
+	Components map[string]string `yaml:"components"`
+}
+
+// TracingConfig holds the configuration for OpenTelemetry tracing
+type TracingConfig struct {
+	// Enabled exports traces of client requests and chain replication
+	Enabled bool `yaml:"enabled"`
+	// Exporter is either otlp (OTLP over HTTP) or stdout
+	Exporter string `yaml:"exporter"`
+	// Endpoint is the host:port of the OTLP collector
+	Endpoint string `yaml:"endpoint"`
+	// SampleRatio is the fraction of new traces recorded, from 0 to 1
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+// DiscoveryConfig holds the configuration for service discovery registration
+type DiscoveryConfig struct {
+	// Backend is etcd or consul; empty disables registration
+	Backend string `yaml:"backend"`
+	// Endpoints are the backend's HTTP endpoints, tried in order
+	Endpoints []string `yaml:"endpoints"`
+	// Prefix is the etcd key prefix or the Consul service name
+	Prefix string `yaml:"prefix"`
+	// TTL is how long a registration outlives the last keepalive, in
+	// whole seconds
+	TTL Duration `yaml:"ttl"`
+}
+
+// CoordinatorConfig holds the configuration for the chain coordinator
+type CoordinatorConfig struct {
+	// Enabled runs the coordinator embedded in this node, served from the
+	// admin API
+	Enabled bool `yaml:"enabled"`
+	// StatePath is where the coordinator persists the chain table;
+	// defaults to coordinator.json in the data path
+	StatePath string `yaml:"state_path"`
+	// NumChains is the number of replication chains in the cluster
+	NumChains int `yaml:"num_chains"`
+	// Hashing is how a new routing table maps blocks to chains: ring, by
+	// consistent hashing, or modulo. Defaults to ring; a table keeps the
+	// hashing it was created with.
+	Hashing string `yaml:"hashing"`
+	// Addresses are the admin addresses of the nodes running the
+	// coordinator, used to fetch routing information
+	Addresses []string `yaml:"addresses"`
+	// RefreshInterval is how often the routing table is polled
+	RefreshInterval Duration `yaml:"refresh_interval"`
+	// HeartbeatInterval is how often the node reports its capacity and
+	// load
+	HeartbeatInterval Duration `yaml:"heartbeat_interval"`
+	// Rebalance configures the rebalancer run by the embedded coordinator
+	Rebalance RebalanceConfig `yaml:"rebalance"`
+	// Election elects one leader among several nodes running the embedded
+	// coordinator
+	Election ElectionConfig `yaml:"election"`
+	// FailureDetector tunes how the embedded coordinator detects failed
+	// nodes from their heartbeats
+	FailureDetector FailureDetectorConfig `yaml:"failure_detector"`
+	// Placement spreads the replicas of each chain over failure domains
+	Placement PlacementConfig `yaml:"placement"`
+	// PlacementRules constrain the nodes chain members are placed on, on
+	// top of the placement policies
+	PlacementRules []PlacementRuleConfig `yaml:"placement_rules"`
+	// Balance skews new chain members and object blocks towards emptier,
+	// less busy nodes
+	Balance BalanceConfig `yaml:"balance"`
+}
+
+// BalanceConfig weighs how full and how busy nodes are when the embedded
+// coordinator places chain members. Leaving the section out uses the
+// default weights; a section that is set takes its weights as given, so
+// a zero weight ignores that input.
+type BalanceConfig struct {
+	// FullnessWeight is how much a full node costs over an empty one
+	FullnessWeight float64 `yaml:"fullness_weight"`
+	// WriteWeight is how much the busiest node costs over an idle one
+	WriteWeight float64 `yaml:"write_weight"`
+	// MaxFullness is the fraction of its capacity above which a node only
+	// gets new data when no other node can take it
+	MaxFullness float64 `yaml:"max_fullness"`
+}
+
+// PlacementConfig holds the chain placement policy of the embedded
+// coordinator
+type PlacementConfig struct {
+	// FailureDomain is host, rack or zone; the replicas of a chain are
+	// placed in different domains. Defaults to host.
+	FailureDomain string `yaml:"failure_domain"`
+	// Strict leaves chains short of members rather than place two
+	// replicas in one domain
+	Strict bool `yaml:"strict"`
+	// Zones restricts chain members to nodes in these zones; empty allows
+	// any zone
+	Zones []string `yaml:"zones"`
+}
+
+// PlacementRuleConfig is a placement rule of the embedded coordinator
+type PlacementRuleConfig struct {
+	// Name identifies the rule in placement explanations
+	Name string `yaml:"name"`
+	// Type is spread, fullness, labels or avoid_labels
+	Type string `yaml:"type"`
+	// Namespaces are the namespaces whose chains the rule applies to;
+	// empty applies it to every chain
+	Namespaces []string `yaml:"namespaces"`
+	// Domain is the failure domain a spread rule keeps members apart in:
+	// host, rack or zone
+	Domain string `yaml:"domain"`
+	// MaxFullness is the fraction of its capacity a node may have used for
+	// a fullness rule to place members on it, such as 0.85
+	MaxFullness float64 `yaml:"max_fullness"`
+	// Labels are the node labels a labels rule requires all of, and an
+	// avoid_labels rule refuses any of
+	Labels map[string]string `yaml:"labels"`
+	// Soft lets the rule be broken when no node satisfies it
+	Soft bool `yaml:"soft"`
+}
+
+// FailureDetectorConfig holds the settings of the phi-accrual failure
+// detector. Phi is the suspicion level of a node: a phi of 1 means a 10%
+// chance that a heartbeat is still coming, 2 a 1% chance, and so on.
+type FailureDetectorConfig struct {
+	// SuspectPhi is the level at which a node is flagged as suspect
+	SuspectPhi float64 `yaml:"suspect_phi"`
+	// DownPhi is the level at which a node is marked down; negative only
+	// flags nodes as suspect
+	DownPhi float64 `yaml:"down_phi"`
+	// Window is the number of recent heartbeat intervals kept per node
+	Window int `yaml:"window"`
+	// MinStdDev is the least deviation of heartbeat intervals assumed
+	MinStdDev Duration `yaml:"min_std_dev"`
+	// AcceptablePause is how late a heartbeat may be before suspicion
+	// rises quickly
+	AcceptablePause Duration `yaml:"acceptable_pause"`
+}
+
+// ElectionConfig holds the leader election settings of the embedded
+// coordinator
+type ElectionConfig struct {
+	// Enabled elects a leader among the coordinators; it requires
+	// coordinator.enabled
+	Enabled bool `yaml:"enabled"`
+	// Peers are the admin addresses of the nodes running the coordinator;
+	// defaults to coordinator.addresses. This node's own address may be
+	// listed.
+	Peers []string `yaml:"peers"`
+	// Lease is how long a leader leads without renewing its lease, and so
+	// bounds failover time
+	Lease Duration `yaml:"lease"`
+}
+
+// RebalanceConfig holds the configuration for the cluster rebalancer
+type RebalanceConfig struct {
+	// Enabled moves chains off the fullest nodes; it requires
+	// coordinator.enabled
+	Enabled bool `yaml:"enabled"`
+	// Interval is how often data skew is checked; zero only rebalances
+	// when triggered through the admin API
+	Interval Duration `yaml:"interval"`
+	// Threshold is how far above the average, as a fraction, the fullest
+	// node may be before chains are moved
+	Threshold float64 `yaml:"threshold"`
+	// MaxMoves caps the number of chain moves per pass
+	MaxMoves int `yaml:"max_moves"`
+	// Concurrency is the number of chain moves run in parallel
+	Concurrency int `yaml:"concurrency"`
+	// Bandwidth caps the copy traffic of all moves per second; zero means
+	// unlimited
+	Bandwidth Size `yaml:"bandwidth"`
+}
+
+// LimitsConfig holds the per-client limits enforced by a node
+type LimitsConfig struct {
+	// Default applies to every client without an override
+	Default ClientLimits `yaml:"default"`
+	// Clients overrides the limits of individual client identities
+	Clients map[string]ClientLimits `yaml:"clients"`
+	// PeerBandwidth caps the blocks other nodes fetch from this node for
+	// repair and recovery, per second; zero means unlimited. These fetches
+	// are not charged to the fetching node's client limits.
+	PeerBandwidth Size `yaml:"peer_bandwidth"`
+}
+
+// ClientLimits caps what a single client may use of a node. Zero values
+// mean unlimited.
+type ClientLimits struct {
+	// RequestsPerSecond caps the requests of the client; requests above it
+	// are refused
+	RequestsPerSecond float64 `yaml:"requests_per_second"`
+	// Bandwidth caps request and response payloads per second
+	Bandwidth Size `yaml:"bandwidth"`
+	// MaxConnections caps the client's open connections
+	MaxConnections int `yaml:"max_connections"`
+}
+
+// AuthConfig holds the authentication settings of the client-facing API
+type AuthConfig struct {
+	// Mode is off (the default) or secure. In secure mode clients must
+	// present a token or a verified client certificate.
+	Mode string `yaml:"mode"`
+	// AllowAnonymous lets clients without credentials in, even in secure
+	// mode
+	AllowAnonymous bool `yaml:"allow_anonymous"`
+	// Tokens are the accepted bearer tokens
+	Tokens []TokenConfig `yaml:"tokens"`
+	// TLS enables TLS, and optionally client certificates, on the data port
+	TLS TLSConfig `yaml:"tls"`
+	// PeerToken is the token this node presents to other nodes
+	PeerToken string `yaml:"peer_token" secret:"true"`
+}
+
+// ACLConfig holds the per-namespace access rules. A block's namespace is
+// the part of its ID before the first colon, or "default".
+type ACLConfig struct {
+	// Enabled denies every operation that no rule allows
+	Enabled bool `yaml:"enabled"`
+	// Rules grant operations to identities, each within a namespace
+	Rules []ACLRule `yaml:"rules"`
+}
+
+// ACLRule grants operations to an identity within a namespace
+type ACLRule struct {
+	// Identity is a client identity, "anonymous", or "*" for everyone
+	Identity string `yaml:"identity"`
+	// Namespace is a namespace or "*" for all of them
+	Namespace string `yaml:"namespace"`
+	// Operations are any of read, write, delete and admin (all operations)
+	Operations []string `yaml:"operations"`
+}
+
+// AuditConfig holds the settings of the audit log, which records admin
+// operations and client deletes
+type AuditConfig struct {
+	// Enabled records admin operations and client deletes
+	Enabled bool `yaml:"enabled"`
+	// Path is the audit log file; it defaults to audit.log in the node's
+	// data path
+	Path string `yaml:"path"`
+	// MaxSize is the size at which the log is rotated; zero uses the
+	// default of 100MiB
+	MaxSize Size `yaml:"max_size"`
+	// MaxFiles is the number of rotated files kept; zero keeps them all
+	MaxFiles int `yaml:"max_files"`
 }
 
-// LoadConfig loads the configuration from a given file path
+// GatewayConfig holds the settings of the S3-compatible gateway, which
+// serves the node's objects over HTTP on a listener of its own
+type GatewayConfig struct {
+	// ListenAddress is where the gateway listens; empty disables it
+	ListenAddress string `yaml:"listen_address"`
+	// Region is the region clients sign their requests for
+	Region string `yaml:"region"`
+	// Domain serves virtual-hosted-style requests, which name the bucket
+	// in the host (bucket.domain); path-style requests are always served
+	Domain string `yaml:"domain"`
+	// Buckets lists the buckets served. Each keeps its objects in the
+	// block namespace of the same name, where the ACL and the namespace's
+	// replication policy apply.
+	Buckets []string `yaml:"buckets"`
+	// Credentials are the access keys clients sign requests with
+	Credentials []S3CredentialConfig `yaml:"credentials"`
+	// Anonymous serves unsigned requests as the anonymous identity
+	Anonymous bool `yaml:"anonymous"`
+	// StripeWidth is the number of blocks of an object written and read
+	// in parallel; zero or one reads and writes them one at a time
+	StripeWidth int `yaml:"stripe_width"`
+	// Metadata keeps the buckets' manifests in a metadata service
+	Metadata MetadataConfig `yaml:"metadata"`
+}
+
+// MetadataConfig selects the metadata service an object store keeps its
+// manifests in, by name, so that objects can be renamed atomically and
+// listed without listing blocks. Every client of a namespace must use the
+// same service.
+type MetadataConfig struct {
+	// Backend is "embedded", a key-value store kept in the namespace's own
+	// blocks, or "etcd"; empty keeps manifests in blocks
+	Backend string `yaml:"backend"`
+	// Endpoints are etcd's HTTP endpoints, tried in order
+	Endpoints []string `yaml:"endpoints"`
+	// Prefix is the etcd key prefix the namespaces' keys are kept under
+	Prefix string `yaml:"prefix"`
+}
+
+// S3CredentialConfig maps an S3 access key to a client identity
+type S3CredentialConfig struct {
+	// AccessKey is the access key ID clients sign requests with
+	AccessKey string `yaml:"access_key"`
+	// SecretKey is the secret access key, or a secret reference
+	SecretKey string `yaml:"secret_key" secret:"true"`
+	// Identity is the client identity the ACL applies to; it defaults to
+	// the access key
+	Identity string `yaml:"identity"`
+}
+
+// GeoReplicationConfig holds the settings of asynchronous replication to a
+// remote cluster, such as a disaster recovery site in another datacenter.
+// Each node ships the blocks written through it.
+type GeoReplicationConfig struct {
+	// Remote is the admin addresses of the remote cluster's coordinator
+	// replicas; empty disables geo-replication
+	Remote []string `yaml:"remote"`
+	// Namespaces lists the namespaces whose blocks are replicated
+	Namespaces []string `yaml:"namespaces"`
+	// Token is the bearer token presented to the remote cluster, or a
+	// secret reference
+	Token string `yaml:"token" secret:"true"`
+	// Bandwidth caps the traffic to the remote cluster per second, as sent
+	// after compression; zero means unlimited
+	Bandwidth Size `yaml:"bandwidth"`
+	// Compression is deflate or none; empty uses deflate
+	Compression string `yaml:"compression"`
+	// Workers is the number of blocks shipped at the same time; zero uses
+	// the default of 4
+	Workers int `yaml:"workers"`
+}
+
+// UsageConfig holds the settings of usage accounting. Nodes report the use
+// of each namespace to the coordinator, which adds the reports up into
+// windows of time.
+type UsageConfig struct {
+	// ReportInterval is how often the node reports to the coordinator;
+	// defaults to 1m
+	ReportInterval Duration `yaml:"report_interval"`
+	// Window is the span of time the embedded coordinator adds usage up
+	// over; defaults to 1h
+	Window Duration `yaml:"window"`
+	// Retention is how long the embedded coordinator keeps windows;
+	// defaults to 30d
+	Retention Duration `yaml:"retention"`
+	// Export sends the windows to billing and monitoring systems
+	Export UsageExportConfig `yaml:"export"`
+}
+
+// UsageExportConfig holds the sinks the embedded coordinator, while it is
+// the leader, exports a record of each namespace's use to as each export
+// window closes
+type UsageExportConfig struct {
+	// Window is the span of time each record covers, a multiple of the
+	// usage window; defaults to the usage window
+	Window Duration `yaml:"window"`
+	// Interval is how often closed windows are exported; defaults to 5m
+	Interval Duration `yaml:"interval"`
+	// CSV is the path of a CSV file records are appended to
+	CSV string `yaml:"csv"`
+	// Webhook is a URL the records of each window are posted to as JSON
+	Webhook string `yaml:"webhook"`
+	// WebhookToken is the bearer token presented to the webhook, or a
+	// secret reference
+	WebhookToken string `yaml:"webhook_token" secret:"true"`
+	// Prometheus serves the namespaces' totals as Prometheus metrics at
+	// /v1/coordinator/usage/metrics
+	Prometheus bool `yaml:"prometheus"`
+}
+
+// EventsConfig holds the sinks the node publishes cluster events to: the
+// node failures and chain changes its embedded coordinator makes while it
+// leads, and the corruption, quota breaches and drain completions of the
+// node itself
+type EventsConfig struct {
+	// Buffer is how many events may wait for each sink before further
+	// events are dropped for it; defaults to 1024
+	Buffer int `yaml:"buffer"`
+	// Sinks are where events are sent
+	Sinks []EventSinkConfig `yaml:"sinks"`
+}
+
+// EventSinkConfig holds one sink of cluster events
+type EventSinkConfig struct {
+	// Type is webhook, kafka or nats
+	Type string `yaml:"type"`
+	// URL is the URL events are posted to for a webhook, the URL of the
+	// Kafka REST proxy, or the nats:// address of a NATS server
+	URL string `yaml:"url"`
+	// Token is the bearer token of a webhook or Kafka REST proxy, or the
+	// auth token of a NATS server, or a secret reference
+	Token string `yaml:"token" secret:"true"`
+	// Topic is the Kafka topic events are produced to
+	Topic string `yaml:"topic"`
+	// Subject is the NATS subject events are published to; the event's
+	// type is appended to it
+	Subject string `yaml:"subject"`
+	// Events are the types of events sent; empty sends every type
+	Events []string `yaml:"events"`
+}
+
+// CDCConfig holds the settings of the change log: a durable, ordered log
+// of the writes and deletes of blocks the node committed, served at
+// /v1/cdc
+type CDCConfig struct {
+	// Enabled logs the node's block mutations
+	Enabled bool `yaml:"enabled"`
+	// Retention is how long records are kept; defaults to 7d
+	Retention Duration `yaml:"retention"`
+	// MaxSize caps the size of the log, dropping the oldest records past
+	// it; defaults to 1GiB
+	MaxSize Size `yaml:"max_size"`
+}
+
+// CacheConfig holds the settings of a cache node: how many blocks it keeps
+// in memory and on local disk, and how long a cached block is served
+// before its version is checked with its chain
+type CacheConfig struct {
+	// MemorySize bounds the blocks kept in memory; defaults to 1GiB
+	MemorySize Size `yaml:"memory_size"`
+	// DiskPath is the directory of the blocks kept on local disk, such as
+	// an SSD; empty keeps blocks in memory only
+	DiskPath string `yaml:"disk_path"`
+	// DiskSize bounds the blocks kept on disk; defaults to 10GiB
+	DiskSize Size `yaml:"disk_size"`
+	// MaxAge is how long a cached block is served without checking its
+	// version with its chain, bounding how stale a read can be should an
+	// invalidation be missed; defaults to 30s
+	MaxAge Duration `yaml:"max_age"`
+}
+
+// WriteBackConfig holds the settings of the write-back buffer. Buffered
+// writes are acknowledged before their chain has them, so only namespaces
+// with eventual consistency are buffered.
+type WriteBackConfig struct {
+	// Enabled buffers small writes
+	Enabled bool `yaml:"enabled"`
+	// Path is the directory of the buffer, on a fast device such as NVMe;
+	// defaults to writeback in the data path
+	Path string `yaml:"path"`
+	// MaxSize bounds the data buffered; writes arriving while the buffer is
+	// full are made directly. Defaults to 256MiB.
+	MaxSize Size `yaml:"max_size"`
+	// MaxBlockSize is the size of the largest write buffered; defaults to
+	// 64KiB
+	MaxBlockSize Size `yaml:"max_block_size"`
+	// BatchSize is the number of buffered writes flushed together;
+	// defaults to 64
+	BatchSize int `yaml:"batch_size"`
+	// FlushInterval is how long writes may wait to be flushed in a fuller
+	// batch; defaults to 100ms
+	FlushInterval Duration `yaml:"flush_interval"`
+}
+
+// CompressionConfig holds the settings of block compression. With
+// dictionaries, a background job trains a zstd dictionary for each
+// namespace from a sample of its small blocks on each target, and the
+// small blocks written to the namespace afterwards are stored compressed
+// with it.
+type CompressionConfig struct {
+	// Dictionaries enables training dictionaries and compressing with them
+	Dictionaries bool `yaml:"dictionaries"`
+	// Namespaces limits training to these namespaces; empty trains every
+	// namespace with enough small blocks
+	Namespaces []string `yaml:"namespaces"`
+	// MaxBlockSize is the size of the largest block sampled and compressed;
+	// defaults to 64KiB
+	MaxBlockSize Size `yaml:"max_block_size"`
+	// DictionarySize is the size of the dictionaries trained; defaults to
+	// 112KiB
+	DictionarySize Size `yaml:"dictionary_size"`
+	// SampleSize bounds the data sampled per namespace; defaults to 16MiB
+	SampleSize Size `yaml:"sample_size"`
+	// MinSamples is the fewest small blocks a namespace is trained from;
+	// defaults to 256
+	MinSamples int `yaml:"min_samples"`
+}
+
+// JobsConfig holds the settings of the background job scheduler, which
+// runs scrub, garbage collection, repair and rebalancing
+type JobsConfig struct {
+	// MaxConcurrent is the number of jobs that may run at the same time
+	MaxConcurrent int `yaml:"max_concurrent"`
+	// Schedule overrides the defaults of individual jobs, by job name
+	Schedule map[string]JobConfig `yaml:"schedule"`
+}
+
+// JobConfig holds the schedule and IO budget of one background job
+type JobConfig struct {
+	// Interval is how often the job runs; zero keeps the job's default
+	// and a negative value only runs it on demand
+	Interval Duration `yaml:"interval"`
+	// Window restricts scheduled runs to a daily range of local time such
+	// as "22:00-06:00"; runs still going when it closes are stopped
+	Window string `yaml:"window"`
+	// Bandwidth caps the job's disk and network traffic per second; zero
+	// keeps the job's default
+	Bandwidth Size `yaml:"bandwidth"`
+}
+
+// TokenConfig maps a bearer token to a client identity
+type TokenConfig struct {
+	// Identity is the client identity the token authenticates
+	Identity string `yaml:"identity"`
+	// Token is the bearer token itself, or a secret reference
+	Token string `yaml:"token" secret:"true"`
+}
+
+// TLSConfig holds TLS certificate settings
+type TLSConfig struct {
+	// CertFile is the path of the node's certificate
+	CertFile string `yaml:"cert_file"`
+	// KeyFile is the path of the private key, or a secret reference
+	// supplying the PEM key itself
+	KeyFile string `yaml:"key_file" secret:"true"`
+	// ClientCAFile verifies client certificates; the certificate's common
+	// name becomes the client identity. Nodes also trust it for their peers.
+	ClientCAFile string `yaml:"client_ca_file"`
+	// RequireClientCert rejects TLS connections without a client certificate
+	RequireClientCert bool `yaml:"require_client_cert"`
+}
+
+// LoadConfig loads the configuration from a given file path. The file is
+// read as JSON or TOML if its extension is .json or .toml, and as YAML
+// otherwise.
 func LoadConfig(configPath string) (*Config, error) {
-	configFile, err := os.ReadFile(configPath)
-	if err != nil {
+	return Load(context.Background(), FileSource(configPath))
+}
+
+// finish applies the environment and command line overrides to a decoded
+// configuration, resolves its secrets and validates it
+func finish(config *Config) (*Config, error) {
+	// Apply environment variable overrides if any
+	if err := applyEnvironmentOverrides(config); err != nil {
 		return nil, err
 	}
 
-	var config Config
-	if err := yaml.Unmarshal(configFile, &config); err != nil {
+	// Command line overrides take precedence over the environment
+	if err := applyOverrides(config); err != nil {
 		return nil, err
 	}
 
-	// Apply environment variable overrides if any
-	applyEnvironmentOverrides(&config)
-
-	return &config, nil
-}
-
-// applyEnvironmentOverrides allows overriding config values with environment variables
-func applyEnvironmentOverrides(config *Config) {
-	// Examples of environment variables that could override config:
-	if nodeID := os.Getenv("STORAGE_NODE_ID"); nodeID != "" {
-		config.Storage.Node.ID = nodeID
-	}
-	if listenAddr := os.Getenv("STORAGE_LISTEN_ADDRESS"); listenAddr != "" {
-		config.Storage.Node.ListenAddress = listenAddr
+	// Replace secret references with the secrets themselves
+	if err := resolveSecrets(config); err != nil {
+		return nil, err
 	}
-	if dataPath := os.Getenv("STORAGE_DATA_PATH"); dataPath != "" {
-		config.Storage.Local.DataPath = dataPath
+
+	// Fill in defaults and report every invalid field up front
+	if err := config.Validate(); err != nil {
+		return nil, err
 	}
-} 
\ No newline at end of file
+
+	return config, nil
+}
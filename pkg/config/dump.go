@@ -0,0 +1,97 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// RedactedValue replaces the value of every secret in a dumped
+// configuration
+const RedactedValue = "<redacted>"
+
+// Redacted returns a copy of the configuration with the value of every
+// field tagged secret:"true" replaced by RedactedValue. Empty secrets stay
+// empty, so that a dump still shows which are unset.
+func (c *Config) Redacted() (*Config, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy config: %w", err)
+	}
+	var redacted Config
+	if err := yaml.Unmarshal(data, &redacted); err != nil {
+		return nil, fmt.Errorf("failed to copy config: %w", err)
+	}
+	redacted.warnings = c.warnings
+
+	walkSecrets(reflect.ValueOf(&redacted).Elem(), "", func(_ string, field reflect.Value) {
+		if field.String() != "" {
+			field.SetString(RedactedValue)
+		}
+	})
+	return &redacted, nil
+}
+
+// Dump encodes the configuration as it was resolved, with the file, its
+// includes, the environment and command line overrides and the defaults
+// applied and the secrets redacted. The dump is a file of the current
+// version, so that it can be compared with, or replace, the original.
+func (c *Config) Dump(format Format) ([]byte, error) {
+	redacted, err := c.Redacted()
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if format == FormatYAML {
+		// The version leads and the sections keep the order of the file
+		fmt.Fprintf(&buf, "%s: %d\n", VersionKey, CurrentVersion)
+		encoder := yaml.NewEncoder(&buf)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(redacted); err != nil {
+			return nil, fmt.Errorf("failed to encode YAML config: %w", err)
+		}
+		return buf.Bytes(), nil
+	}
+
+	// Other formats go through a generic tree, so that they use the field
+	// names of the YAML file
+	tree, err := configTree(redacted)
+	if err != nil {
+		return nil, err
+	}
+	tree[VersionKey] = CurrentVersion
+	switch format {
+	case FormatJSON:
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(tree); err != nil {
+			return nil, fmt.Errorf("failed to encode JSON config: %w", err)
+		}
+	case FormatTOML:
+		if err := toml.NewEncoder(&buf).Encode(tree); err != nil {
+			return nil, fmt.Errorf("failed to encode TOML config: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", format)
+	}
+	return buf.Bytes(), nil
+}
+
+// configTree converts a configuration to a generic tree
+func configTree(c *Config) (map[string]interface{}, error) {
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	tree := make(map[string]interface{})
+	if err := yaml.Unmarshal(data, &tree); err != nil {
+		return nil, fmt.Errorf("failed to encode config: %w", err)
+	}
+	return tree, nil
+}
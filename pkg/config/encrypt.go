@@ -0,0 +1,136 @@
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SecretEncrypted holds a secret encrypted with the node's config key, such
+// as enc://v1:AAECAw..., so that the file can be kept in configuration
+// management without exposing it
+const SecretEncrypted = "enc://"
+
+// DefaultKeyFile is where the node's config key is read from unless
+// KeyFileVariable names another file
+const DefaultKeyFile = "/etc/3fs-storage/config.key"
+
+// KeyFileVariable is the environment variable naming the node's config key
+// file
+const KeyFileVariable = "STORAGE_CONFIG_KEY_FILE"
+
+// KeySize is the size of a config key, for AES-256
+const KeySize = 32
+
+// encryptionVersion prefixes encrypted values, so that the scheme can change
+// without breaking existing files
+const encryptionVersion = "v1:"
+
+// encryptionContext binds encrypted values to their use, so that ciphertext
+// made with the same key for another purpose is not accepted
+var encryptionContext = []byte("3fs-storage config secret")
+
+// KeyFile returns the path of the node's config key file
+func KeyFile() string {
+	if path := os.Getenv(KeyFileVariable); path != "" {
+		return path
+	}
+	return DefaultKeyFile
+}
+
+// GenerateKey returns a new config key, encoded as it is stored in a key
+// file
+func GenerateKey() (string, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return "", fmt.Errorf("failed to generate config key: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ReadKey reads a config key file. The file must not be readable by other
+// users, as the key decrypts every secret of the configuration.
+func ReadKey(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config key: %w", err)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return nil, fmt.Errorf("config key %s is accessible by other users (mode %s), expected 0600", path, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config key: %w", err)
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != KeySize {
+		return nil, fmt.Errorf("config key %s must hold %d base64-encoded bytes", path, KeySize)
+	}
+	return key, nil
+}
+
+// EncryptSecret encrypts a secret with a config key, returning the value to
+// put in the configuration in its place
+func EncryptSecret(key []byte, secret string) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to encrypt secret: %w", err)
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(secret), encryptionContext)
+	return SecretEncrypted + encryptionVersion + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptSecret decrypts a value made by EncryptSecret with the same key
+func DecryptSecret(key []byte, value string) (string, error) {
+	encoded, ok := strings.CutPrefix(strings.TrimPrefix(value, SecretEncrypted), encryptionVersion)
+	if !ok {
+		return "", errors.New("unsupported encrypted value, expected enc://v1:...")
+	}
+	sealed, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("invalid encrypted value: too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	secret, err := aead.Open(nil, nonce, ciphertext, encryptionContext)
+	if err != nil {
+		return "", errors.New("failed to decrypt secret: it was encrypted with another key or altered")
+	}
+	return string(secret), nil
+}
+
+// decryptWithNodeKey decrypts a value with the node's config key
+func decryptWithNodeKey(value string) (string, error) {
+	key, err := ReadKey(KeyFile())
+	if err != nil {
+		return "", err
+	}
+	return DecryptSecret(key, value)
+}
+
+// newAEAD returns the AES-GCM cipher of a config key
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("config key must be %d bytes, got %d", KeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
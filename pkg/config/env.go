@@ -0,0 +1,187 @@
+package config
+
+import (
+	"encoding"
+	"fmt"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// legacyVariable is a variable read before every field could be
+// overridden, or named after a field that has since been renamed
+type legacyVariable struct {
+	// legacy is the variable's old name and name the one it now has
+	legacy, name string
+	// unit is appended to a number without one, for fields whose numbers
+	// had an implicit unit
+	unit string
+}
+
+// legacyEnvironment lists the variables that still work under their old
+// names. The new name wins if both are set, and of two old names the one
+// listed first.
+var legacyEnvironment = legacyVariables()
+
+// legacyVariables lists the old names of the fields renamed in config
+// version 4 to take units, then the older names
+func legacyVariables() []legacyVariable {
+	variables := make([]legacyVariable, 0, len(unitFields)+5)
+	for _, f := range unitFields {
+		variables = append(variables, legacyVariable{legacy: EnvironmentVariable(f.from), name: EnvironmentVariable(f.to), unit: f.unit})
+	}
+	return append(variables,
+		legacyVariable{legacy: "STORAGE_LISTEN_ADDRESS", name: "STORAGE_NODE_LISTEN_ADDRESS"},
+		legacyVariable{legacy: "STORAGE_DATA_PATH", name: "STORAGE_LOCAL_DATA_PATH"},
+		legacyVariable{legacy: "STORAGE_MAX_SPACE_GB", name: "STORAGE_LOCAL_MAX_SPACE", unit: "GiB"},
+		// Moved to the tuning section in config version 3
+		legacyVariable{legacy: "STORAGE_LOCAL_CACHE_MB", name: "STORAGE_TUNING_CACHE_SIZE", unit: "MiB"},
+		legacyVariable{legacy: "STORAGE_LOCAL_WRITE_CONCURRENCY", name: "STORAGE_TUNING_WRITE_CONCURRENCY"},
+	)
+}
+
+// EnvironmentVariable returns the name of the variable overriding a field,
+// given the field's path in the configuration file, such as
+// storage.local.max_space: STORAGE_LOCAL_MAX_SPACE
+func EnvironmentVariable(path string) string {
+	return strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// EnvironmentVariables returns the names of the variables that override
+// configuration fields, in the order of the fields
+func EnvironmentVariables() []string {
+	names := make([]string, 0)
+	walkFields(reflect.TypeOf(Config{}), func(path string, _ []int) {
+		names = append(names, EnvironmentVariable(path))
+	})
+	return names
+}
+
+// applyEnvironmentOverrides overrides configuration fields from environment
+// variables named after their path in the file: storage.node.id is
+// STORAGE_NODE_ID and storage.local.max_space is STORAGE_LOCAL_MAX_SPACE.
+// Lists of strings are comma-separated; other lists and maps take a YAML or
+// JSON value. Empty variables are ignored.
+func applyEnvironmentOverrides(config *Config) error {
+	aliases := make(map[string][]legacyVariable, len(legacyEnvironment))
+	for _, v := range legacyEnvironment {
+		aliases[v.name] = append(aliases[v.name], v)
+	}
+
+	root := reflect.ValueOf(config).Elem()
+	var errs []string
+	walkFields(root.Type(), func(path string, index []int) {
+		name := EnvironmentVariable(path)
+		value := os.Getenv(name)
+		for _, v := range aliases[name] {
+			if value != "" {
+				break
+			}
+			if value = os.Getenv(v.legacy); value != "" {
+				name = v.legacy
+				if number, unit := splitUnit(value); unit == "" && number != "" {
+					value += v.unit
+				}
+			}
+		}
+		if value == "" {
+			return
+		}
+		if err := setField(root.FieldByIndex(index), value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", name, err))
+		}
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid environment overrides: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// walkFields calls fn with the path and index of every field that can be
+// overridden. Nested sections are walked into; lists and maps are fields
+// of their own.
+func walkFields(t reflect.Type, fn func(path string, index []int)) {
+	var walk func(t reflect.Type, prefix string, index []int)
+	walk = func(t reflect.Type, prefix string, index []int) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" || !field.IsExported() {
+				continue
+			}
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			fieldIndex := append(append([]int(nil), index...), i)
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type, path, fieldIndex)
+				continue
+			}
+			fn(path, fieldIndex)
+		}
+	}
+	walk(t, "", nil)
+}
+
+// setField parses an environment variable's value into a field
+func setField(field reflect.Value, value string) error {
+	if u, ok := field.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return u.UnmarshalText([]byte(value))
+	}
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(i)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(value), "[") {
+			items := strings.Split(value, ",")
+			list := reflect.MakeSlice(field.Type(), 0, len(items))
+			for _, item := range items {
+				if item = strings.TrimSpace(item); item != "" {
+					list = reflect.Append(list, reflect.ValueOf(item))
+				}
+			}
+			field.Set(list)
+			return nil
+		}
+		return setYAML(field, value)
+	case reflect.Map:
+		return setYAML(field, value)
+	default:
+		return fmt.Errorf("cannot override a field of type %s", field.Type())
+	}
+	return nil
+}
+
+// setYAML decodes a YAML or JSON value into a list or map field, replacing
+// what the file set
+func setYAML(field reflect.Value, value string) error {
+	decoded := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(value), decoded.Interface()); err != nil {
+		return fmt.Errorf("invalid value: %v", err)
+	}
+	field.Set(decoded.Elem())
+	return nil
+}
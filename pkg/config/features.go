@@ -0,0 +1,78 @@
+package config
+
+import (
+	"sort"
+	"strings"
+)
+
+// Feature names an experimental subsystem gated by a feature flag
+type Feature string
+
+// Experimental subsystems. Each is off unless its flag is set, so that it
+// can be enabled node by node during a rollout.
+const (
+	// FeatureRDMA serves and connects to peers over the RDMA transport
+	// when the hardware supports it, instead of TCP only
+	FeatureRDMA Feature = "rdma"
+	// FeaturePackedSegments stores small blocks packed into large segment
+	// files instead of one file per block
+	FeaturePackedSegments Feature = "packed_segments"
+	// FeatureDedup stores blocks with the same content once
+	FeatureDedup Feature = "dedup"
+	// FeatureErasureCoding stores blocks as erasure coded shards instead of
+	// full replicas
+	FeatureErasureCoding Feature = "erasure_coding"
+)
+
+// Features lists every feature flag, in the order they are documented
+var Features = []Feature{FeatureRDMA, FeaturePackedSegments, FeatureDedup, FeatureErasureCoding}
+
+// known reports whether a flag names a feature
+func (f Feature) known() bool {
+	for _, feature := range Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// FeatureFlags enables experimental subsystems by name. A feature left out
+// is disabled. It is the one gate every experimental subsystem checks.
+type FeatureFlags map[string]bool
+
+// Enabled reports whether a feature is enabled
+func (f FeatureFlags) Enabled(feature Feature) bool {
+	return f[string(feature)]
+}
+
+// List returns the enabled features, sorted
+func (f FeatureFlags) List() []string {
+	enabled := make([]string, 0, len(f))
+	for name, on := range f {
+		if on {
+			enabled = append(enabled, name)
+		}
+	}
+	sort.Strings(enabled)
+	return enabled
+}
+
+// validateFeatureFlags checks that every flag names a feature
+func validateFeatureFlags(v *validator, f FeatureFlags) {
+	names := make([]string, 0, len(f))
+	for name := range f {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	known := make([]string, len(Features))
+	for i, feature := range Features {
+		known[i] = string(feature)
+	}
+	for _, name := range names {
+		if !Feature(name).known() {
+			v.add("storage.feature_flags."+name, "is not a feature; features are %s", strings.Join(known, ", "))
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Format is a configuration file format
+type Format string
+
+const (
+	// FormatYAML is the default format
+	FormatYAML Format = "yaml"
+	// FormatJSON suits configuration generated by tools such as
+	// Kubernetes operators and Terraform
+	FormatJSON Format = "json"
+	// FormatTOML is TOML
+	FormatTOML Format = "toml"
+)
+
+// DetectFormat returns the format of a configuration file from its
+// extension. Files with another extension, or none, are read as YAML.
+func DetectFormat(path string) Format {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return FormatJSON
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatYAML
+	}
+}
+
+// Parse decodes a configuration in the given format. Every format uses
+// the field names of the YAML file, so a configuration reads the same
+// whatever its format. The configuration is neither overridden from the
+// environment nor validated.
+func Parse(data []byte, format Format) (*Config, error) {
+	var config Config
+	if err := decode(data, format, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// decode decodes data into config. JSON and TOML are decoded into a
+// generic document first, which is then decoded as YAML, so that the
+// yaml tags are the only field names to maintain.
+func decode(data []byte, format Format, config *Config) error {
+	var doc map[string]interface{}
+	switch format {
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return fmt.Errorf("failed to parse YAML config: %w", err)
+		}
+		return nil
+	case FormatJSON:
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&doc); err != nil {
+			return fmt.Errorf("failed to parse JSON config: %w", err)
+		}
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &doc); err != nil {
+			return fmt.Errorf("failed to parse TOML config: %w", err)
+		}
+	default:
+		return fmt.Errorf("unsupported config format %q", format)
+	}
+
+	return decodeTree(normalize(doc).(map[string]interface{}), strings.ToUpper(string(format)), config)
+}
+
+// decodeTree decodes a generic document into config through YAML. name
+// describes the document in errors.
+func decodeTree(tree map[string]interface{}, name string, config *Config) error {
+	converted, err := yaml.Marshal(tree)
+	if err != nil {
+		return fmt.Errorf("failed to convert %s config: %w", name, err)
+	}
+	if err := yaml.Unmarshal(converted, config); err != nil {
+		// Line numbers refer to the converted document, not the file
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			problems := make([]string, len(typeErr.Errors))
+			for i, problem := range typeErr.Errors {
+				problems[i] = yamlLine.ReplaceAllString(problem, "")
+			}
+			return fmt.Errorf("invalid %s config: %s", name, strings.Join(problems, "; "))
+		}
+		return fmt.Errorf("invalid %s config: %w", name, err)
+	}
+	return nil
+}
+
+// yamlLine matches the line number prefix of a YAML decoding error
+var yamlLine = regexp.MustCompile(`^line \d+: `)
+
+// normalize prepares a decoded JSON or TOML document for YAML: JSON
+// numbers become integers where they are whole and floats otherwise, so
+// that they decode into int and float64 fields alike
+func normalize(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalize(item)
+		}
+		return v
+	case []map[string]interface{}:
+		items := make([]interface{}, len(v))
+		for i, item := range v {
+			items[i] = normalize(item)
+		}
+		return items
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalize(item)
+		}
+		return v
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1<<53 {
+			return int64(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
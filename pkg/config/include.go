@@ -0,0 +1,195 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// IncludesKey is the top-level key listing the documents a configuration
+// builds on. They are merged in order, and the document listing them is
+// merged last, so that a shared base holds the cluster's settings and each
+// node's file only what is particular to the node.
+const IncludesKey = "includes"
+
+// maxIncludeDepth bounds nested includes
+const maxIncludeDepth = 8
+
+// document is a configuration read from a source along with the documents
+// it includes
+type document struct {
+	data   []byte
+	format Format
+	// merged is the document upgraded and merged over its includes, or
+	// nil if it is current and includes nothing
+	merged map[string]interface{}
+	// digest covers every document read, so that an edit to any of them
+	// is noticed
+	digest [sha256.Size]byte
+	// warnings describe how older documents were upgraded
+	warnings []string
+}
+
+// readDocument reads a source and, recursively, the documents it includes
+func readDocument(ctx context.Context, source Source) (*document, error) {
+	data, err := source.Read(ctx)
+	if err != nil {
+		return nil, err
+	}
+	doc := &document{data: data, format: source.Format(), digest: sha256.Sum256(data)}
+
+	tree, err := parseTree(data, doc.format)
+	if err != nil {
+		return nil, err
+	}
+	migrated, warnings, err := migrate(tree, source)
+	if err != nil {
+		return nil, err
+	}
+	doc.warnings = warnings
+	if _, ok := tree[IncludesKey]; !ok {
+		if migrated {
+			doc.merged = tree
+		}
+		return doc, nil
+	}
+
+	digest := sha256.New()
+	doc.merged, err = resolveIncludes(ctx, source, tree, digest, map[string]bool{source.String(): true}, &doc.warnings)
+	if err != nil {
+		return nil, err
+	}
+	digest.Write(data)
+	copy(doc.digest[:], digest.Sum(nil))
+	return doc, nil
+}
+
+// resolveIncludes merges the documents a tree includes, then the tree
+// itself. seen holds the sources being read, to reject include cycles.
+// Included documents are upgraded to the current version on their own.
+func resolveIncludes(ctx context.Context, source Source, tree map[string]interface{}, digest hash.Hash, seen map[string]bool, warnings *[]string) (map[string]interface{}, error) {
+	if len(seen) > maxIncludeDepth {
+		return nil, fmt.Errorf("%s: includes are nested more than %d deep", source, maxIncludeDepth)
+	}
+
+	names, err := includeNames(tree[IncludesKey])
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", source, err)
+	}
+	delete(tree, IncludesKey)
+
+	merged := make(map[string]interface{})
+	for _, name := range names {
+		included := source.Include(name)
+		if seen[included.String()] {
+			return nil, fmt.Errorf("%s: include cycle through %s", source, included)
+		}
+
+		data, err := included.Read(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s included by %s: %w", included, source, err)
+		}
+		digest.Write(data)
+
+		includedTree, err := parseTree(data, included.Format())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", included, err)
+		}
+		_, migrationWarnings, err := migrate(includedTree, included)
+		if err != nil {
+			return nil, err
+		}
+		*warnings = append(*warnings, migrationWarnings...)
+		if _, ok := includedTree[IncludesKey]; ok {
+			seen[included.String()] = true
+			includedTree, err = resolveIncludes(ctx, included, includedTree, digest, seen, warnings)
+			delete(seen, included.String())
+			if err != nil {
+				return nil, err
+			}
+		}
+		merged = mergeTrees(merged, includedTree)
+	}
+	return mergeTrees(merged, tree), nil
+}
+
+// includeNames returns the names listed under the includes key
+func includeNames(value interface{}) ([]string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	items, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("%s must be a list of paths", IncludesKey)
+	}
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		name, ok := item.(string)
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("%s must be a list of paths", IncludesKey)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// parseTree decodes a document of any format into a generic tree
+func parseTree(data []byte, format Format) (map[string]interface{}, error) {
+	tree := make(map[string]interface{})
+	var err error
+	switch format {
+	case FormatYAML:
+		err = yaml.Unmarshal(data, &tree)
+	case FormatJSON:
+		decoder := json.NewDecoder(strings.NewReader(string(data)))
+		decoder.UseNumber()
+		err = decoder.Decode(&tree)
+	case FormatTOML:
+		err = toml.Unmarshal(data, &tree)
+	default:
+		return nil, fmt.Errorf("unsupported config format %q", format)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s config: %w", strings.ToUpper(string(format)), err)
+	}
+	if tree == nil {
+		tree = make(map[string]interface{})
+	}
+	return normalize(tree).(map[string]interface{}), nil
+}
+
+// mergeTrees merges overlay into base: sections are merged key by key and
+// any other value, lists included, is replaced
+func mergeTrees(base, overlay map[string]interface{}) map[string]interface{} {
+	for key, value := range overlay {
+		baseSection, baseOK := base[key].(map[string]interface{})
+		section, ok := value.(map[string]interface{})
+		if baseOK && ok {
+			base[key] = mergeTrees(baseSection, section)
+			continue
+		}
+		base[key] = value
+	}
+	return base
+}
+
+// load decodes the document, applies the environment and command line
+// overrides and validates the configuration
+func (d *document) load() (*Config, error) {
+	var config Config
+	if d.merged == nil {
+		if err := decode(d.data, d.format, &config); err != nil {
+			return nil, err
+		}
+	} else if err := decodeTree(d.merged, "merged", &config); err != nil {
+		return nil, err
+	}
+	config.warnings = d.warnings
+	return finish(&config)
+}
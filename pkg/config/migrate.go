@@ -0,0 +1,305 @@
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// VersionKey is the top-level key holding the layout version of a
+// configuration file. Files without it have version 1.
+const VersionKey = "version"
+
+// CurrentVersion is the layout version of this release. Older files are
+// upgraded when they are loaded, with a warning for every change, so that
+// upgrading the binary does not require editing every node's file.
+const CurrentVersion = 4
+
+// migration upgrades a configuration tree from one version to the next
+type migration struct {
+	// from is the version the migration upgrades
+	from int
+	// apply rewrites the tree and returns a warning for every change
+	apply func(tree map[string]interface{}) []string
+}
+
+// migrations upgrade each version to the next, in order
+var migrations = []migration{
+	{from: 1, apply: migrateSinglePath},
+	{from: 2, apply: migrateTuning},
+	{from: 3, apply: migrateUnits},
+}
+
+// unitField is a field whose number had an implicit unit up to version 3,
+// such as max_space_gb, and is now written with its unit
+type unitField struct {
+	from, to string
+	unit     string
+}
+
+// unitFields are the fields renamed in version 4 to take units
+var unitFields = []unitField{
+	{"storage.node.drain_timeout_seconds", "storage.node.drain_timeout", "s"},
+	{"storage.replication.repair_bandwidth_mb", "storage.replication.repair_bandwidth", "MiB"},
+	{"storage.replication.repair_interval_seconds", "storage.replication.repair_interval", "s"},
+	{"storage.local.max_space_gb", "storage.local.max_space", "GiB"},
+	{"storage.local.target_check_seconds", "storage.local.target_check_interval", "s"},
+	{"storage.tuning.cache_mb", "storage.tuning.cache_size", "MiB"},
+	{"storage.tuning.scrub_bandwidth_mb", "storage.tuning.scrub_bandwidth", "MiB"},
+	{"storage.logging.stats_interval_seconds", "storage.logging.stats_interval", "s"},
+	{"storage.logging.max_size_mb", "storage.logging.max_size", "MiB"},
+	{"storage.logging.max_age_days", "storage.logging.max_age", "d"},
+	{"storage.discovery.ttl_seconds", "storage.discovery.ttl", "s"},
+	{"storage.coordinator.refresh_seconds", "storage.coordinator.refresh_interval", "s"},
+	{"storage.coordinator.heartbeat_seconds", "storage.coordinator.heartbeat_interval", "s"},
+	{"storage.coordinator.failure_detector.min_std_dev_ms", "storage.coordinator.failure_detector.min_std_dev", "ms"},
+	{"storage.coordinator.failure_detector.acceptable_pause_seconds", "storage.coordinator.failure_detector.acceptable_pause", "s"},
+	{"storage.coordinator.election.lease_seconds", "storage.coordinator.election.lease", "s"},
+	{"storage.coordinator.rebalance.interval_seconds", "storage.coordinator.rebalance.interval", "s"},
+	{"storage.coordinator.rebalance.bandwidth_mb", "storage.coordinator.rebalance.bandwidth", "MiB"},
+	{"storage.limits.default.bandwidth_mb", "storage.limits.default.bandwidth", "MiB"},
+	{"storage.limits.peer_bandwidth_mb", "storage.limits.peer_bandwidth", "MiB"},
+	{"storage.audit.max_size_mb", "storage.audit.max_size", "MiB"},
+}
+
+// unitEntryFields are the fields renamed in version 4 within the entries
+// of lists and maps, by the path of the list or map
+var unitEntryFields = map[string][]unitField{
+	"storage.local.targets":  {{"max_space_gb", "max_space", "GiB"}},
+	"storage.limits.clients": {{"bandwidth_mb", "bandwidth", "MiB"}},
+	"storage.jobs.schedule": {
+		{"interval_seconds", "interval", "s"},
+		{"bandwidth_mb", "bandwidth", "MiB"},
+	},
+}
+
+// migrateUnits renames the fields of version 3 whose numbers had an
+// implicit unit, such as max_space_gb: 100, to fields written with their
+// unit, such as max_space: 100GiB
+func migrateUnits(tree map[string]interface{}) []string {
+	var warnings []string
+	for _, f := range unitFields {
+		if warning := convertField(tree, f.from, f.to, f.unit, f.from); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+
+	paths := make([]string, 0, len(unitEntryFields))
+	for path := range unitEntryFields {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		value, _ := lookupField(tree, path)
+		entries := make(map[string]map[string]interface{})
+		switch v := value.(type) {
+		case []interface{}:
+			for i, item := range v {
+				if entry, ok := item.(map[string]interface{}); ok {
+					entries[fmt.Sprintf("%s[%d]", path, i)] = entry
+				}
+			}
+		case map[string]interface{}:
+			for key, item := range v {
+				if entry, ok := item.(map[string]interface{}); ok {
+					entries[path+"."+key] = entry
+				}
+			}
+		}
+
+		names := make([]string, 0, len(entries))
+		for name := range entries {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			for _, f := range unitEntryFields[path] {
+				if warning := convertField(entries[name], f.from, f.to, f.unit, name+"."+f.from); warning != "" {
+					warnings = append(warnings, warning)
+				}
+			}
+		}
+	}
+	return warnings
+}
+
+// withUnit writes a number with the unit it was implicitly in, then as
+// the value of such a field would be written, such as 600s as 10m. A value
+// that does not parse is left for loading to report.
+func withUnit(number, unit string) string {
+	text := number + unit
+	switch unit {
+	case "ms", "s", "d":
+		if d, err := ParseDuration(text); err == nil {
+			return d.String()
+		}
+	default:
+		if size, err := ParseSize(text); err == nil {
+			return size.String()
+		}
+	}
+	return text
+}
+
+// convertField moves a number with an implicit unit to a field written
+// with its unit, as moveField does. name is the old field's path in
+// warnings.
+func convertField(tree map[string]interface{}, from, to, unit, name string) string {
+	value, ok := removeField(tree, from)
+	if !ok {
+		return ""
+	}
+	newName := strings.TrimSuffix(name, from) + to
+	if _, exists := lookupField(tree, to); exists {
+		return fmt.Sprintf("%s is ignored, as %s replaces it and is set", name, newName)
+	}
+	converted := value
+	switch v := value.(type) {
+	case int, int64, float64:
+		converted = withUnit(fmt.Sprint(v), unit)
+	case string:
+		if number, u := splitUnit(v); number != "" && u == "" {
+			converted = withUnit(number, unit)
+		}
+	}
+	setTreeField(tree, to, converted)
+	return fmt.Sprintf("%s: %v is now %s: %v", name, value, newName, converted)
+}
+
+// migrateTuning moves the IO settings of version 2 from storage.local to
+// the storage.tuning section
+func migrateTuning(tree map[string]interface{}) []string {
+	var warnings []string
+	for _, field := range []string{"cache_mb", "write_concurrency"} {
+		if warning := moveField(tree, "storage.local."+field, "storage.tuning."+field); warning != "" {
+			warnings = append(warnings, warning)
+		}
+	}
+	return warnings
+}
+
+// migrateSinglePath lists the data path of a version 1 node without
+// targets as its single target. Version 2 describes every disk as a
+// target, with its own mount expectations; the target takes the node's ID
+// and data path, so the node stores its blocks where it did before.
+func migrateSinglePath(tree map[string]interface{}) []string {
+	if _, ok := lookupField(tree, "storage.local.data_path"); !ok {
+		return nil
+	}
+	if targets, ok := lookupField(tree, "storage.local.targets"); ok {
+		if list, isList := targets.([]interface{}); !isList || len(list) > 0 {
+			return nil
+		}
+	}
+	setTreeField(tree, "storage.local.targets", []interface{}{map[string]interface{}{}})
+	return []string{"storage.local.data_path without targets is now listed as the single entry of storage.local.targets"}
+}
+
+// migrate upgrades a configuration tree to CurrentVersion. It reports
+// whether the tree was changed and warns about every change.
+func migrate(tree map[string]interface{}, source Source) (bool, []string, error) {
+	version, err := treeVersion(tree)
+	if err != nil {
+		return false, nil, fmt.Errorf("%s: %w", source, err)
+	}
+	delete(tree, VersionKey)
+
+	if version > CurrentVersion {
+		return false, nil, fmt.Errorf("%s: config version %d is newer than this release supports (%d)", source, version, CurrentVersion)
+	}
+	if version == CurrentVersion {
+		return false, nil, nil
+	}
+
+	var warnings []string
+	for _, m := range migrations {
+		if m.from < version {
+			continue
+		}
+		for _, warning := range m.apply(tree) {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", source, warning))
+		}
+	}
+	warnings = append(warnings, fmt.Sprintf("%s: upgraded from config version %d to %d; set %s: %d once the file is updated", source, version, CurrentVersion, VersionKey, CurrentVersion))
+	return true, warnings, nil
+}
+
+// treeVersion returns the version of a configuration tree
+func treeVersion(tree map[string]interface{}) (int, error) {
+	value, ok := tree[VersionKey]
+	if !ok || value == nil {
+		return 1, nil
+	}
+	version, ok := value.(int64)
+	if !ok {
+		if i, isInt := value.(int); isInt {
+			version, ok = int64(i), true
+		}
+	}
+	if !ok || version < 1 {
+		return 0, fmt.Errorf("%s must be a positive integer, got %v", VersionKey, value)
+	}
+	return int(version), nil
+}
+
+// moveField moves the value at one dotted path of a tree to another, for
+// renamed fields and moved sections. A value already at the new path wins
+// over the old one. It returns a warning if anything was found at the old
+// path.
+func moveField(tree map[string]interface{}, from, to string) string {
+	value, ok := removeField(tree, from)
+	if !ok {
+		return ""
+	}
+	if _, exists := lookupField(tree, to); exists {
+		return fmt.Sprintf("%s is ignored, as %s replaces it and is set", from, to)
+	}
+	setTreeField(tree, to, value)
+	return fmt.Sprintf("%s is now %s", from, to)
+}
+
+// lookupField returns the value at a dotted path of a tree
+func lookupField(tree map[string]interface{}, path string) (interface{}, bool) {
+	keys := strings.Split(path, ".")
+	section := tree
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := section[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		section = next
+	}
+	value, ok := section[keys[len(keys)-1]]
+	return value, ok
+}
+
+// removeField removes the value at a dotted path of a tree and returns it
+func removeField(tree map[string]interface{}, path string) (interface{}, bool) {
+	value, ok := lookupField(tree, path)
+	if !ok {
+		return nil, false
+	}
+	keys := strings.Split(path, ".")
+	section := tree
+	for _, key := range keys[:len(keys)-1] {
+		section = section[key].(map[string]interface{})
+	}
+	delete(section, keys[len(keys)-1])
+	return value, true
+}
+
+// setTreeField sets the value at a dotted path of a tree, creating the
+// sections on the way
+func setTreeField(tree map[string]interface{}, path string, value interface{}) {
+	keys := strings.Split(path, ".")
+	section := tree
+	for _, key := range keys[:len(keys)-1] {
+		next, ok := section[key].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			section[key] = next
+		}
+		section = next
+	}
+	section[keys[len(keys)-1]] = value
+}
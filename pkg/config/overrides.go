@@ -0,0 +1,108 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Overrides are field values given on the command line as path=value,
+// such as storage.local.max_space=500GiB. Values take the same form as
+// environment variables. Overrides implements flag.Value, so that a flag
+// can be repeated.
+type Overrides []string
+
+// String returns the overrides, comma-separated
+func (o *Overrides) String() string {
+	return strings.Join(*o, ",")
+}
+
+// Set adds an override after checking that it names a field and that the
+// value suits the field
+func (o *Overrides) Set(value string) error {
+	if _, err := parseOverride(value); err != nil {
+		return err
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+// override is a parsed path=value override
+type override struct {
+	path  string
+	index []int
+	value string
+}
+
+// overrides are the process's overrides, applied to every configuration
+// loaded after the environment variables
+var (
+	overrides   []override
+	overridesMu sync.Mutex
+)
+
+// SetOverrides sets the overrides applied to every configuration loaded
+// from now on, including reloads. They take precedence over the file and
+// the environment.
+func SetOverrides(o Overrides) error {
+	parsed := make([]override, 0, len(o))
+	for _, value := range o {
+		p, err := parseOverride(value)
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, p)
+	}
+
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	overrides = parsed
+	return nil
+}
+
+// parseOverride splits an override, finds the field it names and checks
+// that the value can be set
+func parseOverride(value string) (override, error) {
+	path, v, ok := strings.Cut(value, "=")
+	path = strings.TrimSpace(path)
+	if !ok || path == "" {
+		return override{}, fmt.Errorf("invalid override %q, expected path=value", value)
+	}
+
+	var index []int
+	walkFields(reflect.TypeOf(Config{}), func(fieldPath string, fieldIndex []int) {
+		if fieldPath == path {
+			index = fieldIndex
+		}
+	})
+	if index == nil {
+		return override{}, fmt.Errorf("invalid override %q: unknown field %s", value, path)
+	}
+
+	scratch := reflect.New(reflect.TypeOf(Config{})).Elem()
+	if err := setField(scratch.FieldByIndex(index), v); err != nil {
+		return override{}, fmt.Errorf("invalid override %s: %v", path, err)
+	}
+	return override{path: path, index: index, value: v}, nil
+}
+
+// applyOverrides applies the process's overrides to a configuration
+func applyOverrides(config *Config) error {
+	overridesMu.Lock()
+	defer overridesMu.Unlock()
+
+	root := reflect.ValueOf(config).Elem()
+	var errs []string
+	for _, o := range overrides {
+		if err := setField(root.FieldByIndex(o.index), o.value); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", o.path, err))
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid overrides: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
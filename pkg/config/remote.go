@@ -0,0 +1,320 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// remoteTimeout bounds a read from a configuration backend
+	remoteTimeout = 5 * time.Second
+	// remoteWait is how long a watch on a configuration backend waits for
+	// a change before it is renewed
+	remoteWait = 5 * time.Minute
+)
+
+// errUnreachable reports that no endpoint of a configuration backend
+// answered
+var errUnreachable = errors.New("no config endpoint reachable")
+
+// remoteSource reads the configuration from a key in etcd, through its v3
+// JSON gateway, or in the Consul KV store. A fallback file, when set, is
+// read while no endpoint is reachable, and is kept up to date with every
+// document the backend serves so that the node can also start during an
+// outage.
+type remoteSource struct {
+	backend   string
+	endpoints []string
+	key       string
+	fallback  string
+	client    *http.Client
+
+	mu         sync.Mutex
+	index      string
+	fellBack   bool
+	lastServed []byte
+}
+
+// newRemoteSource creates a source for a key of an etcd or Consul backend
+func newRemoteSource(backend string, endpoints []string, key, fallback string) *remoteSource {
+	return &remoteSource{
+		backend:   backend,
+		endpoints: endpoints,
+		key:       key,
+		fallback:  fallback,
+		// Requests are bounded by their contexts, as watches outlast any
+		// sensible client timeout
+		client: &http.Client{},
+	}
+}
+
+// Format returns the format of the key's extension
+func (s *remoteSource) Format() Format {
+	return DetectFormat(s.key)
+}
+
+// String names the backend and the key
+func (s *remoteSource) String() string {
+	return s.backend + ":" + s.key
+}
+
+// Include returns a key of the same backend, relative to the key's
+// directory unless it starts with a slash. Included keys have no fallback.
+func (s *remoteSource) Include(name string) Source {
+	key := strings.TrimPrefix(name, "/")
+	if !strings.HasPrefix(name, "/") {
+		key = path.Join(path.Dir(s.key), name)
+	}
+	return newRemoteSource(s.backend, s.endpoints, key, "")
+}
+
+// Read fetches the key, or reads the fallback file if no endpoint is
+// reachable
+func (s *remoteSource) Read(ctx context.Context) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, remoteTimeout)
+	defer cancel()
+
+	data, err := s.fetch(ctx)
+	if err == nil {
+		s.served(data)
+		return data, nil
+	}
+	if s.fallback == "" || !errors.Is(err, errUnreachable) {
+		return nil, err
+	}
+
+	data, fallbackErr := os.ReadFile(s.fallback)
+	if fallbackErr != nil {
+		return nil, fmt.Errorf("%w, and failed to read the fallback: %v", err, fallbackErr)
+	}
+
+	s.mu.Lock()
+	if !s.fellBack {
+		slog.Warn("config backend unreachable, using the fallback file", "source", s.String(), "fallback", s.fallback, "error", err)
+		s.fellBack = true
+	}
+	s.mu.Unlock()
+	return data, nil
+}
+
+// served records a document the backend served, saving it as the
+// fallback when it changed
+func (s *remoteSource) served(data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fellBack {
+		slog.Info("config backend reachable again", "source", s.String())
+		s.fellBack = false
+	}
+	if s.fallback == "" || bytes.Equal(data, s.lastServed) {
+		return
+	}
+	if err := writeFileAtomic(s.fallback, data); err != nil {
+		slog.Warn("failed to update the config fallback file", "fallback", s.fallback, "error", err)
+		return
+	}
+	s.lastServed = append([]byte(nil), data...)
+}
+
+// fetch reads the key from the backend and records its index
+func (s *remoteSource) fetch(ctx context.Context) ([]byte, error) {
+	if s.backend == "consul" {
+		resp, err := s.request(ctx, http.MethodGet, "/v1/kv/"+s.key+"?raw", nil)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config from consul: %w", err)
+		}
+		s.setIndex(resp.Header.Get("X-Consul-Index"))
+		return data, nil
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"key": base64.StdEncoding.EncodeToString([]byte(s.key)),
+	})
+	resp, err := s.request(ctx, http.MethodPost, "/v3/kv/range", body)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var rangeResp struct {
+		Header struct {
+			Revision string `json:"revision"`
+		} `json:"header"`
+		KVs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rangeResp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal etcd response: %w", err)
+	}
+	if len(rangeResp.KVs) == 0 {
+		return nil, fmt.Errorf("config key %s not found in etcd", s.key)
+	}
+	data, err := base64.StdEncoding.DecodeString(rangeResp.KVs[0].Value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode config from etcd: %w", err)
+	}
+	s.setIndex(rangeResp.Header.Revision)
+	return data, nil
+}
+
+// setIndex records the Consul index or etcd revision of the last read
+func (s *remoteSource) setIndex(index string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.index = index
+}
+
+// Wait blocks until the key changes after the last read: a Consul blocking
+// query or an etcd watch. It returns after remoteWait without a change.
+func (s *remoteSource) Wait(ctx context.Context) error {
+	s.mu.Lock()
+	index := s.index
+	s.mu.Unlock()
+	if index == "" {
+		return errors.New("config key has not been read from the backend")
+	}
+
+	// Consul adds jitter to its wait, so the request gets some slack
+	ctx, cancel := context.WithTimeout(ctx, remoteWait+remoteTimeout)
+	defer cancel()
+
+	if s.backend == "consul" {
+		query := fmt.Sprintf("/v1/kv/%s?index=%s&wait=%ds", s.key, url.QueryEscape(index), int(remoteWait.Seconds()))
+		resp, err := s.request(ctx, http.MethodGet, query, nil)
+		if err != nil {
+			return s.waitErr(ctx, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return nil
+	}
+
+	revision, err := strconv.ParseInt(index, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid etcd revision %q", index)
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"create_request": map[string]interface{}{
+			"key":            base64.StdEncoding.EncodeToString([]byte(s.key)),
+			"start_revision": strconv.FormatInt(revision+1, 10),
+		},
+	})
+	resp, err := s.request(ctx, http.MethodPost, "/v3/watch", body)
+	if err != nil {
+		return s.waitErr(ctx, err)
+	}
+	defer resp.Body.Close()
+
+	// The gateway streams one JSON object per watch response, the first
+	// confirming the watch was created
+	decoder := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Events   []json.RawMessage `json:"events"`
+				Canceled bool              `json:"canceled"`
+			} `json:"result"`
+		}
+		if err := decoder.Decode(&msg); err != nil {
+			return s.waitErr(ctx, err)
+		}
+		if len(msg.Result.Events) > 0 {
+			return nil
+		}
+		if msg.Result.Canceled {
+			return errors.New("etcd cancelled the config watch")
+		}
+	}
+}
+
+// waitErr turns the expiry of a wait into a normal return
+func (s *remoteSource) waitErr(ctx context.Context, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil
+	}
+	return err
+}
+
+// request sends a request to the first reachable endpoint and returns the
+// successful response, which the caller closes
+func (s *remoteSource) request(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var lastErr error
+	for _, endpoint := range s.endpoints {
+		req, err := http.NewRequestWithContext(ctx, method, endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, fmt.Errorf("failed to build request: %w", err)
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" && s.backend == "consul" {
+			req.Header.Set("X-Consul-Token", token)
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode >= 300 {
+			msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusNotFound {
+				return nil, fmt.Errorf("config key %s not found in %s", s.key, s.backend)
+			}
+			return nil, fmt.Errorf("%s %s returned %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+		}
+		return resp, nil
+	}
+	return nil, fmt.Errorf("%w: %v", errUnreachable, lastErr)
+}
+
+// writeFileAtomic replaces a file with data, so that a crash never leaves
+// it half written
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
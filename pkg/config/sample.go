@@ -0,0 +1,232 @@
+package config
+
+import (
+	_ "embed"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configSource is the source of the configuration structs. The sample
+// configuration takes its comments from their doc comments, so that it
+// documents exactly the fields this build reads.
+//
+//go:embed config.go
+var configSource string
+
+// sampleHeader leads the sample configuration
+const sampleHeader = `Sample 3FS storage node configuration, with every field at its default.
+Sizes take a unit such as 512MiB or 2TiB, durations one such as 30s or 7d.`
+
+// sampleConfig returns the configuration the sample shows: the required
+// fields set to example values, and every other field at its default
+func sampleConfig() *Config {
+	var c Config
+	s := &c.Storage
+	s.Node.ID = "node1"
+	s.Node.ListenAddress = "0.0.0.0:7000"
+	s.Admin.ListenAddress = "127.0.0.1:7100"
+	s.Replication.Factor = 3
+	s.Replication.ChainLength = 3
+	s.Local.DataPath = "/var/lib/3fs-storage"
+	s.Local.MaxSpace = 100 * GiB
+	s.FeatureFlags = make(FeatureFlags, len(Features))
+	for _, feature := range Features {
+		s.FeatureFlags[string(feature)] = false
+	}
+	c.applyDefaults()
+	return &c
+}
+
+// WriteSample writes a sample YAML configuration with every field at its
+// default and documented by the comment of the field it sets
+func WriteSample(w io.Writer) error {
+	var root yaml.Node
+	if err := root.Encode(sampleConfig()); err != nil {
+		return fmt.Errorf("failed to encode sample config: %w", err)
+	}
+	docs, err := fieldDocs()
+	if err != nil {
+		return err
+	}
+	annotate(&root, reflect.TypeOf(Config{}), docs)
+
+	// The version leads, as in every file of the current version
+	key := &yaml.Node{Kind: yaml.ScalarNode, Value: VersionKey, HeadComment: sampleHeader}
+	value := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(CurrentVersion)}
+	root.Content = append([]*yaml.Node{key, value}, root.Content...)
+
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&root); err != nil {
+		return fmt.Errorf("failed to write sample config: %w", err)
+	}
+	return encoder.Close()
+}
+
+// annotate sets the comment of every key of a mapping node to the doc
+// comment of the struct field it encodes, and recurses into sections
+func annotate(node *yaml.Node, t reflect.Type, docs map[string]string) {
+	t = indirect(t)
+	switch {
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			annotate(item, t.Elem(), docs)
+		}
+		return
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			annotate(node.Content[i], t.Elem(), docs)
+		}
+		return
+	case t.Kind() != reflect.Struct || node.Kind != yaml.MappingNode:
+		return
+	}
+
+	names := yamlNames(t)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		field, ok := fieldByYAMLName(t, key.Value)
+		if !ok {
+			continue
+		}
+		doc := docs[t.Name()+"."+field.Name]
+		if doc == "" {
+			// Sections without a field comment take their type's
+			if ft := indirect(field.Type); ft.Kind() == reflect.Struct {
+				doc = renameFields(docs[ft.Name()], map[string]string{ft.Name(): key.Value})
+			}
+		} else {
+			doc = renameFields(doc, names)
+		}
+		key.HeadComment = doc
+		annotate(value, field.Type, docs)
+	}
+}
+
+// indirect returns the type a pointer points to
+func indirect(t reflect.Type) reflect.Type {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	return t
+}
+
+// yamlNames maps the Go names of a struct's fields to their YAML keys
+func yamlNames(t reflect.Type) map[string]string {
+	names := make(map[string]string, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if name := yamlName(field); name != "" {
+			names[field.Name] = name
+		}
+	}
+	return names
+}
+
+// fieldByYAMLName returns the field of a struct encoded under a YAML key
+func fieldByYAMLName(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); yamlName(field) == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+// yamlName returns the YAML key of an exported struct field
+func yamlName(field reflect.StructField) string {
+	if !field.IsExported() {
+		return ""
+	}
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	if name == "-" {
+		return ""
+	}
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// goIdentifier matches the words of a doc comment that may be Go names
+var goIdentifier = regexp.MustCompile(`\b[A-Z][A-Za-z0-9]*\b`)
+
+// renameFields replaces the Go names of fields in a doc comment with their
+// YAML keys, as the reader of the file knows them
+func renameFields(doc string, names map[string]string) string {
+	return goIdentifier.ReplaceAllStringFunc(doc, func(word string) string {
+		if name, ok := names[word]; ok {
+			return name
+		}
+		return word
+	})
+}
+
+// parsedDocs caches the doc comments of the configuration structs
+var (
+	parsedDocs     map[string]string
+	parsedDocsErr  error
+	parsedDocsOnce sync.Once
+)
+
+// fieldDocs returns the doc comments of the configuration structs, by type
+// name and by type and field name, such as NodeConfig.DrainTimeout
+func fieldDocs() (map[string]string, error) {
+	parsedDocsOnce.Do(func() {
+		file, err := parser.ParseFile(token.NewFileSet(), "config.go", configSource, parser.ParseComments)
+		if err != nil {
+			parsedDocsErr = fmt.Errorf("failed to read config field docs: %w", err)
+			return
+		}
+
+		docs := make(map[string]string)
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				doc := ts.Doc
+				if doc == nil && len(gen.Specs) == 1 {
+					doc = gen.Doc
+				}
+				docs[ts.Name.Name] = commentText(doc)
+
+				st, ok := ts.Type.(*ast.StructType)
+				if !ok {
+					continue
+				}
+				for _, field := range st.Fields.List {
+					text := commentText(field.Doc)
+					if text == "" {
+						text = commentText(field.Comment)
+					}
+					for _, name := range field.Names {
+						docs[ts.Name.Name+"."+name.Name] = text
+					}
+				}
+			}
+		}
+		parsedDocs = docs
+	})
+	return parsedDocs, parsedDocsErr
+}
+
+// commentText returns the text of a comment, without a trailing newline
+func commentText(group *ast.CommentGroup) string {
+	if group == nil {
+		return ""
+	}
+	return strings.TrimSpace(group.Text())
+}
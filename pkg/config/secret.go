@@ -0,0 +1,225 @@
+package config
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secret reference schemes. A sensitive field may hold a reference instead
+// of the secret itself, resolved whenever the configuration is loaded.
+const (
+	// SecretFile reads a file, such as file:///run/secrets/peer-token
+	SecretFile = "file://"
+	// SecretEnv reads an environment variable, such as env://PEER_TOKEN
+	SecretEnv = "env://"
+	// SecretVault reads a field of a Vault secret, such as
+	// vault://secret/data/3fs#peer_token, from VAULT_ADDR with VAULT_TOKEN
+	SecretVault = "vault://"
+)
+
+// secretSchemes are the reference schemes, including SecretEncrypted
+var secretSchemes = []string{SecretFile, SecretEnv, SecretVault, SecretEncrypted}
+
+// vaultTimeout bounds a read from Vault
+const vaultTimeout = 10 * time.Second
+
+// IsSecretReference reports whether a value refers to a secret rather than
+// holding it
+func IsSecretReference(value string) bool {
+	for _, scheme := range secretSchemes {
+		if strings.HasPrefix(value, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveSecrets replaces the secret references in the fields tagged
+// secret:"true" with the secrets they refer to, reporting every reference
+// that cannot be resolved
+func resolveSecrets(config *Config) error {
+	var errs []string
+	walkSecrets(reflect.ValueOf(config).Elem(), "", func(path string, field reflect.Value) {
+		value := field.String()
+		if !IsSecretReference(value) {
+			return
+		}
+		secret, err := ResolveSecret(value)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", path, err))
+			return
+		}
+		field.SetString(secret)
+	})
+
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to resolve secrets: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// walkSecrets calls fn with the path and value of every string field
+// tagged secret:"true", including those in lists and maps of sections
+func walkSecrets(v reflect.Value, path string, fn func(path string, field reflect.Value)) {
+	switch v.Kind() {
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+			if name == "" || name == "-" || !field.IsExported() {
+				continue
+			}
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			if field.Tag.Get("secret") == "true" && field.Type.Kind() == reflect.String {
+				fn(fieldPath, v.Field(i))
+				continue
+			}
+			walkSecrets(v.Field(i), fieldPath, fn)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkSecrets(v.Index(i), fmt.Sprintf("%s[%d]", path, i), fn)
+		}
+	case reflect.Map:
+		if v.Type().Elem().Kind() != reflect.Struct {
+			return
+		}
+		keys := make([]string, 0, v.Len())
+		for _, key := range v.MapKeys() {
+			keys = append(keys, key.String())
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// Map values cannot be set in place, so a copy is walked and
+			// stored back
+			item := reflect.New(v.Type().Elem()).Elem()
+			item.Set(v.MapIndex(reflect.ValueOf(key)))
+			walkSecrets(item, path+"."+key, fn)
+			v.SetMapIndex(reflect.ValueOf(key), item)
+		}
+	}
+}
+
+// hasSecrets reports whether values of a type hold fields tagged
+// secret:"true"
+func hasSecrets(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Map:
+		return hasSecrets(t.Elem())
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).Tag.Get("secret") == "true" || hasSecrets(t.Field(i).Type) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ResolveSecret returns the secret a reference refers to. Values that are
+// not references are returned as they are. A trailing newline is trimmed
+// from files, as most tools that write secrets add one.
+func ResolveSecret(reference string) (string, error) {
+	switch {
+	case strings.HasPrefix(reference, SecretFile):
+		path := strings.TrimPrefix(reference, SecretFile)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read secret: %w", err)
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(reference, SecretEnv):
+		name := strings.TrimPrefix(reference, SecretEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok || value == "" {
+			return "", fmt.Errorf("environment variable %s is not set", name)
+		}
+		return value, nil
+	case strings.HasPrefix(reference, SecretVault):
+		return readVaultSecret(strings.TrimPrefix(reference, SecretVault))
+	case strings.HasPrefix(reference, SecretEncrypted):
+		return decryptWithNodeKey(reference)
+	default:
+		return reference, nil
+	}
+}
+
+// readVaultSecret reads one field of a Vault secret, given as
+// path#field. The field defaults to "value". Both versions of the KV
+// engine are supported.
+func readVaultSecret(reference string) (string, error) {
+	path, field, _ := strings.Cut(reference, "#")
+	if field == "" {
+		field = "value"
+	}
+
+	addr := os.Getenv("VAULT_ADDR")
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR is not set")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if token == "" {
+		return "", errors.New("VAULT_TOKEN is not set")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vaultTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to build Vault request: %w", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+	if namespace := os.Getenv("VAULT_NAMESPACE"); namespace != "" {
+		req.Header.Set("X-Vault-Namespace", namespace)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to read secret from Vault: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("Vault returned %s for %s: %s", resp.Status, path, strings.TrimSpace(string(msg)))
+	}
+
+	var secret struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&secret); err != nil {
+		return "", fmt.Errorf("failed to unmarshal Vault response: %w", err)
+	}
+
+	// Version 2 of the KV engine nests the secret's fields under data
+	data := secret.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		if _, versioned := data["metadata"]; versioned {
+			data = nested
+		}
+	}
+
+	value, ok := data[field]
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s has no field %s", path, field)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return "", fmt.Errorf("Vault secret %s field %s is not a string", path, field)
+	}
+	return s, nil
+}
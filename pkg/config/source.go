@@ -0,0 +1,119 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Source supplies a configuration document
+type Source interface {
+	// Read returns the current document
+	Read(ctx context.Context) ([]byte, error)
+	// Format is the format of the document
+	Format() Format
+	// String names the source in logs and errors
+	String() string
+	// Include returns the source of a document the configuration
+	// includes, named relative to this one
+	Include(name string) Source
+}
+
+// Waiter is implemented by sources that can block until their document
+// may have changed, instead of being polled
+type Waiter interface {
+	// Wait returns when the document may have changed since the last
+	// Read, or after a backend-specific timeout
+	Wait(ctx context.Context) error
+}
+
+// fileSource reads a local configuration file
+type fileSource struct {
+	path string
+}
+
+// FileSource returns a source reading the file at path, in the format of
+// its extension
+func FileSource(path string) Source {
+	return &fileSource{path: path}
+}
+
+// Read reads the file
+func (s *fileSource) Read(_ context.Context) ([]byte, error) {
+	return os.ReadFile(s.path)
+}
+
+// Format returns the format of the file's extension
+func (s *fileSource) Format() Format {
+	return DetectFormat(s.path)
+}
+
+// String returns the file's path
+func (s *fileSource) String() string {
+	return s.path
+}
+
+// Include returns the file at a path relative to the file's directory
+func (s *fileSource) Include(name string) Source {
+	if filepath.IsAbs(name) {
+		return FileSource(name)
+	}
+	return FileSource(filepath.Join(filepath.Dir(s.path), name))
+}
+
+// OpenSource returns the source at a location: a file path, or a key in
+// etcd or Consul such as
+//
+//	etcd://10.0.0.1:2379,10.0.0.2:2379/3fs/config.yaml?fallback=/etc/3fs/config.yaml
+//	consul+https://consul.local:8501/3fs/config.yaml
+//
+// The endpoints are tried in order. The format is that of the key's
+// extension.
+func OpenSource(location string) (Source, error) {
+	scheme, _, ok := strings.Cut(location, "://")
+	if !ok {
+		return FileSource(location), nil
+	}
+
+	backend, protocol, _ := strings.Cut(scheme, "+")
+	if protocol == "" {
+		protocol = "http"
+	}
+	if protocol != "http" && protocol != "https" {
+		return nil, fmt.Errorf("unsupported config protocol %q", protocol)
+	}
+	if backend != "etcd" && backend != "consul" {
+		return nil, fmt.Errorf("unsupported config backend %q", backend)
+	}
+
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, fmt.Errorf("invalid config location: %w", err)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("config location %q needs endpoints and a key", location)
+	}
+
+	endpoints := make([]string, 0)
+	for _, host := range strings.Split(u.Host, ",") {
+		if host != "" {
+			endpoints = append(endpoints, protocol+"://"+host)
+		}
+	}
+	return newRemoteSource(backend, endpoints, key, u.Query().Get("fallback")), nil
+}
+
+// Load reads a configuration from a source, merges the documents it
+// includes, applies the environment and command line overrides and
+// validates it
+func Load(ctx context.Context, source Source) (*Config, error) {
+	doc, err := readDocument(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	return doc.load()
+}
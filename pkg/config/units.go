@@ -0,0 +1,293 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Size is a number of bytes, written in the configuration with a unit such
+// as 512MiB or 2TiB. Binary units (KiB, MiB, GiB, TiB, PiB) are powers of
+// 1024 and decimal units (kB, MB, GB, TB, PB) powers of 1000. A number
+// without a unit is rejected, except zero, as it is ambiguous.
+type Size int64
+
+// Binary size units
+const (
+	Byte Size = 1
+	KiB  Size = 1 << 10
+	MiB  Size = 1 << 20
+	GiB  Size = 1 << 30
+	TiB  Size = 1 << 40
+	PiB  Size = 1 << 50
+)
+
+// sizeUnits are the units a size may be written with, largest first within
+// each system, as String picks the first that divides a size exactly
+var sizeUnits = []struct {
+	name  string
+	bytes int64
+}{
+	{"PiB", int64(PiB)}, {"TiB", int64(TiB)}, {"GiB", int64(GiB)}, {"MiB", int64(MiB)}, {"KiB", int64(KiB)},
+	{"PB", 1e15}, {"TB", 1e12}, {"GB", 1e9}, {"MB", 1e6}, {"kB", 1e3}, {"KB", 1e3},
+	{"B", 1},
+}
+
+// ParseSize parses a size with its unit, such as 2TiB, 1.5GB or 0
+func ParseSize(s string) (Size, error) {
+	s = strings.TrimSpace(s)
+	number, unit := splitUnit(s)
+	if number == "" {
+		return 0, fmt.Errorf("invalid size %q, expected a number and a unit such as 512MiB", s)
+	}
+	if strings.HasPrefix(number, "-") {
+		return 0, fmt.Errorf("invalid size %q, sizes cannot be negative", s)
+	}
+	if unit == "" {
+		if isZero(number) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("ambiguous size %q, give a unit such as %sMiB or %sGiB", s, number, number)
+	}
+
+	var bytes int64
+	for _, u := range sizeUnits {
+		if u.name == unit {
+			bytes = u.bytes
+			break
+		}
+	}
+	if bytes == 0 {
+		switch strings.ToUpper(unit) {
+		case "K", "M", "G", "T", "P":
+			return 0, fmt.Errorf("ambiguous size %q, use %s%siB for powers of 1024 or %s%sB for powers of 1000",
+				s, number, strings.ToUpper(unit), number, strings.ToUpper(unit))
+		}
+		return 0, fmt.Errorf("invalid size %q, units are B, KiB, MiB, GiB, TiB, PiB, kB, MB, GB, TB and PB", s)
+	}
+
+	value, err := scale(number, bytes)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %v", s, err)
+	}
+	return Size(value), nil
+}
+
+// String writes the size with the largest unit that divides it exactly
+func (s Size) String() string {
+	if s == 0 {
+		return "0"
+	}
+	for _, u := range sizeUnits {
+		if int64(s)%u.bytes == 0 {
+			return strconv.FormatInt(int64(s)/u.bytes, 10) + u.name
+		}
+	}
+	return strconv.FormatInt(int64(s), 10) + "B"
+}
+
+// MarshalYAML writes the size with its unit, and zero as a number
+func (s Size) MarshalYAML() (interface{}, error) {
+	if s == 0 {
+		return 0, nil
+	}
+	return s.String(), nil
+}
+
+// UnmarshalYAML parses a size with its unit
+func (s *Size) UnmarshalYAML(node *yaml.Node) error {
+	return unmarshalScalar(node, s.UnmarshalText)
+}
+
+// UnmarshalText parses a size with its unit, for environment variables
+// and command line overrides
+func (s *Size) UnmarshalText(text []byte) error {
+	size, err := ParseSize(string(text))
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+// Duration is a length of time, written in the configuration with a unit
+// such as 250ms, 30s, 6h or 7d. A number without a unit is rejected,
+// except zero, as it is ambiguous.
+type Duration time.Duration
+
+// day is the unit d, which time.ParseDuration lacks
+const day = 24 * time.Hour
+
+// ParseDuration parses a duration with its units, such as 1h30m, 7d or 0.
+// The units are those of time.ParseDuration and d for days, which may be
+// separated from their numbers by spaces.
+func ParseDuration(s string) (Duration, error) {
+	s = strings.ReplaceAll(strings.TrimSpace(s), " ", "")
+	number, unit := splitUnit(s)
+	if number != "" && unit == "" {
+		if isZero(number) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("ambiguous duration %q, give a unit such as %ss or %sm", s, number, number)
+	}
+
+	// Whole days lead, as in 7d or 1d12h
+	var days time.Duration
+	rest := s
+	if i := strings.Index(s, "d"); i > 0 {
+		n, err := strconv.ParseInt(s[:i], 10, 32)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q, days must be a whole number", s)
+		}
+		days, rest = time.Duration(n)*day, s[i+1:]
+		if n < 0 && rest != "" {
+			rest = "-" + rest
+		}
+	}
+	if rest == "" {
+		return Duration(days), nil
+	}
+	d, err := time.ParseDuration(rest)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q, expected a number and a unit such as 250ms, 30s, 6h or 7d", s)
+	}
+	return Duration(days + d), nil
+}
+
+// String writes the duration with its units
+func (d Duration) String() string {
+	if d == 0 {
+		return "0"
+	}
+	v := time.Duration(d)
+	if v%day == 0 {
+		return strconv.FormatInt(int64(v/day), 10) + "d"
+	}
+	s := v.String()
+	// Trim the zero units time.Duration writes, as in 6h0m0s
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// MarshalYAML writes the duration with its units, and zero as a number
+func (d Duration) MarshalYAML() (interface{}, error) {
+	if d == 0 {
+		return 0, nil
+	}
+	return d.String(), nil
+}
+
+// UnmarshalYAML parses a duration with its units
+func (d *Duration) UnmarshalYAML(node *yaml.Node) error {
+	return unmarshalScalar(node, d.UnmarshalText)
+}
+
+// UnmarshalText parses a duration with its units, for environment
+// variables and command line overrides
+func (d *Duration) UnmarshalText(text []byte) error {
+	duration, err := ParseDuration(string(text))
+	if err != nil {
+		return err
+	}
+	*d = duration
+	return nil
+}
+
+// unmarshalScalar hands the text of a YAML scalar to parse. Null leaves
+// the value unset. Problems are reported as type errors, so that decoding
+// goes on and reports every value at once.
+func unmarshalScalar(node *yaml.Node, parse func([]byte) error) error {
+	if node.Kind != yaml.ScalarNode {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: expected a value with a unit, got a %s", node.Line, nodeKind(node))}}
+	}
+	if node.Tag == "!!null" {
+		return nil
+	}
+	if err := parse([]byte(node.Value)); err != nil {
+		return &yaml.TypeError{Errors: []string{fmt.Sprintf("line %d: %v", node.Line, err)}}
+	}
+	return nil
+}
+
+// nodeKind names the kind of a YAML node in errors
+func nodeKind(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.MappingNode:
+		return "section"
+	case yaml.SequenceNode:
+		return "list"
+	default:
+		return "value"
+	}
+}
+
+// splitUnit splits a value into its leading number and its unit, which
+// may be separated by a space
+func splitUnit(s string) (string, string) {
+	i := 0
+	if i < len(s) && (s[i] == '-' || s[i] == '+') {
+		i++
+	}
+	for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+		i++
+	}
+	number := s[:i]
+	if number == "-" || number == "+" {
+		number = ""
+	}
+	return number, strings.TrimSpace(s[i:])
+}
+
+// isZero reports whether a number without a unit is zero
+func isZero(number string) bool {
+	f, err := strconv.ParseFloat(number, 64)
+	return err == nil && f == 0
+}
+
+// scale multiplies a decimal number by a unit, which must give a whole
+// number of bytes
+func scale(number string, unit int64) (int64, error) {
+	whole, fraction, _ := strings.Cut(strings.TrimPrefix(number, "+"), ".")
+	if whole == "" && fraction == "" || strings.Contains(fraction, ".") {
+		return 0, fmt.Errorf("%q is not a number", number)
+	}
+
+	var value int64
+	if whole != "" {
+		w, err := strconv.ParseInt(whole, 10, 64)
+		if err != nil || w > (1<<62)/unit {
+			return 0, fmt.Errorf("%s is too large", number)
+		}
+		value = w * unit
+	}
+	if fraction != "" {
+		if len(fraction) > 15 {
+			return 0, fmt.Errorf("%s has too many decimals", number)
+		}
+		f, err := strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a number", number)
+		}
+		denominator := int64(1)
+		for range fraction {
+			denominator *= 10
+		}
+		// f / denominator < 1, so f * unit fits unless both are large
+		if f > 0 && unit > (1<<62)/f {
+			return 0, fmt.Errorf("%s has too many decimals", number)
+		}
+		if f*unit%denominator != 0 {
+			return 0, fmt.Errorf("%s is not a whole number of bytes", number)
+		}
+		value += f * unit / denominator
+	}
+	return value, nil
+}
@@ -0,0 +1,1226 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Defaults applied by Validate to fields left unset. They match the
+// defaults documented on each field, which the node also falls back to.
+const (
+	defaultDrainTimeout         = Duration(30 * time.Second)
+	defaultRepairConcurrency    = 4
+	defaultRepairInterval       = Duration(10 * time.Minute)
+	defaultTargetCheckInterval  = Duration(10 * time.Second)
+	defaultIOWorkers            = 64
+	defaultWriteConcurrency     = 32
+	defaultDiskQueueDepth       = 32
+	defaultBackgroundDiskOps    = 2
+	defaultReadDeadline         = Duration(20 * time.Millisecond)
+	defaultWriteDeadline        = Duration(100 * time.Millisecond)
+	defaultBackgroundDeadline   = Duration(2 * time.Second)
+	defaultMemoryWait           = Duration(time.Second)
+	defaultFSync                = "wal"
+	defaultLogLevel             = "info"
+	defaultLogFormat            = "text"
+	defaultStatsInterval        = Duration(time.Minute)
+	defaultLogOutput            = "stderr"
+	defaultLogMaxSize           = 100 * MiB
+	defaultTraceExporter        = "otlp"
+	defaultDiscoveryTTL         = Duration(15 * time.Second)
+	defaultNumChains            = 64
+	defaultRefreshInterval      = Duration(5 * time.Second)
+	defaultHeartbeatInterval    = Duration(5 * time.Second)
+	defaultFailureDomain        = "host"
+	defaultHashing              = "ring"
+	defaultFullnessWeight       = 1.0
+	defaultWriteWeight          = 0.5
+	defaultMaxFullness          = 0.9
+	defaultConsistency          = "eventual"
+	defaultLease                = Duration(3 * time.Second)
+	defaultSuspectPhi           = 3.0
+	defaultDownPhi              = 8.0
+	defaultDetectorWindow       = 100
+	defaultMinStdDev            = Duration(500 * time.Millisecond)
+	defaultRebalanceThreshold   = 0.1
+	defaultRebalanceMaxMoves    = 8
+	defaultRebalanceConcurrency = 2
+	defaultAuthMode             = "off"
+	defaultMaxConcurrentJobs    = 2
+	defaultAuditMaxSize         = 100 * MiB
+	defaultCoordinatorStateFile = "coordinator.json"
+	defaultAuditFile            = "audit.log"
+	defaultGatewayRegion        = "us-east-1"
+	defaultGeoCompression       = "deflate"
+	defaultGeoWorkers           = 4
+	defaultUsageReportInterval  = Duration(time.Minute)
+	defaultUsageWindow          = Duration(time.Hour)
+	defaultUsageRetention       = Duration(30 * 24 * time.Hour)
+	defaultUsageExportInterval  = Duration(5 * time.Minute)
+	defaultEventBuffer          = 1024
+	defaultNATSSubject          = "3fs.events"
+	defaultCDCRetention         = Duration(7 * 24 * time.Hour)
+	defaultCDCMaxSize           = GiB
+	defaultNodeRole             = "storage"
+	defaultCacheMemorySize      = GiB
+	defaultCacheDiskSize        = 10 * GiB
+	defaultCacheMaxAge          = Duration(30 * time.Second)
+	defaultWriteBackMaxSize     = 256 * MiB
+	defaultWriteBackBlockSize   = 64 * KiB
+	defaultWriteBackBatchSize   = 64
+	defaultWriteBackInterval    = Duration(100 * time.Millisecond)
+	defaultCompressionBlockSize = 64 * KiB
+	defaultDictionarySize       = 112 * KiB
+	defaultDictionarySampleSize = 16 * MiB
+	defaultDictionaryMinSamples = 256
+)
+
+// FieldError is a problem with one configuration field, named by its path
+// in the configuration file
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// Error returns the field's path and what is wrong with it
+func (e *FieldError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidationError lists every problem found in a configuration, so that
+// they can all be fixed at once
+type ValidationError struct {
+	Errors []*FieldError
+}
+
+// Error lists the problems, one per line
+func (e *ValidationError) Error() string {
+	lines := make([]string, 0, len(e.Errors)+1)
+	lines = append(lines, fmt.Sprintf("invalid configuration (%d problems):", len(e.Errors)))
+	for _, fe := range e.Errors {
+		lines = append(lines, "  "+fe.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// validator collects field errors
+type validator struct {
+	errors []*FieldError
+}
+
+// add records a problem with a field
+func (v *validator) add(field, format string, args ...interface{}) {
+	v.errors = append(v.errors, &FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// required records a problem if a string field is empty
+func (v *validator) required(field, value string) {
+	if strings.TrimSpace(value) == "" {
+		v.add(field, "is required")
+	}
+}
+
+// nonNegative records a problem if a number field is negative
+func (v *validator) nonNegative(field string, value int) {
+	if value < 0 {
+		v.add(field, "must not be negative, got %d", value)
+	}
+}
+
+// positive records a problem if a number field is zero or negative
+func (v *validator) positive(field string, value int) {
+	if value <= 0 {
+		v.add(field, "must be greater than zero, got %d", value)
+	}
+}
+
+// nonNegativeDuration records a problem if a duration field is negative
+func (v *validator) nonNegativeDuration(field string, value Duration) {
+	if value < 0 {
+		v.add(field, "must not be negative, got %s", value)
+	}
+}
+
+// nonNegativeSize records a problem if a size field is negative
+func (v *validator) nonNegativeSize(field string, value Size) {
+	if value < 0 {
+		v.add(field, "must not be negative, got %s", value)
+	}
+}
+
+// between records a problem if a number field is outside [min, max]
+func (v *validator) between(field string, value, min, max int) {
+	if value < min || value > max {
+		v.add(field, "must be between %d and %d, got %d", min, max, value)
+	}
+}
+
+// oneOf records a problem if a field is not one of the allowed values
+func (v *validator) oneOf(field, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.add(field, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+}
+
+// address records a problem if a field is not a host:port address. A
+// scheme such as http:// is accepted when allowScheme is set.
+func (v *validator) address(field, value string, allowScheme bool) {
+	if allowScheme {
+		value = strings.TrimPrefix(strings.TrimPrefix(value, "http://"), "https://")
+	}
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		v.add(field, "must be a host:port address, got %q", value)
+		return
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 65535 {
+		v.add(field, "has an invalid port in %q", value)
+	}
+}
+
+// cpuList records a problem if a field is not a CPU list such as
+// "0-7,16-23"
+func (v *validator) cpuList(field, value string) {
+	for _, part := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		lo, err := strconv.Atoi(first)
+		hi := lo
+		if err == nil && isRange {
+			hi, err = strconv.Atoi(last)
+		}
+		if err != nil || lo < 0 || hi < lo {
+			v.add(field, "must be a CPU list such as \"0-7,16-23\", got %q", value)
+			return
+		}
+	}
+}
+
+// err returns the collected problems, or nil if there are none
+func (v *validator) err() error {
+	if len(v.errors) == 0 {
+		return nil
+	}
+	return &ValidationError{Errors: v.errors}
+}
+
+// Validate applies the documented defaults to fields left unset and
+// checks every field, returning a *ValidationError that lists all the
+// problems found
+func (c *Config) Validate() error {
+	c.applyDefaults()
+
+	v := &validator{}
+	s := &c.Storage
+	validateNode(v, s)
+	validateCluster(v, s)
+	validateReplication(v, s.Replication)
+	validateLocal(v, s.Local)
+	validateTuning(v, s.Tuning)
+	validateLogging(v, s.Logging)
+	validateTracing(v, s.Tracing)
+	validateDiscovery(v, s.Discovery)
+	validateCoordinator(v, s)
+	validateLimits(v, s.Limits)
+	validateAuth(v, s.Auth)
+	validateACL(v, s.ACL)
+	validateJobs(v, s.Jobs)
+	validateAudit(v, s.Audit)
+	validateGateway(v, s.Gateway)
+	validateGeoReplication(v, s.GeoReplication)
+	validateUsage(v, s.Usage)
+	validateEvents(v, s.Events)
+	validateCDC(v, s.CDC)
+	validateCache(v, s)
+	validateWriteBack(v, s.WriteBack)
+	validateCompression(v, s.Compression)
+	validateFeatureFlags(v, s.FeatureFlags)
+	return v.err()
+}
+
+// applyDefaults fills in the documented defaults of fields left unset.
+// Fields where zero has a meaning of its own, such as unlimited
+// bandwidth, are left alone.
+func (c *Config) applyDefaults() {
+	s := &c.Storage
+	if s.Node.DrainTimeout == 0 {
+		s.Node.DrainTimeout = defaultDrainTimeout
+	}
+	if s.Node.Role == "" {
+		s.Node.Role = defaultNodeRole
+	}
+
+	if s.Replication.RepairConcurrency == 0 {
+		s.Replication.RepairConcurrency = defaultRepairConcurrency
+	}
+	if s.Replication.RepairInterval == 0 {
+		s.Replication.RepairInterval = defaultRepairInterval
+	}
+	if s.Replication.Consistency == "" {
+		s.Replication.Consistency = defaultConsistency
+	}
+
+	// A single target is the node's own, so it may leave out its ID and
+	// data path
+	if len(s.Local.Targets) == 1 {
+		t := &s.Local.Targets[0]
+		if t.ID == "" {
+			t.ID = s.Node.ID
+		}
+		if t.DataPath == "" {
+			t.DataPath = s.Local.DataPath
+		}
+	}
+	if s.Local.TargetCheckInterval == 0 {
+		s.Local.TargetCheckInterval = defaultTargetCheckInterval
+	}
+
+	if s.Tuning.IOWorkers == 0 {
+		s.Tuning.IOWorkers = defaultIOWorkers
+	}
+	if s.Tuning.WriteConcurrency == 0 {
+		s.Tuning.WriteConcurrency = defaultWriteConcurrency
+	}
+	if s.Tuning.FSync == "" {
+		s.Tuning.FSync = defaultFSync
+	}
+	if s.Tuning.DiskQueueDepth == 0 {
+		s.Tuning.DiskQueueDepth = defaultDiskQueueDepth
+	}
+	if s.Tuning.BackgroundDiskOps == 0 {
+		s.Tuning.BackgroundDiskOps = defaultBackgroundDiskOps
+	}
+	if s.Tuning.ReadDeadline == 0 {
+		s.Tuning.ReadDeadline = defaultReadDeadline
+	}
+	if s.Tuning.WriteDeadline == 0 {
+		s.Tuning.WriteDeadline = defaultWriteDeadline
+	}
+	if s.Tuning.BackgroundDeadline == 0 {
+		s.Tuning.BackgroundDeadline = defaultBackgroundDeadline
+	}
+	if s.Tuning.MemoryWait == 0 {
+		s.Tuning.MemoryWait = defaultMemoryWait
+	}
+
+	if s.Logging.Level == "" {
+		s.Logging.Level = defaultLogLevel
+	}
+	if s.Logging.Format == "" {
+		s.Logging.Format = defaultLogFormat
+	}
+	if s.Logging.StatsInterval == 0 {
+		s.Logging.StatsInterval = defaultStatsInterval
+	}
+	if s.Logging.Output == "" {
+		s.Logging.Output = defaultLogOutput
+	}
+	if s.Logging.MaxSize == 0 {
+		s.Logging.MaxSize = defaultLogMaxSize
+	}
+
+	if s.Tracing.Exporter == "" {
+		s.Tracing.Exporter = defaultTraceExporter
+	}
+	if s.Discovery.TTL == 0 {
+		s.Discovery.TTL = defaultDiscoveryTTL
+	}
+
+	coord := &s.Coordinator
+	if coord.StatePath == "" && s.Local.DataPath != "" {
+		coord.StatePath = filepath.Join(s.Local.DataPath, defaultCoordinatorStateFile)
+	}
+	if coord.NumChains == 0 {
+		coord.NumChains = defaultNumChains
+	}
+	if coord.RefreshInterval == 0 {
+		coord.RefreshInterval = defaultRefreshInterval
+	}
+	if coord.HeartbeatInterval == 0 {
+		coord.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if coord.Placement.FailureDomain == "" {
+		coord.Placement.FailureDomain = defaultFailureDomain
+	}
+	if coord.Hashing == "" {
+		coord.Hashing = defaultHashing
+	}
+	if coord.Balance == (BalanceConfig{}) {
+		coord.Balance.FullnessWeight = defaultFullnessWeight
+		coord.Balance.WriteWeight = defaultWriteWeight
+	}
+	if coord.Balance.MaxFullness == 0 {
+		coord.Balance.MaxFullness = defaultMaxFullness
+	}
+	if coord.Election.Lease == 0 {
+		coord.Election.Lease = defaultLease
+	}
+	fd := &coord.FailureDetector
+	if fd.SuspectPhi == 0 {
+		fd.SuspectPhi = defaultSuspectPhi
+	}
+	if fd.DownPhi == 0 {
+		fd.DownPhi = defaultDownPhi
+	}
+	if fd.Window == 0 {
+		fd.Window = defaultDetectorWindow
+	}
+	if fd.MinStdDev == 0 {
+		fd.MinStdDev = defaultMinStdDev
+	}
+	// Namespace policies follow the cluster's settings they leave unset
+	for name, ns := range s.Replication.Namespaces {
+		if ns.Factor == 0 {
+			ns.Factor = s.Replication.Factor
+		}
+		if ns.ChainLength == 0 && ns.Erasure.Enabled() {
+			ns.ChainLength = ns.Erasure.Data + ns.Erasure.Parity
+		}
+		if ns.ChainLength == 0 {
+			ns.ChainLength = s.Replication.ChainLength
+		}
+		if ns.NumChains == 0 {
+			ns.NumChains = coord.NumChains
+		}
+		if ns.Consistency == "" {
+			ns.Consistency = s.Replication.Consistency
+		}
+		if ns.Placement.FailureDomain == "" {
+			ns.Placement.FailureDomain = coord.Placement.FailureDomain
+		}
+		if len(ns.Placement.Zones) == 0 {
+			ns.Placement.Zones = coord.Placement.Zones
+		}
+		s.Replication.Namespaces[name] = ns
+	}
+	rb := &coord.Rebalance
+	if rb.Threshold == 0 {
+		rb.Threshold = defaultRebalanceThreshold
+	}
+	if rb.MaxMoves == 0 {
+		rb.MaxMoves = defaultRebalanceMaxMoves
+	}
+	if rb.Concurrency == 0 {
+		rb.Concurrency = defaultRebalanceConcurrency
+	}
+
+	if s.Auth.Mode == "" {
+		s.Auth.Mode = defaultAuthMode
+	}
+	if s.Jobs.MaxConcurrent == 0 {
+		s.Jobs.MaxConcurrent = defaultMaxConcurrentJobs
+	}
+	if s.Audit.Path == "" && s.Local.DataPath != "" {
+		s.Audit.Path = filepath.Join(s.Local.DataPath, defaultAuditFile)
+	}
+
+	if s.Gateway.Region == "" {
+		s.Gateway.Region = defaultGatewayRegion
+	}
+	for i := range s.Gateway.Credentials {
+		if c := &s.Gateway.Credentials[i]; c.Identity == "" {
+			c.Identity = c.AccessKey
+		}
+	}
+	if s.Audit.MaxSize == 0 {
+		s.Audit.MaxSize = defaultAuditMaxSize
+	}
+
+	if s.GeoReplication.Compression == "" {
+		s.GeoReplication.Compression = defaultGeoCompression
+	}
+	if s.GeoReplication.Workers == 0 {
+		s.GeoReplication.Workers = defaultGeoWorkers
+	}
+
+	if s.Usage.ReportInterval == 0 {
+		s.Usage.ReportInterval = defaultUsageReportInterval
+	}
+	if s.Usage.Window == 0 {
+		s.Usage.Window = defaultUsageWindow
+	}
+	if s.Usage.Retention == 0 {
+		s.Usage.Retention = defaultUsageRetention
+	}
+	if s.Usage.Export.Window == 0 {
+		s.Usage.Export.Window = s.Usage.Window
+	}
+	if s.Usage.Export.Interval == 0 {
+		s.Usage.Export.Interval = defaultUsageExportInterval
+	}
+	if s.Events.Buffer == 0 {
+		s.Events.Buffer = defaultEventBuffer
+	}
+	for i := range s.Events.Sinks {
+		if sink := &s.Events.Sinks[i]; sink.Type == "nats" && sink.Subject == "" {
+			sink.Subject = defaultNATSSubject
+		}
+	}
+	if s.CDC.Retention == 0 {
+		s.CDC.Retention = defaultCDCRetention
+	}
+	if s.CDC.MaxSize == 0 {
+		s.CDC.MaxSize = defaultCDCMaxSize
+	}
+	if s.Cache.MemorySize == 0 {
+		s.Cache.MemorySize = defaultCacheMemorySize
+	}
+	if s.Cache.DiskSize == 0 {
+		s.Cache.DiskSize = defaultCacheDiskSize
+	}
+	if s.Cache.MaxAge == 0 {
+		s.Cache.MaxAge = defaultCacheMaxAge
+	}
+	if s.WriteBack.MaxSize == 0 {
+		s.WriteBack.MaxSize = defaultWriteBackMaxSize
+	}
+	if s.WriteBack.MaxBlockSize == 0 {
+		s.WriteBack.MaxBlockSize = defaultWriteBackBlockSize
+	}
+	if s.WriteBack.BatchSize == 0 {
+		s.WriteBack.BatchSize = defaultWriteBackBatchSize
+	}
+	if s.WriteBack.FlushInterval == 0 {
+		s.WriteBack.FlushInterval = defaultWriteBackInterval
+	}
+	if s.Compression.MaxBlockSize == 0 {
+		s.Compression.MaxBlockSize = defaultCompressionBlockSize
+	}
+	if s.Compression.DictionarySize == 0 {
+		s.Compression.DictionarySize = defaultDictionarySize
+	}
+	if s.Compression.SampleSize == 0 {
+		s.Compression.SampleSize = defaultDictionarySampleSize
+	}
+	if s.Compression.MinSamples == 0 {
+		s.Compression.MinSamples = defaultDictionaryMinSamples
+	}
+}
+
+// validateNode checks the node's identity and addresses
+func validateNode(v *validator, s *StorageConfig) {
+	v.required("storage.node.id", s.Node.ID)
+	if s.Node.ListenAddress == "" {
+		v.add("storage.node.listen_address", "is required")
+	} else {
+		v.address("storage.node.listen_address", s.Node.ListenAddress, false)
+	}
+	if s.Node.AdvertiseAddress != "" {
+		v.address("storage.node.advertise_address", s.Node.AdvertiseAddress, false)
+	}
+	v.nonNegativeDuration("storage.node.drain_timeout", s.Node.DrainTimeout)
+	v.oneOf("storage.node.role", s.Node.Role, "storage", "cache")
+	if s.Admin.ListenAddress != "" {
+		v.address("storage.admin.listen_address", s.Admin.ListenAddress, false)
+	}
+}
+
+// validateCluster checks the static node list: every node has a unique ID
+// and data address, there are enough nodes for the replication factor, and
+// the entry for this node matches the address it serves on
+func validateCluster(v *validator, s *StorageConfig) {
+	nodes := s.Cluster.Nodes
+	ids := make(map[string]int, len(nodes))
+	addresses := make(map[string]int, len(nodes))
+	for i, n := range nodes {
+		field := fmt.Sprintf("storage.cluster.nodes[%d]", i)
+		v.required(field+".id", n.ID)
+		if n.ID != "" {
+			if first, ok := ids[n.ID]; ok {
+				v.add(field+".id", "duplicates the ID of storage.cluster.nodes[%d]: %q", first, n.ID)
+			} else {
+				ids[n.ID] = i
+			}
+		}
+
+		if n.Address == "" {
+			v.add(field+".address", "is required")
+		} else if validAddress(n.Address) {
+			key := normalizeAddress(n.Address)
+			if first, ok := addresses[key]; ok {
+				v.add(field+".address", "duplicates the address of storage.cluster.nodes[%d]: %q", first, n.Address)
+			} else {
+				addresses[key] = i
+			}
+		} else {
+			v.address(field+".address", n.Address, false)
+		}
+		if n.AdminAddress != "" {
+			v.address(field+".admin_address", n.AdminAddress, true)
+		}
+		if n.Role != "" {
+			v.oneOf(field+".role", n.Role, "storage", "cache")
+		}
+
+		if n.ID != "" && n.ID == s.Node.ID && n.Address != "" && validAddress(n.Address) {
+			self, name := s.Node.ListenAddress, "listen_address"
+			if s.Node.AdvertiseAddress != "" {
+				self, name = s.Node.AdvertiseAddress, "advertise_address"
+			}
+			if validAddress(self) && !sameAddress(n.Address, self) {
+				v.add(field+".address", "is this node's entry, but %q does not match storage.node.%s %q", n.Address, name, self)
+			}
+		}
+	}
+
+	// A static list must hold a distinct node for every replica
+	if len(nodes) == 0 {
+		return
+	}
+	r := s.Replication
+	if r.Factor > len(nodes) {
+		v.add("storage.cluster.nodes", "lists %d nodes, fewer than storage.replication.factor (%d)", len(nodes), r.Factor)
+	}
+	names := make([]string, 0, len(r.Namespaces))
+	for name := range r.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ns := r.Namespaces[name]
+		if ns.Erasure.Enabled() {
+			if shards := ns.Erasure.Data + ns.Erasure.Parity; shards > len(nodes) {
+				v.add("storage.cluster.nodes", "lists %d nodes, fewer than the %d shards of storage.replication.namespaces.%s.erasure", len(nodes), shards, name)
+			}
+		} else if ns.Factor > len(nodes) {
+			v.add("storage.cluster.nodes", "lists %d nodes, fewer than storage.replication.namespaces.%s.factor (%d)", len(nodes), name, ns.Factor)
+		}
+	}
+}
+
+// validAddress reports whether a value is a host:port address with a valid
+// port
+func validAddress(value string) bool {
+	_, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return false
+	}
+	p, err := strconv.Atoi(port)
+	return err == nil && p >= 0 && p <= 65535
+}
+
+// normalizeAddress writes a host:port address in one form, so that
+// localhost:7000 and LOCALHOST:07000 compare equal
+func normalizeAddress(value string) string {
+	host, port, _ := net.SplitHostPort(value)
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	}
+	p, _ := strconv.Atoi(port)
+	return net.JoinHostPort(strings.ToLower(host), strconv.Itoa(p))
+}
+
+// sameAddress reports whether a node list entry names the address a node
+// serves on. A node listening on every interface, such as :7000 or
+// 0.0.0.0:7000, matches any host on its port.
+func sameAddress(entry, self string) bool {
+	host, port, _ := net.SplitHostPort(self)
+	if ip := net.ParseIP(host); host == "" || ip != nil && ip.IsUnspecified() {
+		_, entryPort, _ := net.SplitHostPort(entry)
+		a, _ := strconv.Atoi(entryPort)
+		b, _ := strconv.Atoi(port)
+		return a == b
+	}
+	return normalizeAddress(entry) == normalizeAddress(self)
+}
+
+// validateReplication checks the replication factor against the chain
+// length
+func validateReplication(v *validator, r ReplicationConfig) {
+	v.positive("storage.replication.chain_length", r.ChainLength)
+	v.positive("storage.replication.factor", r.Factor)
+	if r.ChainLength > 0 && r.Factor > r.ChainLength {
+		v.add("storage.replication.factor", "must not exceed chain_length (%d), got %d", r.ChainLength, r.Factor)
+	}
+	v.positive("storage.replication.repair_concurrency", r.RepairConcurrency)
+	v.nonNegativeSize("storage.replication.repair_bandwidth", r.RepairBandwidth)
+	v.nonNegativeDuration("storage.replication.repair_interval", r.RepairInterval)
+	v.oneOf("storage.replication.consistency", r.Consistency, "eventual", "strong")
+
+	names := make([]string, 0, len(r.Namespaces))
+	for name := range r.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		ns := r.Namespaces[name]
+		field := "storage.replication.namespaces." + name
+		if !validNamespace(name) {
+			v.add(field, "is not a valid namespace name: letters, digits, '-', '_' and '.'")
+		}
+		v.positive(field+".chain_length", ns.ChainLength)
+		v.positive(field+".factor", ns.Factor)
+		if ns.Erasure != (ErasureConfig{}) {
+			validateErasure(v, field, ns)
+		} else if ns.ChainLength > 0 && ns.Factor > ns.ChainLength {
+			v.add(field+".factor", "must not exceed chain_length (%d), got %d", ns.ChainLength, ns.Factor)
+		}
+		v.positive(field+".num_chains", ns.NumChains)
+		v.oneOf(field+".consistency", ns.Consistency, "eventual", "strong")
+		v.oneOf(field+".placement.failure_domain", ns.Placement.FailureDomain, "host", "rack", "zone")
+		validateZones(v, field+".placement.zones", ns.Placement.Zones)
+	}
+}
+
+// maxErasureShards is the most shards, data and parity, a block can be
+// erasure coded into
+const maxErasureShards = 256
+
+// validateErasure checks a namespace's erasure coding against its chain
+// length, whose members keep one shard each
+func validateErasure(v *validator, field string, ns NamespaceReplicationConfig) {
+	e := ns.Erasure
+	v.positive(field+".erasure.data", e.Data)
+	v.positive(field+".erasure.parity", e.Parity)
+	shards := e.Data + e.Parity
+	if shards > maxErasureShards {
+		v.add(field+".erasure", "must have at most %d shards, got %d", maxErasureShards, shards)
+	}
+	if ns.ChainLength > 0 && shards > ns.ChainLength {
+		v.add(field+".chain_length", "must be at least the %d erasure shards, got %d", shards, ns.ChainLength)
+	}
+}
+
+// validNamespace reports whether name can prefix block IDs
+func validNamespace(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for _, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-' || c == '_' || c == '.':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validateZones records a problem for every empty or repeated zone
+func validateZones(v *validator, field string, zones []string) {
+	seen := make(map[string]bool, len(zones))
+	for i, zone := range zones {
+		if strings.TrimSpace(zone) == "" {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "is required")
+		} else if seen[zone] {
+			v.add(fmt.Sprintf("%s[%d]", field, i), "repeats zone %q", zone)
+		}
+		seen[zone] = true
+	}
+}
+
+// builtinPlacementChecks name the checks the coordinator runs on every
+// candidate before the placement rules
+var builtinPlacementChecks = []string{"member", "role", "state", "suspect", "space", "nearly_full", "host", "zones", "spread"}
+
+// validatePlacementRules checks that each placement rule is complete and
+// named once
+func validatePlacementRules(v *validator, rules []PlacementRuleConfig) {
+	names := make(map[string]bool, len(rules))
+	for i, rule := range rules {
+		field := fmt.Sprintf("storage.coordinator.placement_rules[%d]", i)
+		v.required(field+".name", rule.Name)
+		if names[rule.Name] && rule.Name != "" {
+			v.add(field+".name", "repeats rule %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if slices.Contains(builtinPlacementChecks, rule.Name) {
+			v.add(field+".name", "is the name of a built-in placement check")
+		}
+		v.oneOf(field+".type", rule.Type, "spread", "fullness", "labels", "avoid_labels")
+		switch rule.Type {
+		case "spread":
+			v.oneOf(field+".domain", rule.Domain, "host", "rack", "zone")
+		case "fullness":
+			if rule.MaxFullness <= 0 || rule.MaxFullness > 1 {
+				v.add(field+".max_fullness", "must be above 0 and at most 1, got %g", rule.MaxFullness)
+			}
+		case "labels", "avoid_labels":
+			if len(rule.Labels) == 0 {
+				v.add(field+".labels", "is required")
+			}
+		}
+	}
+}
+
+// validateLocal checks the data path, the space limits and the storage
+// targets
+func validateLocal(v *validator, l LocalConfig) {
+	v.required("storage.local.data_path", l.DataPath)
+	if len(l.Targets) == 0 && l.MaxSpace == 0 {
+		v.add("storage.local.max_space", "is required")
+	} else {
+		v.nonNegativeSize("storage.local.max_space", l.MaxSpace)
+	}
+
+	ids := make(map[string]bool, len(l.Targets))
+	paths := make(map[string]bool, len(l.Targets))
+	for i, t := range l.Targets {
+		field := fmt.Sprintf("storage.local.targets[%d]", i)
+		v.required(field+".id", t.ID)
+		if t.ID != "" {
+			if ids[t.ID] {
+				v.add(field+".id", "duplicates target %q", t.ID)
+			}
+			ids[t.ID] = true
+		}
+		v.required(field+".data_path", t.DataPath)
+		if t.DataPath != "" {
+			path := filepath.Clean(t.DataPath)
+			if paths[path] {
+				v.add(field+".data_path", "is shared with another target: %s", t.DataPath)
+			}
+			paths[path] = true
+		}
+		if t.MaxSpace < 0 {
+			v.nonNegativeSize(field+".max_space", t.MaxSpace)
+		} else if t.MaxSpace == 0 && l.MaxSpace <= 0 {
+			v.add(field+".max_space", "is required when storage.local.max_space is not set")
+		}
+		if t.FSType != "" && strings.ContainsAny(t.FSType, " \t/") {
+			v.add(field+".fs_type", "must be a filesystem type such as xfs, got %q", t.FSType)
+		}
+		if t.Device != "" && !filepath.IsAbs(t.Device) {
+			v.add(field+".device", "must be an absolute path such as /dev/nvme0n1, got %q", t.Device)
+		}
+	}
+
+	v.nonNegativeDuration("storage.local.target_check_interval", l.TargetCheckInterval)
+}
+
+// Ranges of the tuning settings
+const (
+	maxCacheSize = TiB
+	maxIOWorkers = 4096
+)
+
+// validateTuning checks that the tuning settings are within their ranges
+func validateTuning(v *validator, t TuningConfig) {
+	if t.CacheSize > maxCacheSize {
+		v.add("storage.tuning.cache_size", "must not exceed %s, got %s", maxCacheSize, t.CacheSize)
+	}
+	v.between("storage.tuning.io_workers", t.IOWorkers, 1, maxIOWorkers)
+	if t.WriteConcurrency > t.IOWorkers && t.IOWorkers > 0 {
+		v.add("storage.tuning.write_concurrency", "cannot exceed storage.tuning.io_workers (%d), got %d", t.IOWorkers, t.WriteConcurrency)
+	} else {
+		v.positive("storage.tuning.write_concurrency", t.WriteConcurrency)
+	}
+	v.oneOf("storage.tuning.fsync", t.FSync, "wal", "always", "never")
+	v.nonNegativeSize("storage.tuning.scrub_bandwidth", t.ScrubBandwidth)
+	v.between("storage.tuning.disk_queue_depth", t.DiskQueueDepth, 1, maxIOWorkers)
+	if t.BackgroundDiskOps > t.DiskQueueDepth && t.DiskQueueDepth > 0 {
+		v.add("storage.tuning.background_disk_ops", "cannot exceed storage.tuning.disk_queue_depth (%d), got %d", t.DiskQueueDepth, t.BackgroundDiskOps)
+	} else {
+		v.positive("storage.tuning.background_disk_ops", t.BackgroundDiskOps)
+	}
+	v.nonNegativeDuration("storage.tuning.read_deadline", t.ReadDeadline)
+	v.nonNegativeDuration("storage.tuning.write_deadline", t.WriteDeadline)
+	v.nonNegativeDuration("storage.tuning.background_deadline", t.BackgroundDeadline)
+	v.nonNegativeSize("storage.tuning.memory_limit", t.MemoryLimit)
+	if t.MemoryLimit > 0 && t.CacheSize > t.MemoryLimit {
+		v.add("storage.tuning.cache_size", "cannot exceed storage.tuning.memory_limit (%s), got %s", t.MemoryLimit, t.CacheSize)
+	}
+	v.nonNegativeDuration("storage.tuning.memory_wait", t.MemoryWait)
+
+	a := t.Affinity
+	if a.NetworkCPUs != "" {
+		v.cpuList("storage.tuning.affinity.network_cpus", a.NetworkCPUs)
+	}
+	v.nonNegative("storage.tuning.affinity.network_workers", a.NetworkWorkers)
+	targets := make([]string, 0, len(a.TargetCPUs))
+	for id := range a.TargetCPUs {
+		targets = append(targets, id)
+	}
+	sort.Strings(targets)
+	for _, id := range targets {
+		v.cpuList("storage.tuning.affinity.target_cpus."+id, a.TargetCPUs[id])
+	}
+}
+
+// validateLogging checks the log levels, the format and the rotation of a
+// log file
+func validateLogging(v *validator, l LoggingConfig) {
+	levels := []string{"debug", "info", "warn", "warning", "error"}
+	v.oneOf("storage.logging.level", strings.ToLower(l.Level), levels...)
+	v.oneOf("storage.logging.format", strings.ToLower(l.Format), "text", "json")
+	v.nonNegativeSize("storage.logging.max_size", l.MaxSize)
+	v.nonNegativeDuration("storage.logging.max_age", l.MaxAge)
+	v.nonNegative("storage.logging.max_files", l.MaxFiles)
+
+	components := make([]string, 0, len(l.Components))
+	for component := range l.Components {
+		components = append(components, component)
+	}
+	sort.Strings(components)
+	for _, component := range components {
+		v.oneOf("storage.logging.components."+component, strings.ToLower(l.Components[component]), levels...)
+	}
+}
+
+// validateTracing checks the exporter and sample ratio of enabled tracing
+func validateTracing(v *validator, t TracingConfig) {
+	if !t.Enabled {
+		return
+	}
+	v.oneOf("storage.tracing.exporter", strings.ToLower(t.Exporter), "otlp", "stdout")
+	if t.SampleRatio < 0 || t.SampleRatio > 1 {
+		v.add("storage.tracing.sample_ratio", "must be between 0 and 1, got %g", t.SampleRatio)
+	}
+}
+
+// validateDiscovery checks the registration backend
+func validateDiscovery(v *validator, d DiscoveryConfig) {
+	if d.Backend == "" {
+		return
+	}
+	v.oneOf("storage.discovery.backend", d.Backend, "etcd", "consul")
+	if len(d.Endpoints) == 0 {
+		v.add("storage.discovery.endpoints", "is required when backend is set")
+	}
+	if d.TTL < 0 || d.TTL%Duration(time.Second) != 0 {
+		v.add("storage.discovery.ttl", "must be a whole number of seconds, got %s", d.TTL)
+	}
+}
+
+// validateCoordinator checks the coordinator settings and that a node
+// relying on a coordinator can reach one
+func validateCoordinator(v *validator, s *StorageConfig) {
+	c := s.Coordinator
+	if c.Enabled && s.Admin.ListenAddress == "" {
+		v.add("storage.admin.listen_address", "is required to serve the embedded coordinator")
+	}
+	if s.Cluster.Join && len(c.Addresses) == 0 {
+		v.add("storage.coordinator.addresses", "is required to join a cluster")
+	}
+	for i, addr := range c.Addresses {
+		v.address(fmt.Sprintf("storage.coordinator.addresses[%d]", i), addr, true)
+	}
+	v.positive("storage.coordinator.num_chains", c.NumChains)
+	v.oneOf("storage.coordinator.hashing", c.Hashing, "ring", "modulo")
+	if c.Balance.FullnessWeight < 0 {
+		v.add("storage.coordinator.balance.fullness_weight", "must not be negative, got %g", c.Balance.FullnessWeight)
+	}
+	if c.Balance.WriteWeight < 0 {
+		v.add("storage.coordinator.balance.write_weight", "must not be negative, got %g", c.Balance.WriteWeight)
+	}
+	if c.Balance.MaxFullness <= 0 || c.Balance.MaxFullness > 1 {
+		v.add("storage.coordinator.balance.max_fullness", "must be above 0 and at most 1, got %g", c.Balance.MaxFullness)
+	}
+	v.nonNegativeDuration("storage.coordinator.refresh_interval", c.RefreshInterval)
+	v.nonNegativeDuration("storage.coordinator.heartbeat_interval", c.HeartbeatInterval)
+	v.oneOf("storage.coordinator.placement.failure_domain", c.Placement.FailureDomain, "host", "rack", "zone")
+	validateZones(v, "storage.coordinator.placement.zones", c.Placement.Zones)
+	validatePlacementRules(v, c.PlacementRules)
+
+	if c.Election.Enabled && !c.Enabled {
+		v.add("storage.coordinator.election.enabled", "requires coordinator.enabled")
+	}
+	for i, peer := range c.Election.Peers {
+		v.address(fmt.Sprintf("storage.coordinator.election.peers[%d]", i), peer, true)
+	}
+	v.nonNegativeDuration("storage.coordinator.election.lease", c.Election.Lease)
+
+	fd := c.FailureDetector
+	if fd.SuspectPhi < 0 {
+		v.add("storage.coordinator.failure_detector.suspect_phi", "must not be negative, got %g", fd.SuspectPhi)
+	}
+	if fd.DownPhi > 0 && fd.DownPhi <= fd.SuspectPhi {
+		v.add("storage.coordinator.failure_detector.down_phi", "must be greater than suspect_phi (%g), got %g", fd.SuspectPhi, fd.DownPhi)
+	}
+	v.nonNegative("storage.coordinator.failure_detector.window", fd.Window)
+	v.nonNegativeDuration("storage.coordinator.failure_detector.min_std_dev", fd.MinStdDev)
+	v.nonNegativeDuration("storage.coordinator.failure_detector.acceptable_pause", fd.AcceptablePause)
+
+	rb := c.Rebalance
+	if rb.Enabled && !c.Enabled {
+		v.add("storage.coordinator.rebalance.enabled", "requires coordinator.enabled")
+	}
+	v.nonNegativeDuration("storage.coordinator.rebalance.interval", rb.Interval)
+	if rb.Threshold < 0 {
+		v.add("storage.coordinator.rebalance.threshold", "must not be negative, got %g", rb.Threshold)
+	}
+	v.nonNegative("storage.coordinator.rebalance.max_moves", rb.MaxMoves)
+	v.nonNegative("storage.coordinator.rebalance.concurrency", rb.Concurrency)
+	v.nonNegativeSize("storage.coordinator.rebalance.bandwidth", rb.Bandwidth)
+}
+
+// validateLimits checks that no client limit is negative
+func validateLimits(v *validator, l LimitsConfig) {
+	validateClientLimits(v, "storage.limits.default", l.Default)
+	for identity, cl := range l.Clients {
+		validateClientLimits(v, fmt.Sprintf("storage.limits.clients[%s]", identity), cl)
+	}
+	v.nonNegativeSize("storage.limits.peer_bandwidth", l.PeerBandwidth)
+}
+
+// validateClientLimits checks the limits of one client
+func validateClientLimits(v *validator, field string, cl ClientLimits) {
+	if cl.RequestsPerSecond < 0 {
+		v.add(field+".requests_per_second", "must not be negative, got %g", cl.RequestsPerSecond)
+	}
+	v.nonNegativeSize(field+".bandwidth", cl.Bandwidth)
+	v.nonNegative(field+".max_connections", cl.MaxConnections)
+}
+
+// validateAuth checks the auth mode, the tokens and the TLS files
+func validateAuth(v *validator, a AuthConfig) {
+	v.oneOf("storage.auth.mode", a.Mode, "off", "secure")
+
+	tokens := make(map[string]bool, len(a.Tokens))
+	for i, t := range a.Tokens {
+		field := fmt.Sprintf("storage.auth.tokens[%d]", i)
+		v.required(field+".identity", t.Identity)
+		v.required(field+".token", t.Token)
+		if t.Token != "" {
+			if tokens[t.Token] {
+				v.add(field+".token", "is the same as another token")
+			}
+			tokens[t.Token] = true
+		}
+	}
+
+	tls := a.TLS
+	if (tls.CertFile == "") != (tls.KeyFile == "") {
+		v.add("storage.auth.tls", "cert_file and key_file must be set together")
+	}
+	if tls.RequireClientCert && tls.ClientCAFile == "" {
+		v.add("storage.auth.tls.client_ca_file", "is required to verify client certificates")
+	}
+	if tls.ClientCAFile != "" && tls.CertFile == "" {
+		v.add("storage.auth.tls.cert_file", "is required for client_ca_file to take effect")
+	}
+}
+
+// validateACL checks that every rule names an identity, a namespace and
+// known operations
+func validateACL(v *validator, a ACLConfig) {
+	for i, rule := range a.Rules {
+		field := fmt.Sprintf("storage.acl.rules[%d]", i)
+		v.required(field+".identity", rule.Identity)
+		v.required(field+".namespace", rule.Namespace)
+		if len(rule.Operations) == 0 {
+			v.add(field+".operations", "is required")
+		}
+		for j, op := range rule.Operations {
+			v.oneOf(fmt.Sprintf("%s.operations[%d]", field, j), op, "read", "write", "delete", "admin")
+		}
+	}
+}
+
+// validateJobs checks the job concurrency and that schedule overrides
+// name known jobs
+func validateJobs(v *validator, j JobsConfig) {
+	v.positive("storage.jobs.max_concurrent", j.MaxConcurrent)
+	for name, jc := range j.Schedule {
+		field := "storage.jobs.schedule." + name
+		switch name {
+		case "scrub", "gc", "repair", "rebalance", "fsck", "usage", "usage-export", "dictionary", "dedup":
+		default:
+			v.add(field, "is not a job; jobs are scrub, gc, repair, rebalance, fsck, usage, usage-export, dictionary and dedup")
+		}
+		v.nonNegativeSize(field+".bandwidth", jc.Bandwidth)
+	}
+}
+
+// validateAudit checks the audit log's rotation settings
+func validateAudit(v *validator, a AuditConfig) {
+	v.nonNegativeSize("storage.audit.max_size", a.MaxSize)
+	v.nonNegative("storage.audit.max_files", a.MaxFiles)
+}
+
+// maxStripeWidth is the widest stripe the object layer accepts
+const maxStripeWidth = 64
+
+// validateGateway checks the gateway's address, buckets and credentials
+// when it is enabled
+func validateGateway(v *validator, g GatewayConfig) {
+	if g.ListenAddress == "" {
+		return
+	}
+	v.address("storage.gateway.listen_address", g.ListenAddress, false)
+	v.between("storage.gateway.stripe_width", g.StripeWidth, 0, maxStripeWidth)
+	validateMetadata(v, "storage.gateway.metadata", g.Metadata)
+	if len(g.Buckets) == 0 {
+		v.add("storage.gateway.buckets", "must list at least one bucket")
+	}
+	buckets := make(map[string]bool, len(g.Buckets))
+	for i, bucket := range g.Buckets {
+		field := fmt.Sprintf("storage.gateway.buckets[%d]", i)
+		if !validBucketName(bucket) {
+			v.add(field, "must be 3 to 63 lowercase letters, digits, dots and hyphens, starting and ending with a letter or digit, got %q", bucket)
+		}
+		if buckets[bucket] {
+			v.add(field, "lists bucket %s more than once", bucket)
+		}
+		buckets[bucket] = true
+	}
+
+	keys := make(map[string]bool, len(g.Credentials))
+	for i, c := range g.Credentials {
+		field := fmt.Sprintf("storage.gateway.credentials[%d]", i)
+		v.required(field+".access_key", c.AccessKey)
+		v.required(field+".secret_key", c.SecretKey)
+		if c.AccessKey != "" {
+			if keys[c.AccessKey] {
+				v.add(field+".access_key", "is the same as another access key")
+			}
+			keys[c.AccessKey] = true
+		}
+	}
+	if len(g.Credentials) == 0 && !g.Anonymous {
+		v.add("storage.gateway.credentials", "are required unless anonymous is set")
+	}
+}
+
+// validateMetadata checks the metadata service an object store uses
+func validateMetadata(v *validator, field string, m MetadataConfig) {
+	if m.Backend == "" {
+		return
+	}
+	v.oneOf(field+".backend", m.Backend, "embedded", "etcd")
+	if m.Backend == "etcd" && len(m.Endpoints) == 0 {
+		v.add(field+".endpoints", "is required when backend is etcd")
+	}
+}
+
+// validateGeoReplication checks the remote cluster and the namespaces
+// shipped to it when geo-replication is enabled
+func validateGeoReplication(v *validator, g GeoReplicationConfig) {
+	v.oneOf("storage.geo_replication.compression", g.Compression, "deflate", "none")
+	v.positive("storage.geo_replication.workers", g.Workers)
+	v.nonNegativeSize("storage.geo_replication.bandwidth", g.Bandwidth)
+	if len(g.Remote) == 0 {
+		return
+	}
+	for i, address := range g.Remote {
+		v.address(fmt.Sprintf("storage.geo_replication.remote[%d]", i), address, true)
+	}
+	if len(g.Namespaces) == 0 {
+		v.add("storage.geo_replication.namespaces", "must list at least one namespace")
+	}
+	for i, namespace := range g.Namespaces {
+		if !validNamespace(namespace) {
+			v.add(fmt.Sprintf("storage.geo_replication.namespaces[%d]", i), "is not a valid namespace name: letters, digits, '-', '_' and '.'")
+		}
+	}
+}
+
+// validateUsage checks the intervals and export sinks of usage accounting
+func validateUsage(v *validator, u UsageConfig) {
+	v.nonNegativeDuration("storage.usage.report_interval", u.ReportInterval)
+	v.nonNegativeDuration("storage.usage.window", u.Window)
+	if u.Retention < u.Window {
+		v.add("storage.usage.retention", "must be at least the window")
+	}
+	v.nonNegativeDuration("storage.usage.export.window", u.Export.Window)
+	v.nonNegativeDuration("storage.usage.export.interval", u.Export.Interval)
+	if u.Window > 0 && u.Export.Window%u.Window != 0 {
+		v.add("storage.usage.export.window", "must be a multiple of storage.usage.window")
+	}
+	if u.Export.Webhook != "" {
+		if parsed, err := url.Parse(u.Export.Webhook); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			v.add("storage.usage.export.webhook", "must be an http or https URL")
+		}
+	}
+}
+
+// validateEvents checks the sinks of cluster events
+func validateEvents(v *validator, e EventsConfig) {
+	v.positive("storage.events.buffer", e.Buffer)
+	for i, sink := range e.Sinks {
+		field := fmt.Sprintf("storage.events.sinks[%d]", i)
+		v.oneOf(field+".type", sink.Type, "webhook", "kafka", "nats")
+		schemes := []string{"http", "https"}
+		if sink.Type == "nats" {
+			schemes = []string{"nats"}
+		}
+		if parsed, err := url.Parse(sink.URL); err != nil || !slices.Contains(schemes, parsed.Scheme) || parsed.Host == "" {
+			v.add(field+".url", "must be a %s URL", strings.Join(schemes, " or "))
+		}
+		if sink.Type == "kafka" {
+			v.required(field+".topic", sink.Topic)
+		}
+		for _, event := range sink.Events {
+			v.oneOf(field+".events", event, "node.failed", "chain.reconfigured", "block.corrupted", "quota.breached", "drain.completed")
+		}
+	}
+}
+
+// validateCDC checks the bounds of the change log
+func validateCDC(v *validator, c CDCConfig) {
+	v.nonNegativeDuration("storage.cdc.retention", c.Retention)
+	v.nonNegativeSize("storage.cdc.max_size", c.MaxSize)
+}
+
+// validateCache checks the sizes of a cache node's tiers. A cache node
+// finds the chains it serves, and the nodes whose change logs it follows,
+// in the coordinator's routing table.
+func validateCache(v *validator, s *StorageConfig) {
+	c := s.Cache
+	v.nonNegativeSize("storage.cache.memory_size", c.MemorySize)
+	v.nonNegativeSize("storage.cache.disk_size", c.DiskSize)
+	v.nonNegativeDuration("storage.cache.max_age", c.MaxAge)
+	if s.Node.Role != "cache" {
+		return
+	}
+	if len(s.Coordinator.Addresses) == 0 {
+		v.add("storage.coordinator.addresses", "is required on a cache node")
+	}
+	if s.Coordinator.Enabled {
+		v.add("storage.coordinator.enabled", "must be false on a cache node, which holds no replicas")
+	}
+}
+
+// validateWriteBack checks the bounds of the write-back buffer
+func validateWriteBack(v *validator, w WriteBackConfig) {
+	v.nonNegativeSize("storage.write_back.max_size", w.MaxSize)
+	v.nonNegativeSize("storage.write_back.max_block_size", w.MaxBlockSize)
+	if w.MaxBlockSize > w.MaxSize {
+		v.add("storage.write_back.max_block_size", "must not exceed max_size (%s), got %s", w.MaxSize, w.MaxBlockSize)
+	}
+	v.nonNegative("storage.write_back.batch_size", w.BatchSize)
+	v.nonNegativeDuration("storage.write_back.flush_interval", w.FlushInterval)
+}
+
+// validateCompression checks the sizes of dictionary training
+func validateCompression(v *validator, c CompressionConfig) {
+	v.nonNegativeSize("storage.compression.max_block_size", c.MaxBlockSize)
+	v.nonNegativeSize("storage.compression.dictionary_size", c.DictionarySize)
+	v.nonNegativeSize("storage.compression.sample_size", c.SampleSize)
+	if c.SampleSize < c.DictionarySize {
+		v.add("storage.compression.sample_size", "must be at least dictionary_size (%s), got %s", c.DictionarySize, c.SampleSize)
+	}
+	v.nonNegative("storage.compression.min_samples", c.MinSamples)
+	for i, ns := range c.Namespaces {
+		if ns == "" {
+			v.add(fmt.Sprintf("storage.compression.namespaces[%d]", i), "must not be empty")
+		}
+	}
+}
+
+// validBucketName reports whether a name follows the S3 bucket naming
+// rules, which also make it a valid block namespace
+func validBucketName(name string) bool {
+	if len(name) < 3 || len(name) > 63 {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case (c == '-' || c == '.') && i > 0 && i < len(name)-1:
+		default:
+			return false
+		}
+	}
+	return !strings.Contains(name, "..")
+}
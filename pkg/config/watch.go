@@ -0,0 +1,290 @@
+package config
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultWatchInterval is how often a watcher reads a configuration source
+// that cannot be watched
+const DefaultWatchInterval = 10 * time.Second
+
+// immutableFields are the fields a running node cannot change: they
+// identify the node and its data, so a reload changing them is rejected
+var immutableFields = []string{
+	"storage.node.id",
+	"storage.local.data_path",
+	"storage.local.targets",
+}
+
+// Change is a field whose value differs between two configurations
+type Change struct {
+	// Path is the field's path in the configuration file, such as
+	// storage.tuning.cache_size
+	Path string
+	Old  interface{}
+	New  interface{}
+	// Secret marks fields holding secrets, whose values are never logged
+	Secret bool
+}
+
+// String describes the change for logs
+func (c Change) String() string {
+	if c.Secret {
+		return c.Path + ": changed"
+	}
+	return fmt.Sprintf("%s: %v -> %v", c.Path, c.Old, c.New)
+}
+
+// Diff returns the fields that differ between two configurations, in the
+// order of the fields. Lists and maps are compared as a whole; empty and
+// missing ones are equal.
+func Diff(old, new *Config) []Change {
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+
+	changes := make([]Change, 0)
+	walkFields(oldValue.Type(), func(path string, index []int) {
+		a := oldValue.FieldByIndex(index)
+		b := newValue.FieldByIndex(index)
+		if equalField(a, b) {
+			return
+		}
+		field := oldValue.Type().FieldByIndex(index)
+		changes = append(changes, Change{
+			Path:   path,
+			Old:    a.Interface(),
+			New:    b.Interface(),
+			Secret: field.Tag.Get("secret") == "true" || hasSecrets(field.Type),
+		})
+	})
+	return changes
+}
+
+// equalField compares two values of a field
+func equalField(a, b reflect.Value) bool {
+	switch a.Kind() {
+	case reflect.Slice, reflect.Map:
+		if a.Len() == 0 && b.Len() == 0 {
+			return true
+		}
+	}
+	return reflect.DeepEqual(a.Interface(), b.Interface())
+}
+
+// matchesPath reports whether a field path is prefix or lies within it
+func matchesPath(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+".")
+}
+
+// ImmutableFieldError reports a reload that changes fields a running node
+// cannot change
+type ImmutableFieldError struct {
+	Fields []string
+}
+
+// Error lists the fields
+func (e *ImmutableFieldError) Error() string {
+	return fmt.Sprintf("cannot change %s without a restart", strings.Join(e.Fields, ", "))
+}
+
+// ReloadHook applies changed fields to a running subsystem. It is given
+// the previous and the new configuration and the changes it registered
+// for. An error leaves the subsystem as it was.
+type ReloadHook func(old, new *Config, changes []Change) error
+
+// reloadHook is a hook and the fields it applies
+type reloadHook struct {
+	name     string
+	prefixes []string
+	fn       ReloadHook
+}
+
+// Watcher reloads a configuration when its source changes. Every reload
+// is loaded like the configuration was on start, with the environment
+// overrides and validation, and the fields that changed are handed to the
+// hooks registered for them. Changes no hook applies take effect on
+// restart.
+type Watcher struct {
+	source   Source
+	interval time.Duration
+	logger   *slog.Logger
+
+	mu      sync.Mutex
+	current *Config
+	digest  [sha256.Size]byte
+	hooks   []reloadHook
+}
+
+// NewWatcher creates a watcher for the source current was loaded from. A
+// zero interval uses DefaultWatchInterval.
+func NewWatcher(source Source, current *Config, interval time.Duration, logger *slog.Logger) *Watcher {
+	if interval <= 0 {
+		interval = DefaultWatchInterval
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+
+	return &Watcher{
+		source:   source,
+		interval: interval,
+		logger:   logger,
+		current:  current,
+	}
+}
+
+// OnChange registers a hook for the fields at or below the given paths,
+// such as storage.limits or storage.tuning.cache_size. Hooks run in the
+// order they were registered.
+func (w *Watcher) OnChange(name string, hook ReloadHook, paths ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.hooks = append(w.hooks, reloadHook{name: name, prefixes: paths, fn: hook})
+}
+
+// Current returns the configuration last applied
+func (w *Watcher) Current() *Config {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.current
+}
+
+// Reload reads the source and applies the fields that changed. A
+// configuration that fails to load or validate, or that changes an
+// immutable field, is rejected as a whole. If a hook fails, the other hooks
+// are still run and the configuration is not recorded as applied, so the
+// next reload retries the failed changes.
+func (w *Watcher) Reload(ctx context.Context) ([]Change, error) {
+	doc, err := readDocument(ctx, w.source)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reload config: %w", err)
+	}
+	return w.apply(doc)
+}
+
+// apply applies a document read from the source
+func (w *Watcher) apply(doc *document) ([]Change, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.digest = doc.digest
+	next, err := doc.load()
+	if err != nil {
+		return nil, fmt.Errorf("failed to reload config: %w", err)
+	}
+	for _, warning := range next.Warnings() {
+		w.logger.Warn("configuration upgraded", "change", warning)
+	}
+
+	changes := Diff(w.current, next)
+	if len(changes) == 0 {
+		return changes, nil
+	}
+
+	var immutable []string
+	for _, change := range changes {
+		for _, field := range immutableFields {
+			if matchesPath(change.Path, field) {
+				immutable = append(immutable, change.Path)
+			}
+		}
+	}
+	if len(immutable) > 0 {
+		return changes, fmt.Errorf("failed to reload config: %w", &ImmutableFieldError{Fields: immutable})
+	}
+
+	applied := make(map[string]bool)
+	var errs []string
+	for _, hook := range w.hooks {
+		matched := make([]Change, 0)
+		for _, change := range changes {
+			for _, prefix := range hook.prefixes {
+				if matchesPath(change.Path, prefix) {
+					matched = append(matched, change)
+					applied[change.Path] = true
+					break
+				}
+			}
+		}
+		if len(matched) == 0 {
+			continue
+		}
+		if err := hook.fn(w.current, next, matched); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", hook.name, err))
+		}
+	}
+
+	for _, change := range changes {
+		if applied[change.Path] && change.Secret {
+			w.logger.Info("config changed", "field", change.Path)
+		} else if applied[change.Path] {
+			w.logger.Info("config changed", "field", change.Path, "old", change.Old, "new", change.New)
+		} else {
+			w.logger.Warn("config change takes effect on restart", "field", change.Path)
+		}
+	}
+
+	if len(errs) > 0 {
+		return changes, fmt.Errorf("failed to apply config changes: %s", strings.Join(errs, "; "))
+	}
+	w.current = next
+	return changes, nil
+}
+
+// Run watches the source until ctx is cancelled, reloading the
+// configuration when its content changes. Sources that can wait for a
+// change, such as etcd and Consul keys, are watched; others are read every
+// interval, as are waiting sources whose watch fails. Failed reloads are
+// logged and the previous configuration stays in effect.
+func (w *Watcher) Run(ctx context.Context) {
+	waiter, _ := w.source.(Waiter)
+	for {
+		wait := waiter == nil
+		if waiter != nil {
+			if err := waiter.Wait(ctx); err != nil && ctx.Err() == nil {
+				w.logger.Warn("config watch failed", "source", w.source.String(), "error", err)
+				wait = true
+			}
+		}
+		if wait {
+			select {
+			case <-ctx.Done():
+			case <-time.After(w.interval):
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		doc, err := readDocument(ctx, w.source)
+		if err != nil {
+			w.logger.Error("config reload failed", "source", w.source.String(), "error", err)
+			continue
+		}
+		if !w.changed(doc) {
+			continue
+		}
+		if _, err := w.apply(doc); err != nil {
+			w.logger.Error("config reload failed", "source", w.source.String(), "error", err)
+		}
+	}
+}
+
+// changed reports whether a document, or one it includes, differs from
+// the last one applied, so that a file that was touched but not edited is
+// not reloaded
+func (w *Watcher) changed(doc *document) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return doc.digest != w.digest
+}
@@ -0,0 +1,384 @@
+// Package kv is a key-value store kept in blocks, for workloads of many
+// small values, such as metadata, that would waste a block each. Keys are
+// hashed into a fixed number of shards, and each shard is one block
+// holding its entries sorted by key behind an index. Values larger than
+// the store's inline limit are kept in blocks of their own, which the
+// shard's entry points to, so that shards stay small.
+//
+// A store is reached through any block API, such as a client of one node
+// or of a whole cluster. Writes to one shard are serialised within a
+// Store, which rewrites the shard's block; processes writing to the same
+// store must coordinate between themselves, as the last to write a shard
+// wins.
+package kv
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/3fs-storage/pkg/api"
+)
+
+// Format identifies a store's metadata block
+const Format = "3fs-kv/1"
+
+const (
+	// DefaultShards is the number of shards of a store created without one
+	DefaultShards = 64
+	// DefaultInlineLimit is the largest value kept in its shard by default
+	DefaultInlineLimit = 4 << 10
+	// DefaultMaxShardSize is the size a shard's block may grow to by
+	// default
+	DefaultMaxShardSize = 4 << 20
+	// MaxKeyLength is the longest key a store accepts
+	MaxKeyLength = 1024
+)
+
+var (
+	// ErrNotFound is returned for a key the store does not hold
+	ErrNotFound = errors.New("key not found")
+	// ErrNoStore is returned when opening a store that does not exist
+	ErrNoStore = errors.New("key-value store does not exist")
+	// ErrExists is returned when creating a store that already exists
+	ErrExists = errors.New("key-value store already exists")
+	// ErrShardFull is returned for a write that would grow a shard past
+	// the store's maximum shard size
+	ErrShardFull = errors.New("shard is full")
+)
+
+// Blocks is the block API a store is kept in, which both client.Client
+// and client.Cluster provide
+type Blocks interface {
+	Read(ctx context.Context, blockID string) ([]byte, error)
+	Write(ctx context.Context, blockID string, data []byte) error
+	Delete(ctx context.Context, blockID string) error
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+// Options configures a store when it is created; they are kept with it,
+// so that every client of the store shards its keys alike
+type Options struct {
+	// Shards is the number of shards keys are hashed into
+	Shards int `json:"shards"`
+	// InlineLimit is the largest value kept in its shard's block
+	InlineLimit int `json:"inline_limit"`
+	// MaxShardSize is the size a shard's block may grow to
+	MaxShardSize int `json:"max_shard_size"`
+}
+
+// meta is the content of a store's metadata block
+type meta struct {
+	Format    string `json:"format"`
+	CreatedAt int64  `json:"created_at"`
+	Options
+}
+
+// Entry is a key and its value
+type Entry struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Store is a key-value store kept in blocks. Its blocks are named after
+// the store, so a store named in a namespace shares that namespace's ACL
+// and replication.
+type Store struct {
+	blocks Blocks
+	name   string
+	opts   Options
+	// locks serialise the writes to each shard
+	locks []sync.Mutex
+}
+
+// Create creates a store named name, writing its empty shards
+func Create(ctx context.Context, blocks Blocks, name string, opts Options) (*Store, error) {
+	if opts.Shards <= 0 {
+		opts.Shards = DefaultShards
+	}
+	if opts.InlineLimit <= 0 {
+		opts.InlineLimit = DefaultInlineLimit
+	}
+	if opts.MaxShardSize <= 0 {
+		opts.MaxShardSize = DefaultMaxShardSize
+	}
+	if opts.MaxShardSize > api.MaxDataSize {
+		return nil, fmt.Errorf("maximum shard size cannot exceed %d bytes", api.MaxDataSize)
+	}
+	s, err := newStore(blocks, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	if exists, err := s.exists(ctx); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, fmt.Errorf("%w: %s", ErrExists, name)
+	}
+
+	// The metadata block is written last, so that a store is only found
+	// once all its shards are
+	empty := (&shard{}).encode()
+	for i := 0; i < opts.Shards; i++ {
+		if err := blocks.Write(ctx, s.shardBlockID(i), empty); err != nil {
+			return nil, fmt.Errorf("failed to write shard %d: %w", i, err)
+		}
+	}
+	data, err := json.Marshal(meta{Format: Format, CreatedAt: time.Now().UnixNano(), Options: opts})
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode store metadata: %w", err)
+	}
+	if err := blocks.Write(ctx, s.metaBlockID(), data); err != nil {
+		return nil, fmt.Errorf("failed to write store metadata: %w", err)
+	}
+	return s, nil
+}
+
+// Open opens the store named name
+func Open(ctx context.Context, blocks Blocks, name string) (*Store, error) {
+	s, err := newStore(blocks, name, Options{})
+	if err != nil {
+		return nil, err
+	}
+	data, err := blocks.Read(ctx, s.metaBlockID())
+	if err != nil {
+		if errors.Is(err, api.ErrNotFound) {
+			return nil, fmt.Errorf("%w: %s", ErrNoStore, name)
+		}
+		if exists, listErr := s.exists(ctx); listErr == nil && !exists {
+			return nil, fmt.Errorf("%w: %s", ErrNoStore, name)
+		}
+		return nil, fmt.Errorf("failed to read store metadata: %w", err)
+	}
+	var m meta
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("failed to decode store metadata: %w", err)
+	}
+	if m.Format != Format {
+		return nil, fmt.Errorf("%s is not a key-value store", name)
+	}
+	if m.Shards <= 0 || m.InlineLimit <= 0 || m.MaxShardSize <= 0 {
+		return nil, fmt.Errorf("invalid store metadata: %d shards", m.Shards)
+	}
+	return newStore(blocks, name, m.Options)
+}
+
+// newStore checks a store's name and sets up its locks
+func newStore(blocks Blocks, name string, opts Options) (*Store, error) {
+	if blocks == nil {
+		return nil, errors.New("block API cannot be nil")
+	}
+	s := &Store{blocks: blocks, name: name, opts: opts, locks: make([]sync.Mutex, opts.Shards)}
+	if err := api.ValidateBlockID(s.spillBlockID(strings.Repeat("0", 32))); err != nil {
+		return nil, fmt.Errorf("invalid store name: %w", err)
+	}
+	return s, nil
+}
+
+// Options returns the options the store was created with
+func (s *Store) Options() Options {
+	return s.opts
+}
+
+// metaBlockID returns the ID of the store's metadata block
+func (s *Store) metaBlockID() string {
+	return s.name + ".kv"
+}
+
+// shardBlockID returns the ID of a shard's block
+func (s *Store) shardBlockID(i int) string {
+	return fmt.Sprintf("%s.kv.%04x", s.name, i)
+}
+
+// spillBlockID returns the ID of a block holding a value too large for
+// its shard
+func (s *Store) spillBlockID(nonce string) string {
+	return s.name + ".kv.v." + nonce
+}
+
+// exists reports whether the store's metadata block exists
+func (s *Store) exists(ctx context.Context) (bool, error) {
+	ids, err := s.blocks.List(ctx, s.metaBlockID())
+	if err != nil {
+		return false, fmt.Errorf("failed to list blocks: %w", err)
+	}
+	return slices.Contains(ids, s.metaBlockID()), nil
+}
+
+// shardOf returns the shard a key is hashed into
+func (s *Store) shardOf(key string) int {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return int(h.Sum64() % uint64(s.opts.Shards))
+}
+
+// readShard reads and decodes a shard
+func (s *Store) readShard(ctx context.Context, i int) (*shard, error) {
+	data, err := s.blocks.Read(ctx, s.shardBlockID(i))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read shard %d: %w", i, err)
+	}
+	sh, err := decodeShard(data)
+	if err != nil {
+		return nil, fmt.Errorf("shard %d: %w", i, err)
+	}
+	return sh, nil
+}
+
+// value returns an entry's value, reading it from its own block if it
+// was spilled
+func (s *Store) value(ctx context.Context, e entry) ([]byte, error) {
+	if !e.spilled {
+		return e.value, nil
+	}
+	data, err := s.blocks.Read(ctx, string(e.value))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the value of %q: %w", e.key, err)
+	}
+	return data, nil
+}
+
+// checkKey checks that a key can be stored
+func checkKey(key string) error {
+	if key == "" {
+		return errors.New("key cannot be empty")
+	}
+	if len(key) > MaxKeyLength {
+		return fmt.Errorf("key longer than %d bytes", MaxKeyLength)
+	}
+	return nil
+}
+
+// Get returns the value of key
+func (s *Store) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	sh, err := s.readShard(ctx, s.shardOf(key))
+	if err != nil {
+		return nil, err
+	}
+	i, ok := sh.find(key)
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, key)
+	}
+	return s.value(ctx, sh.entries[i])
+}
+
+// Put sets the value of key. A value larger than the inline limit is
+// written to a block of its own before the shard points to it, and the
+// block of the value it replaces is deleted after.
+func (s *Store) Put(ctx context.Context, key string, value []byte) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	i := s.shardOf(key)
+	s.locks[i].Lock()
+	defer s.locks[i].Unlock()
+
+	sh, err := s.readShard(ctx, i)
+	if err != nil {
+		return err
+	}
+	e := entry{key: key, value: value}
+	if len(value) > s.opts.InlineLimit {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return fmt.Errorf("failed to generate nonce: %w", err)
+		}
+		spillID := s.spillBlockID(hex.EncodeToString(nonce))
+		if err := s.blocks.Write(ctx, spillID, value); err != nil {
+			return fmt.Errorf("failed to write the value of %q: %w", key, err)
+		}
+		e = entry{key: key, value: []byte(spillID), spilled: true}
+	}
+
+	old, replaced := sh.set(e)
+	if size := sh.encodedSize(); size > s.opts.MaxShardSize {
+		s.discard(ctx, e)
+		return fmt.Errorf("%w: shard %d would grow to %d bytes", ErrShardFull, i, size)
+	}
+	if err := s.blocks.Write(ctx, s.shardBlockID(i), sh.encode()); err != nil {
+		s.discard(ctx, e)
+		return fmt.Errorf("failed to write shard %d: %w", i, err)
+	}
+	if replaced {
+		s.discard(ctx, old)
+	}
+	return nil
+}
+
+// Delete removes key from the store. Deleting a key that is not there is
+// not an error.
+func (s *Store) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	i := s.shardOf(key)
+	s.locks[i].Lock()
+	defer s.locks[i].Unlock()
+
+	sh, err := s.readShard(ctx, i)
+	if err != nil {
+		return err
+	}
+	old, ok := sh.remove(key)
+	if !ok {
+		return nil
+	}
+	if err := s.blocks.Write(ctx, s.shardBlockID(i), sh.encode()); err != nil {
+		return fmt.Errorf("failed to write shard %d: %w", i, err)
+	}
+	s.discard(ctx, old)
+	return nil
+}
+
+// discard deletes the block of a spilled value no shard points to. A
+// failure leaves the block behind, unreferenced, which only costs space.
+func (s *Store) discard(ctx context.Context, e entry) {
+	if e.spilled {
+		s.blocks.Delete(ctx, string(e.value))
+	}
+}
+
+// Scan returns the entries with keys starting with prefix, sorted by key,
+// and at most limit of them unless limit is zero. As keys are hashed
+// across shards, a scan reads every shard.
+func (s *Store) Scan(ctx context.Context, prefix string, limit int) ([]Entry, error) {
+	var matches []entry
+	for i := 0; i < s.opts.Shards; i++ {
+		sh, err := s.readShard(ctx, i)
+		if err != nil {
+			return nil, err
+		}
+		start, _ := sh.find(prefix)
+		for _, e := range sh.entries[start:] {
+			if !strings.HasPrefix(e.key, prefix) {
+				break
+			}
+			matches = append(matches, e)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool { return matches[i].key < matches[j].key })
+	if limit > 0 && len(matches) > limit {
+		matches = matches[:limit]
+	}
+
+	entries := make([]Entry, len(matches))
+	for i, e := range matches {
+		value, err := s.value(ctx, e)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = Entry{Key: e.key, Value: value}
+	}
+	return entries, nil
+}
@@ -0,0 +1,154 @@
+package kv
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// shardMagic starts every shard block ("3KV1")
+const shardMagic uint32 = 0x334b5631
+
+// flagSpilled marks an entry whose value is kept in a block of its own,
+// the entry's value then being that block's ID
+const flagSpilled uint8 = 1
+
+// entry is one key of a shard. The value of a spilled entry is the ID of
+// the block holding it.
+type entry struct {
+	key     string
+	value   []byte
+	spilled bool
+}
+
+// shard is the sorted entries of a shard block
+type shard struct {
+	entries []entry
+}
+
+// find returns the index of key in the shard, or where it would be
+// inserted, and whether it is present
+func (s *shard) find(key string) (int, bool) {
+	i := sort.Search(len(s.entries), func(i int) bool { return s.entries[i].key >= key })
+	return i, i < len(s.entries) && s.entries[i].key == key
+}
+
+// set adds or replaces an entry, returning the entry it replaced
+func (s *shard) set(e entry) (entry, bool) {
+	i, ok := s.find(e.key)
+	if ok {
+		old := s.entries[i]
+		s.entries[i] = e
+		return old, true
+	}
+	s.entries = append(s.entries, entry{})
+	copy(s.entries[i+1:], s.entries[i:])
+	s.entries[i] = e
+	return entry{}, false
+}
+
+// remove removes an entry, returning it
+func (s *shard) remove(key string) (entry, bool) {
+	i, ok := s.find(key)
+	if !ok {
+		return entry{}, false
+	}
+	old := s.entries[i]
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	return old, true
+}
+
+// Layout of a shard block, all integers big-endian:
+//
+//	magic   uint32
+//	count   uint32
+//	index   count × (key length uint16, key, flags uint8, offset uint32, length uint32)
+//	values  the values, at their offsets from the start of this section
+//
+// The index lets a lookup find a value without decoding the others.
+
+// indexEntrySize is the size of an index entry without its key
+const indexEntrySize = 2 + 1 + 4 + 4
+
+// encodedSize returns the size of the shard's block
+func (s *shard) encodedSize() int {
+	size := 8
+	for _, e := range s.entries {
+		size += indexEntrySize + len(e.key) + len(e.value)
+	}
+	return size
+}
+
+// encode returns the shard's block
+func (s *shard) encode() []byte {
+	buf := make([]byte, 8, s.encodedSize())
+	binary.BigEndian.PutUint32(buf[0:4], shardMagic)
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(s.entries)))
+	var offset uint32
+	for _, e := range s.entries {
+		var flags uint8
+		if e.spilled {
+			flags = flagSpilled
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(e.key)))
+		buf = append(buf, e.key...)
+		buf = append(buf, flags)
+		buf = binary.BigEndian.AppendUint32(buf, offset)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(e.value)))
+		offset += uint32(len(e.value))
+	}
+	for _, e := range s.entries {
+		buf = append(buf, e.value...)
+	}
+	return buf
+}
+
+// errCorruptShard is returned for a shard block that cannot be decoded
+var errCorruptShard = errors.New("corrupt shard block")
+
+// decodeShard decodes a shard block. The entries' values share the
+// block's memory.
+func decodeShard(data []byte) (*shard, error) {
+	if len(data) < 8 || binary.BigEndian.Uint32(data[0:4]) != shardMagic {
+		return nil, errCorruptShard
+	}
+	count := int(binary.BigEndian.Uint32(data[4:8]))
+	type location struct{ offset, length uint32 }
+	s := &shard{entries: make([]entry, 0, min(count, len(data)/indexEntrySize))}
+	locations := make([]location, 0, cap(s.entries))
+	pos := 8
+	for i := 0; i < count; i++ {
+		if len(data)-pos < 2 {
+			return nil, errCorruptShard
+		}
+		keyLen := int(binary.BigEndian.Uint16(data[pos:]))
+		pos += 2
+		if len(data)-pos < keyLen+indexEntrySize-2 {
+			return nil, errCorruptShard
+		}
+		e := entry{key: string(data[pos : pos+keyLen])}
+		pos += keyLen
+		e.spilled = data[pos]&flagSpilled != 0
+		pos++
+		locations = append(locations, location{
+			offset: binary.BigEndian.Uint32(data[pos:]),
+			length: binary.BigEndian.Uint32(data[pos+4:]),
+		})
+		pos += 8
+		s.entries = append(s.entries, e)
+	}
+
+	values := data[pos:]
+	for i, loc := range locations {
+		end := uint64(loc.offset) + uint64(loc.length)
+		if end > uint64(len(values)) {
+			return nil, fmt.Errorf("%w: value of %q out of range", errCorruptShard, s.entries[i].key)
+		}
+		s.entries[i].value = values[loc.offset:end:end]
+		if i > 0 && s.entries[i-1].key >= s.entries[i].key {
+			return nil, fmt.Errorf("%w: keys out of order", errCorruptShard)
+		}
+	}
+	return s, nil
+}